@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAccessLogMaxSizeMB  = 100
+	defaultAccessLogMaxBackups = 5
+
+	accessLogFlushInterval = time.Second
+	accessLogBufferSize    = 64 << 10
+	backupTimeFormat       = "20060102T150405.000"
+)
+
+// accessLog writes the per-request lines from loggingMiddleware. It is the
+// standard logger until setupAccessLog points it at ACCESS_LOG_PATH.
+var accessLog = log.Default()
+
+// rotatingFile is an append-only log file that rotates itself once it would
+// grow past maxSize: the current file is renamed to name-<timestamp>.ext and
+// a new one started, keeping at most maxBackups old files, none older than
+// maxAge (0 keeps them regardless of age). Writes are buffered; Flush, or the
+// background flush every second, writes them out.
+//
+// A write the file refuses, e.g. on a full disk, goes to fallback (stderr)
+// instead, with a warning the first time, until a later rotation or Reopen
+// gets the file working again.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	maxAge     time.Duration
+	fallback   io.Writer
+
+	mu     sync.Mutex
+	file   *os.File
+	buf    *bufio.Writer
+	size   int64
+	failed bool
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int, maxAge time.Duration) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups, maxAge: maxAge, fallback: os.Stderr}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open starts writing to path, appending to whatever is already there.
+// f.mu must be held, except from openRotatingFile.
+func (f *rotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size, f.failed = file, info.Size(), false
+	f.buf = bufio.NewWriterSize(file, accessLogBufferSize)
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			f.fail(err)
+		}
+	}
+	if f.file == nil || f.failed {
+		return f.fallback.Write(p)
+	}
+	n, err := f.buf.Write(p)
+	f.size += int64(n)
+	if err != nil {
+		f.fail(err)
+		return f.fallback.Write(p[n:])
+	}
+	return n, nil
+}
+
+// fail switches to the fallback, warning there once per failure.
+func (f *rotatingFile) fail(err error) {
+	if !f.failed {
+		fmt.Fprintf(f.fallback, "⚠️ Access log %s failed, writing to stderr instead: %v\n", f.path, err)
+	}
+	f.failed = true
+}
+
+// rotate closes the current file, moves it aside, and opens a new one.
+func (f *rotatingFile) rotate() error {
+	f.closeFile()
+	backup := f.backupName(time.Now().UTC())
+	if err := os.Rename(f.path, backup); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.prune()
+	return nil
+}
+
+// backupName is where the current file goes when rotated at t:
+// access.log becomes access-20240501T120000.000.log.
+func (f *rotatingFile) backupName(t time.Time) string {
+	ext := filepath.Ext(f.path)
+	return strings.TrimSuffix(f.path, ext) + "-" + t.Format(backupTimeFormat) + ext
+}
+
+// prune removes the backups past maxBackups or older than maxAge.
+func (f *rotatingFile) prune() {
+	ext := filepath.Ext(f.path)
+	prefix := strings.TrimSuffix(f.path, ext) + "-"
+	matches, err := filepath.Glob(prefix + "*" + ext)
+	if err != nil {
+		return
+	}
+	type backup struct {
+		path string
+		at   time.Time
+	}
+	var backups []backup
+	for _, m := range matches {
+		at, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(m, prefix), ext))
+		if err != nil {
+			continue // not one of ours
+		}
+		backups = append(backups, backup{m, at})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].at.After(backups[j].at) })
+	for i, b := range backups {
+		if (f.maxBackups > 0 && i >= f.maxBackups) || (f.maxAge > 0 && time.Since(b.at) > f.maxAge) {
+			os.Remove(b.path)
+		}
+	}
+}
+
+// closeFile flushes and closes the current file, if any.
+func (f *rotatingFile) closeFile() {
+	if f.file == nil {
+		return
+	}
+	if err := f.buf.Flush(); err != nil {
+		f.fail(err)
+	}
+	f.file.Close()
+	f.file = nil
+}
+
+// Reopen closes the file and opens path afresh, for logrotate having moved
+// it away.
+func (f *rotatingFile) Reopen() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closeFile()
+	if err := f.open(); err != nil {
+		f.fail(err)
+		return err
+	}
+	return nil
+}
+
+// Flush writes out the buffered lines.
+func (f *rotatingFile) Flush() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil && !f.failed {
+		if err := f.buf.Flush(); err != nil {
+			f.fail(err)
+		}
+	}
+}
+
+// Close flushes and closes the file; later writes go to the fallback.
+func (f *rotatingFile) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closeFile()
+}
+
+// setupAccessLog sends the access log to ACCESS_LOG_PATH, formatted like the
+// application log, and flushes it every second. It returns the file so main
+// can reopen it on SIGUSR1 and close it at shutdown, or nil when the access
+// log stays with the application log.
+func setupAccessLog(cfg *Config) (*rotatingFile, error) {
+	if cfg.AccessLogPath == "" {
+		return nil, nil
+	}
+	f, err := openRotatingFile(cfg.AccessLogPath, int64(cfg.AccessLogMaxSizeMB)<<20, cfg.AccessLogMaxBackups, cfg.AccessLogMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.LogFormat == "json" {
+		accessLog = log.New(jsonLogWriter{out: f}, "", 0)
+	} else {
+		accessLog = log.New(f, "", log.LstdFlags)
+	}
+	go func() {
+		for range time.Tick(accessLogFlushInterval) {
+			f.Flush()
+		}
+	}()
+	return f, nil
+}
+
+// watchAccessLogReopens reopens the access log on every signal from usr1.
+func watchAccessLogReopens(f *rotatingFile, usr1 <-chan os.Signal) {
+	for range usr1 {
+		if err := f.Reopen(); err != nil {
+			log.Printf("🔥 Failed to reopen access log: %v", err)
+			continue
+		}
+		log.Printf("📜 Reopened access log %s", f.path)
+	}
+}
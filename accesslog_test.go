@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRotatingFile opens a rotatingFile in a fresh directory, with its
+// fallback going to the returned buffer.
+func testRotatingFile(t *testing.T, maxSize int64, maxBackups int, maxAge time.Duration) (*rotatingFile, *bytes.Buffer) {
+	t.Helper()
+	f, err := openRotatingFile(filepath.Join(t.TempDir(), "logs", "access.log"), maxSize, maxBackups, maxAge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(f.Close)
+	var fallback bytes.Buffer
+	f.fallback = &fallback
+	return f, &fallback
+}
+
+// backups lists f's rotated files, oldest first.
+func backups(t *testing.T, f *rotatingFile) []string {
+	t.Helper()
+	matches, err := filepath.Glob(strings.TrimSuffix(f.path, ".log") + "-*.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestAccessLogRotation(t *testing.T) {
+	f, fallback := testRotatingFile(t, 100, 2, 0)
+	line := func(i int) string { return "GET /albums " + strings.Repeat(string(rune('a'+i)), 47) + "\n" }
+
+	for i := 0; i < 5; i++ {
+		// Backups are named to the millisecond.
+		time.Sleep(2 * time.Millisecond)
+		if _, err := f.Write([]byte(line(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Flush()
+
+	// Two 60-byte lines don't fit in 100 bytes, so each line after the
+	// first started a new file, and only the last two backups were kept.
+	if got := readFile(t, f.path); got != line(4) {
+		t.Errorf("access.log holds %q, want the last line", got)
+	}
+	files := backups(t, f)
+	if len(files) != 2 {
+		t.Fatalf("%d backups, want 2: %v", len(files), files)
+	}
+	for i, path := range files {
+		if got := readFile(t, path); got != line(i+2) {
+			t.Errorf("%s holds %q, want %q", filepath.Base(path), got, line(i+2))
+		}
+	}
+	if fallback.Len() != 0 {
+		t.Errorf("wrote to the fallback: %s", fallback)
+	}
+
+	// A line longer than the limit still goes in the file, alone.
+	time.Sleep(2 * time.Millisecond)
+	long := strings.Repeat("x", 150) + "\n"
+	f.Write([]byte(long))
+	f.Flush()
+	if got := readFile(t, f.path); got != long {
+		t.Errorf("access.log holds %q, want the long line alone", got)
+	}
+}
+
+func TestAccessLogPruneByAge(t *testing.T) {
+	f, _ := testRotatingFile(t, 10, 0, 24*time.Hour)
+	dir := filepath.Dir(f.path)
+	old := f.backupName(time.Now().Add(-48 * time.Hour).UTC())
+	recent := f.backupName(time.Now().Add(-time.Hour).UTC())
+	notOurs := filepath.Join(dir, "access-notes.log")
+	for _, path := range []string{old, recent, notOurs} {
+		if err := os.WriteFile(path, []byte("x\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f.Write([]byte("first line\n"))
+	f.Write([]byte("second line\n"))
+	for path, want := range map[string]bool{old: false, recent: true, notOurs: true} {
+		if _, err := os.Stat(path); (err == nil) != want {
+			t.Errorf("%s exists: %v, want %v", filepath.Base(path), err == nil, want)
+		}
+	}
+	if n := len(backups(t, f)); n != 3 {
+		t.Errorf("%d backups, want the recent one, the one just rotated, and access-notes.log", n)
+	}
+}
+
+func TestAccessLogReopen(t *testing.T) {
+	f, _ := testRotatingFile(t, 1<<20, 0, 0)
+	f.Write([]byte("before\n"))
+	f.Flush()
+
+	// logrotate moves the file away, then sends SIGUSR1.
+	moved := f.path + ".1"
+	if err := os.Rename(f.path, moved); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("buffered\n"))
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("after\n"))
+	f.Flush()
+	if got := readFile(t, moved); got != "before\nbuffered\n" {
+		t.Errorf("the moved file holds %q", got)
+	}
+	if got := readFile(t, f.path); got != "after\n" {
+		t.Errorf("the reopened file holds %q", got)
+	}
+}
+
+func TestAccessLogFallback(t *testing.T) {
+	f, fallback := testRotatingFile(t, 1<<20, 0, 0)
+	f.Write([]byte("lost\n"))
+	// The file stops taking writes, as on a full disk.
+	f.file.Close()
+	f.Flush()
+	f.Write([]byte("kept\n"))
+	f.Write([]byte("also kept\n"))
+
+	got := fallback.String()
+	if strings.Count(got, "⚠️ Access log") != 1 || !strings.HasSuffix(got, "kept\nalso kept\n") {
+		t.Errorf("the fallback got %q, want one warning and then the lines", got)
+	}
+
+	// Reopening gets the file working again.
+	if err := f.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	fallback.Reset()
+	f.Write([]byte("back\n"))
+	f.Flush()
+	if fallback.Len() != 0 || !strings.HasSuffix(readFile(t, f.path), "back\n") {
+		t.Errorf("after Reopen the fallback got %q and the file %q", fallback, readFile(t, f.path))
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// requireAdmin guards operational endpoints with the bearer token from
+// ADMIN_TOKEN. When no token is configured the endpoints are disabled
+// entirely rather than left open. The token is read per request, so a
+// rotated ADMIN_TOKEN_FILE applies on reload.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := currentConfig().AdminToken
+		if token == "" {
+			writeProblem(w, r, http.StatusForbidden, "admin endpoints are disabled")
+			log.Printf("🔒 Admin endpoint %s called but ADMIN_TOKEN is not set", r.URL.Path)
+			return
+		}
+		if !hasAdminToken(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeProblem(w, r, http.StatusUnauthorized, "unauthorized")
+			log.Printf("🔒 Rejected admin request to %s", r.URL.Path)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// hasAdminToken reports whether r carries ADMIN_TOKEN, which must be set.
+func hasAdminToken(r *http.Request) bool {
+	token := currentConfig().AdminToken
+	presented := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	albumPublisherJobName = "album-publisher"
+
+	// albumPublisherInterval is how often the publisher looks for albums
+	// whose embargo has lifted.
+	albumPublisherInterval = time.Minute
+
+	// privateCacheControl is the Cache-Control of a read that shows albums
+	// outside their availability window, which only its caller may see.
+	privateCacheControl = "private, no-store"
+)
+
+var (
+	errAvailabilityWindow = newCategorizedError(errValidation, "availableUntil must be after availableFrom")
+	// errIncludeUnavailable is returned by parseAlbumFilter, and answered
+	// 403, for an anonymous request asking for includeUnavailable.
+	errIncludeUnavailable = errors.New("includeUnavailable needs an API key, a client certificate, or the admin token")
+	errPublishUnsupported = errors.New("the configured store does not keep a change log")
+)
+
+// availabilityNow is the time albums are checked against their windows:
+// the server clock to the second, as the windows are kept.
+func availabilityNow() time.Time {
+	return serverClock.Now().UTC().Truncate(time.Second)
+}
+
+// availabilityTime is a window bound as the stores keep it: in UTC, to the
+// second, which every backend compares exactly.
+func availabilityTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	u := t.UTC().Truncate(time.Second)
+	return &u
+}
+
+// availableAt reports whether a is within its availability window at t:
+// from AvailableFrom, and before AvailableUntil.
+func availableAt(a album, t time.Time) bool {
+	return (a.AvailableFrom == nil || !a.AvailableFrom.After(t)) && (a.AvailableUntil == nil || a.AvailableUntil.After(t))
+}
+
+// availableAlbums keeps the albums of list within their window at t.
+func availableAlbums(list []album, t time.Time) []album {
+	kept := make([]album, 0, len(list))
+	for _, a := range list {
+		if availableAt(a, t) {
+			kept = append(kept, a)
+		}
+	}
+	return kept
+}
+
+// sameTime reports whether two optional times are both unset or equal.
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// includeUnavailable reports whether r can see the albums outside their
+// availability window: it asks with includeUnavailable=true, and carries
+// the admin token or a caller's credentials. An anonymous request asking is
+// errIncludeUnavailable.
+func includeUnavailable(r *http.Request) (bool, error) {
+	if r.URL.Query().Get("includeUnavailable") != "true" {
+		return false, nil
+	}
+	if hasAdminToken(r) || requestPrincipal(r) != principalAnonymous {
+		return true, nil
+	}
+	return false, errIncludeUnavailable
+}
+
+// writeFilterProblem answers a listing whose filter parseAlbumFilter turned
+// down.
+func writeFilterProblem(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errIncludeUnavailable) {
+		writeProblem(w, r, http.StatusForbidden, err.Error())
+		log.Printf("🔒 Rejected includeUnavailable on an anonymous request to %s", r.URL.Path)
+		return
+	}
+	writeProblem(w, r, http.StatusBadRequest, err.Error())
+	log.Println("📉 Bad request:", err)
+}
+
+// cacheControl is the Cache-Control of a listing with the filter:
+// public, unless it shows albums outside their window.
+func (f AlbumFilter) cacheControl(public string) string {
+	if f.AvailableAt.IsZero() {
+		return privateCacheControl
+	}
+	return public
+}
+
+// keepPrivate marks the answer to a listing with f private, when it shows
+// albums outside their window, for the listings without a Cache-Control of
+// their own.
+func keepPrivate(w http.ResponseWriter, f AlbumFilter) {
+	if f.AvailableAt.IsZero() {
+		w.Header().Set("Cache-Control", privateCacheControl)
+	}
+}
+
+// visibleAlbum is the lookup of a single album by r: errAlbumNotFound for
+// one outside its window, unless r may include those. It reports whether
+// the album is only visible to r.
+func visibleAlbum(r *http.Request, a album) (private bool, err error) {
+	include, err := includeUnavailable(r)
+	if err != nil {
+		return false, err
+	}
+	if include {
+		return true, nil
+	}
+	if !availableAt(a, availabilityNow()) {
+		return false, errAlbumNotFound
+	}
+	return false, nil
+}
+
+// albumPublisher is implemented by the stores that record in their change
+// log when an embargo lifts.
+type albumPublisher interface {
+	// PublishDue records a published change for every album whose
+	// AvailableFrom has passed since the last call, up to now, and that is
+	// still available, and returns those albums. The first call only looks
+	// back to when the change log started.
+	PublishDue(ctx context.Context, now time.Time) ([]album, error)
+}
+
+func storePublishDue(ctx context.Context, store AlbumStore, now time.Time) ([]album, error) {
+	p, ok := store.(albumPublisher)
+	if !ok {
+		return nil, errPublishUnsupported
+	}
+	return p.PublishDue(ctx, now)
+}
+
+// publishAlbums is the album-publisher job. Only one replica records each
+// album's publication, which the event dispatcher then sends as
+// album.published.
+func publishAlbums(ctx context.Context) error {
+	published, err := storePublishDue(ctx, albumStore, availabilityNow())
+	if errors.Is(err, errPublishUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, a := range published {
+		log.Printf("📢 Album published: %s by %s", a.Title, a.Artist)
+	}
+	if len(published) > 0 {
+		albumsChanged()
+	}
+	setJobResult(ctx, map[string]int{"published": len(published)})
+	return nil
+}
+
+// setupAlbumPublisher registers the job that records when an embargo
+// lifts.
+func setupAlbumPublisher() {
+	scheduler.register(albumPublisherJobName, albumPublisherInterval, publishAlbums)
+}
+
+// PublishDue implements albumPublisher.
+func (store *InMemoryAlbumStore) PublishDue(ctx context.Context, now time.Time) ([]album, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	through := store.changes.publishedThrough
+	if !now.After(through) {
+		return nil, nil
+	}
+	var published []album
+	for _, e := range store.albums {
+		if publishDue(e.album, through, now) {
+			a := e.album
+			store.changes.record(changePublished, a.ID, &a, &a)
+			published = append(published, a)
+		}
+	}
+	store.changes.publishedThrough = now
+	return published, nil
+}
+
+// publishDue reports whether a's embargo lifted after through and by now,
+// with a still available. An album written after its AvailableFrom was
+// never held back by it, by that write, so it isn't published.
+func publishDue(a album, through, now time.Time) bool {
+	from := a.AvailableFrom
+	return from != nil && from.After(through) && a.UpdatedAt.Before(*from) && availableAt(a, now)
+}
+
+// PublishDue implements albumPublisher with the published change written
+// as the trigger writes the others, under its advisory lock. Locking
+// published_through stops replicas running the job at once from recording
+// an album twice.
+func (store *PostgresAlbumStore) PublishDue(ctx context.Context, now time.Time) ([]album, error) {
+	var published []album
+	err := store.inTx(ctx, func(tx *PostgresAlbumStore) error {
+		published = nil
+		opCtx, cancel := tx.opContext(ctx)
+		defer cancel()
+		var through time.Time
+		if err := tx.db.QueryRow(opCtx, `SELECT published_through FROM album_change_log FOR UPDATE`).Scan(&through); err != nil {
+			return err
+		}
+		if !now.After(through) {
+			return nil
+		}
+		rows, err := tx.db.Query(opCtx, `SELECT `+postgresAlbumColumns+` FROM albums
+			 WHERE available_from > $1 AND available_from <= $2 AND updated_at < available_from
+			 AND (available_until IS NULL OR available_until > $2) ORDER BY seq`, through, now)
+		if err != nil {
+			return err
+		}
+		var ids []string
+		for rows.Next() {
+			a, err := scanPostgresAlbum(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			published, ids = append(published, a), append(ids, a.ID)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if len(ids) > 0 {
+			if _, err := tx.db.Exec(opCtx, `SELECT pg_advisory_xact_lock(hashtext('album_changes'))`); err != nil {
+				return err
+			}
+			_, err := tx.db.Exec(opCtx, `INSERT INTO album_changes (op, album_id, before, after)
+				 SELECT $1, id, to_jsonb(albums) - 'search_key', to_jsonb(albums) - 'search_key' FROM albums WHERE id = ANY($2) ORDER BY seq`, changePublished, ids)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.db.Exec(opCtx, `UPDATE album_change_log SET published_through = $1`, now)
+		return err
+	})
+	return published, err
+}
+
+// sqliteAlbumSnapshot is an album row as the change log triggers keep it.
+const sqliteAlbumSnapshot = `json_object(
+	'id', id, 'title', title, 'artist', artist, 'price', price,
+	'genre', genre, 'slug', slug, 'barcode', barcode, 'year', year,
+	'tracks', json(tracks), 'metadata', json(metadata), 'stock', stock, 'created_at', created_at,
+	'updated_at', updated_at, 'available_from', available_from, 'available_until', available_until)`
+
+// PublishDue implements albumPublisher. Times are bound in the layout they
+// are stored in, so they compare as text; SQLite runs one write
+// transaction at a time, so no two runs record an album twice.
+func (store *SqliteAlbumStore) PublishDue(ctx context.Context, now time.Time) ([]album, error) {
+	var published []album
+	err := store.inTx(ctx, func(tx *SqliteAlbumStore) error {
+		published = nil
+		var through time.Time
+		if err := tx.db.Raw(`SELECT published_through FROM album_change_log`).Row().Scan(&through); err != nil {
+			return err
+		}
+		if !now.After(through) {
+			return nil
+		}
+		from, to := through.UTC().Format(sqliteTimeLayout), now.UTC().Format(sqliteTimeLayout)
+		var recs []sqliteAlbum
+		err := tx.db.Where(`available_from > ? AND available_from <= ? AND updated_at < available_from
+			 AND (available_until IS NULL OR available_until > ?)`, from, to, to).Order("seq").Find(&recs).Error
+		if err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			err := tx.db.Exec(`INSERT INTO album_changes (op, album_id, changed_at, before, after)
+				 SELECT ?, id, strftime('%Y-%m-%d %H:%M:%f', 'now'), snapshot, snapshot
+				 FROM (SELECT id, `+sqliteAlbumSnapshot+` AS snapshot FROM albums WHERE id = ?)`, changePublished, rec.ID).Error
+			if err != nil {
+				return err
+			}
+			published = append(published, rec.album())
+		}
+		return tx.db.Exec(`UPDATE album_change_log SET published_through = ?`, to).Error
+	})
+	return published, err
+}
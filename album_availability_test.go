@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withWindow gives the album an availability window.
+func withWindow(from, until *time.Time) func(*album) {
+	return func(a *album) { a.AvailableFrom, a.AvailableUntil = from, until }
+}
+
+func timePtr(t time.Time) *time.Time { return &t }
+
+// startAtWallClock moves s's clock to the wall clock, which the stores stamp
+// UpdatedAt with, so an embargo set on s's clock is after the album's last
+// write, and gives s a store made then.
+func startAtWallClock(s *testServer) time.Time {
+	s.clock.Advance(time.Now().Truncate(time.Second).Add(time.Second).Sub(s.clock.Now()))
+	s.albums = NewInMemoryAlbumStore()
+	albumStore = s.albums
+	return availabilityNow()
+}
+
+// runPublisher runs the album-publisher job and returns how many albums it
+// published.
+func runPublisher(t *testing.T) int {
+	t.Helper()
+	var result map[string]int
+	if err := publishAlbums(context.WithValue(context.Background(), jobResultKey{}, &result)); err != nil {
+		t.Fatal(err)
+	}
+	return result["published"]
+}
+
+func TestAvailabilityWindowValidation(t *testing.T) {
+	s := newTestServer(t)
+	from := testStart.Add(time.Hour)
+	for _, tc := range []struct {
+		name   string
+		until  time.Time
+		status int
+	}{
+		{"before", from.Add(-time.Second), http.StatusUnprocessableEntity},
+		{"the same time", from, http.StatusUnprocessableEntity},
+		// The window is kept to the second.
+		{"within the second", from.Add(500 * time.Millisecond), http.StatusUnprocessableEntity},
+		{"after", from.Add(time.Second), http.StatusCreated},
+	} {
+		w := s.do(http.MethodPost, "/albums", albumJSON(newTestAlbum(withWindow(&from, timePtr(tc.until)))))
+		if w.Code != tc.status {
+			t.Errorf("%s: %d, want %d; %s", tc.name, w.Code, tc.status, w.Body)
+		}
+	}
+	// Either bound is enough on its own.
+	expectStatus(t, s.do(http.MethodPost, "/albums", albumJSON(newTestAlbum(withWindow(nil, &from)))), http.StatusCreated)
+}
+
+func TestAvailabilityWindow(t *testing.T) {
+	s := newTestServer(t)
+	captureLog(t)
+	now := startAtWallClock(s)
+	street, delisted := now.Add(time.Hour), now.Add(2*time.Hour)
+	s.create(newTestAlbum(withTitle("Kind of Blue")))
+	embargoed := s.create(newTestAlbum(withTitle("Giant Steps"), withWindow(&street, &delisted)))
+	s.create(newTestAlbum(withTitle("Lush Life")))
+
+	// titles lists the albums GET /albums answers a page of 1 at a time, and
+	// the total each page reports.
+	titles := func(query string, headers ...string) string {
+		t.Helper()
+		var out []string
+		for offset := 0; ; offset++ {
+			w := s.do(http.MethodGet, fmt.Sprintf("/albums?limit=1&offset=%d%s", offset, query), "", headers...)
+			expectStatus(t, w, http.StatusOK)
+			page := decodeBody[[]album](t, w)
+			if len(page) == 0 {
+				return strings.Join(out, ", ")
+			}
+			out = append(out, page[0].Title+" of "+w.Header().Get("X-Total-Count"))
+		}
+	}
+	admin := []string{"Authorization", "Bearer " + testAdminToken}
+
+	// Before the street date, the public listings and lookups leave it out,
+	// and the pages count without it.
+	if got := titles(""); got != "Kind of Blue of 2, Lush Life of 2" {
+		t.Errorf("before the street date: %s", got)
+	}
+	expectProblem(t, s.do(http.MethodGet, "/albums/"+embargoed.ID, ""), http.StatusNotFound)
+	expectProblem(t, s.do(http.MethodGet, "/albums/by-slug/"+embargoed.Slug, ""), http.StatusNotFound)
+	if stats := decodeBody[cachedStats](t, s.do(http.MethodGet, "/albums/stats", "")); stats.Count != 2 {
+		t.Errorf("stats count %d, want the 2 available", stats.Count)
+	}
+
+	// An anonymous caller can't ask for it; the admin can, privately.
+	expectProblem(t, s.do(http.MethodGet, "/albums?includeUnavailable=true", ""), http.StatusForbidden)
+	expectProblem(t, s.do(http.MethodGet, "/albums/"+embargoed.ID+"?includeUnavailable=true", ""), http.StatusForbidden)
+	if got := titles("&includeUnavailable=true", admin...); got != "Kind of Blue of 3, Giant Steps of 3, Lush Life of 3" {
+		t.Errorf("with includeUnavailable: %s", got)
+	}
+	w := s.admin(http.MethodGet, "/albums/"+embargoed.ID+"?includeUnavailable=true", "")
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("Cache-Control"); got != privateCacheControl {
+		t.Errorf("Cache-Control %q, want it kept private", got)
+	}
+	if got := s.do(http.MethodGet, "/albums", "").Header().Get("Cache-Control"); got == privateCacheControl {
+		t.Errorf("the public listing is %q", got)
+	}
+
+	// A second short of the street date, nothing is published.
+	s.clock.Advance(time.Hour - time.Second)
+	if n := runPublisher(t); n != 0 {
+		t.Errorf("published %d albums before the street date", n)
+	}
+	expectStatus(t, s.do(http.MethodGet, "/albums/"+embargoed.ID, ""), http.StatusNotFound)
+
+	// On it, the album shows up without the job running, and the job
+	// publishes it once.
+	s.clock.Advance(time.Second)
+	if got := titles(""); got != "Kind of Blue of 3, Giant Steps of 3, Lush Life of 3" {
+		t.Errorf("on the street date: %s", got)
+	}
+	expectStatus(t, s.do(http.MethodGet, "/albums/"+embargoed.ID, ""), http.StatusOK)
+	if n := runPublisher(t); n != 1 {
+		t.Errorf("published %d albums on the street date, want 1", n)
+	}
+	if n := runPublisher(t); n != 0 {
+		t.Errorf("published %d albums again", n)
+	}
+	changes, _, err := storeChanges(context.Background(), s.albums, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := changes[len(changes)-1]
+	if last.Op != changePublished || last.AlbumID != embargoed.ID || (&eventDispatcher{}).event(last, true).Type != "album.published" {
+		t.Errorf("the last change %+v, want the album published", last)
+	}
+
+	// Once delisted it is gone again, and nothing is published.
+	s.clock.Advance(time.Hour)
+	if got := titles(""); got != "Kind of Blue of 2, Lush Life of 2" {
+		t.Errorf("once delisted: %s", got)
+	}
+	expectProblem(t, s.do(http.MethodGet, "/albums/"+embargoed.ID, ""), http.StatusNotFound)
+	if n := runPublisher(t); n != 0 {
+		t.Errorf("published %d albums on delisting", n)
+	}
+}
+
+// testPublishDue checks store's PublishDue against embargoes lifting around
+// the times it is run at.
+func testPublishDue(t *testing.T, store AlbumStore) {
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second).Add(time.Second)
+	create := func(title string, from, until *time.Time) album {
+		t.Helper()
+		a, err := store.Create(ctx, newTestAlbum(withID(newAlbumID()), withTitle(title), withWindow(from, until)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	create("Out Now", nil, nil)
+	// Already past its street date when written, so never held back.
+	create("Old Embargo", timePtr(now.Add(-time.Hour)), nil)
+	create("Soon", timePtr(now.Add(time.Hour)), nil)
+	create("Later", timePtr(now.Add(2*time.Hour)), nil)
+	// Out for half an hour.
+	create("Withdrawn", timePtr(now.Add(time.Hour)), timePtr(now.Add(90*time.Minute)))
+
+	available := func(at time.Time) int {
+		t.Helper()
+		page, err := store.List(ctx, ListOptions{Filter: AlbumFilter{AvailableAt: at}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(page.Albums)
+	}
+	for _, tc := range []struct {
+		at        time.Time
+		published string
+		available int
+	}{
+		{now, "", 2},
+		{now.Add(time.Hour - time.Second), "", 2},
+		{now.Add(time.Hour), "Soon, Withdrawn", 4},
+		// Each is published once.
+		{now.Add(time.Hour), "", 4},
+		{now.Add(100 * time.Minute), "", 3},
+		{now.Add(3 * time.Hour), "Later", 4},
+	} {
+		published, err := storePublishDue(ctx, store, tc.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, a := range published {
+			titles = append(titles, a.Title)
+		}
+		if got := strings.Join(titles, ", "); got != tc.published {
+			t.Errorf("at %s: published %q, want %q", tc.at.Sub(now), got, tc.published)
+		}
+		if n := available(tc.at); n != tc.available {
+			t.Errorf("at %s: %d available, want %d", tc.at.Sub(now), n, tc.available)
+		}
+	}
+
+	// The published change has the album on both sides.
+	revisions, _, err := storeRevisions(ctx, store, now.Add(-time.Hour), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []string
+	for _, r := range revisions {
+		if r.Op == changePublished {
+			if r.before == nil || r.after == nil || r.before.ID != r.after.ID {
+				t.Errorf("published revision %+v", r)
+			}
+			ops = append(ops, r.after.Title)
+		}
+	}
+	if fmt.Sprint(ops) != "[Soon Withdrawn Later]" {
+		t.Errorf("published revisions of %v", ops)
+	}
+}
+
+func TestPublishDueInMemory(t *testing.T) {
+	newTestServer(t)
+	testPublishDue(t, NewInMemoryAlbumStore())
+}
+
+func TestPublishDueSQLite(t *testing.T) {
+	newTestServer(t)
+	store, err := NewSqliteAlbumStore(testSQLiteStores(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testPublishDue(t, store)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+const (
+	defaultChangesPageSize = 500
+	maxChangesPageSize     = 1000
+
+	defaultChangeLogRetention = 30 * 24 * time.Hour
+	changeLogJanitorInterval  = time.Hour
+
+	// The ops of a change.
+	changeCreated = "created"
+	changeUpdated = "updated"
+	changeDeleted = "deleted"
+	// changePublished is recorded when an album's embargo lifts, with the
+	// album on both sides; see publishAlbums.
+	changePublished = "published"
+)
+
+var (
+	// errChangesTrimmed is returned for a since whose following changes the
+	// store no longer has all of: ones older than CHANGE_LOG_RETENTION, or
+	// a since past the head, as after the change log restarted.
+	errChangesTrimmed     = newCategorizedError(errNotFound, "the changes after since are no longer kept")
+	errChangesUnsupported = errors.New("the configured store does not keep a change log")
+)
+
+// changeFeeder is implemented by stores that number every album mutation,
+// as part of the write, in a sequence clients can follow.
+type changeFeeder interface {
+	// Changes returns up to limit changes after seq since, oldest first,
+	// and the seq of the newest change of all. It returns errChangesTrimmed
+	// when since is older than the oldest change kept, or newer than the
+	// newest.
+	Changes(ctx context.Context, since int64, limit int) ([]types.AlbumChange, int64, error)
+	// TrimChanges forgets the changes made before before and returns how
+	// many there were.
+	TrimChanges(ctx context.Context, before time.Time) (int, error)
+}
+
+func storeChanges(ctx context.Context, store AlbumStore, since int64, limit int) ([]types.AlbumChange, int64, error) {
+	f, ok := store.(changeFeeder)
+	if !ok {
+		return nil, 0, errChangesUnsupported
+	}
+	return f.Changes(ctx, since, limit)
+}
+
+func storeTrimChanges(ctx context.Context, store AlbumStore, before time.Time) (int, error) {
+	f, ok := store.(changeFeeder)
+	if !ok {
+		return 0, errChangesUnsupported
+	}
+	return f.TrimChanges(ctx, before)
+}
+
+// changeLog is the in-memory store's change feed. The store's lock guards
+// it; entries hold every change after trimmed, in seq order with no gaps,
+// with the album on either side of it.
+type changeLog struct {
+	entries   []albumRevision
+	head      int64
+	trimmed   int64     // the seq of the newest change forgotten
+	trimmedAt time.Time // when that change was made
+	sent      int64     // the seq of the newest change the event dispatcher delivered
+
+	publishedThrough time.Time // how far PublishDue has looked for embargoes that lifted
+}
+
+// record adds a change of the album that was before and is now after, nil
+// where it didn't or doesn't exist. The caller passes copies the store won't
+// change later.
+func (l *changeLog) record(op, albumID string, before, after *album) {
+	l.head++
+	change := types.AlbumChange{Seq: l.head, Op: op, AlbumID: albumID, ChangedAt: storeTimestamp()}
+	l.entries = append(l.entries, albumRevision{AlbumChange: change, before: before, after: after})
+}
+
+// rollback forgets the changes after head, which a batch that failed
+// recorded.
+func (l *changeLog) rollback(head int64) {
+	l.entries = l.entries[:len(l.entries)-int(l.head-head)]
+	l.head = head
+}
+
+func (l *changeLog) since(since int64, limit int) ([]types.AlbumChange, int64, error) {
+	if since < l.trimmed || since > l.head {
+		return nil, 0, errChangesTrimmed
+	}
+	page := l.entries[since-l.trimmed:]
+	page = page[:min(len(page), limit)]
+	changes := make([]types.AlbumChange, len(page))
+	for i, rev := range page {
+		changes[i] = rev.AlbumChange
+	}
+	return changes, l.head, nil
+}
+
+// between returns the changes made after from and up to to.
+func (l *changeLog) between(from, to time.Time) []albumRevision {
+	var revisions []albumRevision
+	for _, rev := range l.entries {
+		if rev.ChangedAt.After(from) && !rev.ChangedAt.After(to) {
+			revisions = append(revisions, rev)
+		}
+	}
+	return revisions
+}
+
+func (l *changeLog) trim(before time.Time) int {
+	n := 0
+	for n < len(l.entries) && l.entries[n].ChangedAt.Before(before) {
+		n++
+	}
+	if n > 0 {
+		l.trimmed, l.trimmedAt = l.entries[n-1].Seq, l.entries[n-1].ChangedAt
+		l.entries = append([]albumRevision(nil), l.entries[n:]...)
+	}
+	return n
+}
+
+// trimChangeLog is the change-log-janitor job.
+func trimChangeLog(ctx context.Context) error {
+	retention := currentConfig().ChangeLogRetention
+	if retention == 0 {
+		return nil
+	}
+	before := serverClock.Now().Add(-retention)
+	if albumEvents != nil {
+		var err error
+		if before, err = albumEvents.holdBack(ctx, before); err != nil {
+			return err
+		}
+	}
+	n, err := storeTrimChanges(ctx, albumStore, before)
+	if errors.Is(err, errChangesUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	debugf("Trimmed %d changes from the change log", n)
+	return nil
+}
+
+// setupChangeLog registers the janitor that keeps the change log within
+// CHANGE_LOG_RETENTION.
+func setupChangeLog() {
+	scheduler.register("change-log-janitor", changeLogJanitorInterval, trimChangeLog)
+}
+
+// getAlbumChanges serves the change feed: the changes after since, oldest
+// first, and the head. A client that has read through the head gets an
+// empty page until something changes.
+func getAlbumChanges(w http.ResponseWriter, r *http.Request) {
+	since, err := parseChangesSince(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	limit, _, err := parsePage(r, defaultChangesPageSize, maxChangesPageSize)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	changes, head, err := storeChanges(r.Context(), albumStore, since, limit)
+	switch {
+	case errors.Is(err, errChangesUnsupported):
+		writeProblem(w, r, http.StatusNotImplemented, err.Error())
+		log.Println("🚧 Album changes requested but the album store doesn't keep a change log")
+		return
+	case errors.Is(err, errChangesTrimmed):
+		writeProblem(w, r, http.StatusGone, "the changes after since are no longer kept; fetch the catalog with GET /albums and follow the changes from the head")
+		log.Printf("🧾 Album changes after %d are no longer kept; the client must resync", since)
+		return
+	case err != nil:
+		respondError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, types.AlbumChanges{Changes: changes, Head: head})
+	debugf("Served %d album changes after %d, head %d", len(changes), since, head)
+}
+
+var errChangesSince = errors.New("since must be a non-negative integer")
+
+func parseChangesSince(r *http.Request) (int64, error) {
+	raw := r.URL.Query().Get("since")
+	if raw == "" {
+		return 0, nil
+	}
+	since, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || since < 0 {
+		return 0, errChangesSince
+	}
+	return since, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// testChangeTrimming makes three changes, then three more a little later,
+// the last of them a delete, and trims the first three.
+func testChangeTrimming(t *testing.T, store AlbumStore) {
+	ctx := context.Background()
+	var ids []string
+	for i := 0; i < 5; i++ {
+		if i == 3 {
+			time.Sleep(2 * time.Millisecond) // the stores stamp changes to the millisecond
+		}
+		a, err := store.Create(ctx, newTestAlbum(withID(newAlbumID()), withTitle("Album "+strconv.Itoa(i))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, a.ID)
+	}
+	if err := storeDeleteMany(ctx, store, ids[4:]); err != nil {
+		t.Fatal(err)
+	}
+	changes, _, err := storeChanges(ctx, store, 0, 100)
+	if err != nil || len(changes) != 6 {
+		t.Fatalf("%d changes, %v, want 6", len(changes), err)
+	}
+	cutoff := changes[3].ChangedAt
+
+	if n, err := storeTrimChanges(ctx, store, cutoff); err != nil || n != 3 {
+		t.Fatalf("trimmed %d changes, %v, want 3", n, err)
+	}
+	for _, since := range []int64{0, 2, 7} {
+		if _, _, err := storeChanges(ctx, store, since, 100); !errors.Is(err, errChangesTrimmed) {
+			t.Errorf("since %d: %v, want errChangesTrimmed", since, err)
+		}
+	}
+	changes, head, err := storeChanges(ctx, store, 3, 100)
+	if err != nil || head != 6 || len(changes) != 3 {
+		t.Fatalf("since 3: %v, head %d, %v", changes, head, err)
+	}
+	for i, want := range []types.AlbumChange{{Seq: 4, Op: changeCreated, AlbumID: ids[3]}, {Seq: 5, Op: changeCreated, AlbumID: ids[4]}, {Seq: 6, Op: changeDeleted, AlbumID: ids[4]}} {
+		if got := changes[i]; got.Seq != want.Seq || got.Op != want.Op || got.AlbumID != want.AlbumID {
+			t.Errorf("change %d = %+v, want %+v", i, got, want)
+		}
+	}
+	if changes, _, _ := storeChanges(ctx, store, 3, 1); len(changes) != 1 || changes[0].Seq != 4 {
+		t.Errorf("since 3, limit 1: %+v", changes)
+	}
+	// Reading from the head is cheap and empty.
+	if changes, head, err := storeChanges(ctx, store, 6, 100); err != nil || head != 6 || len(changes) != 0 {
+		t.Errorf("since the head: %+v, head %d, %v", changes, head, err)
+	}
+	// Trimming again with nothing older is a no-op.
+	if n, err := storeTrimChanges(ctx, store, cutoff); err != nil || n != 0 {
+		t.Errorf("trimmed %d more, %v", n, err)
+	}
+}
+
+func TestChangeTrimming(t *testing.T) {
+	t.Run("memory", func(t *testing.T) { testChangeTrimming(t, NewInMemoryAlbumStore()) })
+	t.Run("sqlite", func(t *testing.T) {
+		store, err := NewSqliteAlbumStore(testSQLiteStores(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		testChangeTrimming(t, store)
+	})
+}
+
+func TestAlbumChangesGone(t *testing.T) {
+	s := newTestServer(t)
+	a := s.create(newTestAlbum())
+	s.do(http.MethodPatch, "/albums/"+a.ID, `{"price": 9.99}`)
+
+	page := decodeBody[types.AlbumChanges](t, s.do(http.MethodGet, "/albums/changes?since=1", ""))
+	if page.Head != 2 || len(page.Changes) != 1 || page.Changes[0].Op != changeUpdated {
+		t.Errorf("since=1: %+v", page)
+	}
+	expectProblem(t, s.do(http.MethodGet, "/albums/changes?since=-1", ""), http.StatusBadRequest)
+	expectProblem(t, s.do(http.MethodGet, "/albums/changes?since=3", ""), http.StatusGone)
+
+	// Once the janitor has trimmed history a client is behind, it's told
+	// to resync; one at the head carries on.
+	s.clock.Advance(time.Since(s.clock.Now()) + s.cfg.ChangeLogRetention + time.Minute)
+	if err := trimChangeLog(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p := expectProblem(t, s.do(http.MethodGet, "/albums/changes?since=1", ""), http.StatusGone)
+	if p.Detail != "the changes after since are no longer kept; fetch the catalog with GET /albums and follow the changes from the head" {
+		t.Errorf("detail %q", p.Detail)
+	}
+	if page := decodeBody[types.AlbumChanges](t, s.do(http.MethodGet, "/albums/changes?since=2", "")); page.Head != 2 || len(page.Changes) != 0 {
+		t.Errorf("since the head: %+v", page)
+	}
+	s.do(http.MethodPatch, "/albums/"+a.ID, `{"price": 8.99}`)
+	if page := decodeBody[types.AlbumChanges](t, s.do(http.MethodGet, "/albums/changes?since=2", "")); page.Head != 3 || len(page.Changes) != 1 {
+		t.Errorf("after another change: %+v", page)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+const defaultBulkDeleteMaxAlbums = 1000
+
+var errDeleteUnsupported = errors.New("the configured store does not support deleting albums")
+
+// albumDeleter is implemented by stores that can delete albums.
+type albumDeleter interface {
+	// DeleteMany permanently deletes the albums with the given distinct IDs
+	// as one all-or-nothing batch. If any of them is missing it returns
+	// errAlbumNotFound and deletes none.
+	DeleteMany(ctx context.Context, ids []string) error
+}
+
+func storeDeleteMany(ctx context.Context, store AlbumStore, ids []string) error {
+	d, ok := store.(albumDeleter)
+	if !ok {
+		return errDeleteUnsupported
+	}
+	return d.DeleteMany(ctx, ids)
+}
+
+// albumDeletion is the body of DELETE /admin/albums. The filter fields
+// narrow the albums together; at least one must be set. Confirm must be the
+// number of albums the filter matches, as a dry run reports it.
+type albumDeletion struct {
+	IDs           []string   `json:"ids,omitempty"`
+	Artist        string     `json:"artist,omitempty"`
+	Genre         string     `json:"genre,omitempty"`
+	CreatedBefore *time.Time `json:"createdBefore,omitempty"`
+
+	Confirm   *int `json:"confirm,omitempty"`
+	Permanent bool `json:"permanent,omitempty"`
+}
+
+func (d albumDeletion) empty() bool {
+	return len(d.IDs) == 0 && d.Artist == "" && d.Genre == "" && d.CreatedBefore == nil
+}
+
+// match picks the albums in list that d selects.
+func (d albumDeletion) match(list []album) []album {
+	var ids map[string]bool
+	if len(d.IDs) > 0 {
+		ids = make(map[string]bool, len(d.IDs))
+		for _, id := range d.IDs {
+			ids[id] = true
+		}
+	}
+	var matched []album
+	for _, a := range list {
+		if ids != nil && !ids[a.ID] {
+			continue
+		}
+		if d.CreatedBefore != nil && !a.CreatedAt.Before(*d.CreatedBefore) {
+			continue
+		}
+		matched = append(matched, a)
+	}
+	return matched
+}
+
+// auditFilter is the filter as the audit log records it.
+func (d albumDeletion) auditFilter() map[string]interface{} {
+	filter := map[string]interface{}{}
+	if len(d.IDs) > 0 {
+		filter["ids"] = d.IDs
+	}
+	if d.Artist != "" {
+		filter["artist"] = d.Artist
+	}
+	if d.Genre != "" {
+		filter["genre"] = d.Genre
+	}
+	if d.CreatedBefore != nil {
+		filter["createdBefore"] = d.CreatedBefore.UTC()
+	}
+	return filter
+}
+
+// albumDeletionResult is the answer to DELETE /admin/albums.
+type albumDeletionResult struct {
+	Matched int  `json:"matched"`
+	Deleted int  `json:"deleted"`
+	DryRun  bool `json:"dryRun,omitempty"`
+}
+
+// deleteAlbums deletes every album the filter in the body matches, in one
+// all-or-nothing batch, for cleaning up after a load test. A call with
+// ?dryRun=true only counts the matches; the real call must echo that count
+// as confirm, so a filter broader than intended is turned away with 409
+// before anything is deleted. The catalog has no trash, so the body must
+// also say permanent: true.
+func deleteAlbums(w http.ResponseWriter, r *http.Request) {
+	var body albumDeletion
+	dec := json.NewDecoder(r.Body)
+	// An unknown field, such as a misspelt filter, would otherwise be
+	// ignored and widen the match.
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	if body.empty() {
+		writeProblem(w, r, http.StatusBadRequest, "the filter must set ids, artist, genre, or createdBefore")
+		log.Println("📉 Bad request: bulk delete without a filter")
+		return
+	}
+	dryRun := r.URL.Query().Get("dryRun") == "true"
+	if !dryRun && !body.Permanent {
+		writeProblem(w, r, http.StatusBadRequest, "deleted albums can't be restored; set permanent to true")
+		log.Println("📉 Bad request: bulk delete without permanent")
+		return
+	}
+
+	// A stale listing from an open breaker could match albums that are
+	// already gone, or miss new ones, so only a fresh one will do.
+	list, err := listAll(r.Context(), albumStore, AlbumFilter{Artist: body.Artist, Genre: body.Genre})
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	matched := body.match(list)
+	if dryRun {
+		writeJSON(w, http.StatusOK, albumDeletionResult{Matched: len(matched), DryRun: true})
+		log.Printf("🗑️ Bulk delete dry run matched %d albums", len(matched))
+		return
+	}
+	if limit := currentConfig().BulkDeleteMaxAlbums; len(matched) > limit {
+		writeProblem(w, r, http.StatusBadRequest, localize(r, "the filter matches %d albums, more than the %d one request may delete", len(matched), limit))
+		log.Printf("📉 Bad request: bulk delete of %d albums exceeds BULK_DELETE_MAX_ALBUMS", len(matched))
+		return
+	}
+	if body.Confirm == nil || *body.Confirm != len(matched) {
+		writeProblem(w, r, http.StatusConflict, localize(r, "the filter matches %d albums; set confirm to that count, as a dry run reports it", len(matched)))
+		log.Printf("⚔️ Bulk delete refused: it matches %d albums but confirm doesn't say so", len(matched))
+		return
+	}
+
+	if len(matched) > 0 {
+		ids := make([]string, len(matched))
+		for i, a := range matched {
+			ids[i] = a.ID
+		}
+		err := storeDeleteMany(r.Context(), albumStore, ids)
+		if errors.Is(err, errDeleteUnsupported) {
+			writeProblem(w, r, http.StatusNotImplemented, err.Error())
+			log.Println("🚧 Bulk delete requested but the album store can't delete")
+			return
+		}
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		albumsChanged()
+	}
+	recordAudit(auditAlbumsDeleted, "", principalAdmin, map[string]interface{}{"filter": body.auditFilter(), "count": len(matched)})
+	writeJSON(w, http.StatusOK, albumDeletionResult{Matched: len(matched), Deleted: len(matched)})
+	log.Printf("🗑️ Deleted %d albums", len(matched))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+// auditEntries lists the audit log entries with action.
+func auditEntries(t *testing.T, action string) []AuditEntry {
+	t.Helper()
+	all, err := auditLog.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []AuditEntry
+	for _, e := range all {
+		if e.Action == action {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+func TestBulkDelete(t *testing.T) {
+	s := newTestServer(t)
+	for _, title := range []string{"Blue Train", "Giant Steps", "A Love Supreme"} {
+		s.create(newTestAlbum(withTitle(title)))
+	}
+	kept := s.create(newTestAlbum(withArtist("Miles Davis"), withTitle("Kind of Blue")))
+	remaining := func() int {
+		t.Helper()
+		list, err := listAll(context.Background(), s.albums, AlbumFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(list)
+	}
+
+	w := s.admin(http.MethodDelete, "/admin/albums?dryRun=true", `{"artist": "john coltrane"}`)
+	if got := decodeBody[albumDeletionResult](t, w); got != (albumDeletionResult{Matched: 3, DryRun: true}) || remaining() != 4 {
+		t.Errorf("dry run = %+v with %d albums left, want 3 matched and none deleted", got, remaining())
+	}
+
+	// A confirm that doesn't echo the count, or none, deletes nothing.
+	for _, body := range []string{
+		`{"artist": "john coltrane", "permanent": true, "confirm": 2}`,
+		`{"artist": "john coltrane", "permanent": true}`,
+	} {
+		p := expectProblem(t, s.admin(http.MethodDelete, "/admin/albums", body), http.StatusConflict)
+		if p.Detail != "the filter matches 3 albums; set confirm to that count, as a dry run reports it" {
+			t.Errorf("%s: detail %q", body, p.Detail)
+		}
+	}
+	if remaining() != 4 || len(auditEntries(t, auditAlbumsDeleted)) != 0 {
+		t.Fatalf("a mismatched confirm deleted albums: %d left", remaining())
+	}
+
+	expectProblem(t, s.admin(http.MethodDelete, "/admin/albums", `{"artist": "john coltrane", "confirm": 3}`), http.StatusBadRequest)
+	expectProblem(t, s.admin(http.MethodDelete, "/admin/albums", `{"confirm": 4, "permanent": true}`), http.StatusBadRequest)
+	// A misspelt filter would widen the match, so it is refused.
+	expectProblem(t, s.admin(http.MethodDelete, "/admin/albums", `{"artst": "john coltrane", "genre": "Jazz", "confirm": 4, "permanent": true}`), http.StatusBadRequest)
+	expectProblem(t, s.do(http.MethodDelete, "/admin/albums", `{"artist": "john coltrane", "confirm": 3, "permanent": true}`), http.StatusUnauthorized)
+
+	w = s.admin(http.MethodDelete, "/admin/albums", `{"artist": "john coltrane", "confirm": 3, "permanent": true}`)
+	if got := decodeBody[albumDeletionResult](t, w); got != (albumDeletionResult{Matched: 3, Deleted: 3}) || remaining() != 1 {
+		t.Errorf("delete = %+v with %d albums left, want 3 deleted", got, remaining())
+	}
+	expectStatus(t, s.do(http.MethodGet, "/albums/"+kept.ID, ""), http.StatusOK)
+	entries := auditEntries(t, auditAlbumsDeleted)
+	if len(entries) != 1 || entries[0].Details["count"] != 3 || entries[0].Principal != principalAdmin {
+		t.Errorf("audit entries %+v, want one for the 3 albums", entries)
+	}
+}
+
+func TestBulkDeleteLimit(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.BulkDeleteMaxAlbums = 2 })
+	for _, title := range []string{"Blue Train", "Giant Steps", "A Love Supreme"} {
+		s.create(newTestAlbum(withTitle(title)))
+	}
+	p := expectProblem(t, s.admin(http.MethodDelete, "/admin/albums", `{"genre": "Jazz", "confirm": 3, "permanent": true}`), http.StatusBadRequest)
+	if p.Detail != "the filter matches 3 albums, more than the 2 one request may delete" {
+		t.Errorf("detail %q", p.Detail)
+	}
+	// The dry run still counts them all.
+	if got := decodeBody[albumDeletionResult](t, s.admin(http.MethodDelete, "/admin/albums?dryRun=true", `{"genre": "Jazz"}`)); got.Matched != 3 {
+		t.Errorf("dry run = %+v", got)
+	}
+}
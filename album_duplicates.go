@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/brentmzey/web-service-go/money"
+)
+
+const (
+	defaultDuplicatesPageSize = 100
+	maxDuplicatesPageSize     = 1000
+
+	// maxMergeDuplicates caps the albums one merge folds into a survivor.
+	maxMergeDuplicates = 100
+)
+
+var errMergeUnsupported = errors.New("the configured store does not support merging albums")
+
+// albumMerger is implemented by stores that can merge albums.
+type albumMerger interface {
+	// MergeAlbums writes survivor over the stored album with its ID and
+	// deletes the duplicates, as one all-or-nothing change. If any of them
+	// is missing it returns errAlbumNotFound and changes nothing.
+	MergeAlbums(ctx context.Context, survivor album, duplicates []string) (album, error)
+}
+
+func storeMergeAlbums(ctx context.Context, store AlbumStore, survivor album, duplicates []string) (album, error) {
+	m, ok := store.(albumMerger)
+	if !ok {
+		return album{}, errMergeUnsupported
+	}
+	return m.MergeAlbums(ctx, survivor, duplicates)
+}
+
+// duplicateKey is what near-duplicate albums have in common: the title and
+// artist folded the way slugs fold them, so case, accents, punctuation and
+// extra whitespace don't count, with "featuring" and "ft." read as "feat.".
+func duplicateKey(title, artist string) string {
+	return duplicateWords(title) + " / " + duplicateWords(artist)
+}
+
+func duplicateWords(s string) string {
+	words := strings.Split(slugify(s, ""), "-")
+	for i, w := range words {
+		if w == "featuring" || w == "ft" {
+			words[i] = "feat"
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// duplicateCluster is a group of albums sharing a duplicateKey.
+type duplicateCluster struct {
+	Key    string  `json:"key"`
+	Albums []album `json:"albums"` // oldest first
+}
+
+// duplicateClusters groups list by duplicateKey and keeps the groups with
+// more than one album, largest first.
+func duplicateClusters(list []album) []duplicateCluster {
+	byKey := make(map[string][]album)
+	for _, a := range list {
+		key := duplicateKey(a.Title, a.Artist)
+		byKey[key] = append(byKey[key], a)
+	}
+	clusters := []duplicateCluster{}
+	for key, albums := range byKey {
+		if len(albums) < 2 {
+			continue
+		}
+		sort.Slice(albums, func(i, j int) bool {
+			if !albums[i].CreatedAt.Equal(albums[j].CreatedAt) {
+				return albums[i].CreatedAt.Before(albums[j].CreatedAt)
+			}
+			return albums[i].ID < albums[j].ID
+		})
+		clusters = append(clusters, duplicateCluster{Key: key, Albums: albums})
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if len(clusters[i].Albums) != len(clusters[j].Albums) {
+			return len(clusters[i].Albums) > len(clusters[j].Albums)
+		}
+		return clusters[i].Key < clusters[j].Key
+	})
+	return clusters
+}
+
+// duplicateClustersPage is the answer to GET /admin/albums/duplicates.
+type duplicateClustersPage struct {
+	Clusters []duplicateCluster `json:"clusters"`
+	Total    int                `json:"total"` // clusters across every page
+	Limit    int                `json:"limit"`
+	Offset   int                `json:"offset"`
+}
+
+// getDuplicateAlbums lists the groups of albums that look like copies of
+// one another, for an admin to merge.
+func getDuplicateAlbums(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePage(r, defaultDuplicatesPageSize, maxDuplicatesPageSize)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	list, err := listAll(r.Context(), albumStore, AlbumFilter{})
+	if err = acceptStale(w, err); err != nil {
+		respondError(w, r, err)
+		return
+	}
+	clusters := duplicateClusters(list)
+	total := len(clusters)
+	writeJSON(w, http.StatusOK, duplicateClustersPage{
+		Clusters: clusters[min(offset, total):min(offset+limit, total)],
+		Total:    total,
+		Limit:    limit,
+		Offset:   offset,
+	})
+	log.Printf("👯 Found %d clusters of duplicate albums", total)
+}
+
+// mergePrices picks the merged album's price from the survivor's and the
+// duplicates' prices.
+var mergePrices = map[string]func(survivor money.Amount, duplicates []money.Amount) money.Amount{
+	"lowest":   func(s money.Amount, d []money.Amount) money.Amount { return min(s, slices.Min(d)) },
+	"highest":  func(s money.Amount, d []money.Amount) money.Amount { return max(s, slices.Max(d)) },
+	"survivor": func(s money.Amount, _ []money.Amount) money.Amount { return s },
+}
+
+// albumMerge is the body of POST /admin/albums/merge.
+type albumMerge struct {
+	Survivor   string   `json:"survivor"`
+	Duplicates []string `json:"duplicates"`
+	Price      string   `json:"price,omitempty"` // a mergePrices key; lowest by default
+}
+
+func (m albumMerge) validate() error {
+	switch {
+	case m.Survivor == "":
+		return errors.New("survivor is required")
+	case len(m.Duplicates) == 0:
+		return errors.New("duplicates must list at least one album")
+	case len(m.Duplicates) > maxMergeDuplicates:
+		return errors.New("a merge takes at most 100 duplicates")
+	case mergePrices[m.Price] == nil:
+		return errors.New("price must be \"lowest\", \"highest\", or \"survivor\"")
+	}
+	seen := map[string]bool{m.Survivor: true}
+	for _, id := range m.Duplicates {
+		if seen[id] {
+			return errors.New("duplicates must not repeat an album or include the survivor")
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+// postAlbumMerge folds duplicate albums into a survivor: the survivor takes
+// the price the strategy picks and the duplicates are deleted, all or
+// nothing. Every duplicate must share the survivor's duplicateKey, so a
+// mistyped ID can't delete an unrelated album.
+func postAlbumMerge(w http.ResponseWriter, r *http.Request) {
+	var body albumMerge
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	if body.Price == "" {
+		body.Price = "lowest"
+	}
+	if err := body.validate(); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+
+	// The albums are compared as they are now, never as a stale copy.
+	survivor, err := albumStore.GetByID(r.Context(), body.Survivor)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	key := duplicateKey(survivor.Title, survivor.Artist)
+	prices := make([]money.Amount, len(body.Duplicates))
+	for i, id := range body.Duplicates {
+		d, err := albumStore.GetByID(r.Context(), id)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		if duplicateKey(d.Title, d.Artist) != key {
+			writeProblem(w, r, http.StatusConflict, localize(r, "album %s is not a duplicate of the survivor", id))
+			log.Printf("⚔️ Merge refused: album %s is not a duplicate of %s", id, survivor.ID)
+			return
+		}
+		prices[i] = d.Price
+	}
+
+	oldPrice := survivor.Price
+	survivor.Price = mergePrices[body.Price](survivor.Price, prices)
+	ctx := withPrincipal(r.Context(), principalAdmin)
+	merged, err := storeMergeAlbums(ctx, albumStore, survivor, body.Duplicates)
+	if errors.Is(err, errMergeUnsupported) {
+		writeProblem(w, r, http.StatusNotImplemented, err.Error())
+		log.Println("🚧 Merge requested but the album store can't merge")
+		return
+	}
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	albumsChanged()
+	recordAudit(auditAlbumsMerged, merged.ID, principalAdmin, map[string]interface{}{
+		"duplicates": body.Duplicates,
+		"price":      body.Price,
+		"oldPrice":   oldPrice,
+		"newPrice":   merged.Price,
+	})
+	writeJSON(w, http.StatusOK, merged)
+	log.Printf("👯 Merged %d duplicates into album %s", len(body.Duplicates), merged.ID)
+}
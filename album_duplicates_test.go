@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+)
+
+// duplicateFixtures is a catalog of near-duplicates and of albums that only
+// look like them, by title and artist.
+var duplicateFixtures = [][2]string{
+	{"Blue Train", "John Coltrane"},
+	{"blue  train", "JOHN COLTRANE"},
+	{" Blue Train! ", "John   Coltrane"},
+	{"Blue Train (Remastered)", "John Coltrane"},
+	{"Blue Trains", "John Coltrane"},
+	{"Sorry (feat. Bob)", "Alice"},
+	{"Sorry featuring Bob", "alice"},
+	{"Sorry ft. Bob", "Alice"},
+	{"Sorry", "Alice & Bob"},
+	{"Café Society", "Björk"},
+	{"Cafe Society", "Bjork"},
+	{"Left Alone", "Mal Waldron"},
+}
+
+func TestDuplicateClusters(t *testing.T) {
+	s := newTestServer(t)
+	for _, f := range duplicateFixtures {
+		s.create(newTestAlbum(withTitle(f[0]), withArtist(f[1])))
+	}
+
+	page := decodeBody[duplicateClustersPage](t, s.admin(http.MethodGet, "/admin/albums/duplicates", ""))
+	var got [][]string
+	for _, c := range page.Clusters {
+		var titles []string
+		for _, a := range c.Albums {
+			titles = append(titles, a.Title)
+		}
+		// Created in the same millisecond they could come in any order.
+		slices.Sort(titles)
+		got = append(got, titles)
+	}
+	// Largest first, then by key.
+	want := [][]string{
+		{" Blue Train! ", "Blue Train", "blue  train"},
+		{"Sorry (feat. Bob)", "Sorry featuring Bob", "Sorry ft. Bob"},
+		{"Cafe Society", "Café Society"},
+	}
+	if !slices.EqualFunc(got, want, slices.Equal[[]string]) || page.Total != 3 {
+		t.Fatalf("clusters %q, want %q", got, want)
+	}
+	if page.Clusters[1].Key != "sorry feat bob / alice" {
+		t.Errorf("key %q", page.Clusters[1].Key)
+	}
+	second := decodeBody[duplicateClustersPage](t, s.admin(http.MethodGet, "/admin/albums/duplicates?limit=1&offset=1", ""))
+	if len(second.Clusters) != 1 || second.Clusters[0].Key != page.Clusters[1].Key || second.Total != 3 {
+		t.Errorf("the second page of one = %+v", second)
+	}
+}
+
+func TestAlbumMerge(t *testing.T) {
+	s := newTestServer(t)
+	survivor := s.create(newTestAlbum(withTitle("Blue Train"), withPrice(1999)))
+	cheaper := s.create(newTestAlbum(withTitle("blue train"), withPrice(999)))
+	dearer := s.create(newTestAlbum(withTitle("Blue Train!"), withPrice(2999)))
+	other := s.create(newTestAlbum(withTitle("Blue Train (Remastered)"), withPrice(499)))
+
+	// An album that only looks alike is refused, and nothing changes.
+	w := s.admin(http.MethodPost, "/admin/albums/merge", `{"survivor": "`+survivor.ID+`", "duplicates": ["`+cheaper.ID+`", "`+other.ID+`"]}`)
+	if p := expectProblem(t, w, http.StatusConflict); p.Detail != "album "+other.ID+" is not a duplicate of the survivor" {
+		t.Errorf("detail %q", p.Detail)
+	}
+	expectStatus(t, s.do(http.MethodGet, "/albums/"+cheaper.ID, ""), http.StatusOK)
+	for _, body := range []string{
+		`{"survivor": "` + survivor.ID + `", "duplicates": []}`,
+		`{"survivor": "` + survivor.ID + `", "duplicates": ["` + survivor.ID + `"]}`,
+		`{"survivor": "` + survivor.ID + `", "duplicates": ["` + cheaper.ID + `"], "price": "average"}`,
+	} {
+		expectProblem(t, s.admin(http.MethodPost, "/admin/albums/merge", body), http.StatusBadRequest)
+	}
+
+	// The lowest price wins by default.
+	w = s.admin(http.MethodPost, "/admin/albums/merge", `{"survivor": "`+survivor.ID+`", "duplicates": ["`+cheaper.ID+`", "`+dearer.ID+`"]}`)
+	expectStatus(t, w, http.StatusOK)
+	if merged := decodeBody[album](t, w); merged.ID != survivor.ID || merged.Price.Cents() != 999 {
+		t.Errorf("merged = %+v, want the survivor at 9.99", merged)
+	}
+	for _, id := range []string{cheaper.ID, dearer.ID} {
+		expectProblem(t, s.do(http.MethodGet, "/albums/"+id, ""), http.StatusNotFound)
+	}
+	entries := auditEntries(t, auditAlbumsMerged)
+	if len(entries) != 1 || entries[0].AlbumID != survivor.ID || entries[0].Details["price"] != "lowest" {
+		t.Errorf("audit entries %+v, want the merge", entries)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AlbumFilter narrows an album listing. Zero values mean "no constraint".
+// Artist and genre match exactly, ignoring case; metadata values match
+// exactly, case included. Query is a free-text search, see
+// searchQuery.matches, matched in the Collation of the request.
+// AvailableAt keeps the albums within their availability window then.
+type AlbumFilter struct {
+	Artist      string
+	Genre       string
+	MinPrice    *float64
+	MaxPrice    *float64
+	Query       string
+	Metadata    map[string]string // exact values by key
+	AvailableAt time.Time
+	Collation   textCollation
+}
+
+// parseAlbumFilter reads the artist, genre, minPrice, maxPrice, q, and
+// metadata.<key> query parameters shared by every endpoint that lists
+// albums. The listing only has the albums available now, unless the request
+// may includeUnavailable.
+func parseAlbumFilter(r *http.Request) (AlbumFilter, error) {
+	include, err := includeUnavailable(r)
+	if err != nil {
+		return AlbumFilter{}, err
+	}
+	f, err := parseFilterParams(r.URL.Query())
+	if err != nil {
+		return AlbumFilter{}, err
+	}
+	if !include {
+		f.AvailableAt = availabilityNow()
+	}
+	f.Collation = requestCollation(r)
+	return f, nil
+}
+
+// parseFilterParams reads the filter parameters of parseAlbumFilter from q,
+// ignoring any others.
+func parseFilterParams(q url.Values) (AlbumFilter, error) {
+	f := AlbumFilter{Artist: q.Get("artist"), Genre: q.Get("genre"), Query: q.Get("q")}
+	for name, values := range q {
+		key, ok := strings.CutPrefix(name, "metadata.")
+		if !ok {
+			continue
+		}
+		if !validMetadataKey(key) {
+			return AlbumFilter{}, fmt.Errorf("metadata filter keys must be 1 to 64 letters, digits, hyphens, or underscores")
+		}
+		if f.Metadata == nil {
+			f.Metadata = map[string]string{}
+		}
+		f.Metadata[key] = values[0]
+	}
+	for _, p := range []struct {
+		name string
+		dst  **float64
+	}{{"minPrice", &f.MinPrice}, {"maxPrice", &f.MaxPrice}} {
+		raw := q.Get(p.name)
+		if raw == "" {
+			continue
+		}
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return AlbumFilter{}, fmt.Errorf("%s must be a number", p.name)
+		}
+		*p.dst = &v
+	}
+	if f.MinPrice != nil && f.MaxPrice != nil && *f.MinPrice > *f.MaxPrice {
+		return AlbumFilter{}, fmt.Errorf("minPrice must not exceed maxPrice")
+	}
+	return f, nil
+}
+
+func (f AlbumFilter) matches(a album) bool {
+	if f.Artist != "" && !strings.EqualFold(a.Artist, f.Artist) {
+		return false
+	}
+	if f.Genre != "" && !strings.EqualFold(a.Genre, f.Genre) {
+		return false
+	}
+	if f.MinPrice != nil && float64(a.Price) < *f.MinPrice {
+		return false
+	}
+	if f.MaxPrice != nil && float64(a.Price) > *f.MaxPrice {
+		return false
+	}
+	if !matchesMetadata(a.Metadata, f.Metadata) {
+		return false
+	}
+	if !f.AvailableAt.IsZero() && !availableAt(a, f.AvailableAt) {
+		return false
+	}
+	return f.search().matches(a)
+}
+
+// searchTerms splits a search query into words folded as the stores' search
+// keys are: runs of letters and digits, as SQLite's unicode61 tokenizer sees
+// them. Everything else, including quotes and FTS operators, only separates
+// words. The stores narrow a search in the database with these and leave
+// the final say to searchQuery.matches.
+func searchTerms(q string) []string {
+	return rootCollation.terms(q)
+}
+
+// searchKeyPattern returns a LIKE pattern for the search keys with a word
+// that term starts. Terms hold only letters and digits, so nothing needs
+// escaping, and both sides are folded already.
+func searchKeyPattern(term string) string {
+	return "% " + term + "%"
+}
+
+// searchQuery is a q search: its words as its collation folds them.
+type searchQuery struct {
+	terms     []string
+	collation textCollation
+}
+
+// search is the q search of the filter.
+func (f AlbumFilter) search() searchQuery {
+	return searchQuery{terms: f.Collation.terms(f.Query), collation: f.Collation}
+}
+
+// matches reports whether every term starts a word of a's title or artist,
+// folded the same way, so "col blue" finds Blue Train by John Coltrane and
+// "emigre" finds Émigré. No terms match everything.
+func (q searchQuery) matches(a album) bool {
+	if len(q.terms) == 0 {
+		return true
+	}
+	words := q.collation.terms(a.Title + " " + a.Artist)
+	for _, term := range q.terms {
+		found := false
+		for _, w := range words {
+			if strings.HasPrefix(w, term) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// The strategies of ALBUM_ID_STRATEGY. uuid4 is random; uuid7 and ulid
+	// start with the time the ID is made, so that IDs made later sort
+	// later and a database index takes new albums at its end.
+	idStrategyUUID4 = "uuid4"
+	idStrategyUUID7 = "uuid7"
+	idStrategyULID  = "ulid"
+
+	// The formats of ALBUM_ID_FORMATS.
+	idFormatUUID = "uuid"
+	idFormatULID = "ulid"
+)
+
+// ulidAlphabet is Crockford's base32, which ULIDs are written in.
+const ulidAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// newAlbumID makes the ID of a new album with ALBUM_ID_STRATEGY.
+func newAlbumID() string {
+	switch currentConfig().AlbumIDStrategy {
+	case idStrategyUUID7:
+		return uuid.Must(uuid.NewV7()).String()
+	case idStrategyULID:
+		return newULID(time.Now())
+	default:
+		return uuid.New().String()
+	}
+}
+
+// newULID makes a ULID: the milliseconds since the epoch in 48 bits and 80
+// random bits, as 26 characters of Crockford's base32.
+func newULID(t time.Time) string {
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], uint64(t.UnixMilli())<<16)
+	rand.Read(id[6:])
+	hi, lo := binary.BigEndian.Uint64(id[:8]), binary.BigEndian.Uint64(id[8:])
+	var out [26]byte
+	for i := len(out) - 1; i >= 0; i-- {
+		out[i] = ulidAlphabet[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:])
+}
+
+// isULID reports whether id is a ULID, in either case. The first character
+// carries only the top 3 of the 128 bits.
+func isULID(id string) bool {
+	if len(id) != 26 || id[0] > '7' {
+		return false
+	}
+	for _, c := range strings.ToUpper(id) {
+		if !strings.ContainsRune(ulidAlphabet, c) {
+			return false
+		}
+	}
+	return true
+}
+
+// parseAlbumIDFormats reads ALBUM_ID_FORMATS, a comma-separated list of
+// "uuid" and "ulid".
+func parseAlbumIDFormats(s string) (map[string]bool, error) {
+	formats := make(map[string]bool)
+	for _, f := range strings.Split(s, ",") {
+		switch f = strings.TrimSpace(f); f {
+		case "":
+		case idFormatUUID, idFormatULID:
+			formats[f] = true
+		default:
+			return nil, fmt.Errorf(`must be a list of "uuid" and "ulid", got %q`, f)
+		}
+	}
+	return formats, nil
+}
+
+// albumIDFormats returns the formats album IDs may be given in: those of
+// ALBUM_ID_FORMATS and of the IDs ALBUM_ID_STRATEGY makes, and UUIDs, the
+// format of every ID made before there was a choice.
+func albumIDFormats(cfg *Config) map[string]bool {
+	formats, _ := parseAlbumIDFormats(cfg.AlbumIDFormats)
+	formats[idFormatUUID] = true
+	if cfg.AlbumIDStrategy == idStrategyULID {
+		formats[idFormatULID] = true
+	}
+	return formats
+}
+
+// validAlbumID checks an album ID given by a client, as in a seed file,
+// against the formats accepted. IDs are never checked on lookup: an album
+// is found by whatever ID it was stored with.
+func validAlbumID(id string) error {
+	formats := albumIDFormats(currentConfig())
+	if uuid.Validate(id) == nil || formats[idFormatULID] && isULID(id) {
+		return nil
+	}
+	if formats[idFormatULID] {
+		return fmt.Errorf("%q is not a UUID or ULID", id)
+	}
+	return fmt.Errorf("%q is not a UUID", id)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// useIDStrategy sets ALBUM_ID_STRATEGY and ALBUM_ID_FORMATS on s.
+func useIDStrategy(s *testServer, strategy, formats string) {
+	cfg := *s.cfg
+	cfg.AlbumIDStrategy, cfg.AlbumIDFormats = strategy, formats
+	liveConfig.Store(&cfg)
+}
+
+func TestAlbumIDStrategies(t *testing.T) {
+	s := newTestServer(t)
+	for _, strategy := range []string{idStrategyUUID4, idStrategyUUID7, idStrategyULID} {
+		useIDStrategy(s, strategy, "")
+		var ids []string
+		for range 50 {
+			ids = append(ids, newAlbumID())
+			// Time-ordered IDs only order across milliseconds.
+			time.Sleep(time.Millisecond)
+		}
+		for _, id := range ids {
+			u, err := uuid.Parse(id)
+			switch {
+			case strategy == idStrategyULID && !isULID(id):
+				t.Errorf("ulid made %q", id)
+			case strategy == idStrategyUUID4 && (err != nil || u.Version() != 4):
+				t.Errorf("uuid4 made %q", id)
+			case strategy == idStrategyUUID7 && (err != nil || u.Version() != 7):
+				t.Errorf("uuid7 made %q", id)
+			}
+			if err := validAlbumID(id); err != nil {
+				t.Errorf("%s made %q, which isn't valid: %v", strategy, id, err)
+			}
+		}
+		if strategy != idStrategyUUID4 && !slices.IsSorted(ids) {
+			t.Errorf("%s IDs don't sort in the order they were made: %v", strategy, ids)
+		}
+	}
+
+	// A ULID's first 10 characters are its time.
+	at := time.UnixMilli(1_700_000_000_123)
+	if id := newULID(at); !strings.HasPrefix(id, "01HF7YAT3V") || !isULID(id) {
+		t.Errorf("newULID = %q", id)
+	}
+	for _, id := range []string{"01HF7YAT4VAAAAAAAAAAAAAAAA", "01hf7yat4vaaaaaaaaaaaaaaaa"} {
+		if !isULID(id) {
+			t.Errorf("isULID(%q) = false", id)
+		}
+	}
+	for _, id := range []string{"", "01HF7YAT3V", "81HF7YAT4VAAAAAAAAAAAAAAAA", "01HF7YAT4VAAAAAAAAAAAAAAAI"} {
+		if isULID(id) {
+			t.Errorf("isULID(%q) = true", id)
+		}
+	}
+}
+
+func TestValidAlbumID(t *testing.T) {
+	s := newTestServer(t)
+	const uuid4, ulid = "a1b2c3d4-0000-4000-8000-000000000001", "01HF7YAT4VAAAAAAAAAAAAAAAA"
+	for _, tc := range []struct {
+		strategy, formats string
+		id                string
+		valid             bool
+	}{
+		// UUIDs, the format of every ID made before there was a choice, are
+		// always accepted.
+		{idStrategyUUID4, "", uuid4, true},
+		{idStrategyULID, "", uuid4, true},
+		{idStrategyUUID7, "ulid", uuid4, true},
+		{idStrategyULID, "", ulid, true},
+		// A ULID only with the ulid strategy, or ALBUM_ID_FORMATS naming it.
+		{idStrategyUUID4, "", ulid, false},
+		{idStrategyUUID4, "uuid, ulid", ulid, true},
+		{idStrategyUUID7, "", ulid, false},
+		{idStrategyULID, "", "blue-train", false},
+	} {
+		useIDStrategy(s, tc.strategy, tc.formats)
+		if err := validAlbumID(tc.id); (err == nil) != tc.valid {
+			t.Errorf("%s with formats %q: validAlbumID(%q) = %v", tc.strategy, tc.formats, tc.id, err)
+		}
+	}
+	if _, err := parseAlbumIDFormats("uuid,ksuid"); err == nil {
+		t.Error("ALBUM_ID_FORMATS of ksuid was accepted")
+	}
+}
+
+// testSwitchIDStrategy creates albums in store under each strategy in turn,
+// and looks every one up after each switch.
+func testSwitchIDStrategy(t *testing.T, s *testServer, store AlbumStore) {
+	ctx := context.Background()
+	var made []album
+	for _, strategy := range []string{idStrategyUUID4, idStrategyULID, idStrategyUUID7, idStrategyUUID4} {
+		useIDStrategy(s, strategy, "")
+		a, err := store.Create(ctx, newTestAlbum(withID(newAlbumID()), withTitle("Made with "+strategy)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		made = append(made, a)
+		for _, a := range made {
+			if got, err := store.GetByID(ctx, a.ID); err != nil || got.Title != a.Title {
+				t.Errorf("with %s, %s by ID: %+v, %v", strategy, a.Title, got, err)
+			}
+		}
+	}
+}
+
+func TestSwitchIDStrategy(t *testing.T) {
+	s := newTestServer(t)
+	testSwitchIDStrategy(t, s, s.albums)
+
+	// Through the API too, whatever the format of the ID.
+	useIDStrategy(s, idStrategyUUID4, "")
+	old := s.create(newTestAlbum(withTitle("Blue Train")))
+	useIDStrategy(s, idStrategyULID, "")
+	made := s.create(newTestAlbum(withTitle("Giant Steps")))
+	if !isULID(made.ID) {
+		t.Errorf("created with ID %q under ulid", made.ID)
+	}
+	useIDStrategy(s, idStrategyUUID4, "")
+	for _, a := range []album{old, made} {
+		w := s.do(http.MethodGet, "/albums/"+a.ID, "")
+		expectStatus(t, w, http.StatusOK)
+		if got := decodeBody[album](t, w); got.Title != a.Title {
+			t.Errorf("GET /albums/%s found %q", a.ID, got.Title)
+		}
+		expectStatus(t, s.do(http.MethodPatch, "/albums/"+a.ID, `{"price": 9.99}`), http.StatusOK)
+	}
+}
+
+func TestSwitchIDStrategySQLite(t *testing.T) {
+	s := newTestServer(t)
+	store, err := NewSqliteAlbumStore(testSQLiteStores(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSwitchIDStrategy(t, s, store)
+}
+
+func TestSeedIDsAfterSwitch(t *testing.T) {
+	s := newTestServer(t)
+	const uuid4, ulid = "a1b2c3d4-0000-4000-8000-000000000001", "01HF7YAT4VAAAAAAAAAAAAAAAA"
+	seed := `[{"id": "` + uuid4 + `", "title": "A", "artist": "B"}, {"id": "` + ulid + `", "title": "C", "artist": "D"}]`
+
+	// A seed written under ulid, with a UUID from before, loads under it.
+	useIDStrategy(s, idStrategyULID, "")
+	if list, err := parseSeed("seed.json", []byte(seed)); err != nil || len(list) != 2 {
+		t.Fatalf("under ulid: %d albums, %v", len(list), err)
+	}
+	// Switching back, its ULIDs need ALBUM_ID_FORMATS.
+	useIDStrategy(s, idStrategyUUID4, "")
+	if _, err := parseSeed("seed.json", []byte(seed)); err == nil || !strings.Contains(err.Error(), "[1].id") {
+		t.Errorf("under uuid4 alone: %v", err)
+	}
+	useIDStrategy(s, idStrategyUUID4, "ulid")
+	if _, err := parseSeed("seed.json", []byte(seed)); err != nil {
+		t.Errorf("under uuid4 with ALBUM_ID_FORMATS=ulid: %v", err)
+	}
+}
+
+// BenchmarkInsertAlbumIDs imports 100,000 albums into an empty SQLite or
+// PostgreSQL store under each strategy. Time-ordered IDs pay off once the
+// primary key index outgrows the cache, which takes PostgreSQL, run with
+// TEST_POSTGRES_URL; in SQLite the cost of each row hides the difference.
+func BenchmarkInsertAlbumIDs(b *testing.B) {
+	const rows = 100_000
+	previous := liveConfig.Load()
+	b.Cleanup(func() { liveConfig.Store(previous) })
+	for _, backend := range albumStoreBackends {
+		if backend.name != "sqlite" && backend.name != "postgres" {
+			continue
+		}
+		for _, strategy := range []string{idStrategyUUID4, idStrategyUUID7, idStrategyULID} {
+			b.Run(backend.name+"/"+strategy, func(b *testing.B) {
+				cfg := *previous
+				cfg.AlbumIDStrategy = strategy
+				liveConfig.Store(&cfg)
+				ctx := context.Background()
+				for range b.N {
+					b.StopTimer()
+					store := backend.open(b).(AlbumImporter)
+					b.StartTimer()
+					n := 0
+					_, err := store.Import(ctx, importMerge, func() (album, error) {
+						if n == rows {
+							return album{}, io.EOF
+						}
+						n++
+						return newTestAlbum(withID(newAlbumID()), withTitle(fmt.Sprint("Album ", n)), func(a *album) { a.Slug = fmt.Sprint("album-", n) }), nil
+					})
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
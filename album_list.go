@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// listChunkSize is how many albums a store reads at a time while iterating,
+// so an export or a backup of any size holds only one chunk in memory.
+const listChunkSize = 500
+
+var errInvalidCursor = newCategorizedError(errValidation, "cursor is not one a listing returned")
+
+// ListOptions picks a page of an album listing.
+type ListOptions struct {
+	Filter AlbumFilter
+	// Newest lists the most recently added albums first instead of in
+	// insertion order.
+	Newest bool
+	// Limit caps the page; 0 takes every album after Cursor.
+	Limit int
+	// Cursor is the NextCursor of the page before; "" starts at the
+	// beginning.
+	Cursor string
+}
+
+// albumPage is a page of a listing. NextCursor continues the listing after
+// it, and is "" on the last page.
+type albumPage struct {
+	Albums     []album
+	NextCursor string
+}
+
+// A cursor is the position of the last album of a page in its store's
+// order, such as its seq, with the order it was listed in, so that it reads
+// as opaque and can't be carried over to the other order.
+func encodeCursor(newest bool, position string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorOrder(newest) + ":" + position))
+}
+
+func cursorOrder(newest bool) string {
+	if newest {
+		return "d"
+	}
+	return "a"
+}
+
+// position returns the position in opts.Cursor, or "" for none.
+func (opts ListOptions) position() (string, error) {
+	if opts.Cursor == "" {
+		return "", nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(opts.Cursor)
+	if err != nil {
+		return "", errInvalidCursor
+	}
+	order, position, ok := strings.Cut(string(raw), ":")
+	if !ok || position == "" || order != cursorOrder(opts.Newest) {
+		return "", errInvalidCursor
+	}
+	return position, nil
+}
+
+// seqAfter returns the seq in opts.Cursor, for the stores that order albums
+// by one, and false for no cursor.
+func (opts ListOptions) seqAfter() (int64, bool, error) {
+	position, err := opts.position()
+	if err != nil || position == "" {
+		return 0, false, err
+	}
+	seq, err := strconv.ParseInt(position, 10, 64)
+	if err != nil || seq < 0 {
+		return 0, false, errInvalidCursor
+	}
+	return seq, true, nil
+}
+
+// chunkSize is how many albums a scan for opts reads at a time: one past
+// a small page's limit, so that List knows whether there is another page.
+func (opts ListOptions) chunkSize() int {
+	if opts.Limit > 0 && opts.Limit < listChunkSize {
+		return opts.Limit + 1
+	}
+	return listChunkSize
+}
+
+// albumScan calls fn with each album matching opts after its cursor, in
+// order, and the album's position for a cursor, stopping at fn's first
+// error. It ignores opts.Limit. Each store implements one, so that List and
+// Iterate are the same walk.
+type albumScan func(ctx context.Context, opts ListOptions, fn func(a album, position string) error) error
+
+var errPageFull = errors.New("page full")
+
+// listPage collects a page from scan. It reads one album past the limit, so
+// that the last page has no NextCursor.
+func listPage(ctx context.Context, opts ListOptions, scan albumScan) (albumPage, error) {
+	page := albumPage{Albums: []album{}}
+	var last string
+	err := scan(ctx, opts, func(a album, position string) error {
+		if opts.Limit > 0 && len(page.Albums) == opts.Limit {
+			page.NextCursor = encodeCursor(opts.Newest, last)
+			return errPageFull
+		}
+		page.Albums = append(page.Albums, a)
+		last = position
+		return nil
+	})
+	if err != nil && !errors.Is(err, errPageFull) {
+		return albumPage{}, err
+	}
+	return page, nil
+}
+
+// iterate runs fn over everything scan finds.
+func iterate(ctx context.Context, opts ListOptions, scan albumScan, fn func(album) error) error {
+	return scan(ctx, opts, func(a album, _ string) error { return fn(a) })
+}
+
+// listAll returns every album matching filter, for the callers that need
+// the whole set at once; the rest use Iterate. A stale listing comes back
+// with errStaleRead, as from List.
+func listAll(ctx context.Context, store AlbumStore, filter AlbumFilter) ([]album, error) {
+	page, err := store.List(ctx, ListOptions{Filter: filter})
+	return page.Albums, err
+}
+
+// iterFunc records whether the function an Iterate was given has failed, so
+// that decorators can tell its errors from the store's: a client that hangs
+// up mid-export is no reason to trip a breaker or retry.
+type iterFunc struct {
+	fn     func(album) error
+	called bool
+	failed bool
+}
+
+func (f *iterFunc) call(a album) error {
+	f.called = true
+	if err := f.fn(a); err != nil {
+		f.failed = true
+		return err
+	}
+	return nil
+}
+
+var (
+	errCursorOffset = errors.New("cursor and offset can't be used together")
+	errListOrder    = errors.New(`order must be "oldest" or "newest"`)
+)
+
+// getAlbumsAfter serves GET /albums?cursor=..., the listing a page at a
+// time from the store: each page costs only its own albums, and albums
+// added or removed meanwhile don't shift the pages after, as they do with
+// offset. order=newest lists the most recently added first.
+func getAlbumsAfter(w http.ResponseWriter, r *http.Request, cfg *Config, filter AlbumFilter, limit int) {
+	q := r.URL.Query()
+	if q.Has("offset") {
+		writeProblem(w, r, http.StatusBadRequest, errCursorOffset.Error())
+		log.Println("📉 Bad request:", errCursorOffset)
+		return
+	}
+	opts := ListOptions{Filter: filter, Limit: limit, Cursor: q.Get("cursor")}
+	switch q.Get("order") {
+	case "", "oldest":
+	case "newest":
+		opts.Newest = true
+	default:
+		writeProblem(w, r, http.StatusBadRequest, errListOrder.Error())
+		log.Println("📉 Bad request:", errListOrder)
+		return
+	}
+	page, err := albumStore.List(r.Context(), opts)
+	if errors.Is(err, errInvalidCursor) {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	if err = acceptStale(w, err); err != nil {
+		respondError(w, r, err)
+		return
+	}
+	if n, fits := fitPage(page.Albums, cfg.ResponseMaxBytes, 1); !fits {
+		if opts.Limit, fits = cutPage(w, r, cfg, n, len(page.Albums)); !fits {
+			return
+		}
+		// The next cursor must follow the last album sent, so the cut page
+		// is read again at the limit that fits.
+		if page, err = albumStore.List(r.Context(), opts); acceptStale(w, err) != nil {
+			respondError(w, r, err)
+			return
+		}
+	}
+	if abandoned(r) {
+		return
+	}
+	atomic.AddInt64(&metrics.TotalAlbumsFetched, 1)
+	keepPrivate(w, filter)
+	writeCursorLinks(w, r, opts.Limit, page.NextCursor)
+	writeJSON(w, http.StatusOK, page.Albums)
+	log.Printf("🎶 Fetched a page of %d albums", len(page.Albums))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// Limits on an album's metadata. Keys are restricted to characters that are
+// safe in a query parameter name and in every backend's field paths.
+const (
+	maxMetadataKeys        = 20
+	maxMetadataKeyLength   = 64
+	maxMetadataValueLength = 512
+)
+
+// reservedMetadataPrefixes start keys kept for the service's own use,
+// matched regardless of case.
+var reservedMetadataPrefixes = []string{"wsg_", "_"}
+
+var (
+	errMetadataTooManyKeys = newCategorizedError(errValidation, "metadata may have at most 20 keys")
+	errMetadataKey         = newCategorizedError(errValidation, "metadata keys must be 1 to 64 letters, digits, hyphens, or underscores")
+	errMetadataReservedKey = newCategorizedError(errValidation, `metadata keys starting with "wsg_" or "_" are reserved`)
+	errMetadataValue       = newCategorizedError(errValidation, "metadata values may be at most 512 characters")
+)
+
+// validMetadataKey reports whether key has the length and characters a
+// metadata key may have. It says nothing about reserved prefixes.
+func validMetadataKey(key string) bool {
+	if key == "" || len(key) > maxMetadataKeyLength {
+		return false
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// validateMetadata checks an album's metadata against the limits above.
+func validateMetadata(metadata map[string]string) error {
+	if len(metadata) > maxMetadataKeys {
+		return errMetadataTooManyKeys
+	}
+	for key, value := range metadata {
+		if !validMetadataKey(key) {
+			return errMetadataKey
+		}
+		lower := strings.ToLower(key)
+		for _, prefix := range reservedMetadataPrefixes {
+			if strings.HasPrefix(lower, prefix) {
+				return errMetadataReservedKey
+			}
+		}
+		if utf8.RuneCountInString(value) > maxMetadataValueLength {
+			return errMetadataValue
+		}
+	}
+	return nil
+}
+
+// matchesMetadata reports whether metadata has every key of want with
+// exactly the value given.
+func matchesMetadata(metadata, want map[string]string) bool {
+	for key, value := range want {
+		if got, ok := metadata[key]; !ok || got != value {
+			return false
+		}
+	}
+	return true
+}
+
+// mergePatch applies a JSON merge patch (RFC 7386) to target, both decoded
+// into interface{} values: objects merge key by key, a null removes the
+// key, and anything else replaces what was there.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = map[string]interface{}{}
+	}
+	for key, value := range p {
+		if value == nil {
+			delete(t, key)
+			continue
+		}
+		t[key] = mergePatch(t[key], value)
+	}
+	return t
+}
+
+// patchAlbum applies a JSON merge patch to the fields of an album that PUT
+// sets, so a client can change just the price, or add one metadata key
+// ({"metadata": {"label": "Blue Note"}}) and remove another with null. The
+// patch is applied to the album as read, and written back as by PUT; an
+// update made in between is overwritten.
+func patchAlbum(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var patch map[string]interface{}
+	if err := decodeAlbumJSON(r.Body, &patch); err != nil || patch == nil {
+		writeProblem(w, r, http.StatusBadRequest, "the body must be a JSON object")
+		log.Println("📉 Bad request: merge patch is not an object:", err)
+		return
+	}
+	current, err := albumStore.GetByID(r.Context(), id)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	var doc interface{}
+	data, _ := json.Marshal(inputOf(current))
+	json.Unmarshal(data, &doc)
+	data, _ = json.Marshal(mergePatch(doc, patch))
+	var input albumInput
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&input); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	if err := input.validate(); err != nil {
+		respondError(w, r, err)
+		return
+	}
+
+	regenerateSlug := r.URL.Query().Get("regenerateSlug") == "true"
+	ctx := withPrincipal(r.Context(), requestPrincipal(r))
+	updated, err := albumStore.Update(ctx, input.album(id), regenerateSlug)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	recordAudit(auditAlbumUpdated, updated.ID, requestPrincipal(r), updateAuditDetails(current, updated))
+	albumsChanged()
+
+	writeJSON(w, http.StatusOK, updated)
+	log.Printf("📝 Album patched: %s by %s", updated.Title, updated.Artist)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidateMetadata(t *testing.T) {
+	tooMany := map[string]string{}
+	for i := 0; i <= maxMetadataKeys; i++ {
+		tooMany[fmt.Sprintf("key%d", i)] = "x"
+	}
+	enough := map[string]string{}
+	for i := 0; i < maxMetadataKeys; i++ {
+		enough[fmt.Sprintf("key%d", i)] = "x"
+	}
+	for _, tc := range []struct {
+		name     string
+		metadata map[string]string
+		want     error
+	}{
+		{"none", nil, nil},
+		{"typical", map[string]string{"label": "Blue Note", "catalog-number": "BLP 1577", "vinyl_weight": "180g"}, nil},
+		{"20 keys", enough, nil},
+		{"21 keys", tooMany, errMetadataTooManyKeys},
+		{"empty key", map[string]string{"": "x"}, errMetadataKey},
+		{"key with a space", map[string]string{"catalog number": "x"}, errMetadataKey},
+		{"key with a dot", map[string]string{"label.name": "x"}, errMetadataKey},
+		{"64-character key", map[string]string{strings.Repeat("k", 64): "x"}, nil},
+		{"65-character key", map[string]string{strings.Repeat("k", 65): "x"}, errMetadataKey},
+		{"reserved prefix", map[string]string{"wsg_source": "x"}, errMetadataReservedKey},
+		{"reserved prefix in capitals", map[string]string{"WSG_source": "x"}, errMetadataReservedKey},
+		{"leading underscore", map[string]string{"_id": "x"}, errMetadataReservedKey},
+		{"prefix inside the key", map[string]string{"my_wsg_key": "x"}, nil},
+		{"512-character value", map[string]string{"notes": strings.Repeat("é", 512)}, nil},
+		{"513-character value", map[string]string{"notes": strings.Repeat("v", 513)}, errMetadataValue},
+	} {
+		if err := validateMetadata(tc.metadata); !errors.Is(err, tc.want) || (tc.want == nil) != (err == nil) {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
+
+func TestParseMetadataFilter(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  map[string]string
+		err   string
+	}{
+		{"artist=Miles+Davis", nil, ""},
+		{"metadata.label=Blue%20Note", map[string]string{"label": "Blue Note"}, ""},
+		{"metadata.label=Blue+Note&metadata.format=LP", map[string]string{"label": "Blue Note", "format": "LP"}, ""},
+		// The first of repeated values is the one matched.
+		{"metadata.label=Blue+Note&metadata.label=Impulse!", map[string]string{"label": "Blue Note"}, ""},
+		{"metadata.label=", map[string]string{"label": ""}, ""},
+		{"metadata.=x", nil, "metadata filter keys must be"},
+		{"metadata.a%20b=x", nil, "metadata filter keys must be"},
+		{"metadatalabel=x", nil, ""},
+	} {
+		q, _ := url.ParseQuery(tc.query)
+		f, err := parseFilterParams(q)
+		if tc.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tc.err) {
+				t.Errorf("%s: %v, want %q", tc.query, err, tc.err)
+			}
+			continue
+		}
+		if err != nil || fmt.Sprint(f.Metadata) != fmt.Sprint(tc.want) {
+			t.Errorf("%s: %v, %v, want %v", tc.query, f.Metadata, err, tc.want)
+		}
+	}
+}
+
+func TestAlbumMetadata(t *testing.T) {
+	s := newTestServer(t)
+	a := s.create(newTestAlbum(func(a *album) { a.Metadata = map[string]string{"label": "Blue Note", "format": "LP"} }))
+	s.create(newTestAlbum(withTitle("Kind of Blue"), func(a *album) { a.Metadata = map[string]string{"label": "Columbia"} }))
+	s.create(newTestAlbum(withTitle("Giant Steps")))
+
+	// A merge patch adds a key and removes another, leaving the rest.
+	patched := decodeBody[album](t, s.do(http.MethodPatch, "/albums/"+a.ID, `{"metadata": {"catalogNumber": "BLP 1577", "format": null}}`))
+	if fmt.Sprint(patched.Metadata) != "map[catalogNumber:BLP 1577 label:Blue Note]" {
+		t.Errorf("patched metadata %v", patched.Metadata)
+	}
+	if got := decodeBody[album](t, s.do(http.MethodGet, "/albums/"+a.ID, "")); fmt.Sprint(got.Metadata) != fmt.Sprint(patched.Metadata) {
+		t.Errorf("stored metadata %v, want %v", got.Metadata, patched.Metadata)
+	}
+
+	list := decodeBody[[]album](t, s.do(http.MethodGet, "/albums?metadata.label=Blue%20Note", ""))
+	if len(list) != 1 || list[0].ID != a.ID {
+		t.Errorf("metadata.label=Blue Note matched %d albums, want Blue Train", len(list))
+	}
+	if list := decodeBody[[]album](t, s.do(http.MethodGet, "/albums?metadata.label=blue+note", "")); len(list) != 0 {
+		t.Errorf("the match ignored case: %d albums", len(list))
+	}
+	expectProblem(t, s.do(http.MethodGet, "/albums?metadata.bad%20key=x", ""), http.StatusBadRequest)
+
+	for _, body := range []string{
+		`{"metadata": {"wsg_source": "import"}}`,
+		`{"metadata": {"catalog number": "x"}}`,
+		`{"metadata": {"notes": "` + strings.Repeat("v", 513) + `"}}`,
+	} {
+		expectProblem(t, s.do(http.MethodPatch, "/albums/"+a.ID, body), http.StatusUnprocessableEntity)
+	}
+	bad := newTestAlbum(func(a *album) { a.Metadata = map[string]string{"_internal": "x"} })
+	p := expectProblem(t, s.do(http.MethodPost, "/albums", albumJSON(bad)), http.StatusUnprocessableEntity)
+	if p.Detail != errMetadataReservedKey.Error() {
+		t.Errorf("detail %q", p.Detail)
+	}
+}
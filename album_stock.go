@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/jackc/pgx/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gorm.io/gorm"
+)
+
+var (
+	errNegativeStock   = newCategorizedError(errValidation, "stock must not be negative")
+	errOutOfStock      = newCategorizedError(errConflict, "not enough copies of the album are in stock")
+	errSellUnsupported = errors.New("the configured store does not support selling albums")
+)
+
+// albumSeller is implemented by stores that can take sold copies off an
+// album's stock.
+type albumSeller interface {
+	// SellAlbum takes quantity copies off the stock of the album with id in
+	// one atomic change, bumping UpdatedAt, and returns the album as left.
+	// It returns errAlbumNotFound for a missing album, and errOutOfStock,
+	// changing nothing, when fewer than quantity copies are left.
+	SellAlbum(ctx context.Context, id string, quantity int) (album, error)
+}
+
+func storeSellAlbum(ctx context.Context, store AlbumStore, id string, quantity int) (album, error) {
+	s, ok := store.(albumSeller)
+	if !ok {
+		return album{}, errSellUnsupported
+	}
+	return s.SellAlbum(ctx, id, quantity)
+}
+
+// SellAlbum implements albumSeller under the store's lock.
+func (store *InMemoryAlbumStore) SellAlbum(ctx context.Context, id string, quantity int) (album, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	e, ok := store.byID[id]
+	if !ok {
+		return album{}, errAlbumNotFound
+	}
+	if e.Stock < quantity {
+		return album{}, errOutOfStock
+	}
+	before := e.album
+	e.Stock -= quantity
+	e.UpdatedAt = storeTimestamp()
+	after := e.album
+	store.changes.record(changeUpdated, id, &before, &after)
+	store.generation.Add(1)
+	return e.album, nil
+}
+
+// SellAlbum implements albumSeller with a conditional UPDATE; when it
+// matches nothing, a read tells a missing album from one out of stock.
+func (store *PostgresAlbumStore) SellAlbum(ctx context.Context, id string, quantity int) (album, error) {
+	opCtx, cancel := store.opContext(ctx)
+	defer cancel()
+	a, err := scanPostgresAlbum(store.db.QueryRow(opCtx,
+		`UPDATE albums SET stock = stock - $2, updated_at = $3 WHERE id = $1 AND stock >= $2 RETURNING `+postgresAlbumColumns,
+		id, quantity, storeTimestamp()))
+	if errors.Is(err, pgx.ErrNoRows) {
+		if _, err := store.GetByID(ctx, id); err != nil {
+			return album{}, err
+		}
+		return album{}, errOutOfStock
+	}
+	return a, err
+}
+
+// SellAlbum implements albumSeller with a conditional UPDATE, as the
+// Postgres store does.
+func (store *SqliteAlbumStore) SellAlbum(ctx context.Context, id string, quantity int) (album, error) {
+	res := store.db.WithContext(ctx).Model(&sqliteAlbum{}).Where("id = ? AND stock >= ?", id, quantity).
+		Updates(map[string]interface{}{"stock": gorm.Expr("stock - ?", quantity), "updated_at": storeTimestamp()})
+	if res.Error != nil {
+		return album{}, mapSqliteAlbumError(res.Error)
+	}
+	if res.RowsAffected == 0 {
+		if _, err := store.GetByID(ctx, id); err != nil {
+			return album{}, err
+		}
+		return album{}, errOutOfStock
+	}
+	return store.GetByID(ctx, id)
+}
+
+// SellAlbum implements albumSeller with a findAndModify that only matches
+// while enough copies are left.
+func (store *MongoAlbumStore) SellAlbum(ctx context.Context, id string, quantity int) (album, error) {
+	var doc mongoAlbum
+	err := store.collection.FindOneAndUpdate(ctx,
+		bson.D{{Key: "id", Value: id}, {Key: "stock", Value: bson.D{{Key: "$gte", Value: quantity}}}},
+		bson.D{
+			{Key: "$inc", Value: bson.D{{Key: "stock", Value: -quantity}}},
+			{Key: "$set", Value: bson.D{{Key: "updatedAt", Value: storeTimestamp()}}},
+		},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		if _, err := store.GetByID(ctx, id); err != nil {
+			return album{}, err
+		}
+		return album{}, errOutOfStock
+	}
+	if err != nil {
+		return album{}, err
+	}
+	return doc.album(), nil
+}
+
+// SellAlbum implements albumSeller with a conditional UpdateItem. An item
+// written before albums had stock has no stock attribute, which the
+// condition treats as none left.
+func (store *DynamoAlbumStore) SellAlbum(ctx context.Context, id string, quantity int) (album, error) {
+	opCtx, cancel := store.opContext(ctx)
+	defer cancel()
+	now, err := attributevalue.Marshal(storeTimestamp())
+	if err != nil {
+		return album{}, err
+	}
+	res, err := store.client.UpdateItem(opCtx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(dynamoAlbumsTable),
+		Key:                      map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+		UpdateExpression:         aws.String("SET #stock = #stock - :quantity, updatedAt = :now"),
+		ConditionExpression:      aws.String("#kind = :album AND #stock >= :quantity"),
+		ExpressionAttributeNames: map[string]string{"#kind": "kind", "#stock": "stock"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":quantity": &types.AttributeValueMemberN{Value: strconv.Itoa(quantity)},
+			":now":      now,
+			":album":    &types.AttributeValueMemberS{Value: dynamoKindAlbum},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	var failed *types.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		if _, err := store.getAlbum(opCtx, id); err != nil {
+			return album{}, err
+		}
+		return album{}, errOutOfStock
+	}
+	if err != nil {
+		return album{}, err
+	}
+	var item dynamoAlbum
+	if err := attributevalue.UnmarshalMap(res.Attributes, &item); err != nil {
+		return album{}, err
+	}
+	return item.album(), nil
+}
@@ -0,0 +1,645 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+var errAlbumNotFound = newCategorizedError(errNotFound, "album not found")
+
+// AlbumStore persists the album catalog.
+type AlbumStore interface {
+	// List returns a page of the albums matching opts.Filter after
+	// opts.Cursor, in insertion order or with opts.Newest the reverse, and
+	// the cursor of the next page. No matches is an empty, non-nil slice. A
+	// store with a full-text index may rank the results of a search that
+	// takes every album at once, with no Limit or Cursor. A cursor the store
+	// can't read is errInvalidCursor.
+	List(ctx context.Context, opts ListOptions) (albumPage, error)
+	// Iterate calls fn with every album List would return for opts across
+	// all its pages, ignoring Limit, reading them a chunk at a time so that
+	// memory stays flat however many there are. An error from fn stops the
+	// iteration and is returned.
+	Iterate(ctx context.Context, opts ListOptions, fn func(album) error) error
+	// The Get methods return errAlbumNotFound when nothing matches, including
+	// GetByBarcode with an empty code.
+	GetByID(ctx context.Context, id string) (album, error)
+	GetBySlug(ctx context.Context, slug string) (album, error)
+	GetByBarcode(ctx context.Context, code string) (album, error)
+	// Create stores a new album, assigning it a unique slug derived from its
+	// title and artist and stamping CreatedAt/UpdatedAt. It returns
+	// errBarcodeTaken if another album already uses the barcode, and an
+	// errConflict if one already has the ID; implementations must enforce
+	// both atomically.
+	Create(ctx context.Context, a album) (album, error)
+	// Update replaces an existing album, preserving CreatedAt and bumping
+	// UpdatedAt. The stored slug is kept unless regenerateSlug is set, in
+	// which case it is rebuilt from the new title and artist. Updating a
+	// missing ID returns errAlbumNotFound; it is never an upsert.
+	Update(ctx context.Context, a album, regenerateSlug bool) (album, error)
+	// CreateMany and UpdateMany apply Create or Update to every album, in
+	// order, as one all-or-nothing batch: on error nothing in the batch is
+	// persisted, and the error names the album that failed. Albums later in
+	// the batch see the effects of earlier ones, so two new albums with the
+	// same title get different slugs.
+	CreateMany(ctx context.Context, albums []album) ([]album, error)
+	UpdateMany(ctx context.Context, albums []album, regenerateSlug bool) ([]album, error)
+}
+
+// stampCreated sets the timestamps of an album about to be inserted. A
+// CreatedAt supplied by the caller (e.g. from an import) is kept.
+func stampCreated(a *album) {
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = storeTimestamp()
+	}
+	a.UpdatedAt = a.CreatedAt
+}
+
+// stampUpdated carries CreatedAt over from the stored album and bumps UpdatedAt.
+func stampUpdated(a *album, existing album) {
+	a.CreatedAt = existing.CreatedAt
+	a.UpdatedAt = storeTimestamp()
+}
+
+// storeTimestamp is the current time at millisecond precision, the finest
+// MongoDB stores, so every backend returns the same timestamps from a write
+// as it does from later reads.
+func storeTimestamp() time.Time {
+	return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// InMemoryAlbumStore keeps albums in memory, indexed by ID, slug, barcode,
+// and artist. Lookups are O(1) and artist-filtered listings only visit that
+// artist's albums; every index is maintained on mutation under mu.
+type InMemoryAlbumStore struct {
+	mu         sync.RWMutex
+	generation atomic.Uint64    // bumped after every mutation
+	nextEdge   atomic.Int64     // Unix seconds of the next window edge to pass, or 0
+	seq        int              // the last seq handed out; never reused
+	albums     []*inMemoryAlbum // insertion order
+	byID       map[string]*inMemoryAlbum
+	bySlug     map[string]*inMemoryAlbum
+	byBarcode  map[string]*inMemoryAlbum
+	byArtist   map[string][]*inMemoryAlbum // lowercased artist -> albums in insertion order
+	prices     priceLedger
+	changes    changeLog
+	importJobs map[string]importJob
+	// savedSearches are kept by id.
+	savedSearches map[string]savedSearch
+	// paymentEvents maps the ID of each payment event recorded to when its
+	// record expires.
+	paymentEvents map[string]time.Time
+}
+
+// inMemoryAlbum pairs a stored album with its insertion sequence number,
+// which keeps per-artist index lists in the same order as the full list and
+// is the position a listing's cursor holds. An album keeps its seq until it
+// is deleted, however often the indexes are rebuilt.
+type inMemoryAlbum struct {
+	album
+	seq int
+}
+
+func NewInMemoryAlbumStore() *InMemoryAlbumStore {
+	store := &InMemoryAlbumStore{prices: make(priceLedger), importJobs: make(map[string]importJob), savedSearches: make(map[string]savedSearch),
+		paymentEvents: make(map[string]time.Time)}
+	store.changes.publishedThrough = availabilityNow()
+	store.reindex(nil)
+	return store
+}
+
+// Generation implements generationalStore. An album entering or leaving
+// its availability window changes what List returns, so passing the next
+// window edge bumps the generation as a mutation does.
+func (store *InMemoryAlbumStore) Generation() uint64 {
+	if edge := store.nextEdge.Load(); edge != 0 && serverClock.Now().Unix() >= edge {
+		store.passEdge()
+	}
+	return store.generation.Load()
+}
+
+// passEdge bumps the generation for a window edge passed, and finds the
+// next.
+func (store *InMemoryAlbumStore) passEdge() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if edge := store.nextEdge.Load(); edge == 0 || serverClock.Now().Unix() < edge {
+		return // another reader passed it
+	}
+	store.nextEdge.Store(0)
+	for _, e := range store.albums {
+		store.noteWindow(e.album)
+	}
+	store.generation.Add(1)
+}
+
+// noteWindow brings the next window edge forward to the next of a's, if
+// that is sooner. An album that is gone may leave an edge behind, which
+// only costs the listings cached before it. The caller holds mu.
+func (store *InMemoryAlbumStore) noteWindow(a album) {
+	now := serverClock.Now()
+	for _, bound := range []*time.Time{a.AvailableFrom, a.AvailableUntil} {
+		if bound == nil || !bound.After(now) {
+			continue
+		}
+		if edge := store.nextEdge.Load(); edge == 0 || bound.Unix() < edge {
+			store.nextEdge.Store(bound.Unix())
+		}
+	}
+}
+
+func (store *InMemoryAlbumStore) List(ctx context.Context, opts ListOptions) (albumPage, error) {
+	return listPage(ctx, opts, store.scan)
+}
+
+func (store *InMemoryAlbumStore) Iterate(ctx context.Context, opts ListOptions, fn func(album) error) error {
+	return iterate(ctx, opts, store.scan, fn)
+}
+
+// scan implements albumScan a chunk at a time, so that writers only wait
+// for the read lock while a chunk is copied, not while fn runs.
+func (store *InMemoryAlbumStore) scan(ctx context.Context, opts ListOptions, fn func(album, string) error) error {
+	after, resume, err := opts.seqAfter()
+	if err != nil {
+		return err
+	}
+	for {
+		chunk, more := store.chunk(opts, after, resume)
+		for _, e := range chunk {
+			if err := fn(e.album, strconv.Itoa(e.seq)); err != nil {
+				return err
+			}
+		}
+		if !more || len(chunk) == 0 {
+			return nil
+		}
+		after, resume = int64(chunk[len(chunk)-1].seq), true
+	}
+}
+
+// chunk copies the next albums matching opts after seq after, or from the
+// start unless resume, and reports whether any candidates are left.
+func (store *InMemoryAlbumStore) chunk(opts ListOptions, after int64, resume bool) ([]inMemoryAlbum, bool) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	candidates := store.albums
+	if opts.Filter.Artist != "" {
+		candidates = store.byArtist[strings.ToLower(opts.Filter.Artist)]
+	}
+	// Both lists are in seq order.
+	i, step := 0, 1
+	if opts.Newest {
+		i, step = len(candidates)-1, -1
+	}
+	if resume {
+		i = sort.Search(len(candidates), func(i int) bool { return int64(candidates[i].seq) > after })
+		if opts.Newest {
+			i = sort.Search(len(candidates), func(i int) bool { return int64(candidates[i].seq) >= after }) - 1
+		}
+	}
+	var chunk []inMemoryAlbum
+	for ; i >= 0 && i < len(candidates); i += step {
+		if len(chunk) == opts.chunkSize() {
+			return chunk, true
+		}
+		if e := candidates[i]; opts.Filter.matches(e.album) {
+			chunk = append(chunk, *e)
+		}
+	}
+	return chunk, false
+}
+
+// ArtistGroups groups the albums by artist in one pass over the store.
+func (store *InMemoryAlbumStore) ArtistGroups(ctx context.Context, at time.Time) ([]artistGroup, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	var g artistGrouping
+	for _, e := range store.albums {
+		if at.IsZero() || availableAt(e.album, at) {
+			g.add(e.album)
+		}
+	}
+	return g.groups, nil
+}
+
+// PriceHistory implements priceHistorian.
+func (store *InMemoryAlbumStore) PriceHistory(ctx context.Context, albumID string, limit, offset int) ([]PriceChange, int, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	changes, total := store.prices.page(albumID, limit, offset)
+	return changes, total, nil
+}
+
+// Changes implements changeFeeder.
+func (store *InMemoryAlbumStore) Changes(ctx context.Context, since int64, limit int) ([]types.AlbumChange, int64, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.changes.since(since, limit)
+}
+
+// TrimChanges implements changeFeeder.
+func (store *InMemoryAlbumStore) TrimChanges(ctx context.Context, before time.Time) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.changes.trim(before), nil
+}
+
+// Revisions implements revisionKeeper.
+func (store *InMemoryAlbumStore) Revisions(ctx context.Context, from, to time.Time) ([]albumRevision, time.Time, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return store.changes.between(from, to), store.changes.trimmedAt, nil
+}
+
+// OutboxPosition implements outboxKeeper. The position is lost with the rest
+// of the store on restart, so its events are best-effort.
+func (store *InMemoryAlbumStore) OutboxPosition(ctx context.Context) (outboxPosition, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	return outboxPosition{Sent: store.changes.sent, Trimmed: store.changes.trimmed}, nil
+}
+
+// AdvanceOutbox implements outboxKeeper.
+func (store *InMemoryAlbumStore) AdvanceOutbox(ctx context.Context, from, to int64) (bool, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.changes.sent != from {
+		return false, nil
+	}
+	store.changes.sent = to
+	return true, nil
+}
+
+func (store *InMemoryAlbumStore) GetByID(ctx context.Context, id string) (album, error) {
+	return store.lookup(store.byID, id)
+}
+
+func (store *InMemoryAlbumStore) GetBySlug(ctx context.Context, slug string) (album, error) {
+	return store.lookup(store.bySlug, slug)
+}
+
+func (store *InMemoryAlbumStore) GetByBarcode(ctx context.Context, code string) (album, error) {
+	return store.lookup(store.byBarcode, code)
+}
+
+func (store *InMemoryAlbumStore) lookup(index map[string]*inMemoryAlbum, key string) (album, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	if e, ok := index[key]; ok {
+		return e.album, nil
+	}
+	return album{}, errAlbumNotFound
+}
+
+func (store *InMemoryAlbumStore) Create(ctx context.Context, a album) (album, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := checkCatalogRoom(ctx, len(store.albums), 1); err != nil {
+		return album{}, err
+	}
+	a, err := store.create(ctx, a)
+	if err == nil {
+		store.generation.Add(1)
+	}
+	return a, err
+}
+
+func (store *InMemoryAlbumStore) Update(ctx context.Context, a album, regenerateSlug bool) (album, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	a, err := store.update(ctx, a, regenerateSlug)
+	if err == nil {
+		store.generation.Add(1)
+	}
+	return a, err
+}
+
+// CreateMany checks the catalog limit under the batch's lock, before the
+// first album.
+func (store *InMemoryAlbumStore) CreateMany(ctx context.Context, albums []album) ([]album, error) {
+	checked := false
+	return store.batch(albums, func(a album) (album, error) {
+		if !checked {
+			checked = true
+			if err := checkCatalogRoom(ctx, len(store.albums), len(albums)); err != nil {
+				return album{}, err
+			}
+		}
+		return store.create(ctx, a)
+	})
+}
+
+func (store *InMemoryAlbumStore) UpdateMany(ctx context.Context, albums []album, regenerateSlug bool) ([]album, error) {
+	return store.batch(albums, func(a album) (album, error) { return store.update(ctx, a, regenerateSlug) })
+}
+
+// DeleteMany removes the albums and their price history under one lock.
+func (store *InMemoryAlbumStore) DeleteMany(ctx context.Context, ids []string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.requireAll(ids); err != nil {
+		return err
+	}
+	store.remove(ids)
+	store.generation.Add(1)
+	return nil
+}
+
+// MergeAlbums updates the survivor and removes the duplicates under one
+// lock.
+func (store *InMemoryAlbumStore) MergeAlbums(ctx context.Context, survivor album, duplicates []string) (album, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.requireAll(duplicates); err != nil {
+		return album{}, err
+	}
+	merged, err := store.update(ctx, survivor, false)
+	if err != nil {
+		return album{}, err
+	}
+	store.remove(duplicates)
+	store.generation.Add(1)
+	return merged, nil
+}
+
+// requireAll checks that every album in ids is stored. The caller holds mu.
+func (store *InMemoryAlbumStore) requireAll(ids []string) error {
+	for _, id := range ids {
+		if _, ok := store.byID[id]; !ok {
+			return fmt.Errorf("album %s: %w", id, errAlbumNotFound)
+		}
+	}
+	return nil
+}
+
+// remove drops the albums in ids and their price history. The caller holds
+// mu and bumps the generation.
+func (store *InMemoryAlbumStore) remove(ids []string) {
+	doomed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		doomed[id] = true
+	}
+	kept := make([]inMemoryAlbum, 0, len(store.albums)-len(doomed))
+	gone := make(map[string]album, len(doomed))
+	for _, e := range store.albums {
+		if doomed[e.ID] {
+			gone[e.ID] = e.album
+		} else {
+			kept = append(kept, *e)
+		}
+	}
+	store.reindex(kept)
+	for _, id := range ids {
+		if doomed[id] {
+			delete(store.prices, id)
+			delete(doomed, id)
+			before := gone[id]
+			store.changes.record(changeDeleted, id, &before, nil)
+		}
+	}
+}
+
+// batch applies op to each album under one lock. If any fails, the catalog
+// is rebuilt from a snapshot taken beforehand, and the price history and
+// change log put back, so readers never see a partial batch.
+func (store *InMemoryAlbumStore) batch(albums []album, op func(album) (album, error)) ([]album, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	snapshot := make([]inMemoryAlbum, len(store.albums))
+	for i, e := range store.albums {
+		snapshot[i] = *e
+	}
+	// op only appends to the history, so the slices as they are now still
+	// hold the history as it was.
+	prices := maps.Clone(store.prices)
+	head := store.changes.head
+	done := make([]album, 0, len(albums))
+	for _, a := range albums {
+		applied, err := op(a)
+		if err != nil {
+			store.reindex(snapshot)
+			store.prices = prices
+			store.changes.rollback(head)
+			return nil, fmt.Errorf("album %s: %w", a.ID, err)
+		}
+		done = append(done, applied)
+	}
+	store.generation.Add(1)
+	return done, nil
+}
+
+// create inserts a new album. The caller holds mu and bumps the generation.
+func (store *InMemoryAlbumStore) create(ctx context.Context, a album) (album, error) {
+	if _, exists := store.byID[a.ID]; exists {
+		return album{}, errDuplicateAlbum
+	}
+	if _, taken := store.byBarcode[a.Barcode]; a.Barcode != "" && taken {
+		return album{}, errBarcodeTaken
+	}
+	a.Slug = uniqueSlug(slugify(a.Title, a.Artist), store.slugTaken)
+	stampCreated(&a)
+	store.insert(inMemoryAlbum{album: a})
+	store.prices[a.ID] = append(store.prices[a.ID], initialPrice(ctx, a))
+	after := a
+	store.changes.record(changeCreated, a.ID, nil, &after)
+	return a, nil
+}
+
+// update replaces a stored album. The caller holds mu and bumps the
+// generation.
+func (store *InMemoryAlbumStore) update(ctx context.Context, a album, regenerateSlug bool) (album, error) {
+	e, ok := store.byID[a.ID]
+	if !ok {
+		return album{}, errAlbumNotFound
+	}
+	if other, taken := store.byBarcode[a.Barcode]; a.Barcode != "" && taken && other != e {
+		return album{}, errBarcodeTaken
+	}
+	before := e.album
+	stampUpdated(&a, e.album)
+	if change, ok := priceChange(ctx, e.album, a); ok {
+		store.prices[a.ID] = append(store.prices[a.ID], change)
+	}
+	a.Slug = e.Slug
+	if regenerateSlug {
+		delete(store.bySlug, e.Slug)
+		a.Slug = uniqueSlug(slugify(a.Title, a.Artist), store.slugTaken)
+	}
+	if e.Barcode != a.Barcode {
+		delete(store.byBarcode, e.Barcode)
+	}
+	artistChanged := !strings.EqualFold(e.Artist, a.Artist)
+	if artistChanged {
+		store.unindexArtist(e)
+	}
+	e.album = a
+	store.noteWindow(a)
+	if artistChanged {
+		store.indexArtist(e)
+	}
+	store.bySlug[a.Slug] = e
+	if a.Barcode != "" {
+		store.byBarcode[a.Barcode] = e
+	}
+	after := a
+	store.changes.record(changeUpdated, a.ID, &before, &after)
+	return a, nil
+}
+
+func (store *InMemoryAlbumStore) slugTaken(slug string) bool {
+	_, ok := store.bySlug[slug]
+	return ok
+}
+
+// insert appends an album to the catalog and every index, with the next
+// seq unless it already has one. The caller holds mu, has checked
+// uniqueness, and appends in seq order.
+func (store *InMemoryAlbumStore) insert(entry inMemoryAlbum) {
+	if entry.seq == 0 {
+		store.seq++
+		entry.seq = store.seq
+	}
+	e := &entry
+	store.albums = append(store.albums, e)
+	store.byID[e.ID] = e
+	store.bySlug[e.Slug] = e
+	if e.Barcode != "" {
+		store.byBarcode[e.Barcode] = e
+	}
+	store.indexArtist(e)
+	store.noteWindow(e.album)
+}
+
+// indexArtist adds e to its artist's list, keeping the list in insertion
+// order. New albums land at the end; only an artist change on update needs
+// the binary search.
+func (store *InMemoryAlbumStore) indexArtist(e *inMemoryAlbum) {
+	key := strings.ToLower(e.Artist)
+	list := store.byArtist[key]
+	i := sort.Search(len(list), func(i int) bool { return list[i].seq > e.seq })
+	list = append(list, nil)
+	copy(list[i+1:], list[i:])
+	list[i] = e
+	store.byArtist[key] = list
+}
+
+func (store *InMemoryAlbumStore) unindexArtist(e *inMemoryAlbum) {
+	key := strings.ToLower(e.Artist)
+	list := store.byArtist[key]
+	for i, other := range list {
+		if other == e {
+			list = append(list[:i], list[i+1:]...)
+			break
+		}
+	}
+	if len(list) == 0 {
+		delete(store.byArtist, key)
+	} else {
+		store.byArtist[key] = list
+	}
+}
+
+// reindex replaces the catalog with list, rebuilding every index. Albums
+// keep the seqs they have, in order, and the new ones get the next.
+func (store *InMemoryAlbumStore) reindex(list []inMemoryAlbum) {
+	store.albums = make([]*inMemoryAlbum, 0, len(list))
+	store.byID = make(map[string]*inMemoryAlbum, len(list))
+	store.bySlug = make(map[string]*inMemoryAlbum, len(list))
+	store.byBarcode = make(map[string]*inMemoryAlbum)
+	store.byArtist = make(map[string][]*inMemoryAlbum)
+	for _, e := range list {
+		store.insert(e)
+	}
+}
+
+// Import loads albums as-is, keeping their slugs and timestamps. The batch is
+// staged and checked for slug and barcode clashes before the indexes are
+// rebuilt, so a failed import leaves the catalog untouched.
+func (store *InMemoryAlbumStore) Import(ctx context.Context, mode importMode, next func() (album, error)) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var staged []inMemoryAlbum
+	var imported []string // each ID read once, in the order first read
+	read := make(map[string]bool)
+	byID := make(map[string]int)
+	if mode == importMerge {
+		for i, e := range store.albums {
+			staged = append(staged, *e)
+			byID[e.ID] = i
+		}
+	}
+	n := 0
+	for {
+		a, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		if i, ok := byID[a.ID]; ok {
+			staged[i].album = a
+		} else {
+			byID[a.ID] = len(staged)
+			staged = append(staged, inMemoryAlbum{album: a})
+		}
+		if !read[a.ID] {
+			read[a.ID] = true
+			imported = append(imported, a.ID)
+		}
+		n++
+	}
+
+	slugs := make(map[string]bool, len(staged))
+	barcodes := make(map[string]bool)
+	for _, a := range staged {
+		if slugs[a.Slug] {
+			return 0, fmt.Errorf("album %s: %w", a.ID, errSlugTaken)
+		}
+		slugs[a.Slug] = true
+		if a.Barcode == "" {
+			continue
+		}
+		if barcodes[a.Barcode] {
+			return 0, fmt.Errorf("album %s: %w", a.ID, errBarcodeTaken)
+		}
+		barcodes[a.Barcode] = true
+	}
+	previous := store.albums
+	store.reindex(staged)
+	store.recordImport(previous, imported)
+	store.generation.Add(1)
+	return n, nil
+}
+
+// recordImport adds an import to the change log: the albums in previous, the
+// catalog before it, that it dropped are deleted, and each album in imported
+// created or updated. The caller holds mu.
+func (store *InMemoryAlbumStore) recordImport(previous []*inMemoryAlbum, imported []string) {
+	existed := make(map[string]album, len(previous))
+	for _, e := range previous {
+		existed[e.ID] = e.album
+		if _, ok := store.byID[e.ID]; !ok {
+			before := e.album
+			store.changes.record(changeDeleted, e.ID, &before, nil)
+		}
+	}
+	for _, id := range imported {
+		after := store.byID[id].album
+		if before, ok := existed[id]; ok {
+			store.changes.record(changeUpdated, id, &before, &after)
+		} else {
+			store.changes.record(changeCreated, id, nil, &after)
+		}
+	}
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// BreakerAlbumStore guards a database-backed store with a circuit breaker.
+// Successful reads are remembered; while the breaker is open, or when a read
+// fails, the last-known-good copy is returned together with errStaleRead.
+// Writes fail fast with errCircuitOpen while the breaker is open.
+type BreakerAlbumStore struct {
+	backend AlbumStore
+	breaker *circuitBreaker
+
+	mu     sync.Mutex
+	albums map[string]album     // "id:", "slug:", and "barcode:" keys
+	lists  map[string]albumPage // by listKey
+}
+
+// Bounds on the last-known-good cache; a full map is simply started over.
+const (
+	breakerAlbumCacheSize = 10000
+	breakerListCacheSize  = 64
+)
+
+func NewBreakerAlbumStore(store AlbumStore, breaker *circuitBreaker) *BreakerAlbumStore {
+	return &BreakerAlbumStore{backend: store, breaker: breaker, albums: make(map[string]album), lists: make(map[string]albumPage)}
+}
+
+func (store *BreakerAlbumStore) List(ctx context.Context, opts ListOptions) (albumPage, error) {
+	key := listKey(opts)
+	if !store.breaker.allow() {
+		return store.staleList(key, errCircuitOpen)
+	}
+	page, err := store.backend.List(ctx, opts)
+	store.breaker.record(err)
+	if errors.Is(err, errInvalidCursor) {
+		return albumPage{}, err
+	}
+	if err != nil {
+		return store.staleList(key, err)
+	}
+	store.mu.Lock()
+	if len(store.lists) >= breakerListCacheSize {
+		store.lists = make(map[string]albumPage)
+	}
+	store.lists[key] = page
+	store.mu.Unlock()
+	return page, nil
+}
+
+// Iterate has no stale fallback: an export or a backup must be of the
+// catalog as it is. Errors from fn are the caller's and leave the breaker
+// alone.
+func (store *BreakerAlbumStore) Iterate(ctx context.Context, opts ListOptions, fn func(album) error) error {
+	if !store.breaker.allow() {
+		return errCircuitOpen
+	}
+	f := &iterFunc{fn: fn}
+	err := store.backend.Iterate(ctx, opts, f.call)
+	if !f.failed {
+		store.breaker.record(err)
+	}
+	return err
+}
+
+// listKey identifies a page of a listing in the last-known-good cache.
+func listKey(opts ListOptions) string {
+	return fmt.Sprintf("%s\x00%t\x00%d\x00%s", opts.Filter.cacheKey(), opts.Newest, opts.Limit, opts.Cursor)
+}
+
+func (store *BreakerAlbumStore) staleList(key string, err error) (albumPage, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if page, ok := store.lists[key]; ok {
+		return page, errStaleRead
+	}
+	return albumPage{}, err
+}
+
+// Stats falls back to summarizing the last-known-good listing for filter
+// when the backend can't answer.
+func (store *BreakerAlbumStore) Stats(ctx context.Context, filter AlbumFilter) (albumStats, error) {
+	err := errCircuitOpen
+	if store.breaker.allow() {
+		var s albumStats
+		s, err = storeStats(ctx, store.backend, filter)
+		store.breaker.record(err)
+		if err == nil {
+			return s, nil
+		}
+	}
+	page, err := store.staleList(listKey(ListOptions{Filter: filter}), err)
+	if err != nil && !errors.Is(err, errStaleRead) {
+		return albumStats{}, err
+	}
+	return computeAlbumStats(page.Albums), err
+}
+
+// ArtistGroups falls back to grouping the last-known-good listing of every
+// album when the backend can't answer.
+func (store *BreakerAlbumStore) ArtistGroups(ctx context.Context, availableAt time.Time) ([]artistGroup, error) {
+	err := errCircuitOpen
+	if store.breaker.allow() {
+		var groups []artistGroup
+		groups, err = storeArtistGroups(ctx, store.backend, availableAt)
+		store.breaker.record(err)
+		if err == nil {
+			return groups, nil
+		}
+	}
+	page, err := store.staleList(listKey(ListOptions{}), err)
+	if err != nil && !errors.Is(err, errStaleRead) {
+		return nil, err
+	}
+	list := page.Albums
+	if !availableAt.IsZero() {
+		list = availableAlbums(list, availableAt)
+	}
+	return groupArtists(list), err
+}
+
+// Search falls back to filtering the last-known-good listing of every album
+// when the backend can't answer.
+func (store *BreakerAlbumStore) Search(ctx context.Context, query searchNode) ([]album, error) {
+	err := errCircuitOpen
+	if store.breaker.allow() {
+		var list []album
+		list, err = storeSearch(ctx, store.backend, query)
+		store.breaker.record(err)
+		if err == nil {
+			return list, nil
+		}
+	}
+	page, err := store.staleList(listKey(ListOptions{}), err)
+	if err != nil && !errors.Is(err, errStaleRead) {
+		return nil, err
+	}
+	return query.filter(page.Albums), err
+}
+
+func (store *BreakerAlbumStore) GetByID(ctx context.Context, id string) (album, error) {
+	return store.get("id:"+id, func() (album, error) { return store.backend.GetByID(ctx, id) })
+}
+
+// PriceHistory has no stale fallback: the history is only ever read fresh.
+func (store *BreakerAlbumStore) PriceHistory(ctx context.Context, albumID string, limit, offset int) ([]PriceChange, int, error) {
+	if !store.breaker.allow() {
+		return nil, 0, errCircuitOpen
+	}
+	changes, total, err := storePriceHistory(ctx, store.backend, albumID, limit, offset)
+	if !errors.Is(err, errPriceHistoryUnsupported) {
+		store.breaker.record(err)
+	}
+	return changes, total, err
+}
+
+// The change feed has no stale fallback either: a client that missed
+// changes must not be told it has them all.
+func (store *BreakerAlbumStore) Changes(ctx context.Context, since int64, limit int) ([]types.AlbumChange, int64, error) {
+	if !store.breaker.allow() {
+		return nil, 0, errCircuitOpen
+	}
+	changes, head, err := storeChanges(ctx, store.backend, since, limit)
+	if !errors.Is(err, errChangesUnsupported) {
+		store.breaker.record(err)
+	}
+	return changes, head, err
+}
+
+func (store *BreakerAlbumStore) TrimChanges(ctx context.Context, before time.Time) (int, error) {
+	if !store.breaker.allow() {
+		return 0, errCircuitOpen
+	}
+	n, err := storeTrimChanges(ctx, store.backend, before)
+	if !errors.Is(err, errChangesUnsupported) {
+		store.breaker.record(err)
+	}
+	return n, err
+}
+
+func (store *BreakerAlbumStore) OutboxPosition(ctx context.Context) (outboxPosition, error) {
+	if !store.breaker.allow() {
+		return outboxPosition{}, errCircuitOpen
+	}
+	pos, err := storeOutboxPosition(ctx, store.backend)
+	if !errors.Is(err, errOutboxUnsupported) {
+		store.breaker.record(err)
+	}
+	return pos, err
+}
+
+func (store *BreakerAlbumStore) AdvanceOutbox(ctx context.Context, from, to int64) (bool, error) {
+	if !store.breaker.allow() {
+		return false, errCircuitOpen
+	}
+	moved, err := storeAdvanceOutbox(ctx, store.backend, from, to)
+	if !errors.Is(err, errOutboxUnsupported) {
+		store.breaker.record(err)
+	}
+	return moved, err
+}
+
+func (store *BreakerAlbumStore) PublishDue(ctx context.Context, now time.Time) ([]album, error) {
+	if !store.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+	published, err := storePublishDue(ctx, store.backend, now)
+	if !errors.Is(err, errPublishUnsupported) {
+		store.breaker.record(err)
+	}
+	return published, err
+}
+
+func (store *BreakerAlbumStore) Revisions(ctx context.Context, from, to time.Time) ([]albumRevision, time.Time, error) {
+	if !store.breaker.allow() {
+		return nil, time.Time{}, errCircuitOpen
+	}
+	revisions, since, err := storeRevisions(ctx, store.backend, from, to)
+	if !errors.Is(err, errRevisionsUnsupported) {
+		store.breaker.record(err)
+	}
+	return revisions, since, err
+}
+
+func (store *BreakerAlbumStore) AnonymizeAudit(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	if !store.breaker.allow() {
+		return 0, errCircuitOpen
+	}
+	n, err := storeAnonymizeAudit(ctx, store.backend, before, dryRun)
+	if !errors.Is(err, errRetentionUnsupported) {
+		store.breaker.record(err)
+	}
+	return n, err
+}
+
+func (store *BreakerAlbumStore) PruneImportJobs(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	if !store.breaker.allow() {
+		return 0, errCircuitOpen
+	}
+	n, err := storePruneImportJobs(ctx, store.backend, before, dryRun)
+	if !errors.Is(err, errRetentionUnsupported) {
+		store.breaker.record(err)
+	}
+	return n, err
+}
+
+func (store *BreakerAlbumStore) SyncToken(ctx context.Context) (string, error) {
+	if _, ok := store.backend.(syncTokenIssuer); !ok {
+		return "", nil
+	}
+	if !store.breaker.allow() {
+		return "", errCircuitOpen
+	}
+	token, err := storeSyncToken(ctx, store.backend)
+	store.breaker.record(err)
+	return token, err
+}
+
+func (store *BreakerAlbumStore) GetBySlug(ctx context.Context, slug string) (album, error) {
+	return store.get("slug:"+slug, func() (album, error) { return store.backend.GetBySlug(ctx, slug) })
+}
+
+func (store *BreakerAlbumStore) GetByBarcode(ctx context.Context, code string) (album, error) {
+	return store.get("barcode:"+code, func() (album, error) { return store.backend.GetByBarcode(ctx, code) })
+}
+
+func (store *BreakerAlbumStore) get(key string, fetch func() (album, error)) (album, error) {
+	if !store.breaker.allow() {
+		return store.staleAlbum(key, errCircuitOpen)
+	}
+	a, err := fetch()
+	store.breaker.record(err)
+	if isStoreFailure(err) {
+		return store.staleAlbum(key, err)
+	}
+	if err == nil {
+		store.remember(a)
+	}
+	return a, err
+}
+
+func (store *BreakerAlbumStore) staleAlbum(key string, err error) (album, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if a, ok := store.albums[key]; ok {
+		return a, errStaleRead
+	}
+	return album{}, err
+}
+
+func (store *BreakerAlbumStore) remember(a album) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if len(store.albums) >= breakerAlbumCacheSize {
+		store.albums = make(map[string]album)
+	}
+	store.albums["id:"+a.ID] = a
+	store.albums["slug:"+a.Slug] = a
+	if a.Barcode != "" {
+		store.albums["barcode:"+a.Barcode] = a
+	}
+}
+
+func (store *BreakerAlbumStore) Create(ctx context.Context, a album) (album, error) {
+	return store.write(func() (album, error) { return store.backend.Create(ctx, a) })
+}
+
+func (store *BreakerAlbumStore) Update(ctx context.Context, a album, regenerateSlug bool) (album, error) {
+	return store.write(func() (album, error) { return store.backend.Update(ctx, a, regenerateSlug) })
+}
+
+func (store *BreakerAlbumStore) write(do func() (album, error)) (album, error) {
+	if !store.breaker.allow() {
+		return album{}, errCircuitOpen
+	}
+	a, err := do()
+	store.breaker.record(err)
+	if err == nil {
+		store.remember(a)
+	}
+	return a, err
+}
+
+func (store *BreakerAlbumStore) CreateMany(ctx context.Context, albums []album) ([]album, error) {
+	return store.writeMany(func() ([]album, error) { return store.backend.CreateMany(ctx, albums) })
+}
+
+func (store *BreakerAlbumStore) UpdateMany(ctx context.Context, albums []album, regenerateSlug bool) ([]album, error) {
+	return store.writeMany(func() ([]album, error) { return store.backend.UpdateMany(ctx, albums, regenerateSlug) })
+}
+
+func (store *BreakerAlbumStore) writeMany(do func() ([]album, error)) ([]album, error) {
+	if !store.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+	list, err := do()
+	store.breaker.record(err)
+	for _, a := range list {
+		store.remember(a)
+	}
+	return list, err
+}
+
+func (store *BreakerAlbumStore) Import(ctx context.Context, mode importMode, next func() (album, error)) (int, error) {
+	importer, ok := store.backend.(AlbumImporter)
+	if !ok {
+		return 0, errImportUnsupported
+	}
+	if !store.breaker.allow() {
+		return 0, errCircuitOpen
+	}
+	n, err := importer.Import(ctx, mode, next)
+	store.breaker.record(err)
+	store.mu.Lock()
+	store.albums = make(map[string]album)
+	store.lists = make(map[string]albumPage)
+	store.mu.Unlock()
+	return n, err
+}
+
+func (store *BreakerAlbumStore) DeleteMany(ctx context.Context, ids []string) error {
+	deleter, ok := store.backend.(albumDeleter)
+	if !ok {
+		return errDeleteUnsupported
+	}
+	if !store.breaker.allow() {
+		return errCircuitOpen
+	}
+	err := deleter.DeleteMany(ctx, ids)
+	store.breaker.record(err)
+	store.mu.Lock()
+	store.albums = make(map[string]album)
+	store.lists = make(map[string]albumPage)
+	store.mu.Unlock()
+	return err
+}
+
+func (store *BreakerAlbumStore) MergeAlbums(ctx context.Context, survivor album, duplicates []string) (album, error) {
+	merger, ok := store.backend.(albumMerger)
+	if !ok {
+		return album{}, errMergeUnsupported
+	}
+	if !store.breaker.allow() {
+		return album{}, errCircuitOpen
+	}
+	merged, err := merger.MergeAlbums(ctx, survivor, duplicates)
+	store.breaker.record(err)
+	store.mu.Lock()
+	store.albums = make(map[string]album)
+	store.lists = make(map[string]albumPage)
+	store.mu.Unlock()
+	return merged, err
+}
+
+func (store *BreakerAlbumStore) RenameArtist(ctx context.Context, from, to string) ([]album, error) {
+	renamer, ok := store.backend.(artistRenamer)
+	if !ok {
+		return nil, errRenameUnsupported
+	}
+	if !store.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+	renamed, err := renamer.RenameArtist(ctx, from, to)
+	store.breaker.record(err)
+	store.mu.Lock()
+	store.albums = make(map[string]album)
+	store.lists = make(map[string]albumPage)
+	store.mu.Unlock()
+	return renamed, err
+}
+
+func (store *BreakerAlbumStore) SellAlbum(ctx context.Context, id string, quantity int) (album, error) {
+	seller, ok := store.backend.(albumSeller)
+	if !ok {
+		return album{}, errSellUnsupported
+	}
+	if !store.breaker.allow() {
+		return album{}, errCircuitOpen
+	}
+	sold, err := seller.SellAlbum(ctx, id, quantity)
+	store.breaker.record(err)
+	store.mu.Lock()
+	store.albums = make(map[string]album)
+	store.lists = make(map[string]albumPage)
+	store.mu.Unlock()
+	return sold, err
+}
+
+func (store *BreakerAlbumStore) SellAlbumForPayment(ctx context.Context, eventID string, now, expires time.Time, id string, quantity int) (album, error) {
+	events, err := paymentEventsOf(store.backend)
+	if err != nil {
+		return album{}, err
+	}
+	if !store.breaker.allow() {
+		return album{}, errCircuitOpen
+	}
+	sold, err := events.SellAlbumForPayment(ctx, eventID, now, expires, id, quantity)
+	store.breaker.record(err)
+	store.mu.Lock()
+	store.albums = make(map[string]album)
+	store.lists = make(map[string]albumPage)
+	store.mu.Unlock()
+	return sold, err
+}
+
+// PrunePaymentEvents passes straight through: the records aren't albums.
+func (store *BreakerAlbumStore) PrunePaymentEvents(ctx context.Context, now time.Time) (int, error) {
+	events, err := paymentEventsOf(store.backend)
+	if err != nil {
+		return 0, err
+	}
+	return events.PrunePaymentEvents(ctx, now)
+}
+
+// The import job methods pass straight through: a job is not an album,
+// and the import's own album writes go through the breaker.
+
+func (store *BreakerAlbumStore) CreateImportJob(ctx context.Context, job importJob) error {
+	jobs, err := importJobsOf(store.backend)
+	if err != nil {
+		return err
+	}
+	return jobs.CreateImportJob(ctx, job)
+}
+
+func (store *BreakerAlbumStore) GetImportJob(ctx context.Context, id string) (importJob, error) {
+	jobs, err := importJobsOf(store.backend)
+	if err != nil {
+		return importJob{}, err
+	}
+	return jobs.GetImportJob(ctx, id)
+}
+
+func (store *BreakerAlbumStore) SaveImportJobProgress(ctx context.Context, job importJob) error {
+	jobs, err := importJobsOf(store.backend)
+	if err != nil {
+		return err
+	}
+	return jobs.SaveImportJobProgress(ctx, job)
+}
+
+func (store *BreakerAlbumStore) CancelImportJob(ctx context.Context, id string) error {
+	jobs, err := importJobsOf(store.backend)
+	if err != nil {
+		return err
+	}
+	return jobs.CancelImportJob(ctx, id)
+}
+
+// Saved searches pass straight through as well.
+
+func (store *BreakerAlbumStore) CreateSavedSearch(ctx context.Context, s savedSearch) error {
+	searches, err := savedSearchesOf(store.backend)
+	if err != nil {
+		return err
+	}
+	return searches.CreateSavedSearch(ctx, s)
+}
+
+func (store *BreakerAlbumStore) GetSavedSearch(ctx context.Context, id string) (savedSearch, error) {
+	searches, err := savedSearchesOf(store.backend)
+	if err != nil {
+		return savedSearch{}, err
+	}
+	return searches.GetSavedSearch(ctx, id)
+}
+
+func (store *BreakerAlbumStore) ListSavedSearches(ctx context.Context, owner string) ([]savedSearch, error) {
+	searches, err := savedSearchesOf(store.backend)
+	if err != nil {
+		return nil, err
+	}
+	return searches.ListSavedSearches(ctx, owner)
+}
+
+func (store *BreakerAlbumStore) DeleteSavedSearch(ctx context.Context, id string) error {
+	searches, err := savedSearchesOf(store.backend)
+	if err != nil {
+		return err
+	}
+	return searches.DeleteSavedSearch(ctx, id)
+}
+
+func (store *BreakerAlbumStore) Ping(ctx context.Context) error {
+	if p, ok := store.backend.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
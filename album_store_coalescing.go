@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+	"golang.org/x/sync/singleflight"
+)
+
+// CoalescingAlbumStore wraps a database-backed store so that concurrent
+// GetByID calls for the same album share a single backend query. With a
+// non-zero ttl it also keeps a small read-through cache of albums by ID,
+// dropped for an album whenever it is written through this store. Writes
+// made by other processes aren't seen until the entry expires, so keep the
+// ttl short.
+type CoalescingAlbumStore struct {
+	AlbumStore
+	ttl     time.Duration
+	lookups singleflight.Group
+
+	mu     sync.Mutex
+	cache  map[string]cachedAlbum
+	writes uint64 // bumped by every invalidation, see remember
+}
+
+type cachedAlbum struct {
+	album   album
+	expires time.Time
+}
+
+// albumCacheSize bounds the read-through cache; when it fills up, expired
+// entries are swept and, failing that, the cache starts over.
+const albumCacheSize = 1000
+
+func NewCoalescingAlbumStore(store AlbumStore, ttl time.Duration) *CoalescingAlbumStore {
+	return &CoalescingAlbumStore{AlbumStore: store, ttl: ttl, cache: make(map[string]cachedAlbum)}
+}
+
+func (store *CoalescingAlbumStore) GetByID(ctx context.Context, id string) (album, error) {
+	// A read after a write of its own must not get an album cached, or
+	// read by another caller, before the write.
+	if syncTokenFrom(ctx) != "" || primaryReads(ctx) {
+		return store.AlbumStore.GetByID(ctx, id)
+	}
+	if a, ok := store.cached(id); ok {
+		return a, nil
+	}
+	// The lookup is shared, so one caller disconnecting must not cancel it
+	// for the others waiting on it.
+	shared := context.WithoutCancel(ctx)
+	v, err, _ := store.lookups.Do(id, func() (interface{}, error) {
+		store.mu.Lock()
+		writes := store.writes
+		store.mu.Unlock()
+		a, err := store.AlbumStore.GetByID(shared, id)
+		if err == nil {
+			store.remember(a, writes)
+		}
+		return a, err
+	})
+	if err != nil && !errors.Is(err, errStaleRead) {
+		return album{}, err
+	}
+	return v.(album), err
+}
+
+func (store *CoalescingAlbumStore) Update(ctx context.Context, a album, regenerateSlug bool) (album, error) {
+	updated, err := store.AlbumStore.Update(ctx, a, regenerateSlug)
+	store.forget(a.ID)
+	return updated, err
+}
+
+// UpdateMany forgets every album in the batch, whether or not it went
+// through.
+func (store *CoalescingAlbumStore) UpdateMany(ctx context.Context, albums []album, regenerateSlug bool) ([]album, error) {
+	updated, err := store.AlbumStore.UpdateMany(ctx, albums, regenerateSlug)
+	for _, a := range albums {
+		store.forget(a.ID)
+	}
+	return updated, err
+}
+
+func (store *CoalescingAlbumStore) Stats(ctx context.Context, filter AlbumFilter) (albumStats, error) {
+	return storeStats(ctx, store.AlbumStore, filter)
+}
+
+func (store *CoalescingAlbumStore) PriceHistory(ctx context.Context, albumID string, limit, offset int) ([]PriceChange, int, error) {
+	return storePriceHistory(ctx, store.AlbumStore, albumID, limit, offset)
+}
+
+func (store *CoalescingAlbumStore) Changes(ctx context.Context, since int64, limit int) ([]types.AlbumChange, int64, error) {
+	return storeChanges(ctx, store.AlbumStore, since, limit)
+}
+
+func (store *CoalescingAlbumStore) TrimChanges(ctx context.Context, before time.Time) (int, error) {
+	return storeTrimChanges(ctx, store.AlbumStore, before)
+}
+
+func (store *CoalescingAlbumStore) OutboxPosition(ctx context.Context) (outboxPosition, error) {
+	return storeOutboxPosition(ctx, store.AlbumStore)
+}
+
+func (store *CoalescingAlbumStore) AdvanceOutbox(ctx context.Context, from, to int64) (bool, error) {
+	return storeAdvanceOutbox(ctx, store.AlbumStore, from, to)
+}
+
+func (store *CoalescingAlbumStore) PublishDue(ctx context.Context, now time.Time) ([]album, error) {
+	return storePublishDue(ctx, store.AlbumStore, now)
+}
+
+func (store *CoalescingAlbumStore) Revisions(ctx context.Context, from, to time.Time) ([]albumRevision, time.Time, error) {
+	return storeRevisions(ctx, store.AlbumStore, from, to)
+}
+
+func (store *CoalescingAlbumStore) AnonymizeAudit(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	return storeAnonymizeAudit(ctx, store.AlbumStore, before, dryRun)
+}
+
+func (store *CoalescingAlbumStore) PruneImportJobs(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	return storePruneImportJobs(ctx, store.AlbumStore, before, dryRun)
+}
+
+func (store *CoalescingAlbumStore) SyncToken(ctx context.Context) (string, error) {
+	return storeSyncToken(ctx, store.AlbumStore)
+}
+
+func (store *CoalescingAlbumStore) ArtistGroups(ctx context.Context, availableAt time.Time) ([]artistGroup, error) {
+	return storeArtistGroups(ctx, store.AlbumStore, availableAt)
+}
+
+func (store *CoalescingAlbumStore) Search(ctx context.Context, query searchNode) ([]album, error) {
+	return storeSearch(ctx, store.AlbumStore, query)
+}
+
+func (store *CoalescingAlbumStore) Import(ctx context.Context, mode importMode, next func() (album, error)) (int, error) {
+	importer, ok := store.AlbumStore.(AlbumImporter)
+	if !ok {
+		return 0, errImportUnsupported
+	}
+	n, err := importer.Import(ctx, mode, next)
+	store.mu.Lock()
+	store.cache = make(map[string]cachedAlbum)
+	store.writes++
+	store.mu.Unlock()
+	return n, err
+}
+
+func (store *CoalescingAlbumStore) DeleteMany(ctx context.Context, ids []string) error {
+	err := storeDeleteMany(ctx, store.AlbumStore, ids)
+	for _, id := range ids {
+		store.forget(id)
+	}
+	return err
+}
+
+func (store *CoalescingAlbumStore) MergeAlbums(ctx context.Context, survivor album, duplicates []string) (album, error) {
+	merged, err := storeMergeAlbums(ctx, store.AlbumStore, survivor, duplicates)
+	store.forget(survivor.ID)
+	for _, id := range duplicates {
+		store.forget(id)
+	}
+	return merged, err
+}
+
+func (store *CoalescingAlbumStore) RenameArtist(ctx context.Context, from, to string) ([]album, error) {
+	renamed, err := storeRenameArtist(ctx, store.AlbumStore, from, to)
+	for _, a := range renamed {
+		store.forget(a.ID)
+	}
+	return renamed, err
+}
+
+func (store *CoalescingAlbumStore) SellAlbum(ctx context.Context, id string, quantity int) (album, error) {
+	sold, err := storeSellAlbum(ctx, store.AlbumStore, id, quantity)
+	store.forget(id)
+	return sold, err
+}
+
+func (store *CoalescingAlbumStore) SellAlbumForPayment(ctx context.Context, eventID string, now, expires time.Time, id string, quantity int) (album, error) {
+	events, err := paymentEventsOf(store.AlbumStore)
+	if err != nil {
+		return album{}, err
+	}
+	sold, err := events.SellAlbumForPayment(ctx, eventID, now, expires, id, quantity)
+	store.forget(id)
+	return sold, err
+}
+
+func (store *CoalescingAlbumStore) PrunePaymentEvents(ctx context.Context, now time.Time) (int, error) {
+	events, err := paymentEventsOf(store.AlbumStore)
+	if err != nil {
+		return 0, err
+	}
+	return events.PrunePaymentEvents(ctx, now)
+}
+
+func (store *CoalescingAlbumStore) CreateImportJob(ctx context.Context, job importJob) error {
+	jobs, err := importJobsOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return jobs.CreateImportJob(ctx, job)
+}
+
+func (store *CoalescingAlbumStore) GetImportJob(ctx context.Context, id string) (importJob, error) {
+	jobs, err := importJobsOf(store.AlbumStore)
+	if err != nil {
+		return importJob{}, err
+	}
+	return jobs.GetImportJob(ctx, id)
+}
+
+func (store *CoalescingAlbumStore) SaveImportJobProgress(ctx context.Context, job importJob) error {
+	jobs, err := importJobsOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return jobs.SaveImportJobProgress(ctx, job)
+}
+
+func (store *CoalescingAlbumStore) CancelImportJob(ctx context.Context, id string) error {
+	jobs, err := importJobsOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return jobs.CancelImportJob(ctx, id)
+}
+
+func (store *CoalescingAlbumStore) CreateSavedSearch(ctx context.Context, s savedSearch) error {
+	searches, err := savedSearchesOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return searches.CreateSavedSearch(ctx, s)
+}
+
+func (store *CoalescingAlbumStore) GetSavedSearch(ctx context.Context, id string) (savedSearch, error) {
+	searches, err := savedSearchesOf(store.AlbumStore)
+	if err != nil {
+		return savedSearch{}, err
+	}
+	return searches.GetSavedSearch(ctx, id)
+}
+
+func (store *CoalescingAlbumStore) ListSavedSearches(ctx context.Context, owner string) ([]savedSearch, error) {
+	searches, err := savedSearchesOf(store.AlbumStore)
+	if err != nil {
+		return nil, err
+	}
+	return searches.ListSavedSearches(ctx, owner)
+}
+
+func (store *CoalescingAlbumStore) DeleteSavedSearch(ctx context.Context, id string) error {
+	searches, err := savedSearchesOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return searches.DeleteSavedSearch(ctx, id)
+}
+
+func (store *CoalescingAlbumStore) cached(id string) (album, bool) {
+	if store.ttl <= 0 {
+		return album{}, false
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	entry, ok := store.cache[id]
+	if !ok || time.Now().After(entry.expires) {
+		return album{}, false
+	}
+	return entry.album, true
+}
+
+// remember caches a, unless a write went through this store since the
+// lookup that produced it began: the result may predate that write.
+func (store *CoalescingAlbumStore) remember(a album, writesBefore uint64) {
+	if store.ttl <= 0 {
+		return
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.writes != writesBefore {
+		return
+	}
+	now := time.Now()
+	if len(store.cache) >= albumCacheSize {
+		for id, entry := range store.cache {
+			if now.After(entry.expires) {
+				delete(store.cache, id)
+			}
+		}
+		if len(store.cache) >= albumCacheSize {
+			store.cache = make(map[string]cachedAlbum)
+		}
+	}
+	store.cache[a.ID] = cachedAlbum{album: a, expires: now.Add(store.ttl)}
+}
+
+func (store *CoalescingAlbumStore) forget(id string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.cache, id)
+	store.writes++
+}
+
+// setupAlbumCache wraps database-backed stores in a CoalescingAlbumStore,
+// with the read-through cache enabled by ALBUM_CACHE_TTL (e.g. "2s"). The
+// in-memory store is returned as-is; it has nothing to coalesce.
+func setupAlbumCache(cfg *Config, store AlbumStore) AlbumStore {
+	if _, ok := store.(*InMemoryAlbumStore); ok {
+		return store
+	}
+	return NewCoalescingAlbumStore(store, cfg.AlbumCacheTTL)
+}
+
+func (store *CoalescingAlbumStore) Ping(ctx context.Context) error {
+	if p, ok := store.AlbumStore.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
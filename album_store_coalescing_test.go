@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingAlbumStore counts the GetByID calls that reach the store it
+// wraps, holding each until gate is closed.
+type countingAlbumStore struct {
+	AlbumStore
+	gets    atomic.Int32
+	entered chan struct{} // receives once per GetByID call
+	gate    chan struct{}
+}
+
+func newCountingAlbumStore(store AlbumStore) *countingAlbumStore {
+	return &countingAlbumStore{AlbumStore: store, entered: make(chan struct{}, 1000), gate: make(chan struct{})}
+}
+
+func (s *countingAlbumStore) GetByID(ctx context.Context, id string) (album, error) {
+	s.gets.Add(1)
+	s.entered <- struct{}{}
+	<-s.gate
+	return s.AlbumStore.GetByID(ctx, id)
+}
+
+func TestCoalescingGetByID(t *testing.T) {
+	backend, ids := newSizedAlbumStore(t, 1)
+	counting := newCountingAlbumStore(backend)
+	store := NewCoalescingAlbumStore(counting, time.Minute)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a, err := store.GetByID(context.Background(), ids[0])
+			if err == nil && a.ID != ids[0] {
+				t.Errorf("got album %s", a.ID)
+			}
+			errs <- err
+		}()
+	}
+	// The first caller holds the lookup until the gate opens; the rest
+	// either wait on it or, arriving after, find the album cached.
+	<-counting.entered
+	close(counting.gate)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := counting.gets.Load(); n != 1 {
+		t.Errorf("%d store calls for 100 concurrent GETs, want 1", n)
+	}
+
+	// A write through the store drops the cached album.
+	a, _ := backend.GetByID(context.Background(), ids[0])
+	a.Title = "Naima"
+	if _, err := store.Update(context.Background(), a, false); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.GetByID(context.Background(), ids[0])
+	if err != nil || got.Title != "Naima" {
+		t.Errorf("after an update got %q, %v", got.Title, err)
+	}
+	if n := counting.gets.Load(); n != 2 {
+		t.Errorf("%d store calls, want the update to force a second", n)
+	}
+}
+
+func TestCoalescingSurvivesCallerCancel(t *testing.T) {
+	backend, ids := newSizedAlbumStore(t, 1)
+	counting := newCountingAlbumStore(backend)
+	store := NewCoalescingAlbumStore(counting, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := store.GetByID(ctx, ids[0])
+		first <- err
+	}()
+	<-counting.entered
+	second := make(chan error, 1)
+	go func() {
+		_, err := store.GetByID(context.Background(), ids[0])
+		second <- err
+	}()
+	// The first caller gives up; the lookup it started goes on for the
+	// second.
+	cancel()
+	close(counting.gate)
+	<-first
+	if err := <-second; err != nil {
+		t.Errorf("the second caller got %v after the first cancelled", err)
+	}
+}
+
+func TestCoalescingSkipsReadYourWrites(t *testing.T) {
+	backend, ids := newSizedAlbumStore(t, 1)
+	counting := newCountingAlbumStore(backend)
+	close(counting.gate)
+	store := NewCoalescingAlbumStore(counting, time.Minute)
+	ctx := context.Background()
+	store.GetByID(ctx, ids[0])
+	store.GetByID(withPrimaryReads(ctx), ids[0])
+	if n := counting.gets.Load(); n != 2 {
+		t.Errorf("%d store calls, want a primary read to bypass the cache", n)
+	}
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/money"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gorm.io/gorm"
+)
+
+// albumStoreBackends opens each AlbumStore implementation, empty, for the
+// conformance suite. A backend needing a database server skips the test
+// without one; a new backend only needs an entry here.
+var albumStoreBackends = []struct {
+	name string
+	open func(t testing.TB) AlbumStore
+}{
+	{"memory", func(t testing.TB) AlbumStore { return NewInMemoryAlbumStore() }},
+	{"sqlite", func(t testing.TB) AlbumStore {
+		store, err := NewSqliteAlbumStore(testSQLiteStores(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}},
+	{"postgres", func(t testing.TB) AlbumStore {
+		store, err := NewPostgresAlbumStore(testPostgresPool(t), defaultPostgresQueryTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}},
+	{"mongodb", func(t testing.TB) AlbumStore {
+		db := testMongoDatabase(t)
+		store, err := NewMongoAlbumStore(db.Collection("albums"), db.Collection("auditLog"), db.Collection("importJobs"), db.Collection("savedSearches"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}},
+	{"dynamodb", func(t testing.TB) AlbumStore {
+		return NewDynamoAlbumStore(testDynamoClient(t), defaultDynamoTimeout, 0, 0)
+	}},
+}
+
+// metricsStoreBackends is albumStoreBackends for MetricsStore.
+var metricsStoreBackends = []struct {
+	name string
+	open func(t testing.TB) MetricsStore
+}{
+	{"memory", func(t testing.TB) MetricsStore { return &InMemoryMetricsStore{} }},
+	{"sqlite", func(t testing.TB) MetricsStore { return NewSqliteMetricsStore(testSQLiteStores(t)) }},
+	{"postgres", func(t testing.TB) MetricsStore { return NewPostgresMetricsStore(testPostgresPool(t)) }},
+	{"mongodb", func(t testing.TB) MetricsStore {
+		db := testMongoDatabase(t)
+		return NewMongoMetricsStore(db.Collection("metrics"), db.Collection("clientMetrics"), db.Collection("metricsHistory"))
+	}},
+	{"dynamodb", func(t testing.TB) MetricsStore { return NewDynamoMetricsStore(testDynamoClient(t)) }},
+}
+
+// testSQLiteStores returns a scratch SQLite database migrated up, as main
+// sets it up.
+func testSQLiteStores(t testing.TB) *gorm.DB {
+	t.Helper()
+	db := testSQLiteDB(t)
+	sqlDB, _ := db.DB()
+	migrations, err := loadMigrations("sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrateUp(context.Background(), sqliteMigrations{db: sqlDB}, migrations); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// testMongoDatabase returns a database of its own on the server at
+// TEST_MONGODB_URI, dropped when t ends, skipping t without one.
+func testMongoDatabase(t testing.TB) *mongo.Database {
+	t.Helper()
+	uri := os.Getenv("TEST_MONGODB_URI")
+	if uri == "" {
+		t.Skip("TEST_MONGODB_URI is not set")
+	}
+	ctx := context.Background()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database(fmt.Sprintf("test_%d", rand.Int63()))
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	return db
+}
+
+func TestAlbumStoreConformance(t *testing.T) {
+	for _, b := range albumStoreBackends {
+		t.Run(b.name, func(t *testing.T) { RunAlbumStoreTests(t, b.open) })
+	}
+}
+
+func TestMetricsStoreConformance(t *testing.T) {
+	for _, b := range metricsStoreBackends {
+		t.Run(b.name, func(t *testing.T) { RunMetricsStoreTests(t, b.open) })
+	}
+}
+
+// RunAlbumStoreTests checks the AlbumStore contract against stores opened
+// by open, a fresh one for each subtest.
+func RunAlbumStoreTests(t *testing.T, open func(t testing.TB) AlbumStore) {
+	ctx := context.Background()
+	create := func(t *testing.T, store AlbumStore, opts ...func(*album)) album {
+		t.Helper()
+		a, err := store.Create(ctx, newTestAlbum(append([]func(*album){withID(newAlbumID())}, opts...)...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	ids := func(list []album) []string {
+		out := make([]string, len(list))
+		for i, a := range list {
+			out[i] = a.ID
+		}
+		return out
+	}
+	expectIDs := func(t *testing.T, what string, got []album, want ...album) {
+		t.Helper()
+		if fmt.Sprint(ids(got)) != fmt.Sprint(ids(want)) {
+			t.Errorf("%s = %v, want %v", what, ids(got), ids(want))
+		}
+	}
+
+	t.Run("create and get", func(t *testing.T) {
+		store := open(t)
+		a := create(t, store, withBarcode("036000291452"))
+		if a.Slug != "blue-train-john-coltrane" || a.CreatedAt.IsZero() || !a.UpdatedAt.Equal(a.CreatedAt) {
+			t.Errorf("created %+v, want a slug and equal timestamps", a)
+		}
+		for name, get := range map[string]func() (album, error){
+			"GetByID":      func() (album, error) { return store.GetByID(ctx, a.ID) },
+			"GetBySlug":    func() (album, error) { return store.GetBySlug(ctx, a.Slug) },
+			"GetByBarcode": func() (album, error) { return store.GetByBarcode(ctx, a.Barcode) },
+		} {
+			got, err := get()
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+				continue
+			}
+			if got.ID != a.ID || got.Title != a.Title || got.Price != a.Price || got.Year != a.Year ||
+				!got.CreatedAt.Equal(a.CreatedAt) || !got.UpdatedAt.Equal(a.UpdatedAt) {
+				t.Errorf("%s = %+v, want %+v as created", name, got, a)
+			}
+		}
+		for name, get := range map[string]func() (album, error){
+			"GetByID":                 func() (album, error) { return store.GetByID(ctx, "missing") },
+			"GetBySlug":               func() (album, error) { return store.GetBySlug(ctx, "missing") },
+			"GetByBarcode":            func() (album, error) { return store.GetByBarcode(ctx, "4006381333931") },
+			"GetByBarcode of no code": func() (album, error) { return store.GetByBarcode(ctx, "") },
+		} {
+			if _, err := get(); !errors.Is(err, errAlbumNotFound) {
+				t.Errorf("%s of a missing album = %v, want errAlbumNotFound", name, err)
+			}
+		}
+	})
+
+	t.Run("create conflicts", func(t *testing.T) {
+		store := open(t)
+		a := create(t, store, withBarcode("036000291452"))
+		if _, err := store.Create(ctx, newTestAlbum(withID(a.ID), withTitle("Giant Steps"))); !errors.Is(err, errConflict) {
+			t.Errorf("Create with a taken ID = %v, want errConflict", err)
+		}
+		if _, err := store.Create(ctx, newTestAlbum(withID(newAlbumID()), withBarcode("036000291452"))); !errors.Is(err, errBarcodeTaken) {
+			t.Errorf("Create with a taken barcode = %v, want errBarcodeTaken", err)
+		}
+		if second := create(t, store); second.Slug != a.Slug+"-2" {
+			t.Errorf("the second Blue Train's slug = %q, want %q", second.Slug, a.Slug+"-2")
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		store := open(t)
+		a := create(t, store)
+		time.Sleep(2 * time.Millisecond)
+		changed := a
+		changed.Title, changed.Price = "Lush Life", money.FromCents(4999)
+		updated, err := store.Update(ctx, changed, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.Slug != a.Slug || !updated.CreatedAt.Equal(a.CreatedAt) || !updated.UpdatedAt.After(a.UpdatedAt) {
+			t.Errorf("updated %+v from %+v, want the slug and CreatedAt kept and UpdatedAt bumped", updated, a)
+		}
+		if got, err := store.GetByID(ctx, a.ID); err != nil || got.Title != "Lush Life" || got.Price != changed.Price {
+			t.Errorf("GetByID after Update = %+v, %v", got, err)
+		}
+		if updated, err = store.Update(ctx, changed, true); err != nil || updated.Slug != "lush-life-john-coltrane" {
+			t.Errorf("Update regenerating the slug = %q, %v; want lush-life-john-coltrane", updated.Slug, err)
+		}
+
+		// Update is never an upsert.
+		missing := newTestAlbum(withID(newAlbumID()))
+		if _, err := store.Update(ctx, missing, false); !errors.Is(err, errAlbumNotFound) {
+			t.Errorf("Update of a missing album = %v, want errAlbumNotFound", err)
+		}
+		if _, err := store.GetByID(ctx, missing.ID); !errors.Is(err, errAlbumNotFound) {
+			t.Errorf("Update of a missing album created it: %v", err)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		store := open(t)
+		page, err := store.List(ctx, ListOptions{})
+		if err != nil || page.Albums == nil || len(page.Albums) != 0 {
+			t.Fatalf("List of an empty store = %#v, %v; want an empty, non-nil list", page.Albums, err)
+		}
+		blue := create(t, store)
+		giant := create(t, store, withTitle("Giant Steps"), withPrice(1999))
+		kind := create(t, store, withTitle("Kind of Blue"), withArtist("Miles Davis"), withPrice(2499))
+		bitches := create(t, store, withTitle("Bitches Brew"), withArtist("Miles Davis"), withPrice(3499), func(a *album) { a.Genre = "Fusion" })
+
+		page, err = store.List(ctx, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectIDs(t, "List", page.Albums, blue, giant, kind, bitches)
+		page, _ = store.List(ctx, ListOptions{Newest: true})
+		expectIDs(t, "List newest first", page.Albums, bitches, kind, giant, blue)
+
+		low, high := 20.0, 30.0
+		for _, tc := range []struct {
+			name   string
+			filter AlbumFilter
+			want   []album
+		}{
+			{"by artist, in any case", AlbumFilter{Artist: "miles davis"}, []album{kind, bitches}},
+			{"by genre", AlbumFilter{Genre: "fusion"}, []album{bitches}},
+			{"by price", AlbumFilter{MinPrice: &low, MaxPrice: &high}, []album{kind}},
+			{"by search", AlbumFilter{Query: "blue"}, []album{blue, kind}},
+			{"by nothing that matches", AlbumFilter{Artist: "Sonny Rollins"}, nil},
+		} {
+			page, err := store.List(ctx, ListOptions{Filter: tc.filter})
+			if err != nil {
+				t.Errorf("List %s: %v", tc.name, err)
+				continue
+			}
+			expectIDs(t, "List "+tc.name, page.Albums, tc.want...)
+		}
+
+		// Pages cover every album once, in order.
+		var paged []album
+		opts := ListOptions{Limit: 3}
+		for i := 0; ; i++ {
+			page, err := store.List(ctx, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i > 4 {
+				t.Fatal("paging never ends")
+			}
+			paged = append(paged, page.Albums...)
+			if page.NextCursor == "" {
+				break
+			}
+			opts.Cursor = page.NextCursor
+		}
+		expectIDs(t, "List in pages of 3", paged, blue, giant, kind, bitches)
+		if _, err := store.List(ctx, ListOptions{Cursor: "not-a-cursor"}); !errors.Is(err, errInvalidCursor) {
+			t.Errorf("List with a bad cursor = %v, want errInvalidCursor", err)
+		}
+
+		var iterated []album
+		err = store.Iterate(ctx, ListOptions{Filter: AlbumFilter{Artist: "Miles Davis"}}, func(a album) error {
+			iterated = append(iterated, a)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(iterated) != 2 {
+			t.Errorf("Iterate by artist = %v, want the 2 Miles Davis albums", ids(iterated))
+		}
+		stop := errors.New("stop")
+		if err := store.Iterate(ctx, ListOptions{}, func(album) error { return stop }); err != stop {
+			t.Errorf("Iterate = %v, want fn's error", err)
+		}
+	})
+
+	t.Run("batches are all or nothing", func(t *testing.T) {
+		store := open(t)
+		taken := create(t, store, withBarcode("036000291452"))
+		// The failure comes mid-batch, after more albums than a Dynamo
+		// transaction holds, so the writes before it have to be undone.
+		batch := make([]album, 30)
+		for i := range batch {
+			batch[i] = newTestAlbum(withID(newAlbumID()), withTitle(fmt.Sprintf("Giant Steps %d", i)))
+		}
+		batch[20].Barcode = taken.Barcode
+		_, err := store.CreateMany(ctx, batch)
+		if !errors.Is(err, errBarcodeTaken) {
+			t.Errorf("CreateMany with a taken barcode = %v, want errBarcodeTaken", err)
+		}
+		for _, a := range batch[:20] {
+			if _, err := store.GetByID(ctx, a.ID); !errors.Is(err, errAlbumNotFound) {
+				t.Fatalf("a failed CreateMany left %s behind: %v", a.ID, err)
+			}
+		}
+		created, err := store.CreateMany(ctx, []album{newTestAlbum(withID(newAlbumID())), newTestAlbum(withID(newAlbumID()))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created[0].Slug == created[1].Slug {
+			t.Errorf("a batch gave two albums the slug %q", created[0].Slug)
+		}
+		page, err := store.List(ctx, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectIDs(t, "List after the batches", page.Albums, taken, created[0], created[1])
+
+		missing := newTestAlbum(withID(newAlbumID()))
+		renamed := taken
+		renamed.Title = "Lush Life"
+		if _, err := store.UpdateMany(ctx, []album{renamed, missing}, false); !errors.Is(err, errAlbumNotFound) {
+			t.Errorf("UpdateMany with a missing album = %v, want errAlbumNotFound", err)
+		}
+		if got, _ := store.GetByID(ctx, taken.ID); got.Title != taken.Title {
+			t.Errorf("a failed UpdateMany renamed %s to %q", taken.ID, got.Title)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		store := open(t)
+		if _, ok := store.(albumDeleter); !ok {
+			t.Skip("the store can't delete albums")
+		}
+		a, b := create(t, store), create(t, store, withTitle("Giant Steps"))
+		if err := storeDeleteMany(ctx, store, []string{a.ID, "missing"}); !errors.Is(err, errAlbumNotFound) {
+			t.Errorf("DeleteMany with a missing album = %v, want errAlbumNotFound", err)
+		}
+		if _, err := store.GetByID(ctx, a.ID); err != nil {
+			t.Errorf("a failed DeleteMany deleted %s: %v", a.ID, err)
+		}
+		if err := storeDeleteMany(ctx, store, []string{a.ID}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := store.GetByID(ctx, a.ID); !errors.Is(err, errAlbumNotFound) {
+			t.Errorf("GetByID of a deleted album = %v, want errAlbumNotFound", err)
+		}
+		if _, err := store.GetBySlug(ctx, a.Slug); !errors.Is(err, errAlbumNotFound) {
+			t.Errorf("GetBySlug of a deleted album = %v, want errAlbumNotFound", err)
+		}
+		page, err := store.List(ctx, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectIDs(t, "List after a delete", page.Albums, b)
+	})
+
+	t.Run("concurrent creates", func(t *testing.T) {
+		store := open(t)
+		const n = 20
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := store.Create(ctx, newTestAlbum(withID(newAlbumID()))); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		page, err := store.List(ctx, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		slugs := map[string]bool{}
+		for _, a := range page.Albums {
+			slugs[a.Slug] = true
+		}
+		if len(page.Albums) != n || len(slugs) != n {
+			t.Errorf("%d albums with %d slugs after %d concurrent creates, want %d of each", len(page.Albums), len(slugs), n, n)
+		}
+	})
+
+	t.Run("concurrent creates at the catalog limit", func(t *testing.T) {
+		store := open(t)
+		const limit, n = 10, 20
+		for i := 0; i < limit-3; i++ {
+			create(t, store)
+		}
+		limited := withCatalogLimit(ctx, limit)
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		created, refused := 0, 0
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				var err error
+				if i%2 == 0 {
+					_, err = store.Create(limited, newTestAlbum(withID(newAlbumID())))
+				} else {
+					_, err = store.CreateMany(limited, []album{newTestAlbum(withID(newAlbumID()))})
+				}
+				var full *catalogFullError
+				mu.Lock()
+				defer mu.Unlock()
+				switch {
+				case err == nil:
+					created++
+				case errors.As(err, &full):
+					refused++
+					if full.limit != limit || full.count != limit {
+						t.Errorf("refused with %+v, want a full catalog of %d", full, limit)
+					}
+				default:
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		if created != 3 || refused != n-3 {
+			t.Errorf("%d created and %d refused, want 3 and %d", created, refused, n-3)
+		}
+		page, err := store.List(ctx, ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Albums) != limit {
+			t.Errorf("%d albums, want the limit of %d", len(page.Albums), limit)
+		}
+	})
+
+	t.Run("payment events", func(t *testing.T) {
+		store := open(t)
+		events, err := paymentEventsOf(store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a := create(t, store, func(a *album) { a.Stock = 5 })
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		sell := func(eventID, id string, at time.Time) (album, error) {
+			return events.SellAlbumForPayment(ctx, eventID, at, at.Add(time.Hour), id, 2)
+		}
+		if sold, err := sell("evt_1", a.ID, now); err != nil || sold.Stock != 3 {
+			t.Fatalf("the first delivery sold %+v, %v; want 3 left", sold, err)
+		}
+		if _, err := sell("evt_1", a.ID, now.Add(time.Minute)); !errors.Is(err, errDuplicatePaymentEvent) {
+			t.Errorf("the redelivery = %v, want errDuplicatePaymentEvent", err)
+		}
+		// An unknown album or too little stock keeps the event recorded.
+		if _, err := sell("evt_2", "missing", now); !errors.Is(err, errAlbumNotFound) {
+			t.Errorf("an event for a missing album = %v, want errAlbumNotFound", err)
+		}
+		if _, err := sell("evt_3", a.ID, now); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := sell("evt_4", a.ID, now); !errors.Is(err, errOutOfStock) {
+			t.Errorf("an event for more than are left = %v, want errOutOfStock", err)
+		}
+		for _, id := range []string{"evt_2", "evt_4"} {
+			if _, err := sell(id, a.ID, now); !errors.Is(err, errDuplicatePaymentEvent) {
+				t.Errorf("redelivering %s = %v, want errDuplicatePaymentEvent", id, err)
+			}
+		}
+		if got, err := store.GetByID(ctx, a.ID); err != nil || got.Stock != 1 {
+			t.Errorf("stock %d, %v after the sales; want 1", got.Stock, err)
+		}
+
+		// Once expired, a record is pruned, and an event with its ID is new.
+		if n, err := events.PrunePaymentEvents(ctx, now.Add(time.Hour)); err != nil || n != 4 {
+			t.Errorf("PrunePaymentEvents = %d, %v; want the 4 records", n, err)
+		}
+		if _, err := sell("evt_1", a.ID, now.Add(2*time.Hour)); !errors.Is(err, errOutOfStock) {
+			t.Errorf("evt_1 after its record expired = %v, want errOutOfStock", err)
+		}
+		if n, err := events.PrunePaymentEvents(ctx, now.Add(2*time.Hour)); err != nil || n != 0 {
+			t.Errorf("PrunePaymentEvents of the live record = %d, %v; want 0", n, err)
+		}
+	})
+}
+
+// RunMetricsStoreTests checks the MetricsStore contract against stores
+// opened by open.
+func RunMetricsStoreTests(t *testing.T, open func(t testing.TB) MetricsStore) {
+	ctx := context.Background()
+	store := open(t)
+	if m, err := store.LoadMetrics(ctx); err != nil || m != (Metrics{}) {
+		t.Errorf("LoadMetrics of an empty store = %+v, %v; want zeros", m, err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := store.AddMetrics(ctx, Metrics{TotalRequests: 5, TotalErrors: 1, TotalLatencyMs: 40}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m, err := store.LoadMetrics(ctx); err != nil || m != (Metrics{TotalRequests: 10, TotalErrors: 2, TotalLatencyMs: 80}) {
+		t.Errorf("LoadMetrics = %+v, %v; want the deltas added up", m, err)
+	}
+
+	seen := time.Date(2026, time.March, 2, 12, 0, 0, 0, time.UTC)
+	deltas := []ClientMetrics{{Client: "203.0.113.7", Requests: 3, LastSeen: seen}, {Client: "198.51.100.2", Requests: 1, Errors: 1, LastSeen: seen}}
+	for i := 0; i < 2; i++ {
+		if err := store.AddClientMetrics(ctx, deltas, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clients, err := store.LoadClientMetrics(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byClient := map[string]ClientMetrics{}
+	for _, c := range clients {
+		byClient[c.Client] = c
+	}
+	if c := byClient["203.0.113.7"]; c.Requests != 6 || !c.LastSeen.Equal(seen) {
+		t.Errorf("client 203.0.113.7 = %+v, want 6 requests last seen %v", c, seen)
+	}
+	if c := byClient["198.51.100.2"]; c.Requests != 2 || c.Errors != 2 {
+		t.Errorf("client 198.51.100.2 = %+v, want 2 requests and 2 errors", c)
+	}
+}
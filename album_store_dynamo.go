@@ -0,0 +1,786 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/brentmzey/web-service-go/money"
+)
+
+const dynamoAlbumsTable = "albums"
+
+// Item kinds stored in the albums table. Besides the album items themselves,
+// every slug and barcode gets a marker item whose key is "slug#<slug>" or
+// "barcode#<code>". Markers are written in the same transaction as the album
+// with attribute_not_exists conditions, which is what makes the values unique,
+// and they double as an O(1) index for lookups.
+const (
+	dynamoKindAlbum   = "album"
+	dynamoKindSlug    = "slug"
+	dynamoKindBarcode = "barcode"
+)
+
+type dynamoAlbum struct {
+	ID     string  `dynamodbav:"id"`
+	Kind   string  `dynamodbav:"kind"`
+	Title  string  `dynamodbav:"title"`
+	Artist string  `dynamodbav:"artist"`
+	Price  float64 `dynamodbav:"price"`
+	Genre  string  `dynamodbav:"genre,omitempty"`
+	// Lowercased copies of artist and genre; DynamoDB filter expressions
+	// can't compare case-insensitively.
+	ArtistKey string   `dynamodbav:"artistKey"`
+	GenreKey  string   `dynamodbav:"genreKey,omitempty"`
+	Slug      string   `dynamodbav:"slug"`
+	Barcode   string   `dynamodbav:"barcode,omitempty"`
+	Year      int      `dynamodbav:"year,omitempty"`
+	Tracks    []string `dynamodbav:"tracks,omitempty"`
+	Seq       int64    `dynamodbav:"seq"`
+	// Metadata is a map attribute; filters compare its members directly.
+	Metadata map[string]string `dynamodbav:"metadata,omitempty"`
+	Stock    int               `dynamodbav:"stock"`
+
+	CreatedAt time.Time `dynamodbav:"createdAt"`
+	UpdatedAt time.Time `dynamodbav:"updatedAt"`
+	// The window is stored as RFC 3339 in UTC to the second, so it compares
+	// as text.
+	AvailableFrom  *time.Time `dynamodbav:"availableFrom,omitempty"`
+	AvailableUntil *time.Time `dynamodbav:"availableUntil,omitempty"`
+	// SearchKey is searchKey of the title and artist, which a scan filters
+	// a search on. Items an older version wrote have none.
+	SearchKey string `dynamodbav:"searchKey,omitempty"`
+}
+
+type dynamoMarker struct {
+	ID      string `dynamodbav:"id"`
+	Kind    string `dynamodbav:"kind"`
+	AlbumID string `dynamodbav:"albumId"`
+}
+
+func (item dynamoAlbum) album() album {
+	return album{
+		ID: item.ID, Title: item.Title, Artist: item.Artist, Price: money.FromFloat(item.Price), Genre: item.Genre, Slug: item.Slug,
+		Barcode: item.Barcode, Year: item.Year, Tracks: item.Tracks, Metadata: item.Metadata, Stock: item.Stock,
+		CreatedAt: item.CreatedAt.UTC(), UpdatedAt: item.UpdatedAt.UTC(),
+		AvailableFrom: availabilityTime(item.AvailableFrom), AvailableUntil: availabilityTime(item.AvailableUntil),
+	}
+}
+
+// DynamoAlbumStore keeps albums in a DynamoDB table. Transient failures are
+// retried by the client's own retryer (see newDynamoClient), so this store is
+// not wrapped in RetryingAlbumStore. Single items are read through reads,
+// which may hedge them (see hedgedGetter).
+type DynamoAlbumStore struct {
+	client  *dynamodb.Client
+	reads   dynamoItemGetter
+	timeout time.Duration // per-operation deadline
+}
+
+// NewDynamoAlbumStore returns a store whose item reads are hedged after
+// hedgeAfter, at most hedgeMaxPercent of them; 0 doesn't hedge them.
+func NewDynamoAlbumStore(client *dynamodb.Client, timeout, hedgeAfter time.Duration, hedgeMaxPercent int) *DynamoAlbumStore {
+	return &DynamoAlbumStore{client: client, reads: newHedgedGetter(client, hedgeAfter, hedgeMaxPercent), timeout: timeout}
+}
+
+func (store *DynamoAlbumStore) opContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, store.timeout)
+}
+
+// List scans the whole table, as DynamoDB can't order a scan, and pages
+// through the matches by seq.
+func (store *DynamoAlbumStore) List(ctx context.Context, opts ListOptions) (albumPage, error) {
+	return listPage(ctx, opts, store.sortedScan)
+}
+
+// Iterate streams the matches a scan page at a time in the table's own
+// order, which is not insertion order: nothing in DynamoDB can sort them
+// without reading them all. opts.Newest is ignored, and a cursor from List
+// still skips the albums up to it.
+func (store *DynamoAlbumStore) Iterate(ctx context.Context, opts ListOptions, fn func(album) error) error {
+	return store.scan(ctx, opts, func(item dynamoAlbum) error { return fn(item.album()) })
+}
+
+// sortedScan implements albumScan: it collects the matches after the
+// cursor and puts them in seq order.
+func (store *DynamoAlbumStore) sortedScan(ctx context.Context, opts ListOptions, fn func(album, string) error) error {
+	var items []dynamoAlbum
+	err := store.scan(ctx, opts, func(item dynamoAlbum) error {
+		items = append(items, item)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Scans come back in hash order; seq restores insertion order.
+	sort.Slice(items, func(i, j int) bool {
+		if opts.Newest {
+			return items[i].Seq > items[j].Seq
+		}
+		return items[i].Seq < items[j].Seq
+	})
+	for _, item := range items {
+		if err := fn(item.album(), strconv.FormatInt(item.Seq, 10)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan calls fn with each album item matching opts after its cursor, a scan
+// page at a time, each page under its own deadline.
+func (store *DynamoAlbumStore) scan(ctx context.Context, opts ListOptions, fn func(dynamoAlbum) error) error {
+	filter := opts.Filter
+	conds := []string{"#kind = :album"}
+	values := map[string]types.AttributeValue{":album": &types.AttributeValueMemberS{Value: dynamoKindAlbum}}
+	after, ok, err := opts.seqAfter()
+	if err != nil {
+		return err
+	}
+	if ok {
+		cmp := ">"
+		if opts.Newest {
+			cmp = "<"
+		}
+		conds = append(conds, "seq "+cmp+" :after")
+		values[":after"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(after, 10)}
+	}
+	if filter.Artist != "" {
+		conds = append(conds, "artistKey = :artist")
+		values[":artist"] = &types.AttributeValueMemberS{Value: strings.ToLower(filter.Artist)}
+	}
+	if filter.Genre != "" {
+		conds = append(conds, "genreKey = :genre")
+		values[":genre"] = &types.AttributeValueMemberS{Value: strings.ToLower(filter.Genre)}
+	}
+	if filter.MinPrice != nil {
+		conds = append(conds, "price >= :minPrice")
+		values[":minPrice"] = &types.AttributeValueMemberN{Value: strconv.FormatFloat(*filter.MinPrice, 'f', -1, 64)}
+	}
+	if filter.MaxPrice != nil {
+		conds = append(conds, "price <= :maxPrice")
+		values[":maxPrice"] = &types.AttributeValueMemberN{Value: strconv.FormatFloat(*filter.MaxPrice, 'f', -1, 64)}
+	}
+	if !filter.AvailableAt.IsZero() {
+		conds = append(conds, "(attribute_not_exists(availableFrom) OR availableFrom <= :availableAt)",
+			"(attribute_not_exists(availableUntil) OR availableUntil > :availableAt)")
+		values[":availableAt"] = &types.AttributeValueMemberS{Value: filter.AvailableAt.UTC().Format(time.RFC3339)}
+	}
+
+	// A search is narrowed on the search keys; an item an older version
+	// wrote has none and isn't.
+	for i, term := range searchTerms(filter.Query) {
+		conds = append(conds, fmt.Sprintf("(attribute_not_exists(searchKey) OR contains(searchKey, :term%d))", i))
+		values[fmt.Sprintf(":term%d", i)] = &types.AttributeValueMemberS{Value: " " + term}
+	}
+
+	names := map[string]string{"#kind": "kind"}
+	i := 0
+	for key, value := range filter.Metadata {
+		names["#metadata"] = "metadata"
+		conds = append(conds, fmt.Sprintf("#metadata.#meta%d = :meta%d", i, i))
+		names[fmt.Sprintf("#meta%d", i)] = key
+		values[fmt.Sprintf(":meta%d", i)] = &types.AttributeValueMemberS{Value: value}
+		i++
+	}
+
+	pages := dynamodb.NewScanPaginator(store.client, &dynamodb.ScanInput{
+		TableName:                 aws.String(dynamoAlbumsTable),
+		FilterExpression:          aws.String(strings.Join(conds, " AND ")),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	// The collation of the request has the final say on a search.
+	search := filter.search()
+	for pages.HasMorePages() {
+		pageCtx, cancel := store.opContext(ctx)
+		page, err := pages.NextPage(pageCtx)
+		cancel()
+		if err != nil {
+			return err
+		}
+		var batch []dynamoAlbum
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &batch); err != nil {
+			return fmt.Errorf("decoding DynamoDB albums: %w", err)
+		}
+		for _, item := range batch {
+			if !search.matches(item.album()) {
+				continue
+			}
+			if err := fn(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (store *DynamoAlbumStore) GetByID(ctx context.Context, id string) (album, error) {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	return store.getAlbum(ctx, id)
+}
+
+func (store *DynamoAlbumStore) getAlbum(ctx context.Context, id string) (album, error) {
+	var item dynamoAlbum
+	found, err := store.getItem(ctx, id, &item)
+	if err != nil {
+		return album{}, err
+	}
+	if !found || item.Kind != dynamoKindAlbum {
+		return album{}, errAlbumNotFound
+	}
+	return item.album(), nil
+}
+
+func (store *DynamoAlbumStore) GetBySlug(ctx context.Context, slug string) (album, error) {
+	return store.getByMarker(ctx, dynamoKindSlug+"#"+slug)
+}
+
+func (store *DynamoAlbumStore) GetByBarcode(ctx context.Context, code string) (album, error) {
+	return store.getByMarker(ctx, dynamoKindBarcode+"#"+code)
+}
+
+func (store *DynamoAlbumStore) getByMarker(ctx context.Context, key string) (album, error) {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	var marker dynamoMarker
+	found, err := store.getItem(ctx, key, &marker)
+	if err != nil {
+		return album{}, err
+	}
+	if !found {
+		return album{}, errAlbumNotFound
+	}
+	return store.getAlbum(ctx, marker.AlbumID)
+}
+
+func (store *DynamoAlbumStore) getItem(ctx context.Context, id string, out interface{}) (bool, error) {
+	res, err := store.reads.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(dynamoAlbumsTable),
+		Key:            map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, err
+	}
+	if res.Item == nil {
+		return false, nil
+	}
+	return true, attributevalue.UnmarshalMap(res.Item, out)
+}
+
+func (store *DynamoAlbumStore) Create(ctx context.Context, a album) (album, error) {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	var w dynamoAlbumWrite
+	err := store.withCatalogRoom(ctx, 1, func() (err error) {
+		w, err = store.prepareCreate(ctx, a, func(slug string) bool { return store.slugTaken(ctx, slug) })
+		if err != nil {
+			return err
+		}
+		if _, err := store.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: w.writes}); err != nil {
+			return mapDynamoAlbumError(err, w.writes)
+		}
+		return nil
+	})
+	if err != nil {
+		return album{}, err
+	}
+	return w.album, nil
+}
+
+// dynamoAlbumWrite is one album's part of a transaction: the writes that
+// apply it, and the writes that would revert it once applied.
+type dynamoAlbumWrite struct {
+	album  album
+	writes []types.TransactWriteItem
+	undo   []types.TransactWriteItem
+}
+
+// prepareCreate builds the writes that insert a, with its slug and barcode
+// markers; slugTaken decides which slugs are in use.
+func (store *DynamoAlbumStore) prepareCreate(ctx context.Context, a album, slugTaken func(string) bool) (dynamoAlbumWrite, error) {
+	a.Slug = uniqueSlug(slugify(a.Title, a.Artist), slugTaken)
+	stampCreated(&a)
+	item := dynamoAlbum{
+		ID: a.ID, Kind: dynamoKindAlbum, Title: a.Title, Artist: a.Artist,
+		ArtistKey: strings.ToLower(a.Artist), Genre: a.Genre, GenreKey: strings.ToLower(a.Genre),
+		Price: float64(a.Price), Slug: a.Slug, Barcode: a.Barcode, Year: a.Year, Tracks: a.Tracks,
+		Metadata: a.Metadata, Stock: a.Stock, Seq: time.Now().UnixNano(), CreatedAt: a.CreatedAt, UpdatedAt: a.UpdatedAt,
+		AvailableFrom: a.AvailableFrom, AvailableUntil: a.AvailableUntil, SearchKey: searchKey(a.Title, a.Artist),
+	}
+	puts := []interface{}{item, dynamoMarker{ID: dynamoKindSlug + "#" + a.Slug, Kind: dynamoKindSlug, AlbumID: a.ID}}
+	if a.Barcode != "" {
+		puts = append(puts, dynamoMarker{ID: dynamoKindBarcode + "#" + a.Barcode, Kind: dynamoKindBarcode, AlbumID: a.ID})
+	}
+	w := dynamoAlbumWrite{album: a}
+	for _, p := range puts {
+		put, err := dynamoConditionalPut(p, "attribute_not_exists(id)")
+		if err != nil {
+			return dynamoAlbumWrite{}, err
+		}
+		w.writes = append(w.writes, put)
+		w.undo = append(w.undo, types.TransactWriteItem{Delete: &types.Delete{TableName: put.Put.TableName, Key: map[string]types.AttributeValue{"id": put.Put.Item["id"]}}})
+	}
+	return w, nil
+}
+
+func (store *DynamoAlbumStore) Update(ctx context.Context, a album, regenerateSlug bool) (album, error) {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	w, err := store.prepareUpdate(ctx, a, regenerateSlug, func(slug string) bool { return store.slugTaken(ctx, slug) })
+	if err != nil {
+		return album{}, err
+	}
+	if _, err := store.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: w.writes}); err != nil {
+		return album{}, mapDynamoAlbumError(err, w.writes)
+	}
+	return w.album, nil
+}
+
+// prepareUpdate builds the writes that replace the stored album with a and
+// move its markers; slugTaken decides which slugs are in use.
+func (store *DynamoAlbumStore) prepareUpdate(ctx context.Context, a album, regenerateSlug bool, slugTaken func(string) bool) (dynamoAlbumWrite, error) {
+	var existing dynamoAlbum
+	found, err := store.getItem(ctx, a.ID, &existing)
+	if err != nil {
+		return dynamoAlbumWrite{}, err
+	}
+	if !found || existing.Kind != dynamoKindAlbum {
+		return dynamoAlbumWrite{}, errAlbumNotFound
+	}
+	stampUpdated(&a, existing.album())
+	a.Slug = existing.Slug
+	if regenerateSlug {
+		a.Slug = uniqueSlug(slugify(a.Title, a.Artist), func(slug string) bool {
+			return slug != existing.Slug && slugTaken(slug)
+		})
+	}
+	item := existing
+	item.Title, item.Artist, item.Price, item.Slug, item.Barcode = a.Title, a.Artist, float64(a.Price), a.Slug, a.Barcode
+	item.Year, item.Tracks, item.Metadata, item.Stock, item.UpdatedAt = a.Year, a.Tracks, a.Metadata, a.Stock, a.UpdatedAt
+	item.ArtistKey, item.Genre, item.GenreKey = strings.ToLower(a.Artist), a.Genre, strings.ToLower(a.Genre)
+	item.AvailableFrom, item.AvailableUntil, item.SearchKey = a.AvailableFrom, a.AvailableUntil, searchKey(a.Title, a.Artist)
+
+	albumPut, err := dynamoConditionalPut(item, "attribute_exists(id)")
+	if err != nil {
+		return dynamoAlbumWrite{}, err
+	}
+	albumRestore, err := dynamoConditionalPut(existing, "attribute_exists(id)")
+	if err != nil {
+		return dynamoAlbumWrite{}, err
+	}
+	w := dynamoAlbumWrite{album: a, writes: []types.TransactWriteItem{albumPut}, undo: []types.TransactWriteItem{albumRestore}}
+	swap := func(kind, oldValue, newValue string) error {
+		if oldValue == newValue {
+			return nil
+		}
+		oldMarker := dynamoMarker{ID: kind + "#" + oldValue, Kind: kind, AlbumID: a.ID}
+		newMarker := dynamoMarker{ID: kind + "#" + newValue, Kind: kind, AlbumID: a.ID}
+		if oldValue != "" {
+			w.writes = append(w.writes, dynamoDelete(oldMarker.ID))
+			restore, err := dynamoConditionalPut(oldMarker, "attribute_not_exists(id)")
+			if err != nil {
+				return err
+			}
+			w.undo = append(w.undo, restore)
+		}
+		if newValue != "" {
+			put, err := dynamoConditionalPut(newMarker, "attribute_not_exists(id)")
+			if err != nil {
+				return err
+			}
+			w.writes = append(w.writes, put)
+			w.undo = append(w.undo, dynamoDelete(newMarker.ID))
+		}
+		return nil
+	}
+	if err := swap(dynamoKindSlug, existing.Slug, a.Slug); err != nil {
+		return dynamoAlbumWrite{}, err
+	}
+	if err := swap(dynamoKindBarcode, existing.Barcode, a.Barcode); err != nil {
+		return dynamoAlbumWrite{}, err
+	}
+	return w, nil
+}
+
+// dynamoBatchChunk caps the write items per transaction in a batch. An
+// album's writes are never split across transactions.
+const dynamoBatchChunk = 25
+
+func (store *DynamoAlbumStore) CreateMany(ctx context.Context, albums []album) ([]album, error) {
+	var created []album
+	err := store.withCatalogRoom(ctx, len(albums), func() (err error) {
+		created, err = store.batch(ctx, albums, func(ctx context.Context, a album, slugTaken func(string) bool) (dynamoAlbumWrite, error) {
+			return store.prepareCreate(ctx, a, slugTaken)
+		})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (store *DynamoAlbumStore) UpdateMany(ctx context.Context, albums []album, regenerateSlug bool) ([]album, error) {
+	return store.batch(ctx, albums, func(ctx context.Context, a album, slugTaken func(string) bool) (dynamoAlbumWrite, error) {
+		return store.prepareUpdate(ctx, a, regenerateSlug, slugTaken)
+	})
+}
+
+// DeleteMany deletes the albums and their markers as a batch, with the
+// same guarantees as UpdateMany.
+func (store *DynamoAlbumStore) DeleteMany(ctx context.Context, ids []string) error {
+	albums := make([]album, len(ids))
+	for i, id := range ids {
+		albums[i].ID = id
+	}
+	_, err := store.batch(ctx, albums, func(ctx context.Context, a album, _ func(string) bool) (dynamoAlbumWrite, error) {
+		return store.prepareDelete(ctx, a.ID)
+	})
+	return err
+}
+
+// MergeAlbums updates the survivor and deletes the duplicates as one batch,
+// with the same guarantees as UpdateMany.
+func (store *DynamoAlbumStore) MergeAlbums(ctx context.Context, survivor album, duplicates []string) (album, error) {
+	albums := make([]album, 1, 1+len(duplicates))
+	albums[0] = survivor
+	for _, id := range duplicates {
+		albums = append(albums, album{ID: id})
+	}
+	done, err := store.batch(ctx, albums, func(ctx context.Context, a album, slugTaken func(string) bool) (dynamoAlbumWrite, error) {
+		if a.ID == survivor.ID {
+			return store.prepareUpdate(ctx, a, false, slugTaken)
+		}
+		return store.prepareDelete(ctx, a.ID)
+	})
+	if err != nil {
+		return album{}, err
+	}
+	return done[0], nil
+}
+
+// prepareDelete builds the writes that delete an album and its markers.
+func (store *DynamoAlbumStore) prepareDelete(ctx context.Context, id string) (dynamoAlbumWrite, error) {
+	var existing dynamoAlbum
+	found, err := store.getItem(ctx, id, &existing)
+	if err != nil {
+		return dynamoAlbumWrite{}, err
+	}
+	if !found || existing.Kind != dynamoKindAlbum {
+		return dynamoAlbumWrite{}, errAlbumNotFound
+	}
+	albumDelete := dynamoDelete(id)
+	albumDelete.Delete.ConditionExpression = aws.String("attribute_exists(id)")
+	restores := []interface{}{existing, dynamoMarker{ID: dynamoKindSlug + "#" + existing.Slug, Kind: dynamoKindSlug, AlbumID: id}}
+	w := dynamoAlbumWrite{album: existing.album(), writes: []types.TransactWriteItem{albumDelete, dynamoDelete(dynamoKindSlug + "#" + existing.Slug)}}
+	if existing.Barcode != "" {
+		w.writes = append(w.writes, dynamoDelete(dynamoKindBarcode+"#"+existing.Barcode))
+		restores = append(restores, dynamoMarker{ID: dynamoKindBarcode + "#" + existing.Barcode, Kind: dynamoKindBarcode, AlbumID: id})
+	}
+	for _, r := range restores {
+		put, err := dynamoConditionalPut(r, "attribute_not_exists(id)")
+		if err != nil {
+			return dynamoAlbumWrite{}, err
+		}
+		w.undo = append(w.undo, put)
+	}
+	return w, nil
+}
+
+// batch prepares every album's writes up front, then commits them in
+// transactions of at most dynamoBatchChunk items. A single transaction can't
+// touch an item twice, so a batch that names the same album, or hands the
+// same barcode to two albums, is rejected before anything is written. If a
+// later transaction fails, the ones already committed are reverted; other
+// clients may briefly see the partial batch, and a write they make to the
+// same albums meanwhile is overwritten by the revert. Each album's reads and
+// each transaction get the per-operation timeout; the batch as a whole is
+// bound by ctx.
+func (store *DynamoAlbumStore) batch(ctx context.Context, albums []album, prepare func(context.Context, album, func(string) bool) (dynamoAlbumWrite, error)) ([]album, error) {
+	claimed := map[string]bool{}   // slugs assigned earlier in the batch
+	touched := map[string]string{} // item key -> album ID
+	var prepared []dynamoAlbumWrite
+	for _, a := range albums {
+		opCtx, cancel := store.opContext(ctx)
+		w, err := prepare(opCtx, a, func(slug string) bool { return claimed[slug] || store.slugTaken(opCtx, slug) })
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("album %s: %w", a.ID, err)
+		}
+		claimed[w.album.Slug] = true
+		for _, write := range w.writes {
+			key := dynamoWriteKey(write)
+			if _, dup := touched[key]; dup {
+				if strings.HasPrefix(key, dynamoKindBarcode+"#") {
+					return nil, fmt.Errorf("album %s: %w", a.ID, errBarcodeTaken)
+				}
+				return nil, fmt.Errorf("album %s: %w: it appears in the batch twice", a.ID, errDuplicateAlbum)
+			}
+			touched[key] = a.ID
+		}
+		prepared = append(prepared, w)
+	}
+
+	var committed []dynamoAlbumWrite
+	for start := 0; start < len(prepared); {
+		end, n := start, 0
+		var writes []types.TransactWriteItem
+		for end < len(prepared) && (n == 0 || n+len(prepared[end].writes) <= dynamoBatchChunk) {
+			writes = append(writes, prepared[end].writes...)
+			n += len(prepared[end].writes)
+			end++
+		}
+		opCtx, cancel := store.opContext(ctx)
+		_, err := store.client.TransactWriteItems(opCtx, &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+		cancel()
+		if err != nil {
+			store.revert(ctx, committed)
+			mapped := mapDynamoAlbumError(err, writes)
+			if i := dynamoFailedWrite(err); i >= 0 && i < len(writes) {
+				return nil, fmt.Errorf("album %s: %w", touched[dynamoWriteKey(writes[i])], mapped)
+			}
+			return nil, mapped
+		}
+		committed = append(committed, prepared[start:end]...)
+		start = end
+	}
+	done := make([]album, len(prepared))
+	for i, w := range prepared {
+		done[i] = w.album
+	}
+	return done, nil
+}
+
+// revert applies the undo writes of committed albums, newest first, even if
+// ctx has been cancelled. Failures are logged; there is nothing more to try.
+func (store *DynamoAlbumStore) revert(ctx context.Context, committed []dynamoAlbumWrite) {
+	ctx = context.WithoutCancel(ctx)
+	for i := len(committed) - 1; i >= 0; i-- {
+		w := committed[i]
+		opCtx, cancel := store.opContext(ctx)
+		_, err := store.client.TransactWriteItems(opCtx, &dynamodb.TransactWriteItemsInput{TransactItems: w.undo})
+		cancel()
+		if err != nil {
+			log.Printf("🔥 Failed to revert album %s after a failed DynamoDB batch: %v", w.album.ID, err)
+		}
+	}
+}
+
+// dynamoWriteKey returns the key of the item a transaction write touches.
+func dynamoWriteKey(w types.TransactWriteItem) string {
+	var key types.AttributeValue
+	switch {
+	case w.Put != nil:
+		key = w.Put.Item["id"]
+	case w.Delete != nil:
+		key = w.Delete.Key["id"]
+	}
+	if s, ok := key.(*types.AttributeValueMemberS); ok {
+		return s.Value
+	}
+	return ""
+}
+
+// dynamoFailedWrite returns the index of the write that cancelled a
+// transaction, or -1 if err doesn't say.
+func dynamoFailedWrite(err error) int {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return -1
+	}
+	for i, reason := range canceled.CancellationReasons {
+		if code := aws.ToString(reason.Code); code != "" && code != "None" {
+			return i
+		}
+	}
+	return -1
+}
+
+// Import loads albums as-is, upserting by ID. Each album is written in its
+// own transaction together with its markers, so unlike the SQL stores the
+// import as a whole is not atomic: a failure part-way through keeps the
+// albums written so far, and replace mode has already cleared the table.
+func (store *DynamoAlbumStore) Import(ctx context.Context, mode importMode, next func() (album, error)) (int, error) {
+	if mode == importReplace {
+		if err := store.deleteAll(ctx); err != nil {
+			return 0, err
+		}
+	}
+	seq := time.Now().UnixNano()
+	n := 0
+	for {
+		a, err := next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if err := store.putImported(ctx, a, seq+int64(n)); err != nil {
+			return n, fmt.Errorf("album %s: %w", a.ID, err)
+		}
+		n++
+	}
+}
+
+func (store *DynamoAlbumStore) putImported(ctx context.Context, a album, seq int64) error {
+	var existing dynamoAlbum
+	found, err := store.getItem(ctx, a.ID, &existing)
+	if err != nil {
+		return err
+	}
+	if found && existing.Kind == dynamoKindAlbum {
+		seq = existing.Seq
+	} else {
+		existing = dynamoAlbum{}
+	}
+	item := dynamoAlbum{
+		ID: a.ID, Kind: dynamoKindAlbum, Title: a.Title, Artist: a.Artist,
+		ArtistKey: strings.ToLower(a.Artist), Genre: a.Genre, GenreKey: strings.ToLower(a.Genre),
+		Price: float64(a.Price), Slug: a.Slug, Barcode: a.Barcode, Year: a.Year, Tracks: a.Tracks,
+		Metadata: a.Metadata, Stock: a.Stock, Seq: seq, CreatedAt: a.CreatedAt, UpdatedAt: a.UpdatedAt,
+		AvailableFrom: a.AvailableFrom, AvailableUntil: a.AvailableUntil, SearchKey: searchKey(a.Title, a.Artist),
+	}
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return fmt.Errorf("marshaling DynamoDB item: %w", err)
+	}
+	writes := []types.TransactWriteItem{{Put: &types.Put{TableName: aws.String(dynamoAlbumsTable), Item: av}}}
+	for _, m := range []struct{ kind, oldValue, newValue string }{
+		{dynamoKindSlug, existing.Slug, a.Slug},
+		{dynamoKindBarcode, existing.Barcode, a.Barcode},
+	} {
+		if m.oldValue == m.newValue {
+			continue
+		}
+		if m.oldValue != "" {
+			writes = append(writes, dynamoDelete(m.kind+"#"+m.oldValue))
+		}
+		if m.newValue != "" {
+			w, err := dynamoConditionalPut(dynamoMarker{ID: m.kind + "#" + m.newValue, Kind: m.kind, AlbumID: a.ID}, "attribute_not_exists(id)")
+			if err != nil {
+				return err
+			}
+			writes = append(writes, w)
+		}
+	}
+	if _, err := store.client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: writes}); err != nil {
+		return mapDynamoAlbumError(err, writes)
+	}
+	return nil
+}
+
+// deleteAll removes every item in the albums table, markers included.
+func (store *DynamoAlbumStore) deleteAll(ctx context.Context) error {
+	var keys []map[string]types.AttributeValue
+	pages := dynamodb.NewScanPaginator(store.client, &dynamodb.ScanInput{
+		TableName:            aws.String(dynamoAlbumsTable),
+		ProjectionExpression: aws.String("id"),
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, page.Items...)
+	}
+	// BatchWriteItem takes at most 25 requests at a time.
+	for start := 0; start < len(keys); start += 25 {
+		end := start + 25
+		if end > len(keys) {
+			end = len(keys)
+		}
+		var reqs []types.WriteRequest
+		for _, key := range keys[start:end] {
+			reqs = append(reqs, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: key}})
+		}
+		pending := map[string][]types.WriteRequest{dynamoAlbumsTable: reqs}
+		for len(pending) > 0 {
+			res, err := store.client.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{RequestItems: pending})
+			if err != nil {
+				return err
+			}
+			pending = res.UnprocessedItems
+		}
+	}
+	return nil
+}
+
+func (store *DynamoAlbumStore) slugTaken(ctx context.Context, slug string) bool {
+	var marker dynamoMarker
+	found, err := store.getItem(ctx, dynamoKindSlug+"#"+slug, &marker)
+	return err == nil && found
+}
+
+func dynamoConditionalPut(v interface{}, condition string) (types.TransactWriteItem, error) {
+	item, err := attributevalue.MarshalMap(v)
+	if err != nil {
+		return types.TransactWriteItem{}, fmt.Errorf("marshaling DynamoDB item: %w", err)
+	}
+	return types.TransactWriteItem{Put: &types.Put{
+		TableName:           aws.String(dynamoAlbumsTable),
+		Item:                item,
+		ConditionExpression: aws.String(condition),
+	}}, nil
+}
+
+func dynamoDelete(id string) types.TransactWriteItem {
+	return types.TransactWriteItem{Delete: &types.Delete{
+		TableName: aws.String(dynamoAlbumsTable),
+		Key:       map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+	}}
+}
+
+// mapDynamoAlbumError turns a cancelled transaction into errBarcodeTaken or
+// errSlugTaken when the failed condition belonged to a marker put. A failed
+// condition on the album item itself means it already existed (Create) or
+// was gone (Update).
+func mapDynamoAlbumError(err error, writes []types.TransactWriteItem) error {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) {
+		return err
+	}
+	for i, reason := range canceled.CancellationReasons {
+		if i >= len(writes) || aws.ToString(reason.Code) != "ConditionalCheckFailed" {
+			continue
+		}
+		put := writes[i].Put
+		if put == nil {
+			continue
+		}
+		kind, _ := put.Item["kind"].(*types.AttributeValueMemberS)
+		if kind == nil {
+			continue
+		}
+		switch kind.Value {
+		case dynamoKindBarcode:
+			return errBarcodeTaken
+		case dynamoKindSlug:
+			return errSlugTaken
+		case dynamoKindAlbum:
+			if aws.ToString(put.ConditionExpression) == "attribute_exists(id)" {
+				return errAlbumNotFound
+			}
+			return fmt.Errorf("%w: %v", errDuplicateAlbum, err)
+		}
+	}
+	return err
+}
+
+func (store *DynamoAlbumStore) Ping(ctx context.Context) error {
+	_, err := store.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(dynamoAlbumsTable)})
+	return err
+}
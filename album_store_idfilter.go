@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"hash/maphash"
+	"log"
+	"math"
+	"math/bits"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+const (
+	// The kinds of ALBUM_ID_FILTER.
+	albumIDFilterExact = "exact"
+	albumIDFilterBloom = "bloom"
+
+	defaultAlbumIDFilterCapacity = 1_000_000
+	defaultAlbumIDFilterFPRate   = 0.01
+	defaultAlbumIDFilterRebuild  = 15 * time.Minute
+
+	// albumIDFilterFollowInterval is how often the filter reads the change
+	// log for the albums other replicas created.
+	albumIDFilterFollowInterval = time.Second
+	albumIDFilterFollowBatch    = 1000
+	// albumIDFilterOverlap is how many changes before the last one read
+	// each follow reads again: a change the database numbered before that
+	// one may only commit after it was read.
+	albumIDFilterOverlap = 100
+)
+
+// totalNegativeCacheHits counts lookups by ID the album ID filter answered
+// without asking the store.
+var totalNegativeCacheHits int64
+
+// idSet is the set of album IDs the filter keeps. mayContain must be true
+// for every ID added; a bloom filter is also true for some that weren't.
+type idSet interface {
+	add(id string)
+	mayContain(id string) bool
+}
+
+// idRemover is implemented by the sets that can forget an ID; a bloom
+// filter can't.
+type idRemover interface {
+	remove(id string)
+}
+
+type exactIDSet map[string]struct{}
+
+func (s exactIDSet) add(id string) { s[id] = struct{}{} }
+
+func (s exactIDSet) remove(id string) { delete(s, id) }
+
+func (s exactIDSet) mayContain(id string) bool {
+	_, ok := s[id]
+	return ok
+}
+
+// bloomIDSet is a bloom filter of k bits per ID out of m, chosen by
+// double hashing one 64-bit hash of the ID.
+type bloomIDSet struct {
+	bits []uint64
+	m, k uint64
+	seed maphash.Seed
+}
+
+// newBloomIDSet sizes a filter for n IDs with a false positive rate of p.
+func newBloomIDSet(n int, p float64) *bloomIDSet {
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	m = max(m, 64)
+	k := uint64(max(1, math.Round(float64(m)/float64(n)*math.Ln2)))
+	return &bloomIDSet{bits: make([]uint64, (m+63)/64), m: m, k: k, seed: maphash.MakeSeed()}
+}
+
+func (s *bloomIDSet) add(id string) {
+	h1, h2 := s.hash(id)
+	for i := uint64(0); i < s.k; i++ {
+		bit := (h1 + i*h2) % s.m
+		s.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (s *bloomIDSet) mayContain(id string) bool {
+	h1, h2 := s.hash(id)
+	for i := uint64(0); i < s.k; i++ {
+		bit := (h1 + i*h2) % s.m
+		if s.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *bloomIDSet) hash(id string) (uint64, uint64) {
+	h := maphash.String(s.seed, id)
+	return h, bits.RotateLeft64(h, 32) | 1
+}
+
+// IDFilterAlbumStore wraps a database-backed store with a set of the IDs
+// of every album in it, so that GetByID answers errAlbumNotFound for an ID
+// that is definitely missing without a query. An ID the set may hold goes
+// to the store as before.
+//
+// The set is rebuilt from the store on startup and every
+// ALBUM_ID_FILTER_REBUILD_INTERVAL, and learns of albums as they are
+// created through this store. Albums other replicas create are read from
+// the change log every albumIDFilterFollowInterval. A store that keeps no
+// change log, or one behind a decorator that doesn't pass it on, gets no
+// set at all: without one, another replica's album would be answered
+// missing until the next rebuild. Deleted IDs stay in the set, and go to
+// the store, until the next rebuild, unless the set is exact and they were
+// deleted through this store. Until the first rebuild finishes every
+// lookup goes to the store.
+type IDFilterAlbumStore struct {
+	AlbumStore
+	kind     string
+	capacity int
+	fpRate   float64
+
+	mu         sync.RWMutex
+	ids        idSet    // nil until the first rebuild, and without a change log
+	count      int      // the IDs added to ids
+	rebuilding bool     // pending collects the IDs added meanwhile
+	pending    []string // see rebuild
+	followed   int64    // the seq of the newest change read
+	floor      int64    // the head when ids was rebuilt; the change log is read no further back
+	unfollowed sync.Once
+}
+
+func NewIDFilterAlbumStore(store AlbumStore, kind string, capacity int, fpRate float64) *IDFilterAlbumStore {
+	return &IDFilterAlbumStore{AlbumStore: store, kind: kind, capacity: capacity, fpRate: fpRate}
+}
+
+func (store *IDFilterAlbumStore) GetByID(ctx context.Context, id string) (album, error) {
+	// A read after a write must see it even if it was made on another
+	// replica the filter hasn't heard from yet.
+	if syncTokenFrom(ctx) != "" || primaryReads(ctx) {
+		return store.AlbumStore.GetByID(ctx, id)
+	}
+	store.mu.RLock()
+	missing := store.ids != nil && !store.ids.mayContain(id)
+	store.mu.RUnlock()
+	if missing {
+		atomic.AddInt64(&totalNegativeCacheHits, 1)
+		return album{}, errAlbumNotFound
+	}
+	return store.AlbumStore.GetByID(ctx, id)
+}
+
+// Create adds the ID before the album is stored: between the two, a
+// lookup of it must reach the store.
+func (store *IDFilterAlbumStore) Create(ctx context.Context, a album) (album, error) {
+	store.add(a.ID)
+	return store.AlbumStore.Create(ctx, a)
+}
+
+func (store *IDFilterAlbumStore) CreateMany(ctx context.Context, albums []album) ([]album, error) {
+	for _, a := range albums {
+		store.add(a.ID)
+	}
+	return store.AlbumStore.CreateMany(ctx, albums)
+}
+
+// Import adds every album read from next as it is handed to the store.
+func (store *IDFilterAlbumStore) Import(ctx context.Context, mode importMode, next func() (album, error)) (int, error) {
+	importer, ok := store.AlbumStore.(AlbumImporter)
+	if !ok {
+		return 0, errImportUnsupported
+	}
+	return importer.Import(ctx, mode, func() (album, error) {
+		a, err := next()
+		if err == nil {
+			store.add(a.ID)
+		}
+		return a, err
+	})
+}
+
+// add adds an ID to the set, and to pending while a rebuild is reading:
+// the first rebuild may not list the album, and there is no set yet to
+// keep it in.
+func (store *IDFilterAlbumStore) add(id string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.rebuilding {
+		store.pending = append(store.pending, id)
+	}
+	if store.ids == nil {
+		return
+	}
+	store.ids.add(id)
+	store.count++
+}
+
+// remove forgets the IDs of deleted albums, where the set can. A rebuild
+// already under way may still find them; they are then only looked up.
+func (store *IDFilterAlbumStore) remove(ids []string) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	r, ok := store.ids.(idRemover)
+	if !ok {
+		return
+	}
+	for _, id := range ids {
+		r.remove(id)
+	}
+}
+
+// newSet makes an empty set for a catalog of count albums. A bloom filter
+// is sized for ALBUM_ID_FILTER_CAPACITY IDs, or twice count when that's
+// more, so that the next rebuild makes room for a growing catalog.
+func (store *IDFilterAlbumStore) newSet(count int) idSet {
+	if store.kind == albumIDFilterExact {
+		return make(exactIDSet, count)
+	}
+	return newBloomIDSet(max(store.capacity, 2*count), store.fpRate)
+}
+
+// rebuild reads every album ID into a new set and swaps it in, dropping the
+// IDs of deleted albums. The IDs added while it reads are carried over, and
+// following the change log picks up from where it was when the reading
+// began. Without a change log to follow it drops the set instead.
+func (store *IDFilterAlbumStore) rebuild(ctx context.Context) error {
+	head, err := changeLogHead(ctx, store.AlbumStore)
+	if errors.Is(err, errOutboxUnsupported) || errors.Is(err, errChangesUnsupported) {
+		store.mu.Lock()
+		store.ids = nil
+		store.mu.Unlock()
+		store.unfollowed.Do(func() {
+			log.Println("🚧 The album store doesn't keep a change log for the album ID filter to learn of other replicas' albums from; every lookup goes to the store")
+		})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	store.mu.Lock()
+	if store.rebuilding {
+		store.mu.Unlock()
+		return errJobRunning
+	}
+	store.rebuilding, store.pending = true, nil
+	ids := store.newSet(store.count)
+	store.mu.Unlock()
+
+	count := 0
+	err = store.AlbumStore.Iterate(ctx, ListOptions{}, func(a album) error {
+		ids.add(a.ID)
+		count++
+		return nil
+	})
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	pending := store.pending
+	store.rebuilding, store.pending = false, nil
+	if err != nil {
+		return err
+	}
+	for _, id := range pending {
+		ids.add(id)
+	}
+	store.ids, store.count = ids, count+len(pending)
+	store.floor, store.followed = head, max(store.followed, head)
+	setJobResult(ctx, map[string]int{"albums": count})
+	debugf("Rebuilt the album ID filter with %d albums", count)
+	return nil
+}
+
+// follow adds the albums the change log has since it was last read. A
+// change log trimmed past that point forces a rebuild.
+func (store *IDFilterAlbumStore) follow(ctx context.Context) error {
+	store.mu.RLock()
+	following, since := store.ids != nil, max(store.floor, store.followed-albumIDFilterOverlap)
+	store.mu.RUnlock()
+	if !following {
+		return nil
+	}
+	for {
+		changes, _, err := storeChanges(ctx, store.AlbumStore, since, albumIDFilterFollowBatch)
+		if errors.Is(err, errChangesTrimmed) {
+			log.Println("🧾 The album changes since the album ID filter last read them are no longer kept; rebuilding it")
+			return store.rebuild(ctx)
+		}
+		if err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+		store.addChanges(changes)
+		since = changes[len(changes)-1].Seq
+		if len(changes) < albumIDFilterFollowBatch {
+			return nil
+		}
+	}
+}
+
+// addChanges adds the album of every change but a deletion, in case the
+// change that created it was missed.
+func (store *IDFilterAlbumStore) addChanges(changes []types.AlbumChange) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for _, c := range changes {
+		if c.Op != changeDeleted {
+			store.ids.add(c.AlbumID)
+			if store.rebuilding {
+				store.pending = append(store.pending, c.AlbumID)
+			}
+		}
+	}
+	store.followed = max(store.followed, changes[len(changes)-1].Seq)
+}
+
+// changeLogHead returns the seq of the newest change in store's change log.
+func changeLogHead(ctx context.Context, store AlbumStore) (int64, error) {
+	pos, err := storeOutboxPosition(ctx, store)
+	if err != nil {
+		return 0, err
+	}
+	_, head, err := storeChanges(ctx, store, pos.Trimmed, 1)
+	return head, err
+}
+
+func (store *IDFilterAlbumStore) Stats(ctx context.Context, filter AlbumFilter) (albumStats, error) {
+	return storeStats(ctx, store.AlbumStore, filter)
+}
+
+func (store *IDFilterAlbumStore) PriceHistory(ctx context.Context, albumID string, limit, offset int) ([]PriceChange, int, error) {
+	return storePriceHistory(ctx, store.AlbumStore, albumID, limit, offset)
+}
+
+func (store *IDFilterAlbumStore) Changes(ctx context.Context, since int64, limit int) ([]types.AlbumChange, int64, error) {
+	return storeChanges(ctx, store.AlbumStore, since, limit)
+}
+
+func (store *IDFilterAlbumStore) TrimChanges(ctx context.Context, before time.Time) (int, error) {
+	return storeTrimChanges(ctx, store.AlbumStore, before)
+}
+
+func (store *IDFilterAlbumStore) OutboxPosition(ctx context.Context) (outboxPosition, error) {
+	return storeOutboxPosition(ctx, store.AlbumStore)
+}
+
+func (store *IDFilterAlbumStore) AdvanceOutbox(ctx context.Context, from, to int64) (bool, error) {
+	return storeAdvanceOutbox(ctx, store.AlbumStore, from, to)
+}
+
+func (store *IDFilterAlbumStore) PublishDue(ctx context.Context, now time.Time) ([]album, error) {
+	return storePublishDue(ctx, store.AlbumStore, now)
+}
+
+func (store *IDFilterAlbumStore) Revisions(ctx context.Context, from, to time.Time) ([]albumRevision, time.Time, error) {
+	return storeRevisions(ctx, store.AlbumStore, from, to)
+}
+
+func (store *IDFilterAlbumStore) AnonymizeAudit(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	return storeAnonymizeAudit(ctx, store.AlbumStore, before, dryRun)
+}
+
+func (store *IDFilterAlbumStore) PruneImportJobs(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	return storePruneImportJobs(ctx, store.AlbumStore, before, dryRun)
+}
+
+func (store *IDFilterAlbumStore) SyncToken(ctx context.Context) (string, error) {
+	return storeSyncToken(ctx, store.AlbumStore)
+}
+
+func (store *IDFilterAlbumStore) ArtistGroups(ctx context.Context, availableAt time.Time) ([]artistGroup, error) {
+	return storeArtistGroups(ctx, store.AlbumStore, availableAt)
+}
+
+func (store *IDFilterAlbumStore) Search(ctx context.Context, query searchNode) ([]album, error) {
+	return storeSearch(ctx, store.AlbumStore, query)
+}
+
+func (store *IDFilterAlbumStore) DeleteMany(ctx context.Context, ids []string) error {
+	err := storeDeleteMany(ctx, store.AlbumStore, ids)
+	if err == nil {
+		store.remove(ids)
+	}
+	return err
+}
+
+func (store *IDFilterAlbumStore) MergeAlbums(ctx context.Context, survivor album, duplicates []string) (album, error) {
+	merged, err := storeMergeAlbums(ctx, store.AlbumStore, survivor, duplicates)
+	if err == nil {
+		store.remove(duplicates)
+	}
+	return merged, err
+}
+
+func (store *IDFilterAlbumStore) RenameArtist(ctx context.Context, from, to string) ([]album, error) {
+	return storeRenameArtist(ctx, store.AlbumStore, from, to)
+}
+
+func (store *IDFilterAlbumStore) SellAlbum(ctx context.Context, id string, quantity int) (album, error) {
+	return storeSellAlbum(ctx, store.AlbumStore, id, quantity)
+}
+
+func (store *IDFilterAlbumStore) SellAlbumForPayment(ctx context.Context, eventID string, now, expires time.Time, id string, quantity int) (album, error) {
+	events, err := paymentEventsOf(store.AlbumStore)
+	if err != nil {
+		return album{}, err
+	}
+	return events.SellAlbumForPayment(ctx, eventID, now, expires, id, quantity)
+}
+
+func (store *IDFilterAlbumStore) PrunePaymentEvents(ctx context.Context, now time.Time) (int, error) {
+	events, err := paymentEventsOf(store.AlbumStore)
+	if err != nil {
+		return 0, err
+	}
+	return events.PrunePaymentEvents(ctx, now)
+}
+
+func (store *IDFilterAlbumStore) CreateImportJob(ctx context.Context, job importJob) error {
+	jobs, err := importJobsOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return jobs.CreateImportJob(ctx, job)
+}
+
+func (store *IDFilterAlbumStore) GetImportJob(ctx context.Context, id string) (importJob, error) {
+	jobs, err := importJobsOf(store.AlbumStore)
+	if err != nil {
+		return importJob{}, err
+	}
+	return jobs.GetImportJob(ctx, id)
+}
+
+func (store *IDFilterAlbumStore) SaveImportJobProgress(ctx context.Context, job importJob) error {
+	jobs, err := importJobsOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return jobs.SaveImportJobProgress(ctx, job)
+}
+
+func (store *IDFilterAlbumStore) CancelImportJob(ctx context.Context, id string) error {
+	jobs, err := importJobsOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return jobs.CancelImportJob(ctx, id)
+}
+
+func (store *IDFilterAlbumStore) CreateSavedSearch(ctx context.Context, s savedSearch) error {
+	searches, err := savedSearchesOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return searches.CreateSavedSearch(ctx, s)
+}
+
+func (store *IDFilterAlbumStore) GetSavedSearch(ctx context.Context, id string) (savedSearch, error) {
+	searches, err := savedSearchesOf(store.AlbumStore)
+	if err != nil {
+		return savedSearch{}, err
+	}
+	return searches.GetSavedSearch(ctx, id)
+}
+
+func (store *IDFilterAlbumStore) ListSavedSearches(ctx context.Context, owner string) ([]savedSearch, error) {
+	searches, err := savedSearchesOf(store.AlbumStore)
+	if err != nil {
+		return nil, err
+	}
+	return searches.ListSavedSearches(ctx, owner)
+}
+
+func (store *IDFilterAlbumStore) DeleteSavedSearch(ctx context.Context, id string) error {
+	searches, err := savedSearchesOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return searches.DeleteSavedSearch(ctx, id)
+}
+
+func (store *IDFilterAlbumStore) Ping(ctx context.Context) error {
+	if p, ok := store.AlbumStore.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// albumIDFilter is the IDFilterAlbumStore in front of the album store, or
+// nil when ALBUM_ID_FILTER is unset.
+var albumIDFilter *IDFilterAlbumStore
+
+// setupAlbumIDFilter wraps database-backed stores in an IDFilterAlbumStore
+// when ALBUM_ID_FILTER is set, and schedules its rebuilds and the reading
+// of the change log. The set is first built by buildAlbumIDFilter once the
+// store is connected.
+func setupAlbumIDFilter(cfg *Config, store AlbumStore) AlbumStore {
+	if _, ok := store.(*InMemoryAlbumStore); ok || cfg.AlbumIDFilter == "" {
+		return store
+	}
+	albumIDFilter = NewIDFilterAlbumStore(store, cfg.AlbumIDFilter, cfg.AlbumIDFilterCapacity, cfg.AlbumIDFilterFPRate)
+	if cfg.AlbumIDFilterRebuild > 0 {
+		scheduler.register("album-id-filter-rebuild", cfg.AlbumIDFilterRebuild, albumIDFilter.rebuild)
+	}
+	scheduler.register("album-id-filter-follow", albumIDFilterFollowInterval, albumIDFilter.follow)
+	return albumIDFilter
+}
+
+// buildAlbumIDFilter builds the album ID filter for the first time. Failing
+// leaves every lookup going to the store until a scheduled rebuild works.
+func buildAlbumIDFilter(ctx context.Context) {
+	if albumIDFilter == nil {
+		return
+	}
+	if err := albumIDFilter.rebuild(ctx); err != nil {
+		log.Printf("🔥 Failed to build the album ID filter: %v", err)
+		return
+	}
+	albumIDFilter.mu.RLock()
+	defer albumIDFilter.mu.RUnlock()
+	if albumIDFilter.ids == nil {
+		return
+	}
+	log.Printf("🧮 Album ID filter (%s) built with %d albums", albumIDFilter.kind, albumIDFilter.count)
+}
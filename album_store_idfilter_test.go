@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// testIDFilter puts an ID filter of kind in front of a fresh SQLite store,
+// and returns both.
+func testIDFilter(t *testing.T, kind string, capacity int) (*IDFilterAlbumStore, *SqliteAlbumStore) {
+	t.Helper()
+	store, err := NewSqliteAlbumStore(testSQLiteStores(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewIDFilterAlbumStore(store, kind, capacity, 0.01), store
+}
+
+// negativeHits runs fn and returns the lookups the filter answered meanwhile.
+func negativeHits(fn func()) int64 {
+	before := atomic.LoadInt64(&totalNegativeCacheHits)
+	fn()
+	return atomic.LoadInt64(&totalNegativeCacheHits) - before
+}
+
+func TestBloomIDSet(t *testing.T) {
+	const n = 10_000
+	set := newBloomIDSet(n, 0.01)
+	for i := range n {
+		set.add(fmt.Sprint("in-", i))
+	}
+	for i := range n {
+		if !set.mayContain(fmt.Sprint("in-", i)) {
+			t.Fatalf("in-%d was added but isn't in the set", i)
+		}
+	}
+	falsePositives := 0
+	for i := range n {
+		if set.mayContain(fmt.Sprint("out-", i)) {
+			falsePositives++
+		}
+	}
+	if rate := float64(falsePositives) / n; rate > 0.02 {
+		t.Errorf("a false positive rate of %.3f, sized for 0.01", rate)
+	}
+}
+
+func TestIDFilterNoFalseNegatives(t *testing.T) {
+	for _, kind := range []string{albumIDFilterExact, albumIDFilterBloom} {
+		t.Run(kind, func(t *testing.T) {
+			newTestServer(t)
+			// The bloom filter is far too small, so that it is mostly
+			// false positives by the end.
+			filter, store := testIDFilter(t, kind, 50)
+			ctx := context.Background()
+			for i := range 20 {
+				if _, err := store.Create(ctx, newTestAlbum(withID(newAlbumID()), withTitle(fmt.Sprint("Before ", i)))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := filter.rebuild(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			// Every album is found as soon as it is created, through this
+			// replica or, once the change log is read, another.
+			for i := range 500 {
+				a, err := filter.Create(ctx, newTestAlbum(withID(newAlbumID()), withTitle(fmt.Sprint("Here ", i))))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := filter.GetByID(ctx, a.ID); err != nil {
+					t.Fatalf("album %d created here: %v", i, err)
+				}
+			}
+			var elsewhere []album
+			for i := range 200 {
+				a, err := store.Create(ctx, newTestAlbum(withID(newAlbumID()), withTitle(fmt.Sprint("Elsewhere ", i))))
+				if err != nil {
+					t.Fatal(err)
+				}
+				elsewhere = append(elsewhere, a)
+			}
+			if err := filter.follow(ctx); err != nil {
+				t.Fatal(err)
+			}
+			all, err := listAll(ctx, store, AlbumFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(all) != 720 {
+				t.Fatalf("%d albums stored", len(all))
+			}
+			for _, a := range all {
+				if _, err := filter.GetByID(ctx, a.ID); err != nil {
+					t.Fatalf("%s: %v", a.Title, err)
+				}
+			}
+
+			// An exact set answers every missing ID itself.
+			hits := negativeHits(func() {
+				for i := range 100 {
+					if _, err := filter.GetByID(ctx, fmt.Sprint("missing-", i)); !errors.Is(err, errAlbumNotFound) {
+						t.Fatalf("a missing ID: %v", err)
+					}
+				}
+			})
+			if kind == albumIDFilterExact && hits != 100 {
+				t.Errorf("%d of 100 missing IDs answered by the filter", hits)
+			}
+
+			// A rebuild keeps them all, and makes room for the catalog.
+			if err := filter.rebuild(ctx); err != nil {
+				t.Fatal(err)
+			}
+			for _, a := range elsewhere {
+				if _, err := filter.GetByID(ctx, a.ID); err != nil {
+					t.Fatalf("%s after the rebuild: %v", a.Title, err)
+				}
+			}
+			hits = negativeHits(func() {
+				for i := range 100 {
+					filter.GetByID(ctx, fmt.Sprint("missing-", i))
+				}
+			})
+			if hits < 90 {
+				t.Errorf("%d of 100 missing IDs answered by the filter after the rebuild", hits)
+			}
+		})
+	}
+}
+
+// pausingIterateStore is a SqliteAlbumStore whose Iterate waits, once it
+// has listed every album, until release is closed.
+type pausingIterateStore struct {
+	*SqliteAlbumStore
+	listed, release chan struct{}
+}
+
+func (s *pausingIterateStore) Iterate(ctx context.Context, opts ListOptions, fn func(album) error) error {
+	err := s.SqliteAlbumStore.Iterate(ctx, opts, fn)
+	close(s.listed)
+	<-s.release
+	return err
+}
+
+func TestIDFilterCreateDuringFirstRebuild(t *testing.T) {
+	for _, kind := range []string{albumIDFilterExact, albumIDFilterBloom} {
+		t.Run(kind, func(t *testing.T) {
+			newTestServer(t)
+			_, sqlite := testIDFilter(t, kind, 1000)
+			ctx := context.Background()
+			existing, err := sqlite.Create(ctx, newTestAlbum(withID(newAlbumID())))
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := &pausingIterateStore{SqliteAlbumStore: sqlite, listed: make(chan struct{}), release: make(chan struct{})}
+			filter := NewIDFilterAlbumStore(store, kind, 1000, 0.01)
+
+			built := make(chan error)
+			go func() { built <- filter.rebuild(ctx) }()
+			<-store.listed
+			// Too late for the listing, with no set yet to add it to.
+			created, err := filter.Create(ctx, newTestAlbum(withID(newAlbumID()), withTitle("During")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := filter.GetByID(ctx, created.ID); err != nil {
+				t.Errorf("during the rebuild: %v", err)
+			}
+			close(store.release)
+			if err := <-built; err != nil {
+				t.Fatal(err)
+			}
+
+			for _, a := range []album{existing, created} {
+				if _, err := filter.GetByID(ctx, a.ID); err != nil {
+					t.Errorf("%s after the rebuild: %v", a.Title, err)
+				}
+			}
+			if filter.count != 2 {
+				t.Errorf("the set counts %d albums, want 2", filter.count)
+			}
+		})
+	}
+}
+
+// unfollowableStore passes on the album store's methods but not its
+// change log, as a decorator that forwards capabilities by hand might.
+type unfollowableStore struct {
+	AlbumStore
+}
+
+func TestIDFilterWithoutChangeLog(t *testing.T) {
+	newTestServer(t)
+	logs := captureLog(t)
+	_, sqlite := testIDFilter(t, albumIDFilterExact, 1000)
+	filter := NewIDFilterAlbumStore(unfollowableStore{sqlite}, albumIDFilterExact, 1000, 0.01)
+	ctx := context.Background()
+	for range 2 {
+		if err := filter.rebuild(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := strings.Count(logs.take(), "doesn't keep a change log"); n != 1 {
+		t.Errorf("logged the filter off %d times, want once", n)
+	}
+
+	// Another replica's album is found, as the filter gives no answers of
+	// its own.
+	other, err := sqlite.Create(ctx, newTestAlbum(withID(newAlbumID())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits := negativeHits(func() {
+		if _, err := filter.GetByID(ctx, other.ID); err != nil {
+			t.Errorf("another replica's album: %v", err)
+		}
+		if _, err := filter.GetByID(ctx, "missing"); !errors.Is(err, errAlbumNotFound) {
+			t.Errorf("a missing ID: %v", err)
+		}
+	})
+	if hits != 0 {
+		t.Errorf("%d lookups answered by the filter without a change log", hits)
+	}
+	if err := filter.follow(ctx); err != nil {
+		t.Error(err)
+	}
+}
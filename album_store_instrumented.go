@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// storeCallBuckets are the upper bounds of the store call latency
+// histogram; slower calls fall in a last, unbounded bucket.
+var storeCallBuckets = []time.Duration{
+	time.Millisecond, 5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond, time.Second, 5 * time.Second,
+}
+
+// storeCallStats are the calls of one operation: a latency histogram, and
+// how many of them failed the way isStoreFailure counts failures.
+type storeCallStats struct {
+	calls   int64
+	errors  int64
+	total   time.Duration
+	buckets []int64 // calls per bucket of storeCallBuckets, then the rest
+}
+
+// InstrumentedAlbumStore times every call to a backend and counts its
+// failures, by operation, for /metrics. It sits right on the backend, under
+// the retries and the breaker, so each attempt is observed and a call the
+// breaker turns away isn't.
+type InstrumentedAlbumStore struct {
+	AlbumStore
+	backend string
+
+	mu  sync.Mutex
+	ops map[string]*storeCallStats
+}
+
+// instrumentedStores holds every instrumented store, by backend, for
+// /metrics.
+var instrumentedStores = map[string]*InstrumentedAlbumStore{}
+
+// NewInstrumentedAlbumStore wraps store and registers it under backend.
+func NewInstrumentedAlbumStore(store AlbumStore, backend string) *InstrumentedAlbumStore {
+	s := &InstrumentedAlbumStore{AlbumStore: store, backend: backend, ops: make(map[string]*storeCallStats)}
+	instrumentedStores[backend] = s
+	return s
+}
+
+// observe makes one call of op and records how long it took and whether it
+// failed, adding the time to the request ctx belongs to.
+func (store *InstrumentedAlbumStore) observe(ctx context.Context, op string, call func() error) error {
+	start := time.Now()
+	err := call()
+	took := time.Since(start)
+	noteStoreTime(ctx, took)
+	bucket := len(storeCallBuckets)
+	for i, bound := range storeCallBuckets {
+		if took <= bound {
+			bucket = i
+			break
+		}
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	s, ok := store.ops[op]
+	if !ok {
+		s = &storeCallStats{buckets: make([]int64, len(storeCallBuckets)+1)}
+		store.ops[op] = s
+	}
+	s.calls++
+	s.total += took
+	s.buckets[bucket]++
+	if isStoreFailure(err) {
+		s.errors++
+	}
+	return err
+}
+
+// snapshot copies the stats of every operation made so far.
+func (store *InstrumentedAlbumStore) snapshot() map[string]storeCallStats {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	ops := make(map[string]storeCallStats, len(store.ops))
+	for op, s := range store.ops {
+		c := *s
+		c.buckets = append([]int64(nil), s.buckets...)
+		ops[op] = c
+	}
+	return ops
+}
+
+// storeCallReport lists the calls of every instrumented store for /metrics,
+// by backend and then operation.
+func storeCallReport() []types.StoreCalls {
+	report := []types.StoreCalls{}
+	for _, backend := range slices.Sorted(maps.Keys(instrumentedStores)) {
+		ops := instrumentedStores[backend].snapshot()
+		for _, op := range slices.Sorted(maps.Keys(ops)) {
+			s := ops[op]
+			report = append(report, types.StoreCalls{
+				Backend:          backend,
+				Operation:        op,
+				Calls:            s.calls,
+				Errors:           s.errors,
+				AverageLatencyMs: float64(s.total) / float64(s.calls) / float64(time.Millisecond),
+			})
+		}
+	}
+	return report
+}
+
+// poolStatser is implemented by stores with a connection pool of their own.
+// ok is false while there is none yet.
+type poolStatser interface {
+	PoolStats() (stats types.PoolStats, ok bool)
+}
+
+// connectionPools reports the pool of every instrumented store that has
+// one, by backend.
+func connectionPools() map[string]types.PoolStats {
+	pools := map[string]types.PoolStats{}
+	for backend, store := range instrumentedStores {
+		if p, ok := store.AlbumStore.(poolStatser); ok {
+			if stats, ok := p.PoolStats(); ok {
+				pools[backend] = stats
+			}
+		}
+	}
+	return pools
+}
+
+// hedgeStatser is implemented by stores that may hedge their reads. ok is
+// false when they don't.
+type hedgeStatser interface {
+	HedgeStats() (stats types.HedgeStats, ok bool)
+}
+
+// readHedging reports the hedged reads of every instrumented store that
+// hedges them, by backend.
+func readHedging() map[string]types.HedgeStats {
+	hedging := map[string]types.HedgeStats{}
+	for backend, store := range instrumentedStores {
+		if h, ok := store.AlbumStore.(hedgeStatser); ok {
+			if stats, ok := h.HedgeStats(); ok {
+				hedging[backend] = stats
+			}
+		}
+	}
+	return hedging
+}
+
+func (store *InstrumentedAlbumStore) List(ctx context.Context, opts ListOptions) (albumPage, error) {
+	var page albumPage
+	err := store.observe(ctx, "List", func() (err error) {
+		page, err = store.AlbumStore.List(ctx, opts)
+		return err
+	})
+	return page, err
+}
+
+func (store *InstrumentedAlbumStore) Iterate(ctx context.Context, opts ListOptions, fn func(album) error) error {
+	return store.observe(ctx, "Iterate", func() error { return store.AlbumStore.Iterate(ctx, opts, fn) })
+}
+
+func (store *InstrumentedAlbumStore) GetByID(ctx context.Context, id string) (album, error) {
+	return store.get(ctx, "GetByID", func() (album, error) { return store.AlbumStore.GetByID(ctx, id) })
+}
+
+func (store *InstrumentedAlbumStore) GetBySlug(ctx context.Context, slug string) (album, error) {
+	return store.get(ctx, "GetBySlug", func() (album, error) { return store.AlbumStore.GetBySlug(ctx, slug) })
+}
+
+func (store *InstrumentedAlbumStore) GetByBarcode(ctx context.Context, code string) (album, error) {
+	return store.get(ctx, "GetByBarcode", func() (album, error) { return store.AlbumStore.GetByBarcode(ctx, code) })
+}
+
+func (store *InstrumentedAlbumStore) Create(ctx context.Context, a album) (album, error) {
+	return store.get(ctx, "Create", func() (album, error) { return store.AlbumStore.Create(ctx, a) })
+}
+
+func (store *InstrumentedAlbumStore) Update(ctx context.Context, a album, regenerateSlug bool) (album, error) {
+	return store.get(ctx, "Update", func() (album, error) { return store.AlbumStore.Update(ctx, a, regenerateSlug) })
+}
+
+// get observes a call that returns one album.
+func (store *InstrumentedAlbumStore) get(ctx context.Context, op string, call func() (album, error)) (album, error) {
+	var a album
+	err := store.observe(ctx, op, func() (err error) {
+		a, err = call()
+		return err
+	})
+	return a, err
+}
+
+func (store *InstrumentedAlbumStore) CreateMany(ctx context.Context, albums []album) ([]album, error) {
+	var list []album
+	err := store.observe(ctx, "CreateMany", func() (err error) {
+		list, err = store.AlbumStore.CreateMany(ctx, albums)
+		return err
+	})
+	return list, err
+}
+
+func (store *InstrumentedAlbumStore) UpdateMany(ctx context.Context, albums []album, regenerateSlug bool) ([]album, error) {
+	var list []album
+	err := store.observe(ctx, "UpdateMany", func() (err error) {
+		list, err = store.AlbumStore.UpdateMany(ctx, albums, regenerateSlug)
+		return err
+	})
+	return list, err
+}
+
+func (store *InstrumentedAlbumStore) Search(ctx context.Context, query searchNode) ([]album, error) {
+	var list []album
+	err := store.observe(ctx, "Search", func() (err error) {
+		list, err = storeSearch(ctx, store.AlbumStore, query)
+		return err
+	})
+	return list, err
+}
+
+func (store *InstrumentedAlbumStore) Stats(ctx context.Context, filter AlbumFilter) (albumStats, error) {
+	var s albumStats
+	err := store.observe(ctx, "Stats", func() (err error) {
+		s, err = storeStats(ctx, store.AlbumStore, filter)
+		return err
+	})
+	return s, err
+}
+
+func (store *InstrumentedAlbumStore) PriceHistory(ctx context.Context, albumID string, limit, offset int) ([]PriceChange, int, error) {
+	var changes []PriceChange
+	var total int
+	err := store.observe(ctx, "PriceHistory", func() (err error) {
+		changes, total, err = storePriceHistory(ctx, store.AlbumStore, albumID, limit, offset)
+		return err
+	})
+	return changes, total, err
+}
+
+func (store *InstrumentedAlbumStore) Changes(ctx context.Context, since int64, limit int) ([]types.AlbumChange, int64, error) {
+	var changes []types.AlbumChange
+	var head int64
+	err := store.observe(ctx, "Changes", func() (err error) {
+		changes, head, err = storeChanges(ctx, store.AlbumStore, since, limit)
+		return err
+	})
+	return changes, head, err
+}
+
+func (store *InstrumentedAlbumStore) TrimChanges(ctx context.Context, before time.Time) (int, error) {
+	var n int
+	err := store.observe(ctx, "TrimChanges", func() (err error) {
+		n, err = storeTrimChanges(ctx, store.AlbumStore, before)
+		return err
+	})
+	return n, err
+}
+
+func (store *InstrumentedAlbumStore) OutboxPosition(ctx context.Context) (outboxPosition, error) {
+	var pos outboxPosition
+	err := store.observe(ctx, "OutboxPosition", func() (err error) {
+		pos, err = storeOutboxPosition(ctx, store.AlbumStore)
+		return err
+	})
+	return pos, err
+}
+
+func (store *InstrumentedAlbumStore) AdvanceOutbox(ctx context.Context, from, to int64) (bool, error) {
+	var moved bool
+	err := store.observe(ctx, "AdvanceOutbox", func() (err error) {
+		moved, err = storeAdvanceOutbox(ctx, store.AlbumStore, from, to)
+		return err
+	})
+	return moved, err
+}
+
+func (store *InstrumentedAlbumStore) PublishDue(ctx context.Context, now time.Time) ([]album, error) {
+	var published []album
+	err := store.observe(ctx, "PublishDue", func() (err error) {
+		published, err = storePublishDue(ctx, store.AlbumStore, now)
+		return err
+	})
+	return published, err
+}
+
+func (store *InstrumentedAlbumStore) Revisions(ctx context.Context, from, to time.Time) ([]albumRevision, time.Time, error) {
+	var revisions []albumRevision
+	var since time.Time
+	err := store.observe(ctx, "Revisions", func() (err error) {
+		revisions, since, err = storeRevisions(ctx, store.AlbumStore, from, to)
+		return err
+	})
+	return revisions, since, err
+}
+
+func (store *InstrumentedAlbumStore) AnonymizeAudit(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	var n int
+	err := store.observe(ctx, "AnonymizeAudit", func() (err error) {
+		n, err = storeAnonymizeAudit(ctx, store.AlbumStore, before, dryRun)
+		return err
+	})
+	return n, err
+}
+
+func (store *InstrumentedAlbumStore) PruneImportJobs(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	var n int
+	err := store.observe(ctx, "PruneImportJobs", func() (err error) {
+		n, err = storePruneImportJobs(ctx, store.AlbumStore, before, dryRun)
+		return err
+	})
+	return n, err
+}
+
+func (store *InstrumentedAlbumStore) SyncToken(ctx context.Context) (string, error) {
+	var token string
+	err := store.observe(ctx, "SyncToken", func() (err error) {
+		token, err = storeSyncToken(ctx, store.AlbumStore)
+		return err
+	})
+	return token, err
+}
+
+func (store *InstrumentedAlbumStore) ArtistGroups(ctx context.Context, availableAt time.Time) ([]artistGroup, error) {
+	var groups []artistGroup
+	err := store.observe(ctx, "ArtistGroups", func() (err error) {
+		groups, err = storeArtistGroups(ctx, store.AlbumStore, availableAt)
+		return err
+	})
+	return groups, err
+}
+
+func (store *InstrumentedAlbumStore) Import(ctx context.Context, mode importMode, next func() (album, error)) (int, error) {
+	importer, ok := store.AlbumStore.(AlbumImporter)
+	if !ok {
+		return 0, errImportUnsupported
+	}
+	var n int
+	err := store.observe(ctx, "Import", func() (err error) {
+		n, err = importer.Import(ctx, mode, next)
+		return err
+	})
+	return n, err
+}
+
+func (store *InstrumentedAlbumStore) DeleteMany(ctx context.Context, ids []string) error {
+	return store.observe(ctx, "DeleteMany", func() error { return storeDeleteMany(ctx, store.AlbumStore, ids) })
+}
+
+func (store *InstrumentedAlbumStore) MergeAlbums(ctx context.Context, survivor album, duplicates []string) (album, error) {
+	return store.get(ctx, "MergeAlbums", func() (album, error) { return storeMergeAlbums(ctx, store.AlbumStore, survivor, duplicates) })
+}
+
+func (store *InstrumentedAlbumStore) RenameArtist(ctx context.Context, from, to string) ([]album, error) {
+	var renamed []album
+	err := store.observe(ctx, "RenameArtist", func() (err error) {
+		renamed, err = storeRenameArtist(ctx, store.AlbumStore, from, to)
+		return err
+	})
+	return renamed, err
+}
+
+func (store *InstrumentedAlbumStore) SellAlbum(ctx context.Context, id string, quantity int) (album, error) {
+	return store.get(ctx, "SellAlbum", func() (album, error) { return storeSellAlbum(ctx, store.AlbumStore, id, quantity) })
+}
+
+func (store *InstrumentedAlbumStore) SellAlbumForPayment(ctx context.Context, eventID string, now, expires time.Time, id string, quantity int) (album, error) {
+	events, err := paymentEventsOf(store.AlbumStore)
+	if err != nil {
+		return album{}, err
+	}
+	return store.get(ctx, "SellAlbumForPayment", func() (album, error) {
+		return events.SellAlbumForPayment(ctx, eventID, now, expires, id, quantity)
+	})
+}
+
+func (store *InstrumentedAlbumStore) PrunePaymentEvents(ctx context.Context, now time.Time) (int, error) {
+	events, err := paymentEventsOf(store.AlbumStore)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	err = store.observe(ctx, "PrunePaymentEvents", func() (err error) {
+		n, err = events.PrunePaymentEvents(ctx, now)
+		return err
+	})
+	return n, err
+}
+
+func (store *InstrumentedAlbumStore) CreateImportJob(ctx context.Context, job importJob) error {
+	jobs, err := importJobsOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return store.observe(ctx, "CreateImportJob", func() error { return jobs.CreateImportJob(ctx, job) })
+}
+
+func (store *InstrumentedAlbumStore) GetImportJob(ctx context.Context, id string) (importJob, error) {
+	jobs, err := importJobsOf(store.AlbumStore)
+	if err != nil {
+		return importJob{}, err
+	}
+	var job importJob
+	err = store.observe(ctx, "GetImportJob", func() (err error) {
+		job, err = jobs.GetImportJob(ctx, id)
+		return err
+	})
+	return job, err
+}
+
+func (store *InstrumentedAlbumStore) SaveImportJobProgress(ctx context.Context, job importJob) error {
+	jobs, err := importJobsOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return store.observe(ctx, "SaveImportJobProgress", func() error { return jobs.SaveImportJobProgress(ctx, job) })
+}
+
+func (store *InstrumentedAlbumStore) CancelImportJob(ctx context.Context, id string) error {
+	jobs, err := importJobsOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return store.observe(ctx, "CancelImportJob", func() error { return jobs.CancelImportJob(ctx, id) })
+}
+
+func (store *InstrumentedAlbumStore) CreateSavedSearch(ctx context.Context, s savedSearch) error {
+	searches, err := savedSearchesOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return store.observe(ctx, "CreateSavedSearch", func() error { return searches.CreateSavedSearch(ctx, s) })
+}
+
+func (store *InstrumentedAlbumStore) GetSavedSearch(ctx context.Context, id string) (savedSearch, error) {
+	searches, err := savedSearchesOf(store.AlbumStore)
+	if err != nil {
+		return savedSearch{}, err
+	}
+	var s savedSearch
+	err = store.observe(ctx, "GetSavedSearch", func() (err error) {
+		s, err = searches.GetSavedSearch(ctx, id)
+		return err
+	})
+	return s, err
+}
+
+func (store *InstrumentedAlbumStore) ListSavedSearches(ctx context.Context, owner string) ([]savedSearch, error) {
+	searches, err := savedSearchesOf(store.AlbumStore)
+	if err != nil {
+		return nil, err
+	}
+	var list []savedSearch
+	err = store.observe(ctx, "ListSavedSearches", func() (err error) {
+		list, err = searches.ListSavedSearches(ctx, owner)
+		return err
+	})
+	return list, err
+}
+
+func (store *InstrumentedAlbumStore) DeleteSavedSearch(ctx context.Context, id string) error {
+	searches, err := savedSearchesOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return store.observe(ctx, "DeleteSavedSearch", func() error { return searches.DeleteSavedSearch(ctx, id) })
+}
+
+func (store *InstrumentedAlbumStore) Ping(ctx context.Context) error {
+	p, ok := store.AlbumStore.(pinger)
+	if !ok {
+		return nil
+	}
+	return store.observe(ctx, "Ping", func() error { return p.Ping(ctx) })
+}
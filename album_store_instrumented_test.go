@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// failingAlbumStore is an InMemoryAlbumStore whose GetByID takes a few
+// milliseconds and then fails as a dropped connection would.
+type failingAlbumStore struct {
+	*InMemoryAlbumStore
+}
+
+func (s failingAlbumStore) GetByID(ctx context.Context, id string) (album, error) {
+	time.Sleep(3 * time.Millisecond)
+	return album{}, errors.New("read tcp 10.0.0.5:5432: connection reset by peer")
+}
+
+// useInstrumentedStores gives t a registry of instrumented stores of its
+// own.
+func useInstrumentedStores(t *testing.T) {
+	previous := instrumentedStores
+	t.Cleanup(func() { instrumentedStores = previous })
+	instrumentedStores = map[string]*InstrumentedAlbumStore{}
+}
+
+func TestInstrumentedAlbumStore(t *testing.T) {
+	useInstrumentedStores(t)
+	ctx := context.Background()
+	store := NewInstrumentedAlbumStore(failingAlbumStore{NewInMemoryAlbumStore()}, "fake")
+
+	for i := 0; i < 2; i++ {
+		if _, err := store.GetByID(ctx, "some-id"); err == nil {
+			t.Fatal("GetByID succeeded")
+		}
+	}
+	// A missing album and a conflict are answers, not failures.
+	if _, err := store.GetBySlug(ctx, "nope"); !errors.Is(err, errNotFound) {
+		t.Fatalf("GetBySlug: %v", err)
+	}
+	store.Create(ctx, newTestAlbum(withID(newAlbumID()), withBarcode("036000291452")))
+	if _, err := store.Create(ctx, newTestAlbum(withID(newAlbumID()), withBarcode("036000291452"))); !errors.Is(err, errBarcodeTaken) {
+		t.Fatalf("Create: %v", err)
+	}
+
+	ops := store.snapshot()
+	get := ops["GetByID"]
+	if get.calls != 2 || get.errors != 2 || get.total < 6*time.Millisecond {
+		t.Errorf("GetByID = %+v, want two failed calls of at least 3ms", get)
+	}
+	// Each took longer than the first bucket's millisecond.
+	if get.buckets[0] != 0 || sumBuckets(get.buckets) != 2 {
+		t.Errorf("GetByID latencies %v, want two past 1ms", get.buckets)
+	}
+	if slug, create := ops["GetBySlug"], ops["Create"]; slug.calls != 1 || slug.errors != 0 || create.calls != 2 || create.errors != 0 {
+		t.Errorf("GetBySlug = %+v and Create = %+v, want no failures", slug, create)
+	}
+}
+
+func sumBuckets(buckets []int64) int64 {
+	var n int64
+	for _, b := range buckets {
+		n += b
+	}
+	return n
+}
+
+func TestStoreCallMetrics(t *testing.T) {
+	s := newTestServer(t)
+	useInstrumentedStores(t)
+	albumStore = NewInstrumentedAlbumStore(failingAlbumStore{s.albums}, "fake")
+	for i := 0; i < 3; i++ {
+		s.do(http.MethodGet, "/albums/some-id", "")
+	}
+
+	report := decodeBody[types.MetricsReport](t, s.do(http.MethodGet, "/metrics", ""))
+	var get *types.StoreCalls
+	for i, c := range report.StoreCalls {
+		if c.Backend == "fake" && c.Operation == "GetByID" {
+			get = &report.StoreCalls[i]
+		}
+	}
+	if get == nil || get.Calls != 3 || get.Errors != 3 || get.AverageLatencyMs < 3 {
+		t.Fatalf("storeCalls %+v, want three failed GetByID calls of at least 3ms", report.StoreCalls)
+	}
+
+	prom := s.do(http.MethodGet, "/metrics?format=prometheus", "").Body.String()
+	for _, want := range []string{
+		`backend="fake",operation="GetByID",le="0.001"} 0`,
+		`backend="fake",operation="GetByID",le="+Inf"} 3`,
+		`albums_store_errors_total{`,
+		`backend="fake",operation="GetByID"} 3`,
+	} {
+		if !strings.Contains(prom, want) {
+			t.Errorf("the Prometheus output has no %s", want)
+		}
+	}
+}
@@ -0,0 +1,729 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/brentmzey/web-service-go/money"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// mongoAlbum is the document shape stored by MongoAlbumStore. Barcode is
+// omitted when empty so the sparse unique index ignores those documents.
+type mongoAlbum struct {
+	ID      string   `bson:"id"`
+	Title   string   `bson:"title"`
+	Artist  string   `bson:"artist"`
+	Price   float64  `bson:"price"`
+	Genre   string   `bson:"genre,omitempty"`
+	Slug    string   `bson:"slug"`
+	Barcode string   `bson:"barcode,omitempty"`
+	Year    int      `bson:"year,omitempty"`
+	Tracks  []string `bson:"tracks,omitempty"`
+	// Metadata is a sub-document, so filters can use metadata.<key> paths.
+	Metadata map[string]string `bson:"metadata,omitempty"`
+	Stock    int               `bson:"stock"`
+
+	CreatedAt time.Time `bson:"createdAt"`
+	UpdatedAt time.Time `bson:"updatedAt"`
+
+	AvailableFrom  *time.Time `bson:"availableFrom,omitempty"`
+	AvailableUntil *time.Time `bson:"availableUntil,omitempty"`
+
+	// SearchKey is searchKey of the title and artist. Documents an older
+	// version wrote have none until the store computes it.
+	SearchKey string `bson:"searchKey"`
+}
+
+func newMongoAlbum(a album) mongoAlbum {
+	return mongoAlbum{
+		ID: a.ID, Title: a.Title, Artist: a.Artist, Price: float64(a.Price), Genre: a.Genre, Slug: a.Slug,
+		Barcode: a.Barcode, Year: a.Year, Tracks: a.Tracks, Metadata: a.Metadata, Stock: a.Stock, CreatedAt: a.CreatedAt, UpdatedAt: a.UpdatedAt,
+		AvailableFrom: a.AvailableFrom, AvailableUntil: a.AvailableUntil, SearchKey: searchKey(a.Title, a.Artist),
+	}
+}
+
+func (doc mongoAlbum) album() album {
+	return album{
+		ID: doc.ID, Title: doc.Title, Artist: doc.Artist, Price: money.FromFloat(doc.Price), Genre: doc.Genre, Slug: doc.Slug,
+		Barcode: doc.Barcode, Year: doc.Year, Tracks: doc.Tracks, Metadata: doc.Metadata, Stock: doc.Stock,
+		CreatedAt: doc.CreatedAt.UTC(), UpdatedAt: doc.UpdatedAt.UTC(),
+		AvailableFrom: availabilityTime(doc.AvailableFrom), AvailableUntil: availabilityTime(doc.AvailableUntil),
+	}
+}
+
+type MongoAlbumStore struct {
+	collection *mongo.Collection
+	audit      *mongo.Collection // price changes, see recordPriceChange
+	importJobs *mongo.Collection
+	// savedSearches are the searches of POST /searches, see
+	// mongoSavedSearch.
+	savedSearches *mongo.Collection
+}
+
+// mongoAuditEntry is the document shape of an audit log entry.
+type mongoAuditEntry struct {
+	ID        string                 `bson:"id"`
+	Timestamp time.Time              `bson:"timestamp"`
+	Action    string                 `bson:"action"`
+	AlbumID   string                 `bson:"albumId,omitempty"`
+	Principal string                 `bson:"principal"`
+	Details   map[string]interface{} `bson:"details,omitempty"`
+}
+
+const (
+	mongoSlugIndex    = "slug_1" // default name generated by the driver
+	mongoBarcodeIndex = "barcode_unique"
+)
+
+// mongoListCollation makes string comparisons in listings ignore case. The
+// artist index is built with it so that the case-insensitive artist filter,
+// alone or with a price range, is an index scan.
+var mongoListCollation = &options.Collation{Locale: "en", Strength: 2}
+
+// NewMongoAlbumStore ensures the collections' indexes exist, creating any
+// that are missing; an existing index with conflicting options is an error.
+func NewMongoAlbumStore(collection, audit, importJobs, savedSearches *mongo.Collection) (*MongoAlbumStore, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "slug", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "barcode", Value: 1}}, Options: options.Index().SetUnique(true).SetSparse(true).SetName(mongoBarcodeIndex)},
+		{Keys: bson.D{{Key: "artist", Value: 1}, {Key: "price", Value: 1}}, Options: options.Index().SetCollation(mongoListCollation).SetName("artist_price_ci")},
+		{Keys: bson.D{{Key: "title", Value: "text"}, {Key: "artist", Value: "text"}}, Options: options.Index().SetName("title_artist_text")},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating album indexes: %w", err)
+	}
+	_, err = audit.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "albumId", Value: 1}, {Key: "timestamp", Value: -1}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating audit log index: %w", err)
+	}
+	_, err = savedSearches.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "owner", Value: 1}, {Key: "createdAt", Value: 1}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating saved search index: %w", err)
+	}
+	store := &MongoAlbumStore{collection: collection, audit: audit, importJobs: importJobs, savedSearches: savedSearches}
+	if err := store.fillSearchKeys(ctx); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// fillSearchKeys implements the store's part of fillSearchKeys.
+func (store *MongoAlbumStore) fillSearchKeys(ctx context.Context) error {
+	keyless := bson.D{{Key: "searchKey", Value: bson.D{{Key: "$exists", Value: false}}}}
+	return fillSearchKeys("MongoDB", func() ([]keylessAlbum, error) {
+		find := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(searchKeyBatch).
+			SetProjection(bson.D{{Key: "id", Value: 1}, {Key: "title", Value: 1}, {Key: "artist", Value: 1}})
+		cur, err := store.collection.Find(ctx, keyless, find)
+		if err != nil {
+			return nil, err
+		}
+		var docs []mongoAlbum
+		if err := cur.All(ctx, &docs); err != nil {
+			return nil, err
+		}
+		batch := make([]keylessAlbum, len(docs))
+		for i, doc := range docs {
+			batch[i] = keylessAlbum{ID: doc.ID, Title: doc.Title, Artist: doc.Artist}
+		}
+		return batch, nil
+	}, func(id, key string) error {
+		_, err := store.collection.UpdateOne(ctx, bson.D{{Key: "id", Value: id}}, bson.D{{Key: "$set", Value: bson.D{{Key: "searchKey", Value: key}}}})
+		return err
+	})
+}
+
+func (store *MongoAlbumStore) List(ctx context.Context, opts ListOptions) (albumPage, error) {
+	return listPage(ctx, opts, store.scan)
+}
+
+func (store *MongoAlbumStore) Iterate(ctx context.Context, opts ListOptions, fn func(album) error) error {
+	return iterate(ctx, opts, store.scan, fn)
+}
+
+// mongoListedAlbum is an album document with its _id, the ObjectID the
+// server gave it on insert, which orders listings and is a cursor's
+// position.
+type mongoListedAlbum struct {
+	OID        primitive.ObjectID `bson:"_id"`
+	mongoAlbum `bson:",inline"`
+}
+
+// scan implements albumScan with a server-side cursor on _id, which
+// fetches the documents a chunk at a time.
+func (store *MongoAlbumStore) scan(ctx context.Context, opts ListOptions, fn func(album, string) error) error {
+	position, err := opts.position()
+	if err != nil {
+		return err
+	}
+	filter, order, cmp := mongoAlbumFilter(opts.Filter), 1, "$gt"
+	if opts.Newest {
+		order, cmp = -1, "$lt"
+	}
+	if position != "" {
+		after, err := primitive.ObjectIDFromHex(position)
+		if err != nil {
+			return errInvalidCursor
+		}
+		filter = append(filter, bson.E{Key: "_id", Value: bson.D{{Key: cmp, Value: after}}})
+	}
+	find := options.Find().SetSort(bson.D{{Key: "_id", Value: order}}).SetCollation(mongoListCollation).SetBatchSize(int32(opts.chunkSize()))
+	cur, err := store.collection.Find(ctx, filter, find)
+	if err != nil {
+		return err
+	}
+	defer cur.Close(context.WithoutCancel(ctx))
+	search := opts.Filter.search()
+	for cur.Next(ctx) {
+		var doc mongoListedAlbum
+		if err := cur.Decode(&doc); err != nil {
+			return err
+		}
+		if a := doc.album(); search.matches(a) && matchesMetadata(a.Metadata, opts.Filter.Metadata) {
+			if err := fn(a, doc.OID.Hex()); err != nil {
+				return err
+			}
+		}
+	}
+	return cur.Err()
+}
+
+// mongoAlbumFilter translates filter into a query document. Artist and genre
+// are plain equality matches; run with mongoListCollation they ignore case.
+// A search is only narrowed, with a regex per term on the search key; List
+// applies searchQuery.matches to the documents. Metadata matches ignore case
+// the same way, so List checks those values exactly too.
+func mongoAlbumFilter(filter AlbumFilter) bson.D {
+	q := bson.D{}
+	if filter.Artist != "" {
+		q = append(q, bson.E{Key: "artist", Value: filter.Artist})
+	}
+	if filter.Genre != "" {
+		q = append(q, bson.E{Key: "genre", Value: filter.Genre})
+	}
+	price := bson.D{}
+	if filter.MinPrice != nil {
+		price = append(price, bson.E{Key: "$gte", Value: *filter.MinPrice})
+	}
+	if filter.MaxPrice != nil {
+		price = append(price, bson.E{Key: "$lte", Value: *filter.MaxPrice})
+	}
+	if len(price) > 0 {
+		q = append(q, bson.E{Key: "price", Value: price})
+	}
+	var search bson.A
+	for _, term := range searchTerms(filter.Query) {
+		search = append(search, bson.D{{Key: "searchKey", Value: primitive.Regex{Pattern: " " + regexp.QuoteMeta(term)}}})
+	}
+	if len(search) > 0 {
+		// A document an older version wrote has no key yet and isn't
+		// narrowed.
+		q = append(q, bson.E{Key: "$or", Value: bson.A{
+			bson.D{{Key: "searchKey", Value: bson.D{{Key: "$exists", Value: false}}}},
+			bson.D{{Key: "$and", Value: search}},
+		}})
+	}
+	for key, value := range filter.Metadata {
+		q = append(q, bson.E{Key: "metadata." + key, Value: value})
+	}
+	// $not also matches the documents without the field.
+	if at := filter.AvailableAt; !at.IsZero() {
+		q = append(q, bson.E{Key: "availableFrom", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$gt", Value: at}}}}},
+			bson.E{Key: "availableUntil", Value: bson.D{{Key: "$not", Value: bson.D{{Key: "$lte", Value: at}}}}})
+	}
+	return q
+}
+
+// Search runs the query as a query document, with the case-insensitive
+// collation of List.
+func (store *MongoAlbumStore) Search(ctx context.Context, query searchNode) ([]album, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetCollation(mongoListCollation)
+	cur, err := store.collection.Find(ctx, mongoSearchFilter(query), opts)
+	if err != nil {
+		return nil, err
+	}
+	var docs []mongoAlbum
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	list := make([]album, 0, len(docs))
+	for _, doc := range docs {
+		list = append(list, doc.album())
+	}
+	return list, nil
+}
+
+// mongoSearchFilter translates a query into a query document. Genre,
+// barcode, and year aren't stored when zero, so a condition on one also
+// says whether a document without the field matches: the zero value would.
+func mongoSearchFilter(n searchNode) bson.D {
+	switch n.logic {
+	case "and", "or":
+		operands := make(bson.A, len(n.nodes))
+		for i, c := range n.nodes {
+			operands[i] = mongoSearchFilter(c)
+		}
+		return bson.D{{Key: "$" + n.logic, Value: operands}}
+	case "not":
+		return bson.D{{Key: "$nor", Value: bson.A{mongoSearchFilter(n.nodes[0])}}}
+	}
+	if n.field == "" {
+		return bson.D{}
+	}
+	var cond interface{} = bson.D{{Key: "$" + n.op, Value: n.value}}
+	if n.op == "contains" {
+		cond = primitive.Regex{Pattern: regexp.QuoteMeta(n.value.(string)), Options: "i"}
+	}
+	match := bson.D{{Key: n.field, Value: cond}}
+	var zero interface{}
+	switch n.field {
+	case "genre", "barcode":
+		zero = ""
+	case "year":
+		zero = float64(0)
+	default:
+		return match
+	}
+	if n.test(zero) {
+		return bson.D{{Key: "$or", Value: bson.A{bson.D{{Key: n.field, Value: bson.D{{Key: "$exists", Value: false}}}}, match}}}
+	}
+	return bson.D{{Key: n.field, Value: bson.D{{Key: "$exists", Value: true}}}, {Key: "$and", Value: bson.A{match}}}
+}
+
+// Stats summarizes the matching albums with an aggregation pipeline, so only
+// the totals leave the database.
+func (store *MongoAlbumStore) Stats(ctx context.Context, filter AlbumFilter) (albumStats, error) {
+	if filter.Query != "" || len(filter.Metadata) > 0 {
+		// The pipeline can only narrow a search or a metadata match;
+		// List has to see every candidate.
+		var s albumStats
+		err := store.Iterate(ctx, ListOptions{Filter: filter}, func(a album) error {
+			s.add(a)
+			return nil
+		})
+		return s.finish(), err
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: mongoAlbumFilter(filter)}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: nil},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "totalValue", Value: bson.D{{Key: "$sum", Value: "$price"}}},
+			{Key: "minPrice", Value: bson.D{{Key: "$min", Value: "$price"}}},
+			{Key: "maxPrice", Value: bson.D{{Key: "$max", Value: "$price"}}},
+		}}},
+	}
+	cur, err := store.collection.Aggregate(ctx, pipeline, options.Aggregate().SetCollation(mongoListCollation))
+	if err != nil {
+		return albumStats{}, err
+	}
+	var rows []struct {
+		Count      int     `bson:"count"`
+		TotalValue float64 `bson:"totalValue"`
+		MinPrice   float64 `bson:"minPrice"`
+		MaxPrice   float64 `bson:"maxPrice"`
+	}
+	if err := cur.All(ctx, &rows); err != nil {
+		return albumStats{}, err
+	}
+	// No matches means no group at all.
+	if len(rows) == 0 {
+		return albumStats{}, nil
+	}
+	row := rows[0]
+	s := albumStats{Count: row.Count, TotalValue: money.FromFloat(row.TotalValue), MinPrice: money.FromFloat(row.MinPrice), MaxPrice: money.FromFloat(row.MaxPrice)}
+	return s.finish(), nil
+}
+
+// ArtistGroups groups the albums by artist with an aggregation pipeline, so
+// one document per artist leaves the database.
+func (store *MongoAlbumStore) ArtistGroups(ctx context.Context, availableAt time.Time) ([]artistGroup, error) {
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: mongoAlbumFilter(AlbumFilter{AvailableAt: availableAt})}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$artist"},
+			{Key: "albums", Value: bson.D{{Key: "$sum", Value: 1}}},
+			{Key: "totalValue", Value: bson.D{{Key: "$sum", Value: "$price"}}},
+			{Key: "minPrice", Value: bson.D{{Key: "$min", Value: "$price"}}},
+			{Key: "maxPrice", Value: bson.D{{Key: "$max", Value: "$price"}}},
+			{Key: "lastAddedAt", Value: bson.D{{Key: "$max", Value: "$createdAt"}}},
+		}}},
+	}
+	cur, err := store.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		Artist      string       `bson:"_id"`
+		Albums      int          `bson:"albums"`
+		TotalValue  money.Amount `bson:"totalValue"`
+		MinPrice    money.Amount `bson:"minPrice"`
+		MaxPrice    money.Amount `bson:"maxPrice"`
+		LastAddedAt time.Time    `bson:"lastAddedAt"`
+	}
+	if err := cur.All(ctx, &rows); err != nil {
+		return nil, err
+	}
+	groups := make([]artistGroup, len(rows))
+	for i, row := range rows {
+		groups[i] = artistGroup(row)
+	}
+	return groups, nil
+}
+
+func (store *MongoAlbumStore) GetByID(ctx context.Context, id string) (album, error) {
+	return store.getOne(ctx, bson.D{{Key: "id", Value: id}})
+}
+
+func (store *MongoAlbumStore) GetBySlug(ctx context.Context, slug string) (album, error) {
+	return store.getOne(ctx, bson.D{{Key: "slug", Value: slug}})
+}
+
+func (store *MongoAlbumStore) GetByBarcode(ctx context.Context, code string) (album, error) {
+	return store.getOne(ctx, bson.D{{Key: "barcode", Value: code}})
+}
+
+func (store *MongoAlbumStore) getOne(ctx context.Context, filter bson.D) (album, error) {
+	var doc mongoAlbum
+	err := store.collection.FindOne(ctx, filter).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return album{}, errAlbumNotFound
+	}
+	if err != nil {
+		return album{}, err
+	}
+	return doc.album(), nil
+}
+
+func (store *MongoAlbumStore) Create(ctx context.Context, a album) (album, error) {
+	err := store.withCatalogRoom(ctx, 1, func() (err error) {
+		a, err = store.create(ctx, a)
+		return err
+	})
+	if err != nil {
+		return album{}, err
+	}
+	return a, nil
+}
+
+func (store *MongoAlbumStore) create(ctx context.Context, a album) (album, error) {
+	a.Slug = uniqueSlug(slugify(a.Title, a.Artist), func(slug string) bool { return store.slugTaken(ctx, slug) })
+	stampCreated(&a)
+	if _, err := store.collection.InsertOne(ctx, newMongoAlbum(a)); err != nil {
+		return album{}, mapMongoAlbumError(err)
+	}
+	store.recordPriceChange(ctx, a.ID, initialPrice(ctx, a))
+	return a, nil
+}
+
+func (store *MongoAlbumStore) Update(ctx context.Context, a album, regenerateSlug bool) (album, error) {
+	existing, err := store.GetByID(ctx, a.ID)
+	if err != nil {
+		return album{}, err
+	}
+	stampUpdated(&a, existing)
+	a.Slug = existing.Slug
+	if regenerateSlug {
+		a.Slug = uniqueSlug(slugify(a.Title, a.Artist), func(slug string) bool {
+			return slug != existing.Slug && store.slugTaken(ctx, slug)
+		})
+	}
+	res, err := store.collection.ReplaceOne(ctx, bson.D{{Key: "id", Value: a.ID}}, newMongoAlbum(a))
+	if err != nil {
+		return album{}, mapMongoAlbumError(err)
+	}
+	if res.MatchedCount == 0 {
+		return album{}, errAlbumNotFound
+	}
+	if change, ok := priceChange(ctx, existing, a); ok {
+		store.recordPriceChange(ctx, a.ID, change)
+	}
+	return a, nil
+}
+
+// recordPriceChange adds change to the audit log. In a batch on a replica
+// set it commits with the album; otherwise it follows the album write, and
+// a failure is logged rather than returned, as the album has already
+// changed.
+func (store *MongoAlbumStore) recordPriceChange(ctx context.Context, albumID string, change PriceChange) {
+	_, err := store.audit.InsertOne(ctx, mongoAuditEntry(change.auditEntry(albumID)))
+	if err != nil {
+		log.Printf("🔥 Failed to record the price change of album %s: %v", albumID, err)
+	}
+}
+
+// PriceHistory reads the album's price changes from the audit log.
+func (store *MongoAlbumStore) PriceHistory(ctx context.Context, albumID string, limit, offset int) ([]PriceChange, int, error) {
+	filter := bson.D{{Key: "albumId", Value: albumID}, {Key: "action", Value: auditAlbumPriceChanged}}
+	total, err := store.audit.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+	cur, err := store.audit.Find(ctx, filter, options.Find().
+		SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "id", Value: -1}}).
+		SetSkip(int64(offset)).SetLimit(int64(limit)))
+	if err != nil {
+		return nil, 0, err
+	}
+	var docs []struct {
+		Timestamp time.Time          `bson:"timestamp"`
+		Principal string             `bson:"principal"`
+		Details   priceChangeDetails `bson:"details"`
+	}
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, 0, err
+	}
+	changes := make([]PriceChange, len(docs))
+	for i, doc := range docs {
+		changes[i] = PriceChange{OldPrice: doc.Details.OldPrice, NewPrice: doc.Details.NewPrice, ChangedAt: doc.Timestamp.UTC(), Principal: doc.Principal}
+	}
+	return changes, int(total), nil
+}
+
+func (store *MongoAlbumStore) CreateMany(ctx context.Context, albums []album) ([]album, error) {
+	var created []album
+	err := store.withCatalogRoom(ctx, len(albums), func() (err error) {
+		created, err = store.batch(ctx, albums, func(ctx context.Context, a album) (album, error) { return store.create(ctx, a) })
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (store *MongoAlbumStore) UpdateMany(ctx context.Context, albums []album, regenerateSlug bool) ([]album, error) {
+	return store.batch(ctx, albums, func(ctx context.Context, a album) (album, error) { return store.Update(ctx, a, regenerateSlug) })
+}
+
+// DeleteMany deletes the albums in a transaction, where the server supports
+// one. A standalone server checks that every album exists and then deletes
+// them in one command, which is not atomic with the check. Their price
+// history stays in the audit log.
+func (store *MongoAlbumStore) DeleteMany(ctx context.Context, ids []string) error {
+	err := store.transaction(ctx, func(ctx context.Context) error { return store.deleteAll(ctx, ids) })
+	if !errors.Is(err, errMongoStandalone) {
+		return err
+	}
+	if err := store.requireAll(ctx, ids); err != nil {
+		return err
+	}
+	_, err = store.collection.DeleteMany(ctx, mongoIDs(ids))
+	return err
+}
+
+// MergeAlbums updates the survivor and deletes the duplicates in a
+// transaction, where the server supports one. A standalone server checks
+// that the duplicates exist and then makes the two writes one after the
+// other.
+func (store *MongoAlbumStore) MergeAlbums(ctx context.Context, survivor album, duplicates []string) (album, error) {
+	var merged album
+	err := store.transaction(ctx, func(ctx context.Context) (err error) {
+		if merged, err = store.Update(ctx, survivor, false); err != nil {
+			return err
+		}
+		return store.deleteAll(ctx, duplicates)
+	})
+	if errors.Is(err, errMongoStandalone) {
+		if err = store.requireAll(ctx, duplicates); err == nil {
+			if merged, err = store.Update(ctx, survivor, false); err == nil {
+				_, err = store.collection.DeleteMany(ctx, mongoIDs(duplicates))
+			}
+		}
+	}
+	if err != nil {
+		return album{}, err
+	}
+	return merged, nil
+}
+
+func mongoIDs(ids []string) bson.D {
+	return bson.D{{Key: "id", Value: bson.D{{Key: "$in", Value: ids}}}}
+}
+
+// deleteAll deletes the albums in ids, or returns errAlbumNotFound if any is
+// missing. Only a transaction makes that all or nothing.
+func (store *MongoAlbumStore) deleteAll(ctx context.Context, ids []string) error {
+	res, err := store.collection.DeleteMany(ctx, mongoIDs(ids))
+	if err != nil {
+		return err
+	}
+	if int(res.DeletedCount) != len(ids) {
+		return errAlbumNotFound
+	}
+	return nil
+}
+
+// requireAll checks that every album in ids is stored.
+func (store *MongoAlbumStore) requireAll(ctx context.Context, ids []string) error {
+	n, err := store.collection.CountDocuments(ctx, mongoIDs(ids))
+	if err != nil {
+		return err
+	}
+	if int(n) != len(ids) {
+		return errAlbumNotFound
+	}
+	return nil
+}
+
+// transaction runs fn in a multi-document transaction. It returns
+// errMongoStandalone if the server can't run one. The driver may call fn
+// again on a transient error.
+func (store *MongoAlbumStore) transaction(ctx context.Context, fn func(context.Context) error) error {
+	session, err := store.collection.Database().Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) { return nil, fn(sc) })
+	var cmdErr mongo.CommandError
+	if errors.As(err, &cmdErr) && cmdErr.Code == mongoIllegalOperation {
+		return errMongoStandalone
+	}
+	return err
+}
+
+// mongoIllegalOperation is the server's error code for a transaction on a
+// standalone server, which only replica sets and sharded clusters support.
+const mongoIllegalOperation = 20
+
+var errMongoStandalone = errors.New("the MongoDB server can't run transactions")
+
+// batch runs op for each album in a multi-document transaction. A standalone
+// server can't run one, so there the batch falls back to compensation: the
+// albums are written one by one and, on failure, the ones already written
+// are deleted or restored and their price changes removed. Other clients may briefly see the partial batch
+// in that mode, and a write they make to the same albums meanwhile is
+// overwritten by the restore.
+func (store *MongoAlbumStore) batch(ctx context.Context, albums []album, op func(context.Context, album) (album, error)) ([]album, error) {
+	var done []album
+	err := store.transaction(ctx, func(ctx context.Context) error {
+		done = make([]album, 0, len(albums))
+		for _, a := range albums {
+			applied, err := op(ctx, a)
+			if err != nil {
+				return fmt.Errorf("album %s: %w", a.ID, err)
+			}
+			done = append(done, applied)
+		}
+		return nil
+	})
+	if errors.Is(err, errMongoStandalone) {
+		return store.compensatingBatch(ctx, albums, op)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+func (store *MongoAlbumStore) compensatingBatch(ctx context.Context, albums []album, op func(context.Context, album) (album, error)) ([]album, error) {
+	done := make([]album, 0, len(albums))
+	var undo []func(context.Context) error
+	for _, a := range albums {
+		previous, err := store.GetByID(ctx, a.ID)
+		existed := err == nil
+		if err != nil && !errors.Is(err, errAlbumNotFound) {
+			return nil, store.rollBack(ctx, undo, fmt.Errorf("album %s: %w", a.ID, err))
+		}
+		applied, err := op(ctx, a)
+		if err != nil {
+			return nil, store.rollBack(ctx, undo, fmt.Errorf("album %s: %w", a.ID, err))
+		}
+		id, changedAt := a.ID, applied.UpdatedAt
+		undo = append(undo, func(ctx context.Context) error {
+			_, err := store.audit.DeleteMany(ctx, bson.D{
+				{Key: "albumId", Value: id}, {Key: "action", Value: auditAlbumPriceChanged}, {Key: "timestamp", Value: changedAt},
+			})
+			if err != nil {
+				return err
+			}
+			if existed {
+				_, err = store.collection.ReplaceOne(ctx, bson.D{{Key: "id", Value: id}}, newMongoAlbum(previous))
+				return err
+			}
+			_, err = store.collection.DeleteOne(ctx, bson.D{{Key: "id", Value: id}})
+			return err
+		})
+		done = append(done, applied)
+	}
+	return done, nil
+}
+
+// rollBack undoes a compensating batch's writes, newest first, and returns
+// cause. The undo runs even if ctx has been cancelled.
+func (store *MongoAlbumStore) rollBack(ctx context.Context, undo []func(context.Context) error, cause error) error {
+	ctx = context.WithoutCancel(ctx)
+	for i := len(undo) - 1; i >= 0; i-- {
+		if err := undo[i](ctx); err != nil {
+			log.Printf("🔥 Failed to roll back a MongoDB album batch: %v", err)
+		}
+	}
+	return cause
+}
+
+// Import loads albums as-is, upserting by ID. MongoDB only offers
+// multi-document transactions on replica sets, so this is not atomic: a
+// failure part-way through leaves the albums written so far in place. The
+// backup is fully validated before Import is called, which makes that
+// unlikely outside of connectivity problems.
+func (store *MongoAlbumStore) Import(ctx context.Context, mode importMode, next func() (album, error)) (int, error) {
+	if mode == importReplace {
+		if _, err := store.collection.DeleteMany(ctx, bson.D{}); err != nil {
+			return 0, err
+		}
+	}
+	n := 0
+	for {
+		a, err := next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		_, err = store.collection.ReplaceOne(ctx, bson.D{{Key: "id", Value: a.ID}}, newMongoAlbum(a), options.Replace().SetUpsert(true))
+		if err != nil {
+			return n, fmt.Errorf("album %s: %w", a.ID, mapMongoAlbumError(err))
+		}
+		n++
+	}
+}
+
+func (store *MongoAlbumStore) slugTaken(ctx context.Context, slug string) bool {
+	n, err := store.collection.CountDocuments(ctx, bson.D{{Key: "slug", Value: slug}}, options.Count().SetLimit(1))
+	return err == nil && n > 0
+}
+
+func mapMongoAlbumError(err error) error {
+	if mongo.IsDuplicateKeyError(err) {
+		switch {
+		case strings.Contains(err.Error(), mongoBarcodeIndex):
+			return errBarcodeTaken
+		case strings.Contains(err.Error(), mongoSlugIndex):
+			return errSlugTaken
+		}
+		return fmt.Errorf("%w: %v", errDuplicateAlbum, err)
+	}
+	return err
+}
+
+func (store *MongoAlbumStore) Ping(ctx context.Context) error {
+	return store.collection.Database().Client().Ping(ctx, nil)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// testMongoAlbumStore opens a MongoAlbumStore on a scratch database.
+func testMongoAlbumStore(t *testing.T) *MongoAlbumStore {
+	t.Helper()
+	db := testMongoDatabase(t)
+	store, err := NewMongoAlbumStore(db.Collection("albums"), db.Collection("auditLog"), db.Collection("importJobs"), db.Collection("savedSearches"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestMongoAlbumStoreIndexes(t *testing.T) {
+	store := testMongoAlbumStore(t)
+	ctx := context.Background()
+	cur, err := store.collection.Indexes().List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indexes []struct {
+		Name string `bson:"name"`
+	}
+	if err := cur.All(ctx, &indexes); err != nil {
+		t.Fatal(err)
+	}
+	have := map[string]bool{}
+	for _, ix := range indexes {
+		have[ix.Name] = true
+	}
+	for _, name := range []string{"id_1", mongoSlugIndex, mongoBarcodeIndex, "artist_price_ci", "title_artist_text"} {
+		if !have[name] {
+			t.Errorf("no %s index; have %v", name, have)
+		}
+	}
+	// Opening the store again finds them in place.
+	if _, err := NewMongoAlbumStore(store.collection, store.audit, store.importJobs, store.savedSearches); err != nil {
+		t.Errorf("reopening the store: %v", err)
+	}
+}
+
+func TestMongoArtistQueryUsesIndex(t *testing.T) {
+	store := testMongoAlbumStore(t)
+	ctx := context.Background()
+	for i, artist := range []string{"John Coltrane", "Miles Davis", "Bill Evans"} {
+		a := newTestAlbum(withID(newAlbumID()), withArtist(artist), withTitle(artist), withPrice(int64(1000+i)))
+		if _, err := store.Create(ctx, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	maxPrice := 20.0
+	var explain bson.M
+	err := store.collection.Database().RunCommand(ctx, bson.D{
+		{Key: "explain", Value: bson.D{
+			{Key: "find", Value: store.collection.Name()},
+			{Key: "filter", Value: mongoAlbumFilter(AlbumFilter{Artist: "miles davis", MaxPrice: &maxPrice})},
+			{Key: "collation", Value: mongoListCollation.ToDocument()},
+		}},
+		{Key: "verbosity", Value: "queryPlanner"},
+	}).Decode(&explain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := bson.MarshalExtJSON(explain["queryPlanner"], false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(plan), "IXSCAN") || !strings.Contains(string(plan), "artist_price_ci") {
+		t.Errorf("the artist query doesn't use artist_price_ci: %s", plan)
+	}
+
+	// The same query, through the store, matches case-insensitively.
+	page, err := store.List(ctx, ListOptions{Filter: AlbumFilter{Artist: "miles davis", MaxPrice: &maxPrice}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Albums) != 1 || page.Albums[0].Artist != "Miles Davis" {
+		t.Errorf("List by artist = %+v, want the one Miles Davis album", page.Albums)
+	}
+	stats, err := store.Stats(ctx, AlbumFilter{Artist: "MILES DAVIS"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Count != 1 || stats.TotalValue.Cents() != 1001 {
+		t.Errorf("Stats by artist = %+v, want one album worth 10.01", stats)
+	}
+}
@@ -0,0 +1,744 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// PostgresAlbumStore keeps albums in a Postgres table. Slug and barcode
+// uniqueness are enforced by unique constraints; empty barcodes are stored as
+// NULL so any number of albums may omit one.
+type PostgresAlbumStore struct {
+	pool    *pgxpool.Pool
+	db      postgresQuerier // the pool, or the transaction of a batch
+	timeout time.Duration   // per-operation deadline
+
+	replica     *pgxpool.Pool // where album reads go, see reader; nil without DATABASE_REPLICA_URL
+	replicaWait time.Duration
+}
+
+// postgresQuerier is what album queries need; both *pgxpool.Pool and pgx.Tx
+// provide it.
+type postgresQuerier interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// opContext bounds a single store operation so a stalled database can't hold
+// a request (and a pooled connection) indefinitely.
+func (store *PostgresAlbumStore) opContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, store.timeout)
+}
+
+// NewPostgresAlbumStore expects the albums table from migrations/postgres to
+// exist. It computes the search keys the table lacks.
+func NewPostgresAlbumStore(pool *pgxpool.Pool, timeout time.Duration) (*PostgresAlbumStore, error) {
+	store := &PostgresAlbumStore{pool: pool, db: pool, timeout: timeout}
+	if err := store.fillSearchKeys(context.Background()); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// fillSearchKeys implements the store's part of fillSearchKeys. Setting a
+// key isn't recorded in the change log; the trigger leaves search_key out.
+func (store *PostgresAlbumStore) fillSearchKeys(ctx context.Context) error {
+	return fillSearchKeys("PostgreSQL", func() ([]keylessAlbum, error) {
+		opCtx, cancel := store.opContext(ctx)
+		defer cancel()
+		rows, err := store.db.Query(opCtx, `SELECT id, title, artist FROM albums WHERE search_key IS NULL ORDER BY seq LIMIT $1`, searchKeyBatch)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		var batch []keylessAlbum
+		for rows.Next() {
+			var a keylessAlbum
+			if err := rows.Scan(&a.ID, &a.Title, &a.Artist); err != nil {
+				return nil, err
+			}
+			batch = append(batch, a)
+		}
+		return batch, rows.Err()
+	}, func(id, key string) error {
+		opCtx, cancel := store.opContext(ctx)
+		defer cancel()
+		_, err := store.db.Exec(opCtx, `UPDATE albums SET search_key = $2 WHERE id = $1`, id, key)
+		return err
+	})
+}
+
+// PoolStats reports the state of the store's connection pool.
+func (store *PostgresAlbumStore) PoolStats() (types.PoolStats, bool) {
+	s := store.pool.Stat()
+	return types.PoolStats{
+		MaxConns:             s.MaxConns(),
+		TotalConns:           s.TotalConns(),
+		AcquiredConns:        s.AcquiredConns(),
+		IdleConns:            s.IdleConns(),
+		ConstructingConns:    s.ConstructingConns(),
+		AcquireCount:         s.AcquireCount(),
+		EmptyAcquireCount:    s.EmptyAcquireCount(),
+		CanceledAcquireCount: s.CanceledAcquireCount(),
+		AcquireDurationMs:    float64(s.AcquireDuration()) / float64(time.Millisecond),
+	}, true
+}
+
+const postgresAlbumColumns = `id, title, artist, price, genre, slug, COALESCE(barcode, ''), year, tracks, metadata, stock, created_at, updated_at, available_from, available_until`
+
+// scanPostgresAlbum reads the postgresAlbumColumns of row, then any columns
+// selected after them into extra.
+func scanPostgresAlbum(row pgx.Row, extra ...interface{}) (album, error) {
+	var a album
+	dest := []interface{}{&a.ID, &a.Title, &a.Artist, &a.Price, &a.Genre, &a.Slug, &a.Barcode, &a.Year, &a.Tracks, &a.Metadata, &a.Stock, &a.CreatedAt, &a.UpdatedAt, &a.AvailableFrom, &a.AvailableUntil}
+	err := row.Scan(append(dest, extra...)...)
+	a.Price = a.Price.Round()
+	a.CreatedAt, a.UpdatedAt = a.CreatedAt.UTC(), a.UpdatedAt.UTC()
+	a.AvailableFrom, a.AvailableUntil = availabilityTime(a.AvailableFrom), availabilityTime(a.AvailableUntil)
+	return a, err
+}
+
+func (store *PostgresAlbumStore) List(ctx context.Context, opts ListOptions) (albumPage, error) {
+	return listPage(ctx, opts, store.scan)
+}
+
+func (store *PostgresAlbumStore) Iterate(ctx context.Context, opts ListOptions, fn func(album) error) error {
+	return iterate(ctx, opts, store.scan, fn)
+}
+
+// scan implements albumScan with keyset pagination on seq: each chunk is a
+// query of its own, bound by the per-operation timeout, that starts after
+// the last seq of the one before.
+func (store *PostgresAlbumStore) scan(ctx context.Context, opts ListOptions, fn func(album, string) error) error {
+	after, resume, err := opts.seqAfter()
+	if err != nil {
+		return err
+	}
+	search := opts.Filter.search()
+	for {
+		chunk, seqs, err := store.chunk(ctx, opts, after, resume)
+		if err != nil {
+			return err
+		}
+		for i, a := range chunk {
+			if !search.matches(a) {
+				continue
+			}
+			if err := fn(a, strconv.FormatInt(seqs[i], 10)); err != nil {
+				return err
+			}
+		}
+		if len(chunk) < opts.chunkSize() {
+			return nil
+		}
+		after, resume = seqs[len(seqs)-1], true
+	}
+}
+
+// chunk reads the next rows matching opts after seq after, or from the
+// start unless resume.
+func (store *PostgresAlbumStore) chunk(ctx context.Context, opts ListOptions, after int64, resume bool) ([]album, []int64, error) {
+	where, args := postgresAlbumWhere(opts.Filter)
+	order := " ORDER BY seq"
+	if resume {
+		cond := "seq > $%d"
+		if opts.Newest {
+			cond = "seq < $%d"
+		}
+		args = append(args, after)
+		where = postgresAnd(where, fmt.Sprintf(cond, len(args)))
+	}
+	if opts.Newest {
+		order += " DESC"
+	}
+	args = append(args, opts.chunkSize())
+	db := store.reader(ctx)
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	rows, err := db.Query(ctx, `SELECT `+postgresAlbumColumns+`, seq FROM albums`+where+order+fmt.Sprintf(" LIMIT $%d", len(args)), args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	var chunk []album
+	var seqs []int64
+	for rows.Next() {
+		var seq int64
+		a, err := scanPostgresAlbum(rows, &seq)
+		if err != nil {
+			return nil, nil, err
+		}
+		chunk, seqs = append(chunk, a), append(seqs, seq)
+	}
+	return chunk, seqs, rows.Err()
+}
+
+// postgresAnd adds cond to a WHERE clause from postgresAlbumWhere.
+func postgresAnd(where, cond string) string {
+	if where == "" {
+		return " WHERE " + cond
+	}
+	return where + " AND " + cond
+}
+
+// postgresAlbumWhere translates filter into a WHERE clause and its arguments.
+// A search is only narrowed here; List applies searchQuery.matches to the
+// rows.
+func postgresAlbumWhere(filter AlbumFilter) (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		args = append(args, arg)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+	if filter.Artist != "" {
+		add("lower(artist) = lower($%d)", filter.Artist)
+	}
+	if filter.Genre != "" {
+		add("lower(genre) = lower($%d)", filter.Genre)
+	}
+	if filter.MinPrice != nil {
+		add("price >= $%d", *filter.MinPrice)
+	}
+	if filter.MaxPrice != nil {
+		add("price <= $%d", *filter.MaxPrice)
+	}
+	if len(filter.Metadata) > 0 {
+		add("metadata @> $%d", postgresMetadata(filter.Metadata))
+	}
+	// A row an older version wrote has no key yet and isn't narrowed.
+	for _, term := range searchTerms(filter.Query) {
+		add("(search_key IS NULL OR search_key LIKE $%d)", searchKeyPattern(term))
+	}
+	if !filter.AvailableAt.IsZero() {
+		add("(available_from IS NULL OR available_from <= $%[1]d) AND (available_until IS NULL OR available_until > $%[1]d)", filter.AvailableAt)
+	}
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// Search runs the query as a WHERE clause.
+func (store *PostgresAlbumStore) Search(ctx context.Context, query searchNode) ([]album, error) {
+	var args []interface{}
+	where := searchSQL(query, func(value interface{}) string {
+		args = append(args, value)
+		if _, ok := value.(float64); ok {
+			// year is an integer column; the cast keeps a fractional
+			// value from failing to encode as one.
+			return fmt.Sprintf("$%d::double precision", len(args))
+		}
+		return fmt.Sprintf("$%d", len(args))
+	}, "(strpos(%s, %s) > 0)")
+	if where != "" {
+		where = " WHERE " + where
+	}
+	db := store.reader(ctx)
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	rows, err := db.Query(ctx, `SELECT `+postgresAlbumColumns+` FROM albums`+where+` ORDER BY seq`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []album{}
+	for rows.Next() {
+		a, err := scanPostgresAlbum(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, a)
+	}
+	return list, rows.Err()
+}
+
+// ArtistGroups groups the albums by artist in the database, so one row per
+// artist leaves it.
+func (store *PostgresAlbumStore) ArtistGroups(ctx context.Context, availableAt time.Time) ([]artistGroup, error) {
+	db := store.reader(ctx)
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	where, args := postgresAlbumWhere(AlbumFilter{AvailableAt: availableAt})
+	rows, err := db.Query(ctx, `SELECT artist, count(*), sum(price), min(price), max(price), max(created_at)
+		 FROM albums`+where+` GROUP BY artist`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var groups []artistGroup
+	for rows.Next() {
+		var g artistGroup
+		if err := rows.Scan(&g.Artist, &g.Albums, &g.TotalValue, &g.MinPrice, &g.MaxPrice, &g.LastAddedAt); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+func (store *PostgresAlbumStore) GetByID(ctx context.Context, id string) (album, error) {
+	return store.getOne(ctx, `id = $1`, id)
+}
+
+func (store *PostgresAlbumStore) GetBySlug(ctx context.Context, slug string) (album, error) {
+	return store.getOne(ctx, `slug = $1`, slug)
+}
+
+func (store *PostgresAlbumStore) GetByBarcode(ctx context.Context, code string) (album, error) {
+	return store.getOne(ctx, `barcode = $1`, code)
+}
+
+func (store *PostgresAlbumStore) getOne(ctx context.Context, where string, arg string) (album, error) {
+	db := store.reader(ctx)
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	a, err := scanPostgresAlbum(db.QueryRow(ctx, `SELECT `+postgresAlbumColumns+` FROM albums WHERE `+where, arg))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return album{}, errAlbumNotFound
+	}
+	return a, err
+}
+
+func (store *PostgresAlbumStore) Create(ctx context.Context, a album) (album, error) {
+	err := store.inTx(ctx, func(tx *PostgresAlbumStore) (err error) {
+		if err := tx.checkCatalogRoom(ctx, 1); err != nil {
+			return err
+		}
+		a, err = tx.create(ctx, a)
+		return err
+	})
+	if err != nil {
+		return album{}, err
+	}
+	return a, nil
+}
+
+func (store *PostgresAlbumStore) create(ctx context.Context, a album) (album, error) {
+	a.Slug = uniqueSlug(slugify(a.Title, a.Artist), func(slug string) bool { return store.slugTaken(ctx, slug) })
+	stampCreated(&a)
+	opCtx, cancel := store.opContext(ctx)
+	defer cancel()
+	_, err := store.db.Exec(opCtx,
+		`INSERT INTO albums (id, title, artist, price, genre, slug, barcode, year, tracks, metadata, stock, created_at, updated_at, available_from, available_until, search_key)
+		 VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, $9, $10, $11, $12, $13, $14, $15, $16)`,
+		a.ID, a.Title, a.Artist, a.Price, a.Genre, a.Slug, a.Barcode, a.Year, nonNilTracks(a.Tracks), postgresMetadata(a.Metadata), a.Stock, a.CreatedAt, a.UpdatedAt,
+		a.AvailableFrom, a.AvailableUntil, searchKey(a.Title, a.Artist))
+	if err != nil {
+		return album{}, mapPostgresAlbumError(err)
+	}
+	if err := store.recordPriceChange(ctx, a.ID, initialPrice(ctx, a)); err != nil {
+		return album{}, err
+	}
+	return a, nil
+}
+
+// Update writes the album and any price change in one transaction. The
+// stored row is locked while it is compared, so the change recorded is
+// from the price a concurrent update left.
+func (store *PostgresAlbumStore) Update(ctx context.Context, a album, regenerateSlug bool) (album, error) {
+	err := store.inTx(ctx, func(tx *PostgresAlbumStore) (err error) {
+		a, err = tx.update(ctx, a, regenerateSlug)
+		return err
+	})
+	if err != nil {
+		return album{}, err
+	}
+	return a, nil
+}
+
+func (store *PostgresAlbumStore) update(ctx context.Context, a album, regenerateSlug bool) (album, error) {
+	existing, err := store.getOne(ctx, `id = $1 FOR UPDATE`, a.ID)
+	if err != nil {
+		return album{}, err
+	}
+	stampUpdated(&a, existing)
+	a.Slug = existing.Slug
+	if regenerateSlug {
+		a.Slug = uniqueSlug(slugify(a.Title, a.Artist), func(slug string) bool {
+			return slug != existing.Slug && store.slugTaken(ctx, slug)
+		})
+	}
+	opCtx, cancel := store.opContext(ctx)
+	defer cancel()
+	tag, err := store.db.Exec(opCtx,
+		`UPDATE albums SET title = $2, artist = $3, price = $4, genre = $5, slug = $6, barcode = NULLIF($7, ''),
+		 year = $8, tracks = $9, metadata = $10, stock = $11, updated_at = $12, available_from = $13, available_until = $14, search_key = $15
+		 WHERE id = $1`,
+		a.ID, a.Title, a.Artist, a.Price, a.Genre, a.Slug, a.Barcode, a.Year, nonNilTracks(a.Tracks), postgresMetadata(a.Metadata), a.Stock, a.UpdatedAt,
+		a.AvailableFrom, a.AvailableUntil, searchKey(a.Title, a.Artist))
+	if err != nil {
+		return album{}, mapPostgresAlbumError(err)
+	}
+	if tag.RowsAffected() == 0 {
+		return album{}, errAlbumNotFound
+	}
+	if change, ok := priceChange(ctx, existing, a); ok {
+		if err := store.recordPriceChange(ctx, a.ID, change); err != nil {
+			return album{}, err
+		}
+	}
+	return a, nil
+}
+
+// recordPriceChange adds change to the audit log, in the transaction the
+// store is bound to.
+func (store *PostgresAlbumStore) recordPriceChange(ctx context.Context, albumID string, change PriceChange) error {
+	entry := change.auditEntry(albumID)
+	details, err := json.Marshal(entry.Details)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	_, err = store.db.Exec(ctx,
+		`INSERT INTO audit_log (id, timestamp, action, album_id, principal, details) VALUES ($1, $2, $3, $4, $5, $6)`,
+		entry.ID, entry.Timestamp, entry.Action, entry.AlbumID, entry.Principal, details)
+	return err
+}
+
+// PriceHistory reads the album's price changes from the audit log.
+func (store *PostgresAlbumStore) PriceHistory(ctx context.Context, albumID string, limit, offset int) ([]PriceChange, int, error) {
+	db := store.reader(ctx)
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	var total int
+	err := db.QueryRow(ctx, `SELECT count(*) FROM audit_log WHERE album_id = $1 AND action = $2`,
+		albumID, auditAlbumPriceChanged).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := db.Query(ctx,
+		`SELECT timestamp, principal, details FROM audit_log WHERE album_id = $1 AND action = $2
+		 ORDER BY timestamp DESC, id DESC LIMIT $3 OFFSET $4`,
+		albumID, auditAlbumPriceChanged, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	changes := []PriceChange{}
+	for rows.Next() {
+		var at time.Time
+		var principal string
+		var details []byte
+		if err := rows.Scan(&at, &principal, &details); err != nil {
+			return nil, 0, err
+		}
+		change, err := priceChangeFromAudit(at, principal, details)
+		if err != nil {
+			return nil, 0, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, total, rows.Err()
+}
+
+// Changes reads the change log that the albums table's trigger writes.
+func (store *PostgresAlbumStore) Changes(ctx context.Context, since int64, limit int) ([]types.AlbumChange, int64, error) {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	var trimmed, head int64
+	err := store.db.QueryRow(ctx,
+		`SELECT trimmed_through, COALESCE((SELECT max(seq) FROM album_changes), trimmed_through) FROM album_change_log`).Scan(&trimmed, &head)
+	if err != nil {
+		return nil, 0, err
+	}
+	if since < trimmed || since > head {
+		return nil, 0, errChangesTrimmed
+	}
+	rows, err := store.db.Query(ctx,
+		`SELECT seq, op, album_id, changed_at FROM album_changes WHERE seq > $1 ORDER BY seq LIMIT $2`, since, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	changes := []types.AlbumChange{}
+	for rows.Next() {
+		var c types.AlbumChange
+		if err := rows.Scan(&c.Seq, &c.Op, &c.AlbumID, &c.ChangedAt); err != nil {
+			return nil, 0, err
+		}
+		c.ChangedAt = c.ChangedAt.UTC()
+		changes = append(changes, c)
+	}
+	if n := len(changes); n > 0 {
+		// Changes committed since the head was read.
+		head = max(head, changes[n-1].Seq)
+	}
+	return changes, head, rows.Err()
+}
+
+// TrimChanges deletes the changes made before before, remembering the
+// newest it deleted so that a since older than that is answered 410.
+func (store *PostgresAlbumStore) TrimChanges(ctx context.Context, before time.Time) (int, error) {
+	n := 0
+	err := store.inTx(ctx, func(tx *PostgresAlbumStore) error {
+		ctx, cancel := tx.opContext(ctx)
+		defer cancel()
+		var through *int64
+		if err := tx.db.QueryRow(ctx, `SELECT max(seq) FROM album_changes WHERE changed_at < $1`, before).Scan(&through); err != nil {
+			return err
+		}
+		if through == nil {
+			return nil
+		}
+		_, err := tx.db.Exec(ctx, `UPDATE album_change_log SET trimmed_through = GREATEST(trimmed_through, $1),
+			 history_since = GREATEST(history_since, (SELECT max(changed_at) FROM album_changes WHERE seq <= $1))`, *through)
+		if err != nil {
+			return err
+		}
+		tag, err := tx.db.Exec(ctx, `DELETE FROM album_changes WHERE seq <= $1`, *through)
+		n = int(tag.RowsAffected())
+		return err
+	})
+	return n, err
+}
+
+// Revisions implements revisionKeeper with the snapshots the trigger keeps.
+// history_since is read after the changes, so that a trim in between is
+// seen and the window answered as trimmed.
+func (store *PostgresAlbumStore) Revisions(ctx context.Context, from, to time.Time) ([]albumRevision, time.Time, error) {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	rows, err := store.db.Query(ctx, `SELECT seq, op, album_id, changed_at, before, after FROM album_changes
+		 WHERE changed_at > $1 AND changed_at <= $2 ORDER BY seq`, from, to)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer rows.Close()
+	var revisions []albumRevision
+	for rows.Next() {
+		var rev albumRevision
+		var before, after []byte
+		if err := rows.Scan(&rev.Seq, &rev.Op, &rev.AlbumID, &rev.ChangedAt, &before, &after); err != nil {
+			return nil, time.Time{}, err
+		}
+		rev.ChangedAt = rev.ChangedAt.UTC()
+		if rev.before, err = decodeSnapshot(before); err != nil {
+			return nil, time.Time{}, err
+		}
+		if rev.after, err = decodeSnapshot(after); err != nil {
+			return nil, time.Time{}, err
+		}
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, time.Time{}, err
+	}
+	var since time.Time
+	if err := store.db.QueryRow(ctx, `SELECT history_since FROM album_change_log`).Scan(&since); err != nil {
+		return nil, time.Time{}, err
+	}
+	return revisions, since.UTC(), nil
+}
+
+// OutboxPosition implements outboxKeeper. The trigger writes each change in
+// the transaction of the write, so the events are durable.
+func (store *PostgresAlbumStore) OutboxPosition(ctx context.Context) (outboxPosition, error) {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	pos := outboxPosition{Durable: true}
+	err := store.db.QueryRow(ctx, `SELECT sent_through, trimmed_through FROM album_change_log`).Scan(&pos.Sent, &pos.Trimmed)
+	return pos, err
+}
+
+// AdvanceOutbox implements outboxKeeper.
+func (store *PostgresAlbumStore) AdvanceOutbox(ctx context.Context, from, to int64) (bool, error) {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	tag, err := store.db.Exec(ctx, `UPDATE album_change_log SET sent_through = $1 WHERE sent_through = $2`, to, from)
+	return tag.RowsAffected() == 1, err
+}
+
+func (store *PostgresAlbumStore) CreateMany(ctx context.Context, albums []album) ([]album, error) {
+	var created []album
+	err := store.inTx(ctx, func(tx *PostgresAlbumStore) (err error) {
+		if err := tx.checkCatalogRoom(ctx, len(albums)); err != nil {
+			return err
+		}
+		created, err = tx.batch(ctx, albums, func(tx *PostgresAlbumStore, a album) (album, error) { return tx.create(ctx, a) })
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (store *PostgresAlbumStore) UpdateMany(ctx context.Context, albums []album, regenerateSlug bool) ([]album, error) {
+	return store.batch(ctx, albums, func(tx *PostgresAlbumStore, a album) (album, error) { return tx.update(ctx, a, regenerateSlug) })
+}
+
+// DeleteMany deletes the albums in one statement. Their price history stays
+// in the audit log.
+func (store *PostgresAlbumStore) DeleteMany(ctx context.Context, ids []string) error {
+	return store.inTx(ctx, func(tx *PostgresAlbumStore) error { return tx.deleteAll(ctx, ids) })
+}
+
+// MergeAlbums updates the survivor and deletes the duplicates in one
+// transaction.
+func (store *PostgresAlbumStore) MergeAlbums(ctx context.Context, survivor album, duplicates []string) (album, error) {
+	err := store.inTx(ctx, func(tx *PostgresAlbumStore) (err error) {
+		if survivor, err = tx.update(ctx, survivor, false); err != nil {
+			return err
+		}
+		return tx.deleteAll(ctx, duplicates)
+	})
+	if err != nil {
+		return album{}, err
+	}
+	return survivor, nil
+}
+
+// deleteAll deletes the albums in ids, or returns errAlbumNotFound if any is
+// missing. The caller rolls back on error.
+func (store *PostgresAlbumStore) deleteAll(ctx context.Context, ids []string) error {
+	opCtx, cancel := store.opContext(ctx)
+	defer cancel()
+	tag, err := store.db.Exec(opCtx, `DELETE FROM albums WHERE id = ANY($1)`, ids)
+	if err != nil {
+		return err
+	}
+	if int(tag.RowsAffected()) != len(ids) {
+		return errAlbumNotFound
+	}
+	return nil
+}
+
+// batch runs op for each album against a copy of the store bound to one
+// transaction, so slug checks see the batch's own writes and any failure
+// rolls all of them back. Each statement keeps the per-operation timeout;
+// the batch as a whole is bound by ctx.
+func (store *PostgresAlbumStore) batch(ctx context.Context, albums []album, op func(*PostgresAlbumStore, album) (album, error)) ([]album, error) {
+	done := make([]album, 0, len(albums))
+	err := store.inTx(ctx, func(tx *PostgresAlbumStore) error {
+		for _, a := range albums {
+			applied, err := op(tx, a)
+			if err != nil {
+				return fmt.Errorf("album %s: %w", a.ID, err)
+			}
+			done = append(done, applied)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+// inTx runs fn against a copy of the store bound to a new transaction,
+// committing if it returns nil, or against the store itself when it is
+// already bound to one, as in a batch.
+func (store *PostgresAlbumStore) inTx(ctx context.Context, fn func(tx *PostgresAlbumStore) error) error {
+	if _, ok := store.db.(pgx.Tx); ok {
+		return fn(store)
+	}
+	return store.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		return fn(&PostgresAlbumStore{pool: store.pool, db: tx, timeout: store.timeout})
+	})
+}
+
+// Import loads albums as-is inside a single transaction; merge upserts by ID.
+// Any failure rolls back, leaving the previous catalog intact. A large
+// import can take a while, so it is bound by ctx but not by the
+// per-operation timeout.
+func (store *PostgresAlbumStore) Import(ctx context.Context, mode importMode, next func() (album, error)) (int, error) {
+	tx, err := store.pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+	if mode == importReplace {
+		if _, err := tx.Exec(ctx, `DELETE FROM albums`); err != nil {
+			return 0, err
+		}
+	}
+	n := 0
+	for {
+		a, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(ctx,
+			`INSERT INTO albums (id, title, artist, price, genre, slug, barcode, year, tracks, metadata, stock, created_at, updated_at, available_from, available_until, search_key)
+			 VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, $9, $10, $11, $12, $13, $14, $15, $16)
+			 ON CONFLICT (id) DO UPDATE SET title = EXCLUDED.title, artist = EXCLUDED.artist, price = EXCLUDED.price,
+			 genre = EXCLUDED.genre, slug = EXCLUDED.slug, barcode = EXCLUDED.barcode, year = EXCLUDED.year,
+			 tracks = EXCLUDED.tracks, metadata = EXCLUDED.metadata, stock = EXCLUDED.stock, created_at = EXCLUDED.created_at, updated_at = EXCLUDED.updated_at,
+			 available_from = EXCLUDED.available_from, available_until = EXCLUDED.available_until, search_key = EXCLUDED.search_key`,
+			a.ID, a.Title, a.Artist, a.Price, a.Genre, a.Slug, a.Barcode, a.Year, nonNilTracks(a.Tracks), postgresMetadata(a.Metadata), a.Stock, a.CreatedAt, a.UpdatedAt,
+			a.AvailableFrom, a.AvailableUntil, searchKey(a.Title, a.Artist))
+		if err != nil {
+			return 0, fmt.Errorf("album %s: %w", a.ID, mapPostgresAlbumError(err))
+		}
+		n++
+	}
+	return n, tx.Commit(ctx)
+}
+
+func (store *PostgresAlbumStore) slugTaken(ctx context.Context, slug string) bool {
+	var exists bool
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	err := store.db.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM albums WHERE slug = $1)`, slug).Scan(&exists)
+	return err == nil && exists
+}
+
+func mapPostgresAlbumError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+	switch {
+	case pgErr.Code == "23505" && pgErr.ConstraintName == "albums_barcode_key":
+		return errBarcodeTaken
+	case pgErr.Code == "23505" && pgErr.ConstraintName == "albums_slug_key":
+		return errSlugTaken
+	case pgErr.Code == "23505":
+		return fmt.Errorf("%w: %v", errDuplicateAlbum, err)
+	case strings.HasPrefix(pgErr.Code, "22"), strings.HasPrefix(pgErr.Code, "23"):
+		// Class 22 is data exceptions (bad values); the rest of class 23 is
+		// NOT NULL, CHECK, and foreign key violations.
+		return fmt.Errorf("%w: %v", errRejectedAlbum, err)
+	}
+	return err
+}
+
+// nonNilTracks keeps a nil slice from being written as NULL into the NOT NULL
+// tracks column.
+func nonNilTracks(tracks []string) []string {
+	if tracks == nil {
+		return []string{}
+	}
+	return tracks
+}
+
+// postgresMetadata encodes metadata for the NOT NULL metadata column, as
+// an empty object when there is none.
+func postgresMetadata(metadata map[string]string) string {
+	if len(metadata) == 0 {
+		return "{}"
+	}
+	data, _ := json.Marshal(metadata)
+	return string(data)
+}
+
+func (store *PostgresAlbumStore) Ping(ctx context.Context) error {
+	return store.pool.Ping(ctx)
+}
@@ -0,0 +1,704 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brentmzey/web-service-go/money"
+	"github.com/brentmzey/web-service-go/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// sqliteAlbum is the gorm model backing SqliteAlbumStore. Barcode is nullable
+// so the unique index only applies to albums that actually have one.
+type sqliteAlbum struct {
+	Seq     uint     `gorm:"primaryKey;autoIncrement"`
+	ID      string   `gorm:"uniqueIndex;not null"`
+	Title   string   `gorm:"not null"`
+	Artist  string   `gorm:"not null"`
+	Price   float64  `gorm:"not null"`
+	Genre   string   `gorm:"not null;default:''"`
+	Slug    string   `gorm:"uniqueIndex;not null"`
+	Barcode *string  `gorm:"uniqueIndex"`
+	Year    int      `gorm:"not null;default:0"`
+	Tracks  []string `gorm:"serializer:json"`
+	// Metadata is a JSON object, filtered on with json_extract.
+	Metadata map[string]string `gorm:"serializer:json"`
+	Stock    int               `gorm:"not null;default:0"`
+
+	CreatedAt time.Time `gorm:"autoCreateTime:false"`
+	UpdatedAt time.Time `gorm:"autoUpdateTime:false"`
+
+	AvailableFrom  *time.Time
+	AvailableUntil *time.Time
+
+	// SearchKey is searchKey of the title and artist, NULL until the store
+	// has computed it.
+	SearchKey *string
+}
+
+func (sqliteAlbum) TableName() string { return "albums" }
+
+func newSqliteAlbum(a album) sqliteAlbum {
+	rec := sqliteAlbum{ID: a.ID, Title: a.Title, Artist: a.Artist, Price: float64(a.Price), Genre: a.Genre, Slug: a.Slug, Year: a.Year, Tracks: a.Tracks,
+		Metadata: a.Metadata, Stock: a.Stock, CreatedAt: a.CreatedAt, UpdatedAt: a.UpdatedAt, AvailableFrom: a.AvailableFrom, AvailableUntil: a.AvailableUntil}
+	key := searchKey(a.Title, a.Artist)
+	rec.SearchKey = &key
+	if a.Barcode != "" {
+		rec.Barcode = &a.Barcode
+	}
+	return rec
+}
+
+func (rec sqliteAlbum) album() album {
+	a := album{ID: rec.ID, Title: rec.Title, Artist: rec.Artist, Price: money.FromFloat(rec.Price), Genre: rec.Genre, Slug: rec.Slug, Year: rec.Year, Tracks: rec.Tracks,
+		Metadata: rec.Metadata, Stock: rec.Stock, CreatedAt: rec.CreatedAt.UTC(), UpdatedAt: rec.UpdatedAt.UTC(),
+		AvailableFrom: availabilityTime(rec.AvailableFrom), AvailableUntil: availabilityTime(rec.AvailableUntil)}
+	if rec.Barcode != nil {
+		a.Barcode = *rec.Barcode
+	}
+	return a
+}
+
+type SqliteAlbumStore struct {
+	db  *gorm.DB
+	fts bool // albums_fts exists, see migrations/sqlite/0004_create_albums_fts
+}
+
+// NewSqliteAlbumStore expects the albums table from migrations/sqlite to
+// exist; sqliteAlbum must be kept in step with it. Searches use the
+// albums_fts full-text index when it has been created and fall back to LIKE
+// otherwise.
+func NewSqliteAlbumStore(db *gorm.DB) (*SqliteAlbumStore, error) {
+	ctx := context.Background()
+	var tables int64
+	err := db.WithContext(ctx).Raw(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'albums_fts'`).Scan(&tables).Error
+	if err != nil {
+		return nil, err
+	}
+	if tables > 0 {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		// The triggers on albums write to the index, so without the module
+		// every album write would fail.
+		ok, err := sqliteHasFTS5(ctx, sqlDB)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.New("the database has a full-text index but this build lacks FTS5; build with -tags sqlite_fts5")
+		}
+	}
+	store := &SqliteAlbumStore{db: db, fts: tables > 0}
+	if err := store.fillSearchKeys(ctx); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// fillSearchKeys implements the store's part of fillSearchKeys. The change
+// log triggers leave search_key out, so setting it isn't a change.
+func (store *SqliteAlbumStore) fillSearchKeys(ctx context.Context) error {
+	return fillSearchKeys("SQLite", func() ([]keylessAlbum, error) {
+		var batch []keylessAlbum
+		err := store.db.WithContext(ctx).Model(&sqliteAlbum{}).Select("id", "title", "artist").
+			Where("search_key IS NULL").Order("seq").Limit(searchKeyBatch).Scan(&batch).Error
+		return batch, err
+	}, func(id, key string) error {
+		return store.db.WithContext(ctx).Model(&sqliteAlbum{}).Where("id = ?", id).Update("search_key", key).Error
+	})
+}
+
+// sqliteHasFTS5 reports whether the linked SQLite was compiled with FTS5.
+func sqliteHasFTS5(ctx context.Context, db *sql.DB) (bool, error) {
+	var used bool
+	err := db.QueryRowContext(ctx, `SELECT sqlite_compileoption_used('ENABLE_FTS5')`).Scan(&used)
+	return used, err
+}
+
+// List ranks search results by bm25 when the full-text index is available
+// and the search asks for every album at once; pages go in seq order, like
+// every other listing.
+func (store *SqliteAlbumStore) List(ctx context.Context, opts ListOptions) (albumPage, error) {
+	// A search without a word, all punctuation, would be an empty MATCH.
+	terms := searchTerms(opts.Filter.Query)
+	if store.fts && len(terms) > 0 && opts.Limit == 0 && opts.Cursor == "" && !opts.Newest {
+		var recs []sqliteAlbum
+		q := store.albumQuery(ctx, opts.Filter).
+			Joins("JOIN (SELECT rowid, bm25(albums_fts) AS score FROM albums_fts WHERE albums_fts MATCH ?) AS hits ON hits.rowid = albums.seq", sqliteMatchQuery(terms)).
+			Order("hits.score").Order("albums.seq")
+		if err := q.Find(&recs).Error; err != nil {
+			return albumPage{}, err
+		}
+		search := opts.Filter.search()
+		page := albumPage{Albums: make([]album, 0, len(recs))}
+		for _, rec := range recs {
+			if a := rec.album(); search.matches(a) {
+				page.Albums = append(page.Albums, a)
+			}
+		}
+		return page, nil
+	}
+	return listPage(ctx, opts, store.scan)
+}
+
+func (store *SqliteAlbumStore) Iterate(ctx context.Context, opts ListOptions, fn func(album) error) error {
+	return iterate(ctx, opts, store.scan, fn)
+}
+
+// scan implements albumScan with keyset pagination on seq, a query per
+// chunk. A search uses the full-text index only to match. The index and
+// LIKE match the search keys, which only narrows a search: the collation of
+// the request has the final say.
+func (store *SqliteAlbumStore) scan(ctx context.Context, opts ListOptions, fn func(album, string) error) error {
+	after, resume, err := opts.seqAfter()
+	if err != nil {
+		return err
+	}
+	terms, search := searchTerms(opts.Filter.Query), opts.Filter.search()
+	for {
+		q := store.albumQuery(ctx, opts.Filter).Limit(opts.chunkSize())
+		if len(terms) > 0 && store.fts {
+			q = q.Where("albums.seq IN (SELECT rowid FROM albums_fts WHERE albums_fts MATCH ?)", sqliteMatchQuery(terms))
+		}
+		switch {
+		case opts.Newest && resume:
+			q = q.Where("albums.seq < ?", after)
+		case resume:
+			q = q.Where("albums.seq > ?", after)
+		}
+		if opts.Newest {
+			q = q.Order("albums.seq DESC")
+		} else {
+			q = q.Order("albums.seq")
+		}
+		var recs []sqliteAlbum
+		if err := q.Find(&recs).Error; err != nil {
+			return err
+		}
+		for _, rec := range recs {
+			if a := rec.album(); search.matches(a) {
+				if err := fn(a, strconv.FormatUint(uint64(rec.Seq), 10)); err != nil {
+					return err
+				}
+			}
+		}
+		if len(recs) < opts.chunkSize() {
+			return nil
+		}
+		after, resume = int64(recs[len(recs)-1].Seq), true
+	}
+}
+
+// albumQuery selects the albums matching filter, bar a search when the
+// full-text index is there to match it; that is left to the caller.
+func (store *SqliteAlbumStore) albumQuery(ctx context.Context, filter AlbumFilter) *gorm.DB {
+	q := store.db.WithContext(ctx).Model(&sqliteAlbum{}).Select("albums.*")
+	if filter.Artist != "" {
+		q = q.Where("lower(artist) = lower(?)", filter.Artist)
+	}
+	if filter.Genre != "" {
+		q = q.Where("lower(genre) = lower(?)", filter.Genre)
+	}
+	if filter.MinPrice != nil {
+		q = q.Where("price >= ?", *filter.MinPrice)
+	}
+	if filter.MaxPrice != nil {
+		q = q.Where("price <= ?", *filter.MaxPrice)
+	}
+	for key, value := range filter.Metadata {
+		// Keys are letters, digits, hyphens, and underscores, so the
+		// quoted path always names just that key.
+		q = q.Where("json_extract(metadata, ?) = ?", `$."`+key+`"`, value)
+	}
+	if !store.fts {
+		for _, term := range searchTerms(filter.Query) {
+			q = q.Where("search_key LIKE ?", searchKeyPattern(term))
+		}
+	}
+	if !filter.AvailableAt.IsZero() {
+		at := filter.AvailableAt.UTC().Format(sqliteTimeLayout)
+		q = q.Where("(available_from IS NULL OR available_from <= ?) AND (available_until IS NULL OR available_until > ?)", at, at)
+	}
+	return q
+}
+
+// Search runs the query as a WHERE clause. Times are bound in the layout
+// they are stored in, so they compare as text. lower only folds ASCII, as
+// in the artist and genre filters.
+func (store *SqliteAlbumStore) Search(ctx context.Context, query searchNode) ([]album, error) {
+	var args []interface{}
+	q := store.db.WithContext(ctx).Order("seq")
+	if where := searchSQL(query, func(value interface{}) string {
+		args = append(args, value)
+		return "?"
+	}, "(instr(%s, %s) > 0)"); where != "" {
+		q = q.Where(where, args...)
+	}
+	var recs []sqliteAlbum
+	if err := q.Find(&recs).Error; err != nil {
+		return nil, err
+	}
+	list := make([]album, 0, len(recs))
+	for _, rec := range recs {
+		list = append(list, rec.album())
+	}
+	return list, nil
+}
+
+// sqliteMatchQuery builds an FTS5 query requiring every term as a word
+// prefix. Each term is quoted, doubling any quotes, so user input is never
+// read as query syntax.
+func sqliteMatchQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + strings.ReplaceAll(term, `"`, `""`) + `"*`
+	}
+	return strings.Join(quoted, " ")
+}
+
+// sqliteTimeLayout is how the driver writes times. Album times are UTC, so
+// they sort as text too.
+const sqliteTimeLayout = "2006-01-02 15:04:05.999999999-07:00"
+
+// ArtistGroups groups the albums by artist in the database, so one row per
+// artist leaves it. An aggregate loses the column's datetime type, so the
+// latest addition comes back as text.
+func (store *SqliteAlbumStore) ArtistGroups(ctx context.Context, availableAt time.Time) ([]artistGroup, error) {
+	rows, err := store.albumQuery(ctx, AlbumFilter{AvailableAt: availableAt}).
+		Select("artist, count(*), sum(price), min(price), max(price), max(created_at)").Group("artist").Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var groups []artistGroup
+	for rows.Next() {
+		var g artistGroup
+		var lastAdded string
+		if err := rows.Scan(&g.Artist, &g.Albums, &g.TotalValue, &g.MinPrice, &g.MaxPrice, &lastAdded); err != nil {
+			return nil, err
+		}
+		if g.LastAddedAt, err = time.Parse(sqliteTimeLayout, lastAdded); err != nil {
+			return nil, err
+		}
+		groups = append(groups, g)
+	}
+	return groups, rows.Err()
+}
+
+func (store *SqliteAlbumStore) GetByID(ctx context.Context, id string) (album, error) {
+	return store.getOne(ctx, "id = ?", id)
+}
+
+func (store *SqliteAlbumStore) GetBySlug(ctx context.Context, slug string) (album, error) {
+	return store.getOne(ctx, "slug = ?", slug)
+}
+
+func (store *SqliteAlbumStore) GetByBarcode(ctx context.Context, code string) (album, error) {
+	return store.getOne(ctx, "barcode = ?", code)
+}
+
+func (store *SqliteAlbumStore) getOne(ctx context.Context, where string, arg string) (album, error) {
+	var rec sqliteAlbum
+	err := store.db.WithContext(ctx).Where(where, arg).First(&rec).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return album{}, errAlbumNotFound
+	}
+	if err != nil {
+		return album{}, err
+	}
+	return rec.album(), nil
+}
+
+// Create picks the slug and inserts the album in one transaction, so
+// concurrent creates of the same title can't both pick the same slug.
+func (store *SqliteAlbumStore) Create(ctx context.Context, a album) (album, error) {
+	err := store.inTx(ctx, func(tx *SqliteAlbumStore) (err error) {
+		if err := tx.checkCatalogRoom(ctx, 1); err != nil {
+			return err
+		}
+		a, err = tx.create(ctx, a)
+		return err
+	})
+	if err != nil {
+		return album{}, err
+	}
+	return a, nil
+}
+
+func (store *SqliteAlbumStore) create(ctx context.Context, a album) (album, error) {
+	a.Slug = uniqueSlug(slugify(a.Title, a.Artist), func(slug string) bool { return store.slugTaken(ctx, slug) })
+	stampCreated(&a)
+	rec := newSqliteAlbum(a)
+	if err := store.db.WithContext(ctx).Create(&rec).Error; err != nil {
+		return album{}, mapSqliteAlbumError(err)
+	}
+	if err := store.recordPriceChange(ctx, a.ID, initialPrice(ctx, a)); err != nil {
+		return album{}, err
+	}
+	return a, nil
+}
+
+// Update writes the album and any price change in one transaction.
+func (store *SqliteAlbumStore) Update(ctx context.Context, a album, regenerateSlug bool) (album, error) {
+	err := store.inTx(ctx, func(tx *SqliteAlbumStore) (err error) {
+		a, err = tx.update(ctx, a, regenerateSlug)
+		return err
+	})
+	if err != nil {
+		return album{}, err
+	}
+	return a, nil
+}
+
+func (store *SqliteAlbumStore) update(ctx context.Context, a album, regenerateSlug bool) (album, error) {
+	existing, err := store.GetByID(ctx, a.ID)
+	if err != nil {
+		return album{}, err
+	}
+	stampUpdated(&a, existing)
+	a.Slug = existing.Slug
+	if regenerateSlug {
+		a.Slug = uniqueSlug(slugify(a.Title, a.Artist), func(slug string) bool {
+			return slug != existing.Slug && store.slugTaken(ctx, slug)
+		})
+	}
+	rec := newSqliteAlbum(a)
+	res := store.db.WithContext(ctx).Model(&sqliteAlbum{}).Where("id = ?", a.ID).
+		Select("title", "artist", "price", "genre", "slug", "barcode", "year", "tracks", "metadata", "stock", "updated_at", "available_from", "available_until", "search_key").
+		Updates(&rec)
+	if res.Error != nil {
+		return album{}, mapSqliteAlbumError(res.Error)
+	}
+	if res.RowsAffected == 0 {
+		return album{}, errAlbumNotFound
+	}
+	if change, ok := priceChange(ctx, existing, a); ok {
+		if err := store.recordPriceChange(ctx, a.ID, change); err != nil {
+			return album{}, err
+		}
+	}
+	return a, nil
+}
+
+// sqliteChangeTime is how the change log triggers write changed_at, so
+// that a cutoff in the same layout compares as text.
+const sqliteChangeTime = "2006-01-02 15:04:05.000"
+
+// Changes reads the change log that the albums table's triggers write.
+func (store *SqliteAlbumStore) Changes(ctx context.Context, since int64, limit int) ([]types.AlbumChange, int64, error) {
+	db := store.db.WithContext(ctx)
+	var feed struct {
+		Trimmed int64
+		Head    int64
+	}
+	err := db.Raw(`SELECT trimmed_through AS trimmed, COALESCE((SELECT max(seq) FROM album_changes), trimmed_through) AS head FROM album_change_log`).
+		Scan(&feed).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	if since < feed.Trimmed || since > feed.Head {
+		return nil, 0, errChangesTrimmed
+	}
+	rows, err := db.Raw(`SELECT seq, op, album_id, changed_at FROM album_changes WHERE seq > ? ORDER BY seq LIMIT ?`, since, limit).Rows()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	changes := []types.AlbumChange{}
+	for rows.Next() {
+		var c types.AlbumChange
+		if err := rows.Scan(&c.Seq, &c.Op, &c.AlbumID, &c.ChangedAt); err != nil {
+			return nil, 0, err
+		}
+		c.ChangedAt = c.ChangedAt.UTC()
+		changes = append(changes, c)
+	}
+	if n := len(changes); n > 0 {
+		// Changes committed since the head was read.
+		feed.Head = max(feed.Head, changes[n-1].Seq)
+	}
+	return changes, feed.Head, rows.Err()
+}
+
+// TrimChanges deletes the changes made before before, remembering the
+// newest it deleted so that a since older than that is answered 410.
+func (store *SqliteAlbumStore) TrimChanges(ctx context.Context, before time.Time) (int, error) {
+	n := 0
+	err := store.inTx(ctx, func(tx *SqliteAlbumStore) error {
+		var through *int64
+		cutoff := before.UTC().Format(sqliteChangeTime)
+		if err := tx.db.Raw(`SELECT max(seq) FROM album_changes WHERE changed_at < ?`, cutoff).Row().Scan(&through); err != nil {
+			return err
+		}
+		if through == nil {
+			return nil
+		}
+		err := tx.db.Exec(`UPDATE album_change_log SET trimmed_through = max(trimmed_through, ?),
+			 history_since = max(history_since, (SELECT max(changed_at) FROM album_changes WHERE seq <= ?))`, *through, *through).Error
+		if err != nil {
+			return err
+		}
+		res := tx.db.Exec(`DELETE FROM album_changes WHERE seq <= ?`, *through)
+		n = int(res.RowsAffected)
+		return res.Error
+	})
+	return n, err
+}
+
+// Revisions implements revisionKeeper with the snapshots the triggers keep.
+// history_since is read after the changes, so that a trim in between is
+// seen and the window answered as trimmed.
+func (store *SqliteAlbumStore) Revisions(ctx context.Context, from, to time.Time) ([]albumRevision, time.Time, error) {
+	db := store.db.WithContext(ctx)
+	rows, err := db.Raw(`SELECT seq, op, album_id, changed_at, before, after FROM album_changes
+		 WHERE changed_at > ? AND changed_at <= ? ORDER BY seq`, from.UTC().Format(sqliteChangeTime), to.UTC().Format(sqliteChangeTime)).Rows()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer rows.Close()
+	var revisions []albumRevision
+	for rows.Next() {
+		var rev albumRevision
+		var before, after []byte
+		if err := rows.Scan(&rev.Seq, &rev.Op, &rev.AlbumID, &rev.ChangedAt, &before, &after); err != nil {
+			return nil, time.Time{}, err
+		}
+		rev.ChangedAt = rev.ChangedAt.UTC()
+		if rev.before, err = decodeSnapshot(before); err != nil {
+			return nil, time.Time{}, err
+		}
+		if rev.after, err = decodeSnapshot(after); err != nil {
+			return nil, time.Time{}, err
+		}
+		revisions = append(revisions, rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, time.Time{}, err
+	}
+	var since time.Time
+	if err := db.Raw(`SELECT history_since FROM album_change_log`).Row().Scan(&since); err != nil {
+		return nil, time.Time{}, err
+	}
+	return revisions, since.UTC(), nil
+}
+
+// OutboxPosition implements outboxKeeper. The triggers write each change in
+// the transaction of the write, so the events are durable.
+func (store *SqliteAlbumStore) OutboxPosition(ctx context.Context) (outboxPosition, error) {
+	pos := outboxPosition{Durable: true}
+	err := store.db.WithContext(ctx).Raw(`SELECT sent_through, trimmed_through FROM album_change_log`).Row().Scan(&pos.Sent, &pos.Trimmed)
+	return pos, err
+}
+
+// AdvanceOutbox implements outboxKeeper.
+func (store *SqliteAlbumStore) AdvanceOutbox(ctx context.Context, from, to int64) (bool, error) {
+	res := store.db.WithContext(ctx).Exec(`UPDATE album_change_log SET sent_through = ? WHERE sent_through = ?`, to, from)
+	return res.RowsAffected == 1, res.Error
+}
+
+// recordPriceChange adds change to the audit log, in the transaction the
+// store is bound to.
+func (store *SqliteAlbumStore) recordPriceChange(ctx context.Context, albumID string, change PriceChange) error {
+	entry := change.auditEntry(albumID)
+	details, err := json.Marshal(entry.Details)
+	if err != nil {
+		return err
+	}
+	return store.db.WithContext(ctx).Exec(
+		`INSERT INTO audit_log (id, timestamp, action, album_id, principal, details) VALUES (?, ?, ?, ?, ?, ?)`,
+		entry.ID, entry.Timestamp, entry.Action, entry.AlbumID, entry.Principal, string(details)).Error
+}
+
+// PriceHistory reads the album's price changes from the audit log.
+func (store *SqliteAlbumStore) PriceHistory(ctx context.Context, albumID string, limit, offset int) ([]PriceChange, int, error) {
+	db := store.db.WithContext(ctx)
+	var total int64
+	err := db.Raw(`SELECT count(*) FROM audit_log WHERE album_id = ? AND action = ?`, albumID, auditAlbumPriceChanged).Scan(&total).Error
+	if err != nil {
+		return nil, 0, err
+	}
+	rows, err := db.Raw(`SELECT timestamp, principal, details FROM audit_log WHERE album_id = ? AND action = ?
+		 ORDER BY timestamp DESC, id DESC LIMIT ? OFFSET ?`, albumID, auditAlbumPriceChanged, limit, offset).Rows()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	changes := []PriceChange{}
+	for rows.Next() {
+		var at time.Time
+		var principal, details string
+		if err := rows.Scan(&at, &principal, &details); err != nil {
+			return nil, 0, err
+		}
+		change, err := priceChangeFromAudit(at, principal, []byte(details))
+		if err != nil {
+			return nil, 0, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, int(total), rows.Err()
+}
+
+// CreateMany checks the catalog limit in the batch's transaction, before
+// the first album.
+func (store *SqliteAlbumStore) CreateMany(ctx context.Context, albums []album) ([]album, error) {
+	checked := false
+	return store.batch(ctx, albums, func(tx *SqliteAlbumStore, a album) (album, error) {
+		if !checked {
+			checked = true
+			if err := tx.checkCatalogRoom(ctx, len(albums)); err != nil {
+				return album{}, err
+			}
+		}
+		return tx.create(ctx, a)
+	})
+}
+
+func (store *SqliteAlbumStore) UpdateMany(ctx context.Context, albums []album, regenerateSlug bool) ([]album, error) {
+	return store.batch(ctx, albums, func(tx *SqliteAlbumStore, a album) (album, error) { return tx.update(ctx, a, regenerateSlug) })
+}
+
+// sqliteDeleteChunk caps the IDs bound to one DELETE, well under SQLite's
+// limit on statement parameters.
+const sqliteDeleteChunk = 500
+
+// DeleteMany deletes the albums in one transaction. Their price history
+// stays in the audit log.
+func (store *SqliteAlbumStore) DeleteMany(ctx context.Context, ids []string) error {
+	return store.inTx(ctx, func(tx *SqliteAlbumStore) error { return tx.deleteAll(ctx, ids) })
+}
+
+// MergeAlbums updates the survivor and deletes the duplicates in one
+// transaction.
+func (store *SqliteAlbumStore) MergeAlbums(ctx context.Context, survivor album, duplicates []string) (album, error) {
+	err := store.inTx(ctx, func(tx *SqliteAlbumStore) (err error) {
+		if survivor, err = tx.update(ctx, survivor, false); err != nil {
+			return err
+		}
+		return tx.deleteAll(ctx, duplicates)
+	})
+	if err != nil {
+		return album{}, err
+	}
+	return survivor, nil
+}
+
+// deleteAll deletes the albums in ids, or returns errAlbumNotFound if any is
+// missing. The caller rolls back on error.
+func (store *SqliteAlbumStore) deleteAll(ctx context.Context, ids []string) error {
+	deleted := 0
+	for start := 0; start < len(ids); start += sqliteDeleteChunk {
+		res := store.db.WithContext(ctx).Where("id IN ?", ids[start:min(start+sqliteDeleteChunk, len(ids))]).Delete(&sqliteAlbum{})
+		if res.Error != nil {
+			return res.Error
+		}
+		deleted += int(res.RowsAffected)
+	}
+	if deleted != len(ids) {
+		return errAlbumNotFound
+	}
+	return nil
+}
+
+// batch runs op for each album against a copy of the store bound to one
+// transaction, so slug checks see the batch's own writes and any failure
+// rolls all of them back.
+func (store *SqliteAlbumStore) batch(ctx context.Context, albums []album, op func(*SqliteAlbumStore, album) (album, error)) ([]album, error) {
+	done := make([]album, 0, len(albums))
+	err := store.inTx(ctx, func(tx *SqliteAlbumStore) error {
+		for _, a := range albums {
+			applied, err := op(tx, a)
+			if err != nil {
+				return fmt.Errorf("album %s: %w", a.ID, err)
+			}
+			done = append(done, applied)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return done, nil
+}
+
+// inTx runs fn against a copy of the store bound to a transaction, which
+// commits if fn returns nil.
+func (store *SqliteAlbumStore) inTx(ctx context.Context, fn func(tx *SqliteAlbumStore) error) error {
+	return store.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(&SqliteAlbumStore{db: tx, fts: store.fts})
+	})
+}
+
+// Import loads albums as-is inside a single transaction; merge upserts by ID.
+// Any failure rolls back, leaving the previous catalog intact.
+func (store *SqliteAlbumStore) Import(ctx context.Context, mode importMode, next func() (album, error)) (int, error) {
+	n := 0
+	err := store.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if mode == importReplace {
+			if err := tx.Where("1 = 1").Delete(&sqliteAlbum{}).Error; err != nil {
+				return err
+			}
+		}
+		for {
+			a, err := next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			rec := newSqliteAlbum(a)
+			err = tx.Clauses(clause.OnConflict{
+				Columns:   []clause.Column{{Name: "id"}},
+				DoUpdates: clause.AssignmentColumns([]string{"title", "artist", "price", "genre", "slug", "barcode", "year", "tracks", "metadata", "stock", "created_at", "updated_at", "available_from", "available_until", "search_key"}),
+			}).Create(&rec).Error
+			if err != nil {
+				return fmt.Errorf("album %s: %w", a.ID, mapSqliteAlbumError(err))
+			}
+			n++
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (store *SqliteAlbumStore) slugTaken(ctx context.Context, slug string) bool {
+	var count int64
+	err := store.db.WithContext(ctx).Model(&sqliteAlbum{}).Where("slug = ?", slug).Count(&count).Error
+	return err == nil && count > 0
+}
+
+func mapSqliteAlbumError(err error) error {
+	switch msg := err.Error(); {
+	case strings.Contains(msg, "UNIQUE constraint failed: albums.barcode"):
+		return errBarcodeTaken
+	case strings.Contains(msg, "UNIQUE constraint failed: albums.slug"):
+		return errSlugTaken
+	case strings.Contains(msg, "UNIQUE constraint failed"):
+		return fmt.Errorf("%w: %v", errDuplicateAlbum, err)
+	case strings.Contains(msg, "NOT NULL constraint failed"), strings.Contains(msg, "CHECK constraint failed"):
+		return fmt.Errorf("%w: %v", errRejectedAlbum, err)
+	}
+	return err
+}
+
+func (store *SqliteAlbumStore) Ping(ctx context.Context) error {
+	sqlDB, err := store.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
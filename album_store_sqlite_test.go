@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+func TestSqliteMatchQuery(t *testing.T) {
+	for _, tc := range []struct {
+		terms []string
+		want  string
+	}{
+		{[]string{"blue"}, `"blue"*`},
+		{[]string{"blue", "train"}, `"blue"* "train"*`},
+		{[]string{`say "hi"`}, `"say ""hi"""*`},
+		{[]string{"NEAR(a", "OR", "b*"}, `"NEAR(a"* "OR"* "b*"*`},
+	} {
+		if got := sqliteMatchQuery(tc.terms); got != tc.want {
+			t.Errorf("sqliteMatchQuery(%q) = %s, want %s", tc.terms, got, tc.want)
+		}
+	}
+}
+
+// TestSqliteSearch runs with the full-text index under -tags sqlite_fts5
+// and with the LIKE fallback without; either way the results are the same.
+func TestSqliteSearch(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewSqliteAlbumStore(testSQLiteStores(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("full-text index: %t", store.fts)
+	create := func(a album) album {
+		t.Helper()
+		a, err := store.Create(ctx, a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	search := func(q string) []string {
+		t.Helper()
+		page, err := store.List(ctx, ListOptions{Filter: AlbumFilter{Query: q}})
+		if err != nil {
+			t.Fatalf("searching %q: %v", q, err)
+		}
+		titles := []string{}
+		for _, a := range page.Albums {
+			titles = append(titles, a.Title)
+		}
+		return titles
+	}
+	expect := func(q string, want ...string) {
+		t.Helper()
+		got := search(q)
+		if len(got) != len(want) {
+			t.Errorf("search %q = %q, want %q", q, got, want)
+			return
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("search %q = %q, want %q", q, got, want)
+				return
+			}
+		}
+	}
+
+	blue := create(newTestAlbum(withID(newAlbumID())))
+	kind := create(newTestAlbum(withID(newAlbumID()), withTitle("Kind of Blue"), withArtist("Miles Davis")))
+	giant := create(newTestAlbum(withID(newAlbumID()), withTitle("Giant Steps")))
+
+	// Every word has to match, in the title or the artist, as a prefix.
+	expect("blue train", "Blue Train")
+	expect("coltrane", "Blue Train", "Giant Steps")
+	expect("miles blu", "Kind of Blue")
+	expect("davis steps")
+
+	// Input that is query syntax to FTS5 is searched for as text.
+	for _, q := range []string{`"`, `blue"`, `blue AND`, `NEAR(blue`, `*`, `-blue`, `title:blue`, `(`} {
+		if _, err := store.List(ctx, ListOptions{Filter: AlbumFilter{Query: q}}); err != nil {
+			t.Errorf("searching %q: %v", q, err)
+		}
+	}
+
+	// The index follows updates, and the deletes of a replacing import.
+	blue.Title = "Lush Life"
+	if _, err := store.Update(ctx, blue, false); err != nil {
+		t.Fatal(err)
+	}
+	expect("train")
+	expect("lush", "Lush Life")
+	rest := []album{kind, giant}
+	_, err = store.Import(ctx, importReplace, func() (album, error) {
+		if len(rest) == 0 {
+			return album{}, io.EOF
+		}
+		a := rest[0]
+		rest = rest[1:]
+		return a, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect("lush")
+	expect("coltrane", "Giant Steps")
+}
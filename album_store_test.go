@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+)
+
+// newSizedAlbumStore is an in-memory store holding n albums, with their
+// IDs in insertion order.
+func newSizedAlbumStore(tb testing.TB, n int) (*InMemoryAlbumStore, []string) {
+	tb.Helper()
+	batch := make([]album, n)
+	for i := range batch {
+		batch[i] = newTestAlbum(withID(newAlbumID()), withTitle("Album "+strconv.Itoa(i)))
+	}
+	store := NewInMemoryAlbumStore()
+	created, err := store.CreateMany(context.Background(), batch)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	ids := make([]string, n)
+	for i, a := range created {
+		ids[i] = a.ID
+	}
+	return store, ids
+}
+
+// BenchmarkInMemoryGetByID shows lookups by ID and slug staying flat as
+// the catalog grows, rather than scanning it.
+func BenchmarkInMemoryGetByID(b *testing.B) {
+	for _, n := range []int{100, 1000, 10000, 100000} {
+		store, ids := newSizedAlbumStore(b, n)
+		ctx := context.Background()
+		b.Run(fmt.Sprintf("id/albums=%d", n), func(b *testing.B) {
+			for i := 0; b.Loop(); i++ {
+				if _, err := store.GetByID(ctx, ids[i%len(ids)]); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("slug/albums=%d", n), func(b *testing.B) {
+			for i := 0; b.Loop(); i++ {
+				if _, err := store.GetBySlug(ctx, "album-"+strconv.Itoa(i%n)+"-john-coltrane"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestInMemoryListKeepsInsertionOrder(t *testing.T) {
+	ctx := context.Background()
+	store, ids := newSizedAlbumStore(t, 5)
+
+	// Updates, an artist change among them, don't move an album.
+	a, _ := store.GetByID(ctx, ids[1])
+	a.Artist = "Someone Else"
+	if _, err := store.Update(ctx, a, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DeleteMany(ctx, []string{ids[3]}); err != nil {
+		t.Fatal(err)
+	}
+	created, err := store.Create(ctx, newTestAlbum(withID(newAlbumID())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{ids[0], ids[1], ids[2], ids[4], created.ID}
+
+	page, err := store.List(ctx, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, a := range page.Albums {
+		got = append(got, a.ID)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("List order = %v, want %v", got, want)
+	}
+	page, _ = store.List(ctx, ListOptions{Newest: true, Limit: 2})
+	if len(page.Albums) != 2 || page.Albums[0].ID != created.ID || page.Albums[1].ID != ids[4] {
+		t.Errorf("newest first = %v", page.Albums)
+	}
+
+	// An artist filter reads the artist index, which keeps the same order.
+	page, _ = store.List(ctx, ListOptions{Filter: AlbumFilter{Artist: "John Coltrane"}})
+	got = got[:0]
+	for _, a := range page.Albums {
+		got = append(got, a.ID)
+	}
+	if fmt.Sprint(got) != fmt.Sprint([]string{ids[0], ids[2], ids[4], created.ID}) {
+		t.Errorf("artist filter order = %v", got)
+	}
+}
+
+func TestInMemoryLookups(t *testing.T) {
+	ctx := context.Background()
+	store, ids := newSizedAlbumStore(t, 3)
+	if _, err := store.GetByID(ctx, "missing"); !errors.Is(err, errAlbumNotFound) {
+		t.Errorf("GetByID of a missing ID = %v", err)
+	}
+	if _, err := store.GetByBarcode(ctx, ""); !errors.Is(err, errAlbumNotFound) {
+		t.Errorf("GetByBarcode of no code = %v", err)
+	}
+	store.DeleteMany(ctx, []string{ids[0]})
+	if _, err := store.GetBySlug(ctx, "album-0-john-coltrane"); !errors.Is(err, errAlbumNotFound) {
+		t.Errorf("a deleted album's slug still resolves: %v", err)
+	}
+}
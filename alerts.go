@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	alertJobName = "alerts"
+
+	// alertEvaluationInterval is how often the alert rules are checked,
+	// and so the resolution of ALERT_WINDOW.
+	alertEvaluationInterval = time.Minute
+
+	// alertMinRequests is the fewest requests in the window for the error
+	// rate and latency rules to judge it, so two failures out of three
+	// requests at night don't page anyone.
+	alertMinRequests = 20
+
+	defaultAlertWindow           = 5 * time.Minute
+	defaultAlertErrorRatePercent = 5
+	defaultAlertP99Latency       = time.Second
+)
+
+// latencyBuckets are the upper bounds of the latency histogram kept for the
+// p99 latency alert. Requests slower than the last land in an overflow
+// bucket.
+var latencyBuckets = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+// requestCounters are what the alert rules are evaluated over. Unlike the
+// /metrics counters they count server errors apart from client errors and
+// keep a latency histogram.
+type requestCounters struct {
+	requests     atomic.Int64
+	serverErrors atomic.Int64
+	latency      [12]atomic.Int64 // by latencyBuckets, then the overflow
+}
+
+var alertCounters requestCounters
+
+// observeRequest counts a request for the alert rules. metricsMiddleware
+// calls it for every request it counts.
+func (c *requestCounters) observeRequest(status int, took time.Duration) {
+	c.requests.Add(1)
+	if status >= 500 {
+		c.serverErrors.Add(1)
+	}
+	bucket := sort.Search(len(latencyBuckets), func(i int) bool { return took <= latencyBuckets[i] })
+	c.latency[bucket].Add(1)
+}
+
+// alertSample is a reading of the counters at one evaluation.
+type alertSample struct {
+	at           time.Time
+	requests     int64
+	serverErrors int64
+	latency      [12]int64
+}
+
+func (c *requestCounters) sample(at time.Time) alertSample {
+	s := alertSample{at: at, requests: c.requests.Load(), serverErrors: c.serverErrors.Load()}
+	for i := range c.latency {
+		s.latency[i] = c.latency[i].Load()
+	}
+	return s
+}
+
+// alertWindow is what happened between two samples, plus the breakers open
+// at the end of it.
+type alertWindow struct {
+	span         time.Duration
+	requests     int64
+	serverErrors int64
+	latency      [12]int64
+	openBreakers []string
+}
+
+func windowBetween(from, to alertSample) alertWindow {
+	w := alertWindow{span: to.at.Sub(from.at), requests: to.requests - from.requests, serverErrors: to.serverErrors - from.serverErrors}
+	for i := range w.latency {
+		w.latency[i] = to.latency[i] - from.latency[i]
+	}
+	return w
+}
+
+// errorRate is the percentage of requests in the window that failed with a
+// 5xx.
+func (w alertWindow) errorRate() float64 {
+	if w.requests == 0 {
+		return 0
+	}
+	return 100 * float64(w.serverErrors) / float64(w.requests)
+}
+
+// p99 is the upper bound of the histogram bucket holding the 99th
+// percentile request, or math.MaxInt64 when that is the overflow bucket.
+func (w alertWindow) p99() time.Duration {
+	rank := int64(math.Ceil(0.99 * float64(w.requests)))
+	var seen int64
+	for i, n := range w.latency {
+		seen += n
+		if seen >= rank && i < len(latencyBuckets) {
+			return latencyBuckets[i]
+		}
+	}
+	return math.MaxInt64
+}
+
+// alertRule is one condition the evaluator watches.
+type alertRule struct {
+	name string
+	// check reports whether the rule fires for w, and a one-line summary of
+	// what it saw either way.
+	check func(w alertWindow) (firing bool, summary string)
+}
+
+// alertRules builds the rules enabled in cfg: the 5xx rate, the p99 latency,
+// and open circuit breakers.
+func alertRules(cfg *Config) []alertRule {
+	var rules []alertRule
+	if threshold := cfg.AlertErrorRatePercent; threshold > 0 {
+		rules = append(rules, alertRule{name: "error_rate", check: func(w alertWindow) (bool, string) {
+			rate := w.errorRate()
+			return w.requests >= alertMinRequests && rate > float64(threshold),
+				fmt.Sprintf("5xx rate %.1f%% (%d of %d requests) over %s, threshold %d%%", rate, w.serverErrors, w.requests, w.span.Round(time.Second), threshold)
+		}})
+	}
+	if threshold := cfg.AlertP99Latency; threshold > 0 {
+		rules = append(rules, alertRule{name: "p99_latency", check: func(w alertWindow) (bool, string) {
+			p99 := w.p99()
+			seen := "up to " + p99.String()
+			if p99 == math.MaxInt64 {
+				seen = "over " + latencyBuckets[len(latencyBuckets)-1].String()
+			}
+			return w.requests >= alertMinRequests && p99 > threshold,
+				fmt.Sprintf("p99 latency %s over %s, threshold %s", seen, w.span.Round(time.Second), threshold)
+		}})
+	}
+	if cfg.AlertOnOpenBreaker {
+		rules = append(rules, alertRule{name: "circuit_breaker_open", check: func(w alertWindow) (bool, string) {
+			if len(w.openBreakers) == 0 {
+				return false, "no circuit breaker is open"
+			}
+			return true, "circuit breaker open for " + strings.Join(w.openBreakers, ", ")
+		}})
+	}
+	return rules
+}
+
+// alertEvent is a rule starting or stopping firing.
+type alertEvent struct {
+	Rule       string    `json:"alert"`
+	Status     string    `json:"status"` // firing or resolved
+	Summary    string    `json:"summary"`
+	Service    string    `json:"service"`
+	FiredAt    time.Time `json:"firedAt"`
+	ResolvedAt time.Time `json:"resolvedAt,omitzero"`
+}
+
+// alertEvaluator remembers which rules are firing, so a condition that
+// persists alerts once, and once more when it clears.
+type alertEvaluator struct {
+	firing map[string]time.Time // rule -> when it started firing
+}
+
+func newAlertEvaluator() *alertEvaluator {
+	return &alertEvaluator{firing: make(map[string]time.Time)}
+}
+
+// evaluate checks rules against w at now and calls notify for each rule
+// that started or stopped firing. A transition whose notification fails is
+// left for the next evaluation to send again. It returns the first
+// notification error.
+func (e *alertEvaluator) evaluate(rules []alertRule, w alertWindow, now time.Time, notify func(alertEvent) error) error {
+	var firstErr error
+	for _, rule := range rules {
+		firing, summary := rule.check(w)
+		since, wasFiring := e.firing[rule.name]
+		if firing == wasFiring {
+			continue
+		}
+		event := alertEvent{Rule: rule.name, Status: "firing", Summary: summary, Service: "web-service-go", FiredAt: now.UTC()}
+		if wasFiring {
+			event.Status, event.FiredAt, event.ResolvedAt = "resolved", since, now.UTC()
+		}
+		if err := notify(event); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("sending %s %s alert: %w", rule.name, event.Status, err)
+			}
+			continue
+		}
+		if firing {
+			e.firing[rule.name] = event.FiredAt
+		} else {
+			delete(e.firing, rule.name)
+		}
+	}
+	return firstErr
+}
+
+// alertPayload is the request body for event: the event itself, or for
+// ALERT_FORMAT=slack a message for a Slack incoming webhook.
+func alertPayload(format string, event alertEvent) ([]byte, error) {
+	if format != "slack" {
+		return json.Marshal(event)
+	}
+	text := fmt.Sprintf("🔥 *[FIRING]* %s on %s: %s", event.Rule, event.Service, event.Summary)
+	if event.Status == "resolved" {
+		text = fmt.Sprintf("✅ *[RESOLVED]* %s on %s after %s: %s", event.Rule, event.Service, event.ResolvedAt.Sub(event.FiredAt).Round(time.Second), event.Summary)
+	}
+	return json.Marshal(map[string]string{"text": text})
+}
+
+// alerter samples the counters on every run of the alerts job and evaluates
+// the rules over the last ALERT_WINDOW of samples.
+type alerter struct {
+	client    *http.Client
+	url       string
+	format    string
+	evaluator *alertEvaluator
+
+	mu      sync.Mutex
+	samples []alertSample // oldest first, spanning at most ALERT_WINDOW
+}
+
+func (a *alerter) send(ctx context.Context, event alertEvent) error {
+	body, err := alertPayload(a.format, event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	log.Printf("📣 Alert %s %s: %s", event.Rule, event.Status, event.Summary)
+	return nil
+}
+
+func (a *alerter) run(ctx context.Context) error {
+	cfg := currentConfig()
+	now := serverClock.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.samples = append(a.samples, alertCounters.sample(now))
+	for len(a.samples) > 1 && now.Sub(a.samples[1].at) >= cfg.AlertWindow {
+		a.samples = a.samples[1:]
+	}
+	w := windowBetween(a.samples[0], a.samples[len(a.samples)-1])
+	for name, state := range breakerStates() {
+		if state == breakerOpen.String() {
+			w.openBreakers = append(w.openBreakers, name)
+		}
+	}
+	sort.Strings(w.openBreakers)
+	return a.evaluator.evaluate(alertRules(cfg), w, now, func(event alertEvent) error {
+		return a.send(ctx, event)
+	})
+}
+
+// setupAlerting registers the alerts job when ALERT_WEBHOOK_URL is set. The
+// first run only takes a baseline sample.
+func setupAlerting(cfg *Config) {
+	if cfg.AlertWebhookURL == "" {
+		return
+	}
+	a := &alerter{
+		client:    &http.Client{Timeout: 10 * time.Second},
+		url:       cfg.AlertWebhookURL,
+		format:    cfg.AlertFormat,
+		evaluator: newAlertEvaluator(),
+	}
+	a.samples = []alertSample{alertCounters.sample(serverClock.Now())}
+	scheduler.register(alertJobName, alertEvaluationInterval, a.run)
+	log.Printf("📣 Alerting to a %s webhook every %s", cfg.AlertFormat, alertEvaluationInterval)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWindow is a synthetic five-minute window of requests, of which
+// errors failed with a 5xx and slow took longer than every latency bucket.
+func testWindow(requests, errors, slow int64) alertWindow {
+	w := alertWindow{span: defaultAlertWindow, requests: requests, serverErrors: errors}
+	w.latency[0] = requests - slow
+	w.latency[len(latencyBuckets)] = slow
+	return w
+}
+
+func TestAlertEvaluator(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AlertOnOpenBreaker = true
+	rules := alertRules(&cfg)
+	e := newAlertEvaluator()
+	var sent []alertEvent
+	var failSends bool
+	notify := func(event alertEvent) error {
+		if failSends {
+			return errors.New("webhook down")
+		}
+		sent = append(sent, event)
+		return nil
+	}
+	// expect evaluates w a minute after the last evaluation and checks the
+	// events sent, as rule/status pairs.
+	now := testStart
+	expect := func(w alertWindow, want ...string) {
+		t.Helper()
+		now = now.Add(time.Minute)
+		sent = nil
+		e.evaluate(rules, w, now, notify)
+		var got []string
+		for _, event := range sent {
+			got = append(got, event.Rule+"/"+event.Status)
+		}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("at %s sent %v, want %v", now.Format("15:04"), got, want)
+		}
+	}
+
+	expect(testWindow(100, 5, 0))
+	// Too few requests to judge, however bad they were.
+	expect(testWindow(alertMinRequests-1, alertMinRequests-1, alertMinRequests-1))
+
+	expect(testWindow(100, 6, 0), "error_rate/firing")
+	firedAt := now
+	if sent[0].Summary != "5xx rate 6.0% (6 of 100 requests) over 5m0s, threshold 5%" || !sent[0].FiredAt.Equal(firedAt) {
+		t.Errorf("firing event %+v", sent[0])
+	}
+	// A condition that persists alerts once.
+	expect(testWindow(100, 50, 0))
+	expect(testWindow(100, 50, 2), "p99_latency/firing")
+
+	// A resolution that can't be sent is sent at the next evaluation.
+	failSends = true
+	if err := e.evaluate(rules, testWindow(100, 0, 0), now, notify); err == nil || !strings.Contains(err.Error(), "sending error_rate resolved alert: webhook down") {
+		t.Errorf("evaluate with the webhook down: %v", err)
+	}
+	failSends = false
+	expect(testWindow(100, 0, 0), "error_rate/resolved", "p99_latency/resolved")
+	if !sent[0].FiredAt.Equal(firedAt) || !sent[0].ResolvedAt.Equal(now) {
+		t.Errorf("resolved event %+v, want fired at %s and resolved at %s", sent[0], firedAt, now)
+	}
+	expect(testWindow(100, 0, 0))
+
+	w := testWindow(0, 0, 0)
+	w.openBreakers = []string{"albums", "metrics"}
+	expect(w, "circuit_breaker_open/firing")
+	if sent[0].Summary != "circuit breaker open for albums, metrics" {
+		t.Errorf("breaker summary %q", sent[0].Summary)
+	}
+	expect(testWindow(0, 0, 0), "circuit_breaker_open/resolved")
+}
+
+func TestAlertRulesDisabled(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AlertErrorRatePercent, cfg.AlertP99Latency, cfg.AlertOnOpenBreaker = 0, 0, false
+	if rules := alertRules(&cfg); len(rules) != 0 {
+		t.Errorf("%d rules with every rule off", len(rules))
+	}
+}
+
+func TestAlertWindowP99(t *testing.T) {
+	w := alertWindow{requests: 100}
+	w.latency[0], w.latency[4], w.latency[7] = 90, 9, 1
+	if p99 := w.p99(); p99 != 100*time.Millisecond {
+		t.Errorf("p99 = %s, want 100ms", p99)
+	}
+	w.latency[4], w.latency[7] = 8, 2
+	if p99 := w.p99(); p99 != time.Second {
+		t.Errorf("p99 = %s, want 1s", p99)
+	}
+}
+
+func TestAlertPayload(t *testing.T) {
+	event := alertEvent{Rule: "error_rate", Status: "resolved", Summary: "5xx rate 0.0%", Service: "web-service-go", FiredAt: testStart, ResolvedAt: testStart.Add(90 * time.Second)}
+	body, _ := alertPayload("slack", event)
+	if want := `{"text":"✅ *[RESOLVED]* error_rate on web-service-go after 1m30s: 5xx rate 0.0%"}`; string(body) != want {
+		t.Errorf("slack payload %s, want %s", body, want)
+	}
+	body, _ = alertPayload("json", event)
+	var got alertEvent
+	if err := json.Unmarshal(body, &got); err != nil || got != event {
+		t.Errorf("json payload %s", body)
+	}
+}
+
+func TestAlerter(t *testing.T) {
+	s := newTestServer(t)
+	var mu sync.Mutex
+	var bodies []string
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, string(b))
+		mu.Unlock()
+	}))
+	t.Cleanup(webhook.Close)
+	a := &alerter{client: webhook.Client(), url: webhook.URL, format: "slack", evaluator: newAlertEvaluator()}
+	a.samples = []alertSample{alertCounters.sample(s.clock.Now())}
+	// minute runs the job a minute on, after count requests of which errors
+	// failed.
+	minute := func(count, errors int) {
+		t.Helper()
+		for i := 0; i < count; i++ {
+			status := http.StatusOK
+			if i < errors {
+				status = http.StatusBadGateway
+			}
+			alertCounters.observeRequest(status, time.Millisecond)
+		}
+		s.clock.Advance(time.Minute)
+		if err := a.run(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	minute(100, 0)
+	minute(100, 30)
+	// The rate over the window is 15%, then 10% once a quiet minute joins.
+	minute(100, 0)
+	// Five quiet minutes later the bad one has left the window.
+	for i := 0; i < 5; i++ {
+		minute(100, 0)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(bodies) != 2 || !strings.Contains(bodies[0], "[FIRING]* error_rate") || !strings.Contains(bodies[1], "[RESOLVED]* error_rate") {
+		t.Errorf("webhook got %q, want one firing and one resolved message", bodies)
+	}
+}
@@ -0,0 +1,473 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"gorm.io/gorm"
+)
+
+var errAPIKeyNotFound = newCategorizedError(errNotFound, "API key not found")
+
+// apiKey is a stored API key. The secret itself is never stored, only its
+// SHA-256.
+type apiKey struct {
+	ID         string
+	Name       string
+	Tier       string
+	SecretHash string
+	CreatedAt  time.Time
+	LastUsedAt time.Time // zero until the key is first used
+	RevokedAt  time.Time // zero while the key is active
+}
+
+// APIKeyStore persists the API keys in the configured backend. Revoking,
+// changing the tier, and recording use are separate writes so that none of
+// them can undo another made at the same time.
+type APIKeyStore interface {
+	CreateAPIKey(ctx context.Context, k apiKey) error
+	// GetAPIKey returns errAPIKeyNotFound for an unknown id.
+	GetAPIKey(ctx context.Context, id string) (apiKey, error)
+	// ListAPIKeys returns every key, revoked ones included, oldest first.
+	ListAPIKeys(ctx context.Context) ([]apiKey, error)
+	SetAPIKeyTier(ctx context.Context, id, tier string) error
+	RevokeAPIKey(ctx context.Context, id string, at time.Time) error
+	TouchAPIKey(ctx context.Context, id string, at time.Time) error
+}
+
+func sortAPIKeys(keys []apiKey) {
+	sort.Slice(keys, func(i, j int) bool { return keys[i].CreatedAt.Before(keys[j].CreatedAt) })
+}
+
+type InMemoryAPIKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]apiKey
+}
+
+func NewInMemoryAPIKeyStore() *InMemoryAPIKeyStore {
+	return &InMemoryAPIKeyStore{keys: make(map[string]apiKey)}
+}
+
+func (store *InMemoryAPIKeyStore) CreateAPIKey(ctx context.Context, k apiKey) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.keys[k.ID] = k
+	return nil
+}
+
+func (store *InMemoryAPIKeyStore) GetAPIKey(ctx context.Context, id string) (apiKey, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	k, ok := store.keys[id]
+	if !ok {
+		return apiKey{}, errAPIKeyNotFound
+	}
+	return k, nil
+}
+
+func (store *InMemoryAPIKeyStore) ListAPIKeys(ctx context.Context) ([]apiKey, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	keys := make([]apiKey, 0, len(store.keys))
+	for _, k := range store.keys {
+		keys = append(keys, k)
+	}
+	sortAPIKeys(keys)
+	return keys, nil
+}
+
+// update applies fn to the key with the given id.
+func (store *InMemoryAPIKeyStore) update(id string, fn func(*apiKey)) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	k, ok := store.keys[id]
+	if !ok {
+		return errAPIKeyNotFound
+	}
+	fn(&k)
+	store.keys[id] = k
+	return nil
+}
+
+func (store *InMemoryAPIKeyStore) SetAPIKeyTier(ctx context.Context, id, tier string) error {
+	return store.update(id, func(k *apiKey) { k.Tier = tier })
+}
+
+func (store *InMemoryAPIKeyStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	return store.update(id, func(k *apiKey) { k.RevokedAt = at })
+}
+
+func (store *InMemoryAPIKeyStore) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	return store.update(id, func(k *apiKey) { k.LastUsedAt = at })
+}
+
+// nullTime converts between a zero time and SQL NULL.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+const sqlAPIKeyColumns = `id, name, tier, secret_hash, created_at, last_used_at, revoked_at`
+
+// scanSQLAPIKey reads a row of sqlAPIKeyColumns.
+func scanSQLAPIKey(scan func(dest ...interface{}) error) (apiKey, error) {
+	var k apiKey
+	var lastUsed, revoked sql.NullTime
+	if err := scan(&k.ID, &k.Name, &k.Tier, &k.SecretHash, &k.CreatedAt, &lastUsed, &revoked); err != nil {
+		return apiKey{}, err
+	}
+	k.CreatedAt, k.LastUsedAt, k.RevokedAt = k.CreatedAt.UTC(), lastUsed.Time.UTC(), revoked.Time.UTC()
+	if !lastUsed.Valid {
+		k.LastUsedAt = time.Time{}
+	}
+	if !revoked.Valid {
+		k.RevokedAt = time.Time{}
+	}
+	return k, nil
+}
+
+// PostgresAPIKeyStore keeps the keys in the api_keys table from
+// migrations/postgres.
+type PostgresAPIKeyStore struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresAPIKeyStore(pool *pgxpool.Pool) *PostgresAPIKeyStore {
+	return &PostgresAPIKeyStore{pool: pool}
+}
+
+func (store *PostgresAPIKeyStore) CreateAPIKey(ctx context.Context, k apiKey) error {
+	_, err := store.pool.Exec(ctx, `INSERT INTO api_keys (`+sqlAPIKeyColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		k.ID, k.Name, k.Tier, k.SecretHash, k.CreatedAt, nullTime(k.LastUsedAt), nullTime(k.RevokedAt))
+	return err
+}
+
+func (store *PostgresAPIKeyStore) GetAPIKey(ctx context.Context, id string) (apiKey, error) {
+	k, err := scanSQLAPIKey(store.pool.QueryRow(ctx, `SELECT `+sqlAPIKeyColumns+` FROM api_keys WHERE id = $1`, id).Scan)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return apiKey{}, errAPIKeyNotFound
+	}
+	return k, err
+}
+
+func (store *PostgresAPIKeyStore) ListAPIKeys(ctx context.Context) ([]apiKey, error) {
+	rows, err := store.pool.Query(ctx, `SELECT `+sqlAPIKeyColumns+` FROM api_keys ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []apiKey
+	for rows.Next() {
+		k, err := scanSQLAPIKey(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// exec runs an update of one key, reporting errAPIKeyNotFound if there is
+// none with the id passed as $1.
+func (store *PostgresAPIKeyStore) exec(ctx context.Context, query string, args ...interface{}) error {
+	tag, err := store.pool.Exec(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errAPIKeyNotFound
+	}
+	return nil
+}
+
+func (store *PostgresAPIKeyStore) SetAPIKeyTier(ctx context.Context, id, tier string) error {
+	return store.exec(ctx, `UPDATE api_keys SET tier = $2 WHERE id = $1`, id, tier)
+}
+
+func (store *PostgresAPIKeyStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	return store.exec(ctx, `UPDATE api_keys SET revoked_at = $2 WHERE id = $1`, id, at)
+}
+
+func (store *PostgresAPIKeyStore) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	return store.exec(ctx, `UPDATE api_keys SET last_used_at = $2 WHERE id = $1`, id, at)
+}
+
+// SqliteAPIKeyStore keeps the keys in the api_keys table from
+// migrations/sqlite.
+type SqliteAPIKeyStore struct {
+	db *gorm.DB
+}
+
+func NewSqliteAPIKeyStore(db *gorm.DB) *SqliteAPIKeyStore {
+	return &SqliteAPIKeyStore{db: db}
+}
+
+func (store *SqliteAPIKeyStore) CreateAPIKey(ctx context.Context, k apiKey) error {
+	return store.db.WithContext(ctx).Exec(`INSERT INTO api_keys (`+sqlAPIKeyColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		k.ID, k.Name, k.Tier, k.SecretHash, k.CreatedAt, nullTime(k.LastUsedAt), nullTime(k.RevokedAt)).Error
+}
+
+func (store *SqliteAPIKeyStore) GetAPIKey(ctx context.Context, id string) (apiKey, error) {
+	k, err := scanSQLAPIKey(store.db.WithContext(ctx).Raw(`SELECT `+sqlAPIKeyColumns+` FROM api_keys WHERE id = ?`, id).Row().Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return apiKey{}, errAPIKeyNotFound
+	}
+	return k, err
+}
+
+func (store *SqliteAPIKeyStore) ListAPIKeys(ctx context.Context) ([]apiKey, error) {
+	rows, err := store.db.WithContext(ctx).Raw(`SELECT ` + sqlAPIKeyColumns + ` FROM api_keys ORDER BY created_at`).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []apiKey
+	for rows.Next() {
+		k, err := scanSQLAPIKey(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+// exec runs an update of one key, reporting errAPIKeyNotFound if there is
+// none with the id passed last.
+func (store *SqliteAPIKeyStore) exec(ctx context.Context, query string, args ...interface{}) error {
+	res := store.db.WithContext(ctx).Exec(query, args...)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errAPIKeyNotFound
+	}
+	return nil
+}
+
+func (store *SqliteAPIKeyStore) SetAPIKeyTier(ctx context.Context, id, tier string) error {
+	return store.exec(ctx, `UPDATE api_keys SET tier = ? WHERE id = ?`, tier, id)
+}
+
+func (store *SqliteAPIKeyStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	return store.exec(ctx, `UPDATE api_keys SET revoked_at = ? WHERE id = ?`, at, id)
+}
+
+func (store *SqliteAPIKeyStore) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	return store.exec(ctx, `UPDATE api_keys SET last_used_at = ? WHERE id = ?`, at, id)
+}
+
+// mongoAPIKey is an API key as stored in the apiKeys collection.
+type mongoAPIKey struct {
+	ID         string    `bson:"_id"`
+	Name       string    `bson:"name"`
+	Tier       string    `bson:"tier"`
+	SecretHash string    `bson:"secretHash"`
+	CreatedAt  time.Time `bson:"createdAt"`
+	LastUsedAt time.Time `bson:"lastUsedAt,omitempty"`
+	RevokedAt  time.Time `bson:"revokedAt,omitempty"`
+}
+
+func (doc mongoAPIKey) apiKey() apiKey {
+	return apiKey{
+		ID:         doc.ID,
+		Name:       doc.Name,
+		Tier:       doc.Tier,
+		SecretHash: doc.SecretHash,
+		CreatedAt:  doc.CreatedAt.UTC(),
+		LastUsedAt: doc.LastUsedAt.UTC(),
+		RevokedAt:  doc.RevokedAt.UTC(),
+	}
+}
+
+// MongoAPIKeyStore keeps the keys in the apiKeys collection, one document
+// per key with the ID as _id.
+type MongoAPIKeyStore struct {
+	collection *mongo.Collection
+}
+
+func NewMongoAPIKeyStore(collection *mongo.Collection) *MongoAPIKeyStore {
+	return &MongoAPIKeyStore{collection: collection}
+}
+
+func (store *MongoAPIKeyStore) CreateAPIKey(ctx context.Context, k apiKey) error {
+	_, err := store.collection.InsertOne(ctx, mongoAPIKey(k))
+	return err
+}
+
+func (store *MongoAPIKeyStore) GetAPIKey(ctx context.Context, id string) (apiKey, error) {
+	var doc mongoAPIKey
+	err := store.collection.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return apiKey{}, errAPIKeyNotFound
+	}
+	if err != nil {
+		return apiKey{}, err
+	}
+	return doc.apiKey(), nil
+}
+
+func (store *MongoAPIKeyStore) ListAPIKeys(ctx context.Context) ([]apiKey, error) {
+	cur, err := store.collection.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	var docs []mongoAPIKey
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	keys := make([]apiKey, len(docs))
+	for i, doc := range docs {
+		keys[i] = doc.apiKey()
+	}
+	sortAPIKeys(keys)
+	return keys, nil
+}
+
+func (store *MongoAPIKeyStore) set(ctx context.Context, id, field string, value interface{}) error {
+	res, err := store.collection.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, bson.D{{Key: "$set", Value: bson.D{{Key: field, Value: value}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errAPIKeyNotFound
+	}
+	return nil
+}
+
+func (store *MongoAPIKeyStore) SetAPIKeyTier(ctx context.Context, id, tier string) error {
+	return store.set(ctx, id, "tier", tier)
+}
+
+func (store *MongoAPIKeyStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	return store.set(ctx, id, "revokedAt", at)
+}
+
+func (store *MongoAPIKeyStore) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	return store.set(ctx, id, "lastUsedAt", at)
+}
+
+const dynamoAPIKeysTable = "apiKeys"
+
+// dynamoAPIKey is an API key as stored in the apiKeys table, keyed by id.
+type dynamoAPIKey struct {
+	ID         string     `dynamodbav:"id"`
+	Name       string     `dynamodbav:"name"`
+	Tier       string     `dynamodbav:"tier"`
+	SecretHash string     `dynamodbav:"secretHash"`
+	CreatedAt  time.Time  `dynamodbav:"createdAt"`
+	LastUsedAt *time.Time `dynamodbav:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time `dynamodbav:"revokedAt,omitempty"`
+}
+
+func (item dynamoAPIKey) apiKey() apiKey {
+	k := apiKey{ID: item.ID, Name: item.Name, Tier: item.Tier, SecretHash: item.SecretHash, CreatedAt: item.CreatedAt.UTC()}
+	if item.LastUsedAt != nil {
+		k.LastUsedAt = item.LastUsedAt.UTC()
+	}
+	if item.RevokedAt != nil {
+		k.RevokedAt = item.RevokedAt.UTC()
+	}
+	return k
+}
+
+// DynamoAPIKeyStore keeps the keys in the apiKeys table, one item per key.
+type DynamoAPIKeyStore struct {
+	client *dynamodb.Client
+}
+
+func NewDynamoAPIKeyStore(client *dynamodb.Client) *DynamoAPIKeyStore {
+	return &DynamoAPIKeyStore{client: client}
+}
+
+func (store *DynamoAPIKeyStore) CreateAPIKey(ctx context.Context, k apiKey) error {
+	av, err := attributevalue.MarshalMap(dynamoAPIKey{ID: k.ID, Name: k.Name, Tier: k.Tier, SecretHash: k.SecretHash, CreatedAt: k.CreatedAt})
+	if err != nil {
+		return err
+	}
+	_, err = store.client.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(dynamoAPIKeysTable), Item: av})
+	return err
+}
+
+func (store *DynamoAPIKeyStore) GetAPIKey(ctx context.Context, id string) (apiKey, error) {
+	res, err := store.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(dynamoAPIKeysTable),
+		Key:            map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return apiKey{}, err
+	}
+	if res.Item == nil {
+		return apiKey{}, errAPIKeyNotFound
+	}
+	var item dynamoAPIKey
+	if err := attributevalue.UnmarshalMap(res.Item, &item); err != nil {
+		return apiKey{}, err
+	}
+	return item.apiKey(), nil
+}
+
+func (store *DynamoAPIKeyStore) ListAPIKeys(ctx context.Context) ([]apiKey, error) {
+	var keys []apiKey
+	pages := dynamodb.NewScanPaginator(store.client, &dynamodb.ScanInput{TableName: aws.String(dynamoAPIKeysTable), ConsistentRead: aws.Bool(true)})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var items []dynamoAPIKey
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			keys = append(keys, item.apiKey())
+		}
+	}
+	sortAPIKeys(keys)
+	return keys, nil
+}
+
+// set updates one attribute of an existing key.
+func (store *DynamoAPIKeyStore) set(ctx context.Context, id, attribute string, value types.AttributeValue) error {
+	_, err := store.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(dynamoAPIKeysTable),
+		Key:                       map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+		ConditionExpression:       aws.String("attribute_exists(id)"),
+		UpdateExpression:          aws.String("SET #attr = :value"),
+		ExpressionAttributeNames:  map[string]string{"#attr": attribute},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":value": value},
+	})
+	var failed *types.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		return errAPIKeyNotFound
+	}
+	return err
+}
+
+func dynamoTime(t time.Time) types.AttributeValue {
+	return &types.AttributeValueMemberS{Value: t.UTC().Format(time.RFC3339Nano)}
+}
+
+func (store *DynamoAPIKeyStore) SetAPIKeyTier(ctx context.Context, id, tier string) error {
+	return store.set(ctx, id, "tier", &types.AttributeValueMemberS{Value: tier})
+}
+
+func (store *DynamoAPIKeyStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	return store.set(ctx, id, "revokedAt", dynamoTime(at))
+}
+
+func (store *DynamoAPIKeyStore) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	return store.set(ctx, id, "lastUsedAt", dynamoTime(at))
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+	"github.com/google/uuid"
+)
+
+const (
+	// apiKeyPrefix starts every API key secret, telling it apart from
+	// ADMIN_TOKEN, which is sent the same way. The key's ID follows, then
+	// the random part: wsg_<id>_<32 hex digits>.
+	apiKeyPrefix = "wsg_"
+
+	defaultAPIKeyCacheTTL = 30 * time.Second
+
+	// apiKeyMissTTL is how long a lookup that found no key is kept, or
+	// API_KEY_CACHE_TTL if that is shorter. Only a mistake or a probe
+	// presents an unknown key, so there is little to save by keeping misses
+	// for long, and a scan of made-up IDs shouldn't fill the cache.
+	apiKeyMissTTL = 5 * time.Second
+
+	// apiKeyCacheSize bounds the entries kept, found or not.
+	apiKeyCacheSize = 10000
+
+	// apiKeyTouchInterval spaces out the writes recording when a key was
+	// last used, so a busy key doesn't cost a write per request.
+	apiKeyTouchInterval = time.Minute
+)
+
+// newAPIKeySecret returns a secret for the key with the given ID.
+func newAPIKeySecret(id string) string {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	return apiKeyPrefix + id + "_" + hex.EncodeToString(raw)
+}
+
+func hashAPIKeySecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// presentedAPIKey returns the API key secret sent as a bearer token, or ""
+// if there is none; other bearer tokens, like ADMIN_TOKEN, are left alone.
+func presentedAPIKey(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || !strings.HasPrefix(token, apiKeyPrefix) {
+		return ""
+	}
+	return token
+}
+
+// apiKeyCacheEntry is a lookup of one key ID, including one that found
+// nothing.
+type apiKeyCacheEntry struct {
+	key     apiKey
+	found   bool
+	fetched time.Time
+}
+
+// expired reports whether the entry is older than it may be kept: ttl for a
+// key, and no longer than apiKeyMissTTL for a miss.
+func (e apiKeyCacheEntry) expired(ttl time.Duration) bool {
+	if !e.found {
+		ttl = min(ttl, apiKeyMissTTL)
+	}
+	return serverClock.Since(e.fetched) >= ttl
+}
+
+// apiKeyCache keeps looked-up keys for API_KEY_CACHE_TTL, so checking a key
+// doesn't cost a database read per request. A revocation made through this
+// instance drops the key straight away; other instances see it once their
+// entry expires.
+//
+// It holds at most size entries. Expired ones are swept by the
+// rate-limit-janitor job, and when the cache is full; if it is still full,
+// an entry is dropped at random to make room.
+type apiKeyCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]apiKeyCacheEntry
+}
+
+func newAPIKeyCache(size int) *apiKeyCache {
+	return &apiKeyCache{size: size, entries: make(map[string]apiKeyCacheEntry)}
+}
+
+var apiKeys = newAPIKeyCache(apiKeyCacheSize)
+
+func (c *apiKeyCache) lookup(ctx context.Context, id string) (apiKey, bool, error) {
+	ttl := currentConfig().APIKeyCacheTTL
+	c.mu.Lock()
+	entry, ok := c.entries[id]
+	c.mu.Unlock()
+	if ok && !entry.expired(ttl) {
+		return entry.key, entry.found, nil
+	}
+	k, err := apiKeyStore.GetAPIKey(ctx, id)
+	if err != nil && !errors.Is(err, errAPIKeyNotFound) {
+		return apiKey{}, false, err
+	}
+	entry = apiKeyCacheEntry{key: k, found: err == nil, fetched: serverClock.Now()}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[id]; !ok && len(c.entries) >= c.size {
+		c.sweep(ttl)
+		for evicted := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, evicted)
+		}
+	}
+	c.entries[id] = entry
+	return entry.key, entry.found, nil
+}
+
+// prune drops the expired entries, returning how many.
+func (c *apiKeyCache) prune(ttl time.Duration) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sweep(ttl)
+}
+
+// sweep is prune with c.mu held.
+func (c *apiKeyCache) sweep(ttl time.Duration) int {
+	n := 0
+	for id, entry := range c.entries {
+		if entry.expired(ttl) {
+			delete(c.entries, id)
+			n++
+		}
+	}
+	return n
+}
+
+func (c *apiKeyCache) invalidate(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, id)
+}
+
+// touch records that the key was used, at most once per
+// apiKeyTouchInterval. The write happens in the background; a failed one is
+// only logged.
+func (c *apiKeyCache) touch(k apiKey) {
+	now := serverClock.Now()
+	if now.Sub(k.LastUsedAt) < apiKeyTouchInterval {
+		return
+	}
+	c.mu.Lock()
+	if entry, ok := c.entries[k.ID]; ok {
+		entry.key.LastUsedAt = now
+		c.entries[k.ID] = entry
+	}
+	c.mu.Unlock()
+	store := apiKeyStore
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := store.TouchAPIKey(ctx, k.ID, now.UTC()); err != nil {
+			log.Printf("🔥 Failed to record use of API key %s: %v", k.ID, err)
+		}
+	}()
+}
+
+// authenticateAPIKey checks secret against the stored hash of the key it
+// names. ok is false for a malformed, unknown, or revoked key.
+func authenticateAPIKey(ctx context.Context, secret string) (k apiKey, ok bool, err error) {
+	id, _, found := strings.Cut(strings.TrimPrefix(secret, apiKeyPrefix), "_")
+	if !found {
+		return apiKey{}, false, nil
+	}
+	k, found, err = apiKeys.lookup(ctx, id)
+	if err != nil || !found || !k.RevokedAt.IsZero() {
+		return apiKey{}, false, err
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(secret)), []byte(k.SecretHash)) != 1 {
+		return apiKey{}, false, nil
+	}
+	return k, true, nil
+}
+
+// apiKeyMiddleware turns away requests with an API key that is unknown or
+// revoked. Requests without one pass through as anonymous.
+func apiKeyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := presentedAPIKey(r)
+		if secret == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		k, ok, err := authenticateAPIKey(r.Context(), secret)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			writeProblem(w, r, http.StatusUnauthorized, "invalid API key")
+			log.Printf("🔒 Rejected API key for %s %s", r.Method, r.URL.Path)
+			return
+		}
+		apiKeys.touch(k)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiKeyResponse is the admin view of k. The secret is only ever set in the
+// answer to the POST that created it.
+func apiKeyResponse(k apiKey) types.APIKey {
+	resp := types.APIKey{ID: k.ID, Name: k.Name, Tier: k.Tier, CreatedAt: k.CreatedAt, Revoked: !k.RevokedAt.IsZero()}
+	if !k.LastUsedAt.IsZero() {
+		resp.LastUsedAt = &k.LastUsedAt
+	}
+	if !k.RevokedAt.IsZero() {
+		resp.RevokedAt = &k.RevokedAt
+	}
+	return resp
+}
+
+func validTier(tier string) bool {
+	return tier == tierFree || tier == tierPaid
+}
+
+// postAPIKey mints a key from a body like {"name": "acme", "tier": "paid"}
+// (free by default). The answer carries the secret, which can't be
+// retrieved again.
+func postAPIKey(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Name string `json:"name"`
+		Tier string `json:"tier"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	if body.Tier == "" {
+		body.Tier = tierFree
+	}
+	if strings.TrimSpace(body.Name) == "" || !validTier(body.Tier) {
+		writeProblem(w, r, http.StatusBadRequest, `body must be {"name": "...", "tier": "free"} or "paid"`)
+		log.Println("📉 Bad request: invalid API key", body.Name, body.Tier)
+		return
+	}
+	id := uuid.New().String()
+	secret := newAPIKeySecret(id)
+	k := apiKey{ID: id, Name: body.Name, Tier: body.Tier, SecretHash: hashAPIKeySecret(secret), CreatedAt: time.Now().UTC()}
+	if err := apiKeyStore.CreateAPIKey(r.Context(), k); err != nil {
+		respondError(w, r, err)
+		return
+	}
+	recordAudit(auditAPIKeyCreated, "", principalAdmin, map[string]interface{}{"id": id, "name": k.Name, "tier": k.Tier})
+	resp := apiKeyResponse(k)
+	resp.Secret = secret
+	w.Header().Set("Location", resourceURL(r, apiKeyRoute, id))
+	writeJSON(w, http.StatusCreated, resp)
+	log.Printf("🔑 API key %s created for %s on the %s tier", id, k.Name, k.Tier)
+}
+
+// getAPIKeys lists every key's metadata, revoked keys included.
+func getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	keys, err := apiKeyStore.ListAPIKeys(r.Context())
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	resp := make([]types.APIKey, len(keys))
+	for i, k := range keys {
+		resp[i] = apiKeyResponse(k)
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// getAPIKey answers with one key's metadata, revoked or not.
+func getAPIKey(w http.ResponseWriter, r *http.Request) {
+	k, err := apiKeyStore.GetAPIKey(r.Context(), r.PathValue("id"))
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, apiKeyResponse(k))
+}
+
+// patchAPIKey changes a key's tier, from a body like {"tier": "paid"}. The
+// caller keeps what it has used of its hourly quota and gets the new limit
+// with its next request.
+func patchAPIKey(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var body struct {
+		Tier string `json:"tier"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || !validTier(body.Tier) {
+		writeProblem(w, r, http.StatusBadRequest, `body must be {"tier": "free"} or {"tier": "paid"}`)
+		log.Println("📉 Bad request: invalid API key tier for", id)
+		return
+	}
+	if err := apiKeyStore.SetAPIKeyTier(r.Context(), id, body.Tier); err != nil {
+		respondError(w, r, err)
+		return
+	}
+	apiKeys.invalidate(id)
+	k, err := apiKeyStore.GetAPIKey(r.Context(), id)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	recordAudit(auditAPIKeyTierChanged, "", principalAdmin, map[string]interface{}{"id": id, "tier": body.Tier})
+	writeJSON(w, http.StatusOK, apiKeyResponse(k))
+	log.Printf("🔑 API key %s moved to the %s tier", id, body.Tier)
+}
+
+// deleteAPIKey revokes a key. The key stays listed, marked revoked, and is
+// turned away from then on; revoking it again changes nothing.
+func deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	k, err := apiKeyStore.GetAPIKey(r.Context(), id)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	if k.RevokedAt.IsZero() {
+		if err := apiKeyStore.RevokeAPIKey(r.Context(), id, time.Now().UTC()); err != nil {
+			respondError(w, r, err)
+			return
+		}
+		recordAudit(auditAPIKeyRevoked, "", principalAdmin, map[string]interface{}{"id": id, "name": k.Name})
+		log.Printf("🔑 API key %s revoked", id)
+	}
+	apiKeys.invalidate(id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// countingAPIKeyStore counts the reads of an InMemoryAPIKeyStore.
+type countingAPIKeyStore struct {
+	*InMemoryAPIKeyStore
+	gets atomic.Int32
+}
+
+func (s *countingAPIKeyStore) GetAPIKey(ctx context.Context, id string) (apiKey, error) {
+	s.gets.Add(1)
+	return s.InMemoryAPIKeyStore.GetAPIKey(ctx, id)
+}
+
+// newTestAPIKey creates a key through the admin endpoint.
+func newTestAPIKey(t *testing.T, s *testServer, tier string) types.APIKey {
+	t.Helper()
+	w := s.admin(http.MethodPost, "/admin/apikeys", `{"name": "ci", "tier": "`+tier+`"}`)
+	expectStatus(t, w, http.StatusCreated)
+	return decodeBody[types.APIKey](t, w)
+}
+
+func TestAPIKeyCache(t *testing.T) {
+	s := newTestServer(t)
+	store := &countingAPIKeyStore{InMemoryAPIKeyStore: NewInMemoryAPIKeyStore()}
+	apiKeyStore = store
+	key := newTestAPIKey(t, s, tierFree)
+	bearer := func(secret string) []string { return []string{"Authorization", "Bearer " + secret} }
+	unknown := apiKeyPrefix + "0000_00000000000000000000000000000000"
+
+	// A key is read once per API_KEY_CACHE_TTL.
+	for i := 0; i < 3; i++ {
+		expectStatus(t, s.do(http.MethodGet, "/albums", "", bearer(key.Secret)...), http.StatusOK)
+	}
+	s.clock.Advance(defaultAPIKeyCacheTTL - time.Second)
+	expectStatus(t, s.do(http.MethodGet, "/albums", "", bearer(key.Secret)...), http.StatusOK)
+	if n := store.gets.Load(); n != 1 {
+		t.Errorf("%d reads of a key used four times inside its TTL, want 1", n)
+	}
+
+	// A miss is kept for apiKeyMissTTL only.
+	store.gets.Store(0)
+	expectProblem(t, s.do(http.MethodGet, "/albums", "", bearer(unknown)...), http.StatusUnauthorized)
+	expectProblem(t, s.do(http.MethodGet, "/albums", "", bearer(unknown)...), http.StatusUnauthorized)
+	if n := store.gets.Load(); n != 1 {
+		t.Errorf("%d reads of an unknown key presented twice, want 1", n)
+	}
+	s.clock.Advance(apiKeyMissTTL)
+	expectProblem(t, s.do(http.MethodGet, "/albums", "", bearer(unknown)...), http.StatusUnauthorized)
+	if n := store.gets.Load(); n != 2 {
+		t.Errorf("%d reads of an unknown key after apiKeyMissTTL, want 2", n)
+	}
+
+	// The janitor sweeps what has expired.
+	s.clock.Advance(defaultAPIKeyCacheTTL)
+	pruneRateLimits(context.Background())
+	if n := len(apiKeys.entries); n != 0 {
+		t.Errorf("%d entries left after the janitor, want none", n)
+	}
+}
+
+func TestAPIKeyCacheBounded(t *testing.T) {
+	s := newTestServer(t)
+	apiKeys = newAPIKeyCache(5)
+	key := newTestAPIKey(t, s, tierPaid)
+
+	// A scan of made-up key IDs can't grow the cache past its size.
+	for i := 0; i < 1000; i++ {
+		secret := fmt.Sprintf("%s%04d_00000000000000000000000000000000", apiKeyPrefix, i)
+		expectProblem(t, s.do(http.MethodGet, "/albums", "", "Authorization", "Bearer "+secret), http.StatusUnauthorized)
+		if n := len(apiKeys.entries); n > 5 {
+			t.Fatalf("%d entries after %d unknown keys, want at most 5", n, i+1)
+		}
+	}
+	// A real key still gets in, and is served from it.
+	expectStatus(t, s.do(http.MethodGet, "/albums", "", "Authorization", "Bearer "+key.Secret), http.StatusOK)
+	if _, ok := apiKeys.entries[key.ID]; !ok {
+		t.Error("the key wasn't cached in a full cache")
+	}
+
+	// Once the misses expire they make way without a random eviction.
+	s.clock.Advance(apiKeyMissTTL)
+	for i := 0; i < 4; i++ {
+		secret := fmt.Sprintf("%s%04d_00000000000000000000000000000000", apiKeyPrefix, 2000+i)
+		s.do(http.MethodGet, "/albums", "", "Authorization", "Bearer "+secret)
+	}
+	if _, ok := apiKeys.entries[key.ID]; !ok {
+		t.Error("the key was evicted while expired misses were there to sweep")
+	}
+}
+
+func TestRevokedAPIKey(t *testing.T) {
+	s := newTestServer(t)
+	key := newTestAPIKey(t, s, tierFree)
+	auth := []string{"Authorization", "Bearer " + key.Secret}
+	expectStatus(t, s.do(http.MethodGet, "/albums", "", auth...), http.StatusOK)
+
+	// Revoked on another instance, sharing the store: this one turns the
+	// key away once its cache entry is a TTL old.
+	if err := apiKeyStore.RevokeAPIKey(context.Background(), key.ID, testStart); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, s.do(http.MethodGet, "/albums", "", auth...), http.StatusOK)
+	s.clock.Advance(defaultAPIKeyCacheTTL)
+	expectProblem(t, s.do(http.MethodGet, "/albums", "", auth...), http.StatusUnauthorized)
+
+	// Revoked here, straight away.
+	other := newTestAPIKey(t, s, tierFree)
+	auth = []string{"Authorization", "Bearer " + other.Secret}
+	expectStatus(t, s.do(http.MethodGet, "/albums", "", auth...), http.StatusOK)
+	expectStatus(t, s.admin(http.MethodDelete, "/admin/apikeys/"+other.ID, ""), http.StatusNoContent)
+	expectProblem(t, s.do(http.MethodGet, "/albums", "", auth...), http.StatusUnauthorized)
+}
+
+func TestAPIKeySecretShownOnce(t *testing.T) {
+	s := newTestServer(t)
+	key := newTestAPIKey(t, s, tierFree)
+	if !strings.HasPrefix(key.Secret, apiKeyPrefix+key.ID+"_") {
+		t.Fatalf("secret %q, want %s<id>_...", key.Secret, apiKeyPrefix)
+	}
+
+	for _, path := range []string{"/admin/apikeys", "/admin/apikeys/" + key.ID} {
+		w := s.admin(http.MethodGet, path, "")
+		expectStatus(t, w, http.StatusOK)
+		if strings.Contains(w.Body.String(), key.Secret) || strings.Contains(w.Body.String(), `"secret"`) {
+			t.Errorf("GET %s shows the secret: %s", path, w.Body)
+		}
+	}
+	w := s.admin(http.MethodPatch, "/admin/apikeys/"+key.ID, `{"tier": "paid"}`)
+	if strings.Contains(w.Body.String(), key.Secret) {
+		t.Errorf("PATCH shows the secret: %s", w.Body)
+	}
+
+	stored, err := apiKeyStore.GetAPIKey(context.Background(), key.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.SecretHash != hashAPIKeySecret(key.Secret) || strings.Contains(stored.SecretHash, key.Secret) {
+		t.Errorf("stored %+v, want only the hash of the secret", stored)
+	}
+}
@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// renameArtistRounds caps the passes renameInRounds makes over albums that
+// keep changing under it.
+const renameArtistRounds = 5
+
+var (
+	errRenameUnsupported = errors.New("the configured store does not support renaming artists")
+	errRenameContended   = newCategorizedError(errConflict, "the artist's albums kept changing during the rename; try again")
+)
+
+// artistRenamer is implemented by stores that can rename an artist across
+// the catalog.
+type artistRenamer interface {
+	// RenameArtist credits to to every album GET /albums?artist=from lists,
+	// bumping their UpdatedAt and leaving their slugs, and returns the
+	// albums as left. An album already credited to exactly to is left
+	// alone, so a rename can fix the case of a name. Only the artist is
+	// written, so a concurrent change to another field of a renamed album
+	// is kept.
+	RenameArtist(ctx context.Context, from, to string) ([]album, error)
+}
+
+func storeRenameArtist(ctx context.Context, store AlbumStore, from, to string) ([]album, error) {
+	r, ok := store.(artistRenamer)
+	if !ok {
+		return nil, errRenameUnsupported
+	}
+	return r.RenameArtist(ctx, from, to)
+}
+
+// artistAlbums lists the albums a rename of from to to would change.
+func artistAlbums(ctx context.Context, store AlbumStore, from, to string) ([]album, error) {
+	var list []album
+	err := store.Iterate(ctx, ListOptions{Filter: AlbumFilter{Artist: from}}, func(a album) error {
+		if a.Artist != to {
+			list = append(list, a)
+		}
+		return nil
+	})
+	return list, err
+}
+
+// renameInRounds renames an artist for the stores that write each album on
+// the condition that its UpdatedAt, the version of it, is still the one it
+// was read with. write renames the albums it is given, skipping those that
+// have changed since, and returns the ones it renamed; each pass lists the
+// albums left to rename afresh, so a skipped album is renamed as it is now.
+// Albums still changing after renameArtistRounds passes are
+// errRenameContended.
+func renameInRounds(ctx context.Context, store AlbumStore, from, to string, write func([]album) ([]album, error)) ([]album, error) {
+	var renamed []album
+	for range renameArtistRounds {
+		pending, err := artistAlbums(ctx, store, from, to)
+		if err != nil {
+			return nil, err
+		}
+		if len(pending) == 0 {
+			return renamed, nil
+		}
+		done, err := write(pending)
+		if err != nil {
+			return nil, err
+		}
+		renamed = append(renamed, done...)
+	}
+	return nil, errRenameContended
+}
+
+// RenameArtist implements artistRenamer under the store's lock, moving the
+// albums in the artist index.
+func (store *InMemoryAlbumStore) RenameArtist(ctx context.Context, from, to string) ([]album, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	filter := AlbumFilter{Artist: from}
+	var renamed []album
+	// The list changes as albums move out of it.
+	for _, e := range slices.Clone(store.byArtist[strings.ToLower(from)]) {
+		if !filter.matches(e.album) || e.Artist == to {
+			continue
+		}
+		before := e.album
+		store.unindexArtist(e)
+		e.Artist, e.UpdatedAt = to, storeTimestamp()
+		store.indexArtist(e)
+		after := e.album
+		store.changes.record(changeUpdated, e.ID, &before, &after)
+		renamed = append(renamed, e.album)
+	}
+	if len(renamed) > 0 {
+		store.generation.Add(1)
+	}
+	return renamed, nil
+}
+
+// RenameArtist implements artistRenamer with a single UPDATE, whose row
+// locks order it with concurrent writes to the same albums, and then sets
+// the renamed albums' search keys in the same transaction. The change log
+// trigger records each album.
+func (store *PostgresAlbumStore) RenameArtist(ctx context.Context, from, to string) ([]album, error) {
+	var renamed []album
+	err := store.inTx(ctx, func(tx *PostgresAlbumStore) error {
+		opCtx, cancel := tx.opContext(ctx)
+		defer cancel()
+		rows, err := tx.db.Query(opCtx,
+			`UPDATE albums SET artist = $2, updated_at = $3 WHERE lower(artist) = lower($1) AND artist <> $2 RETURNING `+postgresAlbumColumns,
+			from, to, storeTimestamp())
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			a, err := scanPostgresAlbum(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			renamed = append(renamed, a)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		ids, keys := make([]string, len(renamed)), make([]string, len(renamed))
+		for i, a := range renamed {
+			ids[i], keys[i] = a.ID, searchKey(a.Title, a.Artist)
+		}
+		_, err = tx.db.Exec(opCtx,
+			`UPDATE albums SET search_key = k.key FROM unnest($1::text[], $2::text[]) AS k(id, key) WHERE albums.id = k.id`, ids, keys)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return renamed, nil
+}
+
+// RenameArtist implements artistRenamer with a single UPDATE, as the
+// Postgres store does. SQLite takes the write lock for the transaction, so
+// no other write can interleave with it.
+func (store *SqliteAlbumStore) RenameArtist(ctx context.Context, from, to string) ([]album, error) {
+	var renamed []album
+	err := store.inTx(ctx, func(tx *SqliteAlbumStore) error {
+		var recs []sqliteAlbum
+		err := tx.db.WithContext(ctx).Raw(`UPDATE albums SET artist = ?, updated_at = ? WHERE lower(artist) = lower(?) AND artist <> ? RETURNING *`,
+			to, storeTimestamp(), from, to).Scan(&recs).Error
+		if err != nil {
+			return err
+		}
+		renamed = make([]album, len(recs))
+		for i, rec := range recs {
+			renamed[i] = rec.album()
+			if err := tx.db.WithContext(ctx).Model(&sqliteAlbum{}).Where("id = ?", rec.ID).Update("search_key", searchKey(rec.Title, rec.Artist)).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return renamed, nil
+}
+
+// RenameArtist implements artistRenamer with a bulk write per pass, each
+// update matching the album at the UpdatedAt it was listed with. On a
+// replica set a pass is one transaction; a standalone server applies it
+// album by album, so there readers may see part of a pass, and a rename that
+// fails partway leaves the albums it got to renamed.
+func (store *MongoAlbumStore) RenameArtist(ctx context.Context, from, to string) ([]album, error) {
+	return renameInRounds(ctx, store, from, to, func(pending []album) ([]album, error) {
+		var renamed []album
+		err := store.transaction(ctx, func(ctx context.Context) (err error) {
+			renamed, err = store.renameAll(ctx, pending, to)
+			return err
+		})
+		if errors.Is(err, errMongoStandalone) {
+			renamed, err = store.renameAll(ctx, pending, to)
+		}
+		return renamed, err
+	})
+}
+
+// renameAll credits the albums in pending to to, unless they have changed
+// since they were read, and returns the ones it renamed.
+func (store *MongoAlbumStore) renameAll(ctx context.Context, pending []album, to string) ([]album, error) {
+	now := storeTimestamp()
+	models := make([]mongo.WriteModel, len(pending))
+	ids := make([]string, len(pending))
+	for i, a := range pending {
+		ids[i] = a.ID
+		models[i] = mongo.NewUpdateOneModel().
+			SetFilter(bson.D{{Key: "id", Value: a.ID}, {Key: "updatedAt", Value: a.UpdatedAt}}).
+			SetUpdate(bson.D{{Key: "$set", Value: bson.D{
+				{Key: "artist", Value: to}, {Key: "searchKey", Value: searchKey(a.Title, to)}, {Key: "updatedAt", Value: now},
+			}}})
+	}
+	res, err := store.collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	if err != nil {
+		return nil, err
+	}
+	if int(res.ModifiedCount) == len(pending) {
+		renamed := make([]album, len(pending))
+		for i, a := range pending {
+			a.Artist, a.UpdatedAt = to, now
+			renamed[i] = a
+		}
+		return renamed, nil
+	}
+	// Some had changed; read back the ones this write renamed.
+	cur, err := store.collection.Find(ctx, append(mongoIDs(ids), bson.E{Key: "updatedAt", Value: now}, bson.E{Key: "artist", Value: to}))
+	if err != nil {
+		return nil, err
+	}
+	var docs []mongoAlbum
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	renamed := make([]album, len(docs))
+	for i, doc := range docs {
+		renamed[i] = doc.album()
+	}
+	return renamed, nil
+}
+
+// RenameArtist implements artistRenamer with transactions of at most
+// dynamoBatchChunk conditional updates, each on the UpdatedAt the album was
+// listed with. A transaction an album changed under is written by the next
+// pass instead, so the rename as a whole is not atomic: other clients may
+// see part of it.
+func (store *DynamoAlbumStore) RenameArtist(ctx context.Context, from, to string) ([]album, error) {
+	return renameInRounds(ctx, store, from, to, func(pending []album) ([]album, error) {
+		now := storeTimestamp()
+		var renamed []album
+		for chunk := range slices.Chunk(pending, dynamoBatchChunk) {
+			writes := make([]types.TransactWriteItem, len(chunk))
+			for i, a := range chunk {
+				w, err := dynamoRenameWrite(a, to, now)
+				if err != nil {
+					return nil, err
+				}
+				writes[i] = w
+			}
+			opCtx, cancel := store.opContext(ctx)
+			_, err := store.client.TransactWriteItems(opCtx, &dynamodb.TransactWriteItemsInput{TransactItems: writes})
+			cancel()
+			var canceled *types.TransactionCanceledException
+			if errors.As(err, &canceled) && dynamoFailedWrite(err) >= 0 {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			for _, a := range chunk {
+				a.Artist, a.UpdatedAt = to, now
+				renamed = append(renamed, a)
+			}
+		}
+		return renamed, nil
+	})
+}
+
+// dynamoRenameWrite builds the update that credits a to to, on the
+// condition that it hasn't changed since it was read.
+func dynamoRenameWrite(a album, to string, now time.Time) (types.TransactWriteItem, error) {
+	seen, err := attributevalue.Marshal(a.UpdatedAt)
+	if err != nil {
+		return types.TransactWriteItem{}, err
+	}
+	updated, err := attributevalue.Marshal(now)
+	if err != nil {
+		return types.TransactWriteItem{}, err
+	}
+	return types.TransactWriteItem{Update: &types.Update{
+		TableName:           aws.String(dynamoAlbumsTable),
+		Key:                 map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: a.ID}},
+		UpdateExpression:    aws.String("SET artist = :to, artistKey = :key, searchKey = :search, updatedAt = :now"),
+		ConditionExpression: aws.String("updatedAt = :seen"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":to":     &types.AttributeValueMemberS{Value: to},
+			":key":    &types.AttributeValueMemberS{Value: strings.ToLower(to)},
+			":search": &types.AttributeValueMemberS{Value: searchKey(a.Title, to)},
+			":now":    updated,
+			":seen":   seen,
+		},
+	}}, nil
+}
+
+// artistRename is the body of POST /admin/artists/rename.
+type artistRename struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+func (r artistRename) validate() error {
+	switch {
+	case strings.TrimSpace(r.From) == "":
+		return errors.New("from is required")
+	case strings.TrimSpace(r.To) == "":
+		return errors.New("to is required")
+	case r.From == r.To:
+		return errors.New("to must differ from from")
+	}
+	return nil
+}
+
+// artistRenameResult is the answer to POST /admin/artists/rename.
+type artistRenameResult struct {
+	Matched int  `json:"matched"`
+	Renamed int  `json:"renamed"`
+	DryRun  bool `json:"dryRun,omitempty"`
+}
+
+// postArtistRename credits every album by one artist to another name, such
+// as to fix "Jon Coltrane" to "John Coltrane". The name matches as ?artist=
+// does, ignoring case. A call with ?dryRun=true only counts the albums it
+// would change.
+//
+// The rename is atomic only on Postgres and SQLite. On a standalone MongoDB
+// server, and on DynamoDB past dynamoBatchChunk albums, it is written in
+// parts that readers may see, and a failure leaves the parts written; the
+// same rename sent again finishes it.
+func postArtistRename(w http.ResponseWriter, r *http.Request) {
+	var body artistRename
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&body); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	if err := body.validate(); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+
+	if r.URL.Query().Get("dryRun") == "true" {
+		// As for a bulk delete, only a fresh listing will do.
+		matched, err := artistAlbums(r.Context(), albumStore, body.From, body.To)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, artistRenameResult{Matched: len(matched), DryRun: true})
+		log.Printf("🎤 Artist rename dry run matched %d albums", len(matched))
+		return
+	}
+
+	ctx := withPrincipal(r.Context(), principalAdmin)
+	renamed, err := storeRenameArtist(ctx, albumStore, body.From, body.To)
+	if errors.Is(err, errRenameUnsupported) {
+		writeProblem(w, r, http.StatusNotImplemented, err.Error())
+		log.Println("🚧 Artist rename requested but the album store can't rename")
+		return
+	}
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	if len(renamed) > 0 {
+		albumsChanged()
+	}
+	recordAudit(auditArtistRenamed, "", principalAdmin, map[string]interface{}{"from": body.From, "to": body.To, "count": len(renamed)})
+	writeJSON(w, http.StatusOK, artistRenameResult{Matched: len(renamed), Renamed: len(renamed)})
+	log.Printf("🎤 Renamed artist %q to %q on %d albums", body.From, body.To, len(renamed))
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/money"
+	"github.com/brentmzey/web-service-go/types"
+)
+
+func TestArtistRename(t *testing.T) {
+	s := newTestServer(t)
+	captureLog(t)
+	blue := s.create(newTestAlbum(withTitle("Blue Train"), withArtist("Jon Coltrane")))
+	s.create(newTestAlbum(withTitle("Giant Steps"), withArtist("jon coltrane")))
+	s.create(newTestAlbum(withTitle("Kind of Blue"), withArtist("Miles Davis")))
+	head := decodeBody[types.AlbumChanges](t, s.do(http.MethodGet, "/albums/changes", "")).Head
+
+	for _, body := range []string{`{"from": "", "to": "John Coltrane"}`, `{"from": "Jon Coltrane"}`, `{"from": "x", "to": "x"}`, `{"from": "x", "to": "y", "extra": 1}`} {
+		expectProblem(t, s.admin(http.MethodPost, "/admin/artists/rename", body), http.StatusBadRequest)
+	}
+	expectProblem(t, s.do(http.MethodPost, "/admin/artists/rename", `{"from": "Jon Coltrane", "to": "John Coltrane"}`), http.StatusUnauthorized)
+
+	// A dry run counts, ignoring case, and changes nothing.
+	w := s.admin(http.MethodPost, "/admin/artists/rename?dryRun=true", `{"from": "JON COLTRANE", "to": "John Coltrane"}`)
+	expectStatus(t, w, http.StatusOK)
+	if got := decodeBody[artistRenameResult](t, w); got != (artistRenameResult{Matched: 2, DryRun: true}) {
+		t.Errorf("dry run %+v", got)
+	}
+	if got := decodeBody[album](t, s.do(http.MethodGet, "/albums/"+blue.ID, "")); got.Artist != "Jon Coltrane" {
+		t.Errorf("a dry run renamed the album to %q", got.Artist)
+	}
+
+	w = s.admin(http.MethodPost, "/admin/artists/rename", `{"from": "Jon Coltrane", "to": "John Coltrane"}`)
+	expectStatus(t, w, http.StatusOK)
+	if got := decodeBody[artistRenameResult](t, w); got != (artistRenameResult{Matched: 2, Renamed: 2}) {
+		t.Errorf("rename %+v", got)
+	}
+	// The slug is kept, and the artist index follows the name.
+	if got := decodeBody[album](t, s.do(http.MethodGet, "/albums/"+blue.ID, "")); got.Artist != "John Coltrane" || got.Slug != blue.Slug {
+		t.Errorf("renamed to %+v", got)
+	}
+	for artist, want := range map[string]int{"jon coltrane": 0, "john coltrane": 2, "miles davis": 1} {
+		if got := len(decodeBody[[]album](t, s.do(http.MethodGet, "/albums?artist="+url.QueryEscape(artist), ""))); got != want {
+			t.Errorf("?artist=%s lists %d albums, want %d", artist, got, want)
+		}
+	}
+
+	// Each album is a change; the rename is one audit entry.
+	changes := decodeBody[types.AlbumChanges](t, s.do(http.MethodGet, fmt.Sprintf("/albums/changes?since=%d", head), "")).Changes
+	if len(changes) != 2 || changes[0].Op != changeUpdated || changes[1].Op != changeUpdated {
+		t.Errorf("changes %+v, want 2 updates", changes)
+	}
+	entries := auditEntries(t, auditArtistRenamed)
+	if len(entries) != 1 || fmt.Sprint(entries[0].Details["count"]) != "2" || entries[0].Details["to"] != "John Coltrane" {
+		t.Errorf("audit entries %+v", entries)
+	}
+
+	// Nothing is left to rename the second time, and the case can be fixed.
+	if got := decodeBody[artistRenameResult](t, s.admin(http.MethodPost, "/admin/artists/rename", `{"from": "Jon Coltrane", "to": "John Coltrane"}`)); got.Renamed != 0 {
+		t.Errorf("renamed %d albums again", got.Renamed)
+	}
+	if got := decodeBody[artistRenameResult](t, s.admin(http.MethodPost, "/admin/artists/rename", `{"from": "John Coltrane", "to": "JOHN COLTRANE"}`)); got.Renamed != 2 {
+		t.Errorf("the case fixed on %d albums", got.Renamed)
+	}
+}
+
+// TestRenameInRounds checks the optimistic passes the MongoDB and DynamoDB
+// stores rename in, against an album a goroutine edits between the listing
+// and the conditional write.
+func TestRenameInRounds(t *testing.T) {
+	newTestServer(t)
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name   string
+		edits  int // the passes the album is edited in
+		passes int // the writes made
+		err    error
+	}{
+		{name: "edited once", edits: 1, passes: 2},
+		{name: "edited every pass", edits: renameArtistRounds, err: errRenameContended, passes: renameArtistRounds},
+	} {
+		store := NewInMemoryAlbumStore()
+		var contested album
+		for i := range 5 {
+			a, err := store.Create(ctx, newTestAlbum(withID(newAlbumID()), withTitle(fmt.Sprint("Take ", i)), withArtist("Jon Coltrane"), withPrice(1000)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if i == 2 {
+				contested = a
+			}
+		}
+
+		edit, edited := make(chan struct{}), make(chan struct{})
+		price := int64(1000)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range edit {
+				// UpdatedAt, the version, is kept to the millisecond.
+				time.Sleep(2 * time.Millisecond)
+				a, err := store.GetByID(ctx, contested.ID)
+				if err == nil {
+					price++
+					a.Price = money.FromCents(price)
+					_, err = store.Update(ctx, a, false)
+				}
+				if err != nil {
+					t.Error(err)
+				}
+				edited <- struct{}{}
+			}
+		}()
+
+		// write renames each album as the stores' conditional writes do,
+		// unless its UpdatedAt has moved on since it was listed.
+		passes := 0
+		write := func(pending []album) ([]album, error) {
+			passes++
+			if passes <= tc.edits {
+				edit <- struct{}{}
+				<-edited
+			}
+			var done []album
+			for _, a := range pending {
+				current, err := store.GetByID(ctx, a.ID)
+				if err != nil {
+					return nil, err
+				}
+				if !current.UpdatedAt.Equal(a.UpdatedAt) {
+					continue
+				}
+				a.Artist = "John Coltrane"
+				a, err = store.Update(ctx, a, false)
+				if err != nil {
+					return nil, err
+				}
+				done = append(done, a)
+			}
+			return done, nil
+		}
+		renamed, err := renameInRounds(ctx, store, "Jon Coltrane", "John Coltrane", write)
+		close(edit)
+		wg.Wait()
+
+		if !errors.Is(err, tc.err) || passes != tc.passes {
+			t.Errorf("%s: %v after %d passes, want %v after %d", tc.name, err, passes, tc.err, tc.passes)
+		}
+		// The edits are never lost to the rename.
+		got, err := store.GetByID(ctx, contested.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Price != money.FromCents(price) {
+			t.Errorf("%s: the album's price is %s, want the edit's %d cents", tc.name, got.Price, price)
+		}
+		if tc.err == nil && (len(renamed) != 5 || got.Artist != "John Coltrane") {
+			t.Errorf("%s: renamed %d albums, the edited one to %q", tc.name, len(renamed), got.Artist)
+		}
+	}
+}
+
+// testRenameConcurrentEdit renames an artist on store while a goroutine
+// edits the price of one of the artist's albums.
+func testRenameConcurrentEdit(t *testing.T, store AlbumStore) {
+	ctx := context.Background()
+	const albums = 100
+	var contested album
+	for i := range albums {
+		a, err := store.Create(ctx, newTestAlbum(withID(newAlbumID()), withTitle(fmt.Sprint("Take ", i)), withArtist("Jon Coltrane"), withPrice(1000)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == albums/2 {
+			contested = a
+		}
+	}
+	renamer, ok := store.(artistRenamer)
+	if !ok {
+		t.Fatalf("%T can't rename", store)
+	}
+
+	stop, started := make(chan struct{}), make(chan struct{})
+	var last int64
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for price := int64(1001); ; price++ {
+			a, err := store.GetByID(ctx, contested.ID)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			a.Price = money.FromCents(price)
+			if _, err := store.Update(ctx, a, false); err != nil {
+				t.Error(err)
+				return
+			}
+			last = price
+			if price == 1001 {
+				close(started)
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+	}()
+	<-started
+	renamed, err := renamer.RenameArtist(ctx, "Jon Coltrane", "John Coltrane")
+	close(stop)
+	wg.Wait()
+	if err != nil && !errors.Is(err, errRenameContended) {
+		t.Fatal(err)
+	}
+
+	// The edits are kept. An edit read before the rename and written after
+	// it puts the old name back, as any two writes of an album may; the same
+	// rename again finishes it.
+	got, err := store.GetByID(ctx, contested.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Price != money.FromCents(last) {
+		t.Errorf("the album's price is %s, want the last edit's %d cents", got.Price, last)
+	}
+	again, err := renamer.RenameArtist(ctx, "Jon Coltrane", "John Coltrane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(renamed)+len(again) < albums || len(again) > 1 || (len(again) == 1 && again[0].ID != contested.ID) {
+		t.Errorf("renamed %d albums, then %d more", len(renamed), len(again))
+	}
+	page, err := store.List(ctx, ListOptions{Filter: AlbumFilter{Artist: "John Coltrane"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Albums) != albums {
+		t.Errorf("%d albums renamed, want %d", len(page.Albums), albums)
+	}
+	if got, err := store.GetByID(ctx, contested.ID); err != nil || got.Price != money.FromCents(last) || got.Artist != "John Coltrane" {
+		t.Errorf("the edited album is %+v, %v", got, err)
+	}
+}
+
+func TestRenameConcurrentEditInMemory(t *testing.T) {
+	newTestServer(t)
+	testRenameConcurrentEdit(t, NewInMemoryAlbumStore())
+}
+
+func TestRenameConcurrentEditSQLite(t *testing.T) {
+	newTestServer(t)
+	store, err := NewSqliteAlbumStore(testSQLiteStores(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRenameConcurrentEdit(t, store)
+}
+
+func TestRenameConcurrentEditMongo(t *testing.T) {
+	newTestServer(t)
+	testRenameConcurrentEdit(t, testMongoAlbumStore(t))
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brentmzey/web-service-go/money"
+)
+
+const (
+	defaultArtistStatsSort     = "-albums"
+	defaultArtistStatsPageSize = 100
+	maxArtistStatsPageSize     = 1000
+)
+
+// artistGroup summarizes the albums credited to one spelling of an artist's
+// name. Stores group by the name as written; artistRollup merges the
+// spellings that differ only in case.
+type artistGroup struct {
+	Artist      string
+	Albums      int
+	TotalValue  money.Amount
+	MinPrice    money.Amount
+	MaxPrice    money.Amount
+	LastAddedAt time.Time
+}
+
+// artistGrouper is implemented by stores that can group albums by artist
+// themselves instead of listing every album to the application.
+type artistGrouper interface {
+	// ArtistGroups groups the albums within their availability window at
+	// availableAt, or every album when it is zero.
+	ArtistGroups(ctx context.Context, availableAt time.Time) ([]artistGroup, error)
+}
+
+// artistGrouping groups albums by artist one at a time.
+type artistGrouping struct {
+	index  map[string]int
+	groups []artistGroup
+}
+
+func (g *artistGrouping) add(a album) {
+	i, ok := g.index[a.Artist]
+	if !ok {
+		if g.index == nil {
+			g.index = make(map[string]int)
+		}
+		i = len(g.groups)
+		g.index[a.Artist] = i
+		g.groups = append(g.groups, artistGroup{Artist: a.Artist})
+	}
+	g.groups[i] = g.groups[i].add(artistGroup{Albums: 1, TotalValue: a.Price, MinPrice: a.Price, MaxPrice: a.Price, LastAddedAt: a.CreatedAt})
+}
+
+// groupArtists groups list by artist in a single pass.
+func groupArtists(list []album) []artistGroup {
+	var g artistGrouping
+	for _, a := range list {
+		g.add(a)
+	}
+	return g.groups
+}
+
+// add merges two groups, keeping g's name.
+func (g artistGroup) add(o artistGroup) artistGroup {
+	if g.Albums == 0 {
+		o.Artist = g.Artist
+		return o
+	}
+	g.Albums += o.Albums
+	g.TotalValue = g.TotalValue.Add(o.TotalValue)
+	g.MinPrice = min(g.MinPrice, o.MinPrice)
+	g.MaxPrice = max(g.MaxPrice, o.MaxPrice)
+	if o.LastAddedAt.After(g.LastAddedAt) {
+		g.LastAddedAt = o.LastAddedAt
+	}
+	return g
+}
+
+// storeArtistGroups groups the albums in store by artist, in the database
+// when the store supports it.
+func storeArtistGroups(ctx context.Context, store AlbumStore, availableAt time.Time) ([]artistGroup, error) {
+	if g, ok := store.(artistGrouper); ok {
+		return g.ArtistGroups(ctx, availableAt)
+	}
+	list, err := listAll(ctx, store, AlbumFilter{AvailableAt: availableAt})
+	if err != nil && !errors.Is(err, errStaleRead) {
+		return nil, err
+	}
+	return groupArtists(list), err
+}
+
+// artistKey is the name artists are grouped under, so "Miles Davis" and
+// "miles davis" count as one. It folds case the way the artist filter of
+// GET /albums does.
+func artistKey(name string) string {
+	return strings.ToLower(name)
+}
+
+// artistStats is one artist's entry in GET /artists/stats.
+type artistStats struct {
+	Artist       string       `json:"artist"` // the most common spelling
+	Albums       int          `json:"albums"`
+	MinPrice     money.Amount `json:"minPrice"`
+	AveragePrice money.Amount `json:"averagePrice"`
+	MaxPrice     money.Amount `json:"maxPrice"`
+	TotalValue   money.Amount `json:"totalValue"`
+	LastAddedAt  time.Time    `json:"lastAddedAt"`
+}
+
+// artistRollup merges groups whose names differ only in case. Each artist
+// is shown under the spelling with the most albums, the first in byte order
+// on a tie, so the name doesn't change from one request to the next.
+func artistRollup(groups []artistGroup) []artistStats {
+	type rollup struct {
+		total    artistGroup
+		spelling artistGroup // the best spelling so far
+	}
+	byKey := make(map[string]*rollup)
+	var keys []string
+	for _, g := range groups {
+		key := artistKey(g.Artist)
+		r, ok := byKey[key]
+		if !ok {
+			r = &rollup{}
+			byKey[key] = r
+			keys = append(keys, key)
+		}
+		r.total = r.total.add(g)
+		if r.spelling.Albums == 0 || g.Albums > r.spelling.Albums || g.Albums == r.spelling.Albums && g.Artist < r.spelling.Artist {
+			r.spelling = g
+		}
+	}
+	stats := make([]artistStats, len(keys))
+	for i, key := range keys {
+		r := byKey[key]
+		stats[i] = artistStats{
+			Artist:       r.spelling.Artist,
+			Albums:       r.total.Albums,
+			MinPrice:     r.total.MinPrice.Round(),
+			AveragePrice: r.total.TotalValue.Div(r.total.Albums),
+			MaxPrice:     r.total.MaxPrice.Round(),
+			TotalValue:   r.total.TotalValue.Round(),
+			LastAddedAt:  r.total.LastAddedAt.UTC(),
+		}
+	}
+	return stats
+}
+
+// artistStatsOrder compares two artists by each field GET /artists/stats
+// sorts by, returning a negative number when a comes first in ascending
+// order.
+var artistStatsOrder = map[string]func(a, b artistStats) int{
+	"artist":       func(a, b artistStats) int { return strings.Compare(artistKey(a.Artist), artistKey(b.Artist)) },
+	"albums":       func(a, b artistStats) int { return a.Albums - b.Albums },
+	"minPrice":     func(a, b artistStats) int { return compareFloats(float64(a.MinPrice), float64(b.MinPrice)) },
+	"averagePrice": func(a, b artistStats) int { return compareFloats(float64(a.AveragePrice), float64(b.AveragePrice)) },
+	"maxPrice":     func(a, b artistStats) int { return compareFloats(float64(a.MaxPrice), float64(b.MaxPrice)) },
+	"totalValue":   func(a, b artistStats) int { return compareFloats(float64(a.TotalValue), float64(b.TotalValue)) },
+	"lastAddedAt":  func(a, b artistStats) int { return a.LastAddedAt.Compare(b.LastAddedAt) },
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// parseArtistSort reads ?sort=: one of artistStatsOrder's keys, descending
+// when it starts with -. Ties go by artist name.
+func parseArtistSort(field string) (less func(a, b artistStats) bool, err error) {
+	name, descending := strings.CutPrefix(field, "-")
+	compare, ok := artistStatsOrder[name]
+	if !ok {
+		return nil, errors.New("sort must be one of artist, albums, minPrice, averagePrice, maxPrice, totalValue, or lastAddedAt, optionally prefixed with -")
+	}
+	byName := artistStatsOrder["artist"]
+	return func(a, b artistStats) bool {
+		c := compare(a, b)
+		if descending {
+			c = -c
+		}
+		if c == 0 {
+			return byName(a, b) < 0
+		}
+		return c < 0
+	}, nil
+}
+
+// artistStatsPage is the answer to GET /artists/stats.
+type artistStatsPage struct {
+	Artists []artistStats `json:"artists"`
+	Total   int           `json:"total"` // artists across every page
+	Limit   int           `json:"limit"`
+	Offset  int           `json:"offset"`
+}
+
+// getArtistStats rolls the catalog up by artist: album count, price range
+// and average, total value, and latest addition. ?sort= picks the order,
+// most albums first by default, and limit and offset page through it. Only
+// the albums available now count, unless the request may includeUnavailable.
+func getArtistStats(w http.ResponseWriter, r *http.Request) {
+	field := r.URL.Query().Get("sort")
+	if field == "" {
+		field = defaultArtistStatsSort
+	}
+	var limit, offset int
+	less, err := parseArtistSort(field)
+	if err == nil {
+		limit, offset, err = parsePage(r, defaultArtistStatsPageSize, maxArtistStatsPageSize)
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	include, err := includeUnavailable(r)
+	if err != nil {
+		writeFilterProblem(w, r, err)
+		return
+	}
+	var at time.Time
+	if include {
+		w.Header().Set("Cache-Control", privateCacheControl)
+	} else {
+		at = availabilityNow()
+	}
+	groups, err := storeArtistGroups(r.Context(), albumStore, at)
+	if err = acceptStale(w, err); err != nil {
+		respondError(w, r, err)
+		return
+	}
+	stats := artistRollup(groups)
+	sort.SliceStable(stats, func(i, j int) bool { return less(stats[i], stats[j]) })
+	total := len(stats)
+	writeJSON(w, http.StatusOK, artistStatsPage{
+		Artists: stats[min(offset, total):min(offset+limit, total)],
+		Total:   total,
+		Limit:   limit,
+		Offset:  offset,
+	})
+	log.Printf("🎤 Served stats for %d artists", total)
+}
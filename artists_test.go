@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/money"
+)
+
+func TestArtistRollup(t *testing.T) {
+	at := func(minutes int) func(*album) {
+		return func(a *album) { a.CreatedAt = testStart.Add(time.Duration(minutes) * time.Minute) }
+	}
+	stats := artistRollup(groupArtists([]album{
+		newTestAlbum(withArtist("Miles Davis"), withPrice(1000), at(1)),
+		newTestAlbum(withArtist("miles davis"), withPrice(500), at(5)),
+		newTestAlbum(withArtist("Miles Davis"), withPrice(2000), at(2)),
+		newTestAlbum(withArtist("MILES DAVIS"), withPrice(1500), at(3)),
+		newTestAlbum(withArtist("bill evans"), withPrice(800), at(4)),
+		newTestAlbum(withArtist("Bill Evans"), withPrice(900), at(0)),
+	}))
+	want := []artistStats{
+		// Shown under the spelling with the most albums.
+		{Artist: "Miles Davis", Albums: 4, MinPrice: money.FromCents(500), AveragePrice: money.FromCents(1250), MaxPrice: money.FromCents(2000), TotalValue: money.FromCents(5000), LastAddedAt: testStart.Add(5 * time.Minute)},
+		// On a tie, under the first in byte order.
+		{Artist: "Bill Evans", Albums: 2, MinPrice: money.FromCents(800), AveragePrice: money.FromCents(850), MaxPrice: money.FromCents(900), TotalValue: money.FromCents(1700), LastAddedAt: testStart.Add(4 * time.Minute)},
+	}
+	if !slices.Equal(stats, want) {
+		t.Errorf("rollup = %+v\nwant %+v", stats, want)
+	}
+}
+
+func TestArtistStatsSort(t *testing.T) {
+	s := newTestServer(t)
+	for _, a := range []album{
+		newTestAlbum(withArtist("Miles Davis"), withTitle("Kind of Blue"), withPrice(1000)),
+		newTestAlbum(withArtist("Miles Davis"), withTitle("Bitches Brew"), withPrice(2000)),
+		newTestAlbum(withArtist("miles davis"), withTitle("Milestones"), withPrice(500)),
+		newTestAlbum(withArtist("John Coltrane"), withPrice(3000)),
+		newTestAlbum(withArtist("Bill Evans"), withTitle("Sunday at the Village Vanguard"), withPrice(800)),
+		newTestAlbum(withArtist("Bill Evans"), withTitle("Waltz for Debby"), withPrice(900)),
+	} {
+		s.create(a)
+	}
+	for field, want := range map[string][]string{
+		"":              {"Miles Davis", "Bill Evans", "John Coltrane"},
+		"albums":        {"John Coltrane", "Bill Evans", "Miles Davis"},
+		"artist":        {"Bill Evans", "John Coltrane", "Miles Davis"},
+		"-artist":       {"Miles Davis", "John Coltrane", "Bill Evans"},
+		"minPrice":      {"Miles Davis", "Bill Evans", "John Coltrane"},
+		"-maxPrice":     {"John Coltrane", "Miles Davis", "Bill Evans"},
+		"averagePrice":  {"Bill Evans", "Miles Davis", "John Coltrane"},
+		"-totalValue":   {"Miles Davis", "John Coltrane", "Bill Evans"},
+		"-averagePrice": {"John Coltrane", "Miles Davis", "Bill Evans"},
+	} {
+		w := s.do(http.MethodGet, "/artists/stats?sort="+field, "")
+		expectStatus(t, w, http.StatusOK)
+		var got []string
+		for _, a := range decodeBody[artistStatsPage](t, w).Artists {
+			got = append(got, a.Artist)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("sort=%s: %v, want %v", field, got, want)
+		}
+	}
+
+	page := decodeBody[artistStatsPage](t, s.do(http.MethodGet, "/artists/stats?sort=artist&limit=1&offset=1", ""))
+	if page.Total != 3 || len(page.Artists) != 1 || page.Artists[0].Artist != "John Coltrane" {
+		t.Errorf("the second page of one = %+v", page)
+	}
+	expectProblem(t, s.do(http.MethodGet, "/artists/stats?sort=genre", ""), http.StatusBadRequest)
+}
+
+func TestArtistSortTies(t *testing.T) {
+	stats := []artistStats{
+		{Artist: "miles davis", Albums: 1, LastAddedAt: testStart},
+		{Artist: "Bill Evans", Albums: 1, LastAddedAt: testStart.Add(time.Hour)},
+		{Artist: "Art Blakey", Albums: 1, LastAddedAt: testStart},
+	}
+	for field, want := range map[string][]string{
+		// Equal counts go by name, case aside, whichever the direction.
+		"albums":       {"Art Blakey", "Bill Evans", "miles davis"},
+		"-albums":      {"Art Blakey", "Bill Evans", "miles davis"},
+		"lastAddedAt":  {"Art Blakey", "miles davis", "Bill Evans"},
+		"-lastAddedAt": {"Bill Evans", "Art Blakey", "miles davis"},
+	} {
+		less, err := parseArtistSort(field)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sorted := slices.Clone(stats)
+		sort.SliceStable(sorted, func(i, j int) bool { return less(sorted[i], sorted[j]) })
+		var got []string
+		for _, a := range sorted {
+			got = append(got, a.Artist)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("sort=%s: %v, want %v", field, got, want)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"log"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+	"github.com/google/uuid"
+)
+
+// AuditEntry records a change made to the catalog and who made it.
+type AuditEntry struct {
+	ID        string                 `json:"id"`
+	Timestamp time.Time              `json:"timestamp"`
+	Action    string                 `json:"action"`
+	AlbumID   string                 `json:"albumId,omitempty"`
+	Principal string                 `json:"principal"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+}
+
+// Audit actions.
+const (
+	auditAlbumCreated  = "album.created"
+	auditAlbumUpdated  = "album.updated"
+	auditAlbumEnriched = "album.enriched"
+	auditAlbumSold     = "album.sold"
+
+	// auditAlbumPriceChanged entries are written by the album store itself,
+	// in the same transaction as the change; see PriceChange.
+	auditAlbumPriceChanged = "album.price_changed"
+
+	auditCatalogImported = "catalog.imported"
+	auditAlbumsDeleted   = "albums.deleted"
+	auditAlbumsMerged    = "albums.merged"
+	auditAlbumsImported  = "albums.imported"
+	auditArtistRenamed   = "artist.renamed"
+
+	auditMaintenanceChanged = "maintenance.changed"
+	auditFeatureToggled     = "feature.toggled"
+	auditBodyLogTokenIssued = "body_logging.token_issued"
+	auditAPIKeyCreated      = "api_key.created"
+	auditAPIKeyTierChanged  = "api_key.tier_changed"
+	auditAPIKeyRevoked      = "api_key.revoked"
+)
+
+// Principals for changes that don't originate from a client request.
+const (
+	principalAnonymous = "anonymous"
+	principalEnricher  = "system:enrichment"
+	principalSeed      = "system:seed"
+	principalPayments  = "system:payments"
+	principalAdmin     = "admin"
+
+	// principalAnonymized replaces the principal of an audit entry past
+	// AUDIT_RETENTION.
+	principalAnonymized = "anonymized"
+)
+
+type principalKey struct{}
+
+// withPrincipal records in ctx who is making a change, for the stores that
+// write history alongside it.
+func withPrincipal(ctx context.Context, principal string) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// principalFrom is the principal set by withPrincipal, or principalAnonymous.
+func principalFrom(ctx context.Context) string {
+	if p, ok := ctx.Value(principalKey{}).(string); ok {
+		return p
+	}
+	return principalAnonymous
+}
+
+type AuditLog interface {
+	Record(entry AuditEntry) error
+	List() ([]AuditEntry, error)
+}
+
+type InMemoryAuditLog struct {
+	mu      sync.RWMutex
+	entries []AuditEntry
+}
+
+func (l *InMemoryAuditLog) Record(entry AuditEntry) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, entry)
+	return nil
+}
+
+func (l *InMemoryAuditLog) List() ([]AuditEntry, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return append([]AuditEntry(nil), l.entries...), nil
+}
+
+// recordAudit fills in the entry's ID and timestamp and writes it to the audit
+// log. Failures are logged rather than returned: the change itself already
+// happened and shouldn't be reported to the client as failed.
+func recordAudit(action, albumID, principal string, details map[string]interface{}) {
+	entry := AuditEntry{
+		ID:        uuid.New().String(),
+		Timestamp: time.Now().UTC(),
+		Action:    action,
+		AlbumID:   albumID,
+		Principal: principal,
+		Details:   details,
+	}
+	if err := auditLog.Record(entry); err != nil {
+		log.Printf("🔥 Failed to record audit entry %s for %s: %v", action, albumID, err)
+	}
+}
+
+var auditLog AuditLog = &InMemoryAuditLog{}
+
+// albumFieldChanges lists the fields that differ between before and after,
+// keyed by their JSON names, with the old and new value of each. The IDs
+// and timestamps are left out: they don't change, or change with every
+// write. An update's audit entry records it in its details, and the catalog
+// diff for each album it reports updated.
+func albumFieldChanges(before, after album) map[string]types.FieldChange {
+	changes := make(map[string]types.FieldChange)
+	note := func(field string, old, new interface{}, equal bool) {
+		if !equal {
+			changes[field] = types.FieldChange{Old: old, New: new}
+		}
+	}
+	note("title", before.Title, after.Title, before.Title == after.Title)
+	note("artist", before.Artist, after.Artist, before.Artist == after.Artist)
+	note("price", before.Price, after.Price, before.Price.Cents() == after.Price.Cents())
+	note("genre", before.Genre, after.Genre, before.Genre == after.Genre)
+	note("slug", before.Slug, after.Slug, before.Slug == after.Slug)
+	note("barcode", before.Barcode, after.Barcode, before.Barcode == after.Barcode)
+	note("year", before.Year, after.Year, before.Year == after.Year)
+	note("tracks", before.Tracks, after.Tracks, slices.Equal(before.Tracks, after.Tracks))
+	note("metadata", before.Metadata, after.Metadata, maps.Equal(before.Metadata, after.Metadata))
+	note("stock", before.Stock, after.Stock, before.Stock == after.Stock)
+	note("availableFrom", before.AvailableFrom, after.AvailableFrom, sameTime(before.AvailableFrom, after.AvailableFrom))
+	note("availableUntil", before.AvailableUntil, after.AvailableUntil, sameTime(before.AvailableUntil, after.AvailableUntil))
+	return changes
+}
+
+// updateAuditDetails are the details of the audit entry of an update from
+// before to after.
+func updateAuditDetails(before, after album) map[string]interface{} {
+	return map[string]interface{}{"changes": albumFieldChanges(before, after)}
+}
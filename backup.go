@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// catalogSchemaVersion identifies the backup format. Bump it whenever the
+// album record layout changes incompatibly; imports reject other versions.
+const catalogSchemaVersion = 1
+
+// catalogManifest describes a backup. Checksum is the hex SHA-256 of every
+// album record exactly as written in the backup, each followed by a newline.
+type catalogManifest struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	ExportedAt    time.Time `json:"exportedAt"`
+	Albums        int       `json:"albums,omitempty"`
+	Checksum      string    `json:"checksum,omitempty"`
+}
+
+// ndjsonRecord is one line of the gzipped NDJSON backup format: a manifest
+// header, the album records, and a trailing manifest carrying the
+// count and checksum.
+type ndjsonRecord struct {
+	Type     string           `json:"type"`
+	Album    json.RawMessage  `json:"album,omitempty"`
+	Manifest *catalogManifest `json:"manifest,omitempty"`
+}
+
+var errImportUnsupported = errors.New("the configured store does not support imports")
+
+type importMode string
+
+const (
+	importReplace importMode = "replace"
+	importMerge   importMode = "merge"
+)
+
+// AlbumImporter is implemented by stores that can load a backup in one
+// operation. next returns io.EOF after the last album; any other error must
+// leave the existing catalog untouched where the backend supports it.
+type AlbumImporter interface {
+	Import(ctx context.Context, mode importMode, next func() (album, error)) (int, error)
+}
+
+func getCatalogExport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "ndjson" {
+		writeProblem(w, r, http.StatusBadRequest, `format must be "json" or "ndjson"`)
+		log.Println("📉 Bad request: unknown export format", format)
+		return
+	}
+	manifest := catalogManifest{SchemaVersion: catalogSchemaVersion, ExportedAt: time.Now().UTC()}
+	stamp := manifest.ExportedAt.Format("20060102-150405")
+	ew := &exportWriter{w: w, start: func() {
+		if format == "ndjson" {
+			w.Header().Set("Content-Type", "application/gzip")
+			w.Header().Set("Content-Disposition", `attachment; filename="catalog-`+stamp+`.ndjson.gz"`)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", `attachment; filename="catalog-`+stamp+`.json"`)
+		}
+		w.WriteHeader(http.StatusOK)
+	}}
+	var out io.Writer = ew
+	var gz *gzip.Writer
+	if format == "ndjson" {
+		gz = gzip.NewWriter(ew)
+		out = gz
+	}
+
+	// A backup must not silently contain stale data, so the albums are
+	// iterated, which never falls back to a stale listing.
+	n, err := writeCatalog(r.Context(), out, format, manifest, func(fn func(album) error) error {
+		return albumStore.Iterate(r.Context(), ListOptions{}, fn)
+	})
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	switch {
+	case err != nil && !ew.started:
+		if !abandoned(r) {
+			respondError(w, r, err)
+		}
+		return
+	case err != nil:
+		// Headers are sent; the errors can only be logged.
+		if !abandoned(r) {
+			log.Printf("🔥 Backup export aborted: %v", err)
+		}
+		return
+	}
+	log.Printf("💾 Exported %d albums (%s)", n, format)
+}
+
+// exportWriter sends an export's headers with its first bytes, so that the
+// store failing before the first albums are written still gets an error
+// response.
+type exportWriter struct {
+	w       http.ResponseWriter
+	start   func()
+	started bool
+}
+
+func (e *exportWriter) Write(p []byte) (int, error) {
+	if !e.started {
+		e.started = true
+		e.start()
+	}
+	return e.w.Write(p)
+}
+
+// writeCatalog encodes the albums each yields in the requested format and
+// returns how many there were. Records are encoded one at a time as they
+// come, so a catalog of any size is never held in memory. It stops with
+// ctx's error once ctx is done.
+func writeCatalog(ctx context.Context, out io.Writer, format string, manifest catalogManifest, each func(fn func(album) error) error) (int, error) {
+	bw := bufio.NewWriter(out)
+	sum := sha256.New()
+	enc := json.NewEncoder(bw)
+
+	if format == "ndjson" {
+		header := manifest
+		header.Albums = 0
+		if err := enc.Encode(ndjsonRecord{Type: "manifest", Manifest: &header}); err != nil {
+			return 0, err
+		}
+	} else {
+		bw.WriteString(`{"albums":[`)
+	}
+	n := 0
+	err := each(func(a album) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		raw, err := json.Marshal(a)
+		if err != nil {
+			return err
+		}
+		sum.Write(raw)
+		sum.Write([]byte("\n"))
+		n++
+		if format == "ndjson" {
+			return enc.Encode(ndjsonRecord{Type: "album", Album: raw})
+		}
+		if n > 1 {
+			bw.WriteByte(',')
+		}
+		bw.WriteString("\n")
+		_, err = bw.Write(raw)
+		return err
+	})
+	if err != nil {
+		return n, err
+	}
+
+	manifest.Albums = n
+	manifest.Checksum = hex.EncodeToString(sum.Sum(nil))
+	if format == "ndjson" {
+		if err := enc.Encode(ndjsonRecord{Type: "checksum", Manifest: &manifest}); err != nil {
+			return n, err
+		}
+	} else {
+		bw.WriteString("\n],\"manifest\":")
+		if err := enc.Encode(manifest); err != nil {
+			return n, err
+		}
+		bw.WriteString("}\n")
+	}
+	return n, bw.Flush()
+}
+
+// spooledCatalog holds a validated backup's album records in a temporary
+// file, one JSON record per line, so large imports don't sit in memory.
+type spooledCatalog struct {
+	file     *os.File
+	manifest catalogManifest
+}
+
+func (c *spooledCatalog) Close() {
+	c.file.Close()
+	os.Remove(c.file.Name())
+}
+
+// spoolCatalog reads a backup from body, copying album records to a temp file
+// while checking the schema version, record count, and checksum. Nothing is
+// written to the store until the whole backup has been verified.
+func spoolCatalog(body io.Reader, ndjson bool) (*spooledCatalog, error) {
+	f, err := os.CreateTemp("", "catalog-import-*.ndjson")
+	if err != nil {
+		return nil, err
+	}
+	c := &spooledCatalog{file: f}
+	spool := bufio.NewWriter(f)
+	sum := sha256.New()
+	count := 0
+	add := func(raw json.RawMessage) error {
+		if len(raw) == 0 {
+			return errors.New("album record is empty")
+		}
+		count++
+		sum.Write(raw)
+		sum.Write([]byte("\n"))
+		spool.Write(raw)
+		return spool.WriteByte('\n')
+	}
+
+	var manifest *catalogManifest
+	if ndjson {
+		manifest, err = readNDJSONCatalog(body, add)
+	} else {
+		manifest, err = readJSONCatalog(body, add)
+	}
+	if err == nil {
+		err = verifyManifest(manifest, count, sum)
+	}
+	if err == nil {
+		err = spool.Flush()
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.manifest = *manifest
+	return c, nil
+}
+
+func readNDJSONCatalog(body io.Reader, add func(json.RawMessage) error) (*catalogManifest, error) {
+	dec := json.NewDecoder(body)
+	var trailer *catalogManifest
+	for line := 1; ; line++ {
+		var rec ndjsonRecord
+		if err := dec.Decode(&rec); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("record %d: %w", line, err)
+		}
+		if trailer != nil {
+			return nil, fmt.Errorf("record %d: data after checksum record", line)
+		}
+		switch rec.Type {
+		case "manifest":
+			if line != 1 || rec.Manifest == nil {
+				return nil, fmt.Errorf("record %d: unexpected manifest", line)
+			}
+			if rec.Manifest.SchemaVersion != catalogSchemaVersion {
+				return nil, fmt.Errorf("unsupported schema version %d (want %d)", rec.Manifest.SchemaVersion, catalogSchemaVersion)
+			}
+		case "album":
+			if line == 1 {
+				return nil, errors.New("backup must start with a manifest record")
+			}
+			if err := add(rec.Album); err != nil {
+				return nil, fmt.Errorf("record %d: %w", line, err)
+			}
+		case "checksum":
+			if rec.Manifest == nil {
+				return nil, fmt.Errorf("record %d: checksum record has no manifest", line)
+			}
+			trailer = rec.Manifest
+		default:
+			return nil, fmt.Errorf("record %d: unknown record type %q", line, rec.Type)
+		}
+	}
+	if trailer == nil {
+		return nil, errors.New("backup is truncated: missing checksum record")
+	}
+	return trailer, nil
+}
+
+func readJSONCatalog(body io.Reader, add func(json.RawMessage) error) (*catalogManifest, error) {
+	dec := json.NewDecoder(body)
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, errors.New("backup must be a JSON object")
+	}
+	var manifest *catalogManifest
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch tok {
+		case "albums":
+			if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+				return nil, errors.New(`"albums" must be an array`)
+			}
+			for i := 0; dec.More(); i++ {
+				var raw json.RawMessage
+				if err := dec.Decode(&raw); err != nil {
+					return nil, fmt.Errorf("albums[%d]: %w", i, err)
+				}
+				if err := add(raw); err != nil {
+					return nil, fmt.Errorf("albums[%d]: %w", i, err)
+				}
+			}
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+		case "manifest":
+			if err := dec.Decode(&manifest); err != nil {
+				return nil, fmt.Errorf("manifest: %w", err)
+			}
+		default:
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if manifest == nil {
+		return nil, errors.New("backup has no manifest")
+	}
+	return manifest, nil
+}
+
+func verifyManifest(m *catalogManifest, count int, sum hash.Hash) error {
+	if m.SchemaVersion != catalogSchemaVersion {
+		return fmt.Errorf("unsupported schema version %d (want %d)", m.SchemaVersion, catalogSchemaVersion)
+	}
+	if m.Albums != count {
+		return fmt.Errorf("manifest lists %d albums but backup contains %d", m.Albums, count)
+	}
+	if got := hex.EncodeToString(sum.Sum(nil)); !strings.EqualFold(got, m.Checksum) {
+		return fmt.Errorf("checksum mismatch: manifest says %s, contents hash to %s", m.Checksum, got)
+	}
+	return nil
+}
+
+// next decodes the spooled records one at a time for AlbumImporter.Import.
+func (c *spooledCatalog) next() func() (album, error) {
+	dec := json.NewDecoder(bufio.NewReader(c.file))
+	return func() (album, error) {
+		var a album
+		if err := dec.Decode(&a); err != nil {
+			return album{}, err
+		}
+		if a.ID == "" {
+			return album{}, errors.New("album record has no id")
+		}
+		return a, nil
+	}
+}
+
+func postCatalogImport(w http.ResponseWriter, r *http.Request) {
+	mode := importMode(r.URL.Query().Get("mode"))
+	if mode != importReplace && mode != importMerge {
+		writeProblem(w, r, http.StatusBadRequest, `mode must be "replace" or "merge"`)
+		log.Println("📉 Bad request: unknown import mode", mode)
+		return
+	}
+	importer, ok := albumStore.(AlbumImporter)
+	if !ok {
+		writeProblem(w, r, http.StatusNotImplemented, errImportUnsupported.Error())
+		log.Println("🚧 Import requested but the album store can't import")
+		return
+	}
+
+	body := bufio.NewReader(r.Body)
+	ndjson := strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-ndjson")
+	if magic, _ := body.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, err.Error())
+			log.Println("📉 Bad request:", err)
+			return
+		}
+		defer gz.Close()
+		body = bufio.NewReader(gz)
+		ndjson = true
+	}
+
+	catalog, err := spoolCatalog(body, ndjson)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "invalid backup: "+err.Error())
+		log.Println("📉 Rejected backup:", err)
+		return
+	}
+	defer catalog.Close()
+
+	n, err := importer.Import(r.Context(), mode, catalog.next())
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	albumsChanged()
+	recordAudit(auditCatalogImported, "", principalAdmin, map[string]interface{}{"mode": mode, "albums": n})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"mode": mode, "imported": n})
+	log.Printf("💾 Imported %d albums (%s)", n, mode)
+}
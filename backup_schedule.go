@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	defaultBackupRetention = 30 * 24 * time.Hour
+
+	backupJobName = "backup"
+
+	// backupStampLayout timestamps backup names, like the file names of
+	// GET /admin/export.
+	backupStampLayout = "20060102-150405"
+)
+
+// totalBackupFailures counts scheduled backups that failed, including ones
+// that were written but whose expired predecessors couldn't be pruned.
+var totalBackupFailures int64
+
+var errNoBackupTarget = errors.New("scheduled backups are not configured; set BACKUP_SCHEDULE")
+
+// backupObject is a stored backup, as listed by GET /admin/backups.
+type backupObject struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// backupName names the backup taken at t.
+func backupName(t time.Time) string {
+	return "catalog-" + t.UTC().Format(backupStampLayout) + ".ndjson.gz"
+}
+
+// parseBackupName returns when the backup called name was taken. Other
+// objects alongside the backups aren't ours, so they are never listed or
+// pruned.
+func parseBackupName(name string) (time.Time, bool) {
+	stamp, ok := strings.CutPrefix(name, "catalog-")
+	if !ok {
+		return time.Time{}, false
+	}
+	stamp, ok = strings.CutSuffix(stamp, ".ndjson.gz")
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(backupStampLayout, stamp)
+	return t, err == nil
+}
+
+// BackupTarget stores the scheduled backups. List returns only the objects
+// parseBackupName recognizes, in any order.
+type BackupTarget interface {
+	PutBackup(ctx context.Context, name string, data []byte) error
+	ListBackups(ctx context.Context) ([]backupObject, error)
+	DeleteBackup(ctx context.Context, name string) error
+}
+
+// dirBackupTarget keeps backups as files in a local directory, for
+// deployments without S3.
+type dirBackupTarget struct {
+	dir string
+}
+
+func (t dirBackupTarget) PutBackup(ctx context.Context, name string, data []byte) error {
+	// Written under a temporary name and renamed, so a crash mid-write
+	// never leaves a truncated file that looks like a backup.
+	tmp := filepath.Join(t.dir, "."+name+".tmp")
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(t.dir, name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (t dirBackupTarget) ListBackups(ctx context.Context) ([]backupObject, error) {
+	entries, err := os.ReadDir(t.dir)
+	if err != nil {
+		return nil, err
+	}
+	var backups []backupObject
+	for _, e := range entries {
+		created, ok := parseBackupName(e.Name())
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, backupObject{Name: e.Name(), Size: info.Size(), CreatedAt: created})
+	}
+	return backups, nil
+}
+
+func (t dirBackupTarget) DeleteBackup(ctx context.Context, name string) error {
+	return os.Remove(filepath.Join(t.dir, name))
+}
+
+// s3BackupTarget keeps backups as objects in an S3 bucket, each key being
+// prefix followed by the backup's name.
+type s3BackupTarget struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func (t s3BackupTarget) PutBackup(ctx context.Context, name string, data []byte) error {
+	_, err := t.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(t.bucket),
+		Key:         aws.String(t.prefix + name),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/gzip"),
+	})
+	return err
+}
+
+func (t s3BackupTarget) ListBackups(ctx context.Context) ([]backupObject, error) {
+	var backups []backupObject
+	pages := s3.NewListObjectsV2Paginator(t.client, &s3.ListObjectsV2Input{Bucket: aws.String(t.bucket), Prefix: aws.String(t.prefix)})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range page.Contents {
+			name := strings.TrimPrefix(aws.ToString(obj.Key), t.prefix)
+			created, ok := parseBackupName(name)
+			if !ok {
+				continue
+			}
+			backups = append(backups, backupObject{Name: name, Size: aws.ToInt64(obj.Size), CreatedAt: created})
+		}
+	}
+	return backups, nil
+}
+
+func (t s3BackupTarget) DeleteBackup(ctx context.Context, name string) error {
+	_, err := t.client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(t.bucket), Key: aws.String(t.prefix + name)})
+	return err
+}
+
+// newS3BackupTarget builds an S3 client for AWS_REGION from the default AWS
+// credential chain. BACKUP_S3_ENDPOINT points it at MinIO or another
+// S3-compatible service, using path-style addressing.
+func newS3BackupTarget(cfg *Config) (BackupTarget, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	awsConfig, err := config.LoadDefaultConfig(ctx, config.WithRegion(cfg.AWSRegion))
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS config: %w", err)
+	}
+	client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		if cfg.BackupS3Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.BackupS3Endpoint)
+			o.UsePathStyle = true
+		}
+	})
+	return s3BackupTarget{client: client, bucket: cfg.BackupS3Bucket, prefix: cfg.BackupS3Prefix}, nil
+}
+
+// backupTarget is where the backup job writes, or nil when BACKUP_SCHEDULE
+// is unset.
+var backupTarget BackupTarget
+
+// runBackup writes a gzipped NDJSON export of the catalog to the target,
+// in the format POST /admin/import reads, then deletes the backups older
+// than BACKUP_RETENTION. The one just written is always kept.
+func runBackup(ctx context.Context) error {
+	err := backupCatalog(ctx, backupTarget)
+	if err != nil {
+		atomic.AddInt64(&totalBackupFailures, 1)
+	}
+	return err
+}
+
+func backupCatalog(ctx context.Context, target BackupTarget) error {
+	// Like an export, a backup must not silently contain stale data, which
+	// Iterate never returns.
+	manifest := catalogManifest{SchemaVersion: catalogSchemaVersion, ExportedAt: serverClock.Now().UTC()}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	n, err := writeCatalog(ctx, gz, "ndjson", manifest, func(fn func(album) error) error {
+		return albumStore.Iterate(ctx, ListOptions{}, fn)
+	})
+	if err != nil {
+		return fmt.Errorf("listing albums: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	name := backupName(manifest.ExportedAt)
+	if err := target.PutBackup(ctx, name, buf.Bytes()); err != nil {
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+	log.Printf("💾 Backed up %d albums to %s (%d bytes)", n, name, buf.Len())
+
+	retention := currentConfig().BackupRetention
+	if retention == 0 {
+		return nil
+	}
+	backups, err := target.ListBackups(ctx)
+	if err != nil {
+		return fmt.Errorf("pruning old backups: %w", err)
+	}
+	cutoff := manifest.ExportedAt.Add(-retention)
+	for _, b := range backups {
+		if b.Name == name || !b.CreatedAt.Before(cutoff) {
+			continue
+		}
+		if err := target.DeleteBackup(ctx, b.Name); err != nil {
+			return fmt.Errorf("pruning old backups: %w", err)
+		}
+		log.Printf("🧹 Deleted backup %s, older than %s", b.Name, retention)
+	}
+	return nil
+}
+
+// getBackups lists the stored backups, newest first.
+func getBackups(w http.ResponseWriter, r *http.Request) {
+	if backupTarget == nil {
+		writeProblem(w, r, http.StatusNotFound, errNoBackupTarget.Error())
+		log.Println("❌ Backups listed without BACKUP_SCHEDULE")
+		return
+	}
+	backups, err := backupTarget.ListBackups(r.Context())
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].CreatedAt.After(backups[j].CreatedAt) })
+	if backups == nil {
+		backups = []backupObject{}
+	}
+	writeJSON(w, http.StatusOK, backups)
+}
+
+// parseBackupSchedule reads BACKUP_SCHEDULE: an interval like 24h, or a
+// cron expression like "30 2 * * *" for 02:30 UTC every day.
+func parseBackupSchedule(spec string) (time.Duration, *cronSchedule, error) {
+	if d, err := time.ParseDuration(spec); err == nil {
+		if d <= 0 {
+			return 0, nil, fmt.Errorf("%q is not a positive interval", spec)
+		}
+		return d, nil, nil
+	}
+	cron, err := parseCronSchedule(spec)
+	return 0, cron, err
+}
+
+// setupBackups registers the backup job when BACKUP_SCHEDULE is set, writing
+// to BACKUP_S3_BUCKET or else BACKUP_DIR. validate has already checked the
+// schedule and that exactly one target is set.
+func setupBackups(cfg *Config) {
+	if cfg.BackupSchedule == "" {
+		return
+	}
+	if cfg.BackupS3Bucket != "" {
+		target, err := newS3BackupTarget(cfg)
+		if err != nil {
+			log.Fatalf("Failed to set up backups: %v", err)
+		}
+		backupTarget = target
+	} else {
+		if err := os.MkdirAll(cfg.BackupDir, 0o700); err != nil {
+			log.Fatalf("Failed to set up backups: %v", err)
+		}
+		backupTarget = dirBackupTarget{dir: cfg.BackupDir}
+	}
+	interval, cron, _ := parseBackupSchedule(cfg.BackupSchedule)
+	if cron != nil {
+		scheduler.registerCron(backupJobName, cron, runBackup)
+	} else {
+		scheduler.register(backupJobName, interval, runBackup)
+	}
+	log.Printf("💾 Backups scheduled for %s", cfg.BackupSchedule)
+}
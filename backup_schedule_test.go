@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// fakeBucket is an in-memory BackupTarget standing in for S3, failing every
+// write with putErr when it is set.
+type fakeBucket struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	putErr  error
+}
+
+func newFakeBucket() *fakeBucket {
+	return &fakeBucket{objects: make(map[string][]byte)}
+}
+
+func (b *fakeBucket) PutBackup(ctx context.Context, name string, data []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.putErr != nil {
+		return b.putErr
+	}
+	b.objects[name] = data
+	return nil
+}
+
+func (b *fakeBucket) ListBackups(ctx context.Context) ([]backupObject, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var backups []backupObject
+	for name, data := range b.objects {
+		if created, ok := parseBackupName(name); ok {
+			backups = append(backups, backupObject{Name: name, Size: int64(len(data)), CreatedAt: created})
+		}
+	}
+	return backups, nil
+}
+
+func (b *fakeBucket) DeleteBackup(ctx context.Context, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.objects, name)
+	return nil
+}
+
+// useBackupTarget points the backup job at target until t ends.
+func useBackupTarget(t *testing.T, target BackupTarget) {
+	previous := backupTarget
+	t.Cleanup(func() { backupTarget = previous })
+	backupTarget = target
+}
+
+func TestScheduledBackup(t *testing.T) {
+	s := newTestServer(t)
+	bucket := newFakeBucket()
+	useBackupTarget(t, bucket)
+	s.create(newTestAlbum())
+	s.create(newTestAlbum(withTitle("Giant Steps"), withPrice(1999)))
+	want := catalogJSON(t, s.albums)
+
+	expired, kept := backupName(testStart.Add(-defaultBackupRetention-time.Hour)), backupName(testStart.Add(-time.Hour))
+	bucket.objects[expired] = []byte("old")
+	bucket.objects[kept] = []byte("recent")
+	bucket.objects["notes.txt"] = []byte("not a backup")
+
+	if err := runBackup(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	name := backupName(testStart)
+	backup, ok := bucket.objects[name]
+	if !ok {
+		t.Fatalf("objects %v, want %s", bucket.objects, name)
+	}
+	// Backups older than BACKUP_RETENTION go; anything not named like one
+	// is left alone.
+	for _, n := range []string{kept, "notes.txt"} {
+		if _, ok := bucket.objects[n]; !ok {
+			t.Errorf("%s was deleted", n)
+		}
+	}
+	if _, ok := bucket.objects[expired]; ok {
+		t.Errorf("%s, past the retention, was kept", expired)
+	}
+
+	backups := decodeBody[[]backupObject](t, s.admin(http.MethodGet, "/admin/backups", ""))
+	if len(backups) != 2 || backups[0].Name != name || backups[0].Size != int64(len(backup)) || !backups[0].CreatedAt.Equal(testStart) || backups[1].Name != kept {
+		t.Errorf("GET /admin/backups = %+v, want the new backup with its size, then %s", backups, kept)
+	}
+
+	// The backup restores with POST /admin/import.
+	s = newTestServer(t)
+	expectStatus(t, s.admin(http.MethodPost, "/admin/import?mode=replace", string(backup)), http.StatusOK)
+	if got := catalogJSON(t, s.albums); got != want {
+		t.Errorf("restored catalog differs:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestScheduledBackupFailure(t *testing.T) {
+	s := newTestServer(t)
+	bucket := newFakeBucket()
+	bucket.putErr = errors.New("access denied")
+	useBackupTarget(t, bucket)
+	logs := captureLog(t)
+	before := atomic.LoadInt64(&totalBackupFailures)
+
+	previous := scheduler
+	t.Cleanup(func() { scheduler = previous })
+	scheduler = newJobScheduler(s.clock)
+	scheduler.register(backupJobName, 24*time.Hour, runBackup)
+	startTestScheduler(t, scheduler)
+	s.clock.Advance(24 * time.Hour)
+	status := waitForRuns(t, scheduler, backupJobName, 1)
+	if status.Failures != 1 || status.LastError != "writing "+backupName(testStart.Add(24*time.Hour))+": access denied" {
+		t.Errorf("backup job = %+v, want the failed write", status)
+	}
+	if got := logs.take(); !strings.Contains(got, "Job backup failed") || !strings.Contains(got, "access denied") {
+		t.Errorf("logged %q, want the failure", got)
+	}
+	if n := atomic.LoadInt64(&totalBackupFailures) - before; n != 1 {
+		t.Errorf("counted %d failures, want 1", n)
+	}
+	report := decodeBody[types.MetricsReport](t, s.do(http.MethodGet, "/metrics", ""))
+	if report.TotalBackupFailures != atomic.LoadInt64(&totalBackupFailures) {
+		t.Errorf("/metrics totalBackupFailures = %d", report.TotalBackupFailures)
+	}
+}
+
+func TestDirBackupTarget(t *testing.T) {
+	dir := t.TempDir()
+	target := dirBackupTarget{dir: dir}
+	ctx := context.Background()
+	name := backupName(testStart)
+	if err := target.PutBackup(ctx, name, []byte("catalog")); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "README"), []byte("not a backup"), 0o600)
+
+	backups, err := target.ListBackups(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || backups[0].Name != name || backups[0].Size != 7 || !backups[0].CreatedAt.Equal(testStart) {
+		t.Errorf("backups = %+v, want just %s", backups, name)
+	}
+	if err := target.DeleteBackup(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	if backups, _ := target.ListBackups(ctx); len(backups) != 0 {
+		t.Errorf("backups after the delete = %+v", backups)
+	}
+}
+
+func TestBackupsWithoutSchedule(t *testing.T) {
+	s := newTestServer(t)
+	useBackupTarget(t, nil)
+	expectProblem(t, s.admin(http.MethodGet, "/admin/backups", ""), http.StatusNotFound)
+}
+
+func TestParseBackupSchedule(t *testing.T) {
+	if d, cron, err := parseBackupSchedule("24h"); d != 24*time.Hour || cron != nil || err != nil {
+		t.Errorf("24h = %s, %v, %v", d, cron, err)
+	}
+	if d, cron, err := parseBackupSchedule("30 2 * * *"); d != 0 || cron == nil || err != nil {
+		t.Errorf("30 2 * * * = %s, %v, %v", d, cron, err)
+	}
+	for _, bad := range []string{"-1h", "0s", "nightly", "61 * * * *"} {
+		if _, _, err := parseBackupSchedule(bad); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// catalogJSON is every album in store, in order, as JSON.
+func catalogJSON(t *testing.T, store AlbumStore) string {
+	t.Helper()
+	list, err := listAll(context.Background(), store, AlbumFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCatalogRoundTrip(t *testing.T) {
+	for _, format := range []string{"json", "ndjson"} {
+		t.Run(format, func(t *testing.T) {
+			s := newTestServer(t)
+			s.create(newTestAlbum(withBarcode("036000291452"), func(a *album) { a.Tracks = []string{"Blue Train", "Lazy Bird"} }))
+			s.create(newTestAlbum())
+			s.create(newTestAlbum(withTitle("Giant Steps"), withPrice(1999)))
+			want := catalogJSON(t, s.albums)
+
+			w := s.admin(http.MethodGet, "/admin/export?format="+format, "")
+			expectStatus(t, w, http.StatusOK)
+			backup := w.Body.Bytes()
+			if format == "ndjson" {
+				if w.Header().Get("Content-Type") != "application/gzip" {
+					t.Errorf("Content-Type = %q", w.Header().Get("Content-Type"))
+				}
+				if _, err := gzip.NewReader(bytes.NewReader(backup)); err != nil {
+					t.Fatalf("the backup isn't gzipped: %v", err)
+				}
+			}
+
+			// Wipe the catalog by starting over, then restore it.
+			s = newTestServer(t)
+			s.create(newTestAlbum(withTitle("Overwritten")))
+			w = s.admin(http.MethodPost, "/admin/import?mode=replace", string(backup))
+			expectStatus(t, w, http.StatusOK)
+			if got := decodeBody[map[string]any](t, w); got["imported"] != 3.0 {
+				t.Errorf("import = %v, want 3 albums", got)
+			}
+			if got := catalogJSON(t, s.albums); got != want {
+				t.Errorf("restored catalog differs:\n got %s\nwant %s", got, want)
+			}
+			// The indexes were rebuilt along with the albums.
+			expectStatus(t, s.do(http.MethodGet, "/albums/by-barcode/036000291452", ""), http.StatusOK)
+			expectStatus(t, s.do(http.MethodGet, "/albums/by-slug/blue-train-john-coltrane-2", ""), http.StatusOK)
+		})
+	}
+}
+
+func TestCatalogImportRejectsBadBackups(t *testing.T) {
+	s := newTestServer(t)
+	s.create(newTestAlbum())
+	backup := s.admin(http.MethodGet, "/admin/export", "").Body.String()
+
+	other := newTestServer(t)
+	kept := other.create(newTestAlbum(withTitle("Kept")))
+	before := catalogJSON(t, other.albums)
+	for name, body := range map[string]string{
+		"tampered":     strings.Replace(backup, "Blue Train", "Red Train", 1),
+		"truncated":    backup[:len(backup)/2],
+		"no manifest":  `{"albums": []}`,
+		"wrong schema": strings.Replace(backup, `"schemaVersion":1`, `"schemaVersion":99`, 1),
+	} {
+		t.Run(name, func(t *testing.T) {
+			expectProblem(t, other.admin(http.MethodPost, "/admin/import?mode=replace", body), http.StatusBadRequest)
+			if got := catalogJSON(t, other.albums); got != before {
+				t.Errorf("a rejected backup changed the catalog: %s", got)
+			}
+		})
+	}
+	expectStatus(t, other.do(http.MethodGet, "/albums/"+kept.ID, ""), http.StatusOK)
+}
+
+func TestCatalogImportMerge(t *testing.T) {
+	s := newTestServer(t)
+	a := s.create(newTestAlbum())
+	backup := s.admin(http.MethodGet, "/admin/export?format=ndjson", "").Body.Bytes()
+
+	s = newTestServer(t)
+	b := s.create(newTestAlbum(withTitle("Giant Steps")))
+	expectStatus(t, s.admin(http.MethodPost, "/admin/import?mode=merge", string(backup)), http.StatusOK)
+	for _, id := range []string{a.ID, b.ID} {
+		expectStatus(t, s.do(http.MethodGet, "/albums/"+id, ""), http.StatusOK)
+	}
+}
+
+func TestNDJSONCatalogRecords(t *testing.T) {
+	s := newTestServer(t)
+	s.create(newTestAlbum())
+	zr, err := gzip.NewReader(bytes.NewReader(s.admin(http.MethodGet, "/admin/export?format=ndjson", "").Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := io.ReadAll(zr)
+	var kinds []string
+	for _, line := range strings.Split(strings.TrimSpace(string(raw)), "\n") {
+		var rec ndjsonRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatal(err)
+		}
+		kinds = append(kinds, rec.Type)
+	}
+	if strings.Join(kinds, ",") != "manifest,album,checksum" {
+		t.Errorf("records = %v", kinds)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+var (
+	errInvalidBarcode = newCategorizedError(errValidation, "barcode must be a 12-digit UPC-A or 13-digit EAN-13 code with a valid check digit")
+	errBarcodeTaken   = newCategorizedError(errConflict, "barcode is already assigned to another album")
+)
+
+// validBarcode reports whether code is a UPC-A (12 digits) or EAN-13
+// (13 digits) barcode whose final digit is the correct GS1 check digit.
+func validBarcode(code string) bool {
+	if len(code) != 12 && len(code) != 13 {
+		return false
+	}
+	sum := 0
+	for i := len(code) - 2; i >= 0; i-- {
+		c := code[i]
+		if c < '0' || c > '9' {
+			return false
+		}
+		digit := int(c - '0')
+		// Weights alternate 3, 1, 3, ... moving left from the check digit.
+		if (len(code)-2-i)%2 == 0 {
+			digit *= 3
+		}
+		sum += digit
+	}
+	check := code[len(code)-1]
+	if check < '0' || check > '9' {
+		return false
+	}
+	return (10-sum%10)%10 == int(check-'0')
+}
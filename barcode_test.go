@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestValidBarcode(t *testing.T) {
+	for _, tc := range []struct {
+		code string
+		want bool
+	}{
+		{"036000291452", true},  // UPC-A
+		{"012345678905", true},  // UPC-A
+		{"036000291453", false}, // UPC-A, wrong check digit
+		{"4006381333931", true}, // EAN-13
+		{"9780306406157", true}, // EAN-13, an ISBN
+		{"9780306406158", false},
+		{"0036000291452", true}, // a UPC-A written as EAN-13
+		{"03600029145", false},
+		{"03600029145200", false},
+		{"03600029145a", false},
+		{"03600029145 2", false},
+		{"", false},
+	} {
+		if got := validBarcode(tc.code); got != tc.want {
+			t.Errorf("validBarcode(%q) = %v, want %v", tc.code, got, tc.want)
+		}
+	}
+}
+
+func TestBarcodeLookup(t *testing.T) {
+	s := newTestServer(t)
+	a := s.create(newTestAlbum(withBarcode("4006381333931")))
+	got := decodeBody[album](t, s.do(http.MethodGet, "/albums/by-barcode/4006381333931", ""))
+	if got.ID != a.ID {
+		t.Errorf("by-barcode found %s, want %s", got.ID, a.ID)
+	}
+	expectProblem(t, s.do(http.MethodPost, "/albums", albumJSON(newTestAlbum(withBarcode("4006381333931")))), http.StatusConflict)
+}
+
+// TestBarcodeUniqueUnderConcurrency creates albums with the same barcode
+// all at once, straight on the store, so only the store's own check can
+// keep all but one out.
+func TestBarcodeUniqueUnderConcurrency(t *testing.T) {
+	store := NewInMemoryAlbumStore()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	created, taken := 0, 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.Create(context.Background(), newTestAlbum(withID(newAlbumID()), withBarcode("036000291452")))
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				created++
+			case errors.Is(err, errBarcodeTaken):
+				taken++
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if created != 1 || taken != 49 {
+		t.Errorf("%d created and %d turned away, want 1 and 49", created, taken)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// maxBatchAlbums caps the albums in one batch request; larger catalogs go
+// through /admin/import.
+const maxBatchAlbums = 500
+
+// albumBatchInput is one element of a PUT /albums batch.
+type albumBatchInput struct {
+	ID string `json:"id"`
+	albumInput
+}
+
+// isJSONArray reports whether a decoded value is an array. The decoder
+// strips surrounding whitespace, so the first byte decides.
+func isJSONArray(body json.RawMessage) bool {
+	return len(body) > 0 && body[0] == '['
+}
+
+// checkBatchSize reports a batch that is empty or too large.
+func checkBatchSize(n int) error {
+	if n == 0 {
+		return fmt.Errorf("the batch is empty")
+	}
+	if n > maxBatchAlbums {
+		return fmt.Errorf("a batch holds at most %d albums", maxBatchAlbums)
+	}
+	return nil
+}
+
+// postAlbumsBatch creates every album in body, or none of them.
+func postAlbumsBatch(w http.ResponseWriter, r *http.Request, body json.RawMessage) {
+	var inputs []albumInput
+	if err := json.Unmarshal(body, &inputs); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	if err := checkBatchSize(len(inputs)); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	albums := make([]album, len(inputs))
+	for i, in := range inputs {
+		if err := in.validate(); err != nil {
+			respondError(w, r, fmt.Errorf("album %d: %w", i, err))
+			return
+		}
+		albums[i] = in.album(newAlbumID())
+	}
+
+	ctx := withCatalogLimit(withPrincipal(r.Context(), requestPrincipal(r)), currentConfig().CatalogMaxAlbums)
+	created, err := albumStore.CreateMany(ctx, albums)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	albumsChanged()
+	for _, a := range created {
+		atomic.AddInt64(&metrics.TotalAlbumsAdded, 1)
+		recordAudit(auditAlbumCreated, a.ID, requestPrincipal(r), nil)
+		if enrichmentEnabled() {
+			go enrichAlbum(a)
+		}
+	}
+	writeJSON(w, http.StatusCreated, created)
+	log.Printf("✨ %d new albums added", len(created))
+}
+
+// putAlbumsBatch updates every album in the body, each identified by its
+// id, or none of them.
+func putAlbumsBatch(w http.ResponseWriter, r *http.Request) {
+	var inputs []albumBatchInput
+	if err := decodeAlbumJSON(r.Body, &inputs); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	if err := checkBatchSize(len(inputs)); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	albums := make([]album, len(inputs))
+	for i, in := range inputs {
+		if in.ID == "" {
+			writeProblem(w, r, http.StatusBadRequest, localize(r, "album %d has no id", i))
+			log.Printf("📉 Bad request: album %d has no id", i)
+			return
+		}
+		if err := in.validate(); err != nil {
+			respondError(w, r, fmt.Errorf("album %s: %w", in.ID, err))
+			return
+		}
+		albums[i] = in.album(in.ID)
+	}
+
+	regenerateSlug := r.URL.Query().Get("regenerateSlug") == "true"
+	updated, err := albumStore.UpdateMany(withPrincipal(r.Context(), requestPrincipal(r)), albums, regenerateSlug)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	albumsChanged()
+	for _, a := range updated {
+		recordAudit(auditAlbumUpdated, a.ID, requestPrincipal(r), nil)
+	}
+	writeJSON(w, http.StatusOK, updated)
+	log.Printf("📝 %d albums updated", len(updated))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBatchesAreAllOrNothing(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	taken := s.create(newTestAlbum(withBarcode("036000291452")))
+
+	// A taken barcode halfway through the batch fails all of it.
+	inputs := make([]string, 10)
+	for i := range inputs {
+		a := newTestAlbum(withTitle(fmt.Sprintf("Giant Steps %d", i)))
+		if i == 5 {
+			a.Barcode = taken.Barcode
+		}
+		inputs[i] = albumJSON(a)
+	}
+	expectProblem(t, s.do(http.MethodPost, "/albums", "["+strings.Join(inputs, ",")+"]"), http.StatusConflict)
+	if page, _ := s.albums.List(ctx, ListOptions{}); len(page.Albums) != 1 {
+		t.Errorf("%d albums after a failed batch, want only the first", len(page.Albums))
+	}
+
+	// So does an album that isn't there.
+	body := fmt.Sprintf(`[{"id": %q, "title": "Lush Life", "artist": "John Coltrane", "price": 39.99, "genre": "Jazz", "year": 1958},
+		{"id": "missing", "title": "Ballads", "artist": "John Coltrane", "price": 39.99, "genre": "Jazz", "year": 1963}]`, taken.ID)
+	expectProblem(t, s.do(http.MethodPut, "/albums", body), http.StatusNotFound)
+	if a, _ := s.albums.GetByID(ctx, taken.ID); a.Title != taken.Title {
+		t.Errorf("a failed batch renamed the album to %q", a.Title)
+	}
+}
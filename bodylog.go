@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLogBodyMaxBytes = 4096
+	defaultLogRedactFields = "password,token,secret,apiKey,authorization"
+
+	// bodyLogHeader carries a token from POST /admin/body-logging/tokens to
+	// have one client's bodies logged while LOG_REQUEST_BODIES is off.
+	bodyLogHeader = "X-Log-Body"
+
+	maxBodyLogTokenTTL = 24 * time.Hour
+)
+
+// cappedBuffer keeps the first max bytes written to it and counts the rest,
+// so capturing a body costs at most max bytes however large it is.
+type cappedBuffer struct {
+	buf     bytes.Buffer
+	max     int
+	dropped int64
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.buf.Len(); room < len(p) {
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		b.dropped += int64(len(p) - max(room, 0))
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// teeBody hands the handler the request body as it is while copying what it
+// reads into a cappedBuffer.
+type teeBody struct {
+	io.Reader
+	io.Closer
+}
+
+// bodyCaptureWriter copies an error response's body into a cappedBuffer;
+// bodies of successful responses are passed through untouched.
+type bodyCaptureWriter struct {
+	http.ResponseWriter
+	status  int
+	capture *cappedBuffer
+}
+
+func (w *bodyCaptureWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *bodyCaptureWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.status >= 400 {
+		w.capture.Write(p)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// bodyLoggingMiddleware logs the bodies of mutating requests, and of the
+// responses to them that are errors, up to LOG_BODY_MAX_BYTES each and with
+// the LOG_REDACT_FIELDS fields masked. It is off unless LOG_REQUEST_BODIES is
+// set, or the request carries a live X-Log-Body token.
+func bodyLoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+		cfg := currentConfig()
+		if !cfg.LogRequestBodies && !bodyLogTokens.valid(r.Header.Get(bodyLogHeader)) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		redact := redactFields(cfg.LogRedactFields)
+		reqBody := &cappedBuffer{max: cfg.LogBodyMaxBytes}
+		r.Body = teeBody{Reader: io.TeeReader(r.Body, reqBody), Closer: r.Body}
+		cw := &bodyCaptureWriter{ResponseWriter: w, capture: &cappedBuffer{max: cfg.LogBodyMaxBytes}}
+		next.ServeHTTP(cw, r)
+
+		log.Printf("🔎 %s %s request body: %s", r.Method, r.URL.Path, describeBody(reqBody, redact))
+		if cw.status >= 400 {
+			log.Printf("🔎 %s %s -> %d response body: %s", r.Method, r.URL.Path, cw.status, describeBody(cw.capture, redact))
+		}
+	})
+}
+
+// describeBody renders a captured body for the log, redacted, noting how
+// much was cut off.
+func describeBody(b *cappedBuffer, redact map[string]bool) string {
+	if b.buf.Len() == 0 && b.dropped == 0 {
+		return "(empty)"
+	}
+	s := redactBody(b.buf.Bytes(), redact)
+	if b.dropped > 0 {
+		s += " …(" + strconv.FormatInt(b.dropped, 10) + " more bytes)"
+	}
+	return s
+}
+
+func mustJSON(v interface{}) []byte {
+	data, _ := json.Marshal(v)
+	return data
+}
+
+// redactFields parses LOG_REDACT_FIELDS into a set of lowercased names.
+func redactFields(list string) map[string]bool {
+	fields := map[string]bool{}
+	for _, f := range strings.Split(list, ",") {
+		if f = strings.ToLower(strings.TrimSpace(f)); f != "" {
+			fields[f] = true
+		}
+	}
+	return fields
+}
+
+// jsonStringField matches a "name": "value" pair, for masking fields in a
+// body that was cut off and no longer parses.
+var jsonStringField = regexp.MustCompile(`"([^"\\]+)"\s*:\s*"(?:[^"\\]|\\.)*"?`)
+
+// redactBody masks the values of the named fields in a JSON body, at any
+// depth and matched case-insensitively. A body that isn't JSON is logged as
+// it is, after masking anything that looks like one of the fields.
+func redactBody(body []byte, fields map[string]bool) string {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err == nil {
+		return string(mustJSON(redactValue(v, fields)))
+	}
+	return jsonStringField.ReplaceAllStringFunc(string(body), func(pair string) string {
+		name := jsonStringField.FindStringSubmatch(pair)[1]
+		if !fields[strings.ToLower(name)] {
+			return pair
+		}
+		return `"` + name + `": "[REDACTED]"`
+	})
+}
+
+func redactValue(v interface{}, fields map[string]bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if fields[strings.ToLower(k)] {
+				v[k] = "[REDACTED]"
+			} else {
+				v[k] = redactValue(child, fields)
+			}
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = redactValue(child, fields)
+		}
+	}
+	return v
+}
+
+// bodyLogTokenSet holds the tokens issued by the admin endpoint until they
+// expire.
+type bodyLogTokenSet struct {
+	mu     sync.Mutex
+	tokens map[string]time.Time
+}
+
+var bodyLogTokens = &bodyLogTokenSet{tokens: map[string]time.Time{}}
+
+func (s *bodyLogTokenSet) issue(ttl time.Duration) (string, time.Time) {
+	raw := make([]byte, 16)
+	rand.Read(raw)
+	token := hex.EncodeToString(raw)
+	expires := time.Now().Add(ttl)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for t, exp := range s.tokens {
+		if now.After(exp) {
+			delete(s.tokens, t)
+		}
+	}
+	s.tokens[token] = expires
+	return token, expires
+}
+
+func (s *bodyLogTokenSet) valid(token string) bool {
+	if token == "" {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for t, exp := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return time.Now().Before(exp)
+		}
+	}
+	return false
+}
+
+// postBodyLogToken issues a token that turns on body logging for the
+// requests carrying it in X-Log-Body, for the ttl in a body like
+// {"ttl": "15m"} (15 minutes by default, at most a day).
+func postBodyLogToken(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		TTL string `json:"ttl"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && err != io.EOF {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	ttl := 15 * time.Minute
+	if body.TTL != "" {
+		parsed, err := time.ParseDuration(body.TTL)
+		if err != nil || parsed <= 0 || parsed > maxBodyLogTokenTTL {
+			writeProblem(w, r, http.StatusBadRequest, "ttl must be a duration between 0 and 24h, like \"15m\"")
+			log.Println("📉 Bad request: invalid body logging ttl", body.TTL)
+			return
+		}
+		ttl = parsed
+	}
+	token, expires := bodyLogTokens.issue(ttl)
+	recordAudit(auditBodyLogTokenIssued, "", principalAdmin, map[string]interface{}{"ttl": ttl.String()})
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"header": bodyLogHeader, "token": token, "expiresAt": expires.UTC()})
+	log.Printf("🔎 Issued a body logging token valid for %s", ttl)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCappedBuffer(t *testing.T) {
+	b := &cappedBuffer{max: 5}
+	for _, p := range []string{"abc", "defg", "hij"} {
+		if n, err := b.Write([]byte(p)); n != len(p) || err != nil {
+			t.Errorf("Write(%q) = %d, %v", p, n, err)
+		}
+	}
+	if b.buf.String() != "abcde" || b.dropped != 5 {
+		t.Errorf("kept %q and dropped %d, want abcde and 5", b.buf.String(), b.dropped)
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	fields := redactFields(" password, apiKey ,,")
+	for body, want := range map[string]string{
+		`{"user": "ann", "Password": "hunter2"}`:     `{"Password":"[REDACTED]","user":"ann"}`,
+		`{"keys": [{"apikey": "k1", "name": "ci"}]}`: `{"keys":[{"apikey":"[REDACTED]","name":"ci"}]}`,
+		`{"password": {"old": "a", "new": "b"}}`:     `{"password":"[REDACTED]"}`,
+		`{"user": "ann", "password": "hunt`:          `{"user": "ann", "password": "[REDACTED]"`,
+		`user=ann&password=hunter2`:                  `user=ann&password=hunter2`,
+	} {
+		if got := redactBody([]byte(body), fields); got != want {
+			t.Errorf("redactBody(%s) = %s, want %s", body, got, want)
+		}
+	}
+}
+
+func TestBodyLogging(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.LogBodyMaxBytes = 64 })
+	logs := captureLog(t)
+	var seen []byte
+	h := bodyLoggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = io.ReadAll(r.Body)
+		writeProblem(w, r, http.StatusBadRequest, "no such field: "+strings.Repeat("x", 100))
+	}))
+	send := func(method, body string, headers ...string) {
+		r := httptest.NewRequest(method, "/albums", strings.NewReader(body))
+		for i := 0; i+1 < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	}
+
+	// Off by default.
+	send(http.MethodPost, `{"title": "Blue Train"}`)
+	if got := logs.take(); got != "" {
+		t.Errorf("logged with LOG_REQUEST_BODIES off:\n%s", got)
+	}
+
+	on := *s.cfg
+	on.LogRequestBodies = true
+	liveConfig.Store(&on)
+	// A body larger than the cap reaches the handler whole, and only the
+	// first 64 bytes of it are logged.
+	large := `{"title": "Blue Train", "password": "hunter2", "notes": "` + strings.Repeat("n", 1000) + `"}`
+	send(http.MethodPost, large)
+	if string(seen) != large {
+		t.Errorf("the handler read %d bytes of the %d sent", len(seen), len(large))
+	}
+	got := logs.take()
+	if !strings.Contains(got, `"password": "[REDACTED]"`) || strings.Contains(got, "hunter2") {
+		t.Errorf("the password wasn't redacted:\n%s", got)
+	}
+	if !strings.Contains(got, "…("+strconv.Itoa(len(large)-64)+" more bytes)") || strings.Contains(got, strings.Repeat("n", 20)) {
+		t.Errorf("the request body wasn't cut at 64 bytes:\n%s", got)
+	}
+	if !strings.Contains(got, "-> 400 response body:") || !strings.Contains(got, "more bytes)") {
+		t.Errorf("the error response wasn't logged, cut off:\n%s", got)
+	}
+
+	// Reads are never logged.
+	send(http.MethodGet, "")
+	if got := logs.take(); got != "" {
+		t.Errorf("logged a GET:\n%s", got)
+	}
+}
+
+func TestBodyLoggingToken(t *testing.T) {
+	s := newTestServer(t)
+	logs := captureLog(t)
+
+	w := s.admin(http.MethodPost, "/admin/body-logging/tokens", `{"ttl": "5m"}`)
+	expectStatus(t, w, http.StatusCreated)
+	token := decodeBody[map[string]string](t, w)["token"]
+	expectProblem(t, s.admin(http.MethodPost, "/admin/body-logging/tokens", `{"ttl": "48h"}`), http.StatusBadRequest)
+	logs.take()
+
+	s.do(http.MethodPost, "/albums", albumJSON(newTestAlbum()), bodyLogHeader, "not-the-token")
+	if got := logs.take(); strings.Contains(got, "request body") {
+		t.Errorf("logged with a bad token:\n%s", got)
+	}
+	s.do(http.MethodPost, "/albums", albumJSON(newTestAlbum(withTitle("Lush Life"))), bodyLogHeader, token)
+	if got := logs.take(); !strings.Contains(got, "request body") || !bytes.Contains([]byte(got), []byte("Lush Life")) {
+		t.Errorf("didn't log with the token:\n%s", got)
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned without calling the store while its breaker is
+// open.
+var errCircuitOpen = newCategorizedError(errUnavailable, "store is unavailable, please retry later")
+
+// errStaleRead accompanies a result served from the last-known-good cache
+// while the store is unavailable. The result is usable; callers that accept
+// stale data should flag the response with acceptStale.
+var errStaleRead = newCategorizedError(errUnavailable, "served from cache while the store is unavailable")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops calling a failing store. After threshold consecutive
+// failures it opens and rejects calls for resetTimeout; then it lets a single
+// trial call through (half-open), closing again if it succeeds and reopening
+// if it fails.
+type circuitBreaker struct {
+	name         string
+	threshold    int
+	resetTimeout time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	trial    bool // a half-open trial call is in progress
+}
+
+func newCircuitBreaker(name string, threshold int, resetTimeout time.Duration) *circuitBreaker {
+	return &circuitBreaker{name: name, threshold: threshold, resetTimeout: resetTimeout}
+}
+
+// allow reports whether a call may go through now.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.resetTimeout {
+			return false
+		}
+		b.transition(breakerHalfOpen)
+		b.trial = true
+		return true
+	case breakerHalfOpen:
+		if b.trial {
+			return false
+		}
+		b.trial = true
+		return true
+	default:
+		return true
+	}
+}
+
+// record reports the outcome of a call that allow let through. Only store
+// failures count; domain errors like errAlbumNotFound mean the store is fine.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	if !isStoreFailure(err) {
+		b.failures = 0
+		if b.state != breakerClosed {
+			b.transition(breakerClosed)
+		}
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = time.Now()
+		if b.state != breakerOpen {
+			b.transition(breakerOpen)
+		}
+	}
+}
+
+// transition changes state; the caller holds mu.
+func (b *circuitBreaker) transition(to breakerState) {
+	log.Printf("🔌 %s store circuit breaker %s -> %s", b.name, b.state, to)
+	b.state = to
+}
+
+func (b *circuitBreaker) State() breakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// isStoreFailure reports whether err counts against the store's health.
+// Domain errors don't, and neither does a caller giving up: a client that
+// disconnects mid-query says nothing about the database. A store that hasn't
+// connected yet doesn't either; /readyz already reports it, and an open
+// breaker would keep rejecting calls after the connection comes up.
+func isStoreFailure(err error) bool {
+	var full *catalogFullError
+	switch {
+	case err == nil,
+		errors.Is(err, context.Canceled),
+		errors.Is(err, errStoreConnecting),
+		errors.Is(err, errNotFound),
+		errors.Is(err, errConflict),
+		errors.Is(err, errValidation),
+		errors.As(err, &full):
+		return false
+	}
+	return true
+}
+
+// storeBreakers holds every breaker in use, by store name, for /metrics and
+// /readyz.
+var storeBreakers = map[string]*circuitBreaker{}
+
+// setupCircuitBreaker returns a breaker configured from
+// BREAKER_FAILURE_THRESHOLD and BREAKER_RESET_TIMEOUT and registers it under
+// name.
+func setupCircuitBreaker(cfg *Config, name string) *circuitBreaker {
+	b := newCircuitBreaker(name, cfg.BreakerFailureThreshold, cfg.BreakerResetTimeout)
+	storeBreakers[name] = b
+	return b
+}
+
+func breakerStates() map[string]string {
+	states := make(map[string]string, len(storeBreakers))
+	for name, b := range storeBreakers {
+		states[name] = b.State().String()
+	}
+	return states
+}
+
+// acceptStale turns errStaleRead into success after flagging the response as
+// stale; any other error is returned unchanged.
+func acceptStale(w http.ResponseWriter, err error) error {
+	if !errors.Is(err, errStaleRead) {
+		return err
+	}
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+	w.Header().Set("X-Data-Stale", "true")
+	return nil
+}
+
+// BreakerMetricsStore guards a database-backed MetricsStore with a circuit
+// breaker so a dead database fails metrics persistence fast.
+type BreakerMetricsStore struct {
+	backend MetricsStore
+	breaker *circuitBreaker
+}
+
+func NewBreakerMetricsStore(store MetricsStore, breaker *circuitBreaker) *BreakerMetricsStore {
+	return &BreakerMetricsStore{backend: store, breaker: breaker}
+}
+
+func (store *BreakerMetricsStore) AddMetrics(ctx context.Context, delta Metrics) error {
+	if !store.breaker.allow() {
+		return errCircuitOpen
+	}
+	err := store.backend.AddMetrics(ctx, delta)
+	store.breaker.record(err)
+	return err
+}
+
+func (store *BreakerMetricsStore) LoadMetrics(ctx context.Context) (Metrics, error) {
+	if !store.breaker.allow() {
+		return Metrics{}, errCircuitOpen
+	}
+	m, err := store.backend.LoadMetrics(ctx)
+	store.breaker.record(err)
+	return m, err
+}
+
+func (store *BreakerMetricsStore) AddClientMetrics(ctx context.Context, deltas []ClientMetrics, keep int) error {
+	if !store.breaker.allow() {
+		return errCircuitOpen
+	}
+	err := store.backend.AddClientMetrics(ctx, deltas, keep)
+	store.breaker.record(err)
+	return err
+}
+
+func (store *BreakerMetricsStore) LoadClientMetrics(ctx context.Context) ([]ClientMetrics, error) {
+	if !store.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+	clients, err := store.backend.LoadClientMetrics(ctx)
+	store.breaker.record(err)
+	return clients, err
+}
+
+// guardStores puts circuit breakers in front of database-backed stores, with
+// album reads retried underneath so a call only counts against the breaker
+// once its retries are exhausted. DynamoDB's client retries on its own, and
+// the in-memory stores can't fail that way; neither gets RetryingAlbumStore.
+// Database-backed album stores are instrumented under it all, so /metrics
+// sees every attempt.
+func guardStores(cfg *Config, ms MetricsStore, as AlbumStore) (MetricsStore, AlbumStore) {
+	if _, ok := ms.(*InMemoryMetricsStore); !ok {
+		ms = NewBreakerMetricsStore(ms, setupCircuitBreaker(cfg, "metrics"))
+	}
+	switch as.(type) {
+	case *InMemoryAlbumStore:
+	case *DynamoAlbumStore:
+		as = NewBreakerAlbumStore(NewInstrumentedAlbumStore(as, cfg.DBType), setupCircuitBreaker(cfg, "albums"))
+	default:
+		as = NewBreakerAlbumStore(NewRetryingAlbumStore(NewInstrumentedAlbumStore(as, cfg.DBType), setupRetryPolicy(cfg)), setupCircuitBreaker(cfg, "albums"))
+	}
+	return ms, as
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// errConnectionRefused stands in for a database that has gone away.
+var errConnectionRefused = fmt.Errorf("dial tcp 127.0.0.1:5432: connect: %w", syscall.ECONNREFUSED)
+
+// faultyAlbumStore is an InMemoryAlbumStore whose reads, writes, and imports fail with
+// errConnectionRefused while failing is set, and for the first failFirst
+// calls made to it.
+type faultyAlbumStore struct {
+	*InMemoryAlbumStore
+	failing   atomic.Bool
+	failFirst atomic.Int32
+	calls     atomic.Int32
+}
+
+func newFaultyAlbumStore() *faultyAlbumStore {
+	return &faultyAlbumStore{InMemoryAlbumStore: NewInMemoryAlbumStore()}
+}
+
+func (s *faultyAlbumStore) fault() error {
+	if n := s.calls.Add(1); s.failing.Load() || n <= s.failFirst.Load() {
+		return errConnectionRefused
+	}
+	return nil
+}
+
+func (s *faultyAlbumStore) List(ctx context.Context, opts ListOptions) (albumPage, error) {
+	if err := s.fault(); err != nil {
+		return albumPage{}, err
+	}
+	return s.InMemoryAlbumStore.List(ctx, opts)
+}
+
+func (s *faultyAlbumStore) GetByID(ctx context.Context, id string) (album, error) {
+	if err := s.fault(); err != nil {
+		return album{}, err
+	}
+	return s.InMemoryAlbumStore.GetByID(ctx, id)
+}
+
+func (s *faultyAlbumStore) Create(ctx context.Context, a album) (album, error) {
+	if err := s.fault(); err != nil {
+		return album{}, err
+	}
+	return s.InMemoryAlbumStore.Create(ctx, a)
+}
+
+func (s *faultyAlbumStore) Update(ctx context.Context, a album, regenerateSlug bool) (album, error) {
+	if err := s.fault(); err != nil {
+		return album{}, err
+	}
+	return s.InMemoryAlbumStore.Update(ctx, a, regenerateSlug)
+}
+
+func (s *faultyAlbumStore) Import(ctx context.Context, mode importMode, next func() (album, error)) (int, error) {
+	if err := s.fault(); err != nil {
+		return 0, err
+	}
+	return s.InMemoryAlbumStore.Import(ctx, mode, next)
+}
+
+// expire makes an open breaker's reset timeout run out.
+func (b *circuitBreaker) expire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.openedAt = b.openedAt.Add(-b.resetTimeout)
+}
+
+func TestCircuitBreakerStateMachine(t *testing.T) {
+	b := newCircuitBreaker("test", 3, time.Minute)
+	expectState := func(want breakerState) {
+		t.Helper()
+		if got := b.State(); got != want {
+			t.Fatalf("state = %s, want %s", got, want)
+		}
+	}
+
+	// Failures short of the threshold, or broken by a success, keep it closed.
+	for i := 0; i < 2; i++ {
+		b.allow()
+		b.record(errConnectionRefused)
+	}
+	b.allow()
+	b.record(nil)
+	for i := 0; i < 2; i++ {
+		b.allow()
+		b.record(errConnectionRefused)
+	}
+	expectState(breakerClosed)
+
+	// Domain errors and callers giving up say nothing about the store.
+	for _, err := range []error{errAlbumNotFound, context.Canceled} {
+		b.allow()
+		b.record(err)
+	}
+	expectState(breakerClosed)
+
+	for i := 0; i < 3; i++ {
+		b.allow()
+		b.record(errConnectionRefused)
+	}
+	expectState(breakerOpen)
+	if b.allow() {
+		t.Fatal("an open breaker let a call through")
+	}
+
+	// Once the reset timeout is up, exactly one trial goes through.
+	b.expire()
+	if !b.allow() {
+		t.Fatal("the breaker allowed no trial after its reset timeout")
+	}
+	expectState(breakerHalfOpen)
+	if b.allow() {
+		t.Fatal("a half-open breaker let a second call through during its trial")
+	}
+	b.record(errConnectionRefused)
+	expectState(breakerOpen)
+	if b.allow() {
+		t.Fatal("a breaker reopened by a failed trial let a call through")
+	}
+
+	b.expire()
+	if !b.allow() {
+		t.Fatal("the breaker allowed no second trial")
+	}
+	b.record(nil)
+	expectState(breakerClosed)
+	if !b.allow() || !b.allow() {
+		t.Error("a closed breaker turned calls away")
+	}
+}
+
+func TestBreakerAlbumStore(t *testing.T) {
+	ctx := context.Background()
+	backend := newFaultyAlbumStore()
+	b := newCircuitBreaker("albums", 2, time.Minute)
+	store := NewBreakerAlbumStore(backend, b)
+
+	a, err := store.Create(ctx, newTestAlbum(withID(newAlbumID())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.GetByID(ctx, a.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.List(ctx, ListOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// While the database is down, reads are served stale until the
+	// breaker opens and keeps them away from it altogether.
+	backend.failing.Store(true)
+	for i := 0; i < 2; i++ {
+		got, err := store.GetByID(ctx, a.ID)
+		if !errors.Is(err, errStaleRead) || got.ID != a.ID {
+			t.Fatalf("GetByID with the database down = %v, %v; want the album, stale", got.ID, err)
+		}
+	}
+	if b.State() != breakerOpen {
+		t.Fatalf("breaker is %s after 2 failures, want open", b.State())
+	}
+	calls := backend.calls.Load()
+	if _, err := store.GetByID(ctx, a.ID); !errors.Is(err, errStaleRead) {
+		t.Errorf("GetByID with the breaker open = %v, want a stale read", err)
+	}
+	if page, err := store.List(ctx, ListOptions{}); !errors.Is(err, errStaleRead) || len(page.Albums) != 1 {
+		t.Errorf("List with the breaker open = %d albums, %v; want 1, stale", len(page.Albums), err)
+	}
+	if _, err := store.GetByID(ctx, "never-seen"); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("GetByID of an album never read = %v, want errCircuitOpen", err)
+	}
+	if _, err := store.Create(ctx, newTestAlbum(withID(newAlbumID()))); !errors.Is(err, errCircuitOpen) {
+		t.Errorf("Create with the breaker open = %v, want errCircuitOpen", err)
+	}
+	if got := backend.calls.Load(); got != calls {
+		t.Errorf("the open breaker made %d calls to the store, want none", got-calls)
+	}
+
+	// The database comes back; the next trial closes the breaker.
+	backend.failing.Store(false)
+	b.expire()
+	if _, err := store.GetByID(ctx, a.ID); err != nil {
+		t.Errorf("GetByID after recovery = %v", err)
+	}
+	if b.State() != breakerClosed {
+		t.Errorf("breaker is %s after a successful trial, want closed", b.State())
+	}
+}
+
+func TestBreakerResponses(t *testing.T) {
+	s := newTestServer(t)
+	a := s.create(newTestAlbum())
+	backend := &faultyAlbumStore{InMemoryAlbumStore: s.albums}
+	b := newCircuitBreaker("albums", 1, time.Minute)
+	albumStore = NewBreakerAlbumStore(backend, b)
+	previous := storeBreakers
+	storeBreakers = map[string]*circuitBreaker{"albums": b}
+	t.Cleanup(func() { storeBreakers = previous })
+
+	expectStatus(t, s.do(http.MethodGet, "/albums/"+a.ID, ""), http.StatusOK)
+	backend.failing.Store(true)
+
+	w := s.do(http.MethodGet, "/albums/"+a.ID, "")
+	expectStatus(t, w, http.StatusOK)
+	if w.Header().Get("Warning") == "" || w.Header().Get("X-Data-Stale") != "true" {
+		t.Errorf("a stale read has headers %v, want Warning and X-Data-Stale", w.Header())
+	}
+	expectProblem(t, s.do(http.MethodPost, "/albums", albumJSON(newTestAlbum(withTitle("Giant Steps")))), http.StatusServiceUnavailable)
+
+	w = httptest.NewRecorder()
+	readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	expectStatus(t, w, http.StatusServiceUnavailable)
+	if got := decodeBody[map[string]any](t, w)["circuitBreakers"]; got == nil {
+		t.Errorf("/readyz with the breaker open = %s, want the breaker states", w.Body)
+	}
+}
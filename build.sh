@@ -1,5 +1,11 @@
 #!/bin/sh
 set -e
 mkdir -p bin
-go build -o bin/web-service-go
-echo "Built executable at bin/web-service-go"
\ No newline at end of file
+# Stamp the build for GET /version. VERSION defaults to the nearest tag.
+pkg=github.com/brentmzey/web-service-go/internal/buildinfo
+version=${VERSION:-$(git describe --tags --always --dirty 2>/dev/null || echo dev)}
+commit=$(git rev-parse HEAD 2>/dev/null || echo dev)
+date=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+# sqlite_fts5 compiles FTS5 into SQLite for full-text album search.
+go build -tags sqlite_fts5 -ldflags "-X $pkg.Version=$version -X $pkg.Commit=$commit -X $pkg.Date=$date" -o bin/web-service-go
+echo "Built executable at bin/web-service-go"
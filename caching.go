@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	defaultListCacheControl  = "public, max-age=10"
+	defaultAlbumCacheControl = "public, max-age=60"
+)
+
+// latestUpdate is the newest UpdatedAt in list, the Last-Modified of a
+// listing. It is zero for an empty list.
+func latestUpdate(list []album) time.Time {
+	var latest time.Time
+	for _, a := range list {
+		if a.UpdatedAt.After(latest) {
+			latest = a.UpdatedAt
+		}
+	}
+	return latest
+}
+
+// writeValidators sets Cache-Control and, unless lastModified is zero,
+// Last-Modified on a successful read, then answers 304 and reports true if
+// the request's If-Modified-Since shows the client's copy is current.
+func writeValidators(w http.ResponseWriter, r *http.Request, cacheControl string, lastModified time.Time) bool {
+	w.Header().Set("Cache-Control", cacheControl)
+	if lastModified.IsZero() {
+		return false
+	}
+	w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	if notModified(r, "", lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// noStoreMiddleware keeps caches from storing the answer to anything but a
+// read. Errors are marked no-store where they are written, by writeProblem
+// and respondError.
+func noStoreMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			w.Header().Set("Cache-Control", "no-store")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
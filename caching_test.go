@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCacheHeaders(t *testing.T) {
+	s := newTestServer(t)
+	a := s.create(newTestAlbum())
+	b := s.create(newTestAlbum(withTitle("Giant Steps")))
+
+	for _, tc := range []struct {
+		path         string
+		cacheControl string
+		lastModified time.Time
+	}{
+		{"/albums", defaultListCacheControl, b.UpdatedAt},
+		{"/albums/" + a.ID, defaultAlbumCacheControl, a.UpdatedAt},
+		{"/albums/by-slug/" + b.Slug, defaultAlbumCacheControl, b.UpdatedAt},
+	} {
+		w := s.do(http.MethodGet, tc.path, "")
+		expectStatus(t, w, http.StatusOK)
+		lastModified := tc.lastModified.UTC().Format(http.TimeFormat)
+		if got := w.Header().Get("Cache-Control"); got != tc.cacheControl {
+			t.Errorf("GET %s: Cache-Control %q, want %q", tc.path, got, tc.cacheControl)
+		}
+		if got := w.Header().Get("Last-Modified"); got != lastModified {
+			t.Errorf("GET %s: Last-Modified %q, want %q", tc.path, got, lastModified)
+		}
+
+		// The client's copy is current at Last-Modified and after it, and
+		// stale a second before.
+		w = s.do(http.MethodGet, tc.path, "", "If-Modified-Since", lastModified)
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("Cache-Control") != tc.cacheControl {
+			t.Errorf("GET %s if modified since %s: %d %q, want an empty 304 with Cache-Control", tc.path, lastModified, w.Code, w.Body)
+		}
+		later := tc.lastModified.Add(time.Hour).UTC().Format(http.TimeFormat)
+		expectStatus(t, s.do(http.MethodGet, tc.path, "", "If-Modified-Since", later), http.StatusNotModified)
+		earlier := tc.lastModified.Add(-time.Second).UTC().Format(http.TimeFormat)
+		expectStatus(t, s.do(http.MethodGet, tc.path, "", "If-Modified-Since", earlier), http.StatusOK)
+		expectStatus(t, s.do(http.MethodGet, tc.path, "", "If-Modified-Since", "yesterday"), http.StatusOK)
+	}
+
+	// A change moves Last-Modified on to it, for the album and the list.
+	patched := decodeBody[album](t, s.do(http.MethodPatch, "/albums/"+a.ID, `{"year": 1958}`))
+	want := patched.UpdatedAt.UTC().Format(http.TimeFormat)
+	for _, path := range []string{"/albums/" + a.ID, "/albums"} {
+		if got := s.do(http.MethodGet, path, "").Header().Get("Last-Modified"); got != want {
+			t.Errorf("GET %s after a PATCH: Last-Modified %q, want %q", path, got, want)
+		}
+	}
+
+	// An empty list has nothing to date it by.
+	w := s.do(http.MethodGet, "/albums?artist=Miles+Davis", "")
+	if w.Code != http.StatusOK || w.Header().Get("Last-Modified") != "" || w.Header().Get("Cache-Control") != defaultListCacheControl {
+		t.Errorf("GET of an empty list: %d with headers %v", w.Code, w.Header())
+	}
+}
+
+func TestCacheHeadersNoStore(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.ListCacheControl = "public, max-age=300" })
+	a := s.create(newTestAlbum())
+
+	if got := s.do(http.MethodGet, "/albums", "").Header().Get("Cache-Control"); got != "public, max-age=300" {
+		t.Errorf("CACHE_CONTROL_LIST=%q: Cache-Control %q", s.cfg.ListCacheControl, got)
+	}
+	for _, tc := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodPost, "/albums", albumJSON(newTestAlbum(withTitle("Lush Life"))), http.StatusCreated},
+		{http.MethodPut, "/albums/" + a.ID, albumJSON(newTestAlbum()), http.StatusOK},
+		{http.MethodPatch, "/albums/" + a.ID, `{"year": 1958}`, http.StatusOK},
+		{http.MethodGet, "/albums/no-such-album", "", http.StatusNotFound},
+		{http.MethodGet, "/albums?limit=nope", "", http.StatusBadRequest},
+	} {
+		w := s.do(tc.method, tc.path, tc.body)
+		if w.Code != tc.status || w.Header().Get("Cache-Control") != "no-store" || w.Header().Get("Last-Modified") != "" {
+			t.Errorf("%s %s: %d with Cache-Control %q and Last-Modified %q, want %d with no-store only", tc.method, tc.path, w.Code, w.Header().Get("Cache-Control"), w.Header().Get("Last-Modified"), tc.status)
+		}
+	}
+}
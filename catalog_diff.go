@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/brentmzey/web-service-go/money"
+	"github.com/brentmzey/web-service-go/types"
+)
+
+const (
+	defaultDiffPageSize = 100
+	maxDiffPageSize     = 1000
+)
+
+var errRevisionsUnsupported = errors.New("the configured store does not keep album history")
+
+// albumRevision is a change of the change log with the album as it was
+// before it and as the change left it: a create has no before, and a delete
+// no after.
+type albumRevision struct {
+	types.AlbumChange
+	before, after *album
+}
+
+// revisionKeeper is implemented by the stores whose change log keeps each
+// album as it was on either side of each change.
+type revisionKeeper interface {
+	// Revisions returns the changes made after from and up to to, oldest
+	// first, and the time through which the log has been trimmed: the
+	// changes from before it are gone, so a window that starts earlier is
+	// missing some. The zero time means none has been.
+	Revisions(ctx context.Context, from, to time.Time) ([]albumRevision, time.Time, error)
+}
+
+func storeRevisions(ctx context.Context, store AlbumStore, from, to time.Time) ([]albumRevision, time.Time, error) {
+	k, ok := store.(revisionKeeper)
+	if !ok {
+		return nil, time.Time{}, errRevisionsUnsupported
+	}
+	return k.Revisions(ctx, from, to)
+}
+
+// albumSnapshot is an album as the change log triggers keep it: its row, as
+// a JSON object keyed by column.
+type albumSnapshot struct {
+	ID        string            `json:"id"`
+	Title     string            `json:"title"`
+	Artist    string            `json:"artist"`
+	Price     float64           `json:"price"`
+	Genre     string            `json:"genre"`
+	Slug      string            `json:"slug"`
+	Barcode   *string           `json:"barcode"`
+	Year      int               `json:"year"`
+	Tracks    []string          `json:"tracks"`
+	Metadata  map[string]string `json:"metadata"`
+	Stock     int               `json:"stock"`
+	CreatedAt string            `json:"created_at"`
+	UpdatedAt string            `json:"updated_at"`
+
+	AvailableFrom  *string `json:"available_from"`
+	AvailableUntil *string `json:"available_until"`
+}
+
+// snapshotTimeLayouts are the ways a snapshot's times come written: as
+// Postgres writes a timestamptz to JSON, and as the SQLite driver stores a
+// time.
+var snapshotTimeLayouts = []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999-07:00", "2006-01-02 15:04:05.999999999"}
+
+// decodeSnapshot decodes a snapshot column, which is NULL, and data nil,
+// where the change has no album on that side.
+func decodeSnapshot(data []byte) (*album, error) {
+	if data == nil {
+		return nil, nil
+	}
+	var s albumSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("decoding album snapshot: %w", err)
+	}
+	a := &album{ID: s.ID, Title: s.Title, Artist: s.Artist, Price: money.FromFloat(s.Price), Genre: s.Genre, Slug: s.Slug, Year: s.Year,
+		Tracks: s.Tracks, Metadata: s.Metadata, Stock: s.Stock}
+	if s.Barcode != nil {
+		a.Barcode = *s.Barcode
+	}
+	var err error
+	if a.CreatedAt, err = parseSnapshotTime(s.CreatedAt); err != nil {
+		return nil, err
+	}
+	if a.UpdatedAt, err = parseSnapshotTime(s.UpdatedAt); err != nil {
+		return nil, err
+	}
+	for _, bound := range []struct {
+		raw *string
+		dst **time.Time
+	}{{s.AvailableFrom, &a.AvailableFrom}, {s.AvailableUntil, &a.AvailableUntil}} {
+		if bound.raw == nil {
+			continue
+		}
+		t, err := parseSnapshotTime(*bound.raw)
+		if err != nil {
+			return nil, err
+		}
+		*bound.dst = &t
+	}
+	return a, nil
+}
+
+func parseSnapshotTime(raw string) (time.Time, error) {
+	for _, layout := range snapshotTimeLayouts {
+		if t, err := time.Parse(layout, raw); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("decoding album snapshot: unknown time %q", raw)
+}
+
+// diffAlbums folds revisions, oldest first, into what became of each album:
+// how it was before its first change and how its last one left it. The
+// entries are in the order of each album's last change. An album created
+// and deleted within the revisions, or updated back to how it was, is left
+// out.
+func diffAlbums(revisions []albumRevision) []types.AlbumDiffEntry {
+	type span struct{ first, last albumRevision }
+	spans := make(map[string]*span)
+	for _, rev := range revisions {
+		if s, ok := spans[rev.AlbumID]; ok {
+			s.last = rev
+		} else {
+			spans[rev.AlbumID] = &span{first: rev, last: rev}
+		}
+	}
+	ordered := make([]*span, 0, len(spans))
+	for _, s := range spans {
+		ordered = append(ordered, s)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].last.Seq < ordered[j].last.Seq })
+
+	entries := []types.AlbumDiffEntry{}
+	for _, s := range ordered {
+		before, after := s.first.before, s.last.after
+		entry := types.AlbumDiffEntry{AlbumID: s.last.AlbumID, Album: after, ChangedAt: s.last.ChangedAt}
+		switch {
+		case before == nil && after == nil:
+			continue
+		case before == nil:
+			entry.Op = changeCreated
+		case after == nil:
+			entry.Op, entry.Album = changeDeleted, before
+		default:
+			entry.Op, entry.Changes = changeUpdated, albumFieldChanges(*before, *after)
+			if len(entry.Changes) == 0 {
+				continue
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// diffByArtist keeps the entries of albums by artist, before or after.
+func diffByArtist(entries []types.AlbumDiffEntry, artist string) []types.AlbumDiffEntry {
+	kept := entries[:0]
+	for _, e := range entries {
+		if strings.EqualFold(e.Album.Artist, artist) {
+			kept = append(kept, e)
+			continue
+		}
+		if change, ok := e.Changes["artist"]; ok && strings.EqualFold(fmt.Sprint(change.Old), artist) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// getAlbumsDiff serves the catalog diff between from and to, which is the
+// current time by default or when it is now: the albums created, updated,
+// with the old and new value of each field that changed, and deleted in
+// that window. A from earlier than the oldest change kept is answered 410,
+// with the earliest from there is history for.
+func getAlbumsDiff(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("from") == "" {
+		writeProblem(w, r, http.StatusBadRequest, "from is required")
+		log.Println("📉 Bad request: catalog diff without from")
+		return
+	}
+	from, err := time.Parse(time.RFC3339, q.Get("from"))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, localize(r, "%s must be an RFC 3339 time", "from"))
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	to := serverClock.Now()
+	if raw := q.Get("to"); raw != "" && raw != "now" {
+		if to, err = time.Parse(time.RFC3339, raw); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, localize(r, "%s must be an RFC 3339 time", "to"))
+			log.Println("📉 Bad request:", err)
+			return
+		}
+	}
+	from, to = from.UTC(), to.UTC()
+	if !from.Before(to) {
+		writeProblem(w, r, http.StatusBadRequest, "from must be before to")
+		log.Println("📉 Bad request: empty catalog diff window")
+		return
+	}
+	limit, offset, err := parsePage(r, defaultDiffPageSize, maxDiffPageSize)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+
+	revisions, trimmed, err := storeRevisions(r.Context(), albumStore, from, to)
+	switch {
+	case errors.Is(err, errRevisionsUnsupported):
+		writeProblem(w, r, http.StatusNotImplemented, err.Error())
+		log.Println("🚧 Catalog diff requested but the album store doesn't keep album history")
+		return
+	case err != nil:
+		respondError(w, r, err)
+		return
+	}
+	if from.Before(trimmed) {
+		writeHistoryTrimmed(w, r, trimmed)
+		log.Printf("🧾 Catalog diff from %s predates the history kept, which starts at %s", from.Format(time.RFC3339), trimmed.Format(time.RFC3339))
+		return
+	}
+
+	entries := diffAlbums(revisions)
+	if artist := q.Get("artist"); artist != "" {
+		entries = diffByArtist(entries, artist)
+	}
+	diff := types.AlbumDiff{From: from, To: to, Total: len(entries), Limit: limit, Offset: offset}
+	for _, e := range entries {
+		switch e.Op {
+		case changeCreated:
+			diff.Created++
+		case changeUpdated:
+			diff.Updated++
+		case changeDeleted:
+			diff.Deleted++
+		}
+	}
+	diff.Albums = entries[min(offset, len(entries)):min(offset+limit, len(entries))]
+	writeJSON(w, http.StatusOK, diff)
+	log.Printf("🧾 Catalog diff: %d created, %d updated, %d deleted since %s", diff.Created, diff.Updated, diff.Deleted, from.Format(time.RFC3339))
+}
+
+// writeHistoryTrimmed answers 410 for a catalog diff from before earliest,
+// the time through which the change log has been trimmed.
+func writeHistoryTrimmed(w http.ResponseWriter, r *http.Request, earliest time.Time) {
+	p := problem{Type: types.ProblemHistoryTrimmed, Title: http.StatusText(http.StatusGone), Status: http.StatusGone,
+		Detail: localize(r, "the changes before %s are no longer kept", earliest.Format(time.RFC3339Nano)), Instance: r.URL.Path, Earliest: &earliest}
+	writeLocalizedDetail(w, r, &p)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSONAs(w, http.StatusGone, "application/problem+json", p)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/money"
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// describeChanges writes field changes out in field order.
+func describeChanges(changes map[string]types.FieldChange) string {
+	fields := make([]string, 0, len(changes))
+	for f := range changes {
+		fields = append(fields, f)
+	}
+	sort.Strings(fields)
+	out := make([]string, len(fields))
+	for i, f := range fields {
+		out[i] = fmt.Sprintf("%s: %v -> %v", f, changes[f].Old, changes[f].New)
+	}
+	return strings.Join(out, "; ")
+}
+
+func TestAlbumFieldChanges(t *testing.T) {
+	s := newTestServer(t)
+	for _, tc := range []struct {
+		name, patch, want string
+	}{
+		{"one field", `{"price": 19.99}`, "price: 56.99 -> 19.99"},
+		{"the same value", `{"title": "Blue Train", "price": 56.99}`, ""},
+		// A price that only differs past the cent isn't a change.
+		{"fractions of a cent", `{"price": 56.9900001}`, ""},
+		{"two fields", `{"genre": "Hard Bop", "year": 1958}`, "genre: Jazz -> Hard Bop; year: 1957 -> 1958"},
+		{"a list", `{"tracks": ["Blue Train", "Moment's Notice"]}`, "tracks: [] -> [Blue Train Moment's Notice]"},
+		{"a metadata key", `{"metadata": {"label": "Blue Note"}}`, "metadata: map[] -> map[label:Blue Note]"},
+		{"a metadata key removed", `{"metadata": {"label": null, "format": "LP"}}`, "metadata: map[label:Blue Note] -> map[format:LP]"},
+		{"a cleared barcode", `{"barcode": null}`, "barcode: 036000291452 -> "},
+	} {
+		a := s.create(newTestAlbum(func(a *album) {
+			switch tc.name {
+			case "a metadata key removed":
+				a.Metadata = map[string]string{"label": "Blue Note"}
+			case "a cleared barcode":
+				a.Barcode = "036000291452"
+			}
+		}))
+		updated := decodeBody[album](t, s.do(http.MethodPatch, "/albums/"+a.ID, tc.patch))
+		if got := describeChanges(albumFieldChanges(a, updated)); got != tc.want {
+			t.Errorf("%s: %q, want %q", tc.name, got, tc.want)
+		}
+	}
+
+	// The audit entry of a PATCH records the same changes.
+	a := s.create(newTestAlbum())
+	s.do(http.MethodPatch, "/albums/"+a.ID, `{"artist": "Coltrane", "stock": 4}`)
+	entries := auditEntries(t, auditAlbumUpdated)
+	last := entries[len(entries)-1]
+	if changes, _ := last.Details["changes"].(map[string]types.FieldChange); last.AlbumID != a.ID || describeChanges(changes) != "artist: John Coltrane -> Coltrane; stock: 0 -> 4" {
+		t.Errorf("audit entry %+v", last)
+	}
+}
+
+func TestDiffAlbums(t *testing.T) {
+	blue, giant, lush := newTestAlbum(withID("a")), newTestAlbum(withID("b"), withTitle("Giant Steps")), newTestAlbum(withID("c"), withTitle("Lush Life"))
+	cheaper, renamed := newTestAlbum(withID("a"), withPrice(1999)), newTestAlbum(withID("b"), withTitle("Giant Steps (Remastered)"))
+	rev := func(seq int64, before, after *album) albumRevision {
+		id := ""
+		for _, a := range []*album{before, after} {
+			if a != nil {
+				id = a.ID
+			}
+		}
+		return albumRevision{AlbumChange: types.AlbumChange{Seq: seq, AlbumID: id}, before: before, after: after}
+	}
+	revisions := []albumRevision{
+		rev(1, nil, &blue),       // created
+		rev(2, &giant, &renamed), // updated
+		rev(3, &blue, &cheaper),  // updated after its creation: still created
+		rev(4, nil, &lush),       // created and deleted: left out
+		rev(5, &renamed, &giant), // updated back: left out
+		rev(6, &lush, nil),
+	}
+	var got []string
+	for _, e := range diffAlbums(revisions) {
+		got = append(got, fmt.Sprintf("%s %s %s", e.Op, e.AlbumID, describeChanges(e.Changes)))
+	}
+	if want := []string{"created a "}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("diff %q, want %q", got, want)
+	}
+
+	// An album updated then deleted is deleted, as it was before the window.
+	got = nil
+	for _, e := range diffAlbums([]albumRevision{rev(1, &giant, &renamed), rev(2, &renamed, nil), rev(3, &blue, &cheaper)}) {
+		got = append(got, fmt.Sprintf("%s %s %s %s", e.Op, e.AlbumID, e.Album.Title, describeChanges(e.Changes)))
+	}
+	if want := []string{"deleted b Giant Steps ", "updated a Blue Train price: 56.99 -> 19.99"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("diff %q, want %q", got, want)
+	}
+}
+
+func TestAlbumsDiff(t *testing.T) {
+	s := newTestServer(t)
+	coltrane := s.create(newTestAlbum())
+	s.create(newTestAlbum(withTitle("Kind of Blue"), withArtist("Miles Davis")))
+	// The change log is stamped with the wall clock, to the millisecond.
+	from := time.Now()
+	time.Sleep(time.Millisecond)
+	s.create(newTestAlbum(withTitle("Giant Steps")))
+	s.do(http.MethodPatch, "/albums/"+coltrane.ID, `{"artist": "Coltrane"}`)
+	expectStatus(t, s.admin(http.MethodDelete, "/admin/albums", `{"artist": "Miles Davis", "confirm": 1, "permanent": true}`), http.StatusOK)
+	to := time.Now().Add(time.Minute)
+	window := "from=" + url.QueryEscape(from.Format(time.RFC3339Nano)) + "&to=" + url.QueryEscape(to.Format(time.RFC3339))
+
+	diff := decodeBody[types.AlbumDiff](t, s.admin(http.MethodGet, "/admin/albums/diff?"+window, ""))
+	if diff.Created != 1 || diff.Updated != 1 || diff.Deleted != 1 || diff.Total != 3 || len(diff.Albums) != 3 {
+		t.Fatalf("diff %+v, want one of each", diff)
+	}
+	if e := diff.Albums[1]; e.Op != changeUpdated || e.AlbumID != coltrane.ID || describeChanges(e.Changes) != "artist: John Coltrane -> Coltrane" {
+		t.Errorf("%+v, want the rename of Blue Train's artist", e)
+	}
+
+	page := decodeBody[types.AlbumDiff](t, s.admin(http.MethodGet, "/admin/albums/diff?"+window+"&limit=1&offset=1", ""))
+	if page.Total != 3 || len(page.Albums) != 1 || page.Albums[0].AlbumID != coltrane.ID {
+		t.Errorf("the second page of 1: %+v", page)
+	}
+	byDavis := decodeBody[types.AlbumDiff](t, s.admin(http.MethodGet, "/admin/albums/diff?"+window+"&artist=miles+davis", ""))
+	if byDavis.Total != 1 || byDavis.Albums[0].Op != changeDeleted || byDavis.Albums[0].Album.Title != "Kind of Blue" {
+		t.Errorf("by Miles Davis: %+v", byDavis)
+	}
+	// An album is also found by the artist it had before an update.
+	if byJohn := decodeBody[types.AlbumDiff](t, s.admin(http.MethodGet, "/admin/albums/diff?"+window+"&artist=John+Coltrane", "")); byJohn.Total != 2 {
+		t.Errorf("by John Coltrane: %+v", byJohn)
+	}
+
+	for _, query := range []string{"", "from=yesterday", window + "&limit=0", "from=" + url.QueryEscape(to.Format(time.RFC3339)) + "&to=" + url.QueryEscape(from.Format(time.RFC3339Nano))} {
+		expectProblem(t, s.admin(http.MethodGet, "/admin/albums/diff?"+query, ""), http.StatusBadRequest)
+	}
+
+	// Once the log is trimmed, a window from before it is gone.
+	cutoff := time.Now()
+	if _, err := storeTrimChanges(context.Background(), s.albums, cutoff); err != nil {
+		t.Fatal(err)
+	}
+	p := expectProblem(t, s.admin(http.MethodGet, "/admin/albums/diff?"+window, ""), http.StatusGone)
+	if p.Type != types.ProblemHistoryTrimmed || p.Earliest == nil || p.Earliest.Before(from) {
+		t.Errorf("problem %+v, want the earliest time there is history for", p)
+	}
+	later := "from=" + url.QueryEscape(p.Earliest.Add(time.Second).Format(time.RFC3339)) + "&to=" + url.QueryEscape(to.Format(time.RFC3339))
+	if diff := decodeBody[types.AlbumDiff](t, s.admin(http.MethodGet, "/admin/albums/diff?"+later, "")); diff.Total != 0 {
+		t.Errorf("after the trim: %+v", diff)
+	}
+}
+
+func TestRevisionsSQLite(t *testing.T) {
+	store, err := NewSqliteAlbumStore(testSQLiteStores(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	from := time.Now().Add(-time.Minute)
+	a, err := store.Create(ctx, newTestAlbum(withID(newAlbumID()), withBarcode("036000291452"), func(a *album) {
+		a.Metadata = map[string]string{"label": "Blue Note"}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := a
+	a.Price, a.Tracks, a.Barcode = money.FromCents(1999), []string{"Blue Train", "Moment's Notice"}, ""
+	if _, err := store.Update(ctx, a, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The triggers' snapshots decode to the albums as the store had them.
+	// History starts when the migration adding them ran.
+	revisions, trimmed, err := storeRevisions(ctx, store, from, time.Now().Add(time.Minute))
+	if err != nil || len(revisions) != 2 || trimmed.After(revisions[0].ChangedAt) {
+		t.Fatalf("%d revisions, trimmed through %s: %v", len(revisions), trimmed, err)
+	}
+	update := revisions[1]
+	if update.before == nil || update.after == nil || !update.before.CreatedAt.Equal(before.CreatedAt) {
+		t.Fatalf("the update's revision %+v", update)
+	}
+	if got := describeChanges(albumFieldChanges(*update.before, *update.after)); got != "barcode: 036000291452 -> ; price: 56.99 -> 19.99; tracks: [] -> [Blue Train Moment's Notice]" {
+		t.Errorf("changes %s", got)
+	}
+	if got := describeChanges(albumFieldChanges(before, *update.before)); got != "" {
+		t.Errorf("the snapshot before the update differs from the album created: %s", got)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// catalogFullDetail is the detail of the 403 answering a create that would
+// take the catalog past CATALOG_MAX_ALBUMS; the limit and the count are
+// members of the problem of their own.
+const catalogFullDetail = "the catalog has reached its album limit"
+
+// catalogFullError refuses a create that would take the catalog past its
+// limit. Count is the number of albums the catalog already held.
+type catalogFullError struct {
+	limit, count int
+}
+
+func (e *catalogFullError) Error() string {
+	return fmt.Sprintf("the catalog holds %d albums and is limited to %d", e.count, e.limit)
+}
+
+type catalogLimitKey struct{}
+
+// withCatalogLimit has the stores refuse, in ctx, creates that would take
+// the catalog past limit albums; 0 means no limit. Only the API's create
+// handlers set it: seeding and the admin catalog import aren't limited.
+func withCatalogLimit(ctx context.Context, limit int) context.Context {
+	return context.WithValue(ctx, catalogLimitKey{}, limit)
+}
+
+// catalogLimit is the limit set by withCatalogLimit, or 0.
+func catalogLimit(ctx context.Context) int {
+	limit, _ := ctx.Value(catalogLimitKey{}).(int)
+	return limit
+}
+
+// checkCatalogRoom reports whether a catalog of count albums has room for
+// adding more under ctx's limit. The caller makes the count and the inserts
+// that follow atomic.
+func checkCatalogRoom(ctx context.Context, count, adding int) error {
+	if limit := catalogLimit(ctx); limit > 0 && count+adding > limit {
+		return &catalogFullError{limit: limit, count: count}
+	}
+	return nil
+}
+
+// catalogLockLease bounds how long a crashed instance can hold the lock the
+// DynamoDB and MongoDB stores take to count and create under a limit. It
+// outlasts any single create, so a live holder never loses it.
+const catalogLockLease = 30 * time.Second
+
+// catalogLockRetry is how long a create waits before trying for the lock
+// again.
+const catalogLockRetry = 20 * time.Millisecond
+
+// postgresCatalogLock is the advisory lock key that serializes counting and
+// creating under a limit.
+const postgresCatalogLock = 0x616c62756d73 // "albums"
+
+// checkCatalogRoom takes the catalog lock for the rest of the transaction
+// and counts the albums. Inserts only take the lock under a limit, so
+// unlimited creates don't queue behind each other.
+func (store *PostgresAlbumStore) checkCatalogRoom(ctx context.Context, adding int) error {
+	if catalogLimit(ctx) <= 0 {
+		return nil
+	}
+	opCtx, cancel := store.opContext(ctx)
+	defer cancel()
+	if _, err := store.db.Exec(opCtx, `SELECT pg_advisory_xact_lock($1)`, postgresCatalogLock); err != nil {
+		return err
+	}
+	var count int
+	if err := store.db.QueryRow(opCtx, `SELECT count(*) FROM albums`).Scan(&count); err != nil {
+		return err
+	}
+	return checkCatalogRoom(ctx, count, adding)
+}
+
+// checkCatalogRoom counts the albums inside the caller's transaction.
+// SQLite runs one write transaction at a time, so no other create can
+// commit between the count and the inserts.
+func (store *SqliteAlbumStore) checkCatalogRoom(ctx context.Context, adding int) error {
+	if catalogLimit(ctx) <= 0 {
+		return nil
+	}
+	var count int64
+	if err := store.db.WithContext(ctx).Model(&sqliteAlbum{}).Count(&count).Error; err != nil {
+		return err
+	}
+	return checkCatalogRoom(ctx, int(count), adding)
+}
+
+// dynamoCatalogLockID is the albums table's item that serializes counting
+// and creating under a limit. Its kind keeps it out of List.
+const (
+	dynamoCatalogLockID = "lock#catalog"
+	dynamoKindLock      = "lock"
+)
+
+// withCatalogRoom runs create once the catalog is known to have room for
+// adding albums. Under a limit that means holding the catalog lock, a
+// conditional put that only succeeds when the lock item is missing or its
+// lease has run out, from the count until create returns.
+func (store *DynamoAlbumStore) withCatalogRoom(ctx context.Context, adding int, create func() error) error {
+	if catalogLimit(ctx) <= 0 {
+		return create()
+	}
+	token := uuid.NewString()
+	for {
+		now := time.Now()
+		opCtx, cancel := store.opContext(ctx)
+		_, err := store.client.PutItem(opCtx, &dynamodb.PutItemInput{
+			TableName: aws.String(dynamoAlbumsTable),
+			Item: map[string]types.AttributeValue{
+				"id":        &types.AttributeValueMemberS{Value: dynamoCatalogLockID},
+				"kind":      &types.AttributeValueMemberS{Value: dynamoKindLock},
+				"owner":     &types.AttributeValueMemberS{Value: token},
+				"expiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(catalogLockLease).UnixMilli(), 10)},
+			},
+			ConditionExpression:       aws.String("attribute_not_exists(id) OR expiresAt < :now"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.UnixMilli(), 10)}},
+		})
+		cancel()
+		if err == nil {
+			break
+		}
+		var held *types.ConditionalCheckFailedException
+		if !errors.As(err, &held) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(catalogLockRetry):
+		}
+	}
+	defer func() {
+		opCtx, cancel := store.opContext(context.WithoutCancel(ctx))
+		defer cancel()
+		_, err := store.client.DeleteItem(opCtx, &dynamodb.DeleteItemInput{
+			TableName:                 aws.String(dynamoAlbumsTable),
+			Key:                       map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: dynamoCatalogLockID}},
+			ConditionExpression:       aws.String("#owner = :owner"),
+			ExpressionAttributeNames:  map[string]string{"#owner": "owner"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{":owner": &types.AttributeValueMemberS{Value: token}},
+		})
+		if err != nil {
+			log.Printf("🔥 Failed to release the DynamoDB catalog lock: %v", err)
+		}
+	}()
+	count, err := store.countAlbums(ctx)
+	if err != nil {
+		return err
+	}
+	if err := checkCatalogRoom(ctx, count, adding); err != nil {
+		return err
+	}
+	return create()
+}
+
+// countAlbums counts the album items with a consistent scan, which sees
+// every create committed before it.
+func (store *DynamoAlbumStore) countAlbums(ctx context.Context) (int, error) {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	pages := dynamodb.NewScanPaginator(store.client, &dynamodb.ScanInput{
+		TableName:                 aws.String(dynamoAlbumsTable),
+		Select:                    types.SelectCount,
+		ConsistentRead:            aws.Bool(true),
+		FilterExpression:          aws.String("#kind = :album"),
+		ExpressionAttributeNames:  map[string]string{"#kind": "kind"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":album": &types.AttributeValueMemberS{Value: dynamoKindAlbum}},
+	})
+	count := 0
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		count += int(page.Count)
+	}
+	return count, nil
+}
+
+// mongoCatalogLockID is the document of the locks collection that
+// serializes counting and creating under a limit.
+const mongoCatalogLockID = "catalog"
+
+// withCatalogRoom runs create once the catalog is known to have room for
+// adding albums, holding the catalog lock from the count until create
+// returns under a limit. Taking the lock upserts the document only if its
+// lease has run out; while it is held the upsert hits the duplicate _id.
+// Unlike a transaction, this works on a standalone server too.
+func (store *MongoAlbumStore) withCatalogRoom(ctx context.Context, adding int, create func() error) error {
+	if catalogLimit(ctx) <= 0 {
+		return create()
+	}
+	locks := store.collection.Database().Collection("locks")
+	token := uuid.NewString()
+	for {
+		now := time.Now()
+		_, err := locks.UpdateOne(ctx,
+			bson.D{{Key: "_id", Value: mongoCatalogLockID}, {Key: "expiresAt", Value: bson.D{{Key: "$lt", Value: now}}}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "owner", Value: token}, {Key: "expiresAt", Value: now.Add(catalogLockLease)}}}},
+			options.Update().SetUpsert(true))
+		if err == nil {
+			break
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(catalogLockRetry):
+		}
+	}
+	defer func() {
+		_, err := locks.DeleteOne(context.WithoutCancel(ctx), bson.D{{Key: "_id", Value: mongoCatalogLockID}, {Key: "owner", Value: token}})
+		if err != nil {
+			log.Printf("🔥 Failed to release the MongoDB catalog lock: %v", err)
+		}
+	}()
+	count, err := store.collection.CountDocuments(ctx, bson.D{})
+	if err != nil {
+		return err
+	}
+	if err := checkCatalogRoom(ctx, int(count), adding); err != nil {
+		return err
+	}
+	return create()
+}
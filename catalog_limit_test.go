@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+func TestCatalogLimitConcurrent(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.CatalogMaxAlbums = 5 })
+	for i := 0; i < 4; i++ {
+		s.create(newTestAlbum(withTitle(fmt.Sprintf("Album %d", i))))
+	}
+
+	// Twenty creates race for the one place left.
+	var wg sync.WaitGroup
+	responses := make([]int, 20)
+	problems := make([]string, 20)
+	for i := range responses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := s.do(http.MethodPost, "/albums", albumJSON(newTestAlbum(withTitle(fmt.Sprintf("Racer %d", i)))))
+			responses[i] = w.Code
+			problems[i] = w.Body.String()
+		}()
+	}
+	wg.Wait()
+	created := 0
+	for i, code := range responses {
+		switch code {
+		case http.StatusCreated:
+			created++
+		case http.StatusForbidden:
+		default:
+			t.Errorf("create %d answered %d %s", i, code, problems[i])
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d of the racing creates succeeded, want 1", created)
+	}
+	if n := len(s.albums.byID); n != 5 {
+		t.Errorf("%d albums in the catalog, want the limit of 5", n)
+	}
+
+	p := expectProblem(t, s.do(http.MethodPost, "/albums", albumJSON(newTestAlbum())), http.StatusForbidden)
+	if p.Type != types.ProblemCatalogFull || p.Limit != 5 || p.Count != 5 || p.Detail != catalogFullDetail {
+		t.Errorf("problem %+v, want a full catalog of 5", p)
+	}
+	usage := decodeBody[types.Usage](t, s.do(http.MethodGet, "/me/usage", ""))
+	if usage.Catalog == nil || *usage.Catalog != (types.CatalogUsage{Albums: 5, Limit: 5, Remaining: 0}) {
+		t.Errorf("catalog usage %+v, want 5 of 5", usage.Catalog)
+	}
+
+	// With one place free, a batch of two creates neither.
+	for id := range s.albums.byID {
+		if err := s.albums.DeleteMany(context.Background(), []string{id}); err != nil {
+			t.Fatal(err)
+		}
+		break
+	}
+	batch := "[" + albumJSON(newTestAlbum(withTitle("Batch 1"))) + "," + albumJSON(newTestAlbum(withTitle("Batch 2"))) + "]"
+	if p := expectProblem(t, s.do(http.MethodPost, "/albums", batch), http.StatusForbidden); p.Count != 4 {
+		t.Errorf("problem %+v, want a count of 4", p)
+	}
+	if n := len(s.albums.byID); n != 4 {
+		t.Errorf("%d albums after the refused batch, want 4", n)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	// checkTimeout bounds each connection the check command makes, so an
+	// unreachable store fails the check rather than hanging it.
+	checkTimeout = 5 * time.Second
+
+	// certExpiryWarning is how soon before its expiry the TLS certificate
+	// is reported.
+	certExpiryWarning = 14 * 24 * time.Hour
+)
+
+// checkReport writes the check command's findings, one line each, and
+// counts the failures and warnings.
+type checkReport struct {
+	w        io.Writer
+	failures int
+	warnings int
+}
+
+func (r *checkReport) ok(name, format string, args ...interface{}) {
+	fmt.Fprintf(r.w, "✅ %s: %s\n", name, fmt.Sprintf(format, args...))
+}
+
+func (r *checkReport) warn(name, format string, args ...interface{}) {
+	r.warnings++
+	fmt.Fprintf(r.w, "⚠️ %s: %s\n", name, fmt.Sprintf(format, args...))
+}
+
+func (r *checkReport) fail(name, format string, args ...interface{}) {
+	r.failures++
+	fmt.Fprintf(r.w, "❌ %s: %s\n", name, fmt.Sprintf(format, args...))
+}
+
+// checkCommand implements `check`: it validates the configuration that
+// loadConfig returned, with loadErr, and checks what the service would need
+// to start with it, without listening or serving. It returns the process
+// exit code: 0 when nothing failed, warnings or not, and 1 otherwise.
+func checkCommand(cfg *Config, warnings []string, loadErr error) int {
+	report := &checkReport{w: os.Stdout}
+	runChecks(report, cfg, warnings, loadErr)
+	if report.failures > 0 {
+		fmt.Fprintf(report.w, "Check failed: %d problem(s), %d warning(s)\n", report.failures, report.warnings)
+		return 1
+	}
+	fmt.Fprintf(report.w, "Check passed with %d warning(s)\n", report.warnings)
+	return 0
+}
+
+func runChecks(report *checkReport, cfg *Config, warnings []string, loadErr error) {
+	if loadErr != nil {
+		report.fail("Configuration", "%s", strings.ReplaceAll(loadErr.Error(), "\n", "\n   "))
+		return
+	}
+	report.ok("Configuration", "valid, DB_TYPE=%s", describeDBType(cfg.DBType))
+	for _, warning := range warnings {
+		report.warn("Configuration", "%s", warning)
+	}
+	checkAlbumStore(report, cfg)
+	checkResponseCache(report, cfg)
+	checkQuotas(report, cfg)
+	checkTLS(report, cfg)
+}
+
+func describeDBType(dbType string) string {
+	if dbType == "" {
+		return "(in memory)"
+	}
+	return dbType
+}
+
+// checkAlbumStore connects to the album store with checkTimeout, probes it
+// as readyz does, and compares its schema with the migrations. It never
+// migrates or seeds; reading the migrations creates an empty
+// schema_migrations table where there is none.
+func checkAlbumStore(report *checkReport, cfg *Config) {
+	if cfg.DBType == "" {
+		report.ok("Album store", "in memory, nothing to connect to")
+		return
+	}
+	store, target, closeStore, err := connectForCheck(cfg)
+	if err != nil {
+		report.fail("Album store", "%v", err)
+		return
+	}
+	defer closeStore()
+	if err := pingAlbumStore(context.Background(), store); err != nil {
+		report.fail("Album store", "%s is unreachable: %v", cfg.DBType, err)
+		return
+	}
+	report.ok("Album store", "%s is reachable", cfg.DBType)
+	if target == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	migrations, err := loadMigrations(cfg.DBType)
+	if err != nil {
+		report.fail("Migrations", "%v", err)
+		return
+	}
+	pending, err := pendingMigrations(ctx, target, migrations)
+	switch {
+	case err != nil:
+		report.fail("Migrations", "%v", err)
+	case len(pending) == 0:
+		report.ok("Migrations", "up to date")
+	case cfg.RunMigrations:
+		report.warn("Migrations", "%d pending, to be applied on startup, starting with %04d_%s", len(pending), pending[0].version, pending[0].name)
+	default:
+		report.fail("Migrations", "%d pending and RUN_MIGRATIONS=false; run migrate up, starting with %04d_%s", len(pending), pending[0].version, pending[0].name)
+	}
+}
+
+// connectForCheck connects to the album store of cfg as setupStores would,
+// but once, within checkTimeout. It also returns the store's migration
+// target, for the backends that have one, and how to close the connection.
+func connectForCheck(cfg *Config) (AlbumStore, migrationTarget, func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	switch cfg.DBType {
+	case "postgres":
+		config, err := postgresConfig(cfg)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		config.ConnConfig.ConnectTimeout = checkTimeout
+		pool, err := pgxpool.ConnectConfig(ctx, config)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("connecting to %s:%d: %w", config.ConnConfig.Host, config.ConnConfig.Port, err)
+		}
+		store, _ := NewPostgresAlbumStore(pool, cfg.PGQueryTimeout)
+		return store, postgresMigrations{pool: pool}, pool.Close, nil
+
+	case "sqlite":
+		db, sqlDB, err := openSQLite(cfg.SQLiteDSN, &gorm.Config{Logger: logger.Discard})
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("opening SQLite database: %w", err)
+		}
+		// As for MongoDB, the store is built without NewSqliteAlbumStore,
+		// which fills in search keys and so needs the schema in place.
+		store := &SqliteAlbumStore{db: db}
+		return store, sqliteMigrations{db: sqlDB}, func() { sqlDB.Close() }, nil
+
+	case "mongodb":
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(cfg.MongoURI).SetServerSelectionTimeout(checkTimeout))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("connecting to MongoDB: %w", err)
+		}
+		// The store is built without NewMongoAlbumStore, which would create
+		// the indexes.
+		store := &MongoAlbumStore{collection: client.Database(cfg.MongoDatabase).Collection("albums")}
+		return store, nil, func() { client.Disconnect(context.Background()) }, nil
+
+	case "dynamodb":
+		client, err := newDynamoClient(cfg)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("setting up DynamoDB client: %w", err)
+		}
+		return NewDynamoAlbumStore(client, checkTimeout, 0, 0), nil, func() {}, nil
+	}
+	return nil, nil, nil, fmt.Errorf("unknown DB_TYPE %q", cfg.DBType)
+}
+
+// pendingMigrations lists the migrations migrateUp would apply to target.
+func pendingMigrations(ctx context.Context, target migrationTarget, migrations []migration) ([]migration, error) {
+	applied, err := target.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []migration
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		if m.requires != "" {
+			ok, err := target.supports(ctx, m.requires)
+			if err != nil {
+				return nil, fmt.Errorf("checking %04d_%s: %w", m.version, m.name, err)
+			}
+			if !ok {
+				continue
+			}
+		}
+		pending = append(pending, m)
+	}
+	return pending, nil
+}
+
+// checkResponseCache pings Redis when the response cache is kept there. The
+// service starts without it, serving uncached, so a failure is a warning.
+func checkResponseCache(report *checkReport, cfg *Config) {
+	if cfg.ResponseCacheRedisURL == "" {
+		return
+	}
+	client, err := newRedisClient(cfg.ResponseCacheRedisURL)
+	if err != nil {
+		report.fail("Response cache", "%v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	if _, err := client.do(ctx, "PING"); err != nil {
+		report.warn("Response cache", "Redis at %s is unreachable, responses would be served uncached: %v", client.addr, err)
+		return
+	}
+	report.ok("Response cache", "Redis at %s is reachable", client.addr)
+}
+
+// checkQuotas pings Redis when the quotas are counted there.
+// The service lets requests through uncounted without it, so a failure is
+// a warning.
+func checkQuotas(report *checkReport, cfg *Config) {
+	if cfg.QuotaRedisURL == "" {
+		return
+	}
+	client, err := newRedisClient(cfg.QuotaRedisURL)
+	if err != nil {
+		report.fail("Quotas", "%v", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	if _, err := client.do(ctx, "PING"); err != nil {
+		report.warn("Quotas", "Redis at %s is unreachable, requests would go uncounted: %v", client.addr, err)
+		return
+	}
+	report.ok("Quotas", "Redis at %s is reachable", client.addr)
+}
+
+// checkTLS loads the certificate, key, and client CA as setupTLS does at
+// startup, and reports a certificate that has expired or expires within
+// certExpiryWarning.
+func checkTLS(report *checkReport, cfg *Config) {
+	if cfg.TLSCertFile == "" {
+		report.ok("TLS", "off, serving plain HTTP")
+		return
+	}
+	tlsConfig, err := setupTLS(cfg)
+	if err != nil {
+		report.fail("TLS", "%v", err)
+		return
+	}
+	cert := tlsConfig.Certificates[0]
+	leaf := cert.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			report.fail("TLS", "parsing %s: %v", cfg.TLSCertFile, err)
+			return
+		}
+	}
+	left := leaf.NotAfter.Sub(serverClock.Now())
+	expiry := leaf.NotAfter.UTC().Format(time.RFC3339)
+	switch {
+	case left <= 0:
+		report.fail("TLS", "the certificate for %s expired at %s", certName(leaf), expiry)
+	case left < certExpiryWarning:
+		report.warn("TLS", "the certificate for %s expires in %d day(s), at %s", certName(leaf), int(math.Ceil(left.Hours()/24)), expiry)
+	default:
+		report.ok("TLS", "the certificate for %s is valid until %s", certName(leaf), expiry)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// runCheck runs the checks of cfg and returns the report and its counts.
+func runCheck(cfg *Config, loadErr error) (string, int, int) {
+	var out bytes.Buffer
+	report := &checkReport{w: &out}
+	runChecks(report, cfg, nil, loadErr)
+	return out.String(), report.failures, report.warnings
+}
+
+func TestCheckDatabaseURL(t *testing.T) {
+	s := newTestServer(t)
+	for _, tc := range []struct {
+		name, url, want string
+	}{
+		{"unparseable", "postgres://u:p@%zz/albums", "❌ Album store: "},
+		// Nothing listens on port 1, so the connection is refused at once.
+		{"unreachable", "postgres://u:p@127.0.0.1:1/albums?connect_timeout=2", "❌ Album store: connecting to 127.0.0.1:1: "},
+	} {
+		cfg := *s.cfg
+		cfg.DBType, cfg.DatabaseURL = "postgres", tc.url
+		start := time.Now()
+		report, failures, _ := runCheck(&cfg, nil)
+		if failures != 1 || !strings.Contains(report, tc.want) {
+			t.Errorf("%s: %d failures in\n%s\nwant %q", tc.name, failures, report, tc.want)
+		}
+		if tc.name == "unreachable" && strings.Contains(report, "p@") {
+			t.Errorf("%s: the report has the password:\n%s", tc.name, report)
+		}
+		if took := time.Since(start); took > checkTimeout {
+			t.Errorf("%s: the check took %s", tc.name, took)
+		}
+	}
+
+	report, failures, _ := runCheck(s.cfg, errors.New("DATABASE_URL must be set when DB_TYPE=postgres\nPORT must be a number"))
+	if failures != 1 || !strings.Contains(report, "❌ Configuration: DATABASE_URL must be set when DB_TYPE=postgres\n   PORT must be a number") {
+		t.Errorf("a configuration that doesn't load: %d failures in\n%s", failures, report)
+	}
+}
+
+func TestCheckSQLiteMigrations(t *testing.T) {
+	s := newTestServer(t)
+	cfg := *s.cfg
+	cfg.DBType, cfg.SQLiteDSN, cfg.RunMigrations = "sqlite", "file:"+filepath.Join(t.TempDir(), "albums.db"), false
+
+	report, failures, _ := runCheck(&cfg, nil)
+	if failures != 1 || !strings.Contains(report, "✅ Album store: sqlite is reachable") || !strings.Contains(report, "pending and RUN_MIGRATIONS=false") {
+		t.Errorf("a new database: %d failures in\n%s", failures, report)
+	}
+	cfg.RunMigrations = true
+	if report, failures, warnings := runCheck(&cfg, nil); failures != 0 || warnings != 1 || !strings.Contains(report, "to be applied on startup") {
+		t.Errorf("with RUN_MIGRATIONS: %d failures and %d warnings in\n%s", failures, warnings, report)
+	}
+}
+
+func TestCheckCertificateExpiry(t *testing.T) {
+	s := newTestServer(t)
+	ca := newTestCA(t, "check CA")
+	now := s.clock.Now()
+	for _, tc := range []struct {
+		name               string
+		notAfter           time.Time
+		failures, warnings int
+		want               string
+	}{
+		{"valid", now.Add(60 * 24 * time.Hour), 0, 0, "✅ TLS: the certificate for localhost is valid until 2026-05-01T12:00:00Z"},
+		{"expiring", now.Add(3*24*time.Hour - time.Hour), 0, 1, "⚠️ TLS: the certificate for localhost expires in 3 day(s), at 2026-03-05T11:00:00Z"},
+		{"a day short of the warning", now.Add(certExpiryWarning + 24*time.Hour), 0, 0, "✅ TLS: "},
+		{"expired", now.Add(-time.Minute), 1, 0, "❌ TLS: the certificate for localhost expired at 2026-03-02T11:59:00Z"},
+	} {
+		cfg := *s.cfg
+		cfg.TLSCertFile, cfg.TLSKeyFile = writeKeyPair(t, ca.issueUntil(t, "localhost", tc.notAfter, net.IPv4(127, 0, 0, 1)))
+		report, failures, warnings := runCheck(&cfg, nil)
+		if failures != tc.failures || warnings != tc.warnings || !strings.Contains(report, tc.want) {
+			t.Errorf("%s: %d failures and %d warnings in\n%s\nwant %q", tc.name, failures, warnings, report, tc.want)
+		}
+	}
+
+	cfg := *s.cfg
+	cfg.TLSCertFile, cfg.TLSKeyFile = filepath.Join(t.TempDir(), "missing.pem"), filepath.Join(t.TempDir(), "missing-key.pem")
+	if report, failures, _ := runCheck(&cfg, nil); failures != 1 || !strings.Contains(report, "❌ TLS: loading TLS certificate: ") {
+		t.Errorf("a missing certificate: %d failures in\n%s", failures, report)
+	}
+}
@@ -0,0 +1,401 @@
+// Package client is a Go client for the album service. It uses the same
+// types as the server, from the types package, so the two can't drift apart.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// Errors a call may wrap, matched with errors.Is. The *Error returned
+// carries the server's problem details.
+var (
+	ErrNotFound     = errors.New("not found")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrConflict     = errors.New("conflict")
+	ErrInvalid      = errors.New("invalid request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrUnavailable  = errors.New("service unavailable")
+	ErrCatalogFull  = errors.New("catalog full")
+)
+
+// Error is a response with an error status, decoded from its
+// application/problem+json body.
+type Error struct {
+	types.Problem
+	// RetryAfter is the wait the server asked for, if any.
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Detail != "" {
+		return fmt.Sprintf("%d %s: %s", e.Status, e.Title, e.Detail)
+	}
+	return fmt.Sprintf("%d %s", e.Status, e.Title)
+}
+
+// Is matches e against the Err variables by status.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.Status == http.StatusNotFound
+	case ErrRateLimited:
+		return e.Status == http.StatusTooManyRequests
+	case ErrConflict:
+		return e.Status == http.StatusConflict
+	case ErrInvalid:
+		return e.Status == http.StatusBadRequest || e.Status == http.StatusUnprocessableEntity
+	case ErrUnauthorized:
+		return e.Status == http.StatusUnauthorized || e.Status == http.StatusForbidden && e.Type != types.ProblemCatalogFull
+	case ErrCatalogFull:
+		return e.Type == types.ProblemCatalogFull
+	case ErrUnavailable:
+		return e.Status == http.StatusServiceUnavailable
+	}
+	return false
+}
+
+// Client calls the album service. It is safe for concurrent use.
+type Client struct {
+	baseURL      *url.URL
+	httpClient   *http.Client
+	apiKey       string
+	maxRetries   int
+	maxRetryWait time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithAPIKey sends key as a bearer token with every request.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithHTTPClient makes requests with hc instead of http.DefaultClient.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithRetries sets how many times a rate-limited request is retried (3 by
+// default, 0 to never retry) and the longest Retry-After the client will
+// wait out (30 seconds by default). A longer one fails the call with
+// ErrRateLimited straight away.
+func WithRetries(n int, maxWait time.Duration) Option {
+	return func(c *Client) { c.maxRetries, c.maxRetryWait = n, maxWait }
+}
+
+// New returns a client for the service at baseURL, like
+// http://localhost:8080.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimRight(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("parsing base URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("base URL must be http or https, got %q", baseURL)
+	}
+	c := &Client{baseURL: u, httpClient: http.DefaultClient, maxRetries: 3, maxRetryWait: 30 * time.Second}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// ListOptions filters ListAlbums. Zero values mean no constraint.
+type ListOptions struct {
+	Artist   string
+	Genre    string
+	MinPrice *float64
+	MaxPrice *float64
+	Query    string            // free-text search
+	Metadata map[string]string // exact metadata values by key
+	// IncludeUnavailable lists the albums outside their availability
+	// window too. It takes an API key or the admin token.
+	IncludeUnavailable bool
+}
+
+func (o ListOptions) values() url.Values {
+	v := url.Values{}
+	for name, value := range map[string]string{"artist": o.Artist, "genre": o.Genre, "q": o.Query} {
+		if value != "" {
+			v.Set(name, value)
+		}
+	}
+	if o.MinPrice != nil {
+		v.Set("minPrice", strconv.FormatFloat(*o.MinPrice, 'f', -1, 64))
+	}
+	if o.MaxPrice != nil {
+		v.Set("maxPrice", strconv.FormatFloat(*o.MaxPrice, 'f', -1, 64))
+	}
+	for key, value := range o.Metadata {
+		v.Set("metadata."+key, value)
+	}
+	if o.IncludeUnavailable {
+		v.Set("includeUnavailable", "true")
+	}
+	return v
+}
+
+// listPageSize is the page size ListAlbums asks for. The service may lower
+// it.
+const listPageSize = 500
+
+// ListAlbums returns every album matching opts, fetching them a page at a
+// time.
+func (c *Client) ListAlbums(ctx context.Context, opts ListOptions) ([]types.Album, error) {
+	albums := []types.Album{}
+	query := opts.values()
+	query.Set("limit", strconv.Itoa(listPageSize))
+	for {
+		query.Set("offset", strconv.Itoa(len(albums)))
+		resp, err := c.send(ctx, http.MethodGet, "/albums", query, nil, "")
+		if err != nil {
+			return nil, err
+		}
+		var page []types.Album
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		albums = append(albums, page...)
+		total, err := strconv.Atoi(resp.Header.Get("X-Total-Count"))
+		if err != nil || len(page) == 0 || len(albums) >= total {
+			return albums, nil
+		}
+	}
+}
+
+// SearchAlbums runs a search and returns the one page of results it asks
+// for. Unlike ListAlbums, it doesn't follow the pages; the result's Total
+// says how many albums match.
+func (c *Client) SearchAlbums(ctx context.Context, req types.SearchRequest) (types.SearchResult, error) {
+	var res types.SearchResult
+	err := c.do(ctx, http.MethodPost, "/albums/search", nil, req, &res)
+	return res, err
+}
+
+// GetAlbum returns the album with the given ID.
+func (c *Client) GetAlbum(ctx context.Context, id string) (types.Album, error) {
+	var a types.Album
+	err := c.do(ctx, http.MethodGet, "/albums/"+url.PathEscape(id), nil, nil, &a)
+	return a, err
+}
+
+// CreateAlbum adds an album and returns it with its ID and slug.
+func (c *Client) CreateAlbum(ctx context.Context, in types.AlbumInput) (types.Album, error) {
+	var a types.Album
+	err := c.do(ctx, http.MethodPost, "/albums", nil, in, &a)
+	return a, err
+}
+
+// ValidateAlbum checks in as CreateAlbum would, without creating it.
+func (c *Client) ValidateAlbum(ctx context.Context, in types.AlbumInput) (types.AlbumValidation, error) {
+	var v types.AlbumValidation
+	err := c.do(ctx, http.MethodPost, "/albums/validate", nil, in, &v)
+	return v, err
+}
+
+// AlbumChanges returns up to limit changes to the catalog after seq since,
+// oldest first; a limit of 0 takes the server's default. A since that the
+// server no longer keeps the changes after is an *Error with status 410:
+// fetch the catalog with ListAlbums and carry on from the head.
+func (c *Client) AlbumChanges(ctx context.Context, since int64, limit int) (types.AlbumChanges, error) {
+	q := url.Values{"since": {strconv.FormatInt(since, 10)}}
+	if limit > 0 {
+		q.Set("limit", strconv.Itoa(limit))
+	}
+	var res types.AlbumChanges
+	err := c.do(ctx, http.MethodGet, "/albums/changes", q, nil, &res)
+	return res, err
+}
+
+// UpdateAlbum replaces the fields of the album with the given ID.
+func (c *Client) UpdateAlbum(ctx context.Context, id string, in types.AlbumInput) (types.Album, error) {
+	var a types.Album
+	err := c.do(ctx, http.MethodPut, "/albums/"+url.PathEscape(id), nil, in, &a)
+	return a, err
+}
+
+// PatchAlbum applies a JSON merge patch to the album with the given ID:
+// the fields in patch are set, a nil removes one, and metadata is merged
+// key by key, so map[string]interface{}{"metadata": map[string]interface{}{"label": nil}}
+// removes just the label.
+func (c *Client) PatchAlbum(ctx context.Context, id string, patch map[string]interface{}) (types.Album, error) {
+	var a types.Album
+	err := c.do(ctx, http.MethodPatch, "/albums/"+url.PathEscape(id), nil, patch, &a)
+	return a, err
+}
+
+// Metrics returns the service's request counters.
+func (c *Client) Metrics(ctx context.Context) (types.MetricsReport, error) {
+	var m types.MetricsReport
+	err := c.do(ctx, http.MethodGet, "/metrics", nil, nil, &m)
+	return m, err
+}
+
+// Version returns which build the service is running.
+func (c *Client) Version(ctx context.Context) (types.VersionInfo, error) {
+	var v types.VersionInfo
+	err := c.do(ctx, http.MethodGet, "/version", nil, nil, &v)
+	return v, err
+}
+
+// Usage returns the caller's tier and what is left of its hourly quota, and
+// of its monthly quota when the tier has one.
+func (c *Client) Usage(ctx context.Context) (types.Usage, error) {
+	var u types.Usage
+	err := c.do(ctx, http.MethodGet, "/me/usage", nil, nil, &u)
+	return u, err
+}
+
+// ExportCatalog writes a backup of the whole catalog to w: format "json"
+// for one JSON document, or "ndjson" for gzipped NDJSON. It calls an admin
+// endpoint, so the client needs the admin token as its API key.
+func (c *Client) ExportCatalog(ctx context.Context, format string, w io.Writer) error {
+	resp, err := c.send(ctx, http.MethodGet, "/admin/export", url.Values{"format": {format}}, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// ImportCatalog restores a backup written by ExportCatalog in the given
+// format, with mode "replace" or "merge", and returns how many albums were
+// imported. Like ExportCatalog it needs the admin token.
+func (c *Client) ImportCatalog(ctx context.Context, mode, format string, backup io.Reader) (int, error) {
+	// Read it all so a rate-limited request can be sent again.
+	body, err := io.ReadAll(backup)
+	if err != nil {
+		return 0, err
+	}
+	contentType := "application/json"
+	if format == "ndjson" {
+		contentType = "application/x-ndjson"
+	}
+	resp, err := c.send(ctx, http.MethodPost, "/admin/import", url.Values{"mode": {mode}}, body, contentType)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Imported int `json:"imported"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	return result.Imported, err
+}
+
+// do sends in as JSON and decodes a successful response into out.
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) error {
+	var body []byte
+	var contentType string
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return err
+		}
+		contentType = "application/json"
+	}
+	resp, err := c.send(ctx, method, path, query, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// send makes a request, retrying while it is rate limited, and returns the
+// response if it succeeded; the caller closes its body. An error status
+// comes back as an *Error.
+func (c *Client) send(ctx context.Context, method, path string, query url.Values, body []byte, contentType string) (*http.Response, error) {
+	u := *c.baseURL
+	u.Path += path
+	u.RawQuery = query.Encode()
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		if c.apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+c.apiKey)
+		}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 400 {
+			return resp, nil
+		}
+		apiErr := decodeError(resp)
+		if resp.StatusCode != http.StatusTooManyRequests || attempt >= c.maxRetries {
+			return nil, apiErr
+		}
+		wait := apiErr.RetryAfter
+		if resp.Header.Get("Retry-After") == "" {
+			wait = time.Second << attempt
+		}
+		if wait > c.maxRetryWait {
+			return nil, apiErr
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// decodeError reads an error response. A body that isn't problem details
+// still gives an Error with the status.
+func decodeError(resp *http.Response) *Error {
+	defer resp.Body.Close()
+	apiErr := &Error{}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if json.Unmarshal(data, &apiErr.Problem) != nil || apiErr.Status == 0 {
+		apiErr.Problem = types.Problem{Title: http.StatusText(resp.StatusCode), Detail: strings.TrimSpace(string(data))}
+	}
+	apiErr.Status = resp.StatusCode
+	apiErr.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+	return apiErr
+}
+
+// parseRetryAfter reads a Retry-After of either delay seconds or an HTTP
+// date.
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brentmzey/web-service-go/internal/clock"
+)
+
+const (
+	defaultMetricsClientLimit = 1000
+
+	// otherClients is the entry that counts the requests of every client
+	// past METRICS_CLIENT_LIMIT.
+	otherClients = "other"
+
+	defaultClientMetricsPageSize = 100
+	maxClientMetricsPageSize     = 1000
+)
+
+// ClientMetrics are one client's request counters. The client is an API key
+// as key:<id>, or the address of anonymous traffic, or otherClients.
+type ClientMetrics struct {
+	Client   string    `json:"client"`
+	Requests int64     `json:"requests"`
+	Errors   int64     `json:"errors"`
+	LastSeen time.Time `json:"lastSeen,omitzero"`
+}
+
+// add sums two clients' counters and keeps the later LastSeen. The result
+// is named after m, or o if m is the zero value.
+func (m ClientMetrics) add(o ClientMetrics) ClientMetrics {
+	sum := ClientMetrics{Client: m.Client, Requests: m.Requests + o.Requests, Errors: m.Errors + o.Errors, LastSeen: m.LastSeen}
+	if sum.Client == "" {
+		sum.Client = o.Client
+	}
+	if o.LastSeen.After(sum.LastSeen) {
+		sum.LastSeen = o.LastSeen
+	}
+	return sum
+}
+
+// sortClientMetrics orders clients busiest first, then by name.
+func sortClientMetrics(clients []ClientMetrics) {
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Requests != clients[j].Requests {
+			return clients[i].Requests > clients[j].Requests
+		}
+		return clients[i].Client < clients[j].Client
+	})
+}
+
+// foldClientMetrics keeps the keep busiest clients and sums the rest, with
+// any otherClients entry among them, into other.
+func foldClientMetrics(clients []ClientMetrics, keep int) (kept []ClientMetrics, other ClientMetrics) {
+	other.Client = otherClients
+	named := make([]ClientMetrics, 0, len(clients))
+	for _, c := range clients {
+		if c.Client == otherClients {
+			other = other.add(c)
+			continue
+		}
+		named = append(named, c)
+	}
+	sortClientMetrics(named)
+	for _, c := range named[min(keep, len(named)):] {
+		other = other.add(c)
+	}
+	return named[:min(keep, len(named))], other
+}
+
+// mergeClientMetrics adds the unflushed counts to the stored ones and splits
+// off the otherClients entry.
+func mergeClientMetrics(stored, unflushed []ClientMetrics) (clients []ClientMetrics, other ClientMetrics) {
+	byClient := make(map[string]ClientMetrics, len(stored)+len(unflushed))
+	for _, list := range [][]ClientMetrics{stored, unflushed} {
+		for _, c := range list {
+			byClient[c.Client] = byClient[c.Client].add(c)
+		}
+	}
+	other = ClientMetrics{Client: otherClients}
+	clients = make([]ClientMetrics, 0, len(byClient))
+	for _, c := range byClient {
+		if c.Client == otherClients {
+			other = other.add(c)
+			continue
+		}
+		clients = append(clients, c)
+	}
+	sortClientMetrics(clients)
+	return clients, other
+}
+
+// clientCounters are a tracked client's counts, and how much of them has
+// been flushed to the metrics store.
+type clientCounters struct {
+	requests, errors int64
+	lastSeen         time.Time
+
+	flushedRequests, flushedErrors int64
+}
+
+func (c *clientCounters) observe(failed bool, at time.Time) {
+	c.requests++
+	if failed {
+		c.errors++
+	}
+	c.lastSeen = at
+}
+
+func (c *clientCounters) unflushed(client string) ClientMetrics {
+	return ClientMetrics{Client: client, Requests: c.requests - c.flushedRequests, Errors: c.errors - c.flushedErrors, LastSeen: c.lastSeen}
+}
+
+// clientTracker counts requests per client. It tracks at most
+// METRICS_CLIENT_LIMIT clients and counts the requests of any client past
+// that under otherClients, so a scan from random addresses can't grow it
+// without bound; the rate-limit janitor prunes quiet addresses to make room
+// again.
+type clientTracker struct {
+	clock clock.Clock
+
+	mu      sync.Mutex
+	clients map[string]*clientCounters
+	other   clientCounters
+}
+
+func newClientTracker(c clock.Clock) *clientTracker {
+	return &clientTracker{clock: c, clients: make(map[string]*clientCounters)}
+}
+
+var clientMetrics = newClientTracker(serverClock)
+
+// observe counts a request from client, or from otherClients if client is
+// new and limit clients are already tracked.
+func (t *clientTracker) observe(client string, failed bool, limit int) {
+	now := t.clock.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.clients[client]
+	if !ok {
+		if len(t.clients) >= limit {
+			t.other.observe(failed, now)
+			return
+		}
+		c = &clientCounters{}
+		t.clients[client] = c
+	}
+	c.observe(failed, now)
+}
+
+// pending lists what each client, otherClients included, gained since its
+// last flush.
+func (t *clientTracker) pending() []ClientMetrics {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var deltas []ClientMetrics
+	for client, c := range t.clients {
+		if d := c.unflushed(client); d.Requests != 0 {
+			deltas = append(deltas, d)
+		}
+	}
+	if d := t.other.unflushed(otherClients); d.Requests != 0 {
+		deltas = append(deltas, d)
+	}
+	return deltas
+}
+
+// markFlushed records that deltas from pending were saved.
+func (t *clientTracker) markFlushed(deltas []ClientMetrics) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, d := range deltas {
+		c := &t.other
+		if d.Client != otherClients {
+			if c = t.clients[d.Client]; c == nil {
+				continue
+			}
+		}
+		c.flushedRequests += d.Requests
+		c.flushedErrors += d.Errors
+	}
+}
+
+// prune forgets the addresses that have gone quiet for window, as the rate
+// limiter does. API keys are few and kept. An address with counts not yet
+// flushed waits for the flush, unless flushing is off, when its counts move
+// to otherClients so the totals still add up.
+func (t *clientTracker) prune(window time.Duration, flushing bool) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for client, c := range t.clients {
+		if strings.HasPrefix(client, "key:") || t.clock.Since(c.lastSeen) < window {
+			continue
+		}
+		if d := c.unflushed(client); d.Requests != 0 {
+			if flushing {
+				continue
+			}
+			t.other.requests += d.Requests
+			t.other.errors += d.Errors
+			if c.lastSeen.After(t.other.lastSeen) {
+				t.other.lastSeen = c.lastSeen
+			}
+		}
+		delete(t.clients, client)
+		n++
+	}
+	return n
+}
+
+// clientMetricsPage is the answer to GET /admin/metrics/clients.
+type clientMetricsPage struct {
+	Clients []ClientMetrics `json:"clients"`
+	Other   ClientMetrics   `json:"other"`
+	Total   int             `json:"total"` // clients across every page
+	Limit   int             `json:"limit"`
+	Offset  int             `json:"offset"`
+}
+
+// parsePage reads the limit and offset query parameters. The errors are
+// already in the language r asks for.
+func parsePage(r *http.Request, defaultLimit, maxLimit int) (limit, offset int, err error) {
+	q := r.URL.Query()
+	limit = defaultLimit
+	if raw := q.Get("limit"); raw != "" {
+		if limit, err = strconv.Atoi(raw); err != nil || limit < 1 || limit > maxLimit {
+			return 0, 0, errors.New(localize(r, "limit must be a number from 1 to %d", maxLimit))
+		}
+	}
+	if raw := q.Get("offset"); raw != "" {
+		if offset, err = strconv.Atoi(raw); err != nil || offset < 0 {
+			return 0, 0, errors.New(localize(r, "offset must be a non-negative number"))
+		}
+	}
+	return limit, offset, nil
+}
+
+// getClientMetrics lists the request counts of every client, busiest first,
+// from the stored totals of the whole fleet plus what this instance hasn't
+// flushed yet.
+func getClientMetrics(w http.ResponseWriter, r *http.Request) {
+	limit, offset, err := parsePage(r, defaultClientMetricsPageSize, maxClientMetricsPageSize)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	stored, err := metricsStore.LoadClientMetrics(r.Context())
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	clients, other := mergeClientMetrics(stored, clientMetrics.pending())
+	total := len(clients)
+	writeJSON(w, http.StatusOK, clientMetricsPage{
+		Clients: clients[min(offset, total):min(offset+limit, total)],
+		Other:   other,
+		Total:   total,
+		Limit:   limit,
+		Offset:  offset,
+	})
+}
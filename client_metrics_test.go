@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/internal/clock/clocktest"
+)
+
+func TestClientTrackerBounded(t *testing.T) {
+	clk := clocktest.New(testStart)
+	tracker := newClientTracker(clk)
+
+	// A scan from 5000 addresses, each failing once, past a limit of 100.
+	for i := 0; i < 5000; i++ {
+		tracker.observe(fmt.Sprintf("198.51.%d.%d", i/256, i%256), true, 100)
+	}
+	tracker.observe("key:ci", false, 100)
+	if n := len(tracker.clients); n != 100 {
+		t.Fatalf("tracking %d clients, want 100", n)
+	}
+	var requests, errors int64
+	for _, d := range tracker.pending() {
+		requests += d.Requests
+		errors += d.Errors
+		if d.Client == otherClients && (d.Requests != 4901 || d.Errors != 4900) {
+			t.Errorf("other = %+v, want the 4901 requests past the limit", d)
+		}
+	}
+	if requests != 5001 || errors != 5000 {
+		t.Errorf("pending adds up to %d requests and %d errors, want 5001 and 5000", requests, errors)
+	}
+
+	// Once the addresses go quiet and are flushed, pruning makes room.
+	tracker.markFlushed(tracker.pending())
+	clk.Advance(time.Minute)
+	tracker.observe("key:ci", false, 100)
+	if n := tracker.prune(time.Minute, true); n != 100 {
+		t.Errorf("pruned %d addresses, want 100", n)
+	}
+	tracker.observe("203.0.113.9", false, 100)
+	if _, ok := tracker.clients["203.0.113.9"]; !ok {
+		t.Error("a new address isn't tracked after the prune")
+	}
+}
+
+func TestClientMetricsBounded(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.MetricsClientLimit = 50 })
+	for i := 0; i < 3000; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/albums", nil)
+		req.RemoteAddr = fmt.Sprintf("10.0.%d.%d:5000", i/256, i%256)
+		s.handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	// The flush keeps the stored clients to the same limit.
+	if err := newMetricsFlusher(s.metrics, s.clock, time.Minute, 10).write(context.Background(), snapshotMetrics()); err != nil {
+		t.Fatal(err)
+	}
+	if stored, _ := s.metrics.LoadClientMetrics(context.Background()); len(stored) > 51 {
+		t.Errorf("stored %d clients, want at most 50 and other", len(stored))
+	}
+
+	page := decodeBody[clientMetricsPage](t, s.admin(http.MethodGet, "/admin/metrics/clients?limit=20&offset=10", ""))
+	if page.Total > 50 || len(page.Clients) != 20 || page.Limit != 20 || page.Offset != 10 {
+		t.Fatalf("page = %+v, want 20 of at most 50 clients", page)
+	}
+	all := decodeBody[clientMetricsPage](t, s.admin(http.MethodGet, "/admin/metrics/clients?limit=1000", ""))
+	sum := all.Other.Requests
+	for i, c := range all.Clients {
+		if i > 0 && c.Requests > all.Clients[i-1].Requests {
+			t.Errorf("%s with %d requests after %s with %d", c.Client, c.Requests, all.Clients[i-1].Client, all.Clients[i-1].Requests)
+		}
+		sum += c.Requests
+	}
+	// The first admin request is counted too, under other with the limit
+	// reached.
+	if sum != 3001 {
+		t.Errorf("the clients and other add up to %d requests, want 3001", sum)
+	}
+}
+
+func TestParsePageLocalized(t *testing.T) {
+	s := newTestServer(t)
+	for _, tc := range []struct{ query, lang, detail string }{
+		{"limit=5000", "fr", "limit doit être un nombre de 1 à 1000"},
+		{"limit=0", "es", "limit debe ser un número de 1 a 1000"},
+		{"limit=5000", "en", "limit must be a number from 1 to 1000"},
+		{"offset=-1", "fr", "offset doit être un nombre positif ou nul"},
+	} {
+		p := expectProblem(t, s.admin(http.MethodGet, "/admin/metrics/clients?"+tc.query, "", "Accept-Language", tc.lang), http.StatusBadRequest)
+		if p.Detail != tc.detail {
+			t.Errorf("%s in %s: %q, want %q", tc.query, tc.lang, p.Detail, tc.detail)
+		}
+	}
+	// The template is translated whatever the maximum.
+	r := httptest.NewRequest(http.MethodGet, "/?limit=300", nil)
+	r.Header.Set("Accept-Language", "es")
+	if _, _, err := parsePage(r, 10, 250); err == nil || err.Error() != "limit debe ser un número de 1 a 250" {
+		t.Errorf("parsePage with a maximum of 250: %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/client"
+	"github.com/brentmzey/web-service-go/money"
+)
+
+// newTestClient serves s over HTTP and returns a client for it.
+func newTestClient(t *testing.T, s *testServer, h http.Handler, opts ...client.Option) *client.Client {
+	t.Helper()
+	if h == nil {
+		h = s.handler
+	}
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	c, err := client.New(srv.URL, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClientAlbums(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.AlbumsPageSize = 2
+		cfg.AlbumsMaxPageSize = 2
+	})
+	c := newTestClient(t, s, nil)
+	ctx := context.Background()
+
+	created, err := c.CreateAlbum(ctx, inputOf(newTestAlbum()).AlbumInput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == "" || created.Slug == "" {
+		t.Errorf("CreateAlbum = %+v, want an ID and a slug", created)
+	}
+	got, err := c.GetAlbum(ctx, created.ID)
+	if err != nil || got.Title != "Blue Train" {
+		t.Errorf("GetAlbum = %+v, %v", got, err)
+	}
+	in := inputOf(newTestAlbum(withPrice(3999))).AlbumInput
+	if updated, err := c.UpdateAlbum(ctx, created.ID, in); err != nil || updated.Price != money.FromCents(3999) {
+		t.Errorf("UpdateAlbum = %+v, %v; want the price 39.99", updated, err)
+	}
+	if patched, err := c.PatchAlbum(ctx, created.ID, map[string]interface{}{"year": 1958}); err != nil || patched.Year != 1958 {
+		t.Errorf("PatchAlbum = %+v, %v; want the year 1958", patched, err)
+	}
+
+	// ListAlbums follows the pages the server cuts the listing into.
+	for i := 0; i < 4; i++ {
+		if _, err := c.CreateAlbum(ctx, inputOf(newTestAlbum(withTitle(fmt.Sprintf("Giant Steps %d", i)))).AlbumInput); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list, err := c.ListAlbums(ctx, client.ListOptions{Artist: "John Coltrane"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 5 {
+		t.Errorf("ListAlbums = %d albums, want all 5", len(list))
+	}
+	if list, _ := c.ListAlbums(ctx, client.ListOptions{Artist: "Miles Davis"}); len(list) != 0 {
+		t.Errorf("ListAlbums by another artist = %d albums, want none", len(list))
+	}
+
+	m, err := c.Metrics(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.TotalAlbumsAdded != 5 {
+		t.Errorf("Metrics reports %d albums added, want 5", m.TotalAlbumsAdded)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	s := newTestServer(t)
+	c := newTestClient(t, s, nil)
+	ctx := context.Background()
+
+	_, err := c.GetAlbum(ctx, "no-such-album")
+	var apiErr *client.Error
+	if !errors.Is(err, client.ErrNotFound) || !errors.As(err, &apiErr) || apiErr.Detail == "" {
+		t.Errorf("GetAlbum of a missing album = %v, want ErrNotFound with the problem's detail", err)
+	}
+	if _, err := c.CreateAlbum(ctx, inputOf(newTestAlbum(withBarcode("036000291453"))).AlbumInput); !errors.Is(err, client.ErrInvalid) {
+		t.Errorf("CreateAlbum with a bad barcode = %v, want ErrInvalid", err)
+	}
+	a := s.create(newTestAlbum(withBarcode("036000291452")))
+	if _, err := c.CreateAlbum(ctx, inputOf(newTestAlbum(withBarcode(a.Barcode))).AlbumInput); !errors.Is(err, client.ErrConflict) {
+		t.Errorf("CreateAlbum with a taken barcode = %v, want ErrConflict", err)
+	}
+	if _, err := newTestClient(t, s, nil, client.WithAPIKey(apiKeyPrefix+"nonsense")).GetAlbum(ctx, a.ID); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("GetAlbum with a bad key = %v, want ErrUnauthorized", err)
+	}
+	t.Cleanup(func() { setMaintenance(maintenanceOff) })
+	setMaintenance(maintenanceFull)
+	if _, err := c.GetAlbum(ctx, a.ID); !errors.Is(err, client.ErrUnavailable) {
+		t.Errorf("GetAlbum during maintenance = %v, want ErrUnavailable", err)
+	}
+}
+
+func TestClientRetriesRateLimits(t *testing.T) {
+	s := newTestServer(t)
+	a := s.create(newTestAlbum())
+	ctx := context.Background()
+	// The first two requests are turned away as rate limited.
+	var requests atomic.Int32
+	limited := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= 2 {
+			w.Header().Set("Retry-After", "0")
+			writeProblem(w, r, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		s.handler.ServeHTTP(w, r)
+	})
+
+	c := newTestClient(t, s, limited)
+	if got, err := c.GetAlbum(ctx, a.ID); err != nil || got.ID != a.ID {
+		t.Errorf("GetAlbum after two 429s = %+v, %v; want the album", got, err)
+	}
+	if n := requests.Load(); n != 3 {
+		t.Errorf("%d requests sent, want 3", n)
+	}
+
+	requests.Store(0)
+	c = newTestClient(t, s, limited, client.WithRetries(1, time.Second))
+	if _, err := c.GetAlbum(ctx, a.ID); !errors.Is(err, client.ErrRateLimited) {
+		t.Errorf("GetAlbum with one retry = %v, want ErrRateLimited", err)
+	}
+
+	// A wait longer than the client will wait isn't retried.
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Retry-After", "3600")
+		writeProblem(w, r, http.StatusTooManyRequests, "rate limit exceeded")
+	})
+	requests.Store(0)
+	_, err := newTestClient(t, s, slow).GetAlbum(ctx, a.ID)
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.RetryAfter != time.Hour || requests.Load() != 1 {
+		t.Errorf("GetAlbum told to wait an hour = %v after %d requests, want ErrRateLimited at once", err, requests.Load())
+	}
+}
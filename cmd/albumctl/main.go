@@ -0,0 +1,487 @@
+// Command albumctl manages the album catalog from the command line, through
+// the Go client.
+//
+//	albumctl [--url URL] [--api-key KEY] [--json] <command> [flags] [args]
+//
+// The server URL and API key default to ALBUMCTL_URL and ALBUMCTL_API_KEY.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/brentmzey/web-service-go/client"
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// Exit codes, so scripts can tell failures apart.
+const (
+	exitOK        = 0
+	exitFailure   = 1 // any other error reported by the server
+	exitUsage     = 2
+	exitNotFound  = 3
+	exitInvalid   = 4 // the server rejected the input
+	exitTransport = 5 // the server couldn't be reached
+)
+
+const usage = `Usage: albumctl [--url URL] [--api-key KEY] [--json] <command> [flags] [args]
+
+Commands:
+  list      [--artist A] [--genre G] [--q TEXT] [--sort FIELD] [--limit N]
+  get       ID
+  create    [--file FILE | --title T --artist A --price P ...]
+  update    ID [--file FILE | --title T --artist A --price P ...]
+  export    [--format json|ndjson] [--output FILE]
+  import    --mode replace|merge [--format json|ndjson] FILE
+  metrics
+
+Exit codes: 0 ok, 1 server error, 2 usage, 3 not found, 4 invalid input,
+5 server unreachable.
+`
+
+func main() {
+	os.Exit(run(context.Background(), os.Args[1:], os.Stdin, os.Stdout, os.Stderr, os.Getenv))
+}
+
+// cli is one invocation: the client and where output goes.
+type cli struct {
+	client *client.Client
+	json   bool
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+// errUsage marks a mistake on the command line; run has already been told
+// what it was.
+var errUsage = errors.New("usage")
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer, getenv func(string) string) int {
+	global := flag.NewFlagSet("albumctl", flag.ContinueOnError)
+	global.SetOutput(stderr)
+	global.Usage = func() { fmt.Fprint(stderr, usage) }
+	baseURL := global.String("url", envOr(getenv, "ALBUMCTL_URL", "http://localhost:8080"), "server URL")
+	apiKey := global.String("api-key", getenv("ALBUMCTL_API_KEY"), "API key, sent as a bearer token")
+	asJSON := global.Bool("json", false, "print JSON instead of text")
+	if err := global.Parse(args); err != nil {
+		return exitUsage
+	}
+	if global.NArg() == 0 {
+		fmt.Fprint(stderr, usage)
+		return exitUsage
+	}
+	c, err := client.New(*baseURL, client.WithAPIKey(*apiKey))
+	if err != nil {
+		fmt.Fprintln(stderr, "albumctl:", err)
+		return exitUsage
+	}
+	cmd := &cli{client: c, json: *asJSON, stdin: stdin, stdout: stdout}
+
+	commands := map[string]func(context.Context, *flag.FlagSet, []string) error{
+		"list":    cmd.list,
+		"get":     cmd.get,
+		"create":  cmd.create,
+		"update":  cmd.update,
+		"export":  cmd.export,
+		"import":  cmd.importCatalog,
+		"metrics": cmd.metrics,
+	}
+	name, rest := global.Arg(0), global.Args()[1:]
+	fn, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "albumctl: unknown command %q\n\n%s", name, usage)
+		return exitUsage
+	}
+	fs := flag.NewFlagSet("albumctl "+name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	err = fn(ctx, fs, rest)
+	if err == nil {
+		return exitOK
+	}
+	if !errors.Is(err, errUsage) {
+		fmt.Fprintln(stderr, "albumctl:", err)
+	}
+	return exitCode(err)
+}
+
+func exitCode(err error) int {
+	var apiErr *client.Error
+	switch {
+	case errors.Is(err, errUsage), errors.Is(err, flag.ErrHelp):
+		return exitUsage
+	case errors.Is(err, client.ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, client.ErrInvalid):
+		return exitInvalid
+	case errors.As(err, &apiErr):
+		return exitFailure
+	default:
+		// Anything that isn't a response from the server: refused
+		// connections, DNS, timeouts, a body cut off mid-way.
+		return exitTransport
+	}
+}
+
+func envOr(getenv func(string) string, key, fallback string) string {
+	if v := getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// parse parses fs and checks it left exactly nargs arguments. Flags may come
+// before or after the arguments, as in "update ID --price 9.99".
+func parse(fs *flag.FlagSet, args []string, nargs int, what string) error {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return errUsage
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(positional) != nargs {
+		fmt.Fprintf(fs.Output(), "%s: expected %s\n", fs.Name(), what)
+		return errUsage
+	}
+	// Leave the arguments where fs.Arg finds them.
+	return fs.Parse(append([]string{"--"}, positional...))
+}
+
+func (c *cli) list(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	var opts client.ListOptions
+	fs.StringVar(&opts.Artist, "artist", "", "only albums by this artist")
+	fs.StringVar(&opts.Genre, "genre", "", "only albums in this genre")
+	fs.StringVar(&opts.Query, "q", "", "free-text search")
+	sortBy := fs.String("sort", "", "sort by title, artist, price, or year; prefix with - to reverse")
+	limit := fs.Int("limit", 0, "print at most this many albums")
+	if err := parse(fs, args, 0, "no arguments"); err != nil {
+		return err
+	}
+	albums, err := c.client.ListAlbums(ctx, opts)
+	if err != nil {
+		return err
+	}
+	if *sortBy != "" {
+		if err := sortAlbums(albums, *sortBy); err != nil {
+			fmt.Fprintf(fs.Output(), "%s: %v\n", fs.Name(), err)
+			return errUsage
+		}
+	}
+	if *limit > 0 && len(albums) > *limit {
+		albums = albums[:*limit]
+	}
+	if c.json {
+		return c.printJSON(albums)
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTITLE\tARTIST\tPRICE\tYEAR")
+	for _, a := range albums {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", a.ID, a.Title, a.Artist, a.Price, yearString(a.Year))
+	}
+	return tw.Flush()
+}
+
+// sortAlbums orders albums by field; the server returns them unordered.
+func sortAlbums(albums []types.Album, field string) error {
+	reverse := strings.HasPrefix(field, "-")
+	var less func(a, b types.Album) bool
+	switch strings.TrimPrefix(field, "-") {
+	case "title":
+		less = func(a, b types.Album) bool { return strings.ToLower(a.Title) < strings.ToLower(b.Title) }
+	case "artist":
+		less = func(a, b types.Album) bool { return strings.ToLower(a.Artist) < strings.ToLower(b.Artist) }
+	case "price":
+		less = func(a, b types.Album) bool { return a.Price < b.Price }
+	case "year":
+		less = func(a, b types.Album) bool { return a.Year < b.Year }
+	default:
+		return fmt.Errorf("cannot sort by %q", field)
+	}
+	sort.SliceStable(albums, func(i, j int) bool {
+		if reverse {
+			return less(albums[j], albums[i])
+		}
+		return less(albums[i], albums[j])
+	})
+	return nil
+}
+
+func (c *cli) get(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	if err := parse(fs, args, 1, "an album ID"); err != nil {
+		return err
+	}
+	a, err := c.client.GetAlbum(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	return c.printAlbum(a)
+}
+
+// albumFlags registers the flags that set album fields, for create and
+// update.
+type albumFlags struct {
+	file   string
+	input  types.AlbumInput
+	tracks trackList
+}
+
+type trackList []string
+
+func (t *trackList) String() string     { return strings.Join(*t, ", ") }
+func (t *trackList) Set(v string) error { *t = append(*t, v); return nil }
+
+func (f *albumFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.file, "file", "", "read the album as JSON from this file (- for stdin)")
+	fs.StringVar(&f.input.Title, "title", "", "title")
+	fs.StringVar(&f.input.Artist, "artist", "", "artist")
+	fs.Var(&f.input.Price, "price", "price")
+	fs.StringVar(&f.input.Genre, "genre", "", "genre")
+	fs.StringVar(&f.input.Barcode, "barcode", "", "UPC or EAN barcode")
+	fs.IntVar(&f.input.Year, "year", 0, "release year")
+	fs.Var(&f.tracks, "track", "track title; repeat for each track")
+}
+
+// apply fills in from the --file JSON or the flags that were set on the
+// command line, leaving the other fields of in as they are.
+func (f *albumFlags) apply(fs *flag.FlagSet, c *cli, in *types.AlbumInput) error {
+	if f.file != "" {
+		var r io.Reader = c.stdin
+		if f.file != "-" {
+			file, err := os.Open(f.file)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+			r = file
+		}
+		if err := json.NewDecoder(r).Decode(in); err != nil {
+			fmt.Fprintf(fs.Output(), "%s: reading %s: %v\n", fs.Name(), f.file, err)
+			return errUsage
+		}
+		return nil
+	}
+	fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "title":
+			in.Title = f.input.Title
+		case "artist":
+			in.Artist = f.input.Artist
+		case "price":
+			in.Price = f.input.Price
+		case "genre":
+			in.Genre = f.input.Genre
+		case "barcode":
+			in.Barcode = f.input.Barcode
+		case "year":
+			in.Year = f.input.Year
+		case "track":
+			in.Tracks = f.tracks
+		}
+	})
+	return nil
+}
+
+func (c *cli) create(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	var f albumFlags
+	f.register(fs)
+	if err := parse(fs, args, 0, "no arguments"); err != nil {
+		return err
+	}
+	var in types.AlbumInput
+	if err := f.apply(fs, c, &in); err != nil {
+		return err
+	}
+	a, err := c.client.CreateAlbum(ctx, in)
+	if err != nil {
+		return err
+	}
+	return c.printAlbum(a)
+}
+
+// update changes only the fields given. The server replaces every field on
+// update, so the album is fetched first and the rest are sent back as they
+// were.
+func (c *cli) update(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	var f albumFlags
+	f.register(fs)
+	if err := parse(fs, args, 1, "an album ID"); err != nil {
+		return err
+	}
+	id := fs.Arg(0)
+	current, err := c.client.GetAlbum(ctx, id)
+	if err != nil {
+		return err
+	}
+	in := types.AlbumInput{
+		Title:          current.Title,
+		Artist:         current.Artist,
+		Price:          current.Price,
+		Genre:          current.Genre,
+		Barcode:        current.Barcode,
+		Year:           current.Year,
+		Tracks:         current.Tracks,
+		Metadata:       current.Metadata,
+		Stock:          current.Stock,
+		AvailableFrom:  current.AvailableFrom,
+		AvailableUntil: current.AvailableUntil,
+	}
+	if err := f.apply(fs, c, &in); err != nil {
+		return err
+	}
+	a, err := c.client.UpdateAlbum(ctx, id, in)
+	if err != nil {
+		return err
+	}
+	return c.printAlbum(a)
+}
+
+func (c *cli) export(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	format := fs.String("format", "json", "json, or ndjson for gzipped NDJSON")
+	output := fs.String("output", "", "write the backup to this file instead of stdout")
+	if err := parse(fs, args, 0, "no arguments"); err != nil {
+		return err
+	}
+	w := c.stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	return c.client.ExportCatalog(ctx, *format, w)
+}
+
+func (c *cli) importCatalog(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	mode := fs.String("mode", "", "replace the catalog, or merge into it")
+	format := fs.String("format", "json", "json or ndjson; gzipped files are detected by the server")
+	if err := parse(fs, args, 1, "a backup file (- for stdin)"); err != nil {
+		return err
+	}
+	var r io.Reader = c.stdin
+	if fs.Arg(0) != "-" {
+		file, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+	n, err := c.client.ImportCatalog(ctx, *mode, *format, r)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(map[string]interface{}{"mode": *mode, "imported": n})
+	}
+	_, err = fmt.Fprintf(c.stdout, "Imported %d albums (%s)\n", n, *mode)
+	return err
+}
+
+func (c *cli) metrics(ctx context.Context, fs *flag.FlagSet, args []string) error {
+	if err := parse(fs, args, 0, "no arguments"); err != nil {
+		return err
+	}
+	m, err := c.client.Metrics(ctx)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(m)
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	for _, row := range []struct {
+		name  string
+		value interface{}
+	}{
+		{"Requests", m.TotalRequests},
+		{"Errors", m.TotalErrors},
+		{"Albums fetched", m.TotalAlbumsFetched},
+		{"Albums added", m.TotalAlbumsAdded},
+		{"Rate limited", m.TotalRateLimited},
+		{"Average latency", strconv.FormatInt(m.AverageLatencyMs, 10) + "ms"},
+		{"In flight", m.InFlightRequests},
+		{"Shed", m.TotalOverloadShed},
+		{"Store retries", m.TotalStoreRetries},
+		{"Secondary write failures", m.TotalSecondaryWriteFailures},
+		{"Negative cache hits", m.TotalNegativeCacheHits},
+		{"Maintenance", m.MaintenanceMode},
+	} {
+		fmt.Fprintf(tw, "%s:\t%v\n", row.name, row.value)
+	}
+	names := make([]string, 0, len(m.CircuitBreakers))
+	for name := range m.CircuitBreakers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(tw, "Breaker %s:\t%s\n", name, m.CircuitBreakers[name])
+	}
+	return tw.Flush()
+}
+
+func (c *cli) printAlbum(a types.Album) error {
+	if c.json {
+		return c.printJSON(a)
+	}
+	tw := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "ID:\t%s\n", a.ID)
+	fmt.Fprintf(tw, "Title:\t%s\n", a.Title)
+	fmt.Fprintf(tw, "Artist:\t%s\n", a.Artist)
+	fmt.Fprintf(tw, "Price:\t%s\n", a.Price)
+	fmt.Fprintf(tw, "Slug:\t%s\n", a.Slug)
+	if a.Genre != "" {
+		fmt.Fprintf(tw, "Genre:\t%s\n", a.Genre)
+	}
+	if a.Barcode != "" {
+		fmt.Fprintf(tw, "Barcode:\t%s\n", a.Barcode)
+	}
+	if a.Year != 0 {
+		fmt.Fprintf(tw, "Year:\t%d\n", a.Year)
+	}
+	if a.AvailableFrom != nil {
+		fmt.Fprintf(tw, "Available from:\t%s\n", a.AvailableFrom.Format(time.RFC3339))
+	}
+	if a.AvailableUntil != nil {
+		fmt.Fprintf(tw, "Available until:\t%s\n", a.AvailableUntil.Format(time.RFC3339))
+	}
+	for i, track := range a.Tracks {
+		fmt.Fprintf(tw, "Track %d:\t%s\n", i+1, track)
+	}
+	keys := make([]string, 0, len(a.Metadata))
+	for key := range a.Metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(tw, "%s:\t%s\n", key, a.Metadata[key])
+	}
+	return tw.Flush()
+}
+
+func (c *cli) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func yearString(year int) string {
+	if year == 0 {
+		return ""
+	}
+	return strconv.Itoa(year)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// fakeCatalog serves the endpoints albumctl calls from an in-memory
+// catalog, answering problems the way the service does.
+type fakeCatalog struct {
+	mu     sync.Mutex
+	albums []types.Album
+}
+
+func (f *fakeCatalog) handler() http.Handler {
+	problem := func(w http.ResponseWriter, status int, detail string) {
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(types.Problem{Title: http.StatusText(status), Status: status, Detail: detail})
+	}
+	find := func(id string) int {
+		for i, a := range f.albums {
+			if a.ID == id {
+				return i
+			}
+		}
+		return -1
+	}
+	save := func(w http.ResponseWriter, r *http.Request, id string, status int) {
+		var in types.AlbumInput
+		if err := json.NewDecoder(r.Body).Decode(&in); err != nil || in.Title == "" {
+			problem(w, http.StatusBadRequest, "title is required")
+			return
+		}
+		a := types.Album{ID: id, Title: in.Title, Artist: in.Artist, Price: in.Price, Genre: in.Genre, Year: in.Year, Tracks: in.Tracks, Slug: strings.ToLower(strings.ReplaceAll(in.Title, " ", "-"))}
+		if i := find(id); i >= 0 {
+			f.albums[i] = a
+		} else {
+			f.albums = append(f.albums, a)
+		}
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(a)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /albums", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		albums := []types.Album{}
+		for _, a := range f.albums {
+			if artist := r.URL.Query().Get("artist"); artist == "" || a.Artist == artist {
+				albums = append(albums, a)
+			}
+		}
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(albums)))
+		if offset, _ := strconv.Atoi(r.URL.Query().Get("offset")); offset > 0 {
+			albums = albums[min(offset, len(albums)):]
+		}
+		json.NewEncoder(w).Encode(albums)
+	})
+	mux.HandleFunc("GET /albums/{id}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		i := find(r.PathValue("id"))
+		if i < 0 {
+			problem(w, http.StatusNotFound, "album not found")
+			return
+		}
+		json.NewEncoder(w).Encode(f.albums[i])
+	})
+	mux.HandleFunc("POST /albums", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		save(w, r, strconv.Itoa(len(f.albums)+1), http.StatusCreated)
+	})
+	mux.HandleFunc("PUT /albums/{id}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if find(r.PathValue("id")) < 0 {
+			problem(w, http.StatusNotFound, "album not found")
+			return
+		}
+		save(w, r, r.PathValue("id"), http.StatusOK)
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		json.NewEncoder(w).Encode(types.MetricsReport{TotalRequests: 7, TotalAlbumsAdded: int64(len(f.albums)), MaintenanceMode: "off"})
+	})
+	mux.HandleFunc("GET /admin/export", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer admin-token" {
+			problem(w, http.StatusUnauthorized, "admin token required")
+			return
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		json.NewEncoder(w).Encode(f.albums)
+	})
+	return mux
+}
+
+// albumctl runs the CLI against url with args, and returns its exit code
+// and what it wrote.
+func albumctl(t *testing.T, url string, stdin string, args ...string) (code int, stdout, stderr string) {
+	t.Helper()
+	var out, errOut bytes.Buffer
+	getenv := func(key string) string {
+		if key == "ALBUMCTL_URL" {
+			return url
+		}
+		return ""
+	}
+	code = run(context.Background(), args, strings.NewReader(stdin), &out, &errOut, getenv)
+	return code, out.String(), errOut.String()
+}
+
+func newFakeCatalog(t *testing.T, albums ...types.Album) string {
+	srv := httptest.NewServer((&fakeCatalog{albums: albums}).handler())
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestAlbumctlList(t *testing.T) {
+	url := newFakeCatalog(t,
+		types.Album{ID: "1", Title: "Giant Steps", Artist: "John Coltrane", Price: 17.99, Year: 1960},
+		types.Album{ID: "2", Title: "Blue Train", Artist: "John Coltrane", Price: 56.99, Year: 1957},
+		types.Album{ID: "3", Title: "Kind of Blue", Artist: "Miles Davis", Price: 39.99},
+	)
+
+	code, out, _ := albumctl(t, url, "", "list", "--artist", "John Coltrane", "--sort", "year")
+	if code != exitOK {
+		t.Fatalf("list exited %d", code)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "ID") || !strings.Contains(lines[1], "Blue Train") || !strings.Contains(lines[2], "Giant Steps") {
+		t.Errorf("list --sort year printed\n%s\nwant a header, then Blue Train before Giant Steps", out)
+	}
+
+	code, out, _ = albumctl(t, url, "", "--json", "list", "--sort", "-price", "--limit", "1")
+	var albums []types.Album
+	if err := json.Unmarshal([]byte(out), &albums); err != nil || code != exitOK {
+		t.Fatalf("list --json exited %d: %v", code, err)
+	}
+	if len(albums) != 1 || albums[0].ID != "2" {
+		t.Errorf("list --json --sort -price --limit 1 = %+v, want just Blue Train", albums)
+	}
+
+	if code, _, errOut := albumctl(t, url, "", "list", "--sort", "label"); code != exitUsage || !strings.Contains(errOut, `cannot sort by "label"`) {
+		t.Errorf("list --sort label exited %d: %s", code, errOut)
+	}
+}
+
+func TestAlbumctlCreateAndUpdate(t *testing.T) {
+	url := newFakeCatalog(t)
+
+	code, out, errOut := albumctl(t, url, "", "create", "--title", "Blue Train", "--artist", "John Coltrane", "--price", "56.99", "--track", "Blue Train", "--track", "Moment's Notice")
+	if code != exitOK {
+		t.Fatalf("create exited %d: %s", code, errOut)
+	}
+	for _, want := range []string{"ID:", "Blue Train", "56.99", "Track 2:", "Moment's Notice"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("create printed\n%s\nwant %q in it", out, want)
+		}
+	}
+
+	// update leaves the fields it isn't given as they were.
+	code, out, _ = albumctl(t, url, "", "--json", "update", "1", "--price", "39.99")
+	var a types.Album
+	if err := json.Unmarshal([]byte(out), &a); err != nil || code != exitOK {
+		t.Fatalf("update --json exited %d: %v", code, err)
+	}
+	if a.Price != 39.99 || a.Title != "Blue Train" || len(a.Tracks) != 2 {
+		t.Errorf("update --price 39.99 = %+v, want the new price and the rest unchanged", a)
+	}
+
+	file := filepath.Join(t.TempDir(), "album.json")
+	if err := os.WriteFile(file, []byte(`{"title": "Lush Life", "artist": "John Coltrane", "price": 21.00}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if code, out, _ := albumctl(t, url, "", "create", "--file", file); code != exitOK || !strings.Contains(out, "Lush Life") {
+		t.Errorf("create --file exited %d:\n%s", code, out)
+	}
+	if code, out, _ := albumctl(t, url, `{"title": "Ballads", "artist": "John Coltrane"}`, "create", "--file", "-"); code != exitOK || !strings.Contains(out, "Ballads") {
+		t.Errorf("create --file - exited %d:\n%s", code, out)
+	}
+	if code, _, _ := albumctl(t, url, "{", "create", "--file", "-"); code != exitUsage {
+		t.Errorf("create from bad JSON exited %d, want %d", code, exitUsage)
+	}
+}
+
+func TestAlbumctlMetrics(t *testing.T) {
+	url := newFakeCatalog(t, types.Album{ID: "1", Title: "Blue Train"})
+	code, out, _ := albumctl(t, url, "", "metrics")
+	if code != exitOK || !strings.Contains(out, "Requests:") || !strings.Contains(out, "Maintenance:") {
+		t.Errorf("metrics exited %d:\n%s", code, out)
+	}
+	code, out, _ = albumctl(t, url, "", "--json", "metrics")
+	var m types.MetricsReport
+	if err := json.Unmarshal([]byte(out), &m); err != nil || code != exitOK || m.TotalRequests != 7 || m.TotalAlbumsAdded != 1 {
+		t.Errorf("metrics --json exited %d: %+v, %v", code, m, err)
+	}
+}
+
+func TestAlbumctlExport(t *testing.T) {
+	url := newFakeCatalog(t, types.Album{ID: "1", Title: "Blue Train"})
+	if code, _, errOut := albumctl(t, url, "", "export"); code != exitFailure || !strings.Contains(errOut, "admin token required") {
+		t.Errorf("export without the admin token exited %d: %s", code, errOut)
+	}
+	output := filepath.Join(t.TempDir(), "backup.json")
+	if code, _, errOut := albumctl(t, url, "", "--api-key", "admin-token", "export", "--output", output); code != exitOK {
+		t.Fatalf("export exited %d: %s", code, errOut)
+	}
+	if data, err := os.ReadFile(output); err != nil || !strings.Contains(string(data), "Blue Train") {
+		t.Errorf("the backup holds %q, %v", data, err)
+	}
+}
+
+func TestAlbumctlExitCodes(t *testing.T) {
+	url := newFakeCatalog(t, types.Album{ID: "1", Title: "Blue Train"})
+	// A server that was there, and is closed by the time albumctl calls it.
+	gone := httptest.NewServer(http.NotFoundHandler())
+	gone.Close()
+
+	for _, tc := range []struct {
+		url  string
+		args []string
+		want int
+	}{
+		{url, []string{"get", "1"}, exitOK},
+		{url, []string{"get", "2"}, exitNotFound},
+		{url, []string{"update", "2", "--price", "1.00"}, exitNotFound},
+		{url, []string{"create", "--artist", "John Coltrane"}, exitInvalid},
+		{gone.URL, []string{"get", "1"}, exitTransport},
+		{gone.URL, []string{"list"}, exitTransport},
+		{url, []string{}, exitUsage},
+		{url, []string{"delete-everything"}, exitUsage},
+		{url, []string{"get"}, exitUsage},
+		{url, []string{"get", "1", "2"}, exitUsage},
+		{url, []string{"list", "--nope"}, exitUsage},
+		{url, []string{"--url", "ftp://albums", "list"}, exitUsage},
+	} {
+		if code, _, errOut := albumctl(t, tc.url, "", tc.args...); code != tc.want {
+			t.Errorf("albumctl %s exited %d, want %d: %s", strings.Join(tc.args, " "), code, tc.want, errOut)
+		}
+	}
+}
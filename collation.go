@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+// collationMatcher picks the collation locale an Accept-Language header
+// asks for among those golang.org/x/text/collate has rules for.
+var collationMatcher = language.NewMatcher(collate.Supported())
+
+// rootCollation folds text with the root case rules and without
+// diacritics, the coarsest folding there is. The stores keep search keys
+// folded this way, so every other folding only ever narrows what they find.
+var rootCollation = textCollation{tag: language.Und}
+
+// markFreeLetters are the lowercase letters with a diacritic that NFKD
+// doesn't split off, mapped to their base letter when diacritics are
+// stripped. The Turkish dotless i isn't one of them, see textCollation.fold.
+var markFreeLetters = strings.NewReplacer("ø", "o", "ł", "l", "đ", "d", "ħ", "h", "ŧ", "t")
+
+// textCollation is how a request's text is matched and sorted: in the case
+// rules and order of a locale, with diacritics kept or stripped. The zero
+// locale, language.Und, sorts folded text by code point, which orders ASCII
+// as it always was.
+type textCollation struct {
+	tag       language.Tag
+	keepMarks bool
+}
+
+// requestCollation is the collation of r: COLLATION_LOCALE, or the locale
+// its Accept-Language picks when COLLATION_LOCALE is set, and diacritics
+// stripped unless SEARCH_KEEP_DIACRITICS.
+func requestCollation(r *http.Request) textCollation {
+	cfg := currentConfig()
+	c := textCollation{tag: language.Und, keepMarks: cfg.SearchKeepDiacritics}
+	if cfg.CollationLocale == "" {
+		return c
+	}
+	c.tag = language.Make(cfg.CollationLocale)
+	if tags, _, err := language.ParseAcceptLanguage(r.Header.Get("Accept-Language")); err == nil && len(tags) > 0 {
+		if tag, _, confidence := collationMatcher.Match(tags...); confidence >= language.High {
+			c.tag = tag
+		}
+	}
+	return c
+}
+
+// varyCollation marks a response as depending on Accept-Language when the
+// collation may come from it.
+func varyCollation(w http.ResponseWriter) {
+	if currentConfig().CollationLocale != "" {
+		w.Header().Add("Vary", "Accept-Language")
+	}
+}
+
+// turkic reports whether the locale has the Turkish dotted and dotless i.
+func (c textCollation) turkic() bool {
+	base, _ := c.tag.Base()
+	return base.String() == "tr" || base.String() == "az"
+}
+
+// fold normalizes s for comparison: NFKD, so compatibility forms such as
+// ligatures and full-width letters match their plain letters; case
+// folding, so "ß" matches "ss"; and, unless keepMarks, diacritics stripped,
+// so "Émigré" matches "emigre". In Turkish and Azeri "I" folds to the
+// dotless "ı" and "İ" to "i", and "ı" stays a letter of its own; elsewhere
+// "İ" and "ı" both fold to "i" once diacritics are stripped.
+func (c textCollation) fold(s string) string {
+	if c.turkic() {
+		s = cases.Lower(language.Turkish).String(s)
+	}
+	s = cases.Fold().String(norm.NFKD.String(s))
+	if !c.keepMarks {
+		s, _, _ = transform.String(runes.Remove(runes.In(unicode.Mn)), s)
+		s = markFreeLetters.Replace(s)
+		if !c.turkic() {
+			s = strings.ReplaceAll(s, "ı", "i")
+		}
+	}
+	return norm.NFC.String(s)
+}
+
+// terms splits q into its folded words, see searchTerms.
+func (c textCollation) terms(q string) []string {
+	return strings.FieldsFunc(c.fold(q), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// searchKey is the key the stores keep to narrow q searches: the words of
+// an album's title and artist as rootCollation folds them, each after a
+// space, so that a LIKE for " " plus a term finds the words it starts.
+func searchKey(title, artist string) string {
+	terms := rootCollation.terms(title + " " + artist)
+	if len(terms) == 0 {
+		return ""
+	}
+	return " " + strings.Join(terms, " ")
+}
+
+// sortKeys computes the sort key of every value once, so that sorting
+// compares keys instead of folding or collating text on every comparison.
+// Keys compare with strings.Compare.
+func (c textCollation) sortKeys(values []string) []string {
+	keys := make([]string, len(values))
+	if c.tag == language.Und {
+		for i, v := range values {
+			keys[i] = c.fold(v)
+		}
+		return keys
+	}
+	opts := []collate.Option{collate.IgnoreCase, collate.IgnoreWidth}
+	if !c.keepMarks {
+		opts = append(opts, collate.IgnoreDiacritics)
+	}
+	collator := collate.New(c.tag, opts...)
+	buf := &collate.Buffer{}
+	for i, v := range values {
+		keys[i] = string(collator.KeyFromString(buf, v))
+		buf.Reset()
+	}
+	return keys
+}
+
+// String identifies the collation in cache keys.
+func (c textCollation) String() string {
+	if c.keepMarks {
+		return c.tag.String() + "+marks"
+	}
+	return c.tag.String()
+}
+
+// searchKeyBatch is how many albums a store computes the search keys of at
+// a time.
+const searchKeyBatch = 500
+
+// keylessAlbum is an album a store keeps no search key for: one written
+// before there were keys, or by an older version since.
+type keylessAlbum struct {
+	ID, Title, Artist string
+}
+
+// fillSearchKeys sets the search key of every album a store keeps none for,
+// which each store does as it starts. next returns the next albums without
+// one, up to searchKeyBatch; set stores the key of one, after which next
+// doesn't return it again.
+func fillSearchKeys(backend string, next func() ([]keylessAlbum, error), set func(id, key string) error) error {
+	filled := 0
+	for {
+		batch, err := next()
+		if err != nil {
+			return fmt.Errorf("computing search keys: %w", err)
+		}
+		for _, a := range batch {
+			if err := set(a.ID, searchKey(a.Title, a.Artist)); err != nil {
+				return fmt.Errorf("computing search keys: %w", err)
+			}
+		}
+		filled += len(batch)
+		if len(batch) < searchKeyBatch {
+			break
+		}
+	}
+	if filled > 0 {
+		log.Printf("🔤 Computed the search keys of %d albums in %s", filled, backend)
+	}
+	return nil
+}
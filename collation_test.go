@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/brentmzey/web-service-go/types"
+	"golang.org/x/text/language"
+)
+
+func TestCollationFold(t *testing.T) {
+	root, marks := textCollation{tag: language.Und}, textCollation{tag: language.Und, keepMarks: true}
+	turkish, turkishMarks := textCollation{tag: language.Turkish}, textCollation{tag: language.Turkish, keepMarks: true}
+	for _, tc := range []struct {
+		c        textCollation
+		in, want string
+	}{
+		{root, "Émigré", "emigre"},
+		{marks, "Émigré", "émigré"},
+		{root, "Øresund", "oresund"},
+		{marks, "Øresund", "øresund"},
+		// ß folds to ss, marks or not.
+		{root, "Straße", "strasse"},
+		{marks, "STRASSE", "strasse"},
+		// Compatibility forms fold to their plain letters.
+		{root, "ﬁne", "fine"},
+		{root, "ＡＢＣ", "abc"},
+		// Without a locale, the Turkish i's all fold to i.
+		{root, "İstanbul", "istanbul"},
+		{root, "ISTANBUL", "istanbul"},
+		{root, "Iğdır", "igdir"},
+		{marks, "ılık", "ılık"},
+		// In Turkish, I is the capital of ı and İ of i.
+		{turkish, "İstanbul", "istanbul"},
+		{turkish, "ISTANBUL", "ıstanbul"},
+		{turkish, "Iğdır", "ıgdır"},
+		{turkishMarks, "Iğdır", "ığdır"},
+		{turkish, "Émigré", "emigre"},
+		// ASCII only changes case.
+		{root, "Blue Train (1957)", "blue train (1957)"},
+	} {
+		if got := tc.c.fold(tc.in); got != tc.want {
+			t.Errorf("%s fold(%q) = %q, want %q", tc.c, tc.in, got, tc.want)
+		}
+	}
+
+	if got := searchKey("Émigré: Straße", "Ø-Band"); got != " emigre strasse o band" {
+		t.Errorf("searchKey = %q", got)
+	}
+	if got := searchKey("", "—"); got != "" {
+		t.Errorf("searchKey of no words = %q", got)
+	}
+}
+
+// sortedTitles sorts albums of the titles by title in c, and returns the
+// titles in their new order.
+func sortedTitles(titles []string, c textCollation) []string {
+	list := make([]album, len(titles))
+	for i, title := range titles {
+		list[i] = newTestAlbum(withTitle(title))
+	}
+	sortSearchResults(list, []searchSort{{field: "title"}}, c)
+	out := make([]string, len(list))
+	for i, a := range list {
+		out[i] = a.Title
+	}
+	return out
+}
+
+func TestCollationSort(t *testing.T) {
+	titles := []string{"Zebra", "Émigré", "apple", "Straße", "Strasse", "emigre"}
+	for _, tc := range []struct {
+		c    textCollation
+		want string
+	}{
+		// Émigré sorts as emigre, not after Zebra, and ties keep their order.
+		{textCollation{tag: language.Und}, "apple Émigré emigre Straße Strasse Zebra"},
+		{textCollation{tag: language.French}, "apple Émigré emigre Straße Strasse Zebra"},
+		// Keeping the marks, the root compares code points, and a locale
+		// puts the accent, and ß, after the plain letters.
+		{textCollation{tag: language.Und, keepMarks: true}, "apple emigre Straße Strasse Zebra Émigré"},
+		{textCollation{tag: language.French, keepMarks: true}, "apple emigre Émigré Strasse Straße Zebra"},
+	} {
+		if got := strings.Join(sortedTitles(titles, tc.c), " "); got != tc.want {
+			t.Errorf("in %s: %s, want %s", tc.c, got, tc.want)
+		}
+	}
+
+	// In Turkish ı comes before i; without a locale it is an i.
+	turkish := []string{"İnce", "Irmak", "Ilgaz", "Işık"}
+	if got := strings.Join(sortedTitles(turkish, textCollation{tag: language.Turkish}), " "); got != "Ilgaz Irmak Işık İnce" {
+		t.Errorf("in Turkish: %s", got)
+	}
+	if got := strings.Join(sortedTitles(turkish, textCollation{tag: language.Und}), " "); got != "Ilgaz İnce Irmak Işık" {
+		t.Errorf("without a locale: %s", got)
+	}
+}
+
+// TestCollationASCIIOrder checks that ASCII titles sort as they did before
+// folding, by their lowercase bytes, with ties kept in order.
+func TestCollationASCIIOrder(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	const alphabet = "aAbBzZ09 -_.()'&"
+	titles := make([]string, 500)
+	for i := range titles {
+		b := make([]byte, 1+rng.Intn(6))
+		for j := range b {
+			b[j] = alphabet[rng.Intn(len(alphabet))]
+		}
+		titles[i] = string(b)
+	}
+	want := slices.Clone(titles)
+	slices.SortStableFunc(want, func(a, b string) int { return strings.Compare(strings.ToLower(a), strings.ToLower(b)) })
+	if got := sortedTitles(titles, textCollation{tag: language.Und}); !slices.Equal(got, want) {
+		t.Errorf("ASCII titles sort as %q, want %q", got[:10], want[:10])
+	}
+}
+
+// useCollation sets COLLATION_LOCALE and SEARCH_KEEP_DIACRITICS on s.
+func useCollation(s *testServer, locale string, keepMarks bool) {
+	cfg := *s.cfg
+	cfg.CollationLocale, cfg.SearchKeepDiacritics = locale, keepMarks
+	liveConfig.Store(&cfg)
+}
+
+func TestCollationSearch(t *testing.T) {
+	s := newTestServer(t)
+	for _, title := range []string{"Émigré", "Straße", "İstanbul", "ISTANBUL", "Blue Train"} {
+		s.create(newTestAlbum(withTitle(title), withArtist("Various")))
+	}
+	found := func(q string, headers ...string) string {
+		t.Helper()
+		w := s.do(http.MethodGet, "/albums?q="+url.QueryEscape(q), "", headers...)
+		expectStatus(t, w, http.StatusOK)
+		var titles []string
+		for _, a := range decodeBody[[]album](t, w) {
+			titles = append(titles, a.Title)
+		}
+		return strings.Join(titles, ", ")
+	}
+	for _, tc := range []struct {
+		locale    string
+		keepMarks bool
+		q, want   string
+		headers   []string
+	}{
+		{q: "emigre", want: "Émigré"},
+		{q: "ÉMIGRÉ", want: "Émigré"},
+		{q: "strasse", want: "Straße"},
+		{q: "straß", want: "Straße"},
+		{q: "istanbul", want: "İstanbul, ISTANBUL"},
+		{q: "blue", want: "Blue Train"},
+		// Kept, the marks must match.
+		{keepMarks: true, q: "emigre", want: ""},
+		{keepMarks: true, q: "émigré", want: "Émigré"},
+		// In Turkish, ISTANBUL is ıstanbul.
+		{locale: "tr", q: "istanbul", want: "İstanbul"},
+		{locale: "tr", q: "ıstanbul", want: "ISTANBUL"},
+		// Accept-Language picks the locale, once there is one.
+		{locale: "en", q: "istanbul", want: "İstanbul", headers: []string{"Accept-Language", "tr-TR"}},
+		{q: "istanbul", want: "İstanbul, ISTANBUL", headers: []string{"Accept-Language", "tr-TR"}},
+	} {
+		useCollation(s, tc.locale, tc.keepMarks)
+		if got := found(tc.q, tc.headers...); got != tc.want {
+			t.Errorf("q=%s in %q (marks %t, %v): %q, want %q", tc.q, tc.locale, tc.keepMarks, tc.headers, got, tc.want)
+		}
+	}
+
+	// A collation from Accept-Language varies the answer by it.
+	useCollation(s, "en", false)
+	w := s.do(http.MethodPost, "/albums/search", `{"sort": [{"field": "title"}]}`, "Accept-Language", "tr")
+	expectStatus(t, w, http.StatusOK)
+	if !slices.Contains(w.Header().Values("Vary"), "Accept-Language") {
+		t.Errorf("Vary %q", w.Header().Values("Vary"))
+	}
+	var titles []string
+	for _, a := range decodeBody[types.SearchResult](t, w).Albums {
+		titles = append(titles, a.Title)
+	}
+	if got := strings.Join(titles, ", "); got != "Blue Train, Émigré, ISTANBUL, İstanbul, Straße" {
+		t.Errorf("sorted in Turkish: %s", got)
+	}
+}
+
+func TestCollationSearchSQLite(t *testing.T) {
+	newTestServer(t)
+	store, err := NewSqliteAlbumStore(testSQLiteStores(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, title := range []string{"Émigré", "Straße", "Iğdır", "Blue Train"} {
+		if _, err := store.Create(ctx, newTestAlbum(withID(newAlbumID()), withTitle(title), withArtist("Various"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		c       textCollation
+		q, want string
+	}{
+		{textCollation{tag: language.Und}, "emigre", "[Émigré]"},
+		{textCollation{tag: language.Und}, "STRASSE", "[Straße]"},
+		{textCollation{tag: language.Und}, "igdir", "[Iğdır]"},
+		{textCollation{tag: language.Und}, "various blue", "[Blue Train]"},
+		// The key narrows in the database; the collation has the last word.
+		{textCollation{tag: language.Und, keepMarks: true}, "igdir", "[]"},
+		{textCollation{tag: language.Turkish}, "ıgdır", "[Iğdır]"},
+		{textCollation{tag: language.Turkish}, "igdir", "[]"},
+	} {
+		page, err := store.List(ctx, ListOptions{Filter: AlbumFilter{Query: tc.q, Collation: tc.c}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var titles []string
+		for _, a := range page.Albums {
+			titles = append(titles, a.Title)
+		}
+		if got := fmt.Sprint(titles); got != tc.want {
+			t.Errorf("q=%s in %s: %s, want %s", tc.q, tc.c, got, tc.want)
+		}
+	}
+}
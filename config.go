@@ -0,0 +1,661 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+	"gopkg.in/yaml.v3"
+
+	"github.com/brentmzey/web-service-go/money"
+)
+
+// Config is the service configuration. Every field can be set in the YAML
+// file named by -config, under the lowercased name of its environment
+// variable, and by the environment variable itself, which takes precedence.
+// loadConfig fills in the defaults and validates the result. Fields tagged
+// reload:"true" can also be changed at runtime; see reloadConfig.
+type Config struct {
+	ListenAddr          string        `env:"LISTEN_ADDR"`
+	AdminAddr           string        `env:"ADMIN_ADDR"`
+	UnixSocketMode      string        `env:"UNIX_SOCKET_MODE"`
+	TLSCertFile         string        `env:"TLS_CERT_FILE"`
+	TLSKeyFile          string        `env:"TLS_KEY_FILE"`
+	MTLSClientCA        string        `env:"MTLS_CLIENT_CA"`
+	MTLSOptionalRoutes  string        `env:"MTLS_OPTIONAL_ROUTES"` // served without a client certificate
+	LogFormat           string        `env:"LOG_FORMAT"`
+	LogLevel            string        `env:"LOG_LEVEL" reload:"true"`
+	LogRequestBodies    bool          `env:"LOG_REQUEST_BODIES" reload:"true"`
+	LogBodyMaxBytes     int           `env:"LOG_BODY_MAX_BYTES" reload:"true"`
+	LogRedactFields     string        `env:"LOG_REDACT_FIELDS" reload:"true"`
+	AccessLogPath       string        `env:"ACCESS_LOG_PATH"`
+	AccessLogMaxSizeMB  int           `env:"ACCESS_LOG_MAX_SIZE_MB"`
+	AccessLogMaxBackups int           `env:"ACCESS_LOG_MAX_BACKUPS"` // 0 keeps every backup
+	AccessLogMaxAge     time.Duration `env:"ACCESS_LOG_MAX_AGE"`     // 0 keeps backups of any age
+	CORSAllowedOrigins  string        `env:"CORS_ALLOWED_ORIGINS" reload:"true"`
+	TrustedProxies      string        `env:"TRUSTED_PROXIES" reload:"true"`
+	ListCacheControl    string        `env:"CACHE_CONTROL_LIST" reload:"true"`
+	AlbumCacheControl   string        `env:"CACHE_CONTROL_ALBUM" reload:"true"`
+	ShutdownTimeout     time.Duration `env:"SHUTDOWN_TIMEOUT"`
+	ReadHeaderTimeout   time.Duration `env:"READ_HEADER_TIMEOUT"`
+	BodyMaxBytes        int           `env:"REQUEST_BODY_MAX_BYTES" reload:"true"`    // 0 is no limit
+	BodyTimeout         time.Duration `env:"REQUEST_BODY_TIMEOUT" reload:"true"`      // 0 is no limit
+	BodyIdleTimeout     time.Duration `env:"REQUEST_BODY_IDLE_TIMEOUT" reload:"true"` // 0 is no limit
+	InstanceID          string        `env:"INSTANCE_ID"`
+	Environment         string        `env:"ENVIRONMENT"`
+
+	DBType             string        `env:"DB_TYPE"`
+	SecondaryDBType    string        `env:"SECONDARY_DB_TYPE"`
+	RunMigrations      bool          `env:"RUN_MIGRATIONS"`
+	DatabaseURL        string        `env:"DATABASE_URL" secret:"url"`
+	DatabaseReplicaURL string        `env:"DATABASE_REPLICA_URL" secret:"url"`
+	ReplicaWaitTimeout time.Duration `env:"REPLICA_WAIT_TIMEOUT"`
+	PGMaxConns         int           `env:"PG_MAX_CONNS"` // 0 keeps pgx's default
+	PGMinConns         int           `env:"PG_MIN_CONNS"`
+	PGQueryTimeout     time.Duration `env:"PG_QUERY_TIMEOUT"`
+	SQLiteDSN          string        `env:"SQLITE_DSN"`
+	MongoURI           string        `env:"MONGODB_URI" secret:"url"`
+	MongoDatabase      string        `env:"MONGODB_DATABASE"`
+	AWSRegion          string        `env:"AWS_REGION"`
+	DynamoEndpoint     string        `env:"DYNAMODB_ENDPOINT"`
+	DynamoTimeout      time.Duration `env:"DYNAMODB_TIMEOUT"`
+
+	DynamoHedgeAfter      time.Duration `env:"DYNAMODB_HEDGE_AFTER"`
+	DynamoHedgeMaxPercent int           `env:"DYNAMODB_HEDGE_MAX_PERCENT"`
+
+	AlbumIDStrategy string `env:"ALBUM_ID_STRATEGY"` // "uuid4", "uuid7", or "ulid"
+	AlbumIDFormats  string `env:"ALBUM_ID_FORMATS"`
+
+	StartupRetryAttempts    int           `env:"STARTUP_DB_RETRY_ATTEMPTS"`
+	StartupRetryDelay       time.Duration `env:"STARTUP_DB_RETRY_DELAY"`
+	StoreRetryAttempts      int           `env:"STORE_RETRY_ATTEMPTS"`
+	StoreRetryBaseDelay     time.Duration `env:"STORE_RETRY_BASE_DELAY"`
+	BreakerFailureThreshold int           `env:"BREAKER_FAILURE_THRESHOLD"`
+	BreakerResetTimeout     time.Duration `env:"BREAKER_RESET_TIMEOUT"`
+	AlbumCacheTTL           time.Duration `env:"ALBUM_CACHE_TTL"`
+	AlbumIDFilter           string        `env:"ALBUM_ID_FILTER"` // "", "exact", or "bloom"
+	AlbumIDFilterCapacity   int           `env:"ALBUM_ID_FILTER_CAPACITY"`
+	AlbumIDFilterFPRate     float64       `env:"ALBUM_ID_FILTER_FALSE_POSITIVE_RATE"`
+	AlbumIDFilterRebuild    time.Duration `env:"ALBUM_ID_FILTER_REBUILD_INTERVAL"`
+	StatsCacheTTL           time.Duration `env:"STATS_CACHE_TTL" reload:"true"` // 0 turns the cache off
+	ResponseCacheRoutes     string        `env:"RESPONSE_CACHE_ROUTES" reload:"true"`
+	ResponseCacheSize       int           `env:"RESPONSE_CACHE_SIZE"`
+	ResponseCacheRedisURL   string        `env:"RESPONSE_CACHE_REDIS_URL" secret:"url"`
+
+	RateLimitRequests    int           `env:"RATE_LIMIT_REQUESTS" reload:"true"`
+	RateLimitWindow      time.Duration `env:"RATE_LIMIT_WINDOW" reload:"true"`
+	MaxInFlight          int           `env:"MAX_IN_FLIGHT"`
+	InFlightQueueTimeout time.Duration `env:"IN_FLIGHT_QUEUE_TIMEOUT"`
+	QuotaFreePerHour     int           `env:"QUOTA_FREE_PER_HOUR" reload:"true"`
+	QuotaPaidPerHour     int           `env:"QUOTA_PAID_PER_HOUR" reload:"true"`
+	QuotaFreePerMonth    int           `env:"QUOTA_FREE_PER_MONTH" reload:"true"` // 0 means no monthly quota
+	QuotaPaidPerMonth    int           `env:"QUOTA_PAID_PER_MONTH" reload:"true"`
+	QuotaRedisURL        string        `env:"QUOTA_REDIS_URL" secret:"url"`
+	APIKeyCacheTTL       time.Duration `env:"API_KEY_CACHE_TTL" reload:"true"`
+	MetricsFlushInterval time.Duration `env:"METRICS_FLUSH_INTERVAL"`
+	MetricsExcludeRoutes string        `env:"METRICS_EXCLUDE_ROUTES" reload:"true"`
+	MetricsClientLimit   int           `env:"METRICS_CLIENT_LIMIT" reload:"true"`
+	MetricsBufferSize    int           `env:"METRICS_BUFFER_SIZE"`
+	SlowRequestThreshold time.Duration `env:"SLOW_REQUEST_THRESHOLD" reload:"true"`
+	BulkDeleteMaxAlbums  int           `env:"BULK_DELETE_MAX_ALBUMS" reload:"true"`
+	ImportAsyncBytes     int           `env:"IMPORT_ASYNC_BYTES" reload:"true"`
+	ImportMaxBytes       int           `env:"IMPORT_MAX_BYTES" reload:"true"`
+	AlbumsPageSize       int           `env:"ALBUMS_PAGE_SIZE" reload:"true"`
+	AlbumsMaxPageSize    int           `env:"ALBUMS_MAX_PAGE_SIZE" reload:"true"`
+	ResponseMaxBytes     int           `env:"RESPONSE_MAX_BYTES" reload:"true"`
+	ResponseOversize     string        `env:"RESPONSE_OVERSIZE" reload:"true"`
+	CollationLocale      string        `env:"COLLATION_LOCALE" reload:"true"`
+	SearchKeepDiacritics bool          `env:"SEARCH_KEEP_DIACRITICS" reload:"true"`
+	RateLimitSnapshot    time.Duration `env:"RATE_LIMIT_SNAPSHOT_INTERVAL"`
+	CatalogMaxAlbums     int           `env:"CATALOG_MAX_ALBUMS" reload:"true"`
+	PriceRounding        string        `env:"PRICE_ROUNDING"`
+
+	AdminToken        string        `env:"ADMIN_TOKEN" secret:"true" reload:"true"`
+	DebugEndpoints    bool          `env:"DEBUG_ENDPOINTS"`
+	MaintenanceMode   string        `env:"MAINTENANCE_MODE"` // at startup; POST /admin/maintenance changes it
+	EnrichmentEnabled bool          `env:"ENRICHMENT_ENABLED" reload:"true"`
+	MusicBrainzURL    string        `env:"MUSICBRAINZ_URL"`
+	SeedFile          string        `env:"SEED_FILE"`
+	WarmupEnabled     bool          `env:"WARMUP_ENABLED"`
+	WarmupTimeout     time.Duration `env:"WARMUP_TIMEOUT"`
+
+	BackupSchedule   string        `env:"BACKUP_SCHEDULE"` // an interval like 24h or a cron expression, in UTC
+	BackupDir        string        `env:"BACKUP_DIR"`
+	BackupS3Bucket   string        `env:"BACKUP_S3_BUCKET"`
+	BackupS3Prefix   string        `env:"BACKUP_S3_PREFIX"`
+	BackupS3Endpoint string        `env:"BACKUP_S3_ENDPOINT"`
+	BackupRetention  time.Duration `env:"BACKUP_RETENTION" reload:"true"` // 0 keeps every backup
+
+	ChangeLogRetention time.Duration `env:"CHANGE_LOG_RETENTION" reload:"true"` // 0 keeps every change
+
+	AuditRetention             time.Duration `env:"AUDIT_RETENTION" reload:"true"` // 0 keeps every principal
+	ImportJobRetention         time.Duration `env:"IMPORT_JOB_RETENTION" reload:"true"`
+	MetricsHistoryRetention    time.Duration `env:"METRICS_HISTORY_RETENTION" reload:"true"`
+	RateLimitSnapshotRetention time.Duration `env:"RATE_LIMIT_SNAPSHOT_RETENTION" reload:"true"`
+	RetentionDryRun            bool          `env:"RETENTION_DRY_RUN" reload:"true"`
+
+	EventsWebhookURL    string `env:"EVENTS_WEBHOOK_URL" secret:"true"`
+	EventsWebhookSecret string `env:"EVENTS_WEBHOOK_SECRET" secret:"true"`
+
+	AlertWebhookURL       string        `env:"ALERT_WEBHOOK_URL" secret:"true"`
+	AlertFormat           string        `env:"ALERT_FORMAT"`
+	AlertWindow           time.Duration `env:"ALERT_WINDOW" reload:"true"`
+	AlertErrorRatePercent int           `env:"ALERT_ERROR_RATE_PERCENT" reload:"true"` // 0 turns the rule off
+	AlertP99Latency       time.Duration `env:"ALERT_P99_LATENCY" reload:"true"`        // 0 turns the rule off
+	AlertOnOpenBreaker    bool          `env:"ALERT_ON_OPEN_BREAKER" reload:"true"`
+
+	SentryDSN                string `env:"SENTRY_DSN" secret:"true"`
+	SentrySamplePercent      int    `env:"SENTRY_SAMPLE_PERCENT" reload:"true"`
+	SentryMaxEventsPerMinute int    `env:"SENTRY_MAX_EVENTS_PER_MINUTE" reload:"true"`
+
+	PaymentWebhookSecret    string        `env:"PAYMENT_WEBHOOK_SECRET" secret:"true"`
+	PaymentWebhookTolerance time.Duration `env:"PAYMENT_WEBHOOK_TOLERANCE"`
+	PaymentEventTTL         time.Duration `env:"PAYMENT_EVENT_TTL"`
+
+	// Features holds the flags in knownFeatures, each set by its own
+	// FEATURE_<NAME> variable. They can always be reloaded.
+	Features map[string]bool
+}
+
+func defaultConfig() Config {
+	return Config{
+		ListenAddr:          "localhost:8080",
+		UnixSocketMode:      "0660",
+		MTLSOptionalRoutes:  defaultMTLSOptionalRoutes,
+		LogFormat:           "text",
+		LogLevel:            "info",
+		LogBodyMaxBytes:     defaultLogBodyMaxBytes,
+		LogRedactFields:     defaultLogRedactFields,
+		AccessLogMaxSizeMB:  defaultAccessLogMaxSizeMB,
+		AccessLogMaxBackups: defaultAccessLogMaxBackups,
+		ListCacheControl:    defaultListCacheControl,
+		AlbumCacheControl:   defaultAlbumCacheControl,
+		ShutdownTimeout:     10 * time.Second,
+		ReadHeaderTimeout:   defaultReadHeaderTimeout,
+		BodyMaxBytes:        defaultBodyMaxBytes,
+		BodyTimeout:         defaultBodyTimeout,
+		BodyIdleTimeout:     defaultBodyIdleTimeout,
+		InstanceID:          defaultInstanceID,
+
+		RunMigrations:      true,
+		ReplicaWaitTimeout: defaultReplicaWaitTimeout,
+		PGQueryTimeout:     defaultPostgresQueryTimeout,
+		SQLiteDSN:          defaultSQLiteDSN,
+		MongoURI:           "mongodb://localhost:27017",
+		MongoDatabase:      "metricsDb",
+		DynamoTimeout:      defaultDynamoTimeout,
+
+		DynamoHedgeMaxPercent: defaultDynamoHedgeMaxPercent,
+
+		AlbumIDStrategy: idStrategyUUID4,
+
+		StartupRetryAttempts:    3,
+		StartupRetryDelay:       time.Second,
+		StoreRetryAttempts:      3,
+		StoreRetryBaseDelay:     50 * time.Millisecond,
+		BreakerFailureThreshold: 5,
+		BreakerResetTimeout:     30 * time.Second,
+		AlbumIDFilterCapacity:   defaultAlbumIDFilterCapacity,
+		AlbumIDFilterFPRate:     defaultAlbumIDFilterFPRate,
+		AlbumIDFilterRebuild:    defaultAlbumIDFilterRebuild,
+		StatsCacheTTL:           defaultStatsCacheTTL,
+		ResponseCacheSize:       defaultResponseCacheSize,
+
+		RateLimitRequests:    5,
+		RateLimitWindow:      15 * time.Second,
+		QuotaFreePerHour:     defaultQuotaFreePerHour,
+		QuotaPaidPerHour:     defaultQuotaPaidPerHour,
+		APIKeyCacheTTL:       defaultAPIKeyCacheTTL,
+		MaxInFlight:          defaultMaxInFlight,
+		MetricsFlushInterval: defaultMetricsFlushInterval,
+		MetricsExcludeRoutes: defaultMetricsExcludeRoutes,
+		MetricsClientLimit:   defaultMetricsClientLimit,
+		MetricsBufferSize:    defaultMetricsBufferSize,
+		SlowRequestThreshold: defaultSlowRequestThreshold,
+		BulkDeleteMaxAlbums:  defaultBulkDeleteMaxAlbums,
+		ImportAsyncBytes:     defaultImportAsyncBytes,
+		ImportMaxBytes:       defaultImportMaxBytes,
+		AlbumsPageSize:       defaultAlbumsPageSize,
+		AlbumsMaxPageSize:    defaultAlbumsMaxPageSize,
+		ResponseMaxBytes:     defaultResponseMaxBytes,
+		ResponseOversize:     oversizePaginate,
+		PriceRounding:        money.HalfUp.String(),
+
+		MusicBrainzURL:  defaultMusicBrainzURL,
+		MaintenanceMode: maintenanceOff.String(),
+		WarmupTimeout:   defaultWarmupTimeout,
+
+		BackupRetention: defaultBackupRetention,
+
+		ChangeLogRetention: defaultChangeLogRetention,
+
+		AlertFormat:           "json",
+		AlertWindow:           defaultAlertWindow,
+		AlertErrorRatePercent: defaultAlertErrorRatePercent,
+		AlertP99Latency:       defaultAlertP99Latency,
+		AlertOnOpenBreaker:    true,
+
+		SentrySamplePercent:      defaultSentrySamplePercent,
+		SentryMaxEventsPerMinute: defaultSentryMaxEventsPerMinute,
+
+		PaymentWebhookTolerance: defaultPaymentWebhookTolerance,
+		PaymentEventTTL:         defaultPaymentEventTTL,
+
+		Features: defaultFeatures(),
+	}
+}
+
+// loadConfig builds the configuration from the defaults, then the file at
+// path (if any), then the variables lookupEnv finds; an empty variable counts
+// as unset. Unknown keys in the file are returned as warnings rather than
+// errors so a typo doesn't take the service down, but every invalid value is
+// an error.
+func loadConfig(path string, lookupEnv func(string) (string, bool)) (Config, []string, error) {
+	cfg := defaultConfig()
+	fields := configFields(&cfg)
+	var warnings []string
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, nil, err
+		}
+		var file map[string]interface{}
+		if err := yaml.Unmarshal(data, &file); err != nil {
+			return Config{}, nil, fmt.Errorf("%s: %w", path, err)
+		}
+		keys := make([]string, 0, len(file))
+		for key := range file {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if name, ok := strings.CutPrefix(key, "feature_"); ok {
+				if _, known := knownFeatures[name]; !known {
+					warnings = append(warnings, fmt.Sprintf("%s: unknown feature %q", path, name))
+					continue
+				}
+				on, err := strconv.ParseBool(fmt.Sprint(file[key]))
+				if err != nil {
+					return Config{}, nil, fmt.Errorf("%s: %s must be true or false, got %v", path, key, file[key])
+				}
+				cfg.Features[name] = on
+				continue
+			}
+			f, ok := fields[key]
+			if !ok {
+				warnings = append(warnings, fmt.Sprintf("%s: unknown key %q", path, key))
+				continue
+			}
+			switch value := file[key].(type) {
+			case nil:
+			case map[string]interface{}, []interface{}:
+				return Config{}, nil, fmt.Errorf("%s: %s must be a single value", path, key)
+			default:
+				if err := f.set(fmt.Sprint(value)); err != nil {
+					return Config{}, nil, fmt.Errorf("%s: %s %w", path, key, err)
+				}
+			}
+		}
+	}
+
+	for _, f := range fields {
+		if raw, ok := lookupEnv(f.env); ok && raw != "" {
+			if err := f.set(raw); err != nil {
+				return Config{}, nil, fmt.Errorf("%s %w", f.env, err)
+			}
+		}
+		if f.secret {
+			if err := f.setFromFile(lookupEnv); err != nil {
+				return Config{}, nil, err
+			}
+		}
+	}
+	for name := range knownFeatures {
+		if raw, ok := lookupEnv(featureEnv(name)); ok && raw != "" {
+			on, err := strconv.ParseBool(raw)
+			if err != nil {
+				return Config{}, nil, fmt.Errorf("%s must be true or false, got %q", featureEnv(name), raw)
+			}
+			cfg.Features[name] = on
+		}
+	}
+	return cfg, warnings, cfg.validate()
+}
+
+// configField is one settable field of a Config, known by its environment
+// variable.
+type configField struct {
+	env    string
+	value  reflect.Value
+	secret bool
+}
+
+// configFields indexes cfg's fields by file key. Features have keys of their
+// own and are left out.
+func configFields(cfg *Config) map[string]configField {
+	v := reflect.ValueOf(cfg).Elem()
+	fields := make(map[string]configField, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		env := v.Type().Field(i).Tag.Get("env")
+		if env == "" {
+			continue
+		}
+		fields[strings.ToLower(env)] = configField{env: env, value: v.Field(i), secret: v.Type().Field(i).Tag.Get("secret") != ""}
+	}
+	return fields
+}
+
+// setFromFile reads a secret from the file named by its <ENV>_FILE variable,
+// for orchestrators that mount secrets as files rather than passing them in
+// the environment. The file beats the configuration file; setting both the
+// variable and its _FILE form is an error, as is a missing or empty file.
+// One trailing newline is dropped.
+func (f configField) setFromFile(lookupEnv func(string) (string, bool)) error {
+	fileEnv := f.env + "_FILE"
+	path, ok := lookupEnv(fileEnv)
+	if !ok || path == "" {
+		return nil
+	}
+	if raw, ok := lookupEnv(f.env); ok && raw != "" {
+		return fmt.Errorf("set %s or %s, not both", f.env, fileEnv)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fileEnv, err)
+	}
+	secret := strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r")
+	if secret == "" {
+		return fmt.Errorf("%s: %s is empty", fileEnv, path)
+	}
+	return f.set(secret)
+}
+
+func (f configField) set(raw string) error {
+	switch f.value.Interface().(type) {
+	case string:
+		f.value.SetString(raw)
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("must be true or false, got %q", raw)
+		}
+		f.value.SetBool(b)
+	case int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("must be an integer, got %q", raw)
+		}
+		f.value.SetInt(int64(n))
+	case float64:
+		x, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("must be a number, got %q", raw)
+		}
+		f.value.SetFloat(x)
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("must be a duration like 5s, got %q", raw)
+		}
+		f.value.SetInt(int64(d))
+	}
+	return nil
+}
+
+// validate checks every setting and reports all the problems at once.
+func (cfg *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(cfg.ListenAddr != "", "LISTEN_ADDR must not be empty")
+	check(cfg.AdminAddr != cfg.ListenAddr, "ADMIN_ADDR must differ from LISTEN_ADDR, got %q for both", cfg.ListenAddr)
+	for _, addr := range []struct{ env, addr string }{{"LISTEN_ADDR", cfg.ListenAddr}, {"ADMIN_ADDR", cfg.AdminAddr}} {
+		check(addr.addr != unixSocketPrefix, "%s must name a socket path after unix:", addr.env)
+	}
+	check((cfg.TLSCertFile == "") == (cfg.TLSKeyFile == ""), "TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	check(cfg.MTLSClientCA == "" || cfg.TLSCertFile != "", "TLS_CERT_FILE must be set when MTLS_CLIENT_CA is; client certificates need TLS")
+	if _, err := parseSocketMode(cfg.UnixSocketMode); err != nil {
+		check(false, "UNIX_SOCKET_MODE %v", err)
+	}
+	if _, err := parseMaintenanceMode(cfg.MaintenanceMode); err != nil {
+		check(false, "MAINTENANCE_MODE %v", err)
+	}
+	if _, err := parseTrustedProxies(cfg.TrustedProxies); err != nil {
+		check(false, "TRUSTED_PROXIES %v", err)
+	}
+	if _, err := parseResponseCacheRoutes(cfg.ResponseCacheRoutes); err != nil {
+		check(false, "RESPONSE_CACHE_ROUTES %v", err)
+	}
+	if cfg.ResponseCacheRedisURL != "" {
+		if _, err := newRedisClient(cfg.ResponseCacheRedisURL); err != nil {
+			check(false, "RESPONSE_CACHE_REDIS_URL %v", err)
+		}
+	}
+	if cfg.QuotaRedisURL != "" {
+		if _, err := newRedisClient(cfg.QuotaRedisURL); err != nil {
+			check(false, "QUOTA_REDIS_URL %v", err)
+		}
+	}
+	if _, err := money.ParseRounding(cfg.PriceRounding); err != nil {
+		check(false, "PRICE_ROUNDING %v", err)
+	}
+	check(cfg.AlbumsPageSize <= cfg.AlbumsMaxPageSize, "ALBUMS_PAGE_SIZE (%d) must not exceed ALBUMS_MAX_PAGE_SIZE (%d)", cfg.AlbumsPageSize, cfg.AlbumsMaxPageSize)
+	if cfg.CollationLocale != "" {
+		_, err := language.Parse(cfg.CollationLocale)
+		check(err == nil, "COLLATION_LOCALE must be a BCP 47 language tag such as de or tr, got %q", cfg.CollationLocale)
+	}
+	check(cfg.ResponseOversize == oversizePaginate || cfg.ResponseOversize == oversizeReject, `RESPONSE_OVERSIZE must be "paginate" or "reject", got %q`, cfg.ResponseOversize)
+	check(cfg.LogFormat == "text" || cfg.LogFormat == "json", `LOG_FORMAT must be "text" or "json", got %q`, cfg.LogFormat)
+	check(cfg.LogLevel == "info" || cfg.LogLevel == "debug", `LOG_LEVEL must be "info" or "debug", got %q`, cfg.LogLevel)
+	for _, db := range []struct{ env, dbType string }{{"DB_TYPE", cfg.DBType}, {"SECONDARY_DB_TYPE", cfg.SecondaryDBType}} {
+		switch db.dbType {
+		case "", "sqlite", "mongodb":
+		case "postgres":
+			check(cfg.DatabaseURL != "", "DATABASE_URL must be set when %s=postgres", db.env)
+		case "dynamodb":
+			check(cfg.AWSRegion != "", "AWS_REGION must be set when %s=dynamodb", db.env)
+		default:
+			check(false, "%s must be postgres, sqlite, mongodb, or dynamodb, got %q", db.env, db.dbType)
+		}
+	}
+	check(cfg.DatabaseReplicaURL == "" || cfg.DBType == "postgres" || cfg.SecondaryDBType == "postgres", "DATABASE_REPLICA_URL is only used with DB_TYPE=postgres")
+	check(cfg.SecondaryDBType == "" || cfg.SecondaryDBType != cfg.DBType, "SECONDARY_DB_TYPE must differ from DB_TYPE, got %q for both", cfg.DBType)
+	check(cfg.PGMaxConns == 0 || cfg.PGMinConns <= cfg.PGMaxConns, "PG_MIN_CONNS (%d) must not exceed PG_MAX_CONNS (%d)", cfg.PGMinConns, cfg.PGMaxConns)
+	check(!cfg.DebugEndpoints || cfg.AdminAddr != "", "ADMIN_ADDR must be set when DEBUG_ENDPOINTS=true; the debug endpoints are never served on LISTEN_ADDR")
+	check(!cfg.EnrichmentEnabled || cfg.MusicBrainzURL != "", "MUSICBRAINZ_URL must be set when ENRICHMENT_ENABLED=true")
+	check(cfg.AlertFormat == "json" || cfg.AlertFormat == "slack", `ALERT_FORMAT must be "json" or "slack", got %q`, cfg.AlertFormat)
+	check(cfg.PaymentEventTTL >= 2*cfg.PaymentWebhookTolerance, "PAYMENT_EVENT_TTL (%s) must be at least twice PAYMENT_WEBHOOK_TOLERANCE (%s), or a replayed event could outlive its record", cfg.PaymentEventTTL, cfg.PaymentWebhookTolerance)
+	check(cfg.AlertErrorRatePercent <= 100, "ALERT_ERROR_RATE_PERCENT must be at most 100, got %d", cfg.AlertErrorRatePercent)
+	check(cfg.AlbumIDStrategy == idStrategyUUID4 || cfg.AlbumIDStrategy == idStrategyUUID7 || cfg.AlbumIDStrategy == idStrategyULID, `ALBUM_ID_STRATEGY must be "uuid4", "uuid7", or "ulid", got %q`, cfg.AlbumIDStrategy)
+	if _, err := parseAlbumIDFormats(cfg.AlbumIDFormats); err != nil {
+		check(false, "ALBUM_ID_FORMATS %v", err)
+	}
+	check(cfg.AlbumIDFilter == "" || cfg.AlbumIDFilter == albumIDFilterExact || cfg.AlbumIDFilter == albumIDFilterBloom, `ALBUM_ID_FILTER must be "exact" or "bloom", got %q`, cfg.AlbumIDFilter)
+	check(cfg.AlbumIDFilterFPRate > 0 && cfg.AlbumIDFilterFPRate < 1, "ALBUM_ID_FILTER_FALSE_POSITIVE_RATE must be between 0 and 1, got %g", cfg.AlbumIDFilterFPRate)
+	check(cfg.DynamoHedgeMaxPercent <= 100, "DYNAMODB_HEDGE_MAX_PERCENT must be at most 100, got %d", cfg.DynamoHedgeMaxPercent)
+	check(cfg.SentrySamplePercent <= 100, "SENTRY_SAMPLE_PERCENT must be at most 100, got %d", cfg.SentrySamplePercent)
+	if cfg.SentryDSN != "" {
+		if _, _, err := parseSentryDSN(cfg.SentryDSN); err != nil {
+			check(false, "SENTRY_DSN %v", err)
+		}
+	}
+	if cfg.BackupSchedule != "" {
+		if _, _, err := parseBackupSchedule(cfg.BackupSchedule); err != nil {
+			check(false, "BACKUP_SCHEDULE %v", err)
+		}
+		check((cfg.BackupDir == "") != (cfg.BackupS3Bucket == ""), "exactly one of BACKUP_DIR and BACKUP_S3_BUCKET must be set when BACKUP_SCHEDULE is")
+		check(cfg.BackupS3Bucket == "" || cfg.AWSRegion != "", "AWS_REGION must be set when BACKUP_S3_BUCKET is")
+	}
+
+	for _, n := range []struct {
+		env      string
+		value    int
+		positive bool
+	}{
+		{"PG_MAX_CONNS", cfg.PGMaxConns, false},
+		{"PG_MIN_CONNS", cfg.PGMinConns, false},
+		{"STARTUP_DB_RETRY_ATTEMPTS", cfg.StartupRetryAttempts, false},
+		{"MAX_IN_FLIGHT", cfg.MaxInFlight, false},
+		{"STORE_RETRY_ATTEMPTS", cfg.StoreRetryAttempts, true},
+		{"BREAKER_FAILURE_THRESHOLD", cfg.BreakerFailureThreshold, true},
+		{"RATE_LIMIT_REQUESTS", cfg.RateLimitRequests, true},
+		{"QUOTA_FREE_PER_HOUR", cfg.QuotaFreePerHour, true},
+		{"QUOTA_PAID_PER_HOUR", cfg.QuotaPaidPerHour, true},
+		{"QUOTA_FREE_PER_MONTH", cfg.QuotaFreePerMonth, false},
+		{"QUOTA_PAID_PER_MONTH", cfg.QuotaPaidPerMonth, false},
+		{"METRICS_CLIENT_LIMIT", cfg.MetricsClientLimit, true},
+		{"METRICS_BUFFER_SIZE", cfg.MetricsBufferSize, true},
+		{"RESPONSE_CACHE_SIZE", cfg.ResponseCacheSize, true},
+		{"BULK_DELETE_MAX_ALBUMS", cfg.BulkDeleteMaxAlbums, true},
+		{"ALBUM_ID_FILTER_CAPACITY", cfg.AlbumIDFilterCapacity, true},
+		{"IMPORT_ASYNC_BYTES", cfg.ImportAsyncBytes, false},
+		{"IMPORT_MAX_BYTES", cfg.ImportMaxBytes, true},
+		{"ALBUMS_PAGE_SIZE", cfg.AlbumsPageSize, true},
+		{"ALBUMS_MAX_PAGE_SIZE", cfg.AlbumsMaxPageSize, true},
+		{"RESPONSE_MAX_BYTES", cfg.ResponseMaxBytes, false},
+		{"CATALOG_MAX_ALBUMS", cfg.CatalogMaxAlbums, false},
+		{"ALERT_ERROR_RATE_PERCENT", cfg.AlertErrorRatePercent, false},
+		{"SENTRY_SAMPLE_PERCENT", cfg.SentrySamplePercent, false},
+		{"DYNAMODB_HEDGE_MAX_PERCENT", cfg.DynamoHedgeMaxPercent, false},
+		{"SENTRY_MAX_EVENTS_PER_MINUTE", cfg.SentryMaxEventsPerMinute, true},
+		{"LOG_BODY_MAX_BYTES", cfg.LogBodyMaxBytes, true},
+		{"ACCESS_LOG_MAX_SIZE_MB", cfg.AccessLogMaxSizeMB, true},
+		{"ACCESS_LOG_MAX_BACKUPS", cfg.AccessLogMaxBackups, false},
+		{"REQUEST_BODY_MAX_BYTES", cfg.BodyMaxBytes, false},
+	} {
+		if n.positive {
+			check(n.value > 0, "%s must be a positive integer, got %d", n.env, n.value)
+		} else {
+			check(n.value >= 0, "%s must be a non-negative integer, got %d", n.env, n.value)
+		}
+	}
+	for _, d := range []struct {
+		env      string
+		value    time.Duration
+		positive bool
+	}{
+		{"SHUTDOWN_TIMEOUT", cfg.ShutdownTimeout, true},
+		{"READ_HEADER_TIMEOUT", cfg.ReadHeaderTimeout, true},
+		{"REQUEST_BODY_TIMEOUT", cfg.BodyTimeout, false},
+		{"REQUEST_BODY_IDLE_TIMEOUT", cfg.BodyIdleTimeout, false},
+		{"PG_QUERY_TIMEOUT", cfg.PGQueryTimeout, true},
+		{"REPLICA_WAIT_TIMEOUT", cfg.ReplicaWaitTimeout, false},
+		{"DYNAMODB_TIMEOUT", cfg.DynamoTimeout, true},
+		{"DYNAMODB_HEDGE_AFTER", cfg.DynamoHedgeAfter, false},
+		{"STARTUP_DB_RETRY_DELAY", cfg.StartupRetryDelay, true},
+		{"STORE_RETRY_BASE_DELAY", cfg.StoreRetryBaseDelay, true},
+		{"BREAKER_RESET_TIMEOUT", cfg.BreakerResetTimeout, true},
+		{"RATE_LIMIT_WINDOW", cfg.RateLimitWindow, true},
+		{"ALBUM_CACHE_TTL", cfg.AlbumCacheTTL, false},
+		{"ALBUM_ID_FILTER_REBUILD_INTERVAL", cfg.AlbumIDFilterRebuild, false},
+		{"STATS_CACHE_TTL", cfg.StatsCacheTTL, false},
+		{"IN_FLIGHT_QUEUE_TIMEOUT", cfg.InFlightQueueTimeout, false},
+		{"METRICS_FLUSH_INTERVAL", cfg.MetricsFlushInterval, false},
+		{"ACCESS_LOG_MAX_AGE", cfg.AccessLogMaxAge, false},
+		{"API_KEY_CACHE_TTL", cfg.APIKeyCacheTTL, false},
+		{"SLOW_REQUEST_THRESHOLD", cfg.SlowRequestThreshold, true},
+		{"BACKUP_RETENTION", cfg.BackupRetention, false},
+		{"CHANGE_LOG_RETENTION", cfg.ChangeLogRetention, false},
+		{"AUDIT_RETENTION", cfg.AuditRetention, false},
+		{"IMPORT_JOB_RETENTION", cfg.ImportJobRetention, false},
+		{"METRICS_HISTORY_RETENTION", cfg.MetricsHistoryRetention, false},
+		{"RATE_LIMIT_SNAPSHOT_RETENTION", cfg.RateLimitSnapshotRetention, false},
+		{"ALERT_WINDOW", cfg.AlertWindow, true},
+		{"ALERT_P99_LATENCY", cfg.AlertP99Latency, false},
+		{"RATE_LIMIT_SNAPSHOT_INTERVAL", cfg.RateLimitSnapshot, false},
+		{"PAYMENT_WEBHOOK_TOLERANCE", cfg.PaymentWebhookTolerance, true},
+		{"PAYMENT_EVENT_TTL", cfg.PaymentEventTTL, true},
+		{"WARMUP_TIMEOUT", cfg.WarmupTimeout, true},
+	} {
+		if d.positive {
+			check(d.value > 0, "%s must be a positive duration, got %v", d.env, d.value)
+		} else {
+			check(d.value >= 0, "%s must be a non-negative duration, got %v", d.env, d.value)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// String lists every setting as key=value for the startup log, with secrets
+// masked: tokens entirely, URLs down to their password.
+func (cfg Config) String() string {
+	v := reflect.ValueOf(cfg)
+	var b strings.Builder
+	for i := 0; i < v.NumField(); i++ {
+		tag := v.Type().Field(i).Tag
+		if tag.Get("env") == "" {
+			continue
+		}
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		fmt.Fprintf(&b, "%s=%s", strings.ToLower(tag.Get("env")), maskSecret(tag, fmt.Sprint(v.Field(i).Interface())))
+	}
+	for _, setting := range featureSettings(cfg.Features) {
+		fmt.Fprintf(&b, " %s", strings.ToLower(setting))
+	}
+	return b.String()
+}
+
+// maskSecret hides value if tag marks it secret: tokens entirely, URLs
+// down to their password.
+func maskSecret(tag reflect.StructTag, value string) string {
+	switch tag.Get("secret") {
+	case "true":
+		if value != "" {
+			return "********"
+		}
+	case "url":
+		// A key=value connection string has no scheme and is masked whole.
+		if u, err := url.Parse(value); err == nil && u.Scheme != "" {
+			return u.Redacted()
+		} else if value != "" {
+			return "********"
+		}
+	}
+	return value
+}
+
+// setupLogging switches the standard logger to one JSON object per line when
+// format is "json"; "text" keeps the default output.
+func setupLogging(format string) {
+	if format == "json" {
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{out: os.Stderr})
+	}
+}
+
+// jsonLogWriter wraps each log line in a JSON object. The log package makes
+// one Write per message, so every Write is exactly one line.
+type jsonLogWriter struct {
+	out io.Writer
+}
+
+func (w jsonLogWriter) Write(p []byte) (int, error) {
+	line, err := json.Marshal(struct {
+		Time    string `json:"time"`
+		Message string `json:"msg"`
+	}{time.Now().UTC().Format(time.RFC3339Nano), strings.TrimSuffix(string(p), "\n")})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.out.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
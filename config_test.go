@@ -0,0 +1,172 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEnv is a lookupEnv over a fixed set of variables.
+func testEnv(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+// writeConfigFile writes a YAML configuration file for t.
+func writeConfigFile(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+listen_addr: ":9000"
+rate_limit_requests: 50
+shutdown_timeout: 20s
+log_level: debug
+`)
+	cfg, warnings, err := loadConfig(path, testEnv(map[string]string{
+		"RATE_LIMIT_REQUESTS": "70",
+		"LOG_LEVEL":           "", // empty counts as unset
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 0 {
+		t.Errorf("warnings %q, want none", warnings)
+	}
+	defaults := defaultConfig()
+	for _, tc := range []struct {
+		name      string
+		got, want interface{}
+	}{
+		{"listen_addr, from the file", cfg.ListenAddr, ":9000"},
+		{"rate_limit_requests, from the environment over the file", cfg.RateLimitRequests, 70},
+		{"shutdown_timeout, from the file", cfg.ShutdownTimeout, 20 * time.Second},
+		{"log_level, from the file under an empty variable", cfg.LogLevel, "debug"},
+		{"log_format, the default", cfg.LogFormat, defaults.LogFormat},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("%s = %v, want %v", tc.name, tc.got, tc.want)
+		}
+	}
+}
+
+func TestConfigRequiredPerDBType(t *testing.T) {
+	for _, tc := range []struct {
+		env     map[string]string
+		missing string // "" if valid
+	}{
+		{map[string]string{"DB_TYPE": "sqlite"}, ""},
+		{map[string]string{"DB_TYPE": "mongodb"}, ""},
+		{map[string]string{"DB_TYPE": "postgres"}, "DATABASE_URL"},
+		{map[string]string{"DB_TYPE": "postgres", "DATABASE_URL": "postgres://localhost/albums"}, ""},
+		{map[string]string{"DB_TYPE": "dynamodb"}, "AWS_REGION"},
+		{map[string]string{"DB_TYPE": "dynamodb", "AWS_REGION": "eu-west-1"}, ""},
+		{map[string]string{"DB_TYPE": "sqlite", "SECONDARY_DB_TYPE": "postgres"}, "DATABASE_URL"},
+		{map[string]string{"DB_TYPE": "oracle"}, "DB_TYPE"},
+	} {
+		_, _, err := loadConfig("", testEnv(tc.env))
+		switch {
+		case tc.missing == "" && err != nil:
+			t.Errorf("%v: %v", tc.env, err)
+		case tc.missing != "" && (err == nil || !strings.Contains(err.Error(), tc.missing)):
+			t.Errorf("%v: error %v, want one about %s", tc.env, err, tc.missing)
+		}
+	}
+}
+
+func TestConfigUnknownKeys(t *testing.T) {
+	path := writeConfigFile(t, `
+listen_adr: ":9000"
+feature_teleport: true
+rate_limit_requests: 50
+`)
+	cfg, warnings, err := loadConfig(path, testEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(warnings) != 2 || !strings.Contains(warnings[0], `"teleport"`) || !strings.Contains(warnings[1], `"listen_adr"`) {
+		t.Errorf("warnings %q, want one for each unknown key", warnings)
+	}
+	if cfg.RateLimitRequests != 50 {
+		t.Errorf("rate_limit_requests = %d; the known keys still apply", cfg.RateLimitRequests)
+	}
+
+	// A bad value is an error, unlike an unknown key.
+	path = writeConfigFile(t, "rate_limit_requests: lots\n")
+	if _, _, err := loadConfig(path, testEnv(nil)); err == nil {
+		t.Error("a value that isn't a number loaded")
+	}
+}
+
+func TestConfigStringMasksSecrets(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AdminToken = "s3cr3t-token"
+	cfg.DatabaseURL = "postgres://albums:hunter2@db:5432/albums"
+	s := cfg.String()
+	for _, secret := range []string{"s3cr3t-token", "hunter2"} {
+		if strings.Contains(s, secret) {
+			t.Errorf("the logged configuration shows %q: %s", secret, s)
+		}
+	}
+	if !strings.Contains(s, "database_url=postgres://albums:xxxxx@db:5432/albums") {
+		t.Errorf("the logged configuration lost the rest of the URL: %s", s)
+	}
+}
+
+// writeSecretFile writes contents to a file of its own for t.
+func writeSecretFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigSecretFiles(t *testing.T) {
+	configFile := writeConfigFile(t, "admin_token: from-the-file\n")
+	for _, tc := range []struct {
+		name    string
+		env     map[string]string
+		want    string
+		wantErr string
+	}{
+		{"the _FILE form over the configuration file", map[string]string{"ADMIN_TOKEN_FILE": writeSecretFile(t, "from-a-secret\n")}, "from-a-secret", ""},
+		{"one trailing newline dropped", map[string]string{"ADMIN_TOKEN_FILE": writeSecretFile(t, "crlf\r\n")}, "crlf", ""},
+		{"spaces kept", map[string]string{"ADMIN_TOKEN_FILE": writeSecretFile(t, " padded \n\n")}, " padded \n", ""},
+		{"an empty _FILE variable is unset", map[string]string{"ADMIN_TOKEN_FILE": ""}, "from-the-file", ""},
+		{"both forms", map[string]string{"ADMIN_TOKEN": "x", "ADMIN_TOKEN_FILE": writeSecretFile(t, "y")}, "", "set ADMIN_TOKEN or ADMIN_TOKEN_FILE, not both"},
+		{"a missing file", map[string]string{"ADMIN_TOKEN_FILE": filepath.Join(t.TempDir(), "nope")}, "", "ADMIN_TOKEN_FILE: open"},
+		{"an empty file", map[string]string{"ADMIN_TOKEN_FILE": writeSecretFile(t, "\n")}, "", "is empty"},
+	} {
+		cfg, _, err := loadConfig(configFile, testEnv(tc.env))
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: error %v, want one containing %q", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil || cfg.AdminToken != tc.want {
+			t.Errorf("%s: admin token %q, %v; want %q", tc.name, cfg.AdminToken, err, tc.want)
+		}
+	}
+
+	// Only secrets have a _FILE form.
+	cfg, _, err := loadConfig("", testEnv(map[string]string{
+		"DATABASE_URL_FILE": writeSecretFile(t, "postgres://db/albums"),
+		"LOG_LEVEL_FILE":    writeSecretFile(t, "debug"),
+	}))
+	if err != nil || cfg.DatabaseURL != "postgres://db/albums" || cfg.LogLevel == "debug" {
+		t.Errorf("DATABASE_URL %q and LOG_LEVEL %q, %v; want only the first from its file", cfg.DatabaseURL, cfg.LogLevel, err)
+	}
+}
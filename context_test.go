@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingAlbumStore is an InMemoryAlbumStore whose GetByID and List block
+// until their context is done, then return its error, which it also sends on
+// stopped.
+type blockingAlbumStore struct {
+	*InMemoryAlbumStore
+	entered chan struct{}
+	stopped chan error
+}
+
+func newBlockingAlbumStore() *blockingAlbumStore {
+	return &blockingAlbumStore{InMemoryAlbumStore: NewInMemoryAlbumStore(), entered: make(chan struct{}, 1), stopped: make(chan error, 1)}
+}
+
+func (s *blockingAlbumStore) block(ctx context.Context) error {
+	s.entered <- struct{}{}
+	<-ctx.Done()
+	s.stopped <- ctx.Err()
+	return ctx.Err()
+}
+
+func (s *blockingAlbumStore) GetByID(ctx context.Context, id string) (album, error) {
+	return album{}, s.block(ctx)
+}
+
+func (s *blockingAlbumStore) List(ctx context.Context, opts ListOptions) (albumPage, error) {
+	return albumPage{}, s.block(ctx)
+}
+
+// serveWithContext serves a GET of path with ctx in a goroutine and returns
+// the recorder once the handler returns.
+func serveWithContext(h http.Handler, ctx context.Context, path string) <-chan *httptest.ResponseRecorder {
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil).WithContext(ctx))
+		done <- w
+	}()
+	return done
+}
+
+func TestClientDisconnectCancelsStoreCall(t *testing.T) {
+	s := newTestServer(t)
+	store := newBlockingAlbumStore()
+	albumStore = store
+
+	for _, path := range []string{"/albums/some-id", "/albums"} {
+		closedBefore := atomic.LoadInt64(&totalClientClosedRequests)
+		errorsBefore := atomic.LoadInt64(&metrics.TotalErrors)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := serveWithContext(s.handler, ctx, path)
+		<-store.entered
+		cancel()
+
+		select {
+		case err := <-store.stopped:
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("GET %s: the store stopped with %v, want context.Canceled", path, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("GET %s: the store call outlived the request", path)
+		}
+		w := <-done
+		if w.Body.Len() != 0 {
+			t.Errorf("GET %s: answered a client that hung up: %d %s", path, w.Code, w.Body)
+		}
+		if got := atomic.LoadInt64(&totalClientClosedRequests) - closedBefore; got != 1 {
+			t.Errorf("GET %s: %d closed requests counted, want 1", path, got)
+		}
+		if got := atomic.LoadInt64(&metrics.TotalErrors) - errorsBefore; got != 0 {
+			t.Errorf("GET %s: a hang-up counted as %d errors", path, got)
+		}
+	}
+}
+
+// slowAlbumStore is an InMemoryAlbumStore whose List takes until release is
+// closed, paying no attention to its context, and whose Iterate calls hook
+// before each album.
+type slowAlbumStore struct {
+	*InMemoryAlbumStore
+	entered chan struct{}
+	release chan struct{}
+	hook    func(n int)
+}
+
+func (s *slowAlbumStore) List(ctx context.Context, opts ListOptions) (albumPage, error) {
+	s.entered <- struct{}{}
+	<-s.release
+	return s.InMemoryAlbumStore.List(ctx, opts)
+}
+
+func (s *slowAlbumStore) Iterate(ctx context.Context, opts ListOptions, fn func(album) error) error {
+	n := 0
+	return s.InMemoryAlbumStore.Iterate(ctx, opts, func(a album) error {
+		n++
+		s.hook(n)
+		return fn(a)
+	})
+}
+
+func TestClientDisconnectSkipsWrite(t *testing.T) {
+	s := newTestServer(t)
+	s.create(newTestAlbum())
+	store := &slowAlbumStore{InMemoryAlbumStore: s.albums, entered: make(chan struct{}, 1), release: make(chan struct{})}
+	albumStore = store
+	closedBefore := atomic.LoadInt64(&totalClientClosedRequests)
+	requestsBefore := atomic.LoadInt64(&metrics.TotalRequests)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := serveWithContext(s.handler, ctx, "/albums")
+	<-store.entered
+	// The client gives up while the listing is slow, and the listing then
+	// completes all the same.
+	cancel()
+	close(store.release)
+	w := <-done
+	if w.Body.Len() != 0 || w.Header().Get("Link") != "" {
+		t.Errorf("answered a client that hung up: %d %s", w.Code, w.Body)
+	}
+	if got := atomic.LoadInt64(&totalClientClosedRequests) - closedBefore; got != 1 {
+		t.Errorf("%d closed requests counted, want 1", got)
+	}
+	if got := atomic.LoadInt64(&metrics.TotalRequests) - requestsBefore; got != 0 {
+		t.Errorf("the hang-up counted as %d requests", got)
+	}
+}
+
+func TestClientDisconnectStopsExport(t *testing.T) {
+	s := newTestServer(t)
+	for i := 0; i < 20; i++ {
+		s.create(newTestAlbum())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var visited int
+	albumStore = &slowAlbumStore{InMemoryAlbumStore: s.albums, hook: func(n int) {
+		visited = n
+		if n == 5 {
+			cancel()
+		}
+	}}
+	closedBefore := atomic.LoadInt64(&totalClientClosedRequests)
+
+	<-serveWithContext(s.handler, ctx, "/albums/export?format=xlsx")
+	if visited != 5 {
+		t.Errorf("the export went on to album %d after the client hung up at the fifth", visited)
+	}
+	if got := atomic.LoadInt64(&totalClientClosedRequests) - closedBefore; got != 1 {
+		t.Errorf("%d closed requests counted, want 1", got)
+	}
+}
+
+func TestRequestDeadlineReachesStore(t *testing.T) {
+	s := newTestServer(t)
+	store := newBlockingAlbumStore()
+	albumStore = store
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	w := <-serveWithContext(s.handler, ctx, "/albums/some-id")
+	<-store.entered
+	if err := <-store.stopped; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("the store stopped with %v, want context.DeadlineExceeded", err)
+	}
+	// A deadline isn't the client leaving: it is answered.
+	expectProblem(t, w, http.StatusServiceUnavailable)
+}
+
+func TestFlushMetricsAtShutdown(t *testing.T) {
+	s := newTestServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go flushMetrics(ctx, s.metrics, s.clock, time.Minute, done)
+
+	atomic.AddInt64(&metrics.TotalRequests, 3)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the flusher kept running after shutdown")
+	}
+	m, err := s.metrics.LoadMetrics(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.TotalRequests != 3 {
+		t.Errorf("the last flush saved %d requests, want 3", m.TotalRequests)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// processStart is when the service started, for the uptime in /debug/vars.
+var processStart = time.Now()
+
+// routeDebug mounts the Go profiler and the runtime snapshot under /debug,
+// each behind the admin token. newServers only calls it for the admin
+// listener, and only with DEBUG_ENDPOINTS=true.
+func routeDebug(mux *routeTable) {
+	get := func(h http.HandlerFunc) http.HandlerFunc {
+		return requireAdmin(methods{http.MethodGet: h}.ServeHTTP)
+	}
+	mux.HandleFunc("/debug/pprof/", get(pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", get(pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", get(pprof.Profile))
+	// go tool pprof looks symbols up with POST.
+	mux.HandleFunc("/debug/pprof/symbol", requireAdmin(methods{http.MethodGet: pprof.Symbol, http.MethodPost: pprof.Symbol}.ServeHTTP))
+	mux.HandleFunc("/debug/pprof/trace", get(pprof.Trace))
+	mux.HandleFunc("/debug/vars", get(debugVarsHandler))
+}
+
+// recentGCPauses is how many of the latest GC pauses /debug/vars lists.
+const recentGCPauses = 10
+
+// debugVarsHandler reports goroutines, heap, and GC statistics and the
+// uptime.
+func debugVarsHandler(w http.ResponseWriter, r *http.Request) {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	// PauseNs is a ring buffer with the latest pause at (NumGC+255)%256.
+	pauses := []string{}
+	for i := uint32(0); i < mem.NumGC && i < recentGCPauses; i++ {
+		pauses = append(pauses, time.Duration(mem.PauseNs[(mem.NumGC-i+255)%256]).String())
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"uptime":         time.Since(processStart).Round(time.Second).String(),
+		"goroutines":     runtime.NumGoroutine(),
+		"heapAllocBytes": mem.HeapAlloc,
+		"heapInuseBytes": mem.HeapInuse,
+		"heapSysBytes":   mem.HeapSys,
+		"heapObjects":    mem.HeapObjects,
+		"numGC":          mem.NumGC,
+		"gcPauseTotal":   time.Duration(mem.PauseTotalNs).String(),
+		"recentGCPauses": pauses,
+		"nextGCBytes":    mem.NextGC,
+		"goVersion":      runtime.Version(),
+		"cpus":           runtime.NumCPU(),
+	})
+}
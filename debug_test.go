@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDebugEndpoints(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.AdminAddr = "localhost:0"
+		cfg.DebugEndpoints = true
+	})
+	servers := newServers(s.cfg)
+	api, admin := servers[0].Handler, servers[1].Handler
+	do := func(h http.Handler, path string, auth bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if auth {
+			r.Header.Set("Authorization", "Bearer "+testAdminToken)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	paths := []string{"/debug/pprof/", "/debug/pprof/heap", "/debug/vars"}
+	for _, path := range paths {
+		if w := do(api, path, true); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s on the API listener: %d, want 404", path, w.Code)
+		}
+	}
+	limited := *s.cfg
+	limited.RateLimitRequests = 1
+	liveConfig.Store(&limited)
+	for _, path := range paths {
+		if w := do(admin, path, false); w.Code != http.StatusUnauthorized {
+			t.Errorf("GET %s on the admin listener without the token: %d, want 401", path, w.Code)
+		}
+		// Past the rate limit of 1, every time.
+		for i := 0; i < 3; i++ {
+			if w := do(admin, path, true); w.Code != http.StatusOK {
+				t.Errorf("GET %s on the admin listener: %d, want 200", path, w.Code)
+			}
+		}
+	}
+	vars := decodeBody[map[string]any](t, do(admin, "/debug/vars", true))
+	if n, _ := vars["goroutines"].(float64); n < 1 {
+		t.Errorf("/debug/vars = %v, want a goroutine count", vars)
+	}
+
+	// Without DEBUG_ENDPOINTS the admin listener doesn't have them either.
+	limited.DebugEndpoints = false
+	if w := do(newServers(&limited)[1].Handler, "/debug/pprof/", true); w.Code != http.StatusNotFound {
+		t.Errorf("GET /debug/pprof/ with DEBUG_ENDPOINTS=false: %d, want 404", w.Code)
+	}
+}
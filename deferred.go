@@ -0,0 +1,587 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// errStoreConnecting is returned by a deferred store until its backend's
+// first connection succeeds.
+var errStoreConnecting = newCategorizedError(errUnavailable, "store is still connecting, please retry later")
+
+// storesReady is set once every store has connected and the seed is loaded;
+// until then /readyz reports 503.
+var storesReady atomic.Bool
+
+// startupRetryPolicy paces the attempts to reach a database at startup.
+type startupRetryPolicy struct {
+	attempts  int           // tries before serving without the database; 0 goes straight to the background
+	baseDelay time.Duration // pause after the first failure; doubles per attempt
+	maxDelay  time.Duration
+}
+
+func (p startupRetryPolicy) backoff(attempt int) time.Duration {
+	d := p.baseDelay << attempt
+	if d > p.maxDelay || d <= 0 {
+		d = p.maxDelay
+	}
+	return d
+}
+
+// storeConnector opens a backend and builds its stores, migrating the schema
+// on the way.
+type storeConnector func() (MetricsStore, AlbumStore, APIKeyStore, error)
+
+// deferredConnection is a backend that was still unreachable when startup
+// moved on. metrics, albums, and apiKeys are set by the attempt that
+// succeeds, which then closes ready.
+type deferredConnection struct {
+	name    string
+	ready   chan struct{}
+	metrics MetricsStore
+	albums  AlbumStore
+	apiKeys APIKeyStore
+}
+
+// deferredConnections lists every backend still connecting when startup
+// moved on, for whenStoresConnected.
+var deferredConnections []*deferredConnection
+
+// connectStores calls connect until it succeeds. The first policy.attempts
+// tries are made before it returns, so a database that is up at boot is used
+// directly. After that the tries continue in the background, and the stores
+// returned in the meantime answer errStoreConnecting.
+func connectStores(name string, connect storeConnector, policy startupRetryPolicy) (MetricsStore, AlbumStore, APIKeyStore) {
+	conn := &deferredConnection{name: name, ready: make(chan struct{})}
+	for attempt := 0; attempt < policy.attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(policy.backoff(attempt - 1))
+		}
+		if conn.try(connect, attempt) {
+			return conn.metrics, conn.albums, conn.apiKeys
+		}
+	}
+	log.Printf("🔌 %s is unreachable, serving without it and retrying in the background", name)
+	deferredConnections = append(deferredConnections, conn)
+	go func() {
+		for attempt := policy.attempts; ; attempt++ {
+			if attempt > 0 {
+				time.Sleep(policy.backoff(attempt - 1))
+			}
+			if conn.try(connect, attempt) {
+				log.Printf("🔌 Connected to %s", name)
+				return
+			}
+		}
+	}()
+	return &DeferredMetricsStore{conn: conn}, &DeferredAlbumStore{conn: conn}, &DeferredAPIKeyStore{conn: conn}
+}
+
+func (conn *deferredConnection) try(connect storeConnector, attempt int) bool {
+	ms, as, ks, err := connect()
+	if err != nil {
+		log.Printf("🔁 Connecting to %s failed (attempt %d): %v", conn.name, attempt+1, err)
+		return false
+	}
+	conn.metrics, conn.albums, conn.apiKeys = ms, as, ks
+	close(conn.ready)
+	return true
+}
+
+// stores returns the connected stores, or ok=false while still connecting.
+func (conn *deferredConnection) stores() (ms MetricsStore, as AlbumStore, ks APIKeyStore, ok bool) {
+	select {
+	case <-conn.ready:
+		return conn.metrics, conn.albums, conn.apiKeys, true
+	default:
+		return nil, nil, nil, false
+	}
+}
+
+// whenStoresConnected calls fn once every deferred connection is up: right
+// away if none is pending, otherwise from a goroutine.
+func whenStoresConnected(fn func()) {
+	if len(deferredConnections) == 0 {
+		fn()
+		return
+	}
+	pending := deferredConnections
+	go func() {
+		for _, conn := range pending {
+			<-conn.ready
+		}
+		fn()
+	}()
+}
+
+// setupStartupRetryPolicy applies STARTUP_DB_RETRY_ATTEMPTS and
+// STARTUP_DB_RETRY_DELAY. Background attempts back off up to 30 seconds
+// apart.
+func setupStartupRetryPolicy(cfg *Config) startupRetryPolicy {
+	return startupRetryPolicy{attempts: cfg.StartupRetryAttempts, baseDelay: cfg.StartupRetryDelay, maxDelay: 30 * time.Second}
+}
+
+// DeferredMetricsStore stands in for a metrics store that is still
+// connecting.
+type DeferredMetricsStore struct {
+	conn *deferredConnection
+}
+
+func (store *DeferredMetricsStore) AddMetrics(ctx context.Context, delta Metrics) error {
+	ms, _, _, ok := store.conn.stores()
+	if !ok {
+		return errStoreConnecting
+	}
+	return ms.AddMetrics(ctx, delta)
+}
+
+func (store *DeferredMetricsStore) LoadMetrics(ctx context.Context) (Metrics, error) {
+	ms, _, _, ok := store.conn.stores()
+	if !ok {
+		return Metrics{}, errStoreConnecting
+	}
+	return ms.LoadMetrics(ctx)
+}
+
+func (store *DeferredMetricsStore) AddClientMetrics(ctx context.Context, deltas []ClientMetrics, keep int) error {
+	ms, _, _, ok := store.conn.stores()
+	if !ok {
+		return errStoreConnecting
+	}
+	return ms.AddClientMetrics(ctx, deltas, keep)
+}
+
+func (store *DeferredMetricsStore) LoadClientMetrics(ctx context.Context) ([]ClientMetrics, error) {
+	ms, _, _, ok := store.conn.stores()
+	if !ok {
+		return nil, errStoreConnecting
+	}
+	return ms.LoadClientMetrics(ctx)
+}
+
+// DeferredAlbumStore stands in for an album store that is still connecting,
+// failing every call with errStoreConnecting until it is up and passing them
+// through after.
+type DeferredAlbumStore struct {
+	conn *deferredConnection
+}
+
+func (store *DeferredAlbumStore) backend() (AlbumStore, error) {
+	_, as, _, ok := store.conn.stores()
+	if !ok {
+		return nil, errStoreConnecting
+	}
+	return as, nil
+}
+
+func (store *DeferredAlbumStore) List(ctx context.Context, opts ListOptions) (albumPage, error) {
+	as, err := store.backend()
+	if err != nil {
+		return albumPage{}, err
+	}
+	return as.List(ctx, opts)
+}
+
+func (store *DeferredAlbumStore) Iterate(ctx context.Context, opts ListOptions, fn func(album) error) error {
+	as, err := store.backend()
+	if err != nil {
+		return err
+	}
+	return as.Iterate(ctx, opts, fn)
+}
+
+func (store *DeferredAlbumStore) GetByID(ctx context.Context, id string) (album, error) {
+	as, err := store.backend()
+	if err != nil {
+		return album{}, err
+	}
+	return as.GetByID(ctx, id)
+}
+
+func (store *DeferredAlbumStore) GetBySlug(ctx context.Context, slug string) (album, error) {
+	as, err := store.backend()
+	if err != nil {
+		return album{}, err
+	}
+	return as.GetBySlug(ctx, slug)
+}
+
+func (store *DeferredAlbumStore) GetByBarcode(ctx context.Context, code string) (album, error) {
+	as, err := store.backend()
+	if err != nil {
+		return album{}, err
+	}
+	return as.GetByBarcode(ctx, code)
+}
+
+func (store *DeferredAlbumStore) Create(ctx context.Context, a album) (album, error) {
+	as, err := store.backend()
+	if err != nil {
+		return album{}, err
+	}
+	return as.Create(ctx, a)
+}
+
+func (store *DeferredAlbumStore) Update(ctx context.Context, a album, regenerateSlug bool) (album, error) {
+	as, err := store.backend()
+	if err != nil {
+		return album{}, err
+	}
+	return as.Update(ctx, a, regenerateSlug)
+}
+
+func (store *DeferredAlbumStore) CreateMany(ctx context.Context, albums []album) ([]album, error) {
+	as, err := store.backend()
+	if err != nil {
+		return nil, err
+	}
+	return as.CreateMany(ctx, albums)
+}
+
+func (store *DeferredAlbumStore) UpdateMany(ctx context.Context, albums []album, regenerateSlug bool) ([]album, error) {
+	as, err := store.backend()
+	if err != nil {
+		return nil, err
+	}
+	return as.UpdateMany(ctx, albums, regenerateSlug)
+}
+
+func (store *DeferredAlbumStore) Stats(ctx context.Context, filter AlbumFilter) (albumStats, error) {
+	as, err := store.backend()
+	if err != nil {
+		return albumStats{}, err
+	}
+	return storeStats(ctx, as, filter)
+}
+
+func (store *DeferredAlbumStore) PriceHistory(ctx context.Context, albumID string, limit, offset int) ([]PriceChange, int, error) {
+	as, err := store.backend()
+	if err != nil {
+		return nil, 0, err
+	}
+	return storePriceHistory(ctx, as, albumID, limit, offset)
+}
+
+func (store *DeferredAlbumStore) Changes(ctx context.Context, since int64, limit int) ([]types.AlbumChange, int64, error) {
+	as, err := store.backend()
+	if err != nil {
+		return nil, 0, err
+	}
+	return storeChanges(ctx, as, since, limit)
+}
+
+func (store *DeferredAlbumStore) TrimChanges(ctx context.Context, before time.Time) (int, error) {
+	as, err := store.backend()
+	if err != nil {
+		return 0, err
+	}
+	return storeTrimChanges(ctx, as, before)
+}
+
+func (store *DeferredAlbumStore) OutboxPosition(ctx context.Context) (outboxPosition, error) {
+	as, err := store.backend()
+	if err != nil {
+		return outboxPosition{}, err
+	}
+	return storeOutboxPosition(ctx, as)
+}
+
+func (store *DeferredAlbumStore) AdvanceOutbox(ctx context.Context, from, to int64) (bool, error) {
+	as, err := store.backend()
+	if err != nil {
+		return false, err
+	}
+	return storeAdvanceOutbox(ctx, as, from, to)
+}
+
+func (store *DeferredAlbumStore) PublishDue(ctx context.Context, now time.Time) ([]album, error) {
+	as, err := store.backend()
+	if err != nil {
+		return nil, err
+	}
+	return storePublishDue(ctx, as, now)
+}
+
+func (store *DeferredAlbumStore) Revisions(ctx context.Context, from, to time.Time) ([]albumRevision, time.Time, error) {
+	as, err := store.backend()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return storeRevisions(ctx, as, from, to)
+}
+
+func (store *DeferredAlbumStore) AnonymizeAudit(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	as, err := store.backend()
+	if err != nil {
+		return 0, err
+	}
+	return storeAnonymizeAudit(ctx, as, before, dryRun)
+}
+
+func (store *DeferredAlbumStore) PruneImportJobs(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	as, err := store.backend()
+	if err != nil {
+		return 0, err
+	}
+	return storePruneImportJobs(ctx, as, before, dryRun)
+}
+
+func (store *DeferredAlbumStore) SyncToken(ctx context.Context) (string, error) {
+	as, err := store.backend()
+	if err != nil {
+		return "", err
+	}
+	return storeSyncToken(ctx, as)
+}
+
+func (store *DeferredAlbumStore) ArtistGroups(ctx context.Context, availableAt time.Time) ([]artistGroup, error) {
+	as, err := store.backend()
+	if err != nil {
+		return nil, err
+	}
+	return storeArtistGroups(ctx, as, availableAt)
+}
+
+func (store *DeferredAlbumStore) Search(ctx context.Context, query searchNode) ([]album, error) {
+	as, err := store.backend()
+	if err != nil {
+		return nil, err
+	}
+	return storeSearch(ctx, as, query)
+}
+
+func (store *DeferredAlbumStore) Import(ctx context.Context, mode importMode, next func() (album, error)) (int, error) {
+	as, err := store.backend()
+	if err != nil {
+		return 0, err
+	}
+	importer, ok := as.(AlbumImporter)
+	if !ok {
+		return 0, errImportUnsupported
+	}
+	return importer.Import(ctx, mode, next)
+}
+
+func (store *DeferredAlbumStore) DeleteMany(ctx context.Context, ids []string) error {
+	as, err := store.backend()
+	if err != nil {
+		return err
+	}
+	return storeDeleteMany(ctx, as, ids)
+}
+
+func (store *DeferredAlbumStore) MergeAlbums(ctx context.Context, survivor album, duplicates []string) (album, error) {
+	as, err := store.backend()
+	if err != nil {
+		return album{}, err
+	}
+	return storeMergeAlbums(ctx, as, survivor, duplicates)
+}
+
+func (store *DeferredAlbumStore) RenameArtist(ctx context.Context, from, to string) ([]album, error) {
+	as, err := store.backend()
+	if err != nil {
+		return nil, err
+	}
+	return storeRenameArtist(ctx, as, from, to)
+}
+
+func (store *DeferredAlbumStore) SellAlbum(ctx context.Context, id string, quantity int) (album, error) {
+	as, err := store.backend()
+	if err != nil {
+		return album{}, err
+	}
+	return storeSellAlbum(ctx, as, id, quantity)
+}
+
+func (store *DeferredAlbumStore) paymentEvents() (paymentEventStore, error) {
+	as, err := store.backend()
+	if err != nil {
+		return nil, err
+	}
+	return paymentEventsOf(as)
+}
+
+func (store *DeferredAlbumStore) SellAlbumForPayment(ctx context.Context, eventID string, now, expires time.Time, id string, quantity int) (album, error) {
+	events, err := store.paymentEvents()
+	if err != nil {
+		return album{}, err
+	}
+	return events.SellAlbumForPayment(ctx, eventID, now, expires, id, quantity)
+}
+
+func (store *DeferredAlbumStore) PrunePaymentEvents(ctx context.Context, now time.Time) (int, error) {
+	events, err := store.paymentEvents()
+	if err != nil {
+		return 0, err
+	}
+	return events.PrunePaymentEvents(ctx, now)
+}
+
+func (store *DeferredAlbumStore) importJobs() (importJobStore, error) {
+	as, err := store.backend()
+	if err != nil {
+		return nil, err
+	}
+	return importJobsOf(as)
+}
+
+func (store *DeferredAlbumStore) CreateImportJob(ctx context.Context, job importJob) error {
+	jobs, err := store.importJobs()
+	if err != nil {
+		return err
+	}
+	return jobs.CreateImportJob(ctx, job)
+}
+
+func (store *DeferredAlbumStore) GetImportJob(ctx context.Context, id string) (importJob, error) {
+	jobs, err := store.importJobs()
+	if err != nil {
+		return importJob{}, err
+	}
+	return jobs.GetImportJob(ctx, id)
+}
+
+func (store *DeferredAlbumStore) SaveImportJobProgress(ctx context.Context, job importJob) error {
+	jobs, err := store.importJobs()
+	if err != nil {
+		return err
+	}
+	return jobs.SaveImportJobProgress(ctx, job)
+}
+
+func (store *DeferredAlbumStore) CancelImportJob(ctx context.Context, id string) error {
+	jobs, err := store.importJobs()
+	if err != nil {
+		return err
+	}
+	return jobs.CancelImportJob(ctx, id)
+}
+
+func (store *DeferredAlbumStore) savedSearches() (savedSearchStore, error) {
+	as, err := store.backend()
+	if err != nil {
+		return nil, err
+	}
+	return savedSearchesOf(as)
+}
+
+func (store *DeferredAlbumStore) CreateSavedSearch(ctx context.Context, s savedSearch) error {
+	searches, err := store.savedSearches()
+	if err != nil {
+		return err
+	}
+	return searches.CreateSavedSearch(ctx, s)
+}
+
+func (store *DeferredAlbumStore) GetSavedSearch(ctx context.Context, id string) (savedSearch, error) {
+	searches, err := store.savedSearches()
+	if err != nil {
+		return savedSearch{}, err
+	}
+	return searches.GetSavedSearch(ctx, id)
+}
+
+func (store *DeferredAlbumStore) ListSavedSearches(ctx context.Context, owner string) ([]savedSearch, error) {
+	searches, err := store.savedSearches()
+	if err != nil {
+		return nil, err
+	}
+	return searches.ListSavedSearches(ctx, owner)
+}
+
+func (store *DeferredAlbumStore) DeleteSavedSearch(ctx context.Context, id string) error {
+	searches, err := store.savedSearches()
+	if err != nil {
+		return err
+	}
+	return searches.DeleteSavedSearch(ctx, id)
+}
+
+func (store *DeferredAlbumStore) PoolStats() (types.PoolStats, bool) {
+	as, err := store.backend()
+	if err != nil {
+		return types.PoolStats{}, false
+	}
+	if p, ok := as.(poolStatser); ok {
+		return p.PoolStats()
+	}
+	return types.PoolStats{}, false
+}
+
+func (store *DeferredAlbumStore) Ping(ctx context.Context) error {
+	as, err := store.backend()
+	if err != nil {
+		return err
+	}
+	if p, ok := as.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// DeferredAPIKeyStore stands in for an API key store that is still
+// connecting.
+type DeferredAPIKeyStore struct {
+	conn *deferredConnection
+}
+
+func (store *DeferredAPIKeyStore) backend() (APIKeyStore, error) {
+	_, _, ks, ok := store.conn.stores()
+	if !ok {
+		return nil, errStoreConnecting
+	}
+	return ks, nil
+}
+
+func (store *DeferredAPIKeyStore) CreateAPIKey(ctx context.Context, k apiKey) error {
+	ks, err := store.backend()
+	if err != nil {
+		return err
+	}
+	return ks.CreateAPIKey(ctx, k)
+}
+
+func (store *DeferredAPIKeyStore) GetAPIKey(ctx context.Context, id string) (apiKey, error) {
+	ks, err := store.backend()
+	if err != nil {
+		return apiKey{}, err
+	}
+	return ks.GetAPIKey(ctx, id)
+}
+
+func (store *DeferredAPIKeyStore) ListAPIKeys(ctx context.Context) ([]apiKey, error) {
+	ks, err := store.backend()
+	if err != nil {
+		return nil, err
+	}
+	return ks.ListAPIKeys(ctx)
+}
+
+func (store *DeferredAPIKeyStore) SetAPIKeyTier(ctx context.Context, id, tier string) error {
+	ks, err := store.backend()
+	if err != nil {
+		return err
+	}
+	return ks.SetAPIKeyTier(ctx, id, tier)
+}
+
+func (store *DeferredAPIKeyStore) RevokeAPIKey(ctx context.Context, id string, at time.Time) error {
+	ks, err := store.backend()
+	if err != nil {
+		return err
+	}
+	return ks.RevokeAPIKey(ctx, id, at)
+}
+
+func (store *DeferredAPIKeyStore) TouchAPIKey(ctx context.Context, id string, at time.Time) error {
+	ks, err := store.backend()
+	if err != nil {
+		return err
+	}
+	return ks.TouchAPIKey(ctx, id, at)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testStartupRetryPolicy = startupRetryPolicy{attempts: 5, baseDelay: time.Millisecond, maxDelay: 5 * time.Millisecond}
+
+// thirdTimeConnector is a storeConnector whose first two attempts fail. The
+// third waits for release, if set, then returns s's stores.
+func thirdTimeConnector(s *testServer, attempts *atomic.Int32, release <-chan struct{}) storeConnector {
+	return func() (MetricsStore, AlbumStore, APIKeyStore, error) {
+		if attempts.Add(1) < 3 {
+			return nil, nil, nil, errors.New("dial tcp 127.0.0.1:5432: connect: connection refused")
+		}
+		if release != nil {
+			<-release
+		}
+		return s.metrics, s.albums, apiKeyStore, nil
+	}
+}
+
+// useDeferredConnections gives t its own list of deferred connections.
+func useDeferredConnections(t *testing.T) {
+	previous := deferredConnections
+	deferredConnections = nil
+	t.Cleanup(func() { deferredConnections = previous })
+}
+
+func TestConnectStoresRetriesAtStartup(t *testing.T) {
+	s := newTestServer(t)
+	useDeferredConnections(t)
+	var attempts atomic.Int32
+	ms, as, _ := connectStores("test database", thirdTimeConnector(s, &attempts, nil), testStartupRetryPolicy)
+	if attempts.Load() != 3 {
+		t.Errorf("%d attempts, want 3", attempts.Load())
+	}
+	if ms != MetricsStore(s.metrics) || as != AlbumStore(s.albums) {
+		t.Errorf("connectStores returned %T and %T, want the connected stores", ms, as)
+	}
+	if len(deferredConnections) != 0 {
+		t.Error("a connection made at startup was deferred")
+	}
+}
+
+func TestConnectStoresInBackground(t *testing.T) {
+	s := newTestServer(t)
+	useDeferredConnections(t)
+	var attempts atomic.Int32
+	release := make(chan struct{})
+	policy := testStartupRetryPolicy
+	policy.attempts = 1
+	ms, as, ks := connectStores("test database", thirdTimeConnector(s, &attempts, release), policy)
+	metricsStore, albumStore, apiKeyStore = ms, as, ks
+	storesReady.Store(false)
+	connected := make(chan struct{})
+	whenStoresConnected(func() {
+		storesReady.Store(true)
+		close(connected)
+	})
+
+	// Until the database is up, the album endpoints and /readyz answer 503.
+	expectProblem(t, s.do(http.MethodGet, "/albums", ""), http.StatusServiceUnavailable)
+	expectProblem(t, s.do(http.MethodPost, "/albums", albumJSON(newTestAlbum())), http.StatusServiceUnavailable)
+	expectStatus(t, s.do(http.MethodGet, "/readyz", ""), http.StatusServiceUnavailable)
+	expectStatus(t, s.do(http.MethodGet, "/healthz", ""), http.StatusOK)
+
+	close(release)
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the background attempts never connected")
+	}
+	if attempts.Load() != 3 {
+		t.Errorf("%d attempts, want 3", attempts.Load())
+	}
+	expectStatus(t, s.do(http.MethodGet, "/readyz", ""), http.StatusOK)
+	s.create(newTestAlbum())
+	expectStatus(t, s.do(http.MethodGet, "/albums", ""), http.StatusOK)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+)
+
+// statusClientClosedRequest is the status nginx logs for a request whose
+// client hung up before the answer. It is never sent; there is no one to
+// send it to.
+const statusClientClosedRequest = 499
+
+// totalClientClosedRequests counts the requests whose client went away
+// before they were answered. They are left out of the request, error, and
+// latency counts, which describe the answers clients actually got.
+var totalClientClosedRequests int64
+
+var errClientGone = errors.New("client closed the connection")
+
+// clientGone reports whether r's client has hung up. The server cancels the
+// request's context when the connection closes; nothing in this service
+// cancels it otherwise, and its own deadlines end in DeadlineExceeded. The
+// server also cancels it when a read goes past the connection's deadline,
+// but a client whose body was late is still there to be answered 408.
+func clientGone(r *http.Request) bool {
+	return contextGone(r.Context())
+}
+
+func contextGone(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.Canceled) && !bodyTimedOut(ctx)
+}
+
+// abandoned reports whether r's client has hung up, logging it so the
+// handler can return straight away, before or after an expensive step.
+func abandoned(r *http.Request) bool {
+	if !clientGone(r) {
+		return false
+	}
+	log.Printf("👋 Client went away during %s %s", r.Method, r.URL.Path)
+	return true
+}
+
+// disconnectWriter stops writing once the client has hung up, so a handler
+// that finishes after that doesn't encode into a dead connection. Streaming
+// handlers see errClientGone from Write and stop. It also carries the
+// jsonStyle the client asked for.
+type disconnectWriter struct {
+	http.ResponseWriter
+	ctx   context.Context
+	style jsonStyle
+}
+
+func (w *disconnectWriter) gone() bool {
+	return contextGone(w.ctx)
+}
+
+func (w *disconnectWriter) WriteHeader(code int) {
+	if !w.gone() {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *disconnectWriter) Write(b []byte) (int, error) {
+	if w.gone() {
+		return 0, errClientGone
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// disconnectMiddleware sits right outside the routes, so a handler gets the
+// disconnectWriter itself and writeJSON can skip encoding for a client
+// that is gone, and write in the client's style.
+func disconnectMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&disconnectWriter{ResponseWriter: w, ctx: r.Context(), style: requestJSONStyle(r)}, r)
+	})
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useDualWrite puts a DualWriteAlbumStore over s's albums and secondary in
+// place of the album store, with a fresh backfill tracker.
+func useDualWrite(s *testServer, secondary AlbumStore) *DualWriteAlbumStore {
+	store := NewDualWriteAlbumStore(s.albums, secondary)
+	previousStore, previousBackfill := dualWriteStore, backfill
+	s.t.Cleanup(func() { dualWriteStore, backfill = previousStore, previousBackfill })
+	albumStore, dualWriteStore = store, store
+	backfill = &backfillTracker{status: backfillStatus{State: "idle"}}
+	return store
+}
+
+func TestDualWriteMirrorsWrites(t *testing.T) {
+	s := newTestServer(t)
+	secondary := NewInMemoryAlbumStore()
+	useDualWrite(s, secondary)
+	ctx := context.Background()
+
+	a := s.create(newTestAlbum())
+	expectStatus(t, s.do(http.MethodPut, "/albums/"+a.ID, albumJSON(newTestAlbum(withPrice(4999)))), http.StatusOK)
+	got, err := secondary.GetByID(ctx, a.ID)
+	if err != nil {
+		t.Fatalf("the secondary lacks the album written: %v", err)
+	}
+	if got.Slug != a.Slug || got.Price.Cents() != 4999 {
+		t.Errorf("the secondary has %+v, want the primary's album at 49.99", got)
+	}
+	v, err := verifyStores(ctx, s.albums, secondary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !v.Match || v.Primary.Count != 1 {
+		t.Errorf("verification = %+v, want one album in each, matching", v)
+	}
+}
+
+func TestDualWriteSecondaryFailure(t *testing.T) {
+	s := newTestServer(t)
+	secondary := newFaultyAlbumStore()
+	useDualWrite(s, secondary)
+	ctx := context.Background()
+
+	secondary.failing.Store(true)
+	failuresBefore := atomic.LoadInt64(&totalSecondaryWriteFailures)
+	a := s.create(newTestAlbum())
+	if got := atomic.LoadInt64(&totalSecondaryWriteFailures) - failuresBefore; got != 1 {
+		t.Errorf("%d secondary failures counted, want 1", got)
+	}
+	if _, err := s.albums.GetByID(ctx, a.ID); err != nil {
+		t.Errorf("the primary lacks the album: %v", err)
+	}
+	if _, err := secondary.InMemoryAlbumStore.GetByID(ctx, a.ID); err == nil {
+		t.Error("the failing secondary has the album")
+	}
+	w := s.admin(http.MethodPost, "/admin/stores/verify", "")
+	expectStatus(t, w, http.StatusOK)
+	if v := decodeBody[storeVerification](t, w); v.Match {
+		t.Errorf("verification with the secondary behind = %+v, want a mismatch", v)
+	}
+
+	// Once the secondary is back, a backfill brings it level.
+	secondary.failing.Store(false)
+	s.create(newTestAlbum(withTitle("Giant Steps")))
+	expectStatus(t, s.admin(http.MethodPost, "/admin/stores/backfill", ""), http.StatusAccepted)
+	var status backfillStatus
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		status = decodeBody[backfillStatus](t, s.admin(http.MethodGet, backfillStatusRoute, ""))
+		if status.State != "running" || time.Now().After(deadline) {
+			break
+		}
+	}
+	if status.State != "done" || status.Total != 2 || status.Copied != 2 {
+		t.Fatalf("backfill status = %+v, want done with 2 of 2 copied", status)
+	}
+	if status.Verification == nil || !status.Verification.Match {
+		t.Errorf("backfill verification = %+v, want a match", status.Verification)
+	}
+}
+
+func TestBackfillWithoutSecondary(t *testing.T) {
+	s := newTestServer(t)
+	expectProblem(t, s.admin(http.MethodPost, "/admin/stores/backfill", ""), http.StatusNotFound)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+const (
+	defaultDynamoTimeout = 5 * time.Second
+
+	// defaultDynamoHedgeMaxPercent is the share of item reads that may be
+	// hedged, when DYNAMODB_HEDGE_AFTER turns hedging on.
+	defaultDynamoHedgeMaxPercent = 10
+)
+
+// newDynamoClient builds a DynamoDB client for AWS_REGION from the default
+// AWS credential chain. DYNAMODB_ENDPOINT points the client at DynamoDB Local
+// or another compatible endpoint. Transient failures are retried by the SDK's
+// standard retryer, capped by STORE_RETRY_ATTEMPTS like the other stores.
+func newDynamoClient(cfg *Config) (*dynamodb.Client, error) {
+	policy := setupRetryPolicy(cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	awsConfig, err := config.LoadDefaultConfig(ctx,
+		config.WithRegion(cfg.AWSRegion),
+		config.WithRetryer(func() aws.Retryer {
+			return retry.NewStandard(func(o *retry.StandardOptions) {
+				o.MaxAttempts = policy.attempts
+				o.MaxBackoff = policy.maxDelay
+			})
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS config: %w", err)
+	}
+	client := dynamodb.NewFromConfig(awsConfig, func(o *dynamodb.Options) {
+		if cfg.DynamoEndpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.DynamoEndpoint)
+		}
+	})
+	return client, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// dynamoHedgeBurst is the most hedges the budget saves up, so that a quiet
+// spell doesn't pay for a long run of them later.
+const dynamoHedgeBurst = 10
+
+// dynamoItemGetter is the read DynamoAlbumStore makes of single items.
+// *dynamodb.Client implements it, and so does hedgedGetter around one. It
+// is the only call ever hedged: a GetItem can be sent twice without
+// changing anything.
+type dynamoItemGetter interface {
+	GetItem(ctx context.Context, in *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+}
+
+// hedgedGetter sends a second, identical GetItem when the first hasn't
+// answered within after, takes whichever answers first, and cancels the
+// other. Hedges are budgeted: every read earns maxPercent of one, so when
+// every read is slow, as in an outage, no more than that share of them are
+// sent twice.
+type hedgedGetter struct {
+	client     dynamoItemGetter
+	after      time.Duration
+	maxPercent int
+
+	mu     sync.Mutex
+	budget float64 // hedges that may be sent now
+
+	hedged  atomic.Int64 // second requests sent
+	wins    atomic.Int64 // reads the second request answered
+	skipped atomic.Int64 // slow reads not hedged for want of budget
+}
+
+// newHedgedGetter hedges the reads of client after the delay, or returns
+// client as it is when after is 0.
+func newHedgedGetter(client dynamoItemGetter, after time.Duration, maxPercent int) dynamoItemGetter {
+	if after <= 0 {
+		return client
+	}
+	return &hedgedGetter{client: client, after: after, maxPercent: maxPercent, budget: dynamoHedgeBurst}
+}
+
+type hedgeResult struct {
+	out   *dynamodb.GetItemOutput
+	err   error
+	hedge bool
+}
+
+func (h *hedgedGetter) GetItem(ctx context.Context, in *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	h.earn()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops the request that lost
+	results := make(chan hedgeResult, 2)
+	send := func(hedge bool) {
+		out, err := h.client.GetItem(ctx, in, optFns...)
+		results <- hedgeResult{out: out, err: err, hedge: hedge}
+	}
+	go send(false)
+
+	timer := time.NewTimer(h.after)
+	defer timer.Stop()
+	select {
+	case r := <-results:
+		return r.out, r.err
+	case <-timer.C:
+	}
+	if !h.spend() {
+		h.skipped.Add(1)
+		r := <-results
+		return r.out, r.err
+	}
+	h.hedged.Add(1)
+	go send(true)
+
+	// The first answer wins, unless it is a failure and the other request
+	// may still succeed.
+	r := <-results
+	if r.err != nil {
+		r = <-results
+	}
+	if r.hedge && r.err == nil {
+		h.wins.Add(1)
+	}
+	return r.out, r.err
+}
+
+// earn adds a read's share of a hedge to the budget.
+func (h *hedgedGetter) earn() {
+	h.mu.Lock()
+	h.budget = min(h.budget+float64(h.maxPercent)/100, dynamoHedgeBurst)
+	h.mu.Unlock()
+}
+
+// spend takes a hedge from the budget, if there is one.
+func (h *hedgedGetter) spend() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.budget < 1 {
+		return false
+	}
+	h.budget--
+	return true
+}
+
+func (h *hedgedGetter) stats() types.HedgeStats {
+	return types.HedgeStats{
+		Hedged:  h.hedged.Load(),
+		Wins:    h.wins.Load(),
+		Skipped: h.skipped.Load(),
+	}
+}
+
+// HedgeStats implements hedgeStatser.
+func (store *DynamoAlbumStore) HedgeStats() (types.HedgeStats, bool) {
+	h, ok := store.reads.(*hedgedGetter)
+	if !ok {
+		return types.HedgeStats{}, false
+	}
+	return h.stats(), true
+}
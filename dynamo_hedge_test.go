@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamotypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// fakeGetter is a GetItem client whose calls each take the latency the
+// test sets for them, in order, the last for any after, and fail with the
+// error set beside it. It answers with the item of items under the key
+// asked for.
+type fakeGetter struct {
+	latencies []time.Duration
+	errs      []error
+	items     map[string]map[string]dynamotypes.AttributeValue
+
+	mu        sync.Mutex
+	calls     int
+	cancelled []int // the calls cancelled before they answered
+	running   sync.WaitGroup
+}
+
+func (f *fakeGetter) GetItem(ctx context.Context, in *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	f.mu.Lock()
+	call := f.calls
+	f.calls++
+	f.running.Add(1)
+	f.mu.Unlock()
+	defer f.running.Done()
+
+	latency := f.latencies[min(call, len(f.latencies)-1)]
+	select {
+	case <-time.After(latency):
+	case <-ctx.Done():
+		f.mu.Lock()
+		f.cancelled = append(f.cancelled, call)
+		f.mu.Unlock()
+		return nil, ctx.Err()
+	}
+	if call < len(f.errs) && f.errs[call] != nil {
+		return nil, f.errs[call]
+	}
+	id := in.Key["id"].(*dynamotypes.AttributeValueMemberS).Value
+	return &dynamodb.GetItemOutput{Item: f.items[id]}, nil
+}
+
+// finished waits for every call made so far to return, and reports which
+// were cancelled.
+func (f *fakeGetter) finished() []int {
+	f.running.Wait()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.cancelled
+}
+
+func getTestItem(getter dynamoItemGetter) (time.Duration, error) {
+	start := time.Now()
+	_, err := getter.GetItem(context.Background(), &dynamodb.GetItemInput{
+		TableName: aws.String(dynamoAlbumsTable),
+		Key:       map[string]dynamotypes.AttributeValue{"id": &dynamotypes.AttributeValueMemberS{Value: "a"}},
+	})
+	return time.Since(start), err
+}
+
+func TestHedgedGetter(t *testing.T) {
+	const after = 20 * time.Millisecond
+	const slow = 2 * time.Second
+	errThrottled := errors.New("ThrottlingException")
+	for _, tc := range []struct {
+		name      string
+		latencies []time.Duration
+		errs      []error
+		err       error
+		want      types.HedgeStats
+		cancelled string // the calls cancelled, the first being 0
+	}{
+		{name: "a fast read", latencies: []time.Duration{time.Millisecond}, cancelled: "[]"},
+		{name: "the hedge answering first", latencies: []time.Duration{slow, time.Millisecond}, want: types.HedgeStats{Hedged: 1, Wins: 1}, cancelled: "[0]"},
+		{name: "the first answering first", latencies: []time.Duration{after + 10*time.Millisecond, slow}, want: types.HedgeStats{Hedged: 1}, cancelled: "[1]"},
+		// A failure doesn't end the read while the other request may still
+		// succeed.
+		{name: "the first failing", latencies: []time.Duration{after + 5*time.Millisecond, 20 * time.Millisecond}, errs: []error{errThrottled}, want: types.HedgeStats{Hedged: 1, Wins: 1}, cancelled: "[]"},
+		{name: "the hedge failing", latencies: []time.Duration{after + 20*time.Millisecond, time.Millisecond}, errs: []error{nil, errThrottled}, want: types.HedgeStats{Hedged: 1}, cancelled: "[]"},
+		{name: "both failing", latencies: []time.Duration{after + 5*time.Millisecond, time.Millisecond}, errs: []error{errThrottled, errThrottled}, err: errThrottled, want: types.HedgeStats{Hedged: 1}, cancelled: "[]"},
+		// A failure before the hedge is due is the answer.
+		{name: "a fast failure", latencies: []time.Duration{time.Millisecond}, errs: []error{errThrottled}, err: errThrottled, cancelled: "[]"},
+	} {
+		fake := &fakeGetter{latencies: tc.latencies, errs: tc.errs}
+		h := newHedgedGetter(fake, after, 10).(*hedgedGetter)
+		took, err := getTestItem(h)
+		if !errors.Is(err, tc.err) || (tc.err == nil) != (err == nil) {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.err)
+		}
+		if took >= slow {
+			t.Errorf("%s: took %s, waiting on the slow request", tc.name, took)
+		}
+		if got := fmt.Sprint(fake.finished()); got != tc.cancelled {
+			t.Errorf("%s: cancelled %s, want %s", tc.name, got, tc.cancelled)
+		}
+		if got := h.stats(); got != tc.want {
+			t.Errorf("%s: %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestHedgeBudget(t *testing.T) {
+	// Every read is slow, as in an outage: the saved-up burst is hedged,
+	// then one read in ten.
+	fake := &fakeGetter{latencies: []time.Duration{3 * time.Millisecond}}
+	h := newHedgedGetter(fake, time.Millisecond, 10).(*hedgedGetter)
+	const reads = 100
+	for i := 0; i < reads; i++ {
+		if _, err := getTestItem(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake.finished()
+	stats := h.stats()
+	if stats.Hedged+stats.Skipped != reads || stats.Hedged < dynamoHedgeBurst+8 || stats.Hedged > dynamoHedgeBurst+reads/10+1 {
+		t.Errorf("%+v, want the burst and a tenth of the rest hedged", stats)
+	}
+	if fake.calls != reads+int(stats.Hedged) {
+		t.Errorf("%d calls for %d reads and %d hedges", fake.calls, reads, stats.Hedged)
+	}
+
+	// Without a delay nothing is hedged.
+	if got := newHedgedGetter(fake, 0, 10); got != dynamoItemGetter(fake) {
+		t.Errorf("a zero delay hedges with %T", got)
+	}
+}
+
+func TestDynamoHedgedRead(t *testing.T) {
+	s := newTestServer(t)
+	useInstrumentedStores(t)
+	a := newTestAlbum(withID("a"))
+	item, err := attributevalue.MarshalMap(dynamoAlbum{ID: a.ID, Kind: dynamoKindAlbum, Title: a.Title, Artist: a.Artist, Price: float64(a.Price), Slug: "blue-train"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeGetter{latencies: []time.Duration{time.Second, time.Millisecond}, items: map[string]map[string]dynamotypes.AttributeValue{"a": item}}
+	store := NewInstrumentedAlbumStore(&DynamoAlbumStore{reads: newHedgedGetter(fake, 10*time.Millisecond, 10), timeout: 5 * time.Second}, "dynamodb")
+
+	// The album store's reads of an item go through the hedger.
+	got, err := store.GetByID(context.Background(), "a")
+	if err != nil || got.Title != a.Title {
+		t.Fatalf("GetByID = %+v, %v", got, err)
+	}
+	if cancelled := fmt.Sprint(fake.finished()); cancelled != "[0]" {
+		t.Errorf("cancelled %s, want the slow first request", cancelled)
+	}
+
+	// /metrics and its Prometheus output report the hedge and its win.
+	report := decodeBody[types.MetricsReport](t, s.do(http.MethodGet, "/metrics", ""))
+	if got := report.ReadHedging["dynamodb"]; got != (types.HedgeStats{Hedged: 1, Wins: 1}) {
+		t.Errorf("readHedging %+v", report.ReadHedging)
+	}
+	prom := strings.Split(s.do(http.MethodGet, "/metrics?format=prometheus", "").Body.String(), "\n")
+	for name, want := range map[string]string{"albums_store_hedged_reads_total": "1", "albums_store_hedge_wins_total": "1", "albums_store_hedges_skipped_total": "0"} {
+		if !slices.ContainsFunc(prom, func(line string) bool {
+			return strings.HasPrefix(line, name+"{") && strings.HasSuffix(line, `backend="dynamodb"} `+want)
+		}) {
+			t.Errorf("the Prometheus output has no %s of %s", name, want)
+		}
+	}
+}
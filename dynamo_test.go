@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// testDynamoTables are the tables the stores expect, by name, with their
+// keys: a hash key and, for metricsHistory, a numeric range key.
+var testDynamoTables = map[string][2]string{
+	dynamoAlbumsTable:         {"id"},
+	dynamoMetricsTable:        {"id"},
+	dynamoClientMetricsTable:  {"client"},
+	dynamoMetricsHistoryTable: {"instance", "at"},
+	dynamoAPIKeysTable:        {"id"},
+	dynamoImportJobsTable:     {"id"},
+	dynamoSavedSearchesTable:  {"id"},
+}
+
+// testDynamoClient returns a client of the DynamoDB Local at
+// TEST_DYNAMODB_ENDPOINT, skipping t without one. The stores' table names
+// are fixed, so the tables are created afresh for each test, and tests using
+// them can't share an endpoint.
+func testDynamoClient(t testing.TB) *dynamodb.Client {
+	t.Helper()
+	endpoint := os.Getenv("TEST_DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("TEST_DYNAMODB_ENDPOINT is not set")
+	}
+	// DynamoDB Local takes any credentials, but the SDK wants some.
+	for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+		if os.Getenv(env) == "" {
+			t.Setenv(env, "test")
+		}
+	}
+	cfg := defaultConfig()
+	cfg.AWSRegion, cfg.DynamoEndpoint = "us-east-1", endpoint
+	client, err := newDynamoClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for table, key := range testDynamoTables {
+		client.DeleteTable(ctx, &dynamodb.DeleteTableInput{TableName: aws.String(table)})
+		in := &dynamodb.CreateTableInput{
+			TableName:            aws.String(table),
+			BillingMode:          types.BillingModePayPerRequest,
+			KeySchema:            []types.KeySchemaElement{{AttributeName: aws.String(key[0]), KeyType: types.KeyTypeHash}},
+			AttributeDefinitions: []types.AttributeDefinition{{AttributeName: aws.String(key[0]), AttributeType: types.ScalarAttributeTypeS}},
+		}
+		if key[1] != "" {
+			in.KeySchema = append(in.KeySchema, types.KeySchemaElement{AttributeName: aws.String(key[1]), KeyType: types.KeyTypeRange})
+			in.AttributeDefinitions = append(in.AttributeDefinitions, types.AttributeDefinition{AttributeName: aws.String(key[1]), AttributeType: types.ScalarAttributeTypeN})
+		}
+		if _, err := client.CreateTable(ctx, in); err != nil {
+			t.Fatalf("creating %s: %v", table, err)
+		}
+	}
+	return client
+}
+
+func TestNewDynamoClient(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.AWSRegion, cfg.DynamoEndpoint, cfg.StoreRetryAttempts = "eu-west-1", "http://localhost:8000", 4
+	client, err := newDynamoClient(&cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := client.Options()
+	if opts.Region != "eu-west-1" {
+		t.Errorf("region = %q, want eu-west-1", opts.Region)
+	}
+	if got := aws.ToString(opts.BaseEndpoint); got != "http://localhost:8000" {
+		t.Errorf("endpoint = %q, want DYNAMODB_ENDPOINT", got)
+	}
+	if got := opts.Retryer.MaxAttempts(); got != 4 {
+		t.Errorf("the SDK retries %d times, want STORE_RETRY_ATTEMPTS", got)
+	}
+}
+
+func TestDynamoStores(t *testing.T) {
+	client := testDynamoClient(t)
+	ctx := context.Background()
+	albums := NewDynamoAlbumStore(client, defaultDynamoTimeout, 0, 0)
+
+	a, err := albums.Create(ctx, newTestAlbum(withID(newAlbumID()), withBarcode("036000291452")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := albums.GetBySlug(ctx, a.Slug)
+	if err != nil || got.ID != a.ID || got.Price != a.Price {
+		t.Errorf("GetBySlug(%s) = %+v, %v; want %+v", a.Slug, got, err, a)
+	}
+	if _, err := albums.Create(ctx, newTestAlbum(withID(newAlbumID()), withBarcode("036000291452"))); !errors.Is(err, errBarcodeTaken) {
+		t.Errorf("Create with a taken barcode = %v, want errBarcodeTaken", err)
+	}
+	if _, err := albums.GetByID(ctx, "missing"); !errors.Is(err, errAlbumNotFound) {
+		t.Errorf("GetByID of a missing album = %v, want errAlbumNotFound", err)
+	}
+
+	ms := NewDynamoMetricsStore(client)
+	for i := 0; i < 2; i++ {
+		if err := ms.AddMetrics(ctx, Metrics{TotalRequests: 3, TotalErrors: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := ms.LoadMetrics(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.TotalRequests != 6 || m.TotalErrors != 2 {
+		t.Errorf("metrics = %+v, want 6 requests and 2 errors", m)
+	}
+	if err := ms.AddClientMetrics(ctx, []ClientMetrics{{Client: "203.0.113.7", Requests: 2, LastSeen: time.Now()}}, 10); err != nil {
+		t.Fatal(err)
+	}
+	clients, err := ms.LoadClientMetrics(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 || clients[0].Requests != 2 {
+		t.Errorf("client metrics = %+v, want one client with 2 requests", clients)
+	}
+}
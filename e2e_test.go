@@ -0,0 +1,644 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// These tests drive the API through the handler main serves, middleware
+// and all, over in-memory stores.
+
+func TestAlbumRoutes(t *testing.T) {
+	s := newTestServer(t)
+	blue := s.create(newTestAlbum(withBarcode("036000291452")))
+	giant := s.create(newTestAlbum(withTitle("Giant Steps"), withPrice(2499)))
+
+	t.Run("list", func(t *testing.T) {
+		w := s.do(http.MethodGet, "/albums", "")
+		expectStatus(t, w, http.StatusOK)
+		if got := w.Header().Get("X-Total-Count"); got != "2" {
+			t.Errorf("X-Total-Count = %q, want 2", got)
+		}
+		list := decodeBody[[]album](t, w)
+		if len(list) != 2 || list[0].ID != blue.ID || list[1].ID != giant.ID {
+			t.Errorf("GET /albums = %+v, want the two albums in order", list)
+		}
+	})
+	t.Run("by id", func(t *testing.T) {
+		w := s.do(http.MethodGet, "/albums/"+blue.ID, "")
+		expectStatus(t, w, http.StatusOK)
+		if got := decodeBody[album](t, w); got.ID != blue.ID || got.Title != "Blue Train" {
+			t.Errorf("got %+v", got)
+		}
+	})
+	t.Run("by slug", func(t *testing.T) {
+		w := s.do(http.MethodGet, "/albums/by-slug/"+giant.Slug, "")
+		expectStatus(t, w, http.StatusOK)
+		if got := decodeBody[album](t, w); got.ID != giant.ID {
+			t.Errorf("got %s, want %s", got.ID, giant.ID)
+		}
+	})
+	t.Run("by barcode", func(t *testing.T) {
+		w := s.do(http.MethodGet, "/albums/by-barcode/036000291452", "")
+		expectStatus(t, w, http.StatusOK)
+		if got := decodeBody[album](t, w); got.ID != blue.ID {
+			t.Errorf("got %s, want %s", got.ID, blue.ID)
+		}
+	})
+	t.Run("put", func(t *testing.T) {
+		w := s.do(http.MethodPut, "/albums/"+giant.ID, albumJSON(newTestAlbum(withTitle("Giant Steps"), withPrice(1999))))
+		expectStatus(t, w, http.StatusOK)
+		if got := decodeBody[album](t, w); got.Price.String() != "19.99" {
+			t.Errorf("price = %s, want 19.99", got.Price)
+		}
+	})
+	t.Run("patch", func(t *testing.T) {
+		w := s.do(http.MethodPatch, "/albums/"+giant.ID, `{"price": 17.5}`)
+		expectStatus(t, w, http.StatusOK)
+		if got := decodeBody[album](t, w); got.Price.String() != "17.50" || got.Title != "Giant Steps" {
+			t.Errorf("got %+v, want only the price changed", got)
+		}
+	})
+	t.Run("batch", func(t *testing.T) {
+		body := `[{"id": "` + blue.ID + `", "title": "Blue Train", "artist": "John Coltrane", "price": 39.99, "genre": "Jazz", "year": 1957}]`
+		w := s.do(http.MethodPut, "/albums", body)
+		expectStatus(t, w, http.StatusOK)
+		got := s.do(http.MethodGet, "/albums/"+blue.ID, "")
+		if a := decodeBody[album](t, got); a.Price.String() != "39.99" {
+			t.Errorf("price after the batch = %s, want 39.99", a.Price)
+		}
+	})
+	t.Run("search", func(t *testing.T) {
+		w := s.do(http.MethodPost, "/albums/search", `{"query": {"field": "title", "op": "contains", "value": "giant"}}`)
+		expectStatus(t, w, http.StatusOK)
+		var page struct {
+			Albums []album `json:"albums"`
+			Total  int     `json:"total"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != 1 || len(page.Albums) != 1 || page.Albums[0].ID != giant.ID {
+			t.Errorf("search = %+v, want only Giant Steps", page)
+		}
+	})
+	t.Run("validate", func(t *testing.T) {
+		w := s.do(http.MethodPost, "/albums/validate", albumJSON(newTestAlbum()))
+		expectStatus(t, w, http.StatusOK)
+		if got := decodeBody[map[string]any](t, w); got["valid"] != true {
+			t.Errorf("validate = %v, want valid", got)
+		}
+	})
+	t.Run("changes", func(t *testing.T) {
+		w := s.do(http.MethodGet, "/albums/changes", "")
+		expectStatus(t, w, http.StatusOK)
+		var body struct {
+			Changes []struct {
+				Op      string `json:"op"`
+				AlbumID string `json:"albumId"`
+			} `json:"changes"`
+			Head int64 `json:"head"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body.Changes) == 0 || body.Changes[0].Op != "created" || body.Changes[0].AlbumID != blue.ID {
+			t.Errorf("changes = %+v, want the create of %s first", body.Changes, blue.ID)
+		}
+		if body.Head != int64(len(body.Changes)) {
+			t.Errorf("head = %d with %d changes", body.Head, len(body.Changes))
+		}
+	})
+	t.Run("feed", func(t *testing.T) {
+		w := s.do(http.MethodGet, "/albums/feed", "")
+		expectStatus(t, w, http.StatusOK)
+		if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/atom+xml") {
+			t.Errorf("Content-Type = %q", ct)
+		}
+	})
+	t.Run("stats", func(t *testing.T) {
+		w := s.do(http.MethodGet, "/albums/stats", "")
+		expectStatus(t, w, http.StatusOK)
+		if got := decodeBody[map[string]any](t, w); got["count"] != 2.0 {
+			t.Errorf("stats = %v, want a count of 2", got)
+		}
+	})
+	t.Run("artist stats", func(t *testing.T) {
+		w := s.do(http.MethodGet, "/artists/stats", "")
+		expectStatus(t, w, http.StatusOK)
+		if got := decodeBody[map[string]any](t, w); got["total"] != 1.0 {
+			t.Errorf("artist stats = %v, want one artist", got)
+		}
+	})
+	t.Run("export", func(t *testing.T) {
+		w := s.do(http.MethodGet, "/albums/export?format=xlsx", "")
+		expectStatus(t, w, http.StatusOK)
+		if !strings.HasPrefix(w.Body.String(), "PK") {
+			t.Error("the export isn't a zip file")
+		}
+	})
+	t.Run("usage", func(t *testing.T) {
+		w := s.do(http.MethodGet, "/me/usage", "")
+		expectStatus(t, w, http.StatusOK)
+		if got := decodeBody[map[string]any](t, w); got["tier"] != tierFree {
+			t.Errorf("usage = %v, want the free tier", got)
+		}
+	})
+}
+
+func TestAlbumJSONShape(t *testing.T) {
+	s := newTestServer(t)
+	a := s.create(newTestAlbum(withBarcode("036000291452")))
+	keys := jsonKeys(t, s.do(http.MethodGet, "/albums/"+a.ID, "").Body.Bytes())
+	for _, k := range []string{"id", "title", "artist", "price", "genre", "slug", "barcode", "year", "stock", "createdAt", "updatedAt"} {
+		if !keys[k] {
+			t.Errorf("album JSON has no %q", k)
+		}
+	}
+	for _, k := range []string{"tracks", "metadata", "availableFrom", "availableUntil"} {
+		if keys[k] {
+			t.Errorf("album JSON has %q when it is unset", k)
+		}
+	}
+	body := s.do(http.MethodGet, "/albums/"+a.ID, "").Body.String()
+	if !strings.Contains(body, `"price": 56.99`) {
+		t.Errorf("price isn't written with two decimals: %s", body)
+	}
+
+	keys = jsonKeys(t, s.do(http.MethodGet, "/metrics", "").Body.Bytes())
+	for _, k := range []string{"totalRequests", "totalErrors", "totalAlbumsFetched", "totalAlbumsAdded", "totalRateLimited", "averageLatencyMs"} {
+		if !keys[k] {
+			t.Errorf("metrics JSON has no %q", k)
+		}
+	}
+
+	p := expectProblem(t, s.do(http.MethodGet, "/albums/"+a.ID+"x", ""), http.StatusNotFound)
+	if p.Type != "about:blank" || p.Instance != "/albums/"+a.ID+"x" {
+		t.Errorf("problem = %+v", p)
+	}
+}
+
+func TestCreateAlbum(t *testing.T) {
+	s := newTestServer(t)
+	w := s.do(http.MethodPost, "/albums", albumJSON(newTestAlbum()))
+	expectStatus(t, w, http.StatusCreated)
+	a := decodeBody[album](t, w)
+	if a.ID == "" || a.Slug != "blue-train-john-coltrane" {
+		t.Errorf("created %+v, want an ID and a slug", a)
+	}
+	if loc := w.Header().Get("Location"); !strings.HasSuffix(loc, "/albums/"+a.ID) {
+		t.Errorf("Location = %q", loc)
+	}
+	if _, err := s.albums.GetByID(context.Background(), a.ID); err != nil {
+		t.Errorf("the album isn't in the store: %v", err)
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	s := newTestServer(t)
+	a := s.create(newTestAlbum())
+	for _, tc := range []struct {
+		name, method, path, body string
+	}{
+		{"malformed JSON", http.MethodPost, "/albums", `{"title": `},
+		{"unknown field", http.MethodPatch, "/albums/" + a.ID, `{"colour": "blue"}`},
+		{"empty batch", http.MethodPut, "/albums", `[]`},
+		{"bad search", http.MethodPost, "/albums/search", `{"query": []}`},
+		{"bad limit", http.MethodGet, "/albums?limit=abc", ""},
+		{"bad metrics format", http.MethodGet, "/metrics?format=xml", ""},
+		{"bad export format", http.MethodGet, "/albums/export", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			expectProblem(t, s.do(tc.method, tc.path, tc.body), http.StatusBadRequest)
+		})
+	}
+}
+
+func TestInvalidAlbums(t *testing.T) {
+	s := newTestServer(t)
+	for _, tc := range []struct {
+		name string
+		a    album
+	}{
+		{"bad check digit", newTestAlbum(withBarcode("036000291453"))},
+		{"negative stock", newTestAlbum(func(a *album) { a.Stock = -1 })},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			expectProblem(t, s.do(http.MethodPost, "/albums", albumJSON(tc.a)), http.StatusUnprocessableEntity)
+		})
+	}
+	if page, _ := s.albums.List(context.Background(), ListOptions{}); len(page.Albums) != 0 {
+		t.Errorf("%d albums were stored", len(page.Albums))
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	s := newTestServer(t)
+	for _, path := range []string{
+		"/nope",
+		"/albums/00000000-0000-4000-8000-000000000000",
+		"/albums/by-slug/no-such-album",
+		"/albums/by-barcode/036000291452",
+	} {
+		t.Run(path, func(t *testing.T) {
+			p := expectProblem(t, s.do(http.MethodGet, path, ""), http.StatusNotFound)
+			if p.Instance != path {
+				t.Errorf("instance = %q, want %q", p.Instance, path)
+			}
+		})
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	s := newTestServer(t)
+	for _, tc := range []struct{ method, path, allow string }{
+		{http.MethodDelete, "/albums", "GET, OPTIONS, POST, PUT"},
+		{http.MethodPost, "/albums/stats", "GET, OPTIONS"},
+		{http.MethodGet, "/albums/search", "OPTIONS, POST"},
+	} {
+		t.Run(tc.method+" "+tc.path, func(t *testing.T) {
+			w := s.do(tc.method, tc.path, "")
+			expectProblem(t, w, http.StatusMethodNotAllowed)
+			if got := w.Header().Get("Allow"); got != tc.allow {
+				t.Errorf("Allow = %q, want %q", got, tc.allow)
+			}
+		})
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	s := newTestServer(t)
+	w := s.do(http.MethodGet, "/admin/features", "")
+	expectProblem(t, w, http.StatusUnauthorized)
+	if got := w.Header().Get("WWW-Authenticate"); got != `Bearer realm="admin"` {
+		t.Errorf("WWW-Authenticate = %q", got)
+	}
+	expectProblem(t, s.do(http.MethodGet, "/admin/features", "", "Authorization", "Bearer wrong"), http.StatusUnauthorized)
+	expectStatus(t, s.admin(http.MethodGet, "/admin/features", ""), http.StatusOK)
+
+	s = newTestServer(t, func(c *Config) { c.AdminToken = "" })
+	expectProblem(t, s.do(http.MethodGet, "/admin/features", "", "Authorization", "Bearer "), http.StatusForbidden)
+}
+
+func TestAdminRoutes(t *testing.T) {
+	s := newTestServer(t)
+	a := s.create(newTestAlbum())
+	s.create(newTestAlbum(withTitle("Blue Train "), withPrice(999)))
+
+	t.Run("export and import", func(t *testing.T) {
+		w := s.admin(http.MethodGet, "/admin/export", "")
+		expectStatus(t, w, http.StatusOK)
+		expectStatus(t, s.admin(http.MethodPost, "/admin/import?mode=merge", w.Body.String()), http.StatusOK)
+	})
+	t.Run("duplicates", func(t *testing.T) {
+		expectStatus(t, s.admin(http.MethodGet, "/admin/albums/duplicates", ""), http.StatusOK)
+	})
+	t.Run("diff", func(t *testing.T) {
+		expectStatus(t, s.admin(http.MethodGet, "/admin/albums/diff?from="+testStart.Add(-time.Hour).Format(time.RFC3339), ""), http.StatusOK)
+		expectProblem(t, s.admin(http.MethodGet, "/admin/albums/diff", ""), http.StatusBadRequest)
+	})
+	t.Run("artist rename", func(t *testing.T) {
+		w := s.admin(http.MethodPost, "/admin/artists/rename", `{"from": "John Coltrane", "to": "Coltrane"}`)
+		expectStatus(t, w, http.StatusOK)
+		got := decodeBody[album](t, s.do(http.MethodGet, "/albums/"+a.ID, ""))
+		if got.Artist != "Coltrane" {
+			t.Errorf("artist = %q after the rename", got.Artist)
+		}
+	})
+	t.Run("features", func(t *testing.T) {
+		expectStatus(t, s.admin(http.MethodPut, "/admin/features/feed", `{"enabled": false}`), http.StatusOK)
+		expectStatus(t, s.do(http.MethodGet, "/albums/feed", ""), http.StatusNotFound)
+		expectStatus(t, s.admin(http.MethodPut, "/admin/features/feed", `{"enabled": true}`), http.StatusOK)
+		expectStatus(t, s.do(http.MethodGet, "/albums/feed", ""), http.StatusOK)
+		expectProblem(t, s.admin(http.MethodPut, "/admin/features/teleport", `{"enabled": true}`), http.StatusNotFound)
+	})
+	t.Run("maintenance", func(t *testing.T) {
+		expectStatus(t, s.admin(http.MethodPost, "/admin/maintenance", `{"mode": "read-only"}`), http.StatusOK)
+		expectStatus(t, s.do(http.MethodGet, "/albums", ""), http.StatusOK)
+		w := s.do(http.MethodPost, "/albums", albumJSON(newTestAlbum()))
+		expectProblem(t, w, http.StatusServiceUnavailable)
+		if w.Header().Get("Retry-After") == "" {
+			t.Error("no Retry-After during maintenance")
+		}
+		expectStatus(t, s.admin(http.MethodPost, "/admin/maintenance", `{"mode": "off"}`), http.StatusOK)
+		s.create(newTestAlbum())
+	})
+	t.Run("jobs", func(t *testing.T) {
+		expectStatus(t, s.admin(http.MethodGet, "/admin/jobs", ""), http.StatusOK)
+	})
+	t.Run("client metrics", func(t *testing.T) {
+		expectStatus(t, s.admin(http.MethodGet, "/admin/metrics/clients", ""), http.StatusOK)
+	})
+	t.Run("bulk delete", func(t *testing.T) {
+		w := s.admin(http.MethodDelete, "/admin/albums", `{"ids": ["`+a.ID+`"], "confirm": 1, "permanent": true}`)
+		expectStatus(t, w, http.StatusOK)
+		expectProblem(t, s.do(http.MethodGet, "/albums/"+a.ID, ""), http.StatusNotFound)
+	})
+}
+
+func TestOperationalRoutes(t *testing.T) {
+	s := newTestServer(t)
+	for _, path := range []string{"/healthz", "/readyz", "/version", "/metrics", "/metrics?format=prometheus", "/metrics/history"} {
+		t.Run(path, func(t *testing.T) {
+			expectStatus(t, s.do(http.MethodGet, path, ""), http.StatusOK)
+		})
+	}
+	storesReady.Store(false)
+	expectStatus(t, s.do(http.MethodGet, "/readyz", ""), http.StatusServiceUnavailable)
+}
+
+func TestAPIKeys(t *testing.T) {
+	s := newTestServer(t)
+	w := s.admin(http.MethodPost, "/admin/apikeys", `{"name": "ci", "tier": "paid"}`)
+	expectStatus(t, w, http.StatusCreated)
+	key := decodeBody[types.APIKey](t, w)
+	if key.Secret == "" {
+		t.Fatal("no secret in the answer to the create")
+	}
+
+	w = s.do(http.MethodGet, "/me/usage", "", "Authorization", "Bearer "+key.Secret)
+	expectStatus(t, w, http.StatusOK)
+	if got := decodeBody[map[string]any](t, w); got["tier"] != tierPaid {
+		t.Errorf("usage with the key = %v, want the paid tier", got)
+	}
+	w = s.do(http.MethodGet, "/albums", "", "Authorization", "Bearer "+apiKeyPrefix+"nonsense")
+	expectProblem(t, w, http.StatusUnauthorized)
+
+	t.Run("saved searches", func(t *testing.T) {
+		auth := []string{"Authorization", "Bearer " + key.Secret}
+		expectProblem(t, s.do(http.MethodGet, "/searches", ""), http.StatusForbidden)
+		w := s.do(http.MethodPost, "/searches", `{"name": "jazz", "params": {"genre": "Jazz"}}`, auth...)
+		expectStatus(t, w, http.StatusCreated)
+		expectStatus(t, s.do(http.MethodGet, "/searches", "", auth...), http.StatusOK)
+	})
+}
+
+func TestRateLimitBoundary(t *testing.T) {
+	s := newTestServer(t, func(c *Config) {
+		c.RateLimitRequests = 3
+		c.RateLimitWindow = 10 * time.Second
+	})
+	for i := 1; i <= 3; i++ {
+		expectStatus(t, s.do(http.MethodGet, "/albums", ""), http.StatusOK)
+		s.clock.Advance(time.Second)
+	}
+	// The window runs out 10s after the third request, 8.5s from now,
+	// which Retry-After rounds up.
+	s.clock.Advance(500 * time.Millisecond)
+	w := s.do(http.MethodGet, "/albums", "")
+	expectProblem(t, w, http.StatusTooManyRequests)
+	if got := w.Header().Get("Retry-After"); got != "9" {
+		t.Errorf("Retry-After = %q, want 9", got)
+	}
+
+	// Another client has a window of its own.
+	req := httptest.NewRequest(http.MethodGet, "/albums", nil)
+	req.RemoteAddr = "198.51.100.7:4000"
+	other := httptest.NewRecorder()
+	s.handler.ServeHTTP(other, req)
+	expectStatus(t, other, http.StatusOK)
+
+	// A turned-away request doesn't extend the window, which runs from the
+	// last request let through, 1.5s ago.
+	s.clock.Advance(8500*time.Millisecond - time.Nanosecond)
+	expectProblem(t, s.do(http.MethodGet, "/albums", ""), http.StatusTooManyRequests)
+	s.clock.Advance(time.Nanosecond)
+	expectStatus(t, s.do(http.MethodGet, "/albums", ""), http.StatusOK)
+
+	// Health checks are never limited.
+	for i := 0; i < 5; i++ {
+		expectStatus(t, s.do(http.MethodGet, "/healthz", ""), http.StatusOK)
+	}
+	if got := snapshotMetrics().TotalRateLimited; got != 2 {
+		t.Errorf("TotalRateLimited = %d, want 2", got)
+	}
+}
+
+// TestRateLimitConcurrent sends one client's requests all at once; run it
+// with -race.
+func TestRateLimitConcurrent(t *testing.T) {
+	const limit = 10
+	s := newTestServer(t, func(c *Config) {
+		c.RateLimitRequests = limit
+		c.RateLimitWindow = time.Minute
+	})
+	var wg sync.WaitGroup
+	codes := make([]int, 50)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			s.handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/albums", nil))
+			codes[i] = w.Code
+		}()
+	}
+	wg.Wait()
+	if ok := len(codes) - len(slices.DeleteFunc(slices.Clone(codes), func(c int) bool { return c == http.StatusOK })); ok != limit {
+		t.Errorf("%d of %d requests let through, want the limit of %d", ok, len(codes), limit)
+	}
+}
+
+func TestMetricsAfterRequests(t *testing.T) {
+	s := newTestServer(t)
+	a := s.create(newTestAlbum())
+	s.create(newTestAlbum(withTitle("Giant Steps")))
+	s.do(http.MethodGet, "/albums", "")
+	s.do(http.MethodGet, "/albums/"+a.ID, "")
+	s.do(http.MethodGet, "/nope", "")
+	s.do(http.MethodPost, "/albums", `{`)
+
+	w := s.do(http.MethodGet, "/metrics", "")
+	expectStatus(t, w, http.StatusOK)
+	report := decodeBody[types.MetricsReport](t, w)
+	// /metrics is in the default METRICS_EXCLUDE_ROUTES, so it never
+	// counts itself.
+	// Each listing counts as one fetch, however many albums it returns.
+	want := types.MetricsReport{TotalRequests: 6, TotalErrors: 2, TotalAlbumsFetched: 1, TotalAlbumsAdded: 2}
+	if report.TotalRequests != want.TotalRequests || report.TotalErrors != want.TotalErrors ||
+		report.TotalAlbumsFetched != want.TotalAlbumsFetched || report.TotalAlbumsAdded != want.TotalAlbumsAdded {
+		t.Errorf("metrics = %+v, want %+v", report, want)
+	}
+
+	w = s.do(http.MethodGet, "/metrics?format=prometheus", "")
+	for name, want := range map[string]string{"albums_requests_total": "6", "albums_errors_total": "2", "albums_added_total": "2"} {
+		if got := prometheusValue(w.Body.String(), name); got != want {
+			t.Errorf("%s = %q, want %s", name, got, want)
+		}
+	}
+}
+
+func TestMetricsExcludeRoutes(t *testing.T) {
+	s := newTestServer(t)
+	s.do(http.MethodGet, "/albums", "")
+	before := snapshotMetrics()
+
+	for i := 0; i < 20; i++ {
+		expectStatus(t, s.do(http.MethodGet, "/metrics", ""), http.StatusOK)
+		s.do(http.MethodGet, "/metrics?format=prometheus", "")
+		s.do(http.MethodGet, "/healthz", "")
+		s.do(http.MethodGet, "/readyz", "")
+	}
+	if after := snapshotMetrics(); after.TotalRequests != before.TotalRequests || after.TotalLatencyMs != before.TotalLatencyMs {
+		t.Errorf("80 scrapes and probes took TotalRequests from %d to %d", before.TotalRequests, after.TotalRequests)
+	}
+
+	// The list is reloadable, and counts a route once it is off it.
+	counted := *s.cfg
+	counted.MetricsExcludeRoutes = "/healthz"
+	liveConfig.Store(&counted)
+	s.do(http.MethodGet, "/metrics", "")
+	s.do(http.MethodGet, "/healthz", "")
+	if after := snapshotMetrics(); after.TotalRequests != before.TotalRequests+1 {
+		t.Errorf("TotalRequests went from %d to %d, want the /metrics scrape counted", before.TotalRequests, after.TotalRequests)
+	}
+}
+
+func TestRouteListed(t *testing.T) {
+	const list = "/metrics, /healthz,/debug/*"
+	for pattern, want := range map[string]bool{
+		"/metrics":         true,
+		"/metrics/history": false,
+		"/healthz":         true,
+		"/debug/pprof/":    true,
+		"/debug/vars":      true,
+		"/albums":          false,
+		"/albums/{id...}":  false,
+		"":                 false,
+		unmatchedPattern:   false,
+	} {
+		if got := routeListed(list, pattern); got != want {
+			t.Errorf("routeListed(%q, %q) = %v, want %v", list, pattern, got, want)
+		}
+	}
+	// The exclusion is by route, so no path sent to an unmatched route is
+	// excluded, whatever it looks like.
+	if routeListed("/*", unmatchedPattern) {
+		t.Error("/* lists unmatched requests")
+	}
+}
+
+func TestMetricsFlush(t *testing.T) {
+	s := newTestServer(t)
+	s.create(newTestAlbum())
+	s.do(http.MethodGet, "/nope", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go flushMetrics(ctx, s.metrics, s.clock, time.Minute, done)
+	cancel()
+	<-done
+
+	calls := s.metrics.Calls()
+	if !slices.Equal(calls, []string{"AddMetrics", "AddMetricsSample", "AddClientMetrics"}) {
+		t.Errorf("store calls = %v", calls)
+	}
+	stored, err := s.metrics.InMemoryMetricsStore.LoadMetrics(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Metrics{TotalRequests: 2, TotalErrors: 1, TotalAlbumsAdded: 1, TotalLatencyMs: stored.TotalLatencyMs}); stored != want {
+		t.Errorf("stored metrics = %+v, want %+v", stored, want)
+	}
+	clients, err := s.metrics.InMemoryMetricsStore.LoadClientMetrics(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clients) != 1 || clients[0].Requests != 2 || clients[0].Errors != 1 {
+		t.Errorf("client metrics = %+v, want one client with 2 requests and 1 error", clients)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Run("timing", func(t *testing.T) {
+		s := newTestServer(t)
+		if got := s.do(http.MethodGet, "/albums", "").Header().Get(responseTimeHeader); !strings.HasSuffix(got, "ms") {
+			t.Errorf("%s = %q", responseTimeHeader, got)
+		}
+	})
+	t.Run("cors", func(t *testing.T) {
+		s := newTestServer(t, func(c *Config) { c.CORSAllowedOrigins = "https://shop.example" })
+		w := s.do(http.MethodOptions, "/albums", "", "Origin", "https://shop.example", "Access-Control-Request-Method", "POST")
+		expectStatus(t, w, http.StatusNoContent)
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://shop.example" {
+			t.Errorf("Access-Control-Allow-Origin = %q", got)
+		}
+		w = s.do(http.MethodGet, "/albums", "", "Origin", "https://elsewhere.example")
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("Access-Control-Allow-Origin = %q for an origin not allowed", got)
+		}
+	})
+	t.Run("no-store", func(t *testing.T) {
+		s := newTestServer(t)
+		w := s.do(http.MethodPost, "/albums", albumJSON(newTestAlbum()))
+		if got := w.Header().Get("Cache-Control"); got != "no-store" {
+			t.Errorf("Cache-Control of a POST = %q", got)
+		}
+	})
+	t.Run("request body", func(t *testing.T) {
+		s := newTestServer(t, func(c *Config) { c.BodyMaxBytes = 64 })
+		body := albumJSON(newTestAlbum(withTitle(strings.Repeat("x", 100))))
+		expectProblem(t, s.do(http.MethodPost, "/albums", body), http.StatusRequestEntityTooLarge)
+	})
+	t.Run("recovery", func(t *testing.T) {
+		newTestServer(t)
+		h := apiMiddleware(currentConfig()).then(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { panic("boom") }))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/albums", nil))
+		expectProblem(t, w, http.StatusInternalServerError)
+	})
+	t.Run("load shedding", func(t *testing.T) {
+		newTestServer(t, func(c *Config) { c.MaxInFlight = 1; c.InFlightQueueTimeout = time.Millisecond })
+		release := make(chan struct{})
+		started := make(chan struct{})
+		h := apiMiddleware(currentConfig()).then(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+		}))
+		// The first request holds the only slot until released, and must
+		// finish before the next subtest swaps the package state under it.
+		first := make(chan struct{})
+		go func() {
+			defer close(first)
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/albums", nil))
+		}()
+		<-started
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/albums", nil))
+		close(release)
+		<-first
+		expectProblem(t, w, http.StatusServiceUnavailable)
+	})
+	t.Run("response cache", func(t *testing.T) {
+		s := newTestServer(t, func(c *Config) { c.ResponseCacheRoutes = "/albums=1m" })
+		s.create(newTestAlbum())
+		first := s.do(http.MethodGet, "/albums", "")
+		second := s.do(http.MethodGet, "/albums", "")
+		if first.Header().Get("X-Cache") != "MISS" || second.Header().Get("X-Cache") != "HIT" {
+			t.Errorf("X-Cache = %q then %q, want MISS then HIT", first.Header().Get("X-Cache"), second.Header().Get("X-Cache"))
+		}
+		if first.Body.String() != second.Body.String() {
+			t.Error("the cached body differs")
+		}
+	})
+}
+
+// prometheusValue returns the value of the first sample of metric name in
+// the text exposition format.
+func prometheusValue(text, name string) string {
+	for _, line := range strings.Split(text, "\n") {
+		if rest, ok := strings.CutPrefix(line, name); ok && (strings.HasPrefix(rest, "{") || strings.HasPrefix(rest, " ")) {
+			return line[strings.LastIndexByte(line, ' ')+1:]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Enrichment holds catalog data looked up from an external source. Zero
+// values mean the source had nothing for that field.
+type Enrichment struct {
+	Year   int
+	Tracks []string
+	Artist string
+}
+
+// Enricher looks up additional details for an album by title and artist.
+type Enricher interface {
+	Enrich(ctx context.Context, title, artist string) (Enrichment, error)
+}
+
+var errNoEnrichmentMatch = errors.New("no matching release found")
+
+const (
+	defaultMusicBrainzURL = "https://musicbrainz.org"
+	musicBrainzUserAgent  = "web-service-go/1.0 (https://github.com/brentmzey/web-service-go)"
+	enrichmentCacheSize   = 1000
+)
+
+// MusicBrainzEnricher queries the MusicBrainz web service. Requests are spaced
+// at least one second apart, as the MusicBrainz usage policy requires, and
+// results (including misses) are cached by title and artist.
+type MusicBrainzEnricher struct {
+	baseURL  string
+	client   *http.Client
+	interval time.Duration
+
+	throttle sync.Mutex
+	next     time.Time
+
+	cacheMu sync.Mutex
+	cache   map[string]enrichmentResult
+}
+
+type enrichmentResult struct {
+	enrichment Enrichment
+	err        error
+}
+
+func NewMusicBrainzEnricher(baseURL string, timeout time.Duration) *MusicBrainzEnricher {
+	return &MusicBrainzEnricher{
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		client:   &http.Client{Timeout: timeout},
+		interval: time.Second,
+		cache:    make(map[string]enrichmentResult),
+	}
+}
+
+type musicBrainzSearch struct {
+	Releases []struct {
+		ID           string `json:"id"`
+		Date         string `json:"date"`
+		ArtistCredit []struct {
+			Name   string `json:"name"`
+			Artist struct {
+				Name string `json:"name"`
+			} `json:"artist"`
+		} `json:"artist-credit"`
+	} `json:"releases"`
+}
+
+type musicBrainzRelease struct {
+	Media []struct {
+		Tracks []struct {
+			Title string `json:"title"`
+		} `json:"tracks"`
+	} `json:"media"`
+}
+
+func (e *MusicBrainzEnricher) Enrich(ctx context.Context, title, artist string) (Enrichment, error) {
+	key := strings.ToLower(title) + "\x00" + strings.ToLower(artist)
+	e.cacheMu.Lock()
+	cached, ok := e.cache[key]
+	e.cacheMu.Unlock()
+	if ok {
+		return cached.enrichment, cached.err
+	}
+
+	enrichment, err := e.lookup(ctx, title, artist)
+	// Only definitive answers are cached; transport failures may succeed later.
+	if err == nil || errors.Is(err, errNoEnrichmentMatch) {
+		e.cacheMu.Lock()
+		if len(e.cache) >= enrichmentCacheSize {
+			e.cache = make(map[string]enrichmentResult)
+		}
+		e.cache[key] = enrichmentResult{enrichment: enrichment, err: err}
+		e.cacheMu.Unlock()
+	}
+	return enrichment, err
+}
+
+func (e *MusicBrainzEnricher) lookup(ctx context.Context, title, artist string) (Enrichment, error) {
+	query := fmt.Sprintf(`release:"%s" AND artist:"%s"`, escapeLucene(title), escapeLucene(artist))
+	var search musicBrainzSearch
+	if err := e.get(ctx, "/ws/2/release/?fmt=json&limit=1&query="+url.QueryEscape(query), &search); err != nil {
+		return Enrichment{}, err
+	}
+	if len(search.Releases) == 0 {
+		return Enrichment{}, errNoEnrichmentMatch
+	}
+	release := search.Releases[0]
+
+	var enrichment Enrichment
+	if len(release.Date) >= 4 {
+		enrichment.Year, _ = strconv.Atoi(release.Date[:4])
+	}
+	if len(release.ArtistCredit) > 0 {
+		enrichment.Artist = release.ArtistCredit[0].Artist.Name
+	}
+
+	var details musicBrainzRelease
+	if err := e.get(ctx, "/ws/2/release/"+url.PathEscape(release.ID)+"?fmt=json&inc=recordings", &details); err != nil {
+		return Enrichment{}, err
+	}
+	for _, medium := range details.Media {
+		for _, track := range medium.Tracks {
+			enrichment.Tracks = append(enrichment.Tracks, track.Title)
+		}
+	}
+	return enrichment, nil
+}
+
+func (e *MusicBrainzEnricher) get(ctx context.Context, path string, out interface{}) error {
+	if err := e.wait(ctx); err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, e.baseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", musicBrainzUserAgent)
+	req.Header.Set("Accept", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return errNoEnrichmentMatch
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("musicbrainz returned %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// wait blocks until the next request slot, keeping calls at most one per
+// interval across all goroutines.
+func (e *MusicBrainzEnricher) wait(ctx context.Context) error {
+	e.throttle.Lock()
+	now := time.Now()
+	slot := e.next
+	if slot.Before(now) {
+		slot = now
+	}
+	e.next = slot.Add(e.interval)
+	e.throttle.Unlock()
+
+	timer := time.NewTimer(time.Until(slot))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var luceneEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+func escapeLucene(s string) string {
+	return luceneEscaper.Replace(s)
+}
+
+// enrichAlbum looks up extra details for a newly created album and fills in
+// any fields the client left empty. It runs in the background after the create
+// response has been sent, so failures are only logged.
+func enrichAlbum(a album) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	enrichment, err := enricher.Enrich(ctx, a.Title, a.Artist)
+	if err != nil {
+		log.Printf("🔎 Enrichment skipped for %q by %s: %v", a.Title, a.Artist, err)
+		return
+	}
+
+	// Re-read so a client update made while we were looking things up wins.
+	current, err := albumStore.GetByID(ctx, a.ID)
+	if err != nil {
+		log.Printf("🔥 Enrichment could not reload album %s: %v", a.ID, err)
+		return
+	}
+	filled := map[string]interface{}{}
+	if current.Year == 0 && enrichment.Year != 0 {
+		current.Year = enrichment.Year
+		filled["year"] = enrichment.Year
+	}
+	if len(current.Tracks) == 0 && len(enrichment.Tracks) > 0 {
+		current.Tracks = enrichment.Tracks
+		filled["tracks"] = len(enrichment.Tracks)
+	}
+	if current.Artist == "" && enrichment.Artist != "" {
+		current.Artist = enrichment.Artist
+		filled["artist"] = enrichment.Artist
+	}
+	if len(filled) == 0 {
+		return
+	}
+	if _, err := albumStore.Update(ctx, current, false); err != nil {
+		log.Printf("🔥 Failed to save enrichment for album %s: %v", a.ID, err)
+		return
+	}
+	albumsChanged()
+	recordAudit(auditAlbumEnriched, a.ID, principalEnricher, filled)
+	log.Printf("🔎 Enriched %q by %s", current.Title, current.Artist)
+}
+
+// setupEnricher returns the MusicBrainz enricher, or nil when MUSICBRAINZ_URL
+// is empty. It is built even while ENRICHMENT_ENABLED=false so a reload can
+// switch enrichment on.
+func setupEnricher(cfg *Config) Enricher {
+	if cfg.MusicBrainzURL == "" {
+		return nil
+	}
+	return NewMusicBrainzEnricher(cfg.MusicBrainzURL, 10*time.Second)
+}
+
+var enricher Enricher
+
+// enrichmentEnabled reports whether new albums should be enriched, going by
+// the live ENRICHMENT_ENABLED.
+func enrichmentEnabled() bool {
+	return enricher != nil && currentConfig().EnrichmentEnabled
+}
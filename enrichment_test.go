@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newMusicBrainzStub serves one release of Blue Train for searches naming
+// it, and no releases for any other search, counting the requests it gets.
+func newMusicBrainzStub(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("User-Agent") != musicBrainzUserAgent {
+			t.Errorf("User-Agent = %q", r.Header.Get("User-Agent"))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/ws/2/release/" && strings.Contains(r.URL.Query().Get("query"), `release:"Blue Train"`):
+			w.Write([]byte(`{"releases": [{"id": "r1", "date": "1957-09", "artist-credit": [{"name": "Coltrane", "artist": {"name": "John Coltrane"}}]}]}`))
+		case r.URL.Path == "/ws/2/release/":
+			w.Write([]byte(`{"releases": []}`))
+		case r.URL.Path == "/ws/2/release/r1":
+			w.Write([]byte(`{"media": [{"tracks": [{"title": "Blue Train"}, {"title": "Moment's Notice"}]}, {"tracks": [{"title": "Lazy Bird"}]}]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+// newTestEnricher is a MusicBrainzEnricher of url that doesn't space its
+// requests out.
+func newTestEnricher(url string) *MusicBrainzEnricher {
+	e := NewMusicBrainzEnricher(url, 0)
+	e.interval = 0
+	return e
+}
+
+func TestMusicBrainzEnricher(t *testing.T) {
+	srv, calls := newMusicBrainzStub(t)
+	e := newTestEnricher(srv.URL)
+
+	got, err := e.Enrich(context.Background(), "Blue Train", "John Coltrane")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Year != 1957 || got.Artist != "John Coltrane" || !slices.Equal(got.Tracks, []string{"Blue Train", "Moment's Notice", "Lazy Bird"}) {
+		t.Errorf("enrichment = %+v", got)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("%d requests for a lookup, want a search and a release", calls.Load())
+	}
+	if _, err := e.Enrich(context.Background(), "blue train", "JOHN COLTRANE"); err != nil || calls.Load() != 2 {
+		t.Errorf("a repeated lookup made a request or failed: %v", err)
+	}
+
+	if _, err := e.Enrich(context.Background(), `Say "Cheese"`, "Nobody"); !errors.Is(err, errNoEnrichmentMatch) {
+		t.Errorf("err = %v, want errNoEnrichmentMatch", err)
+	}
+	before := calls.Load()
+	if _, err := e.Enrich(context.Background(), `Say "Cheese"`, "Nobody"); !errors.Is(err, errNoEnrichmentMatch) || calls.Load() != before {
+		t.Errorf("a miss wasn't cached: %v after %d requests", err, calls.Load()-before)
+	}
+}
+
+func TestMusicBrainzEnricherFailureNotCached(t *testing.T) {
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	e := newTestEnricher(srv.URL)
+	for i := 0; i < 2; i++ {
+		if _, err := e.Enrich(context.Background(), "Blue Train", "John Coltrane"); err == nil || errors.Is(err, errNoEnrichmentMatch) {
+			t.Fatalf("err = %v, want the failure", err)
+		}
+	}
+	if calls.Load() != 2 {
+		t.Errorf("%d requests, want the failure retried", calls.Load())
+	}
+}
+
+func TestEnrichAlbum(t *testing.T) {
+	srv, _ := newMusicBrainzStub(t)
+	s := newTestServer(t)
+	previous := enricher
+	t.Cleanup(func() { enricher = previous })
+	enricher = newTestEnricher(srv.URL)
+
+	bare := s.create(newTestAlbum(func(a *album) { a.Year = 0 }))
+	enrichAlbum(bare)
+	got, err := s.albums.GetByID(context.Background(), bare.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Year != 1957 || len(got.Tracks) != 3 || got.Artist != "John Coltrane" {
+		t.Errorf("enriched album = %+v, want the year and tracks filled in", got)
+	}
+	entries, _ := auditLog.List()
+	if len(entries) == 0 || entries[len(entries)-1].Action != auditAlbumEnriched || entries[len(entries)-1].Principal != principalEnricher {
+		t.Errorf("audit log = %+v, want the enrichment last", entries)
+	}
+
+	// Fields the client set are kept.
+	set := s.create(newTestAlbum(func(a *album) { a.Year = 2003; a.Tracks = []string{"Locomotion"} }))
+	enrichAlbum(set)
+	if got, _ := s.albums.GetByID(context.Background(), set.ID); got.Year != 2003 || !slices.Equal(got.Tracks, []string{"Locomotion"}) {
+		t.Errorf("enrichment overwrote the client's fields: %+v", got)
+	}
+
+	// A lookup that finds nothing leaves the album alone.
+	missing := s.create(newTestAlbum(withTitle("Unreleased"), func(a *album) { a.Year = 0 }))
+	enrichAlbum(missing)
+	if got, _ := s.albums.GetByID(context.Background(), missing.ID); !got.UpdatedAt.Equal(missing.UpdatedAt) {
+		t.Errorf("a failed lookup updated the album: %+v", got)
+	}
+}
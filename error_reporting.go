@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	defaultSentrySamplePercent      = 100
+	defaultSentryMaxEventsPerMinute = 60
+
+	// errorReportQueueSize is how many reports can wait to be sent. Past
+	// that they are dropped, so a storm of errors never holds up a
+	// response.
+	errorReportQueueSize = 100
+
+	// errorReportMaxBodyBytes is how much of a request body a report
+	// includes.
+	errorReportMaxBodyBytes = 4096
+
+	errorReportTimeout = 5 * time.Second
+
+	// inAppModule is the module whose frames a report marks as the
+	// service's own, with the main package's.
+	inAppModule = "github.com/brentmzey/web-service-go"
+)
+
+// filteredHeaders are the request headers a report never includes the
+// value of. Those named in LOG_REDACT_FIELDS are filtered too.
+var filteredHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"X-Api-Key":           true,
+	"Payment-Signature":   true,
+	bodyLogHeader:         true,
+}
+
+// redactedValue stands in for a scrubbed value, as in the logged bodies.
+const redactedValue = "[REDACTED]"
+
+// parseSentryDSN turns a DSN like https://<key>@o1.ingest.sentry.io/42
+// into the URL its events are posted to and the key they are sent with.
+func parseSentryDSN(dsn string) (endpoint, key string, err error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", err
+	}
+	prefix, project := path.Split(strings.TrimSuffix(u.Path, "/"))
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User.Username() == "" || project == "" {
+		return "", "", errors.New("must be like https://<key>@<host>/<project>")
+	}
+	return fmt.Sprintf("%s://%s%sapi/%s/store/", u.Scheme, u.Host, prefix, project), u.User.Username(), nil
+}
+
+// The parts of a Sentry event a report fills in.
+type sentryEvent struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Level       string            `json:"level"`
+	Platform    string            `json:"platform"`
+	Logger      string            `json:"logger"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Release     string            `json:"release"`
+	Environment string            `json:"environment,omitempty"`
+	Transaction string            `json:"transaction"`
+	Tags        map[string]string `json:"tags"`
+	User        *sentryUser       `json:"user,omitempty"`
+	Request     sentryRequest     `json:"request"`
+	Exception   struct {
+		Values []sentryException `json:"values"`
+	} `json:"exception"`
+}
+
+type sentryUser struct {
+	ID string `json:"id"`
+}
+
+type sentryRequest struct {
+	Method      string            `json:"method"`
+	URL         string            `json:"url"`
+	QueryString string            `json:"query_string,omitempty"`
+	Headers     map[string]string `json:"headers"`
+	Data        string            `json:"data,omitempty"`
+}
+
+type sentryException struct {
+	Type       string `json:"type"`
+	Value      string `json:"value"`
+	Stacktrace struct {
+		Frames []sentryFrame `json:"frames"`
+	} `json:"stacktrace"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Module   string `json:"module"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+// errorReport is what is kept of a failed request until the worker turns
+// it into an event, so the request only pays for the stack.
+type errorReport struct {
+	r         *http.Request
+	body      []byte
+	at        time.Time
+	level     string
+	status    int
+	exception sentryException
+}
+
+// errorReporter sends reports to a Sentry-compatible sink from one
+// goroutine, after sampling them and capping them per minute.
+type errorReporter struct {
+	client   *http.Client
+	endpoint string
+	auth     string // the X-Sentry-Auth header
+	queue    chan errorReport
+	pending  sync.WaitGroup
+
+	mu          sync.Mutex
+	windowStart time.Time
+	admitted    int  // reports let through since windowStart
+	capped      bool // whether going over the cap was logged this window
+}
+
+// errorReports is nil unless SENTRY_DSN is set, and then reports panics
+// and unexpected 500s.
+var errorReports *errorReporter
+
+// setupErrorReporting starts the reporter with SENTRY_DSN, which validate
+// has already parsed.
+func setupErrorReporting(cfg *Config) {
+	if cfg.SentryDSN == "" {
+		return
+	}
+	endpoint, key, _ := parseSentryDSN(cfg.SentryDSN)
+	rep := &errorReporter{
+		client:   &http.Client{Timeout: errorReportTimeout},
+		endpoint: endpoint,
+		auth:     fmt.Sprintf("Sentry sentry_version=7, sentry_key=%s, sentry_client=web-service-go/%s", key, versionInfo().Version),
+		queue:    make(chan errorReport, errorReportQueueSize),
+	}
+	go rep.deliver()
+	errorReports = rep
+	u, _ := url.Parse(endpoint)
+	log.Printf("📮 Reporting panics and server errors to %s", u.Host)
+}
+
+// reportPanic reports p, recovered serving r. It must be called from the
+// deferred function that recovered it, for the stack to be the panic's.
+func reportPanic(r *http.Request, p interface{}) {
+	if errorReports == nil {
+		return
+	}
+	exception := sentryException{Type: "panic", Value: fmt.Sprint(p)}
+	exception.Stacktrace.Frames = stackFrames(2, "runtime.gopanic")
+	errorReports.report(r, "fatal", http.StatusInternalServerError, exception)
+}
+
+// reportError reports err, answered with status.
+func reportError(r *http.Request, status int, err error) {
+	if errorReports == nil {
+		return
+	}
+	cause := err
+	for errors.Unwrap(cause) != nil {
+		cause = errors.Unwrap(cause)
+	}
+	exception := sentryException{Type: fmt.Sprintf("%T", cause), Value: err.Error()}
+	exception.Stacktrace.Frames = stackFrames(2, "")
+	errorReports.report(r, "error", status, exception)
+}
+
+// report queues a report if it is sampled and under the cap, or drops it
+// when the queue is full.
+func (rep *errorReporter) report(r *http.Request, level string, status int, exception sentryException) {
+	if !rep.admit() {
+		return
+	}
+	// The middleware goes on changing the request once the report is
+	// queued, so the worker gets a copy of it as it is now.
+	report := errorReport{r: r.Clone(r.Context()), at: serverClock.Now(), level: level, status: status, exception: exception}
+	if body, ok := r.Context().Value(errorReportBodyKey{}).(*cappedBuffer); ok {
+		report.body = bytes.Clone(body.buf.Bytes())
+	}
+	rep.pending.Add(1)
+	select {
+	case rep.queue <- report:
+	default:
+		rep.pending.Done()
+		debugf("Dropped the error report of %s %s: the queue is full", r.Method, r.URL.Path)
+	}
+}
+
+// admit picks SENTRY_SAMPLE_PERCENT of the reports, up to
+// SENTRY_MAX_EVENTS_PER_MINUTE a minute. Both are read per report so a
+// reload applies straight away.
+func (rep *errorReporter) admit() bool {
+	cfg := currentConfig()
+	if rand.Intn(100) >= cfg.SentrySamplePercent {
+		return false
+	}
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	now := serverClock.Now()
+	if now.Sub(rep.windowStart) >= time.Minute {
+		rep.windowStart, rep.admitted, rep.capped = now, 0, false
+	}
+	if rep.admitted >= cfg.SentryMaxEventsPerMinute {
+		if !rep.capped {
+			rep.capped = true
+			log.Printf("📮 Over SENTRY_MAX_EVENTS_PER_MINUTE (%d); dropping error reports until %s",
+				cfg.SentryMaxEventsPerMinute, rep.windowStart.Add(time.Minute).Format(time.TimeOnly))
+		}
+		return false
+	}
+	rep.admitted++
+	return true
+}
+
+func (rep *errorReporter) deliver() {
+	for report := range rep.queue {
+		if err := rep.send(report.event()); err != nil {
+			log.Printf("📮 Failed to report the error of %s %s: %v", report.r.Method, report.r.URL.Path, err)
+		}
+		rep.pending.Done()
+	}
+}
+
+func (rep *errorReporter) send(event sentryEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, rep.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", rep.auth)
+	resp, err := rep.client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("the sink answered %s", resp.Status)
+	}
+	return nil
+}
+
+// flush waits for the queued reports to be sent, or for ctx to be done.
+func (rep *errorReporter) flush(ctx context.Context) {
+	if rep == nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		rep.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("📮 Shut down with %d error report(s) unsent", len(rep.queue))
+	}
+}
+
+// event builds the Sentry event of report, scrubbing the headers, query,
+// and body of the request of everything sensitive.
+func (report errorReport) event() sentryEvent {
+	cfg := currentConfig()
+	redact := redactFields(cfg.LogRedactFields)
+	r := report.r
+	build := versionInfo()
+	route := requestRoute(r)
+	event := sentryEvent{
+		EventID:     strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Timestamp:   report.at.UTC().Format(time.RFC3339Nano),
+		Level:       report.level,
+		Platform:    "go",
+		Logger:      "web-service-go",
+		ServerName:  cfg.InstanceID,
+		Release:     "web-service-go@" + build.Version,
+		Environment: cfg.Environment,
+		Transaction: r.Method + " " + route,
+		Tags:        map[string]string{"route": route, "method": r.Method, "status": strconv.Itoa(report.status), "commit": build.Commit},
+		Request:     sentryRequest{Method: r.Method, URL: requestBaseURL(r) + r.URL.Path, Headers: map[string]string{}},
+	}
+	event.Exception.Values = []sentryException{report.exception}
+	if id := r.Header.Get("X-Request-ID"); id != "" {
+		event.Tags["request_id"] = id
+	}
+	if principal := requestPrincipal(r); principal != principalAnonymous {
+		event.User = &sentryUser{ID: principal}
+	}
+	for name, values := range r.Header {
+		value := strings.Join(values, ", ")
+		if filteredHeaders[name] || redact[strings.ToLower(name)] {
+			value = redactedValue
+		}
+		event.Request.Headers[name] = value
+	}
+	if query := r.URL.Query(); len(query) > 0 {
+		for name := range query {
+			if redact[strings.ToLower(name)] {
+				query[name] = []string{redactedValue}
+			}
+		}
+		event.Request.QueryString = query.Encode()
+	}
+	if len(report.body) > 0 {
+		event.Request.Data = redactBody(report.body, redact)
+	}
+	return event
+}
+
+// stackFrames is the calling goroutine's stack, outermost call first as
+// Sentry wants it, without the skip innermost frames. With after, it also
+// leaves out the frames inside the innermost call of that function, such
+// as the recovery's own frames above runtime.gopanic.
+func stackFrames(skip int, after string) []sentryFrame {
+	pcs := make([]uintptr, 64)
+	pcs = pcs[:runtime.Callers(skip+1, pcs)]
+	frames := runtime.CallersFrames(pcs)
+	var stack []sentryFrame
+	for {
+		frame, more := frames.Next()
+		if frame.Function == after {
+			stack = stack[:0]
+		} else {
+			module, function := splitFunction(frame.Function)
+			stack = append(stack, sentryFrame{Function: function, Module: module, AbsPath: frame.File, Lineno: frame.Line,
+				InApp: module == "main" || module == inAppModule || strings.HasPrefix(module, inAppModule+"/")})
+		}
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+		stack[i], stack[j] = stack[j], stack[i]
+	}
+	return stack
+}
+
+// splitFunction splits a function name like
+// "github.com/brentmzey/web-service-go/client.(*Client).do" into its
+// package and the rest.
+func splitFunction(name string) (module, function string) {
+	slash := strings.LastIndex(name, "/")
+	dot := strings.Index(name[slash+1:], ".")
+	if dot < 0 {
+		return "", name
+	}
+	return name[:slash+1+dot], name[slash+1+dot+1:]
+}
+
+type errorReportBodyKey struct{}
+
+// captureForReport copies the body of r into a buffer the reports of its
+// errors include, up to errorReportMaxBodyBytes. Without a reporter, or
+// for a method without a body, it returns r as it is.
+func captureForReport(r *http.Request) *http.Request {
+	switch {
+	case errorReports == nil:
+		return r
+	case r.Method == http.MethodGet, r.Method == http.MethodHead, r.Method == http.MethodOptions:
+		return r
+	}
+	body := &cappedBuffer{max: errorReportMaxBodyBytes}
+	r = r.WithContext(context.WithValue(r.Context(), errorReportBodyKey{}, body))
+	r.Body = teeBody{Reader: io.TeeReader(r.Body, body), Closer: r.Body}
+	return r
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// Error categories. Stores report failures with errors that wrap one of
+// these, mapping driver errors onto them where the driver can tell, and
+// respondError turns them into HTTP statuses without knowing which backend
+// is in use.
+var (
+	errNotFound    = errors.New("not found")
+	errConflict    = errors.New("conflict")
+	errValidation  = errors.New("validation failed")
+	errUnavailable = errors.New("unavailable")
+)
+
+// categorizedError is a specific error, like errBarcodeTaken, that belongs to
+// one of the categories above. Its message is shown to clients as-is, or
+// translated if the locales catalogs have it.
+type categorizedError struct {
+	category error
+	msg      string
+}
+
+func newCategorizedError(category error, msg string) error {
+	return &categorizedError{category: category, msg: msg}
+}
+
+func (e *categorizedError) Error() string { return e.msg }
+func (e *categorizedError) Unwrap() error { return e.category }
+
+// Fallbacks for driver errors that fall in a category but have no more
+// specific error. Backends wrap the driver error with %w so it still reaches
+// the log.
+var (
+	errDuplicateAlbum = newCategorizedError(errConflict, "album conflicts with an existing album")
+	errRejectedAlbum  = newCategorizedError(errValidation, "album was rejected by the database")
+)
+
+// problem is an RFC 7807 problem details body.
+type problem = types.Problem
+
+// writeProblem sends an application/problem+json error response, with detail
+// in the language the request asks for. The type, title, and status stay in
+// English for clients to match on. A 400 for a body that broke one of the
+// REQUEST_BODY_* limits is answered with the 408 or 413 of that limit.
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	if g := failedBody(r); g != nil && status == http.StatusBadRequest {
+		status, detail = g.failed, g.detail(r)
+	}
+	p := statusProblem(status, detail)
+	writeLocalizedDetail(w, r, &p)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSONAs(w, status, "application/problem+json", p)
+}
+
+// statusProblem is a problem that says no more than its status and detail.
+func statusProblem(status int, detail string) problem {
+	return problem{Type: "about:blank", Title: http.StatusText(status), Status: status, Detail: detail}
+}
+
+// errorProblem is the problem respondError answers err with, its detail
+// still in English.
+func errorProblem(r *http.Request, err error) problem {
+	var full *catalogFullError
+	if errors.As(err, &full) {
+		return problem{Type: types.ProblemCatalogFull, Title: http.StatusText(http.StatusForbidden), Status: http.StatusForbidden,
+			Detail: catalogFullDetail, Instance: r.URL.Path, Limit: full.limit, Count: full.count}
+	}
+	// Clients see the categorized error's own message, never the driver
+	// error it may wrap.
+	status, detail := http.StatusInternalServerError, "internal server error"
+	clientMessage := err.Error()
+	var known *categorizedError
+	if errors.As(err, &known) {
+		clientMessage = known.msg
+	}
+	switch {
+	case errors.Is(err, errNotFound):
+		status, detail = http.StatusNotFound, clientMessage
+	case errors.Is(err, errConflict):
+		status, detail = http.StatusConflict, clientMessage
+	case errors.Is(err, errValidation):
+		status, detail = http.StatusUnprocessableEntity, clientMessage
+	case errors.Is(err, errUnavailable), isTransientStoreError(err):
+		status, detail = http.StatusServiceUnavailable, errCircuitOpen.Error()
+	}
+	p := statusProblem(status, detail)
+	p.Instance = r.URL.Path
+	return p
+}
+
+// respondError reports a store or validation error: not found is 404,
+// conflicts 409, validation failures 422, a full catalog 403, and an
+// unavailable store (an open breaker, or a connection error or timeout that
+// outlasted the retries) 503.
+// Anything else is a bug or an unmapped driver error; it is answered with a
+// bare 500, logged with the stack, and reported with SENTRY_DSN.
+func respondError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.Canceled) && abandoned(r) {
+		// The client is gone, so there is no one to answer.
+		return
+	}
+	if g := failedBody(r); g != nil {
+		writeProblem(w, r, g.failed, g.detail(r))
+		return
+	}
+	p := errorProblem(r, err)
+	switch p.Status {
+	case http.StatusForbidden:
+		log.Println("📦 Catalog full:", err)
+	case http.StatusNotFound:
+		log.Println("❌ Not found:", err)
+	case http.StatusConflict:
+		log.Println("⚔️ Conflict:", err)
+	case http.StatusUnprocessableEntity:
+		log.Println("📉 Invalid album:", err)
+	case http.StatusServiceUnavailable:
+		w.Header().Set("Retry-After", "5")
+		log.Printf("🔌 Store unavailable for %s %s: %v", r.Method, r.URL.Path, err)
+	default:
+		log.Printf("🔥 %s %s failed: %v\n%s", r.Method, r.URL.Path, err, debug.Stack())
+		reportError(r, p.Status, err)
+	}
+	writeLocalizedDetail(w, r, &p)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSONAs(w, p.Status, "application/problem+json", p)
+}
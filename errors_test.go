@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	dynamotypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/jackc/pgconn"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// expectCategory fails t unless err is want, or when want is one of the
+// categories, an error in it.
+func expectCategory(t *testing.T, name string, err, want error) {
+	t.Helper()
+	if !errors.Is(err, want) {
+		t.Errorf("%s maps to %v, want %v", name, err, want)
+	}
+}
+
+func TestMapPostgresAlbumError(t *testing.T) {
+	for _, tc := range []struct {
+		err  *pgconn.PgError
+		want error
+	}{
+		{&pgconn.PgError{Code: "23505", ConstraintName: "albums_barcode_key"}, errBarcodeTaken},
+		{&pgconn.PgError{Code: "23505", ConstraintName: "albums_slug_key"}, errSlugTaken},
+		{&pgconn.PgError{Code: "23505", ConstraintName: "albums_pkey"}, errConflict},
+		{&pgconn.PgError{Code: "23502", ColumnName: "title"}, errValidation},
+		{&pgconn.PgError{Code: "22003"}, errValidation},
+	} {
+		expectCategory(t, "Postgres "+tc.err.Code+" "+tc.err.ConstraintName, mapPostgresAlbumError(fmt.Errorf("inserting: %w", tc.err)), tc.want)
+	}
+	syntax := &pgconn.PgError{Code: "42601"}
+	if err := mapPostgresAlbumError(syntax); err != error(syntax) {
+		t.Errorf("a syntax error maps to %v, want it unchanged", err)
+	}
+}
+
+func TestMapMongoAlbumError(t *testing.T) {
+	duplicate := func(index string) error {
+		return mongo.WriteException{WriteErrors: []mongo.WriteError{{Code: 11000,
+			Message: "E11000 duplicate key error collection: albums.albums index: " + index + " dup key: { : \"x\" }"}}}
+	}
+	expectCategory(t, "Mongo duplicate barcode", mapMongoAlbumError(duplicate(mongoBarcodeIndex)), errBarcodeTaken)
+	expectCategory(t, "Mongo duplicate slug", mapMongoAlbumError(duplicate(mongoSlugIndex)), errSlugTaken)
+	expectCategory(t, "Mongo duplicate _id", mapMongoAlbumError(duplicate("_id_")), errConflict)
+	if err := mapMongoAlbumError(mongo.ErrClientDisconnected); err != mongo.ErrClientDisconnected {
+		t.Errorf("a disconnected client maps to %v, want it unchanged", err)
+	}
+}
+
+func TestMapSqliteAlbumError(t *testing.T) {
+	for msg, want := range map[string]error{
+		"UNIQUE constraint failed: albums.barcode":   errBarcodeTaken,
+		"UNIQUE constraint failed: albums.slug":      errSlugTaken,
+		"UNIQUE constraint failed: albums.id":        errConflict,
+		"NOT NULL constraint failed: albums.title":   errValidation,
+		"CHECK constraint failed: stock_nonnegative": errValidation,
+	} {
+		expectCategory(t, "SQLite "+msg, mapSqliteAlbumError(errors.New(msg)), want)
+	}
+}
+
+func TestMapDynamoAlbumError(t *testing.T) {
+	put := func(kind, condition string) dynamotypes.TransactWriteItem {
+		return dynamotypes.TransactWriteItem{Put: &dynamotypes.Put{
+			Item:                map[string]dynamotypes.AttributeValue{"kind": &dynamotypes.AttributeValueMemberS{Value: kind}},
+			ConditionExpression: aws.String(condition),
+		}}
+	}
+	canceled := func(failed int, n int) error {
+		reasons := make([]dynamotypes.CancellationReason, n)
+		for i := range reasons {
+			reasons[i].Code = aws.String("None")
+		}
+		reasons[failed].Code = aws.String("ConditionalCheckFailed")
+		return &dynamotypes.TransactionCanceledException{CancellationReasons: reasons}
+	}
+	create := []dynamotypes.TransactWriteItem{
+		put(dynamoKindAlbum, "attribute_not_exists(id)"),
+		put(dynamoKindSlug, "attribute_not_exists(id)"),
+		put(dynamoKindBarcode, "attribute_not_exists(id)"),
+	}
+	expectCategory(t, "Dynamo album put", mapDynamoAlbumError(canceled(0, 3), create), errConflict)
+	expectCategory(t, "Dynamo slug marker", mapDynamoAlbumError(canceled(1, 3), create), errSlugTaken)
+	expectCategory(t, "Dynamo barcode marker", mapDynamoAlbumError(canceled(2, 3), create), errBarcodeTaken)
+	update := []dynamotypes.TransactWriteItem{put(dynamoKindAlbum, "attribute_exists(id)")}
+	expectCategory(t, "Dynamo update of a missing album", mapDynamoAlbumError(canceled(0, 1), update), errAlbumNotFound)
+}
+
+func TestRespondError(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		status int
+		detail string
+	}{
+		{errAlbumNotFound, http.StatusNotFound, errAlbumNotFound.Error()},
+		{errBarcodeTaken, http.StatusConflict, errBarcodeTaken.Error()},
+		{fmt.Errorf("%w: duplicate key value violates unique constraint", errDuplicateAlbum), http.StatusConflict, errDuplicateAlbum.Error()},
+		{fmt.Errorf("%w: null value in column", errRejectedAlbum), http.StatusUnprocessableEntity, errRejectedAlbum.Error()},
+		{errCircuitOpen, http.StatusServiceUnavailable, errCircuitOpen.Error()},
+		{errConnectionRefused, http.StatusServiceUnavailable, errCircuitOpen.Error()},
+		{errors.New("pq: relation \"albums\" does not exist"), http.StatusInternalServerError, "internal server error"},
+	} {
+		w := httptest.NewRecorder()
+		respondError(w, httptest.NewRequest(http.MethodGet, "/albums/1", nil), tc.err)
+		if w.Code != tc.status {
+			t.Errorf("%v: status %d, want %d", tc.err, w.Code, tc.status)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+			t.Errorf("%v: Content-Type %q, want application/problem+json", tc.err, ct)
+		}
+		p := decodeBody[problem](t, w)
+		if p.Detail != tc.detail || p.Instance != "/albums/1" {
+			t.Errorf("%v: problem %+v, want detail %q", tc.err, p, tc.detail)
+		}
+		// Clients never see what the driver said.
+		if strings.Contains(w.Body.String(), "constraint") || strings.Contains(w.Body.String(), "relation") {
+			t.Errorf("%v: the response leaks the driver error: %s", tc.err, w.Body)
+		}
+		if got := w.Header().Get("Retry-After"); (tc.status == http.StatusServiceUnavailable) != (got != "") {
+			t.Errorf("%v: Retry-After %q", tc.err, got)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+const (
+	albumEventsJobName = "album-events"
+
+	// albumEventsInterval is how often the dispatcher looks for changes to
+	// deliver.
+	albumEventsInterval = 2 * time.Second
+
+	// albumEventsBatch is how many changes the dispatcher reads at a time.
+	albumEventsBatch = 100
+
+	// albumEventSignatureHeader carries "t=<unix seconds>,v1=<hex HMAC>",
+	// the HMAC-SHA256 of "<t>.<body>" with EVENTS_WEBHOOK_SECRET, as the
+	// payments webhook is signed.
+	albumEventSignatureHeader = "Album-Event-Signature"
+)
+
+var errOutboxUnsupported = errors.New("the configured store does not keep an outbox")
+
+// outboxPosition is how far the event dispatcher has delivered a store's
+// change log, which serves as its outbox.
+type outboxPosition struct {
+	Sent    int64 // the seq of the newest change delivered
+	Trimmed int64 // the seq of the newest change trimmed from the log
+	// Durable is set when the store writes each change in the transaction
+	// of the write and keeps Sent across restarts, so that no event is lost
+	// to a crash.
+	Durable bool
+}
+
+// outboxKeeper is implemented by the stores whose change log the event
+// dispatcher can follow.
+type outboxKeeper interface {
+	OutboxPosition(ctx context.Context) (outboxPosition, error)
+	// AdvanceOutbox moves Sent from from to to. It reports false, moving
+	// nothing, if Sent is no longer from: another replica's dispatcher has
+	// delivered those changes.
+	AdvanceOutbox(ctx context.Context, from, to int64) (bool, error)
+}
+
+func storeOutboxPosition(ctx context.Context, store AlbumStore) (outboxPosition, error) {
+	k, ok := store.(outboxKeeper)
+	if !ok {
+		return outboxPosition{}, errOutboxUnsupported
+	}
+	return k.OutboxPosition(ctx)
+}
+
+func storeAdvanceOutbox(ctx context.Context, store AlbumStore, from, to int64) (bool, error) {
+	k, ok := store.(outboxKeeper)
+	if !ok {
+		return false, errOutboxUnsupported
+	}
+	return k.AdvanceOutbox(ctx, from, to)
+}
+
+// albumEvents is the dispatcher, nil unless EVENTS_WEBHOOK_URL is set.
+var albumEvents *eventDispatcher
+
+// eventDispatcher delivers the store's changes to the events webhook, one at
+// a time in seq order, moving the outbox position past each once the webhook
+// has taken it. A change is delivered again if the process stops between the
+// two, so delivery is at least once; it is never skipped.
+type eventDispatcher struct {
+	client   *http.Client
+	url      string
+	secret   string
+	instance string
+
+	unsupported sync.Once
+}
+
+// setupAlbumEvents registers the album-events job when EVENTS_WEBHOOK_URL is
+// set.
+func setupAlbumEvents(cfg *Config) {
+	if cfg.EventsWebhookURL == "" {
+		return
+	}
+	albumEvents = &eventDispatcher{
+		client:   &http.Client{Timeout: 10 * time.Second},
+		url:      cfg.EventsWebhookURL,
+		secret:   cfg.EventsWebhookSecret,
+		instance: cfg.InstanceID,
+	}
+	scheduler.register(albumEventsJobName, albumEventsInterval, albumEvents.run)
+	log.Printf("📨 Delivering album events to a webhook every %s", albumEventsInterval)
+}
+
+// run is the album-events job: it delivers every change after the outbox
+// position, and stops at the first the webhook refuses, to try it again on
+// the next run. A later change of the same album must not overtake it.
+func (d *eventDispatcher) run(ctx context.Context) error {
+	pos, err := storeOutboxPosition(ctx, albumStore)
+	if errors.Is(err, errOutboxUnsupported) {
+		d.unsupported.Do(func() {
+			log.Println("🚧 Album events are on but the album store doesn't keep a change log; no events will be delivered")
+		})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	sent := pos.Sent
+	if sent < pos.Trimmed {
+		log.Printf("🔥 %d album changes were trimmed from the change log before they were delivered", pos.Trimmed-sent)
+		if ok, err := storeAdvanceOutbox(ctx, albumStore, sent, pos.Trimmed); err != nil || !ok {
+			return err
+		}
+		sent = pos.Trimmed
+	}
+	for {
+		changes, _, err := storeChanges(ctx, albumStore, sent, albumEventsBatch)
+		if err != nil {
+			return err
+		}
+		if len(changes) == 0 {
+			return nil
+		}
+		for _, c := range changes {
+			if err := d.send(ctx, d.event(c, pos.Durable)); err != nil {
+				return fmt.Errorf("delivering album change %d: %w", c.Seq, err)
+			}
+			ok, err := storeAdvanceOutbox(ctx, albumStore, sent, c.Seq)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				debugf("Another dispatcher delivered album change %d", c.Seq)
+				return nil
+			}
+			sent = c.Seq
+		}
+	}
+}
+
+// event turns c into the body of its webhook. A durable change's ID is its
+// seq; a best-effort one's also names this process, whose seqs start again
+// from 1 on restart.
+func (d *eventDispatcher) event(c types.AlbumChange, durable bool) types.AlbumEvent {
+	id := strconv.FormatInt(c.Seq, 10)
+	if !durable {
+		id = d.instance + "-" + id
+	}
+	return types.AlbumEvent{ID: id, Type: "album." + c.Op, Seq: c.Seq, AlbumID: c.AlbumID, OccurredAt: c.ChangedAt, BestEffort: !durable}
+}
+
+func (d *eventDispatcher) send(ctx context.Context, event types.AlbumEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if d.secret != "" {
+		timestamp := strconv.FormatInt(serverClock.Now().Unix(), 10)
+		req.Header.Set(albumEventSignatureHeader, "t="+timestamp+",v1="+hex.EncodeToString(signWebhook(d.secret, timestamp, body)))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	debugf("Delivered album event %s: %s %s", event.ID, event.Type, event.AlbumID)
+	return nil
+}
+
+// holdBack moves before, the change log janitor's cutoff, back to the oldest
+// change not yet delivered, so that the janitor never trims an event away.
+func (d *eventDispatcher) holdBack(ctx context.Context, before time.Time) (time.Time, error) {
+	pos, err := storeOutboxPosition(ctx, albumStore)
+	if errors.Is(err, errOutboxUnsupported) {
+		return before, nil
+	}
+	if err != nil {
+		return before, err
+	}
+	changes, _, err := storeChanges(ctx, albumStore, max(pos.Sent, pos.Trimmed), 1)
+	if err != nil {
+		return before, err
+	}
+	if len(changes) > 0 && changes[0].ChangedAt.Before(before) {
+		debugf("Keeping album changes from %s on until they are delivered", changes[0].ChangedAt)
+		return changes[0].ChangedAt, nil
+	}
+	return before, nil
+}
+
+// signWebhook is the HMAC-SHA256 of "<timestamp>.<body>" with secret, the
+// signature of the payments webhook and of album events.
+func signWebhook(secret, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// eventReceiver is an events webhook that keeps what it is sent. Once, the
+// first time it is sent the change with seq hang, it takes the event and
+// then hangs until the sender gives up, as if the process delivering it had
+// died before hearing back.
+type eventReceiver struct {
+	t      *testing.T
+	secret string
+	hang   int64
+	hung   chan struct{}
+
+	mu     sync.Mutex
+	events []types.AlbumEvent
+}
+
+func (rc *eventReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	ts, sig, _ := strings.Cut(strings.TrimPrefix(r.Header.Get(albumEventSignatureHeader), "t="), ",v1=")
+	if sig != hex.EncodeToString(signWebhook(rc.secret, ts, body)) {
+		rc.t.Errorf("an event signed %q", r.Header.Get(albumEventSignatureHeader))
+	}
+	var event types.AlbumEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		rc.t.Error(err)
+	}
+	rc.mu.Lock()
+	rc.events = append(rc.events, event)
+	hang := event.Seq == rc.hang
+	if hang {
+		rc.hang = 0
+	}
+	rc.mu.Unlock()
+	if hang {
+		close(rc.hung)
+		<-r.Context().Done()
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestEventDispatcherRedelivers(t *testing.T) {
+	newTestServer(t)
+	db := testSQLiteStores(t)
+	store, err := NewSqliteAlbumStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albumStore = store
+	ctx := context.Background()
+	blue, _ := store.Create(ctx, newTestAlbum(withID(newAlbumID())))
+	giant, _ := store.Create(ctx, newTestAlbum(withID(newAlbumID()), withTitle("Giant Steps")))
+	blue.Price = 999
+	if _, err := store.Update(ctx, blue, false); err != nil {
+		t.Fatal(err)
+	}
+	giant.Price = 1999
+	if _, err := store.Update(ctx, giant, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := storeDeleteMany(ctx, store, []string{blue.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	receiver := &eventReceiver{t: t, secret: "whsec_events", hang: 3, hung: make(chan struct{})}
+	hook := httptest.NewServer(receiver)
+	defer hook.Close()
+	dispatcher := func() *eventDispatcher {
+		return &eventDispatcher{client: hook.Client(), url: hook.URL, secret: receiver.secret, instance: "web-1"}
+	}
+
+	// The process dies while the webhook has the third change.
+	runCtx, kill := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() { done <- dispatcher().run(runCtx) }()
+	select {
+	case <-receiver.hung:
+	case err := <-done:
+		t.Fatalf("the run returned %v before the third change", err)
+	}
+	kill()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("the killed run returned %v", err)
+	}
+	if pos, _ := storeOutboxPosition(ctx, store); pos.Sent != 2 {
+		t.Fatalf("sent through %d, want 2: the third change was never acknowledged", pos.Sent)
+	}
+
+	// Another process picks up from what the database says was sent.
+	albumStore, err = NewSqliteAlbumStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dispatcher().run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range receiver.events {
+		if e.ID != strconv.FormatInt(e.Seq, 10) || e.BestEffort {
+			t.Errorf("event %+v, want a durable one identified by its seq", e)
+		}
+		got = append(got, e.Type+" "+e.AlbumID)
+	}
+	want := []string{
+		"album.created " + blue.ID,
+		"album.created " + giant.ID,
+		"album.updated " + blue.ID,
+		"album.updated " + blue.ID, // redelivered
+		"album.updated " + giant.ID,
+		"album.deleted " + blue.ID,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("delivered\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if pos, _ := storeOutboxPosition(ctx, albumStore); pos.Sent != 5 {
+		t.Errorf("sent through %d, want 5", pos.Sent)
+	}
+	// Nothing new, nothing sent.
+	if err := dispatcher().run(ctx); err != nil || len(receiver.events) != 6 {
+		t.Errorf("an idle run: %v, %d events", err, len(receiver.events))
+	}
+}
+
+// TestEventDispatcherStopsAtRefusal checks that a change the webhook refuses
+// holds back the ones after it, and that the in-memory store's events are
+// marked best-effort.
+func TestEventDispatcherStopsAtRefusal(t *testing.T) {
+	s := newTestServer(t)
+	a := s.create(newTestAlbum())
+	s.do(http.MethodPatch, "/albums/"+a.ID, `{"price": 9.99}`)
+
+	var mu sync.Mutex
+	var seqs []int64
+	refuse := true
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event types.AlbumEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		mu.Lock()
+		defer mu.Unlock()
+		seqs = append(seqs, event.Seq)
+		if !event.BestEffort || event.ID != "web-1-"+strconv.FormatInt(event.Seq, 10) {
+			t.Errorf("event %+v, want a best-effort one named for the instance", event)
+		}
+		if refuse {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer hook.Close()
+	d := &eventDispatcher{client: hook.Client(), url: hook.URL, instance: "web-1"}
+
+	if err := d.run(context.Background()); err == nil || !strings.Contains(err.Error(), "delivering album change 1") {
+		t.Errorf("run while refused: %v", err)
+	}
+	mu.Lock()
+	refuse = false
+	mu.Unlock()
+	if err := d.run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(seqs) != 3 || seqs[0] != 1 || seqs[1] != 1 || seqs[2] != 2 {
+		t.Errorf("delivered seqs %v, want 1 refused, then 1 and 2", seqs)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"testing"
+)
+
+// xlsxSheet is the part of a worksheet the export tests read back.
+type xlsxSheet struct {
+	Rows []struct {
+		Cells []struct {
+			Ref    string `xml:"r,attr"`
+			Style  string `xml:"s,attr"`
+			Value  string `xml:"v"`
+			Inline string `xml:"is>t"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+	AutoFilter struct {
+		Ref string `xml:"ref,attr"`
+	} `xml:"autoFilter"`
+}
+
+// readXLSXSheet opens the workbook in body and decodes its one sheet.
+func readXLSXSheet(t *testing.T, body []byte) xlsxSheet {
+	t.Helper()
+	zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("the export isn't a zip file: %v", err)
+	}
+	var names []string
+	var sheet xlsxSheet
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := xml.Unmarshal(data, new(struct{})); err != nil {
+			t.Errorf("%s isn't valid XML: %v", f.Name, err)
+		}
+		if f.Name == "xl/worksheets/sheet1.xml" {
+			if err := xml.Unmarshal(data, &sheet); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for _, want := range []string{"[Content_Types].xml", "_rels/.rels", "xl/workbook.xml", "xl/_rels/workbook.xml.rels", "xl/styles.xml", "xl/worksheets/sheet1.xml"} {
+		if !slices.Contains(names, want) {
+			t.Errorf("the workbook has no %s", want)
+		}
+	}
+	return sheet
+}
+
+func TestXLSXExport(t *testing.T) {
+	s := newTestServer(t)
+	a := s.create(newTestAlbum(withTitle("Rock & <Roll>"), withBarcode("036000291452")))
+	s.create(newTestAlbum(withTitle("Giant Steps"), withArtist("Someone Else"), func(a *album) { a.Year = 0 }))
+
+	w := s.do(http.MethodGet, "/albums/export?format=xlsx&artist=John+Coltrane", "")
+	expectStatus(t, w, http.StatusOK)
+	if ct := w.Header().Get("Content-Type"); ct != "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if cd := w.Header().Get("Content-Disposition"); !regexp.MustCompile(`^attachment; filename="albums-\d{8}-\d{6}\.xlsx"$`).MatchString(cd) {
+		t.Errorf("Content-Disposition = %q, want a timestamped filename", cd)
+	}
+
+	sheet := readXLSXSheet(t, w.Body.Bytes())
+	if len(sheet.Rows) != 2 {
+		t.Fatalf("%d rows, want the header and the one album matching the filter", len(sheet.Rows))
+	}
+	var header []string
+	for _, c := range sheet.Rows[0].Cells {
+		header = append(header, c.Inline)
+	}
+	if !slices.Equal(header, albumExportHeader) {
+		t.Errorf("header = %v", header)
+	}
+	row := map[string]string{}
+	for _, c := range sheet.Rows[1].Cells {
+		row[c.Ref] = c.Inline + c.Value
+	}
+	for ref, want := range map[string]string{"A2": a.ID, "B2": "Rock & <Roll>", "C2": "John Coltrane", "D2": "Jazz", "E2": "56.99", "F2": "036000291452", "G2": "1957"} {
+		if row[ref] != want {
+			t.Errorf("%s = %q, want %q", ref, row[ref], want)
+		}
+	}
+	if row["H2"] == "" || row["I2"] == "" {
+		t.Errorf("the timestamps are missing: %v", row)
+	}
+	if sheet.AutoFilter.Ref != "A1:I2" {
+		t.Errorf("autoFilter = %q, want A1:I2", sheet.AutoFilter.Ref)
+	}
+}
+
+func TestXLSXColumn(t *testing.T) {
+	for i, want := range map[int]string{0: "A", 8: "I", 25: "Z", 26: "AA", 51: "AZ", 52: "BA", 701: "ZZ", 702: "AAA"} {
+		if got := xlsxColumn(i); got != want {
+			t.Errorf("xlsxColumn(%d) = %q, want %q", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// knownFeatures lists every feature flag with its default. A flag is set
+// with FEATURE_<NAME>, or feature_<name> in the config file. New endpoints
+// can ship dark by registering a flag that defaults to false.
+var knownFeatures = map[string]bool{
+	"feed":               true,
+	"stats":              true,
+	"spreadsheet_export": true,
+}
+
+// FeatureFlags reports whether a feature is switched on. Handlers check flags
+// through it so tests can inject any combination.
+type FeatureFlags interface {
+	Enabled(name string) bool
+}
+
+// liveFeatures reads the flags from the live configuration, so a reload or
+// a toggle through /admin/features applies to the next request.
+type liveFeatures struct{}
+
+func (liveFeatures) Enabled(name string) bool {
+	return currentConfig().Features[name]
+}
+
+var features FeatureFlags = liveFeatures{}
+
+// defaultFeatures returns a copy of the registered defaults.
+func defaultFeatures() map[string]bool {
+	flags := make(map[string]bool, len(knownFeatures))
+	for name, on := range knownFeatures {
+		flags[name] = on
+	}
+	return flags
+}
+
+// featureEnv is the environment variable that sets the flag name.
+func featureEnv(name string) string {
+	return "FEATURE_" + strings.ToUpper(name)
+}
+
+// getFeatures lists every flag and its current state.
+func getFeatures(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, currentConfig().Features)
+}
+
+// putFeature switches one flag with a body like {"enabled": true}. The
+// change lasts until the next restart or configuration reload.
+func putFeature(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := knownFeatures[name]; !ok {
+		writeProblem(w, r, http.StatusNotFound, "unknown feature "+name)
+		log.Println("❌ Not found: feature", name)
+		return
+	}
+	var body struct {
+		Enabled *bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Enabled == nil {
+		writeProblem(w, r, http.StatusBadRequest, `body must be {"enabled": true} or {"enabled": false}`)
+		log.Println("📉 Bad request: invalid feature toggle for", name)
+		return
+	}
+	if previous := setFeature(name, *body.Enabled); previous != *body.Enabled {
+		recordAudit(auditFeatureToggled, "", principalAdmin, map[string]interface{}{"feature": name, "from": previous, "to": *body.Enabled})
+		log.Printf("🚩 Feature %s %v -> %v", name, previous, *body.Enabled)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "enabled": *body.Enabled})
+}
+
+// setFeature swaps in a configuration with the flag changed and returns its
+// previous state. It shares reloadMu with reloadConfig so neither loses the
+// other's change.
+func setFeature(name string, on bool) (previous bool) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	next := *currentConfig()
+	next.Features = make(map[string]bool, len(next.Features))
+	for n, v := range currentConfig().Features {
+		next.Features[n] = v
+	}
+	previous = next.Features[name]
+	next.Features[name] = on
+	liveConfig.Store(&next)
+	return previous
+}
+
+// featureSettings lists the flags as FEATURE_<NAME>=value, sorted, for logs.
+func featureSettings(flags map[string]bool) []string {
+	settings := make([]string, 0, len(flags))
+	for name, on := range flags {
+		settings = append(settings, featureEnv(name)+"="+strconv.FormatBool(on))
+	}
+	sort.Strings(settings)
+	return settings
+}
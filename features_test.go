@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// fakeFeatures switches on exactly the flags set in it.
+type fakeFeatures map[string]bool
+
+func (f fakeFeatures) Enabled(name string) bool { return f[name] }
+
+// useFeatures puts flags in place of the live ones for t.
+func useFeatures(t *testing.T, flags FeatureFlags) {
+	previous := features
+	t.Cleanup(func() { features = previous })
+	features = flags
+}
+
+func TestFeatureFlaggedRoutes(t *testing.T) {
+	s := newTestServer(t)
+	s.create(newTestAlbum())
+	routes := map[string]string{
+		"/albums/feed":               "feed",
+		"/albums/stats":              "stats",
+		"/artists/stats":             "stats",
+		"/albums/export?format=xlsx": "spreadsheet_export",
+	}
+
+	for _, flags := range []fakeFeatures{
+		{},
+		{"feed": true},
+		{"stats": true, "spreadsheet_export": true},
+		{"feed": true, "stats": true, "spreadsheet_export": true},
+	} {
+		useFeatures(t, flags)
+		for path, flag := range routes {
+			w := s.do(http.MethodGet, path, "")
+			if flags[flag] {
+				if w.Code != http.StatusOK {
+					t.Errorf("GET %s with %v: %d, want 200", path, flags, w.Code)
+				}
+				continue
+			}
+			// The 404 of a path matching no route, which may suggest
+			// another route but not the one switched off.
+			p := expectProblem(t, w, http.StatusNotFound)
+			route, _, _ := strings.Cut(path, "?")
+			if !strings.HasPrefix(p.Detail, "no route matches "+route) || p.Suggestion == route {
+				t.Errorf("GET %s with %v: %+v, want the 404 of an unknown route", path, flags, p)
+			}
+		}
+	}
+}
+
+func TestFeatureToggles(t *testing.T) {
+	s := newTestServer(t)
+	flags := decodeBody[map[string]bool](t, s.admin(http.MethodGet, "/admin/features", ""))
+	if len(flags) != len(knownFeatures) || !flags["feed"] {
+		t.Errorf("GET /admin/features = %v, want every flag with its default", flags)
+	}
+
+	expectStatus(t, s.do(http.MethodPut, "/admin/features/feed", `{"enabled": false}`), http.StatusUnauthorized)
+	expectProblem(t, s.admin(http.MethodPut, "/admin/features/feed", `{"on": false}`), http.StatusBadRequest)
+	expectStatus(t, s.admin(http.MethodPut, "/admin/features/feed", `{"enabled": false}`), http.StatusOK)
+	expectStatus(t, s.do(http.MethodGet, "/albums/feed", ""), http.StatusNotFound)
+	if flags := decodeBody[map[string]bool](t, s.admin(http.MethodGet, "/admin/features", "")); flags["feed"] {
+		t.Error("GET /admin/features still lists feed as on")
+	}
+
+	entries, _ := auditLog.List()
+	var toggles int
+	for _, e := range entries {
+		if e.Action == auditFeatureToggled && e.Details["feature"] == "feed" && e.Details["to"] == false {
+			toggles++
+		}
+	}
+	if toggles != 1 {
+		t.Errorf("%d audit entries for turning feed off, want 1", toggles)
+	}
+}
+
+func TestFeatureFlagsFromConfig(t *testing.T) {
+	cfg, _, err := loadConfig(writeConfigFile(t, "feature_stats: false\nfeature_feed: false\n"), testEnv(map[string]string{"FEATURE_FEED": "true"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Features["stats"] || !cfg.Features["feed"] || !cfg.Features["spreadsheet_export"] {
+		t.Errorf("features = %v, want stats off from the file, feed on from the environment, and the default for the rest", cfg.Features)
+	}
+	if _, _, err := loadConfig("", testEnv(map[string]string{"FEATURE_FEED": "sometimes"})); err == nil {
+		t.Error("FEATURE_FEED=sometimes loaded")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const feedSize = 50
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title     string     `xml:"title"`
+	ID        string     `xml:"id"`
+	Published string     `xml:"published"`
+	Updated   string     `xml:"updated"`
+	Author    atomAuthor `xml:"author"`
+	Link      atomLink   `xml:"link"`
+	Summary   string     `xml:"summary"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+	Description string  `xml:"description"`
+}
+
+type rssGUID struct {
+	Value       string `xml:",chardata"`
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+}
+
+// feedValidators computes the Last-Modified time and a strong ETag for a feed
+// built from entries in the given format.
+func feedValidators(entries []album, format string) (time.Time, string) {
+	var lastModified time.Time
+	h := sha256.New()
+	fmt.Fprintln(h, format)
+	for _, a := range entries {
+		if a.UpdatedAt.After(lastModified) {
+			lastModified = a.UpdatedAt
+		}
+		fmt.Fprintln(h, a.ID, a.UpdatedAt.UnixNano())
+	}
+	return lastModified, `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// notModified reports whether the request's conditional headers match.
+// If-None-Match takes precedence over If-Modified-Since, per RFC 9110.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return inm == etag || inm == "*"
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		return err == nil && !lastModified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+func getAlbumsFeed(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "atom"
+	}
+	if format != "atom" && format != "rss" {
+		writeProblem(w, r, http.StatusBadRequest, `format must be "atom" or "rss"`)
+		log.Println("📉 Bad request: unknown feed format", format)
+		return
+	}
+
+	// The store reads just the newest page, as GET /albums?order=newest
+	// does, however large the catalog.
+	page, err := albumStore.List(r.Context(), ListOptions{Filter: AlbumFilter{AvailableAt: availabilityNow()}, Newest: true, Limit: feedSize})
+	if err = acceptStale(w, err); err != nil {
+		respondError(w, r, err)
+		return
+	}
+	entries := page.Albums
+	lastModified, etag := feedValidators(entries, format)
+
+	w.Header().Set("ETag", etag)
+	if !lastModified.IsZero() {
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+	}
+	if notModified(r, etag, lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	base := requestBaseURL(r)
+	var doc interface{}
+	contentType := "application/atom+xml; charset=utf-8"
+	if format == "rss" {
+		contentType = "application/rss+xml; charset=utf-8"
+		channel := rssChannel{
+			Title:       "Recently added albums",
+			Link:        base + "/albums",
+			Description: fmt.Sprintf("The %d most recently added albums", feedSize),
+		}
+		if !lastModified.IsZero() {
+			channel.LastBuildDate = lastModified.Format(time.RFC1123Z)
+		}
+		for _, a := range entries {
+			channel.Items = append(channel.Items, rssItem{
+				Title:       a.Title + " by " + a.Artist,
+				Link:        base + "/albums/" + a.ID,
+				GUID:        rssGUID{Value: "urn:uuid:" + a.ID},
+				PubDate:     a.CreatedAt.Format(time.RFC1123Z),
+				Description: fmt.Sprintf("%s by %s, $%s", a.Title, a.Artist, a.Price),
+			})
+		}
+		doc = rssFeed{Version: "2.0", Channel: channel}
+	} else {
+		updated := lastModified
+		if updated.IsZero() {
+			updated = time.Unix(0, 0).UTC()
+		}
+		feed := atomFeed{
+			Title:   "Recently added albums",
+			ID:      base + "/albums/feed",
+			Updated: updated.Format(time.RFC3339),
+			Links: []atomLink{
+				{Href: base + "/albums/feed", Rel: "self", Type: "application/atom+xml"},
+				{Href: base + "/albums", Rel: "alternate", Type: "application/json"},
+			},
+		}
+		for _, a := range entries {
+			feed.Entries = append(feed.Entries, atomEntry{
+				Title:     a.Title,
+				ID:        "urn:uuid:" + a.ID,
+				Published: a.CreatedAt.Format(time.RFC3339),
+				Updated:   a.UpdatedAt.Format(time.RFC3339),
+				Author:    atomAuthor{Name: a.Artist},
+				Link:      atomLink{Href: base + "/albums/" + a.ID, Rel: "alternate", Type: "application/json"},
+				Summary:   fmt.Sprintf("%s by %s, $%s", a.Title, a.Artist, a.Price),
+			})
+		}
+		doc = feed
+	}
+
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "internal server error")
+		log.Printf("🔥 Feed marshal error: %v", err)
+		reportError(r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+	log.Printf("📰 Served %s feed with %d entries", format, len(entries))
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// listOptionsStore records the options of each List call, and fails
+// Iterate, so a test can see a handler read a single page.
+type listOptionsStore struct {
+	AlbumStore
+	lists []ListOptions
+}
+
+func (s *listOptionsStore) List(ctx context.Context, opts ListOptions) (albumPage, error) {
+	s.lists = append(s.lists, opts)
+	return s.AlbumStore.List(ctx, opts)
+}
+
+func (s *listOptionsStore) Iterate(ctx context.Context, opts ListOptions, fn func(album) error) error {
+	return errors.New("the whole catalog was read")
+}
+
+func TestFeedEscapesTitles(t *testing.T) {
+	s := newTestServer(t)
+	const title = `Rock & Roll <Live> "at" the 'Bowl'`
+	s.create(newTestAlbum(withTitle("Blue Train")))
+	time.Sleep(2 * time.Millisecond) // the store stamps CreatedAt to the millisecond
+	s.create(newTestAlbum(withTitle(title), withArtist("Tom & Jerry")))
+
+	t.Run("atom", func(t *testing.T) {
+		w := s.do(http.MethodGet, "/albums/feed", "")
+		expectStatus(t, w, http.StatusOK)
+		var feed atomFeed
+		if err := xml.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+			t.Fatalf("the feed isn't valid XML: %v\n%s", err, w.Body)
+		}
+		if len(feed.Entries) != 2 || feed.Entries[0].Title != title || feed.Entries[0].Author.Name != "Tom & Jerry" {
+			t.Errorf("entries = %+v, want the newest album first, its title intact", feed.Entries)
+		}
+	})
+	t.Run("rss", func(t *testing.T) {
+		w := s.do(http.MethodGet, "/albums/feed?format=rss", "")
+		expectStatus(t, w, http.StatusOK)
+		var feed rssFeed
+		if err := xml.Unmarshal(w.Body.Bytes(), &feed); err != nil {
+			t.Fatalf("the feed isn't valid XML: %v\n%s", err, w.Body)
+		}
+		if feed.Version != "2.0" || len(feed.Channel.Items) != 2 || feed.Channel.Items[0].Title != title+" by Tom & Jerry" {
+			t.Errorf("feed = %+v", feed)
+		}
+	})
+	t.Run("not modified", func(t *testing.T) {
+		etag := s.do(http.MethodGet, "/albums/feed", "").Header().Get("ETag")
+		expectStatus(t, s.do(http.MethodGet, "/albums/feed", "", "If-None-Match", etag), http.StatusNotModified)
+		if other := s.do(http.MethodGet, "/albums/feed?format=rss", "").Header().Get("ETag"); other == etag {
+			t.Error("the Atom and RSS feeds share an ETag")
+		}
+	})
+	expectProblem(t, s.do(http.MethodGet, "/albums/feed?format=json", ""), http.StatusBadRequest)
+}
+
+func TestFeedReadsNewestPage(t *testing.T) {
+	s := newTestServer(t)
+	backend, ids := newSizedAlbumStore(t, feedSize+3)
+	store := &listOptionsStore{AlbumStore: backend}
+	albumStore = store
+
+	var feed atomFeed
+	if err := xml.Unmarshal(s.do(http.MethodGet, "/albums/feed", "").Body.Bytes(), &feed); err != nil {
+		t.Fatal(err)
+	}
+	if len(feed.Entries) != feedSize || feed.Entries[0].ID != "urn:uuid:"+ids[len(ids)-1] {
+		t.Errorf("%d entries starting with %s, want %d starting with the last added", len(feed.Entries), feed.Entries[0].ID, feedSize)
+	}
+	if len(store.lists) != 1 || !store.lists[0].Newest || store.lists[0].Limit != feedSize {
+		t.Errorf("listed with %+v, want one newest page of %d", store.lists, feedSize)
+	}
+}
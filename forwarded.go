@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// requestOrigin is where a request really came from: the client's address
+// and the scheme and host it used to reach the service. Behind a trusted
+// proxy those come from its X-Forwarded-* headers; from anyone else the
+// headers are ignored.
+type requestOrigin struct {
+	client string
+	scheme string
+	host   string
+}
+
+type originKey struct{}
+
+// originMiddleware works out the origin of each request once, for the rate
+// limiter, the logs, and the URLs handlers build.
+func originMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o := resolveOrigin(r, currentConfig().TrustedProxies)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), originKey{}, o)))
+	})
+}
+
+// originOf is the origin originMiddleware found for r, or, for a request
+// that didn't pass through it, the one it would have found.
+func originOf(r *http.Request) requestOrigin {
+	if o, ok := r.Context().Value(originKey{}).(requestOrigin); ok {
+		return o
+	}
+	return resolveOrigin(r, currentConfig().TrustedProxies)
+}
+
+// resolveOrigin works out r's origin when the proxies in TRUSTED_PROXIES,
+// a comma-separated list already checked by validate, can be believed.
+// Any peer on a unix socket is trusted, since only local processes can
+// reach it.
+//
+// Behind a trusted proxy the client is the rightmost X-Forwarded-For hop
+// that isn't itself a trusted proxy: each proxy appends the peer it saw, so
+// the hops left of that one are whatever the client chose to send. The
+// proxies append to X-Forwarded-Proto and X-Forwarded-Host the same way,
+// so the scheme and host are the values as far from the right as that hop,
+// the ones the proxy the client reached wrote. A header with fewer values
+// was set rather than appended to along the way, and its leftmost value
+// stands.
+func resolveOrigin(r *http.Request, trustedProxies string) requestOrigin {
+	o := requestOrigin{client: "unix", scheme: "http", host: r.Host}
+	if r.TLS != nil {
+		o.scheme = "https"
+	}
+	proxies, _ := parseTrustedProxies(trustedProxies)
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		o.client = host
+		ip, err := netip.ParseAddr(host)
+		if err != nil || !trustedAddr(proxies, ip) {
+			return o
+		}
+	} else if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); ip != "" {
+		// A proxy in front of a unix socket may only say who it's for
+		// in X-Real-IP.
+		o.client = ip
+	}
+	var depth int
+	o.client, depth = forwardedClient(r.Header.Values("X-Forwarded-For"), proxies, o.client)
+	if proto := strings.ToLower(forwardedValue(r.Header.Values("X-Forwarded-Proto"), depth)); proto == "http" || proto == "https" {
+		o.scheme = proto
+	}
+	if host := forwardedValue(r.Header.Values("X-Forwarded-Host"), depth); host != "" {
+		o.host = host
+	}
+	return o
+}
+
+// forwardedClient walks the X-Forwarded-For hops from the right, past the
+// trusted proxies, and returns the first other address, with how many hops
+// from the right it is. When every hop is a trusted proxy, the leftmost is
+// the client. A hop that isn't an address ends the walk, and the last
+// address before it is the client; with no hops at all, it's peer, at 0.
+func forwardedClient(headers []string, proxies []netip.Prefix, peer string) (string, int) {
+	hops := forwardedValues(headers)
+	client, depth := peer, 0
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, ok := parseHop(hops[i])
+		if !ok {
+			break
+		}
+		client, depth = ip.String(), len(hops)-i
+		if !trustedAddr(proxies, ip) {
+			break
+		}
+	}
+	return client, depth
+}
+
+// forwardedValue is the value depth from the right of an X-Forwarded-*
+// header, or the leftmost if there are fewer. A depth of 0, with no hops
+// forwarded, takes the rightmost, which the peer wrote.
+func forwardedValue(headers []string, depth int) string {
+	values := forwardedValues(headers)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[max(len(values)-max(depth, 1), 0)]
+}
+
+// forwardedValues splits the comma-separated values of a header sent any
+// number of times.
+func forwardedValues(headers []string) []string {
+	var values []string
+	for _, h := range headers {
+		for _, v := range strings.Split(h, ",") {
+			values = append(values, strings.TrimSpace(v))
+		}
+	}
+	return values
+}
+
+// parseHop reads an X-Forwarded-For hop, which some proxies write with a
+// port, and an IPv6 address then in brackets.
+func parseHop(hop string) (netip.Addr, bool) {
+	hop = strings.TrimSpace(hop)
+	if ip, err := netip.ParseAddr(hop); err == nil {
+		return ip.Unmap().WithZone(""), true
+	}
+	if ap, err := netip.ParseAddrPort(hop); err == nil {
+		return ap.Addr().Unmap().WithZone(""), true
+	}
+	if ip, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(hop, "["), "]")); err == nil {
+		return ip.Unmap().WithZone(""), true
+	}
+	return netip.Addr{}, false
+}
+
+func trustedAddr(proxies []netip.Prefix, ip netip.Addr) bool {
+	ip = ip.Unmap().WithZone("")
+	for _, p := range proxies {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr identifies the client for logs and rate limiting: the IP of
+// the peer, without its port, or the one a trusted proxy forwarded the
+// request for. A peer on a unix socket that didn't say who it's for is
+// "unix".
+func clientAddr(r *http.Request) string {
+	return originOf(r).client
+}
+
+// requestBaseURL is the scheme and host the client used to reach the
+// service, for absolute URLs in links and Location headers.
+func requestBaseURL(r *http.Request) string {
+	o := originOf(r)
+	u := url.URL{Scheme: o.scheme, Host: o.host}
+	return u.String()
+}
+
+// parseTrustedProxies reads a comma-separated list of IP addresses and CIDR
+// ranges.
+func parseTrustedProxies(list string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if ip, err := netip.ParseAddr(entry); err == nil {
+			proxies = append(proxies, netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", entry)
+		}
+		proxies = append(proxies, p.Masked())
+	}
+	return proxies, nil
+}
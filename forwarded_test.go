@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResolveOrigin(t *testing.T) {
+	const trusted = "10.0.0.0/8, 192.0.2.7, fd00::/8"
+	for _, tc := range []struct {
+		name    string
+		peer    string
+		headers []string // pairs of name and value
+		tls     bool
+		want    requestOrigin
+	}{
+		{"direct", "203.0.113.9:4000", nil, false, requestOrigin{"203.0.113.9", "http", "example.com"}},
+		{"direct over TLS", "203.0.113.9:4000", nil, true, requestOrigin{"203.0.113.9", "https", "example.com"}},
+		{"one hop", "10.0.0.2:4000", []string{"X-Forwarded-For", "198.51.100.4", "X-Forwarded-Proto", "https", "X-Forwarded-Host", "catalog.example.org"}, false, requestOrigin{"198.51.100.4", "https", "catalog.example.org"}},
+		{"two trusted hops", "10.0.0.2:4000", []string{"X-Forwarded-For", "198.51.100.4, 10.3.0.1"}, false, requestOrigin{"198.51.100.4", "http", "example.com"}},
+		{"hops in two headers", "10.0.0.2:4000", []string{"X-Forwarded-For", "198.51.100.4", "X-Forwarded-For", "192.0.2.7"}, false, requestOrigin{"198.51.100.4", "http", "example.com"}},
+		// The client prepended an address of its own: the rightmost
+		// untrusted hop is the one the first proxy saw.
+		{"spoofed hop", "10.0.0.2:4000", []string{"X-Forwarded-For", "1.2.3.4, 198.51.100.4, 10.3.0.1"}, false, requestOrigin{"198.51.100.4", "http", "example.com"}},
+		{"spoofed trusted hop", "10.0.0.2:4000", []string{"X-Forwarded-For", "10.9.9.9, 198.51.100.4"}, false, requestOrigin{"198.51.100.4", "http", "example.com"}},
+		{"only trusted hops", "10.0.0.2:4000", []string{"X-Forwarded-For", "10.1.0.1, 10.2.0.1"}, false, requestOrigin{"10.1.0.1", "http", "example.com"}},
+		{"garbage hop", "10.0.0.2:4000", []string{"X-Forwarded-For", "198.51.100.4, not-an-ip, 10.3.0.1"}, false, requestOrigin{"10.3.0.1", "http", "example.com"}},
+		{"no hops", "10.0.0.2:4000", []string{"X-Forwarded-Proto", "https"}, false, requestOrigin{"10.0.0.2", "https", "example.com"}},
+		{"hop with a port", "10.0.0.2:4000", []string{"X-Forwarded-For", "198.51.100.4:51000"}, false, requestOrigin{"198.51.100.4", "http", "example.com"}},
+		{"unknown scheme", "10.0.0.2:4000", []string{"X-Forwarded-Proto", "gopher"}, false, requestOrigin{"10.0.0.2", "http", "example.com"}},
+		// The scheme and host are the values the proxy the client reached
+		// appended, as far from the right as the client's hop.
+		{"several schemes and hosts", "10.0.0.2:4000", []string{"X-Forwarded-For", "198.51.100.4, 10.3.0.1", "X-Forwarded-Proto", "HTTPS, http", "X-Forwarded-Host", "catalog.example.org, lb.internal"}, false, requestOrigin{"198.51.100.4", "https", "catalog.example.org"}},
+		{"spoofed scheme and host", "10.0.0.2:4000", []string{"X-Forwarded-For", "198.51.100.4", "X-Forwarded-Proto", "https, http", "X-Forwarded-Host", "evil.example, catalog.example.org"}, false, requestOrigin{"198.51.100.4", "http", "catalog.example.org"}},
+		{"spoofed hop, scheme and host", "10.0.0.2:4000", []string{"X-Forwarded-For", "1.2.3.4, 198.51.100.4, 10.3.0.1", "X-Forwarded-Proto", "http, https, http", "X-Forwarded-Host", "evil.example", "X-Forwarded-Host", "catalog.example.org, lb.internal"}, false, requestOrigin{"198.51.100.4", "https", "catalog.example.org"}},
+		{"scheme and host set, not appended", "10.0.0.2:4000", []string{"X-Forwarded-For", "198.51.100.4, 10.3.0.1", "X-Forwarded-Proto", "https", "X-Forwarded-Host", "catalog.example.org"}, false, requestOrigin{"198.51.100.4", "https", "catalog.example.org"}},
+		{"several schemes and hosts, no hops", "10.0.0.2:4000", []string{"X-Forwarded-Proto", "https, http", "X-Forwarded-Host", "evil.example, lb.internal"}, false, requestOrigin{"10.0.0.2", "http", "lb.internal"}},
+
+		// An untrusted peer's headers are ignored entirely.
+		{"untrusted peer", "203.0.113.9:4000", []string{"X-Forwarded-For", "198.51.100.4", "X-Forwarded-Proto", "https", "X-Forwarded-Host", "evil.example"}, false, requestOrigin{"203.0.113.9", "http", "example.com"}},
+		{"untrusted peer claiming a proxy", "203.0.113.9:4000", []string{"X-Forwarded-For", "10.0.0.2", "X-Real-IP", "10.0.0.2"}, false, requestOrigin{"203.0.113.9", "http", "example.com"}},
+		{"a trusted address's neighbour", "192.0.2.8:4000", []string{"X-Forwarded-For", "198.51.100.4"}, false, requestOrigin{"192.0.2.8", "http", "example.com"}},
+
+		{"IPv6 proxy", "[fd00::1]:4000", []string{"X-Forwarded-For", "2001:db8::5"}, false, requestOrigin{"2001:db8::5", "http", "example.com"}},
+		{"IPv6 hop in brackets", "[fd00::1]:4000", []string{"X-Forwarded-For", "[2001:db8::5]:51000, fd00::2"}, false, requestOrigin{"2001:db8::5", "http", "example.com"}},
+		{"IPv6 hop without a port in brackets", "[fd00::1]:4000", []string{"X-Forwarded-For", "[2001:db8::5]"}, false, requestOrigin{"2001:db8::5", "http", "example.com"}},
+		{"IPv6 hop with a zone", "[fd00::1]:4000", []string{"X-Forwarded-For", "fe80::1%eth0"}, false, requestOrigin{"fe80::1", "http", "example.com"}},
+		{"IPv4-mapped proxy", "[::ffff:10.0.0.2]:4000", []string{"X-Forwarded-For", "198.51.100.4"}, false, requestOrigin{"198.51.100.4", "http", "example.com"}},
+		{"IPv4-mapped hop", "10.0.0.2:4000", []string{"X-Forwarded-For", "::ffff:198.51.100.4, ::ffff:10.3.0.1"}, false, requestOrigin{"198.51.100.4", "http", "example.com"}},
+		{"untrusted IPv6 peer", "[2001:db8::9]:4000", []string{"X-Forwarded-For", "2001:db8::5"}, false, requestOrigin{"2001:db8::9", "http", "example.com"}},
+
+		// Only local processes reach a unix socket.
+		{"unix socket", "@", []string{"X-Real-IP", "198.51.100.4"}, false, requestOrigin{"198.51.100.4", "http", "example.com"}},
+		{"unix socket with hops", "@", []string{"X-Forwarded-For", "198.51.100.4, 10.3.0.1"}, false, requestOrigin{"198.51.100.4", "http", "example.com"}},
+		{"unix socket, nobody said", "@", nil, false, requestOrigin{"unix", "http", "example.com"}},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/albums", nil)
+		req.RemoteAddr = tc.peer
+		if !tc.tls {
+			req.TLS = nil
+		} else {
+			req.TLS = &tls.ConnectionState{}
+		}
+		for i := 0; i+1 < len(tc.headers); i += 2 {
+			req.Header.Add(tc.headers[i], tc.headers[i+1])
+		}
+		if got := resolveOrigin(req, trusted); got != tc.want {
+			t.Errorf("%s: %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies(" 10.0.0.0/8 ,192.0.2.7,, ::ffff:192.0.2.8, fd00::1/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range proxies {
+		got = append(got, p.String())
+	}
+	if strings.Join(got, " ") != "10.0.0.0/8 192.0.2.7/32 192.0.2.8/32 fd00::/8" {
+		t.Errorf("parsed %v", got)
+	}
+	if _, err := parseTrustedProxies("10.0.0.0/8, the-alb"); err == nil || !strings.Contains(err.Error(), `"the-alb"`) {
+		t.Errorf("a name in the list: %v", err)
+	}
+}
+
+// TestForwardedClient checks that the limiter, the access log and the
+// Location header all see the client behind the proxy.
+func TestForwardedClient(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.TrustedProxies = "10.0.0.0/8"
+		cfg.RateLimitRequests = 1
+	})
+	logs := captureLog(t)
+	send := func(method, client, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/albums", strings.NewReader(body))
+		req.RemoteAddr = "10.0.0.2:4000"
+		req.Header.Set("X-Forwarded-For", "1.2.3.4, "+client)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "catalog.example.org")
+		w := httptest.NewRecorder()
+		s.handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send(http.MethodPost, "198.51.100.4", albumJSON(newTestAlbum()))
+	created := decodeBody[album](t, w)
+	if loc := w.Header().Get("Location"); loc != "https://catalog.example.org/albums/"+created.ID {
+		t.Errorf("Location %q", loc)
+	}
+	if line := logs.take(); !strings.Contains(line, "POST /albums from 198.51.100.4 -> 201") {
+		t.Errorf("access log %q, want the forwarded client", line)
+	}
+	// Two clients behind the one proxy are limited apart; the spoofed hop
+	// doesn't make them one.
+	expectStatus(t, send(http.MethodGet, "198.51.100.4", ""), http.StatusTooManyRequests)
+	expectStatus(t, send(http.MethodGet, "198.51.100.5", ""), http.StatusOK)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// pinger is implemented by album stores backed by a server that can be
+// unreachable.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// isHealthCheck reports whether path is a probe endpoint. Probes bypass load
+// shedding so an overloaded instance isn't mistaken for a dead one.
+func isHealthCheck(path string) bool {
+	return path == "/healthz" || path == "/readyz"
+}
+
+// healthzHandler is the liveness probe: the process is up and serving. It
+// also reports the maintenance mode, since a service in maintenance is alive
+// but turning requests away, and whether metrics flushes are reaching the
+// metrics store, which doesn't make the instance any less alive.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":              "ok",
+		"maintenance":         maintenance().String(),
+		"metricsStoreHealthy": !metricsStoreFailing.Load(),
+	})
+}
+
+// readyzHandler is the readiness probe: the stores have connected, the album
+// store is reachable, and no store circuit breaker is open.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if !storesReady.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "message": "stores are still connecting"})
+		log.Println("🩺 Readiness check failed: stores are still connecting")
+		return
+	}
+	if warmingUp.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "message": "caches are warming up"})
+		log.Println("🩺 Readiness check failed: caches are warming up")
+		return
+	}
+	breakers := breakerStates()
+	for name, state := range breakers {
+		if state == breakerOpen.String() {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "message": name + " store circuit breaker is open", "circuitBreakers": breakers})
+			log.Printf("🩺 Readiness check failed: %s circuit breaker is open", name)
+			return
+		}
+	}
+	if err := pingAlbumStore(r.Context(), albumStore); err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "message": "album store is unreachable"})
+		log.Printf("🩺 Readiness check failed: %v", err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
+
+// pingAlbumStore is the probe of the album store that readyz and the check
+// command share. A store that can't be unreachable always passes.
+func pingAlbumStore(ctx context.Context, store AlbumStore) error {
+	p, ok := store.(pinger)
+	if !ok {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	return p.Ping(ctx)
+}
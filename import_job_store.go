@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/jackc/pgx/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+var errImportJobNotFound = newCategorizedError(errNotFound, "import job not found")
+
+// importJobStore is implemented by album stores that keep the import jobs
+// of POST /albums/import next to the albums, so a job can be followed from
+// any instance and its history outlives a restart. Progress and
+// cancellation are separate writes so that neither can undo the other.
+type importJobStore interface {
+	CreateImportJob(ctx context.Context, job importJob) error
+	// GetImportJob returns errImportJobNotFound for an unknown id.
+	GetImportJob(ctx context.Context, id string) (importJob, error)
+	// SaveImportJobProgress writes every field of job but CancelRequested.
+	SaveImportJobProgress(ctx context.Context, job importJob) error
+	// CancelImportJob sets CancelRequested and leaves the rest alone.
+	CancelImportJob(ctx context.Context, id string) error
+}
+
+func (store *InMemoryAlbumStore) CreateImportJob(ctx context.Context, job importJob) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.importJobs[job.ID] = job
+	return nil
+}
+
+func (store *InMemoryAlbumStore) GetImportJob(ctx context.Context, id string) (importJob, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	job, ok := store.importJobs[id]
+	if !ok {
+		return importJob{}, errImportJobNotFound
+	}
+	return job, nil
+}
+
+func (store *InMemoryAlbumStore) SaveImportJobProgress(ctx context.Context, job importJob) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	stored, ok := store.importJobs[job.ID]
+	if !ok {
+		return errImportJobNotFound
+	}
+	job.CancelRequested = stored.CancelRequested
+	store.importJobs[job.ID] = job
+	return nil
+}
+
+func (store *InMemoryAlbumStore) CancelImportJob(ctx context.Context, id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	job, ok := store.importJobs[id]
+	if !ok {
+		return errImportJobNotFound
+	}
+	job.CancelRequested = true
+	store.importJobs[id] = job
+	return nil
+}
+
+// sqlImportJobProgressColumns are the columns SaveImportJobProgress writes.
+const sqlImportJobProgressColumns = `state, principal, rows_processed, rows_created, rows_failed, failures, error, created_at, started_at, finished_at, updated_at`
+
+const sqlImportJobColumns = `id, cancel_requested, ` + sqlImportJobProgressColumns
+
+// sqlImportJobProgress lists job's values for sqlImportJobProgressColumns.
+func sqlImportJobProgress(job importJob) ([]interface{}, error) {
+	failures, err := json.Marshal(job.Failures)
+	if err != nil {
+		return nil, err
+	}
+	return []interface{}{
+		job.State, job.Principal, job.RowsProcessed, job.RowsCreated, job.RowsFailed, string(failures), job.Error,
+		job.CreatedAt, nullTime(job.StartedAt), nullTime(job.FinishedAt), job.UpdatedAt,
+	}, nil
+}
+
+// scanSQLImportJob reads a row of sqlImportJobColumns.
+func scanSQLImportJob(scan func(dest ...interface{}) error) (importJob, error) {
+	var job importJob
+	var failures []byte
+	var started, finished sql.NullTime
+	err := scan(&job.ID, &job.CancelRequested, &job.State, &job.Principal, &job.RowsProcessed, &job.RowsCreated, &job.RowsFailed,
+		&failures, &job.Error, &job.CreatedAt, &started, &finished, &job.UpdatedAt)
+	if err != nil {
+		return importJob{}, err
+	}
+	if err := json.Unmarshal(failures, &job.Failures); err != nil {
+		return importJob{}, err
+	}
+	job.CreatedAt, job.UpdatedAt = job.CreatedAt.UTC(), job.UpdatedAt.UTC()
+	if started.Valid {
+		job.StartedAt = started.Time.UTC()
+	}
+	if finished.Valid {
+		job.FinishedAt = finished.Time.UTC()
+	}
+	return job, nil
+}
+
+func (store *PostgresAlbumStore) CreateImportJob(ctx context.Context, job importJob) error {
+	progress, err := sqlImportJobProgress(job)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	_, err = store.db.Exec(ctx, `INSERT INTO import_jobs (`+sqlImportJobColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`,
+		append([]interface{}{job.ID, job.CancelRequested}, progress...)...)
+	return err
+}
+
+func (store *PostgresAlbumStore) GetImportJob(ctx context.Context, id string) (importJob, error) {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	job, err := scanSQLImportJob(store.db.QueryRow(ctx, `SELECT `+sqlImportJobColumns+` FROM import_jobs WHERE id = $1`, id).Scan)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return importJob{}, errImportJobNotFound
+	}
+	return job, err
+}
+
+func (store *PostgresAlbumStore) SaveImportJobProgress(ctx context.Context, job importJob) error {
+	progress, err := sqlImportJobProgress(job)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	tag, err := store.db.Exec(ctx,
+		`UPDATE import_jobs SET (`+sqlImportJobProgressColumns+`) = ($2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) WHERE id = $1`,
+		append([]interface{}{job.ID}, progress...)...)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errImportJobNotFound
+	}
+	return nil
+}
+
+func (store *PostgresAlbumStore) CancelImportJob(ctx context.Context, id string) error {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	tag, err := store.db.Exec(ctx, `UPDATE import_jobs SET cancel_requested = TRUE WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errImportJobNotFound
+	}
+	return nil
+}
+
+func (store *SqliteAlbumStore) CreateImportJob(ctx context.Context, job importJob) error {
+	progress, err := sqlImportJobProgress(job)
+	if err != nil {
+		return err
+	}
+	return store.db.WithContext(ctx).Exec(`INSERT INTO import_jobs (`+sqlImportJobColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		append([]interface{}{job.ID, job.CancelRequested}, progress...)...).Error
+}
+
+func (store *SqliteAlbumStore) GetImportJob(ctx context.Context, id string) (importJob, error) {
+	job, err := scanSQLImportJob(store.db.WithContext(ctx).Raw(`SELECT `+sqlImportJobColumns+` FROM import_jobs WHERE id = ?`, id).Row().Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return importJob{}, errImportJobNotFound
+	}
+	return job, err
+}
+
+func (store *SqliteAlbumStore) SaveImportJobProgress(ctx context.Context, job importJob) error {
+	progress, err := sqlImportJobProgress(job)
+	if err != nil {
+		return err
+	}
+	res := store.db.WithContext(ctx).Exec(
+		`UPDATE import_jobs SET (`+sqlImportJobProgressColumns+`) = (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) WHERE id = ?`,
+		append(progress, job.ID)...)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errImportJobNotFound
+	}
+	return nil
+}
+
+func (store *SqliteAlbumStore) CancelImportJob(ctx context.Context, id string) error {
+	res := store.db.WithContext(ctx).Exec(`UPDATE import_jobs SET cancel_requested = 1 WHERE id = ?`, id)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errImportJobNotFound
+	}
+	return nil
+}
+
+// mongoImportJob is an import job as stored in the importJobs collection,
+// with the ID as _id.
+type mongoImportJob struct {
+	ID              string          `bson:"_id"`
+	State           string          `bson:"state"`
+	Principal       string          `bson:"principal"`
+	RowsProcessed   int             `bson:"rowsProcessed"`
+	RowsCreated     int             `bson:"rowsCreated"`
+	RowsFailed      int             `bson:"rowsFailed"`
+	Failures        []importFailure `bson:"failures"`
+	Error           string          `bson:"error,omitempty"`
+	CancelRequested bool            `bson:"cancelRequested"`
+	CreatedAt       time.Time       `bson:"createdAt"`
+	StartedAt       time.Time       `bson:"startedAt,omitempty"`
+	FinishedAt      time.Time       `bson:"finishedAt,omitempty"`
+	UpdatedAt       time.Time       `bson:"updatedAt"`
+}
+
+func (doc mongoImportJob) importJob() importJob {
+	job := importJob(doc)
+	job.CreatedAt, job.StartedAt, job.FinishedAt, job.UpdatedAt = doc.CreatedAt.UTC(), doc.StartedAt.UTC(), doc.FinishedAt.UTC(), doc.UpdatedAt.UTC()
+	return job
+}
+
+func (store *MongoAlbumStore) CreateImportJob(ctx context.Context, job importJob) error {
+	_, err := store.importJobs.InsertOne(ctx, mongoImportJob(job))
+	return err
+}
+
+func (store *MongoAlbumStore) GetImportJob(ctx context.Context, id string) (importJob, error) {
+	var doc mongoImportJob
+	err := store.importJobs.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return importJob{}, errImportJobNotFound
+	}
+	if err != nil {
+		return importJob{}, err
+	}
+	return doc.importJob(), nil
+}
+
+func (store *MongoAlbumStore) SaveImportJobProgress(ctx context.Context, job importJob) error {
+	set := bson.D{
+		{Key: "state", Value: job.State}, {Key: "principal", Value: job.Principal},
+		{Key: "rowsProcessed", Value: job.RowsProcessed}, {Key: "rowsCreated", Value: job.RowsCreated}, {Key: "rowsFailed", Value: job.RowsFailed},
+		{Key: "failures", Value: job.Failures}, {Key: "error", Value: job.Error},
+		{Key: "createdAt", Value: job.CreatedAt}, {Key: "startedAt", Value: job.StartedAt}, {Key: "finishedAt", Value: job.FinishedAt},
+		{Key: "updatedAt", Value: job.UpdatedAt},
+	}
+	res, err := store.importJobs.UpdateOne(ctx, bson.D{{Key: "_id", Value: job.ID}}, bson.D{{Key: "$set", Value: set}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errImportJobNotFound
+	}
+	return nil
+}
+
+func (store *MongoAlbumStore) CancelImportJob(ctx context.Context, id string) error {
+	res, err := store.importJobs.UpdateOne(ctx, bson.D{{Key: "_id", Value: id}}, bson.D{{Key: "$set", Value: bson.D{{Key: "cancelRequested", Value: true}}}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return errImportJobNotFound
+	}
+	return nil
+}
+
+const dynamoImportJobsTable = "importJobs"
+
+// dynamoImportJob is an import job as stored in the importJobs table, keyed
+// by id.
+type dynamoImportJob struct {
+	ID              string          `dynamodbav:"id"`
+	State           string          `dynamodbav:"state"`
+	Principal       string          `dynamodbav:"principal"`
+	RowsProcessed   int             `dynamodbav:"rowsProcessed"`
+	RowsCreated     int             `dynamodbav:"rowsCreated"`
+	RowsFailed      int             `dynamodbav:"rowsFailed"`
+	Failures        []importFailure `dynamodbav:"failures"`
+	Error           string          `dynamodbav:"error,omitempty"`
+	CancelRequested bool            `dynamodbav:"cancelRequested"`
+	CreatedAt       time.Time       `dynamodbav:"createdAt"`
+	StartedAt       *time.Time      `dynamodbav:"startedAt,omitempty"`
+	FinishedAt      *time.Time      `dynamodbav:"finishedAt,omitempty"`
+	UpdatedAt       time.Time       `dynamodbav:"updatedAt"`
+}
+
+func newDynamoImportJob(job importJob) dynamoImportJob {
+	item := dynamoImportJob{
+		ID: job.ID, State: job.State, Principal: job.Principal, RowsProcessed: job.RowsProcessed, RowsCreated: job.RowsCreated,
+		RowsFailed: job.RowsFailed, Failures: job.Failures, Error: job.Error, CancelRequested: job.CancelRequested,
+		CreatedAt: job.CreatedAt, UpdatedAt: job.UpdatedAt,
+	}
+	if !job.StartedAt.IsZero() {
+		item.StartedAt = &job.StartedAt
+	}
+	if !job.FinishedAt.IsZero() {
+		item.FinishedAt = &job.FinishedAt
+	}
+	return item
+}
+
+func (item dynamoImportJob) importJob() importJob {
+	job := importJob{
+		ID: item.ID, State: item.State, Principal: item.Principal, RowsProcessed: item.RowsProcessed, RowsCreated: item.RowsCreated,
+		RowsFailed: item.RowsFailed, Failures: item.Failures, Error: item.Error, CancelRequested: item.CancelRequested,
+		CreatedAt: item.CreatedAt.UTC(), UpdatedAt: item.UpdatedAt.UTC(),
+	}
+	if item.StartedAt != nil {
+		job.StartedAt = item.StartedAt.UTC()
+	}
+	if item.FinishedAt != nil {
+		job.FinishedAt = item.FinishedAt.UTC()
+	}
+	return job
+}
+
+func (store *DynamoAlbumStore) CreateImportJob(ctx context.Context, job importJob) error {
+	av, err := attributevalue.MarshalMap(newDynamoImportJob(job))
+	if err != nil {
+		return err
+	}
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	_, err = store.client.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(dynamoImportJobsTable), Item: av})
+	return err
+}
+
+func (store *DynamoAlbumStore) GetImportJob(ctx context.Context, id string) (importJob, error) {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	res, err := store.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(dynamoImportJobsTable),
+		Key:            map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return importJob{}, err
+	}
+	if res.Item == nil {
+		return importJob{}, errImportJobNotFound
+	}
+	var item dynamoImportJob
+	if err := attributevalue.UnmarshalMap(res.Item, &item); err != nil {
+		return importJob{}, err
+	}
+	return item.importJob(), nil
+}
+
+// SaveImportJobProgress puts the whole item, carrying over cancelRequested
+// under a condition that it hasn't changed since it was read, and tries
+// again if it has.
+func (store *DynamoAlbumStore) SaveImportJobProgress(ctx context.Context, job importJob) error {
+	for {
+		stored, err := store.GetImportJob(ctx, job.ID)
+		if err != nil {
+			return err
+		}
+		job.CancelRequested = stored.CancelRequested
+		av, err := attributevalue.MarshalMap(newDynamoImportJob(job))
+		if err != nil {
+			return err
+		}
+		opCtx, cancel := store.opContext(ctx)
+		_, err = store.client.PutItem(opCtx, &dynamodb.PutItemInput{
+			TableName:                 aws.String(dynamoImportJobsTable),
+			Item:                      av,
+			ConditionExpression:       aws.String("cancelRequested = :cancel"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{":cancel": &types.AttributeValueMemberBOOL{Value: stored.CancelRequested}},
+		})
+		cancel()
+		var failed *types.ConditionalCheckFailedException
+		if !errors.As(err, &failed) {
+			return err
+		}
+	}
+}
+
+func (store *DynamoAlbumStore) CancelImportJob(ctx context.Context, id string) error {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	_, err := store.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(dynamoImportJobsTable),
+		Key:                       map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+		ConditionExpression:       aws.String("attribute_exists(id)"),
+		UpdateExpression:          aws.String("SET cancelRequested = :cancel"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":cancel": &types.AttributeValueMemberBOOL{Value: true}},
+	})
+	var failed *types.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		return errImportJobNotFound
+	}
+	return err
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brentmzey/web-service-go/money"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultImportAsyncBytes = 1 << 20
+	defaultImportMaxBytes   = 64 << 20
+
+	// maxImportFailures caps the failed rows a job reports; RowsFailed still
+	// counts every one.
+	maxImportFailures = 100
+	// maxRunningImports caps the imports one instance runs at a time.
+	maxRunningImports = 2
+	// importJobStaleAfter is how long a queued or running job can go
+	// without progress before an instance that isn't running it reports it
+	// as interrupted. A batch takes far less.
+	importJobStaleAfter = 5 * time.Minute
+)
+
+// The states of an import job. Only queued and running jobs can change.
+const (
+	importQueued    = "queued"
+	importRunning   = "running"
+	importCompleted = "completed"
+	importFailed    = "failed"
+	importCancelled = "cancelled"
+)
+
+var (
+	errImportJobsUnsupported = errors.New("the configured store does not keep import jobs")
+	errImportJobFinished     = newCategorizedError(errConflict, "the import job has already finished")
+	errTooManyImports        = errors.New("too many imports are running, please retry later")
+	errUnknownImportColumn   = errors.New("the header may only name the title, artist, price, genre, barcode, year, and tracks columns")
+)
+
+// importColumns are the columns a CSV import may have, in any order and
+// case. Tracks are separated by "|".
+var importColumns = []string{"title", "artist", "price", "genre", "barcode", "year", "tracks"}
+
+// importJob is the progress of one POST /albums/import. Its fields are in
+// the order of mongoImportJob's, which converts to it.
+type importJob struct {
+	ID              string          `json:"id"`
+	State           string          `json:"state"`
+	Principal       string          `json:"principal"`
+	RowsProcessed   int             `json:"rowsProcessed"`
+	RowsCreated     int             `json:"rowsCreated"`
+	RowsFailed      int             `json:"rowsFailed"`
+	Failures        []importFailure `json:"failures"` // the first maxImportFailures
+	Error           string          `json:"error,omitempty"`
+	CancelRequested bool            `json:"cancelRequested,omitempty"`
+	CreatedAt       time.Time       `json:"createdAt"`
+	StartedAt       time.Time       `json:"startedAt,omitzero"`
+	FinishedAt      time.Time       `json:"finishedAt,omitzero"`
+	UpdatedAt       time.Time       `json:"updatedAt"`
+}
+
+// importFailure is a row that wasn't imported, by its line in the CSV.
+type importFailure struct {
+	Row   int    `json:"row" dynamodbav:"row"`
+	Error string `json:"error" dynamodbav:"error"`
+}
+
+func (job importJob) finished() bool {
+	return job.State != importQueued && job.State != importRunning
+}
+
+func (job *importJob) fail(row int, err error) {
+	job.RowsFailed++
+	if len(job.Failures) < maxImportFailures {
+		job.Failures = append(job.Failures, importFailure{Row: row, Error: err.Error()})
+	}
+}
+
+// finish moves the job to a final state.
+func (job *importJob) finish(state, reason string) {
+	job.State, job.Error = state, reason
+	job.FinishedAt = time.Now().UTC()
+	job.UpdatedAt = job.FinishedAt
+}
+
+func importJobsOf(store AlbumStore) (importJobStore, error) {
+	jobs, ok := store.(importJobStore)
+	if !ok {
+		return nil, errImportJobsUnsupported
+	}
+	return jobs, nil
+}
+
+// importRunner tracks the imports this instance is running, so it can cap
+// them and wait for them on shutdown.
+type importRunner struct {
+	mu     sync.Mutex
+	ctx    context.Context // cancelled on shutdown
+	active map[string]bool
+	wg     sync.WaitGroup
+}
+
+var imports = &importRunner{ctx: context.Background(), active: make(map[string]bool)}
+
+// reserve claims one of the maxRunningImports slots for the job with id.
+func (ir *importRunner) reserve(id string) bool {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	if len(ir.active) >= maxRunningImports {
+		return false
+	}
+	ir.active[id] = true
+	ir.wg.Add(1)
+	return true
+}
+
+func (ir *importRunner) release(id string) {
+	ir.mu.Lock()
+	delete(ir.active, id)
+	ir.mu.Unlock()
+	ir.wg.Done()
+}
+
+func (ir *importRunner) running(id string) bool {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	return ir.active[id]
+}
+
+// wait blocks until every import has stopped. Cancelling ir.ctx stops them
+// at the next batch.
+func (ir *importRunner) wait() {
+	ir.wg.Wait()
+}
+
+// importRow is a parsed row, with the line it came from.
+type importRow struct {
+	line  int
+	album album
+}
+
+// importReader reads albums from a CSV import.
+type importReader struct {
+	csv     *csv.Reader
+	columns []string // importColumns names, in the CSV's order
+}
+
+// newImportReader reads the header of a CSV import. It must name the title
+// and artist columns and nothing outside importColumns.
+func newImportReader(body []byte) (*importReader, error) {
+	cr := csv.NewReader(bytes.NewReader(body))
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("the import must start with a header row naming its columns")
+	}
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !slices.Contains(importColumns, name) {
+			return nil, fmt.Errorf("%w: %q", errUnknownImportColumn, name)
+		}
+		header[i] = name
+		seen[name] = true
+	}
+	if !seen["title"] || !seen["artist"] {
+		return nil, errors.New("the header must name the title and artist columns")
+	}
+	return &importReader{csv: cr, columns: header}, nil
+}
+
+// next returns the next row, or the error that makes it unusable with the
+// line it is on. It returns io.EOF after the last row.
+func (ir *importReader) next() (importRow, error) {
+	record, err := ir.csv.Read()
+	if err != nil {
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return importRow{line: parseErr.StartLine}, err
+		}
+		return importRow{}, err
+	}
+	line, _ := ir.csv.FieldPos(0)
+	var in albumInput
+	for i, value := range record {
+		if i >= len(ir.columns) {
+			break
+		}
+		value = strings.TrimSpace(value)
+		switch ir.columns[i] {
+		case "title":
+			in.Title = value
+		case "artist":
+			in.Artist = value
+		case "genre":
+			in.Genre = value
+		case "barcode":
+			in.Barcode = value
+		case "price":
+			if value == "" {
+				continue
+			}
+			if in.Price, err = money.Parse(value); err != nil {
+				return importRow{line: line}, errors.New("price is not a number")
+			}
+		case "year":
+			if value == "" {
+				continue
+			}
+			if in.Year, err = strconv.Atoi(value); err != nil {
+				return importRow{line: line}, errors.New("year is not a whole number")
+			}
+		case "tracks":
+			if value != "" {
+				in.Tracks = strings.Split(value, "|")
+			}
+		}
+	}
+	switch {
+	case in.Title == "":
+		return importRow{line: line}, errors.New("title is required")
+	case in.Artist == "":
+		return importRow{line: line}, errors.New("artist is required")
+	}
+	if err := in.validate(); err != nil {
+		return importRow{line: line}, err
+	}
+	return importRow{line: line, album: in.album(newAlbumID())}, nil
+}
+
+// importMessage is what a job reports for an error that stopped it: the
+// categorized message, never the driver error it may wrap.
+func importMessage(err error) string {
+	var known *categorizedError
+	var full *catalogFullError
+	switch {
+	case errors.As(err, &known):
+		return known.msg
+	case errors.As(err, &full):
+		return catalogFullDetail
+	case errors.Is(err, errUnavailable), isTransientStoreError(err):
+		return errCircuitOpen.Error()
+	default:
+		return "internal server error"
+	}
+}
+
+// runImport creates the albums rows reads, maxBatchAlbums at a time, saving
+// the job's progress after each batch. Before each batch it checks whether
+// the job was cancelled or the service is shutting down, and stops there if
+// so. Bad rows are counted and skipped; an error other than a bad row fails
+// the job and is returned.
+func runImport(ctx context.Context, store AlbumStore, jobs importJobStore, job importJob, rows *importReader) (importJob, error) {
+	// Writes outlive shutdown so that a batch, once started, completes.
+	writeCtx := withCatalogLimit(withPrincipal(context.WithoutCancel(ctx), job.Principal), currentConfig().CatalogMaxAlbums)
+	save := func() {
+		if err := jobs.SaveImportJobProgress(writeCtx, job); err != nil {
+			log.Printf("🔥 Failed to save progress of import %s: %v", job.ID, err)
+		}
+	}
+	finish := func(state, reason string) {
+		job.finish(state, reason)
+		save()
+		recordAudit(auditAlbumsImported, "", job.Principal, map[string]interface{}{
+			"job":     job.ID,
+			"state":   job.State,
+			"created": job.RowsCreated,
+			"failed":  job.RowsFailed,
+		})
+		log.Printf("📥 Import %s %s: %d albums created, %d rows failed", job.ID, job.State, job.RowsCreated, job.RowsFailed)
+	}
+
+	job.State = importRunning
+	job.StartedAt = time.Now().UTC()
+	job.UpdatedAt = job.StartedAt
+	save()
+	for done := false; !done; {
+		if ctx.Err() != nil {
+			finish(importFailed, "the service shut down during the import")
+			return job, nil
+		}
+		if stored, err := jobs.GetImportJob(writeCtx, job.ID); err == nil && stored.CancelRequested {
+			job.CancelRequested = true
+			finish(importCancelled, "")
+			return job, nil
+		}
+
+		var batch []importRow
+		for len(batch) < maxBatchAlbums {
+			row, err := rows.next()
+			if errors.Is(err, io.EOF) {
+				done = true
+				break
+			}
+			job.RowsProcessed++
+			if err != nil {
+				job.fail(row.line, err)
+				continue
+			}
+			batch = append(batch, row)
+		}
+		created, err := importBatch(writeCtx, store, &job, batch)
+		job.RowsCreated += created
+		atomic.AddInt64(&metrics.TotalAlbumsAdded, int64(created))
+		if err != nil {
+			log.Printf("🔥 Import %s failed: %v", job.ID, err)
+			finish(importFailed, importMessage(err))
+			return job, err
+		}
+		job.UpdatedAt = time.Now().UTC()
+		if !done {
+			save()
+		}
+	}
+	finish(importCompleted, "")
+	return job, nil
+}
+
+// importBatch creates the albums in batch in one CreateMany and returns how
+// many it created. If a row is rejected, or the batch doesn't fit under the
+// catalog limit, it is retried one album at a time so that only the bad
+// rows fail and the catalog fills up to the limit. A full catalog then
+// fails the import.
+func importBatch(ctx context.Context, store AlbumStore, job *importJob, batch []importRow) (int, error) {
+	if len(batch) == 0 {
+		return 0, nil
+	}
+	defer albumsChanged()
+	albums := make([]album, len(batch))
+	for i, row := range batch {
+		albums[i] = row.album
+	}
+	created, err := store.CreateMany(ctx, albums)
+	if err == nil {
+		return len(created), nil
+	}
+	var full *catalogFullError
+	if !errors.Is(err, errConflict) && !errors.Is(err, errValidation) && !errors.As(err, &full) {
+		return 0, err
+	}
+	n := 0
+	for _, row := range batch {
+		_, err := store.Create(ctx, row.album)
+		switch {
+		case err == nil:
+			n++
+		case errors.Is(err, errConflict), errors.Is(err, errValidation):
+			job.fail(row.line, errors.New(importMessage(err)))
+		default:
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// postAlbumsImport creates albums from a CSV with a header row. A body
+// larger than IMPORT_ASYNC_BYTES, or any body with ?async=true, is imported
+// in the background: the answer is 202 with the job, whose progress GET
+// /imports/{jobId} reports. A smaller one is imported before the answer.
+// Either way bad rows are skipped and listed in the job.
+func postAlbumsImport(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	jobs, err := importJobsOf(albumStore)
+	if err != nil {
+		writeProblem(w, r, http.StatusNotImplemented, err.Error())
+		log.Println("🚧 Import requested but the album store doesn't keep import jobs")
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(cfg.ImportMaxBytes)))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		atomic.AddInt64(&totalBodyTooLarge, 1)
+		w.Header().Set("Connection", "close")
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, localize(r, "the import is larger than %d bytes", cfg.ImportMaxBytes))
+		log.Printf("📉 Bad request: import over IMPORT_MAX_BYTES")
+		return
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	rows, err := newImportReader(body)
+	if err != nil {
+		detail := err.Error()
+		if errors.Is(err, errUnknownImportColumn) {
+			detail = errUnknownImportColumn.Error()
+		}
+		writeProblem(w, r, http.StatusBadRequest, detail)
+		log.Println("📉 Bad request:", err)
+		return
+	}
+
+	now := time.Now().UTC()
+	job := importJob{
+		ID:        uuid.New().String(),
+		State:     importQueued,
+		Principal: requestPrincipal(r),
+		Failures:  []importFailure{},
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if !imports.reserve(job.ID) {
+		w.Header().Set("Retry-After", "30")
+		writeProblem(w, r, http.StatusServiceUnavailable, errTooManyImports.Error())
+		log.Println("🚦 Import refused: too many imports are running")
+		return
+	}
+	if err := jobs.CreateImportJob(r.Context(), job); err != nil {
+		imports.release(job.ID)
+		respondError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", resourceURL(r, importJobRoute, job.ID))
+
+	if len(body) > cfg.ImportAsyncBytes || r.URL.Query().Get("async") == "true" {
+		go func() {
+			defer imports.release(job.ID)
+			runImport(imports.ctx, albumStore, jobs, job, rows)
+		}()
+		writeJSON(w, http.StatusAccepted, job)
+		log.Printf("📥 Import %s queued (%d bytes)", job.ID, len(body))
+		return
+	}
+	job, err = runImport(imports.ctx, albumStore, jobs, job, rows)
+	imports.release(job.ID)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// getImportJob reports an import's progress. A job left queued or running
+// by an instance that stopped without finishing it is marked failed here,
+// once it is clearly no longer making progress.
+func getImportJob(w http.ResponseWriter, r *http.Request) {
+	jobs, err := importJobsOf(albumStore)
+	if err != nil {
+		writeProblem(w, r, http.StatusNotImplemented, err.Error())
+		log.Println("🚧 Import job requested but the album store doesn't keep import jobs")
+		return
+	}
+	job, err := jobs.GetImportJob(r.Context(), r.PathValue("jobId"))
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	if !job.finished() && !imports.running(job.ID) && time.Since(job.UpdatedAt) > importJobStaleAfter {
+		job.finish(importFailed, "the import was interrupted before it finished")
+		if err := jobs.SaveImportJobProgress(r.Context(), job); err != nil {
+			respondError(w, r, err)
+			return
+		}
+		log.Printf("📥 Import %s marked failed: no progress since %s", job.ID, job.UpdatedAt.Format(time.RFC3339))
+	}
+	writeJSON(w, http.StatusOK, job)
+}
+
+// deleteImportJob asks a queued or running import to stop. It stops before
+// its next batch, so the 202 answer may not yet show it cancelled.
+func deleteImportJob(w http.ResponseWriter, r *http.Request) {
+	jobs, err := importJobsOf(albumStore)
+	if err != nil {
+		writeProblem(w, r, http.StatusNotImplemented, err.Error())
+		log.Println("🚧 Import cancel requested but the album store doesn't keep import jobs")
+		return
+	}
+	job, err := jobs.GetImportJob(r.Context(), r.PathValue("jobId"))
+	if err == nil && job.finished() {
+		err = errImportJobFinished
+	}
+	if err == nil {
+		err = jobs.CancelImportJob(r.Context(), job.ID)
+	}
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	job.CancelRequested = true
+	writeJSON(w, http.StatusAccepted, job)
+	log.Printf("📥 Import %s cancellation requested", job.ID)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// batchRecordingStore records the size of each CreateMany asked of an
+// InMemoryAlbumStore, and holds the first until release is closed when
+// release is set.
+type batchRecordingStore struct {
+	*InMemoryAlbumStore
+	mu      sync.Mutex
+	batches []int
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *batchRecordingStore) CreateMany(ctx context.Context, albums []album) ([]album, error) {
+	s.mu.Lock()
+	s.batches = append(s.batches, len(albums))
+	first := len(s.batches) == 1
+	s.mu.Unlock()
+	if first && s.release != nil {
+		close(s.started)
+		<-s.release
+	}
+	return s.InMemoryAlbumStore.CreateMany(ctx, albums)
+}
+
+// importCSV is a header and rows albums, each with its own title, with the
+// lines in bad replacing theirs.
+func importCSV(rows int, bad map[int]string) string {
+	var b strings.Builder
+	b.WriteString("title,artist,price,barcode\n")
+	for line := 2; line < rows+2; line++ {
+		if row, ok := bad[line]; ok {
+			b.WriteString(row + "\n")
+			continue
+		}
+		fmt.Fprintf(&b, "Album %d,John Coltrane,9.99,\n", line)
+	}
+	return b.String()
+}
+
+func TestImportBatches(t *testing.T) {
+	s := newTestServer(t)
+	store := &batchRecordingStore{InMemoryAlbumStore: s.albums}
+	albumStore = store
+
+	// Line 10 can't be parsed, and line 800 repeats line 700's barcode, which
+	// only the store sees, failing the second batch as a whole.
+	body := importCSV(1201, map[int]string{
+		10:  "Album 10,John Coltrane,abc,",
+		700: "Album 700,John Coltrane,9.99,036000291452",
+		800: "Album 800,John Coltrane,9.99,036000291452",
+	})
+	job := decodeBody[importJob](t, s.do(http.MethodPost, "/albums/import", body))
+	if job.State != importCompleted || job.RowsProcessed != 1201 || job.RowsCreated != 1199 || job.RowsFailed != 2 {
+		t.Fatalf("job = %+v, want 1199 of 1201 rows created", job)
+	}
+	want := []importFailure{{10, "price is not a number"}, {800, errBarcodeTaken.Error()}}
+	if fmt.Sprint(job.Failures) != fmt.Sprint(want) {
+		t.Errorf("failures %v, want %v", job.Failures, want)
+	}
+	if fmt.Sprint(store.batches) != "[500 500 200]" {
+		t.Errorf("batches of %v, want 500, 500 and 200", store.batches)
+	}
+	// The rest of the failed batch was created one album at a time.
+	if n := len(s.albums.byID); n != 1199 {
+		t.Errorf("%d albums in the store, want 1199", n)
+	}
+	if a, err := s.albums.GetByBarcode(context.Background(), "036000291452"); err != nil || a.Title != "Album 700" {
+		t.Errorf("barcode held by %+v, %v, want Album 700", a, err)
+	}
+
+	stored := decodeBody[importJob](t, s.do(http.MethodGet, "/imports/"+job.ID, ""))
+	if stored.State != importCompleted || stored.RowsCreated != 1199 || len(stored.Failures) != 2 {
+		t.Errorf("GET /imports/%s = %+v", job.ID, stored)
+	}
+}
+
+func TestImportCancelled(t *testing.T) {
+	s := newTestServer(t)
+	store := &batchRecordingStore{InMemoryAlbumStore: s.albums, started: make(chan struct{}), release: make(chan struct{})}
+	albumStore = store
+
+	w := s.do(http.MethodPost, "/albums/import?async=true", importCSV(1200, nil))
+	expectStatus(t, w, http.StatusAccepted)
+	job := decodeBody[importJob](t, w)
+	<-store.started
+	// The cancellation lands while the first batch is being written, which
+	// completes; the job stops before the next.
+	expectStatus(t, s.do(http.MethodDelete, "/imports/"+job.ID, ""), http.StatusAccepted)
+	close(store.release)
+	imports.wait()
+
+	job = decodeBody[importJob](t, s.do(http.MethodGet, "/imports/"+job.ID, ""))
+	if job.State != importCancelled || job.RowsProcessed != 500 || job.RowsCreated != 500 || !job.CancelRequested {
+		t.Errorf("job = %+v, want it cancelled after the first batch", job)
+	}
+	if len(store.batches) != 1 {
+		t.Errorf("batches of %v, want just the first", store.batches)
+	}
+	expectProblem(t, s.do(http.MethodDelete, "/imports/"+job.ID, ""), http.StatusConflict)
+}
@@ -0,0 +1,72 @@
+// Package buildinfo says which build of the service is running. build.sh
+// sets Version, Commit, and Date with -ldflags, for example
+//
+//	go build -ldflags "-X github.com/brentmzey/web-service-go/internal/buildinfo.Version=v1.4.0"
+//
+// and whatever it leaves unset is read from the module and VCS details the
+// go command embeds, or else reported as "dev".
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// Set with -ldflags -X.
+var (
+	Version string
+	Commit  string
+	Date    string // RFC 3339
+)
+
+// Unknown stands in for anything neither -ldflags nor the embedded build
+// information says.
+const Unknown = "dev"
+
+// Info describes a build.
+type Info struct {
+	Version   string
+	Commit    string
+	Date      string
+	GoVersion string
+}
+
+// Get returns the running build's Info.
+func Get() Info {
+	bi, _ := debug.ReadBuildInfo()
+	return resolve(Version, Commit, Date, bi)
+}
+
+// resolve fills in what -ldflags didn't set from bi, which may be nil.
+func resolve(version, commit, date string, bi *debug.BuildInfo) Info {
+	info := Info{Version: version, Commit: commit, Date: date, GoVersion: runtime.Version()}
+	if bi != nil {
+		if info.Version == "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		dirty := false
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.Date == "" {
+					info.Date = s.Value
+				}
+			case "vcs.modified":
+				dirty = s.Value == "true"
+			}
+		}
+		if dirty && commit == "" && info.Commit != "" {
+			info.Commit += "-dirty"
+		}
+	}
+	for _, field := range []*string{&info.Version, &info.Commit, &info.Date} {
+		if *field == "" {
+			*field = Unknown
+		}
+	}
+	return info
+}
@@ -0,0 +1,34 @@
+package buildinfo
+
+import (
+	"runtime"
+	"runtime/debug"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	vcs := &debug.BuildInfo{
+		Main: debug.Module{Version: "v1.3.0"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs.revision", Value: "0123abcd"},
+			{Key: "vcs.time", Value: "2026-03-01T09:00:00Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+	for _, tc := range []struct {
+		name                  string
+		version, commit, date string
+		bi                    *debug.BuildInfo
+		want                  Info
+	}{
+		{"no ldflags and no build info", "", "", "", nil, Info{Unknown, Unknown, Unknown, runtime.Version()}},
+		{"go run", "", "", "", &debug.BuildInfo{Main: debug.Module{Version: "(devel)"}}, Info{Unknown, Unknown, Unknown, runtime.Version()}},
+		{"build info only", "", "", "", vcs, Info{"v1.3.0", "0123abcd-dirty", "2026-03-01T09:00:00Z", runtime.Version()}},
+		{"ldflags win", "v1.4.0", "fedc9876", "2026-03-02T12:00:00Z", vcs, Info{"v1.4.0", "fedc9876", "2026-03-02T12:00:00Z", runtime.Version()}},
+		{"some ldflags", "v1.4.0", "", "", vcs, Info{"v1.4.0", "0123abcd-dirty", "2026-03-01T09:00:00Z", runtime.Version()}},
+	} {
+		if got := resolve(tc.version, tc.commit, tc.date, tc.bi); got != tc.want {
+			t.Errorf("%s: %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brentmzey/web-service-go/internal/clock"
+)
+
+var (
+	errJobNotFound = newCategorizedError(errNotFound, "job not found")
+	errJobRunning  = newCategorizedError(errConflict, "the job is already running")
+	// errJobsStopped is returned once shutdown has begun.
+	errJobsStopped = errors.New("the service is shutting down")
+)
+
+// jobFunc is one run of a background job. ctx is cancelled at shutdown; a
+// run should return soon after.
+type jobFunc func(ctx context.Context) error
+
+// job is a named piece of periodic work and the record of its runs. It runs
+// every interval, or when cron is set, at the minutes it matches.
+type job struct {
+	name     string
+	interval time.Duration
+	cron     *cronSchedule
+	run      jobFunc
+	running  atomic.Bool
+
+	mu     sync.Mutex
+	status jobStatus
+}
+
+// jobStatus is a job's entry in GET /admin/jobs.
+type jobStatus struct {
+	Name         string     `json:"name"`
+	Interval     string     `json:"interval,omitempty"`
+	Schedule     string     `json:"schedule,omitempty"` // a cron expression
+	Running      bool       `json:"running"`
+	Runs         int        `json:"runs"`
+	Failures     int        `json:"failures"`
+	Skipped      int        `json:"skipped"` // runs not started because the previous one was still going
+	LastRunAt    *time.Time `json:"lastRunAt,omitempty"`
+	LastDuration string     `json:"lastDuration,omitempty"`
+	LastError    string     `json:"lastError,omitempty"` // from the last run that failed
+	LastErrorAt  *time.Time `json:"lastErrorAt,omitempty"`
+	// LastResult is what the last run reported with setJobResult, such as
+	// how many rows it deleted.
+	LastResult map[string]int `json:"lastResult,omitempty"`
+}
+
+// jobScheduler runs the registered jobs, each on its own ticker from clock.
+// A run that comes due while the job's previous run is still going is
+// skipped rather than stacked up, and a run that panics is recorded as a
+// failure instead of taking the process down.
+type jobScheduler struct {
+	clock clock.Clock
+
+	mu      sync.Mutex
+	jobs    []*job
+	ctx     context.Context // set by start
+	stopped bool
+	wg      sync.WaitGroup // the tickers and every run in progress
+}
+
+func newJobScheduler(c clock.Clock) *jobScheduler {
+	return &jobScheduler{clock: c}
+}
+
+// scheduler runs the service's periodic maintenance. Jobs are registered in
+// main before it starts.
+var scheduler = newJobScheduler(serverClock)
+
+// register adds a job. It must be called before start.
+func (s *jobScheduler) register(name string, interval time.Duration, run jobFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, &job{name: name, interval: interval, run: run, status: jobStatus{Name: name, Interval: interval.String()}})
+}
+
+// registerCron adds a job that runs at the minutes schedule matches. It
+// must be called before start.
+func (s *jobScheduler) registerCron(name string, schedule *cronSchedule, run jobFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs = append(s.jobs, &job{name: name, cron: schedule, run: run, status: jobStatus{Name: name, Schedule: schedule.String()}})
+}
+
+// start begins ticking every job until ctx is cancelled. Runs get ctx too.
+// A cron job's ticker checks once a minute whether its next run is due.
+func (s *jobScheduler) start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx = ctx
+	for _, j := range s.jobs {
+		period, due := j.interval, time.Time{}
+		if j.cron != nil {
+			period, due = time.Minute, j.cron.next(s.clock.Now())
+		}
+		ticker := s.clock.NewTicker(period)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer ticker.Stop()
+			for {
+				select {
+				case now := <-ticker.C():
+					if j.cron != nil {
+						if now.Before(due) {
+							continue
+						}
+						due = j.cron.next(now)
+					}
+					if err := s.trigger(j); errors.Is(err, errJobRunning) {
+						log.Printf("⏭️ Skipped job %s: the previous run is still going", j.name)
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+}
+
+// wait stops new runs from starting and waits for the tickers and the runs
+// in progress to finish. Call it once ctx passed to start is cancelled.
+func (s *jobScheduler) wait() {
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+func (s *jobScheduler) find(name string) (*job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.name == name {
+			return j, nil
+		}
+	}
+	return nil, errJobNotFound
+}
+
+// trigger starts a run of j in the background. It returns errJobRunning,
+// counting a skipped run, if the last one hasn't finished.
+func (s *jobScheduler) trigger(j *job) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped || s.ctx == nil || s.ctx.Err() != nil {
+		return errJobsStopped
+	}
+	if !j.running.CompareAndSwap(false, true) {
+		j.mu.Lock()
+		j.status.Skipped++
+		j.mu.Unlock()
+		return errJobRunning
+	}
+	ctx := s.ctx
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer j.running.Store(false)
+		started := s.clock.Now()
+		var result map[string]int
+		err := j.safeRun(context.WithValue(ctx, jobResultKey{}, &result))
+		j.finish(started, s.clock.Since(started), result, err)
+	}()
+	return nil
+}
+
+type jobResultKey struct{}
+
+// setJobResult records what a run did, from the ctx the run was given, for
+// the job's status. Without a call the status has no result.
+func setJobResult(ctx context.Context, result map[string]int) {
+	if r, ok := ctx.Value(jobResultKey{}).(*map[string]int); ok {
+		*r = result
+	}
+}
+
+// safeRun runs j, turning a panic into an error.
+func (j *job) safeRun(ctx context.Context) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+			log.Printf("💥 Job %s panicked: %v\n%s", j.name, p, debug.Stack())
+		}
+	}()
+	return j.run(ctx)
+}
+
+func (j *job) finish(started time.Time, took time.Duration, result map[string]int, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	started = started.UTC()
+	j.status.Runs++
+	j.status.LastResult = result
+	j.status.LastRunAt = &started
+	j.status.LastDuration = took.String()
+	if err != nil {
+		j.status.Failures++
+		j.status.LastError = err.Error()
+		j.status.LastErrorAt = &started
+		log.Printf("🔥 Job %s failed after %s: %v", j.name, took, err)
+		return
+	}
+	debugf("Job %s finished in %s", j.name, took)
+}
+
+func (j *job) snapshot() jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := j.status
+	status.Running = j.running.Load()
+	return status
+}
+
+// snapshot lists every job's status in registration order.
+func (s *jobScheduler) snapshot() []jobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	statuses := make([]jobStatus, len(s.jobs))
+	for i, j := range s.jobs {
+		statuses[i] = j.snapshot()
+	}
+	return statuses
+}
+
+func getJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, scheduler.snapshot())
+}
+
+// postJobRun starts a run of the named job now, outside its schedule. The
+// answer is 202 with the job's status; the run's outcome shows in
+// GET /admin/jobs.
+func postJobRun(w http.ResponseWriter, r *http.Request) {
+	j, err := scheduler.find(r.PathValue("name"))
+	if err == nil {
+		err = scheduler.trigger(j)
+	}
+	if errors.Is(err, errJobsStopped) {
+		writeProblem(w, r, http.StatusServiceUnavailable, err.Error())
+		log.Printf("🛑 Run of job %s requested during shutdown", r.PathValue("name"))
+		return
+	}
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", resourceURL(r, jobsRoute))
+	writeJSON(w, http.StatusAccepted, j.snapshot())
+	log.Printf("⏱️ Job %s started by hand", j.name)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/internal/clock/clocktest"
+)
+
+// startTestScheduler starts s with clk's tickers, stopping it when t ends.
+func startTestScheduler(t *testing.T, s *jobScheduler) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.start(ctx)
+	t.Cleanup(func() {
+		cancel()
+		s.wait()
+	})
+}
+
+// waitForRuns waits for the named job to have finished runs runs and
+// returns its status.
+func waitForRuns(t *testing.T, s *jobScheduler, name string, runs int) jobStatus {
+	t.Helper()
+	j, err := s.find(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if status := j.snapshot(); status.Runs >= runs && !status.Running {
+			return status
+		}
+	}
+	t.Fatalf("job %s: %+v, want %d runs", name, j.snapshot(), runs)
+	return jobStatus{}
+}
+
+func TestJobScheduler(t *testing.T) {
+	clk := clocktest.New(testStart)
+	s := newJobScheduler(clk)
+	calls := 0
+	s.register("flaky", time.Minute, func(ctx context.Context) error {
+		calls++
+		setJobResult(ctx, map[string]int{"call": calls})
+		if calls == 2 {
+			return errors.New("the store went away")
+		}
+		return nil
+	})
+	s.register("panics", time.Minute, func(context.Context) error { panic("oops") })
+	startTestScheduler(t, s)
+
+	clk.Advance(30 * time.Second)
+	if status := s.snapshot()[0]; status.Runs != 0 {
+		t.Errorf("ran before its interval: %+v", status)
+	}
+	for i := 1; i <= 3; i++ {
+		clk.Advance(time.Minute)
+		waitForRuns(t, s, "flaky", i)
+		waitForRuns(t, s, "panics", i)
+	}
+
+	flaky := waitForRuns(t, s, "flaky", 3)
+	if flaky.Failures != 1 || flaky.LastError != "the store went away" || !flaky.LastErrorAt.Equal(testStart.Add(150*time.Second)) {
+		t.Errorf("flaky = %+v, want the second of three runs failed", flaky)
+	}
+	if !flaky.LastRunAt.Equal(testStart.Add(210*time.Second)) || flaky.LastResult["call"] != 3 {
+		t.Errorf("flaky = %+v, want the third run last", flaky)
+	}
+	// A panic fails the run and leaves the scheduler going.
+	if panics := waitForRuns(t, s, "panics", 3); panics.Failures != 3 || panics.LastError != "panic: oops" {
+		t.Errorf("panics = %+v, want three failed runs", panics)
+	}
+}
+
+func TestJobSchedulerSkipsOverlap(t *testing.T) {
+	clk := clocktest.New(testStart)
+	s := newJobScheduler(clk)
+	started, release := make(chan struct{}), make(chan struct{})
+	s.register("slow", time.Minute, func(context.Context) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+	startTestScheduler(t, s)
+
+	clk.Advance(time.Minute)
+	<-started
+	// The next two ticks come while the first run is still going.
+	j, _ := s.find("slow")
+	for i := 1; i <= 2; i++ {
+		clk.Advance(time.Minute)
+		for deadline := time.Now().Add(5 * time.Second); j.snapshot().Skipped < i && time.Now().Before(deadline); {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if err := s.trigger(j); !errors.Is(err, errJobRunning) {
+		t.Errorf("triggering a running job: %v, want errJobRunning", err)
+	}
+	close(release)
+	if status := waitForRuns(t, s, "slow", 1); status.Runs != 1 || status.Skipped != 3 {
+		t.Errorf("slow = %+v, want one run and three skipped", status)
+	}
+
+	clk.Advance(time.Minute)
+	<-started
+	if status := waitForRuns(t, s, "slow", 2); status.Skipped != 3 {
+		t.Errorf("slow = %+v, want the next tick run", status)
+	}
+}
+
+func TestJobSchedulerCron(t *testing.T) {
+	clk := clocktest.New(testStart.Add(-time.Minute)) // 11:59
+	s := newJobScheduler(clk)
+	schedule, err := parseCronSchedule("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.registerCron("hourly", schedule, func(context.Context) error { return nil })
+	startTestScheduler(t, s)
+	j, _ := s.find("hourly")
+
+	clk.Advance(time.Minute)
+	waitForRuns(t, s, "hourly", 1)
+	for runs := 2; runs <= 3; runs++ {
+		// The minutes up to the hour tick without a run. The ticker holds
+		// one tick, so it is given a moment to take it before the one on
+		// the hour.
+		clk.Advance(59 * time.Minute)
+		time.Sleep(10 * time.Millisecond)
+		if n := j.snapshot().Runs; n != runs-1 {
+			t.Fatalf("%d runs before the hour, want %d", n, runs-1)
+		}
+		clk.Advance(time.Minute)
+		waitForRuns(t, s, "hourly", runs)
+	}
+	if status := waitForRuns(t, s, "hourly", 3); status.Runs != 3 || !status.LastRunAt.Equal(testStart.Add(2*time.Hour)) || status.Schedule != "0 * * * *" {
+		t.Errorf("hourly = %+v, want a run at 12:00, 13:00 and 14:00", status)
+	}
+	if n := j.snapshot().Skipped; n != 0 {
+		t.Errorf("%d skipped runs", n)
+	}
+}
+
+func TestJobsEndpoints(t *testing.T) {
+	s := newTestServer(t)
+	previous := scheduler
+	t.Cleanup(func() { scheduler = previous })
+	scheduler = newJobScheduler(s.clock)
+	ran := make(chan struct{}, 1)
+	scheduler.register("purge", time.Hour, func(context.Context) error {
+		ran <- struct{}{}
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	scheduler.start(ctx)
+
+	w := s.admin(http.MethodPost, "/admin/jobs/purge/run", "")
+	expectStatus(t, w, http.StatusAccepted)
+	if loc := w.Header().Get("Location"); loc != "http://example.com/admin/jobs" {
+		t.Errorf("Location = %q", loc)
+	}
+	<-ran
+	waitForRuns(t, scheduler, "purge", 1)
+	jobs := decodeBody[[]jobStatus](t, s.admin(http.MethodGet, "/admin/jobs", ""))
+	if len(jobs) != 1 || jobs[0].Name != "purge" || jobs[0].Runs != 1 || jobs[0].Interval != "1h0m0s" {
+		t.Errorf("GET /admin/jobs = %+v", jobs)
+	}
+	expectProblem(t, s.admin(http.MethodPost, "/admin/jobs/nope/run", ""), http.StatusNotFound)
+
+	// Once shutdown begins nothing more starts.
+	cancel()
+	scheduler.wait()
+	expectProblem(t, s.admin(http.MethodPost, "/admin/jobs/purge/run", ""), http.StatusServiceUnavailable)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// The profiles a client can ask for in the profile parameter of Accept, as
+// in Accept: application/json; profile="snake_case nulls". A profile may
+// list both, separated by a space.
+const (
+	jsonProfileSnakeCase = "snake_case"
+	jsonProfileNulls     = "nulls"
+)
+
+// jsonStyle is how a JSON response is written. The zero jsonStyle is the
+// API's own: camelCase names, with empty optional fields left out.
+type jsonStyle struct {
+	snakeCase bool // names in snake_case
+	nulls     bool // empty optional fields written as null
+}
+
+// requestJSONStyle reads the profile of the first application/json entry of
+// r's Accept header that has one. Profiles it doesn't know are ignored.
+func requestJSONStyle(r *http.Request) jsonStyle {
+	var style jsonStyle
+	for _, entry := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(entry))
+		if err != nil || mediaType != "application/json" || params["profile"] == "" {
+			continue
+		}
+		for _, profile := range strings.Fields(params["profile"]) {
+			switch profile {
+			case jsonProfileSnakeCase:
+				style.snakeCase = true
+			case jsonProfileNulls:
+				style.nulls = true
+			}
+		}
+		break
+	}
+	return style
+}
+
+// contentType is the Content-Type of a response written in s: application/json
+// with the profiles s follows.
+func (s jsonStyle) contentType() string {
+	var profiles []string
+	if s.snakeCase {
+		profiles = append(profiles, jsonProfileSnakeCase)
+	}
+	if s.nulls {
+		profiles = append(profiles, jsonProfileNulls)
+	}
+	if len(profiles) == 0 {
+		return "application/json"
+	}
+	return mime.FormatMediaType("application/json", map[string]string{"profile": strings.Join(profiles, " ")})
+}
+
+func (s jsonStyle) name(name string) string {
+	if s.snakeCase {
+		return snakeCase(name)
+	}
+	return name
+}
+
+var jsonMarshalerType = reflect.TypeFor[json.Marshaler]()
+
+// encode writes v as encoding/json would, with the names and empty fields
+// of s. The names are the json tags of the types, so every response type is
+// written in either style without a copy of it. The keys of a
+// map[string]interface{} are names too and are converted; the keys of any
+// other map, such as an album's metadata, are data and are left as they
+// are. A value with a MarshalJSON of its own, like a price or a time, is
+// written as it writes itself.
+func (s jsonStyle) encode(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		buf.WriteString("null")
+		return nil
+	}
+	if v.Type().Implements(jsonMarshalerType) || v.CanAddr() && reflect.PointerTo(v.Type()).Implements(jsonMarshalerType) {
+		if (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface || v.Kind() == reflect.Map || v.Kind() == reflect.Slice) && v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		if v.CanAddr() && !v.Type().Implements(jsonMarshalerType) {
+			v = v.Addr()
+		}
+		return s.marshal(buf, v)
+	}
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		return s.encode(buf, v.Elem())
+	case reflect.Struct:
+		buf.WriteByte('{')
+		first := true
+		if err := s.encodeFields(buf, v, &first); err != nil {
+			return err
+		}
+		buf.WriteByte('}')
+		return nil
+	case reflect.Map:
+		if v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			return s.marshal(buf, v)
+		}
+		rename := v.Type().Elem().Kind() == reflect.Interface
+		keys := make(map[string]reflect.Value, v.Len())
+		names := make([]string, 0, v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			name := iter.Key().String()
+			if rename {
+				name = s.name(name)
+			}
+			keys[name] = iter.Value()
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		buf.WriteByte('{')
+		for i, name := range names {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			s.marshal(buf, reflect.ValueOf(name))
+			buf.WriteByte(':')
+			if err := s.encode(buf, keys[name]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			buf.WriteString("null")
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return s.marshal(buf, v)
+		}
+		buf.WriteByte('[')
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := s.encode(buf, v.Index(i)); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	}
+	return s.marshal(buf, v)
+}
+
+// encodeFields writes the fields of the struct v, and those of the structs
+// it embeds without a name, as members of the object being written.
+func (s jsonStyle) encodeFields(buf *bytes.Buffer, v reflect.Value, first *bool) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || !f.IsExported() && !f.Anonymous {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		fv := v.Field(i)
+		if f.Anonymous && name == "" {
+			if fv.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				if err := s.encodeFields(buf, fv, first); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		empty := hasJSONOption(opts, "omitempty") && emptyJSONValue(fv) || hasJSONOption(opts, "omitzero") && fv.IsZero()
+		if empty && !s.nulls {
+			continue
+		}
+		if !*first {
+			buf.WriteByte(',')
+		}
+		*first = false
+		s.marshal(buf, reflect.ValueOf(s.name(name)))
+		buf.WriteByte(':')
+		if empty {
+			buf.WriteString("null")
+			continue
+		}
+		if err := s.encode(buf, fv); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s jsonStyle) marshal(buf *bytes.Buffer, v reflect.Value) error {
+	data, err := json.Marshal(v.Interface())
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+	return nil
+}
+
+func hasJSONOption(opts, option string) bool {
+	for _, o := range strings.Split(opts, ",") {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// emptyJSONValue is the emptiness omitempty leaves a field out for.
+func emptyJSONValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Interface, reflect.Pointer:
+		return v.IsZero()
+	}
+	return false
+}
+
+// snakeCase turns a camelCase name into snake_case: createdAt is
+// created_at, and albumID is album_id.
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (!unicode.IsUpper(runes[i-1]) || i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// camelCase turns a snake_case name into camelCase: created_at is
+// createdAt.
+func camelCase(name string) string {
+	parts := strings.Split(name, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// decodeAlbumJSON decodes the body of an album write into v, taking the
+// albums' field names in snake_case as well as in camelCase: the body a
+// client got from a snake_case response can be sent back as it is.
+func decodeAlbumJSON(body io.Reader, v interface{}) error {
+	var raw json.RawMessage
+	if err := json.NewDecoder(body).Decode(&raw); err != nil {
+		return err
+	}
+	if bytes.IndexByte(raw, '_') < 0 {
+		return json.Unmarshal(raw, v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	data, err := json.Marshal(camelCaseKeys(doc))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// camelCaseKeys converts the keys of every object in doc to camelCase,
+// except within metadata, whose keys are the client's own.
+func camelCaseKeys(doc interface{}) interface{} {
+	switch doc := doc.(type) {
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(doc))
+		for key, value := range doc {
+			key = camelCase(key)
+			if key != "metadata" {
+				value = camelCaseKeys(value)
+			}
+			converted[key] = value
+		}
+		return converted
+	case []interface{}:
+		for i, item := range doc {
+			doc[i] = camelCaseKeys(item)
+		}
+	}
+	return doc
+}
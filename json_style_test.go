@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// styleFixture is an album with some optional fields empty, and a metadata
+// key in snake_case that no style may touch.
+var styleFixture = newTestAlbum(withID("7d3c1a5e-2f4b-4c8e-9a61-3b5d7e9f1c2a"), func(a *album) {
+	a.Slug = "blue-train-john-coltrane"
+	a.Genre = ""
+	a.Metadata = map[string]string{"catalog_number": "BLP 1577"}
+	a.Stock = 3
+	a.CreatedAt = testStart
+	a.UpdatedAt = testStart.Add(time.Hour)
+})
+
+const camelCaseSnapshot = `{
+  "id": "7d3c1a5e-2f4b-4c8e-9a61-3b5d7e9f1c2a",
+  "title": "Blue Train",
+  "artist": "John Coltrane",
+  "price": 56.99,
+  "slug": "blue-train-john-coltrane",
+  "year": 1957,
+  "metadata": {
+    "catalog_number": "BLP 1577"
+  },
+  "stock": 3,
+  "createdAt": "2026-03-02T12:00:00Z",
+  "updatedAt": "2026-03-02T13:00:00Z"
+}`
+
+const snakeCaseNullsSnapshot = `{
+  "id": "7d3c1a5e-2f4b-4c8e-9a61-3b5d7e9f1c2a",
+  "title": "Blue Train",
+  "artist": "John Coltrane",
+  "price": 56.99,
+  "genre": null,
+  "slug": "blue-train-john-coltrane",
+  "barcode": null,
+  "year": 1957,
+  "tracks": null,
+  "metadata": {
+    "catalog_number": "BLP 1577"
+  },
+  "stock": 3,
+  "available_from": null,
+  "available_until": null,
+  "created_at": "2026-03-02T12:00:00Z",
+  "updated_at": "2026-03-02T13:00:00Z"
+}`
+
+func TestJSONStyleSnapshots(t *testing.T) {
+	for _, tc := range []struct {
+		style jsonStyle
+		want  string
+	}{
+		{jsonStyle{}, camelCaseSnapshot},
+		{jsonStyle{snakeCase: true, nulls: true}, snakeCaseNullsSnapshot},
+		// Each option on its own is the one change from the default.
+		{jsonStyle{snakeCase: true}, strings.NewReplacer(`"createdAt"`, `"created_at"`, `"updatedAt"`, `"updated_at"`).Replace(camelCaseSnapshot)},
+		{jsonStyle{nulls: true}, strings.NewReplacer(`"available_from"`, `"availableFrom"`, `"available_until"`, `"availableUntil"`, `"created_at"`, `"createdAt"`, `"updated_at"`, `"updatedAt"`).Replace(snakeCaseNullsSnapshot)},
+	} {
+		var buf bytes.Buffer
+		if err := encodeJSON(&buf, tc.style, styleFixture); err != nil {
+			t.Fatal(err)
+		}
+		// As writeJSON sends it, without the encoder's newline.
+		if got := strings.TrimSuffix(buf.String(), "\n"); got != tc.want {
+			t.Errorf("%+v:\n%s\nwant\n%s", tc.style, got, tc.want)
+		}
+	}
+}
+
+func TestRequestJSONStyle(t *testing.T) {
+	for _, tc := range []struct {
+		accept      string
+		want        jsonStyle
+		contentType string
+	}{
+		{"", jsonStyle{}, "application/json"},
+		{"application/json", jsonStyle{}, "application/json"},
+		{`application/json; profile="snake_case nulls"`, jsonStyle{true, true}, `application/json; profile="snake_case nulls"`},
+		{`application/json; profile=nulls`, jsonStyle{nulls: true}, "application/json; profile=nulls"},
+		{`application/json; profile="nulls yaml"`, jsonStyle{nulls: true}, "application/json; profile=nulls"},
+		{`text/html, application/json; profile=snake_case, application/json; profile=nulls`, jsonStyle{snakeCase: true}, "application/json; profile=snake_case"},
+		{`application/xml; profile=snake_case`, jsonStyle{}, "application/json"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/albums", nil)
+		req.Header.Set("Accept", tc.accept)
+		got := requestJSONStyle(req)
+		if got != tc.want || got.contentType() != tc.contentType {
+			t.Errorf("%q: %+v, %s, want %+v, %s", tc.accept, got, got.contentType(), tc.want, tc.contentType)
+		}
+	}
+}
+
+func TestSnakeCase(t *testing.T) {
+	for camel, snake := range map[string]string{
+		"id":             "id",
+		"createdAt":      "created_at",
+		"availableUntil": "available_until",
+		"albumID":        "album_id",
+		"averagePriceMs": "average_price_ms",
+		"ID":             "id",
+		"URLPath":        "url_path",
+	} {
+		if got := snakeCase(camel); got != snake {
+			t.Errorf("snakeCase(%s) = %s, want %s", camel, got, snake)
+		}
+	}
+	for _, name := range []string{"id", "createdAt", "availableUntil", "averagePriceMs"} {
+		if got := camelCase(snakeCase(name)); got != name {
+			t.Errorf("%s came back as %s", name, got)
+		}
+	}
+}
+
+// TestJSONStyleRoundTrip sends albums back as they were received in each
+// style and checks that nothing changes.
+func TestJSONStyleRoundTrip(t *testing.T) {
+	s := newTestServer(t)
+	created := s.create(newTestAlbum(withBarcode("036000291452"), func(a *album) {
+		a.Tracks = []string{"Blue Train", "Moment's Notice"}
+		a.Metadata = map[string]string{"catalog_number": "BLP 1577"}
+		from := testStart.Add(-24 * time.Hour)
+		a.AvailableFrom = &from
+	}))
+	for _, profile := range []string{"", "snake_case", "nulls", "snake_case nulls"} {
+		accept := "application/json"
+		if profile != "" {
+			accept += `; profile="` + profile + `"`
+		}
+		w := s.do(http.MethodGet, "/albums/"+created.ID, "", "Accept", accept)
+		if ct := w.Header().Get("Content-Type"); (profile == "") != (ct == "application/json") {
+			t.Errorf("%q: Content-Type %s", profile, ct)
+		}
+		expectStatus(t, s.do(http.MethodPut, "/albums/"+created.ID, w.Body.String()), http.StatusOK)
+		got := decodeBody[album](t, s.do(http.MethodGet, "/albums/"+created.ID, ""))
+		got.UpdatedAt = created.UpdatedAt
+		if albumJSON(got) != albumJSON(created) {
+			t.Errorf("%q sent back changed the album to\n%s\nfrom\n%s", profile, albumJSON(got), albumJSON(created))
+		}
+	}
+
+	// A snake_case patch is taken too, and a nulls one clears the field.
+	patched := decodeBody[album](t, s.do(http.MethodPatch, "/albums/"+created.ID, `{"available_from": null, "metadata": {"catalog_number": "BLP-1577"}}`))
+	if patched.AvailableFrom != nil || patched.Metadata["catalog_number"] != "BLP-1577" {
+		t.Errorf("after a snake_case patch: %+v", patched)
+	}
+}
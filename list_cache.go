@@ -0,0 +1,93 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// generationalStore is implemented by album stores that count their own
+// mutations. The counter must change whenever anything List could return
+// changes. Stores shared with other processes (the database backends) can't
+// promise that, so their listings are never cached.
+type generationalStore interface {
+	Generation() uint64
+}
+
+const albumListCacheSize = 128
+
+// albumListCache holds marshaled GET /albums responses keyed by filter.
+// Every entry belongs to the store generation it was built from; the first
+// lookup after a mutation sees a newer generation and drops the lot.
+type albumListCache struct {
+	mu         sync.Mutex
+	generation uint64
+	entries    map[string]cachedList
+	order      []string // insertion order, for evicting the oldest entry
+}
+
+// cachedList is a marshaled page of a listing, the size of the whole
+// listing, and its Last-Modified time.
+type cachedList struct {
+	body         []byte
+	total        int
+	lastModified time.Time
+}
+
+var albumListResponses = &albumListCache{}
+
+func (c *albumListCache) get(generation uint64, key string) (cachedList, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return cachedList{}, false
+	}
+	entry, ok := c.entries[key]
+	return entry, ok
+}
+
+// put stores entry for key. generation must have been read before the listing
+// was fetched, so a mutation racing the fetch can only make the entry look
+// older than it is, never newer.
+func (c *albumListCache) put(generation uint64, key string, entry cachedList) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation || c.entries == nil {
+		if generation < c.generation {
+			return
+		}
+		c.generation = generation
+		c.entries = make(map[string]cachedList)
+		c.order = nil
+	}
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	if len(c.order) >= albumListCacheSize {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.entries[key] = entry
+	c.order = append(c.order, key)
+}
+
+// cacheKey normalizes the filter so equivalent queries share an entry, in
+// the same collation.
+// AvailableAt only counts as set or not: the store's generation changes as
+// albums pass their window edges.
+func (f AlbumFilter) cacheKey() string {
+	price := func(p *float64) string {
+		if p == nil {
+			return ""
+		}
+		return strconv.FormatFloat(*p, 'g', -1, 64)
+	}
+	var metadata []string
+	for _, key := range slices.Sorted(maps.Keys(f.Metadata)) {
+		metadata = append(metadata, key+"="+f.Metadata[key])
+	}
+	return strings.Join([]string{strings.ToLower(f.Artist), strings.ToLower(f.Genre), price(f.MinPrice), price(f.MaxPrice), strings.Join(f.search().terms, " "), strings.Join(metadata, "\x01"), strconv.FormatBool(f.AvailableAt.IsZero()), f.Collation.String()}, "\x00")
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// ungenerationalStore hides the generation of the store it wraps, as the
+// database stores have none, so its listings are never cached.
+type ungenerationalStore struct{ AlbumStore }
+
+func TestListCacheSeesWrites(t *testing.T) {
+	s := newTestServer(t)
+	s.create(newTestAlbum())
+	expectStatus(t, s.do(http.MethodGet, "/albums", ""), http.StatusOK)
+
+	a := s.create(newTestAlbum(withTitle("Giant Steps")))
+	list := decodeBody[[]album](t, s.do(http.MethodGet, "/albums", ""))
+	if len(list) != 2 || list[1].ID != a.ID {
+		t.Fatalf("GET after a POST = %d albums, want the new one listed", len(list))
+	}
+
+	expectStatus(t, s.do(http.MethodPatch, "/albums/"+a.ID, `{"title": "Naima"}`), http.StatusOK)
+	if list := decodeBody[[]album](t, s.do(http.MethodGet, "/albums", "")); list[1].Title != "Naima" {
+		t.Errorf("GET after a PATCH lists %q", list[1].Title)
+	}
+
+	// Listings of other filters are cached apart, and dropped together.
+	jazz := decodeBody[[]album](t, s.do(http.MethodGet, "/albums?genre=jazz", ""))
+	s.create(newTestAlbum(withTitle("Lush Life")))
+	if again := decodeBody[[]album](t, s.do(http.MethodGet, "/albums?genre=jazz", "")); len(again) != len(jazz)+1 {
+		t.Errorf("the filtered listing has %d albums after a create, want %d", len(again), len(jazz)+1)
+	}
+}
+
+func TestListCacheGeneration(t *testing.T) {
+	var c albumListCache
+	c.put(2, "k", cachedList{total: 2})
+	if _, ok := c.get(2, "k"); !ok {
+		t.Fatal("miss for the generation just stored")
+	}
+	if _, ok := c.get(3, "k"); ok {
+		t.Error("hit for a newer generation")
+	}
+	// A listing fetched before a mutation must not replace newer entries.
+	c.put(3, "k", cachedList{total: 3})
+	c.put(2, "k", cachedList{total: 2})
+	if entry, ok := c.get(3, "k"); !ok || entry.total != 3 {
+		t.Errorf("entry = %+v, %v after a stale put", entry, ok)
+	}
+}
+
+// BenchmarkGetAlbums lists a 10k-album catalog with and without the
+// marshaled listing cache.
+func BenchmarkGetAlbums(b *testing.B) {
+	newTestServer(b, func(c *Config) { c.AlbumsPageSize = 10000; c.AlbumsMaxPageSize = 10000 })
+	store, _ := newSizedAlbumStore(b, 10000)
+	for _, bc := range []struct {
+		name  string
+		store AlbumStore
+	}{
+		{"uncached", ungenerationalStore{store}},
+		{"cached", store},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			albumStore = bc.store
+			req := httptest.NewRequest(http.MethodGet, "/albums?limit=10000", nil)
+			for b.Loop() {
+				w := httptest.NewRecorder()
+				getAlbums(w, req.WithContext(context.Background()))
+				if w.Code != http.StatusOK {
+					b.Fatalf("status %d: %s", w.Code, w.Body)
+				}
+			}
+			b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unixSocketPrefix marks a LISTEN_ADDR or ADMIN_ADDR that names a unix
+// domain socket, as in unix:/run/web-service-go.sock.
+const unixSocketPrefix = "unix:"
+
+// sdListenFdsStart is the first file descriptor systemd passes, as in
+// sd_listen_fds(3).
+const sdListenFdsStart = 3
+
+// openListeners returns a listener for each server, in order. Sockets passed
+// by systemd socket activation are used first, the first for the API and the
+// second for the admin listener; any server left over listens on its own
+// address.
+func openListeners(cfg *Config, servers []*http.Server, lookupEnv func(string) (string, bool)) ([]net.Listener, error) {
+	activated, err := systemdListeners(lookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	if len(activated) > len(servers) {
+		closeListeners(activated)
+		return nil, fmt.Errorf("systemd passed %d sockets but only %d listeners are configured", len(activated), len(servers))
+	}
+	listeners := activated
+	for _, srv := range servers[len(activated):] {
+		l, err := listen(srv.Addr, cfg.UnixSocketMode)
+		if err != nil {
+			closeListeners(listeners)
+			return nil, err
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+func closeListeners(listeners []net.Listener) {
+	for _, l := range listeners {
+		l.Close()
+	}
+}
+
+// listen opens a TCP address, or a unix socket for a unix: address. A socket
+// file left behind by an earlier run is removed first, unless a process is
+// still accepting on it. The socket gets mode and is removed again when the
+// listener closes.
+func listen(addr, mode string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, unixSocketPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	perm, _ := parseSocketMode(mode) // validated with the rest of the config
+	if err := os.Chmod(path, perm); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("setting permissions on %s: %w", path, err)
+	}
+	return l, nil
+}
+
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("another process is listening on %s", path)
+	}
+	log.Printf("🧹 Removing stale socket %s", path)
+	return os.Remove(path)
+}
+
+// parseSocketMode parses UNIX_SOCKET_MODE, an octal permission like 0660.
+func parseSocketMode(mode string) (os.FileMode, error) {
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0o777 {
+		return 0, fmt.Errorf("must be octal permissions like 0660, got %q", mode)
+	}
+	return os.FileMode(perm), nil
+}
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// following sd_listen_fds(3): LISTEN_FDS sockets starting at descriptor 3,
+// meant for this process when LISTEN_PID is its pid. The variables are
+// cleared so child processes don't take the sockets for their own.
+func systemdListeners(lookupEnv func(string) (string, bool)) ([]net.Listener, error) {
+	pid, _ := lookupEnv("LISTEN_PID")
+	fds, _ := lookupEnv("LISTEN_FDS")
+	if pid == "" || fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("LISTEN_FDS must be a count of sockets, got %q", fds)
+	}
+	var listeners []net.Listener
+	for fd := sdListenFdsStart; fd < sdListenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close() // FileListener holds its own duplicate
+		if err != nil {
+			closeListeners(listeners)
+			return nil, fmt.Errorf("systemd socket %d: %w", fd, err)
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners, nil
+}
+
+// listenerURL describes where l accepts connections, for the startup log.
+func listenerURL(l net.Listener, tls bool) string {
+	if l.Addr().Network() == "unix" {
+		return unixSocketPrefix + l.Addr().String()
+	}
+	if tls {
+		return "https://" + l.Addr().String()
+	}
+	return "http://" + l.Addr().String()
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// startServers serves newServers(s.cfg) on listeners of their own, with TLS
+// if it is configured, and shuts them all down when t ends, failing t if
+// serve doesn't return then.
+func startServers(t *testing.T, s *testServer) []string {
+	t.Helper()
+	servers := newServers(s.cfg)
+	tlsConfig, err := setupTLS(s.cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, srv := range servers {
+		srv.TLSConfig = tlsConfig
+	}
+	listeners, err := openListeners(s.cfg, servers, testEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		serve(servers, listeners)
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, srv := range servers {
+			if err := srv.Shutdown(ctx); err != nil {
+				t.Errorf("shutting down %s: %v", srv.Addr, err)
+			}
+		}
+		<-served
+	})
+	urls := make([]string, len(listeners))
+	for i, l := range listeners {
+		urls[i] = listenerURL(l, tlsConfig != nil)
+	}
+	return urls
+}
+
+// get sends an unauthenticated GET, or an admin's with admin set.
+func get(t *testing.T, client *http.Client, url string, admin bool) int {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admin {
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestAdminListener(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.ListenAddr = "127.0.0.1:0"
+		cfg.AdminAddr = "localhost:0"
+	})
+	urls := startServers(t, s)
+	if len(urls) != 2 {
+		t.Fatalf("%d listeners, want the API's and the admin one", len(urls))
+	}
+	api, admin := urls[0], urls[1]
+
+	for _, tc := range []struct {
+		path    string
+		admin   bool
+		onAPI   int
+		onAdmin int
+	}{
+		{"/albums", false, http.StatusOK, http.StatusNotFound},
+		{"/healthz", false, http.StatusNotFound, http.StatusOK},
+		{"/readyz", false, http.StatusNotFound, http.StatusOK},
+		{"/metrics", false, http.StatusNotFound, http.StatusOK},
+		{"/admin/features", true, http.StatusNotFound, http.StatusOK},
+		{"/admin/features", false, http.StatusNotFound, http.StatusUnauthorized},
+	} {
+		if got := get(t, http.DefaultClient, api+tc.path, tc.admin); got != tc.onAPI {
+			t.Errorf("GET %s on the API listener: %d, want %d", tc.path, got, tc.onAPI)
+		}
+		if got := get(t, http.DefaultClient, admin+tc.path, tc.admin); got != tc.onAdmin {
+			t.Errorf("GET %s on the admin listener: %d, want %d", tc.path, got, tc.onAdmin)
+		}
+	}
+
+	// The admin listener isn't rate limited; the API is.
+	limited := *s.cfg
+	limited.RateLimitRequests = 3
+	liveConfig.Store(&limited)
+	for i := 0; i < 10; i++ {
+		if got := get(t, http.DefaultClient, admin+"/metrics", false); got != http.StatusOK {
+			t.Fatalf("GET /metrics %d on the admin listener: %d, want 200", i+1, got)
+		}
+	}
+	var throttled bool
+	for i := 0; i < 10 && !throttled; i++ {
+		throttled = get(t, http.DefaultClient, api+"/albums", false) == http.StatusTooManyRequests
+	}
+	if !throttled {
+		t.Error("the API listener never rate limited")
+	}
+}
+
+func TestNoAdminListener(t *testing.T) {
+	s := newTestServer(t)
+	if n := len(newServers(s.cfg)); n != 1 {
+		t.Fatalf("%d servers without ADMIN_ADDR, want 1", n)
+	}
+	// The operational endpoints stay on the API, except the profiler.
+	expectStatus(t, s.do(http.MethodGet, "/healthz", ""), http.StatusOK)
+	expectStatus(t, s.do(http.MethodGet, "/metrics", ""), http.StatusOK)
+	expectStatus(t, s.admin(http.MethodGet, "/admin/export", ""), http.StatusOK)
+	expectStatus(t, s.do(http.MethodGet, "/debug/pprof/", ""), http.StatusNotFound)
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.sock")
+	// A socket file left behind by a crash is cleared at startup.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.ListenAddr = unixSocketPrefix + path
+		cfg.UnixSocketMode = "0640"
+	})
+	urls := startServers(t, s)
+	if urls[0] != unixSocketPrefix+path {
+		t.Errorf("listening on %s, want %s", urls[0], unixSocketPrefix+path)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o640 {
+		t.Errorf("socket mode %o, want 640", perm)
+	}
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	if got := get(t, client, "http://albums/albums", false); got != http.StatusOK {
+		t.Fatalf("GET /albums over the socket: %d, want 200", got)
+	}
+
+	// Clients on the socket are told apart by the X-Real-IP the proxy
+	// sets, or are all "unix".
+	limited := *s.cfg
+	limited.RateLimitRequests = 2
+	liveConfig.Store(&limited)
+	status := func(realIP string) int {
+		req, _ := http.NewRequest(http.MethodGet, "http://albums/albums", nil)
+		if realIP != "" {
+			req.Header.Set("X-Real-IP", realIP)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	for i := 0; i < 2; i++ {
+		status("203.0.113.7")
+	}
+	if got := status("203.0.113.7"); got != http.StatusTooManyRequests {
+		t.Errorf("a third request from 203.0.113.7: %d, want 429", got)
+	}
+	if got := status("203.0.113.8"); got != http.StatusOK {
+		t.Errorf("the first request from 203.0.113.8: %d, want 200", got)
+	}
+	if got := status(""); got != http.StatusOK {
+		t.Errorf("a request without X-Real-IP: %d, want 200", got)
+	}
+}
+
+func TestUnixSocketInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.sock")
+	l, err := listen(unixSocketPrefix+path, "0660")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	if _, err := listen(unixSocketPrefix+path, "0660"); err == nil {
+		t.Error("took over a socket another process is listening on")
+	}
+	l.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("the socket is still there after closing: %v", err)
+	}
+}
+
+func TestSystemdListeners(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	for _, tc := range []struct {
+		env     map[string]string
+		wantErr bool
+	}{
+		{map[string]string{}, false},
+		{map[string]string{"LISTEN_PID": "1", "LISTEN_FDS": "1"}, false}, // another process's
+		{map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "0"}, false},
+		{map[string]string{"LISTEN_PID": pid, "LISTEN_FDS": "two"}, true},
+	} {
+		listeners, err := systemdListeners(testEnv(tc.env))
+		if (err != nil) != tc.wantErr || len(listeners) != 0 {
+			t.Errorf("%v: %d listeners, %v", tc.env, len(listeners), err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultMaxInFlight = 256
+	overloadRetryAfter = "1" // seconds
+)
+
+// inFlightLimiter caps the number of requests being served at once. A request
+// arriving at the cap waits up to queueTimeout for a slot and is otherwise
+// shed with 503, so a spike degrades into fast rejections rather than every
+// request slowing down together.
+type inFlightLimiter struct {
+	slots        chan struct{}
+	queueTimeout time.Duration
+}
+
+// Counters reported by /metrics. They're updated concurrently, so always go
+// through sync/atomic.
+var (
+	inFlightRequests  int64
+	totalOverloadShed int64
+)
+
+func newInFlightLimiter(max int, queueTimeout time.Duration) *inFlightLimiter {
+	return &inFlightLimiter{slots: make(chan struct{}, max), queueTimeout: queueTimeout}
+}
+
+// acquire takes a slot, waiting up to the queue timeout or until the client
+// goes away.
+func (l *inFlightLimiter) acquire(r *http.Request) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.queueTimeout <= 0 {
+		return false
+	}
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (l *inFlightLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isHealthCheck(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !l.acquire(r) {
+			atomic.AddInt64(&totalOverloadShed, 1)
+			w.Header().Set("Retry-After", overloadRetryAfter)
+			writeProblem(w, r, http.StatusServiceUnavailable, "server is overloaded, please retry")
+			log.Printf("🚦 Shed %s %s: %d requests in flight", r.Method, r.URL.Path, cap(l.slots))
+			return
+		}
+		atomic.AddInt64(&inFlightRequests, 1)
+		defer func() {
+			atomic.AddInt64(&inFlightRequests, -1)
+			<-l.slots
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setupLoadShedding builds the in-flight limiter from MAX_IN_FLIGHT (0
+// disables it) and IN_FLIGHT_QUEUE_TIMEOUT (how long a request may wait for
+// a slot; 0 rejects immediately).
+func setupLoadShedding(cfg *Config) func(http.Handler) http.Handler {
+	if cfg.MaxInFlight == 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	return newInFlightLimiter(cfg.MaxInFlight, cfg.InFlightQueueTimeout).middleware
+}
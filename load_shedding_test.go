@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingHandler holds every request until release is closed, counting
+// those inside it and the most there ever were at once.
+type blockingHandler struct {
+	release     chan struct{}
+	entered     chan struct{}
+	inside, max atomic.Int32
+}
+
+func newBlockingHandler() *blockingHandler {
+	return &blockingHandler{release: make(chan struct{}), entered: make(chan struct{}, 100)}
+}
+
+func (h *blockingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := h.inside.Add(1)
+	for {
+		m := h.max.Load()
+		if n <= m || h.max.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	h.entered <- struct{}{}
+	<-h.release
+	h.inside.Add(-1)
+}
+
+// serveAsync serves a GET of path on h in the background; the channel
+// receives the answer.
+func serveAsync(h http.Handler, path string) <-chan *httptest.ResponseRecorder {
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		done <- w
+	}()
+	return done
+}
+
+func TestInFlightLimiterSheds(t *testing.T) {
+	newTestServer(t)
+	inner := newBlockingHandler()
+	h := newInFlightLimiter(2, 0).middleware(inner)
+	first, second := serveAsync(h, "/albums"), serveAsync(h, "/albums")
+	<-inner.entered
+	<-inner.entered
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/albums", nil))
+	expectProblem(t, w, http.StatusServiceUnavailable)
+	if w.Header().Get("Retry-After") != overloadRetryAfter {
+		t.Errorf("Retry-After = %q", w.Header().Get("Retry-After"))
+	}
+
+	// Health checks are never shed.
+	health := serveAsync(h, "/healthz")
+	<-inner.entered
+
+	close(inner.release)
+	for _, done := range []<-chan *httptest.ResponseRecorder{first, second, health} {
+		expectStatus(t, <-done, http.StatusOK)
+	}
+}
+
+func TestInFlightLimiterQueues(t *testing.T) {
+	newTestServer(t)
+	inner := newBlockingHandler()
+	h := newInFlightLimiter(3, time.Minute).middleware(inner)
+
+	var answers []<-chan *httptest.ResponseRecorder
+	for i := 0; i < 10; i++ {
+		answers = append(answers, serveAsync(h, "/albums"))
+	}
+	for i := 0; i < 3; i++ {
+		<-inner.entered
+	}
+	select {
+	case <-inner.entered:
+		t.Fatal("a fourth request got in past the cap")
+	case <-time.After(20 * time.Millisecond):
+	}
+	// Freeing the slots lets the queued requests through, never more than
+	// three at once.
+	close(inner.release)
+	var wg sync.WaitGroup
+	for _, done := range answers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if w := <-done; w.Code != http.StatusOK {
+				t.Errorf("a queued request got %d", w.Code)
+			}
+		}()
+	}
+	wg.Wait()
+	if m := inner.max.Load(); m != 3 {
+		t.Errorf("%d requests were in flight at once, want 3", m)
+	}
+}
+
+func TestInFlightLimiterQueueTimeout(t *testing.T) {
+	newTestServer(t)
+	inner := newBlockingHandler()
+	h := newInFlightLimiter(1, 10*time.Millisecond).middleware(inner)
+	held := serveAsync(h, "/albums")
+	<-inner.entered
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/albums", nil))
+	expectProblem(t, w, http.StatusServiceUnavailable)
+	close(inner.release)
+	expectStatus(t, <-held, http.StatusOK)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultLanguage is the language the messages are written in, used when
+// the client accepts none of the catalogs.
+const defaultLanguage = "en"
+
+// localeFiles are the message catalogs, one per language, each mapping an
+// English message as it appears in the code to its translation. A message
+// missing from a catalog is sent in English.
+//
+//go:embed locales/*.json
+var localeFiles embed.FS
+
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[string]map[string]string {
+	files, err := localeFiles.ReadDir("locales")
+	if err != nil {
+		panic(err)
+	}
+	catalogs := map[string]map[string]string{defaultLanguage: {}}
+	for _, f := range files {
+		data, err := localeFiles.ReadFile("locales/" + f.Name())
+		if err != nil {
+			panic(err)
+		}
+		var messages map[string]string
+		if err := json.Unmarshal(data, &messages); err != nil {
+			panic(fmt.Sprintf("locales/%s: %v", f.Name(), err))
+		}
+		catalogs[strings.TrimSuffix(f.Name(), path.Ext(f.Name()))] = messages
+	}
+	return catalogs
+}
+
+// negotiateLanguage picks the catalog best matching an Accept-Language
+// header like "fr-CH, fr;q=0.9, en;q=0.8". Languages are tried by quality,
+// then in the order given; a regional tag falls back to its base language,
+// and "*" or no match gives defaultLanguage.
+func negotiateLanguage(header string) string {
+	type choice struct {
+		tag string
+		q   float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if tag = strings.ToLower(strings.TrimSpace(tag)); tag != "" && q > 0 {
+			choices = append(choices, choice{tag, q})
+		}
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	for _, c := range choices {
+		if c.tag == "*" {
+			return defaultLanguage
+		}
+		if _, ok := catalogs[c.tag]; ok {
+			return c.tag
+		}
+		if base, _, ok := strings.Cut(c.tag, "-"); ok {
+			if _, ok := catalogs[base]; ok {
+				return base
+			}
+		}
+	}
+	return defaultLanguage
+}
+
+// translate returns msg in the language r asks for, and that language. A
+// message the catalog lacks comes back as it is, in defaultLanguage.
+func translate(r *http.Request, msg string) (string, string) {
+	lang := negotiateLanguage(r.Header.Get("Accept-Language"))
+	if t, ok := catalogs[lang][msg]; ok {
+		return t, lang
+	}
+	return msg, defaultLanguage
+}
+
+// localize formats a message in the language r asks for, for a detail
+// built with arguments, like "album %d has no id".
+func localize(r *http.Request, format string, args ...interface{}) string {
+	t, _ := translate(r, format)
+	return fmt.Sprintf(t, args...)
+}
+
+// writeLocalizedDetail translates a problem's detail and sets the headers
+// saying which language it is in.
+func writeLocalizedDetail(w http.ResponseWriter, r *http.Request, p *problem) {
+	detail, lang := translate(r, p.Detail)
+	p.Detail = detail
+	w.Header().Set("Content-Language", lang)
+	w.Header().Add("Vary", "Accept-Language")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"testing"
+)
+
+func TestNegotiateLanguage(t *testing.T) {
+	for header, want := range map[string]string{
+		"":                          "en",
+		"fr":                        "fr",
+		"FR":                        "fr",
+		"fr-CH, fr;q=0.9, en;q=0.8": "fr",
+		"de, es;q=0.5":              "es",
+		"en;q=0.5, es":              "es",
+		"es;q=0.5, fr;q=0.5":        "es",
+		"es-MX":                     "es",
+		"de":                        "en",
+		"*":                         "en",
+		"fr;q=0, es;q=0.1":          "es",
+		"fr;q=high, es":             "es",
+		"es;q=0.1, *;q=0.5":         "en",
+	} {
+		if got := negotiateLanguage(header); got != want {
+			t.Errorf("negotiateLanguage(%q) = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestLocalizedProblems(t *testing.T) {
+	s := newTestServer(t)
+	for _, tc := range []struct {
+		accept, detail, lang string
+	}{
+		{"", "album not found", "en"},
+		{"fr-FR, en;q=0.5", "album introuvable", "fr"},
+		{"es", "álbum no encontrado", "es"},
+		{"de", "album not found", "en"},
+	} {
+		w := s.do(http.MethodGet, "/albums/no-such-album", "", "Accept-Language", tc.accept)
+		p := expectProblem(t, w, http.StatusNotFound)
+		if p.Detail != tc.detail || w.Header().Get("Content-Language") != tc.lang {
+			t.Errorf("Accept-Language %q: detail %q in %q, want %q in %q", tc.accept, p.Detail, w.Header().Get("Content-Language"), tc.detail, tc.lang)
+		}
+		// The title is for machines and stays in English.
+		if p.Title != "Not Found" {
+			t.Errorf("Accept-Language %q: title %q", tc.accept, p.Title)
+		}
+	}
+}
+
+func TestMissingTranslation(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Language", "fr")
+	if got, lang := translate(r, "a message no catalog has"); got != "a message no catalog has" || lang != "en" {
+		t.Errorf("translate of a missing message = %q in %q, want it as it is, in en", got, lang)
+	}
+	if got := localize(r, "%d albums, none of them translated", 3); got != "3 albums, none of them translated" {
+		t.Errorf("localize of a missing template = %q", got)
+	}
+}
+
+// TestCatalogVerbs checks that every translation of a template takes the
+// arguments the English does, so it formats the same way.
+func TestCatalogVerbs(t *testing.T) {
+	verbs := regexp.MustCompile(`%[-+# 0]*\d*(\.\d+)?[a-zA-Z%]`)
+	for lang, messages := range catalogs {
+		for msg, translation := range messages {
+			if want, got := verbs.FindAllString(msg, -1), verbs.FindAllString(translation, -1); !slices.Equal(want, got) {
+				t.Errorf("%s: %q has verbs %v, want %v as in %q", lang, translation, got, want, msg)
+			}
+		}
+	}
+}
@@ -1,175 +1,278 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/google/uuid"
-	"github.com/jackc/pgx/v4" // PostgreSQL
+	"github.com/brentmzey/web-service-go/internal/buildinfo"
+	"github.com/brentmzey/web-service-go/internal/clock"
+	"github.com/brentmzey/web-service-go/money"
+	"github.com/brentmzey/web-service-go/types"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"gorm.io/driver/sqlite" // SQLite
-	"gorm.io/gorm"          // ORM for SQLite
+	"gorm.io/gorm" // ORM for SQLite
 )
 
-// album represents data about a record album.
-type album struct {
-	ID     string  `json:"id"`
-	Title  string  `json:"title"`
-	Artist string  `json:"artist"`
-	Price  float64 `json:"price"`
-}
-
-var albums = []album{
-	{ID: uuid.New().String(), Title: "Blue Train", Artist: "John Coltrane", Price: 56.99},
-	{ID: uuid.New().String(), Title: "Jeru", Artist: "Gerry Mulligan", Price: 17.99},
-	{ID: uuid.New().String(), Title: "Sarah Vaughan and Clifford Brown", Artist: "Sarah Vaughan", Price: 39.99},
-	// Add more albums...
-}
+// album represents data about a record album. It is defined in the types
+// package, which the client shares.
+type album = types.Album
 
 type clientInfo struct {
 	lastRequest  time.Time
 	requestCount int
 }
 
-var clients = make(map[string]*clientInfo)
-
-type Metrics struct {
-	TotalRequests      int64
-	TotalErrors        int64
-	TotalAlbumsFetched int64
-	TotalAlbumsAdded   int64
-	TotalRateLimited   int64
-	TotalLatencyMs     int64
-}
-
-var metrics = &Metrics{}
-
-type MetricsStore interface {
-	SaveMetrics(metrics Metrics) error
-	LoadMetrics() (Metrics, error)
+// rateLimiter counts each client's requests. Requests are served
+// concurrently, so the counts are kept under mu.
+type rateLimiter struct {
+	clock   clock.Clock
+	mu      sync.Mutex
+	clients map[string]*clientInfo
+	// rejected counts the requests turned away in each second of the last
+	// minute, by Unix second modulo 60.
+	rejected [60]struct{ second, count int64 }
 }
 
-type InMemoryMetricsStore struct {
-	metrics Metrics
+func newRateLimiter(c clock.Clock) *rateLimiter {
+	return &rateLimiter{clock: c, clients: make(map[string]*clientInfo)}
 }
 
-func (store *InMemoryMetricsStore) SaveMetrics(metrics Metrics) error {
-	store.metrics = metrics
-	return nil
-}
-
-func (store *InMemoryMetricsStore) LoadMetrics() (Metrics, error) {
-	return store.metrics, nil
+// record counts a request from clientIP and returns its count in the
+// current window, which starts over after a gap of window since the last
+// request let through. A count past limit means the request is turned away.
+func (l *rateLimiter) record(clientIP string, window time.Duration, limit int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	info, exists := l.clients[clientIP]
+	if !exists {
+		l.clients[clientIP] = &clientInfo{requestCount: 1, lastRequest: l.clock.Now()}
+		return 1
+	}
+	if l.clock.Since(info.lastRequest) < window {
+		info.requestCount++
+		if info.requestCount > limit {
+			l.countRejection()
+			return info.requestCount
+		}
+	} else {
+		info.requestCount = 1
+	}
+	info.lastRequest = l.clock.Now()
+	return info.requestCount
 }
 
-// PostgresMetricsStore is a basic outline for future implementation
-type PostgresMetricsStore struct {
-	conn *pgx.Conn
+// retryAfter is how long until clientIP's window runs out and its count
+// starts over: window after its last request let through.
+func (l *rateLimiter) retryAfter(clientIP string, window time.Duration) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	info, exists := l.clients[clientIP]
+	if !exists {
+		return 0
+	}
+	return info.lastRequest.Add(window).Sub(l.clock.Now())
 }
 
-func NewPostgresMetricsStore(conn *pgx.Conn) *PostgresMetricsStore {
-	return &PostgresMetricsStore{conn: conn}
+// countRejection counts a request turned away; l.mu is held.
+func (l *rateLimiter) countRejection() {
+	now := l.clock.Now().Unix()
+	slot := &l.rejected[now%60]
+	if slot.second != now {
+		slot.second, slot.count = now, 0
+	}
+	slot.count++
 }
 
-func (store *PostgresMetricsStore) SaveMetrics(metrics Metrics) error {
-	// Implement PostgreSQL saving logic
-	return nil
+// rejectedLastMinute is how many requests were turned away in the last 60
+// seconds.
+func (l *rateLimiter) rejectedLastMinute() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.clock.Now().Unix()
+	n := int64(0)
+	for _, slot := range l.rejected {
+		if now-slot.second < 60 {
+			n += slot.count
+		}
+	}
+	return n
 }
 
-func (store *PostgresMetricsStore) LoadMetrics() (Metrics, error) {
-	// Implement PostgreSQL loading logic
-	return Metrics{}, nil
+// clientCount is how many clients the limiter is tracking.
+func (l *rateLimiter) clientCount() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.clients)
 }
 
-// Implement similar structures for SQLite, MongoDB, and DynamoDB
-
-type SqliteMetricsStore struct {
-	db *gorm.DB
+// prune forgets the clients whose window has run out; their next request
+// would start a new one anyway.
+func (l *rateLimiter) prune(window time.Duration) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for clientIP, info := range l.clients {
+		if l.clock.Since(info.lastRequest) >= window {
+			delete(l.clients, clientIP)
+			n++
+		}
+	}
+	return n
 }
 
-func NewSqliteMetricsStore(db *gorm.DB) *SqliteMetricsStore {
-	return &SqliteMetricsStore{db: db}
-}
+// rateLimitJanitorInterval is how often pruneRateLimits runs.
+const rateLimitJanitorInterval = time.Minute
 
-func (store *SqliteMetricsStore) SaveMetrics(metrics Metrics) error {
-	// Implement SQLite saving logic
+// pruneRateLimits is the rate-limit-janitor job. It drops the rate limit,
+// quota, and per-client metrics state of callers who have gone quiet, the
+// monthly counts of past months, which otherwise grow with every client
+// address ever seen, and the expired API key lookups.
+func pruneRateLimits(ctx context.Context) error {
+	cfg := currentConfig()
+	clients := limiter.prune(cfg.RateLimitWindow)
+	windows, months := 0, 0
+	if store, ok := quotas.(*memoryQuotaStore); ok {
+		windows = store.prune(quotaWindow)
+	}
+	if store, ok := monthlyQuotas.(*memoryMonthlyQuotas); ok {
+		month, _ := quotaMonth(serverClock.Now())
+		months = store.prune(month)
+	}
+	tracked := clientMetrics.prune(cfg.RateLimitWindow, cfg.MetricsFlushInterval > 0)
+	keys := apiKeys.prune(cfg.APIKeyCacheTTL)
+	debugf("Pruned %d rate limit clients, %d quota windows, %d past monthly quotas, %d client metrics, and %d API key lookups", clients, windows, months, tracked, keys)
 	return nil
 }
 
-func (store *SqliteMetricsStore) LoadMetrics() (Metrics, error) {
-	// Implement SQLite loading logic
-	return Metrics{}, nil
-}
+// serverClock times the latency metrics and the metrics flusher, and the
+// limiter built from it. A test can replace both with ones on a
+// clocktest.Fake to step through windows and intervals without sleeping.
+var serverClock clock.Clock = clock.Real{}
 
-type MongoMetricsStore struct {
-	collection *mongo.Collection
-}
-
-func NewMongoMetricsStore(collection *mongo.Collection) *MongoMetricsStore {
-	return &MongoMetricsStore{collection: collection}
-}
+var limiter = newRateLimiter(serverClock)
 
-func (store *MongoMetricsStore) SaveMetrics(metrics Metrics) error {
-	// Implement MongoDB saving logic
-	return nil
+// Metrics are the request counters. They are updated with sync/atomic; use
+// snapshotMetrics to read them all.
+type Metrics struct {
+	TotalRequests      int64
+	TotalErrors        int64
+	TotalAlbumsFetched int64
+	TotalAlbumsAdded   int64
+	TotalRateLimited   int64
+	TotalLatencyMs     int64
 }
 
-func (store *MongoMetricsStore) LoadMetrics() (Metrics, error) {
-	// Implement MongoDB loading logic
-	return Metrics{}, nil
-}
+var metrics = &Metrics{}
 
-type DynamoMetricsStore struct {
-	session *dynamodb.DynamoDB
-}
+// responseBuffers recycles the buffers writeJSON encodes into.
+var responseBuffers = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
 
-func NewDynamoMetricsStore(sess *dynamodb.DynamoDB) *DynamoMetricsStore {
-	return &DynamoMetricsStore{session: sess}
-}
+// maxPooledBufferSize keeps a buffer that grew for one unusually large
+// response from being held by the pool indefinitely.
+const maxPooledBufferSize = 1 << 20
 
-func (store *DynamoMetricsStore) SaveMetrics(metrics Metrics) error {
-	// Implement DynamoDB saving logic
-	return nil
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	writeJSONAs(w, status, "application/json", data)
 }
 
-func (store *DynamoMetricsStore) LoadMetrics() (Metrics, error) {
-	// Implement DynamoDB loading logic
-	return Metrics{}, nil
-}
+// writeJSONAs writes data as JSON. A plain application/json answer follows
+// the jsonStyle of the request; problems are always written as they are.
+func writeJSONAs(w http.ResponseWriter, status int, contentType string, data interface{}) {
+	var style jsonStyle
+	// The context of the request being answered, for its timing; only a
+	// handler's own writer has one.
+	ctx := context.Background()
+	if dw, ok := w.(*disconnectWriter); ok {
+		if dw.gone() {
+			return
+		}
+		ctx = dw.ctx
+		if contentType == "application/json" {
+			style = dw.style
+			contentType = style.contentType()
+			w.Header().Add("Vary", "Accept")
+		}
+	}
+	buf := responseBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledBufferSize {
+			responseBuffers.Put(buf)
+		}
+	}()
 
-func writeJSON(w http.ResponseWriter, status int, data interface{}) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	js, err := json.MarshalIndent(data, "", "  ")
+	start := time.Now()
+	err := encodeJSON(buf, style, data)
+	noteSerializeTime(ctx, time.Since(start))
 	if err != nil {
-		http.Error(w, `{"message":"internal server error"}`, http.StatusInternalServerError)
+		w.Header().Set("Content-Type", "application/problem+json")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"type":"about:blank","title":"Internal Server Error","status":500,"detail":"internal server error"}`))
 		log.Printf("🔥 JSON marshal error: %v", err)
 		return
 	}
-	w.Write(js)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	// Encode adds a newline that MarshalIndent never did; keep the body unchanged.
+	w.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+}
+
+// encodeJSON writes data into buf indented, in style.
+func encodeJSON(buf *bytes.Buffer, style jsonStyle, data interface{}) error {
+	if style == (jsonStyle{}) {
+		enc := json.NewEncoder(buf)
+		enc.SetIndent("", "  ")
+		return enc.Encode(data)
+	}
+	var compact bytes.Buffer
+	if err := style.encode(&compact, reflect.ValueOf(data)); err != nil {
+		return err
+	}
+	return json.Indent(buf, compact.Bytes(), "", "  ")
 }
 
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		debugf("%s %s from %s", r.Method, r.URL.RequestURI(), clientAddr(r))
 		lrw := &loggingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		body := countBody(r)
 		next.ServeHTTP(lrw, r)
 		duration := time.Since(start)
-		log.Printf("🚀 %s %s -> %d %s 🌟", r.Method, r.URL.Path, lrw.statusCode, duration)
+		if clientGone(r) && !body.timedOut {
+			lrw.statusCode = statusClientClosedRequest
+		}
+		// Scrapes and probes would drown out the rest of the access log.
+		if !excludedFromMetrics(r) || currentConfig().LogLevel == "debug" {
+			accessLog.Printf("🚀 %s %s from %s -> %d %s (%dB in, %dB out) 🌟", r.Method, r.URL.Path, clientAddr(r), lrw.statusCode, duration, body.n, lrw.written)
+		}
+		noteSlowRequest(r, lrw.statusCode, duration)
 	})
 }
 
+// loggingResponseWriter records the status and counts the bytes of the body
+// actually written, which a Content-Length header may not match.
 type loggingResponseWriter struct {
 	http.ResponseWriter
 	statusCode int
+	written    int64
 }
 
 func (lrw *loggingResponseWriter) WriteHeader(code int) {
@@ -177,171 +280,800 @@ func (lrw *loggingResponseWriter) WriteHeader(code int) {
 	lrw.ResponseWriter.WriteHeader(code)
 }
 
+func (lrw *loggingResponseWriter) Write(b []byte) (int, error) {
+	n, err := lrw.ResponseWriter.Write(b)
+	lrw.written += int64(n)
+	return n, err
+}
+
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter { return lrw.ResponseWriter }
+
+// metricsMiddleware counts requests, errors, latency, and bytes in and out. The routes in
+// METRICS_EXCLUDE_ROUTES are left out so that scrapes and probes don't skew
+// them; the route is only known once the ServeMux has matched it, so the
+// request is counted after it is served. A request whose client hung up is
+// only counted in totalClientClosedRequests.
 func metricsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		metrics.TotalRequests++
+		start := serverClock.Now()
 		lrw := &loggingResponseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+		body := countBody(r)
 		next.ServeHTTP(lrw, r)
-		latency := time.Since(start).Milliseconds()
-		metrics.TotalLatencyMs += latency
+		if excludedFromMetrics(r) {
+			return
+		}
+		noteTraffic(r, lrw.statusCode, body.n, lrw.written)
+		if clientGone(r) && !body.timedOut {
+			atomic.AddInt64(&totalClientClosedRequests, 1)
+			return
+		}
+		atomic.AddInt64(&metrics.TotalRequests, 1)
+		took := serverClock.Since(start)
+		atomic.AddInt64(&metrics.TotalLatencyMs, took.Milliseconds())
+		alertCounters.observeRequest(lrw.statusCode, took)
+		clientMetrics.observe(identifyCaller(r).id, lrw.statusCode >= 400, currentConfig().MetricsClientLimit)
 		if lrw.statusCode >= 400 {
-			metrics.TotalErrors++
+			atomic.AddInt64(&metrics.TotalErrors, 1)
 		}
 	})
 }
 
+// excludedFromMetrics reports whether r was routed by a pattern in
+// METRICS_EXCLUDE_ROUTES.
+func excludedFromMetrics(r *http.Request) bool {
+	return routeListed(currentConfig().MetricsExcludeRoutes, r.Pattern)
+}
+
+// routeListed reports whether pattern is in a comma-separated list of route
+// patterns. An entry ending in /* covers every pattern under it, like
+// /debug/* for the pprof routes. The pattern of an unmatched request, empty
+// or unmatchedPattern, is never listed.
+func routeListed(list, pattern string) bool {
+	if pattern == "" || pattern == unmatchedPattern {
+		return false
+	}
+	for _, route := range strings.Split(list, ",") {
+		route = strings.TrimSpace(route)
+		if prefix, ok := strings.CutSuffix(route, "*"); ok {
+			if strings.HasPrefix(pattern, prefix) {
+				return true
+			}
+		} else if route == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// metricsHandler reports this instance's counters as JSON, or with
+// format=prometheus in the Prometheus text format.
 func metricsHandler(w http.ResponseWriter, r *http.Request) {
-	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"totalRequests":      metrics.TotalRequests,
-		"totalErrors":        metrics.TotalErrors,
-		"totalAlbumsFetched": metrics.TotalAlbumsFetched,
-		"totalAlbumsAdded":   metrics.TotalAlbumsAdded,
-		"totalRateLimited":   metrics.TotalRateLimited,
-		"averageLatencyMs":   avgLatency(),
-	})
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "prometheus" {
+		writeProblem(w, r, http.StatusBadRequest, `format must be "json" or "prometheus"`)
+		log.Println("📉 Bad request: unknown metrics format", format)
+		return
+	}
+	cfg := currentConfig()
+	m := snapshotMetrics()
+	bytesIn, bytesOut, traffic := trafficSnapshot()
+	report := types.MetricsReport{
+		TotalRequests:               m.TotalRequests,
+		TotalErrors:                 m.TotalErrors,
+		TotalAlbumsFetched:          m.TotalAlbumsFetched,
+		TotalAlbumsAdded:            m.TotalAlbumsAdded,
+		TotalRateLimited:            m.TotalRateLimited,
+		AverageLatencyMs:            m.averageLatency(),
+		InFlightRequests:            atomic.LoadInt64(&inFlightRequests),
+		TotalOverloadShed:           atomic.LoadInt64(&totalOverloadShed),
+		ClientClosedRequests:        atomic.LoadInt64(&totalClientClosedRequests),
+		TotalBodyTimeouts:           atomic.LoadInt64(&totalBodyTimeouts),
+		TotalBodyTooLarge:           atomic.LoadInt64(&totalBodyTooLarge),
+		CircuitBreakers:             breakerStates(),
+		TotalStoreRetries:           atomic.LoadInt64(&totalStoreRetries),
+		TotalSecondaryWriteFailures: atomic.LoadInt64(&totalSecondaryWriteFailures),
+		TotalNegativeCacheHits:      atomic.LoadInt64(&totalNegativeCacheHits),
+		MaintenanceMode:             maintenance().String(),
+		SlowRequests:                slowRequests(),
+		TotalBytesIn:                bytesIn,
+		TotalBytesOut:               bytesOut,
+		Traffic:                     traffic,
+		TotalBackupFailures:         atomic.LoadInt64(&totalBackupFailures),
+		TotalMetricsSamplesDropped:  atomic.LoadInt64(&totalMetricsSamplesDropped),
+		RateLimitClients:            limiter.clientCount(),
+		RateLimitedLastMinute:       limiter.rejectedLastMinute(),
+		StoreCalls:                  storeCallReport(),
+		ConnectionPools:             connectionPools(),
+		ReadHedging:                 readHedging(),
+		Build:                       versionInfo(),
+		Instance:                    cfg.InstanceID,
+		Environment:                 cfg.Environment,
+	}
+	if format == "prometheus" {
+		writePrometheus(w, report)
+		return
+	}
+	writeJSON(w, http.StatusOK, report)
+}
+
+// versionInfo describes the running build, for GET /version, /metrics and
+// the startup log. The in-memory backend is reported as DB_TYPE "memory".
+func versionInfo() types.VersionInfo {
+	info := buildinfo.Get()
+	dbType := currentConfig().DBType
+	if dbType == "" {
+		dbType = "memory"
+	}
+	return types.VersionInfo{
+		Version:   info.Version,
+		Commit:    info.Commit,
+		BuildDate: info.Date,
+		GoVersion: info.GoVersion,
+		DBType:    dbType,
+	}
+}
+
+func getVersion(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, versionInfo())
 }
 
-func avgLatency() int64 {
-	if metrics.TotalRequests == 0 {
+func (m Metrics) averageLatency() int64 {
+	if m.TotalRequests == 0 {
 		return 0
 	}
-	return metrics.TotalLatencyMs / metrics.TotalRequests
+	return m.TotalLatencyMs / m.TotalRequests
 }
 
+// rateLimitingMiddleware turns away a client's requests past the first
+// RATE_LIMIT_REQUESTS that each arrive within RATE_LIMIT_WINDOW of the one
+// before, and those past the hourly or monthly quota of the client's tier.
+// All are read per request, so a reload applies straight away.
 func rateLimitingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		clientIP := r.RemoteAddr
-		if info, exists := clients[clientIP]; exists {
-			if time.Since(info.lastRequest) < 15*time.Second {
-				info.requestCount++
-				if info.requestCount > 5 {
-					waitTime := time.Duration(1<<info.requestCount) * time.Second
-					metrics.TotalRateLimited++
-					http.Error(w, "Too many requests, please wait a bit", http.StatusTooManyRequests)
-					log.Printf("⏳ Rate limit exceeded for %s, waiting %v", clientIP, waitTime)
-					return
-				}
-			} else {
-				info.requestCount = 1
-			}
-			info.lastRequest = time.Now()
-		} else {
-			clients[clientIP] = &clientInfo{requestCount: 1, lastRequest: time.Now()}
+		if isHealthCheck(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cfg := currentConfig()
+		c := identifyCaller(r)
+		clientIP := c.id
+		count := limiter.record(clientIP, cfg.RateLimitWindow, cfg.RateLimitRequests)
+		if count > cfg.RateLimitRequests {
+			// Retry-After is in whole seconds, rounded up so that a client
+			// waiting it out is let through.
+			waitTime := max(time.Duration(math.Ceil(limiter.retryAfter(clientIP, cfg.RateLimitWindow).Seconds()))*time.Second, time.Second)
+			atomic.AddInt64(&metrics.TotalRateLimited, 1)
+			w.Header().Set("Retry-After", strconv.Itoa(int(waitTime/time.Second)))
+			writeProblem(w, r, http.StatusTooManyRequests, "Too many requests, please wait a bit")
+			log.Printf("⏳ Rate limit exceeded for %s, waiting %v", clientIP, waitTime)
+			return
+		}
+		debugf("%s has made %d of %d requests in the rate limit window", clientIP, count, cfg.RateLimitRequests)
+		// A request the hourly quota turns away isn't counted in the month.
+		if !consumeQuota(w, r, c) || !consumeMonthlyQuota(w, r, c) {
+			return
 		}
 		next.ServeHTTP(w, r)
 	})
 }
 
 func getAlbums(w http.ResponseWriter, r *http.Request) {
-	metrics.TotalAlbumsFetched++
-	writeJSON(w, http.StatusOK, albums)
-	log.Println("🎶 Fetched all albums")
+	filter, err := parseAlbumFilter(r)
+	if err != nil {
+		writeFilterProblem(w, r, err)
+		return
+	}
+	varyCollation(w)
+	cfg := currentConfig()
+	cacheControl := filter.cacheControl(cfg.ListCacheControl)
+	limit, offset, clamped, err := parseListPage(r, cfg.AlbumsPageSize, cfg.AlbumsMaxPageSize)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	if clamped {
+		w.Header().Set("X-Limit-Clamped", strconv.Itoa(limit))
+	}
+	if r.URL.Query().Has("cursor") {
+		getAlbumsAfter(w, r, cfg, filter, limit)
+		return
+	}
+	cacheKey := filter.cacheKey() + "\x00" + strconv.Itoa(limit) + "\x00" + strconv.Itoa(offset)
+	gs, cacheable := albumStore.(generationalStore)
+	var generation uint64
+	if cacheable {
+		generation = gs.Generation()
+		// A page cached before RESPONSE_MAX_BYTES was lowered is cut
+		// again from the listing.
+		if entry, ok := albumListResponses.get(generation, cacheKey); ok && (cfg.ResponseMaxBytes == 0 || len(entry.body) <= cfg.ResponseMaxBytes) {
+			atomic.AddInt64(&metrics.TotalAlbumsFetched, 1)
+			writePageLinks(w, r, limit, offset, entry.total)
+			if writeValidators(w, r, cacheControl, entry.lastModified) {
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(entry.body)
+			log.Printf("🎶 Fetched a page of %d albums (cached)", entry.total)
+			return
+		}
+	}
+	if abandoned(r) {
+		return
+	}
+	list, err := listAll(r.Context(), albumStore, filter)
+	if err = acceptStale(w, err); err != nil {
+		respondError(w, r, err)
+		return
+	}
+	if abandoned(r) {
+		return
+	}
+	atomic.AddInt64(&metrics.TotalAlbumsFetched, 1)
+	// Last-Modified covers the whole listing, since a change anywhere in it
+	// can move albums between pages.
+	lastModified := latestUpdate(list)
+	total := len(list)
+	page := list[min(offset, total):min(offset+limit, total)]
+	if n, fits := fitPage(page, cfg.ResponseMaxBytes, 1); !fits {
+		var ok bool
+		if limit, ok = cutPage(w, r, cfg, n, len(page)); !ok {
+			return
+		}
+		// A cut page isn't cached under the limit it was asked for.
+		page, cacheable = page[:limit], false
+	}
+	writePageLinks(w, r, limit, offset, total)
+	if !cacheable {
+		if writeValidators(w, r, cacheControl, lastModified) {
+			return
+		}
+		writeJSON(w, http.StatusOK, page)
+		log.Printf("🎶 Fetched %d of %d albums", len(page), total)
+		return
+	}
+	body, err := json.MarshalIndent(page, "", "  ")
+	if err != nil {
+		writeProblem(w, r, http.StatusInternalServerError, "internal server error")
+		log.Printf("🔥 JSON marshal error: %v", err)
+		reportError(r, http.StatusInternalServerError, err)
+		return
+	}
+	albumListResponses.put(generation, cacheKey, cachedList{body: body, total: total, lastModified: lastModified})
+	if writeValidators(w, r, cacheControl, lastModified) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	log.Printf("🎶 Fetched %d of %d albums", len(page), total)
 }
 
 func getAlbumByID(w http.ResponseWriter, r *http.Request) {
-	id := strings.TrimPrefix(r.URL.Path, "/albums/")
-	for _, a := range albums {
-		if a.ID == id {
-			writeJSON(w, http.StatusOK, a)
-			log.Printf("🔍 Album found: %s", a.Title)
-			return
-		}
+	id := r.PathValue("id")
+	respondAlbumLookup(w, r, albumStore.GetByID, id)
+}
+
+func getAlbumBySlug(w http.ResponseWriter, r *http.Request) {
+	slug := r.PathValue("slug")
+	respondAlbumLookup(w, r, albumStore.GetBySlug, slug)
+}
+
+func getAlbumByBarcode(w http.ResponseWriter, r *http.Request) {
+	code := r.PathValue("code")
+	respondAlbumLookup(w, r, albumStore.GetByBarcode, code)
+}
+
+func respondAlbumLookup(w http.ResponseWriter, r *http.Request, lookup func(context.Context, string) (album, error), key string) {
+	a, err := lookup(r.Context(), key)
+	if err = acceptStale(w, err); err != nil {
+		respondError(w, r, err)
+		return
+	}
+	private, err := visibleAlbum(r, a)
+	if errors.Is(err, errIncludeUnavailable) {
+		writeFilterProblem(w, r, err)
+		return
+	}
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	cacheControl := currentConfig().AlbumCacheControl
+	if private {
+		cacheControl = privateCacheControl
+	}
+	if writeValidators(w, r, cacheControl, a.UpdatedAt) {
+		return
+	}
+	writeJSON(w, http.StatusOK, a)
+	log.Printf("🔍 Album found: %s", a.Title)
+}
+
+// albumInput is the body of a create or update.
+type albumInput struct {
+	types.AlbumInput
+}
+
+// validate checks the fields that have format rules.
+func (in albumInput) validate() error {
+	if errs := in.validationErrors(); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// validationErrors runs every check validate makes, for POST
+// /albums/validate to report all of those that fail rather than the first.
+func (in albumInput) validationErrors() []error {
+	var errs []error
+	if in.Barcode != "" && !validBarcode(in.Barcode) {
+		errs = append(errs, errInvalidBarcode)
+	}
+	if err := validateMetadata(in.Metadata); err != nil {
+		errs = append(errs, err)
 	}
-	writeJSON(w, http.StatusNotFound, map[string]string{"message": "album not found"})
-	log.Println("❌ Album not found")
+	if in.Stock < 0 {
+		errs = append(errs, errNegativeStock)
+	}
+	// The window is checked as it is stored, to the second.
+	if from, until := availabilityTime(in.AvailableFrom), availabilityTime(in.AvailableUntil); from != nil && until != nil && !until.After(*from) {
+		errs = append(errs, errAvailabilityWindow)
+	}
+	return errs
 }
 
+func (in albumInput) album(id string) album {
+	a := album{
+		ID:             id,
+		Title:          in.Title,
+		Artist:         in.Artist,
+		Price:          in.Price.Round(),
+		Genre:          in.Genre,
+		Barcode:        in.Barcode,
+		Year:           in.Year,
+		Tracks:         in.Tracks,
+		Metadata:       in.Metadata,
+		Stock:          in.Stock,
+		AvailableFrom:  availabilityTime(in.AvailableFrom),
+		AvailableUntil: availabilityTime(in.AvailableUntil),
+	}
+	if len(a.Metadata) == 0 {
+		a.Metadata = nil
+	}
+	return a
+}
+
+// inputOf is the input that would set a's fields as they are.
+func inputOf(a album) albumInput {
+	return albumInput{types.AlbumInput{
+		Title: a.Title, Artist: a.Artist, Price: a.Price, Genre: a.Genre,
+		Barcode: a.Barcode, Year: a.Year, Tracks: a.Tracks, Metadata: a.Metadata, Stock: a.Stock,
+		AvailableFrom: a.AvailableFrom, AvailableUntil: a.AvailableUntil,
+	}}
+}
+
+// postAlbums creates one album, or a batch when the body is a JSON array.
 func postAlbums(w http.ResponseWriter, r *http.Request) {
-	var newAlbum struct {
-		Title  string  `json:"title"`
-		Artist string  `json:"artist"`
-		Price  float64 `json:"price"`
+	var body json.RawMessage
+	if err := decodeAlbumJSON(r.Body, &body); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	if isJSONArray(body) {
+		postAlbumsBatch(w, r, body)
+		return
 	}
-	if err := json.NewDecoder(r.Body).Decode(&newAlbum); err != nil {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"message": err.Error()})
+	var newAlbum albumInput
+	if err := json.Unmarshal(body, &newAlbum); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
 		log.Println("📉 Bad request:", err)
 		return
 	}
+	if err := newAlbum.validate(); err != nil {
+		respondError(w, r, err)
+		return
+	}
 
-	album := album{
-		ID:     uuid.New().String(),
-		Title:  newAlbum.Title,
-		Artist: newAlbum.Artist,
-		Price:  newAlbum.Price,
+	ctx := withCatalogLimit(withPrincipal(r.Context(), requestPrincipal(r)), currentConfig().CatalogMaxAlbums)
+	album, err := albumStore.Create(ctx, newAlbum.album(newAlbumID()))
+	if err != nil {
+		respondError(w, r, err)
+		return
 	}
 
-	albums = append(albums, album)
-	metrics.TotalAlbumsAdded++
+	atomic.AddInt64(&metrics.TotalAlbumsAdded, 1)
+	recordAudit(auditAlbumCreated, album.ID, requestPrincipal(r), nil)
+	albumsChanged()
+	w.Header().Set("Location", resourceURL(r, albumRoute, album.ID))
 	writeJSON(w, http.StatusCreated, album)
 	log.Printf("✨ New album added: %s by %s", album.Title, album.Artist)
+	if enrichmentEnabled() {
+		go enrichAlbum(album)
+	}
 }
 
-func albumsHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case http.MethodGet:
-		getAlbums(w, r)
-	case http.MethodPost:
-		postAlbums(w, r)
-	default:
-		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"message": "Method not allowed"})
-		log.Println("🔒 Method not allowed")
+func putAlbum(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var input albumInput
+	if err := decodeAlbumJSON(r.Body, &input); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	if err := input.validate(); err != nil {
+		respondError(w, r, err)
+		return
 	}
-}
 
-func albumByIDHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodGet {
-		getAlbumByID(w, r)
-	} else {
-		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"message": "Method not allowed"})
-		log.Println("🔒 Method not allowed")
+	// The album as it was, for the audit entry's changes.
+	current, err := albumStore.GetByID(r.Context(), id)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	regenerateSlug := r.URL.Query().Get("regenerateSlug") == "true"
+	ctx := withPrincipal(r.Context(), requestPrincipal(r))
+	updated, err := albumStore.Update(ctx, input.album(id), regenerateSlug)
+	if err != nil {
+		respondError(w, r, err)
+		return
 	}
+	recordAudit(auditAlbumUpdated, updated.ID, requestPrincipal(r), updateAuditDetails(current, updated))
+	albumsChanged()
+
+	writeJSON(w, http.StatusOK, updated)
+	log.Printf("📝 Album updated: %s by %s", updated.Title, updated.Artist)
+}
+
+// setupStores connects to the backend selected by DB_TYPE and builds the
+// metrics, album, and API key stores on top of the shared connection.
+func setupStores(cfg *Config) (MetricsStore, AlbumStore, APIKeyStore) {
+	return setupStoresFor(cfg, cfg.DBType)
 }
 
-func setupMetricsStore() MetricsStore {
-	dbType := os.Getenv("DB_TYPE")
+// setupStoresFor builds the stores for dbType; an empty type means the
+// in-memory stores. PostgreSQL and MongoDB servers may be briefly down at
+// boot, so they are reached through connectStores. A local SQLite file and
+// the DynamoDB client, which doesn't connect up front, fail fast instead.
+func setupStoresFor(cfg *Config, dbType string) (MetricsStore, AlbumStore, APIKeyStore) {
 	switch dbType {
 	case "postgres":
-		conn, err := pgx.Connect(context.Background(), os.Getenv("DATABASE_URL"))
+		config, err := postgresConfig(cfg)
 		if err != nil {
-			log.Fatalf("Unable to connect to database: %v", err)
+			log.Fatalf("Invalid PostgreSQL configuration: %v", err)
 		}
-		return NewPostgresMetricsStore(conn)
+		replicaConfig, err := postgresReplicaConfig(cfg)
+		if err != nil {
+			log.Fatalf("Invalid PostgreSQL replica configuration: %v", err)
+		}
+		return connectStores("PostgreSQL", func() (MetricsStore, AlbumStore, APIKeyStore, error) {
+			pool, err := dialPostgres(config)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			if err := migrateOnStartup(cfg, postgresMigrations{pool: pool}, "postgres"); err != nil {
+				pool.Close()
+				return nil, nil, nil, fmt.Errorf("migrating: %w", err)
+			}
+			albumStore, err := NewPostgresAlbumStore(pool, cfg.PGQueryTimeout)
+			if err != nil {
+				pool.Close()
+				return nil, nil, nil, fmt.Errorf("setting up album store: %w", err)
+			}
+			if replicaConfig != nil {
+				replica, err := dialPostgres(replicaConfig)
+				if err != nil {
+					pool.Close()
+					return nil, nil, nil, fmt.Errorf("replica: %w", err)
+				}
+				albumStore.useReplica(replica, cfg.ReplicaWaitTimeout)
+				log.Printf("🪞 Reading albums from the PostgreSQL replica at %s:%d", replicaConfig.ConnConfig.Host, replicaConfig.ConnConfig.Port)
+			}
+			return NewPostgresMetricsStore(pool), albumStore, NewPostgresAPIKeyStore(pool), nil
+		}, setupStartupRetryPolicy(cfg))
 
 	case "sqlite":
-		db, err := gorm.Open(sqlite.Open("file:metrics.db?cache=shared&_fk=1"), &gorm.Config{})
+		db, sqlDB, err := openSQLite(cfg.SQLiteDSN, &gorm.Config{})
 		if err != nil {
 			log.Fatalf("Failed to connect to SQLite database: %v", err)
 		}
-		return NewSqliteMetricsStore(db)
-
-	case "mongodb":
-		client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI("mongodb://localhost:27017"))
+		if err := migrateOnStartup(cfg, sqliteMigrations{db: sqlDB}, "sqlite"); err != nil {
+			log.Fatalf("Failed to migrate SQLite database: %v", err)
+		}
+		albumStore, err := NewSqliteAlbumStore(db)
 		if err != nil {
-			log.Fatalf("Failed to connect to MongoDB: %v", err)
+			log.Fatalf("Failed to set up SQLite album store: %v", err)
 		}
-		return NewMongoMetricsStore(client.Database("metricsDb").Collection("metrics"))
+		return NewSqliteMetricsStore(db), albumStore, NewSqliteAPIKeyStore(db)
+
+	case "mongodb":
+		return connectStores("MongoDB", func() (MetricsStore, AlbumStore, APIKeyStore, error) {
+			client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(cfg.MongoURI))
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			db := client.Database(cfg.MongoDatabase)
+			albumStore, err := NewMongoAlbumStore(db.Collection("albums"), db.Collection("auditLog"), db.Collection("importJobs"), db.Collection("savedSearches"))
+			if err != nil {
+				client.Disconnect(context.Background())
+				return nil, nil, nil, fmt.Errorf("setting up album store: %w", err)
+			}
+			return NewMongoMetricsStore(db.Collection("metrics"), db.Collection("clientMetrics"), db.Collection("metricsHistory")), albumStore, NewMongoAPIKeyStore(db.Collection("apiKeys")), nil
+		}, setupStartupRetryPolicy(cfg))
 
 	case "dynamodb":
-		sess := session.Must(session.NewSession())
-		svc := dynamodb.New(sess)
-		return NewDynamoMetricsStore(svc)
+		client, err := newDynamoClient(cfg)
+		if err != nil {
+			log.Fatalf("Failed to set up DynamoDB client: %v", err)
+		}
+		return NewDynamoMetricsStore(client), NewDynamoAlbumStore(client, cfg.DynamoTimeout, cfg.DynamoHedgeAfter, cfg.DynamoHedgeMaxPercent), NewDynamoAPIKeyStore(client)
 
 	default:
-		return &InMemoryMetricsStore{}
+		return &InMemoryMetricsStore{}, NewInMemoryAlbumStore(), NewInMemoryAPIKeyStore()
 	}
 }
 
 var metricsStore MetricsStore
+var albumStore AlbumStore
+var apiKeyStore APIKeyStore
 
 func main() {
-	metricsStore = setupMetricsStore()
-	mux := http.NewServeMux()
-	mux.HandleFunc("/albums", albumsHandler)
-	mux.HandleFunc("/albums/", albumByIDHandler)
-	mux.HandleFunc("/metrics", metricsHandler)
-	log.Println("🎧 Listening on http://localhost:8080")
-
-	wrappedMux := metricsMiddleware(loggingMiddleware(rateLimitingMiddleware(mux)))
-	log.Fatal(http.ListenAndServe("localhost:8080", wrappedMux))
+	flag.StringVar(&configPath, "config", "", "path to a YAML configuration file; environment variables override it")
+	flag.Parse()
+	cfg, warnings, err := loadConfig(configPath, os.LookupEnv)
+	if args := flag.Args(); len(args) > 0 && args[0] == "check" {
+		liveConfig.Store(&cfg)
+		os.Exit(checkCommand(&cfg, warnings, err))
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	liveConfig.Store(&cfg)
+	setupLogging(cfg.LogFormat)
+	rounding, _ := money.ParseRounding(cfg.PriceRounding)
+	money.SetRounding(rounding)
+	for _, warning := range warnings {
+		log.Printf("⚠️ Configuration: %s", warning)
+	}
+	if args := flag.Args(); len(args) > 0 && args[0] == "migrate" {
+		os.Exit(migrateCommand(&cfg, args[1:]))
+	}
+	build := versionInfo()
+	log.Printf("🏷️ web-service-go %s, commit %s, built %s with %s, DB_TYPE=%s", build.Version, build.Commit, build.BuildDate, build.GoVersion, build.DBType)
+	log.Printf("⚙️ Configuration: %s", cfg)
+	if mode, _ := parseMaintenanceMode(cfg.MaintenanceMode); mode != maintenanceOff {
+		setMaintenance(mode)
+		log.Printf("🚧 Starting in %s maintenance mode", mode)
+	}
+
+	// ctx is cancelled on SIGINT or SIGTERM and drives shutdown.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go watchConfigReloads(hup)
+	accessLogFile, err := setupAccessLog(&cfg)
+	if err != nil {
+		log.Fatalf("Failed to open access log: %v", err)
+	}
+	if accessLogFile != nil {
+		defer accessLogFile.Close()
+		usr1 := make(chan os.Signal, 1)
+		signal.Notify(usr1, syscall.SIGUSR1)
+		go watchAccessLogReopens(accessLogFile, usr1)
+	}
+
+	setupErrorReporting(&cfg)
+	if err := setupResponseCache(&cfg); err != nil {
+		log.Fatalf("Failed to set up the response cache: %v", err)
+	}
+	if err := setupQuotas(&cfg); err != nil {
+		log.Fatalf("Failed to set up the quotas: %v", err)
+	}
+	metricsStore, albumStore, apiKeyStore = setupStores(&cfg)
+	metricsStore, albumStore = guardStores(&cfg, metricsStore, albumStore)
+	albumStore = setupDualWrite(&cfg, albumStore)
+	albumStore = setupAlbumCache(&cfg, albumStore)
+	albumStore = setupAlbumIDFilter(&cfg, albumStore)
+	whenStoresConnected(func() {
+		if cfg.RateLimitSnapshot > 0 {
+			restoreRateLimits(ctx, metricsStore)
+		}
+		if err := seedAlbums(ctx, albumStore, cfg.SeedFile); err != nil {
+			log.Fatalf("Failed to seed albums: %v", err)
+		}
+		buildAlbumIDFilter(ctx)
+		startWarmup(ctx, &cfg)
+		storesReady.Store(true)
+	})
+	enricher = setupEnricher(&cfg)
+
+	flushed := make(chan struct{})
+	if cfg.MetricsFlushInterval > 0 {
+		go flushMetrics(ctx, metricsStore, serverClock, cfg.MetricsFlushInterval, flushed)
+	} else {
+		close(flushed)
+	}
+
+	scheduler.register("rate-limit-janitor", rateLimitJanitorInterval, pruneRateLimits)
+	if cfg.RateLimitSnapshot > 0 {
+		scheduler.register("rate-limit-snapshot", cfg.RateLimitSnapshot, saveRateLimits)
+	}
+	setupBackups(&cfg)
+	setupAlerting(&cfg)
+	setupPayments(&cfg)
+	setupChangeLog()
+	setupAlbumPublisher()
+	setupRetention()
+	setupAlbumEvents(&cfg)
+	scheduler.start(ctx)
+	imports.ctx = ctx
+
+	servers := newServers(&cfg)
+	tlsConfig, err := setupTLS(&cfg)
+	if err != nil {
+		log.Fatalf("Failed to set up TLS: %v", err)
+	}
+	for _, srv := range servers {
+		srv.TLSConfig = tlsConfig
+	}
+	listeners, err := openListeners(&cfg, servers, os.LookupEnv)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		<-ctx.Done()
+		log.Println("🛑 Shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+		defer cancel()
+		var wg sync.WaitGroup
+		for _, srv := range servers {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := srv.Shutdown(shutdownCtx); err != nil {
+					log.Printf("🔥 Shutdown of %s: %v", srv.Addr, err)
+				}
+			}()
+		}
+		wg.Wait()
+	}()
+	serve(servers, listeners)
+	<-shutdownDone
+	scheduler.wait()
+	imports.wait()
+	reportCtx, cancel := context.WithTimeout(context.Background(), errorReportTimeout)
+	errorReports.flush(reportCtx)
+	cancel()
+	if cfg.RateLimitSnapshot > 0 {
+		saveCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := saveRateLimits(saveCtx); err != nil {
+			log.Printf("🔥 Failed to save the rate limits: %v", err)
+		}
+		cancel()
+	}
+	<-flushed
+}
+
+// serve runs each server on its listener until all of them are shut down.
+// A server failing for any other reason is fatal.
+func serve(servers []*http.Server, listeners []net.Listener) {
+	errs := make(chan error, len(servers))
+	for i, srv := range servers {
+		if i == 0 {
+			log.Printf("🎧 Listening on %s", listenerURL(listeners[i], srv.TLSConfig != nil))
+		} else {
+			log.Printf("🛠️ Admin endpoints on %s", listenerURL(listeners[i], srv.TLSConfig != nil))
+		}
+		go func() {
+			if srv.TLSConfig != nil {
+				// The certificate is already in TLSConfig.
+				errs <- srv.ServeTLS(listeners[i], "", "")
+				return
+			}
+			errs <- srv.Serve(listeners[i])
+		}()
+	}
+	for range servers {
+		if err := <-errs; err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}
+}
+
+// newAPIRoutes routes the public API, without the operational endpoints or
+// any middleware. The warm-up sends its requests to it too.
+func newAPIRoutes(cfg *Config) *routeTable {
+	api := newRouteTable()
+	api.Handle("/albums", methods{http.MethodGet: getAlbums, http.MethodPost: postAlbums, http.MethodPut: putAlbumsBatch})
+	api.Handle("/albums/search", methods{http.MethodPost: postAlbumsSearch})
+	api.Handle("/albums/validate", methods{http.MethodPost: postAlbumsValidate})
+	api.Handle("/albums/changes", methods{http.MethodGet: getAlbumChanges})
+	album := newRouteTable()
+	album.Handle(albumRoute, methods{http.MethodGet: getAlbumByID, http.MethodPut: putAlbum, http.MethodPatch: patchAlbum})
+	album.Handle("/albums/{id}/price-history", methods{http.MethodGet: getPriceHistory})
+	api.HandleNested(albumRoute, album)
+	api.Handle("/albums/by-slug/{slug...}", methods{http.MethodGet: getAlbumBySlug})
+	api.Handle("/albums/by-barcode/{code...}", methods{http.MethodGet: getAlbumByBarcode})
+	api.HandleFeature("feed", "/albums/feed", methods{http.MethodGet: getAlbumsFeed, http.MethodHead: getAlbumsFeed}.ServeHTTP)
+	api.HandleFeature("stats", "/albums/stats", methods{http.MethodGet: getAlbumStats}.ServeHTTP)
+	api.HandleFeature("stats", "/artists/stats", methods{http.MethodGet: getArtistStats}.ServeHTTP)
+	api.Handle("/me/usage", methods{http.MethodGet: getUsage})
+	api.Handle("/albums/import", methods{http.MethodPost: postAlbumsImport})
+	api.Handle(importJobRoute, methods{http.MethodGet: getImportJob, http.MethodDelete: deleteImportJob})
+	api.Handle("/searches", methods{http.MethodGet: withSavedSearches(getSearches), http.MethodPost: withSavedSearches(postSearches)})
+	api.Handle(savedSearchRoute, methods{http.MethodGet: withSavedSearches(getSavedSearch), http.MethodDelete: withSavedSearches(deleteSavedSearch)})
+	api.Handle(savedSearchRoute+"/results", methods{http.MethodGet: withSavedSearches(getSavedSearchResults)})
+	api.HandleFeature("spreadsheet_export", "/albums/export", methods{http.MethodGet: getAlbumsExport}.ServeHTTP)
+	if cfg.PaymentWebhookSecret != "" {
+		api.Handle("/integrations/payments", methods{http.MethodPost: postPaymentWebhook})
+	}
+	return api
+}
+
+// newServers builds the public API server and, when ADMIN_ADDR is set, a
+// second server for the operational endpoints, which then leave the public
+// one, along with the /debug endpoints when DEBUG_ENDPOINTS=true. The admin
+// server keeps logging and metrics but skips CORS, load shedding, and rate
+// limiting, so a 30-second CPU profile isn't throttled. Both count towards
+// the same /metrics.
+func newServers(cfg *Config) []*http.Server {
+	api := newAPIRoutes(cfg)
+	ops := api
+	if cfg.AdminAddr != "" {
+		ops = newRouteTable()
+	}
+	admin := func(m methods) http.HandlerFunc { return requireAdmin(m.ServeHTTP) }
+	ops.HandleFunc("/admin/export", admin(methods{http.MethodGet: getCatalogExport}))
+	ops.HandleFunc("/admin/import", admin(methods{http.MethodPost: postCatalogImport}))
+	ops.HandleFunc("/admin/albums", admin(methods{http.MethodDelete: deleteAlbums}))
+	ops.HandleFunc("/admin/albums/diff", admin(methods{http.MethodGet: getAlbumsDiff}))
+	ops.HandleFunc("/admin/albums/duplicates", admin(methods{http.MethodGet: getDuplicateAlbums}))
+	ops.HandleFunc("/admin/albums/merge", admin(methods{http.MethodPost: postAlbumMerge}))
+	ops.HandleFunc("/admin/artists/rename", admin(methods{http.MethodPost: postArtistRename}))
+	ops.HandleFunc("/admin/backups", admin(methods{http.MethodGet: getBackups}))
+	ops.HandleFunc("/admin/stores/backfill", admin(methods{http.MethodPost: postStoreBackfill}))
+	ops.HandleFunc(backfillStatusRoute, admin(methods{http.MethodGet: getStoreBackfillStatus}))
+	ops.HandleFunc("/admin/stores/verify", admin(methods{http.MethodPost: postStoreVerify}))
+	ops.HandleFunc("/admin/config/reload", admin(methods{http.MethodPost: postConfigReload}))
+	ops.HandleFunc("/admin/maintenance", admin(methods{http.MethodGet: getMaintenance, http.MethodPost: postMaintenance}))
+	ops.HandleFunc("/admin/features", admin(methods{http.MethodGet: getFeatures}))
+	ops.HandleFunc("/admin/features/{name...}", admin(methods{http.MethodPut: putFeature}))
+	ops.HandleFunc("/admin/body-logging/tokens", admin(methods{http.MethodPost: postBodyLogToken}))
+	ops.HandleFunc("/admin/apikeys", admin(methods{http.MethodGet: getAPIKeys, http.MethodPost: postAPIKey}))
+	ops.HandleFunc(apiKeyRoute, admin(methods{http.MethodGet: getAPIKey, http.MethodPatch: patchAPIKey, http.MethodDelete: deleteAPIKey}))
+	ops.HandleFunc(jobsRoute, admin(methods{http.MethodGet: getJobs}))
+	ops.HandleFunc("/admin/jobs/{name}/run", admin(methods{http.MethodPost: postJobRun}))
+	ops.HandleFunc("/admin/metrics/clients", admin(methods{http.MethodGet: getClientMetrics}))
+	ops.Handle("/metrics", methods{http.MethodGet: metricsHandler})
+	ops.Handle("/metrics/history", methods{http.MethodGet: getMetricsHistory})
+	ops.Handle("/version", methods{http.MethodGet: getVersion})
+	ops.Handle("/healthz", methods{http.MethodGet: healthzHandler, http.MethodHead: healthzHandler})
+	ops.Handle("/readyz", methods{http.MethodGet: readyzHandler, http.MethodHead: readyzHandler})
+
+	// With optional routes the handshake lets clients without a
+	// certificate in, and requireClientCert checks the rest of the routes.
+	var apiRoutes, opsRoutes http.Handler = api, ops
+	if cfg.MTLSClientCA != "" && hasOptionalCertRoutes(cfg) {
+		apiRoutes, opsRoutes = requireClientCert(cfg, api), requireClientCert(cfg, ops)
+	}
+	apiRoutes, opsRoutes = disconnectMiddleware(apiRoutes), disconnectMiddleware(opsRoutes)
+
+	servers := []*http.Server{{
+		Addr:              cfg.ListenAddr,
+		Handler:           apiMiddleware(cfg).then(apiRoutes),
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+	}}
+	if cfg.AdminAddr != "" {
+		if cfg.DebugEndpoints {
+			routeDebug(ops)
+		}
+		servers = append(servers, &http.Server{Addr: cfg.AdminAddr, Handler: opsMiddleware().then(opsRoutes), ReadHeaderTimeout: cfg.ReadHeaderTimeout})
+	}
+	return servers
 }
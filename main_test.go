@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/internal/clock/clocktest"
+	"github.com/brentmzey/web-service-go/money"
+	"github.com/brentmzey/web-service-go/types"
+)
+
+const testAdminToken = "test-admin-token"
+
+// testStart is where every test server's fake clock starts.
+var testStart = time.Date(2026, time.March, 2, 12, 0, 0, 0, time.UTC)
+
+func TestMain(m *testing.M) {
+	// The handlers log every request; the failures say what went wrong.
+	log.SetOutput(io.Discard)
+	// Tests of code that reads the configuration without a test server get
+	// the defaults.
+	cfg := defaultConfig()
+	liveConfig.Store(&cfg)
+	os.Exit(m.Run())
+}
+
+// testServer serves the API as main does, over fresh in-memory stores and
+// a fake clock. The service keeps its state in package variables, so a
+// test server replaces them and tests using one must not run in parallel.
+type testServer struct {
+	t       testing.TB
+	cfg     *Config
+	handler http.Handler
+	clock   *clocktest.Fake
+	albums  *InMemoryAlbumStore
+	metrics *recordingMetricsStore
+}
+
+// newTestServer starts a test server with the default configuration,
+// except for limits high enough that only a test that lowers them is
+// limited, changed by each of configure.
+func newTestServer(t testing.TB, configure ...func(*Config)) *testServer {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.AdminToken = testAdminToken
+	cfg.RateLimitRequests = 10000
+	cfg.QuotaFreePerHour = 100000
+	cfg.QuotaPaidPerHour = 100000
+	for _, c := range configure {
+		c(&cfg)
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("invalid test configuration: %v", err)
+	}
+	s := &testServer{t: t, cfg: &cfg, clock: clocktest.New(testStart), albums: NewInMemoryAlbumStore(), metrics: newRecordingMetricsStore()}
+	useTestGlobals(t, &cfg, s.clock)
+	albumStore, metricsStore, apiKeyStore = s.albums, s.metrics, NewInMemoryAPIKeyStore()
+	s.handler = newServers(&cfg)[0].Handler
+	return s
+}
+
+// useTestGlobals points the package state main sets up at cfg and clk, and
+// puts the previous configuration and clock back when t ends.
+func useTestGlobals(t testing.TB, cfg *Config, clk *clocktest.Fake) {
+	t.Helper()
+	previousConfig, previousClock := liveConfig.Load(), serverClock
+	t.Cleanup(func() {
+		liveConfig.Store(previousConfig)
+		serverClock = previousClock
+	})
+	liveConfig.Store(cfg)
+	serverClock = clk
+	limiter = newRateLimiter(clk)
+	clientMetrics = newClientTracker(clk)
+	metrics = &Metrics{}
+	albumStatsResults = &statsCache{}
+	albumListResponses = &albumListCache{}
+	apiKeys = newAPIKeyCache(apiKeyCacheSize)
+	auditLog = &InMemoryAuditLog{}
+	if err := setupResponseCache(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := setupQuotas(cfg); err != nil {
+		t.Fatal(err)
+	}
+	storesReady.Store(true)
+}
+
+// do sends a request with body, which may be "", and the headers given as
+// name, value pairs.
+func (s *testServer) do(method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	var r io.Reader
+	if body != "" {
+		r = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, r)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	return w
+}
+
+// admin sends a request with the admin token.
+func (s *testServer) admin(method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	return s.do(method, path, body, append([]string{"Authorization", "Bearer " + testAdminToken}, headers...)...)
+}
+
+// create adds a through POST /albums and returns it as created.
+func (s *testServer) create(a album) album {
+	s.t.Helper()
+	w := s.do(http.MethodPost, "/albums", albumJSON(a))
+	if w.Code != http.StatusCreated {
+		s.t.Fatalf("POST /albums = %d %s", w.Code, w.Body)
+	}
+	return decodeBody[album](s.t, w)
+}
+
+// decodeBody decodes the JSON body of w as a T.
+func decodeBody[T any](t testing.TB, w *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(w.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decoding %s: %v", w.Body, err)
+	}
+	return v
+}
+
+// expectStatus fails t unless w has status.
+func expectStatus(t testing.TB, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status = %d, want %d; body %s", w.Code, status, w.Body)
+	}
+}
+
+// expectProblem fails t unless w is a problem+json answer with status.
+func expectProblem(t *testing.T, w *httptest.ResponseRecorder, status int) types.Problem {
+	t.Helper()
+	expectStatus(t, w, status)
+	if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Fatalf("Content-Type = %q, want application/problem+json", ct)
+	}
+	p := decodeBody[types.Problem](t, w)
+	if p.Status != status || p.Title != http.StatusText(status) {
+		t.Fatalf("problem = %+v, want status %d", p, status)
+	}
+	return p
+}
+
+// newTestAlbum builds an album with every required field, changed by each
+// of opts.
+func newTestAlbum(opts ...func(*album)) album {
+	a := album{Title: "Blue Train", Artist: "John Coltrane", Price: money.FromCents(5699), Genre: "Jazz", Year: 1957}
+	for _, opt := range opts {
+		opt(&a)
+	}
+	return a
+}
+
+func withTitle(title string) func(*album)   { return func(a *album) { a.Title = title } }
+func withArtist(artist string) func(*album) { return func(a *album) { a.Artist = artist } }
+func withPrice(cents int64) func(*album)    { return func(a *album) { a.Price = money.FromCents(cents) } }
+func withBarcode(code string) func(*album)  { return func(a *album) { a.Barcode = code } }
+func withID(id string) func(*album)         { return func(a *album) { a.ID = id } }
+
+// albumJSON is the body of a create or update of a.
+func albumJSON(a album) string {
+	in := inputOf(a)
+	b, err := json.Marshal(in.AlbumInput)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// recordingMetricsStore is an InMemoryMetricsStore that records every call
+// made to it by method name.
+type recordingMetricsStore struct {
+	*InMemoryMetricsStore
+	mu    sync.Mutex
+	calls []string
+	added []Metrics // the delta of each AddMetrics
+}
+
+func newRecordingMetricsStore() *recordingMetricsStore {
+	return &recordingMetricsStore{InMemoryMetricsStore: &InMemoryMetricsStore{}}
+}
+
+func (s *recordingMetricsStore) record(call string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, call)
+}
+
+func (s *recordingMetricsStore) Calls() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.calls...)
+}
+
+func (s *recordingMetricsStore) AddMetrics(ctx context.Context, delta Metrics) error {
+	s.record("AddMetrics")
+	s.mu.Lock()
+	s.added = append(s.added, delta)
+	s.mu.Unlock()
+	return s.InMemoryMetricsStore.AddMetrics(ctx, delta)
+}
+
+func (s *recordingMetricsStore) LoadMetrics(ctx context.Context) (Metrics, error) {
+	s.record("LoadMetrics")
+	return s.InMemoryMetricsStore.LoadMetrics(ctx)
+}
+
+func (s *recordingMetricsStore) AddClientMetrics(ctx context.Context, deltas []ClientMetrics, keep int) error {
+	s.record("AddClientMetrics")
+	return s.InMemoryMetricsStore.AddClientMetrics(ctx, deltas, keep)
+}
+
+func (s *recordingMetricsStore) LoadClientMetrics(ctx context.Context) ([]ClientMetrics, error) {
+	s.record("LoadClientMetrics")
+	return s.InMemoryMetricsStore.LoadClientMetrics(ctx)
+}
+
+func (s *recordingMetricsStore) SaveRateLimitSnapshot(ctx context.Context, snapshot []byte) error {
+	s.record("SaveRateLimitSnapshot")
+	return s.InMemoryMetricsStore.SaveRateLimitSnapshot(ctx, snapshot)
+}
+
+func (s *recordingMetricsStore) LoadRateLimitSnapshot(ctx context.Context) ([]byte, error) {
+	s.record("LoadRateLimitSnapshot")
+	return s.InMemoryMetricsStore.LoadRateLimitSnapshot(ctx)
+}
+
+func (s *recordingMetricsStore) AddMetricsSample(ctx context.Context, sample MetricsSample) error {
+	s.record("AddMetricsSample")
+	return s.InMemoryMetricsStore.AddMetricsSample(ctx, sample)
+}
+
+func (s *recordingMetricsStore) LoadMetricsHistory(ctx context.Context, filter metricsHistoryFilter) ([]MetricsSample, error) {
+	s.record("LoadMetricsHistory")
+	return s.InMemoryMetricsStore.LoadMetricsHistory(ctx, filter)
+}
+
+// jsonKeys returns the keys of the JSON object in body.
+func jsonKeys(t *testing.T, body []byte) map[string]bool {
+	t.Helper()
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(bytes.TrimSpace(body), &obj); err != nil {
+		t.Fatalf("decoding %s: %v", body, err)
+	}
+	keys := make(map[string]bool, len(obj))
+	for k := range obj {
+		keys[k] = true
+	}
+	return keys
+}
+
+func TestHarnessSmoke(t *testing.T) {
+	s := newTestServer(t)
+	a := s.create(newTestAlbum())
+	w := s.do(http.MethodGet, "/albums/"+a.ID, "")
+	expectStatus(t, w, http.StatusOK)
+}
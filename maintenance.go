@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// maintenanceMode freezes the catalog during data migrations without taking
+// the service down.
+type maintenanceMode int32
+
+const (
+	maintenanceOff      maintenanceMode = iota
+	maintenanceReadOnly                 // writes get 503, reads are served
+	maintenanceFull                     // everything but health checks and admin endpoints gets 503
+)
+
+// maintenanceRetryAfter is the Retry-After, in seconds, sent with a
+// maintenance 503. Maintenance usually lasts minutes, not the seconds of an
+// overload.
+const maintenanceRetryAfter = "60"
+
+func (m maintenanceMode) String() string {
+	switch m {
+	case maintenanceReadOnly:
+		return "read-only"
+	case maintenanceFull:
+		return "full"
+	default:
+		return "off"
+	}
+}
+
+func parseMaintenanceMode(s string) (maintenanceMode, error) {
+	for _, m := range []maintenanceMode{maintenanceOff, maintenanceReadOnly, maintenanceFull} {
+		if s == m.String() {
+			return m, nil
+		}
+	}
+	return 0, fmt.Errorf(`must be "off", "read-only", or "full", got %q`, s)
+}
+
+// currentMaintenance holds the maintenanceMode in effect. It is read on every
+// request, so a change applies to the next request without racing the ones in
+// flight.
+var currentMaintenance atomic.Int32
+
+func maintenance() maintenanceMode {
+	return maintenanceMode(currentMaintenance.Load())
+}
+
+func setMaintenance(m maintenanceMode) (previous maintenanceMode) {
+	return maintenanceMode(currentMaintenance.Swap(int32(m)))
+}
+
+// isOperational reports whether path is a health check, /metrics, or an
+// admin or debug endpoint. Maintenance never blocks these, so the service can
+// be watched and taken out of maintenance again.
+func isOperational(path string) bool {
+	return isHealthCheck(path) || path == "/metrics" || strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/debug/")
+}
+
+// maintenanceMiddleware answers 503 with Retry-After for requests the
+// current maintenance mode blocks: writes in read-only mode, everything in
+// full mode, but never operational endpoints. A search is a POST but only
+// reads.
+func maintenanceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mode := maintenance()
+		if mode == maintenanceOff || isOperational(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		detail := "the service is down for maintenance, please retry later"
+		if mode == maintenanceReadOnly {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				next.ServeHTTP(w, r)
+				return
+			}
+			if r.URL.Path == "/albums/search" || r.URL.Path == "/albums/validate" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			detail = "the catalog is read-only for maintenance, please retry later"
+		}
+		w.Header().Set("Retry-After", maintenanceRetryAfter)
+		writeProblem(w, r, http.StatusServiceUnavailable, detail)
+		log.Printf("🚧 Rejected %s %s during %s maintenance", r.Method, r.URL.Path, mode)
+	})
+}
+
+// getMaintenance reports the maintenance mode.
+func getMaintenance(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"mode": maintenance().String()})
+}
+
+// postMaintenance changes the maintenance mode with a body like
+// {"mode": "read-only"}.
+func postMaintenance(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Mode string `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	mode, err := parseMaintenanceMode(body.Mode)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "mode "+err.Error())
+		log.Println("📉 Bad request: unknown maintenance mode", body.Mode)
+		return
+	}
+	previous := setMaintenance(mode)
+	if previous != mode {
+		recordAudit(auditMaintenanceChanged, "", principalAdmin, map[string]interface{}{"from": previous.String(), "to": mode.String()})
+		log.Printf("🚧 Maintenance mode %s -> %s", previous, mode)
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"mode": mode.String()})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMaintenanceLevels(t *testing.T) {
+	s := newTestServer(t)
+	t.Cleanup(func() { setMaintenance(maintenanceOff) })
+	a := s.create(newTestAlbum())
+
+	// Each endpoint class, with the status it gets in off, read-only, and
+	// full maintenance.
+	for _, tc := range []struct {
+		class        string
+		method, path string
+		body         string
+		admin        bool
+		want         [3]int
+	}{
+		{"read", http.MethodGet, "/albums", "", false, [3]int{200, 200, 503}},
+		{"read", http.MethodGet, "/albums/" + a.ID, "", false, [3]int{200, 200, 503}},
+		{"read by POST", http.MethodPost, "/albums/search", `{"query": {"field": "artist", "op": "contains", "value": "coltrane"}}`, false, [3]int{200, 200, 503}},
+		{"write", http.MethodPost, "/albums", albumJSON(newTestAlbum(withTitle("Lush Life"))), false, [3]int{201, 503, 503}},
+		{"write", http.MethodPut, "/albums/" + a.ID, albumJSON(newTestAlbum()), false, [3]int{200, 503, 503}},
+		{"write", http.MethodPatch, "/albums/" + a.ID, `{"year": 1958}`, false, [3]int{200, 503, 503}},
+		{"health", http.MethodGet, "/healthz", "", false, [3]int{200, 200, 200}},
+		{"health", http.MethodGet, "/readyz", "", false, [3]int{200, 200, 200}},
+		{"metrics", http.MethodGet, "/metrics", "", false, [3]int{200, 200, 200}},
+		{"admin", http.MethodGet, "/admin/features", "", true, [3]int{200, 200, 200}},
+	} {
+		for mode, want := range tc.want {
+			setMaintenance(maintenanceMode(mode))
+			send := s.do
+			if tc.admin {
+				send = s.admin
+			}
+			w := send(tc.method, tc.path, tc.body)
+			if w.Code != want {
+				t.Errorf("%s %s (%s) in %s maintenance: %d, want %d", tc.method, tc.path, tc.class, maintenanceMode(mode), w.Code, want)
+				continue
+			}
+			if want == http.StatusServiceUnavailable {
+				expectProblem(t, w, want)
+				if w.Header().Get("Retry-After") != maintenanceRetryAfter {
+					t.Errorf("%s %s in %s maintenance: Retry-After %q", tc.method, tc.path, maintenanceMode(mode), w.Header().Get("Retry-After"))
+				}
+			}
+		}
+	}
+}
+
+func TestMaintenanceReporting(t *testing.T) {
+	s := newTestServer(t)
+	t.Cleanup(func() { setMaintenance(maintenanceOff) })
+
+	expectStatus(t, s.admin(http.MethodPost, "/admin/maintenance", `{"mode": "full"}`), http.StatusOK)
+	if got := decodeBody[map[string]any](t, s.do(http.MethodGet, "/healthz", ""))["maintenance"]; got != "full" {
+		t.Errorf("/healthz maintenance = %v, want full", got)
+	}
+	if got := decodeBody[map[string]any](t, s.do(http.MethodGet, "/metrics", ""))["maintenanceMode"]; got != "full" {
+		t.Errorf("/metrics maintenanceMode = %v, want full", got)
+	}
+	expectStatus(t, s.admin(http.MethodPost, "/admin/maintenance", `{"mode": "full"}`), http.StatusOK)
+	expectStatus(t, s.admin(http.MethodPost, "/admin/maintenance", `{"mode": "off"}`), http.StatusOK)
+	expectProblem(t, s.admin(http.MethodPost, "/admin/maintenance", `{"mode": "partial"}`), http.StatusBadRequest)
+
+	// Each change is audited once; setting the mode in effect isn't one.
+	entries, _ := auditLog.List()
+	var changes []map[string]interface{}
+	for _, e := range entries {
+		if e.Action == auditMaintenanceChanged {
+			changes = append(changes, e.Details)
+		}
+	}
+	if len(changes) != 2 || changes[0]["to"] != "full" || changes[1]["from"] != "full" || changes[1]["to"] != "off" {
+		t.Errorf("audited maintenance changes %v, want off to full and back", changes)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/brentmzey/web-service-go/internal/clock"
+)
+
+const (
+	defaultMetricsFlushInterval = 30 * time.Second
+	defaultMetricsBufferSize    = 120 // an hour of samples at the default interval
+	defaultMetricsExcludeRoutes = "/metrics,/metrics/history,/healthz,/readyz,/debug/*"
+)
+
+// snapshotMetrics reads every counter atomically. The counters are loaded one
+// at a time, so a request finishing mid-snapshot may be half counted; the next
+// snapshot picks up the rest.
+func snapshotMetrics() Metrics {
+	return Metrics{
+		TotalRequests:      atomic.LoadInt64(&metrics.TotalRequests),
+		TotalErrors:        atomic.LoadInt64(&metrics.TotalErrors),
+		TotalAlbumsFetched: atomic.LoadInt64(&metrics.TotalAlbumsFetched),
+		TotalAlbumsAdded:   atomic.LoadInt64(&metrics.TotalAlbumsAdded),
+		TotalRateLimited:   atomic.LoadInt64(&metrics.TotalRateLimited),
+		TotalLatencyMs:     atomic.LoadInt64(&metrics.TotalLatencyMs),
+	}
+}
+
+func (m Metrics) add(o Metrics) Metrics {
+	return Metrics{
+		TotalRequests:      m.TotalRequests + o.TotalRequests,
+		TotalErrors:        m.TotalErrors + o.TotalErrors,
+		TotalAlbumsFetched: m.TotalAlbumsFetched + o.TotalAlbumsFetched,
+		TotalAlbumsAdded:   m.TotalAlbumsAdded + o.TotalAlbumsAdded,
+		TotalRateLimited:   m.TotalRateLimited + o.TotalRateLimited,
+		TotalLatencyMs:     m.TotalLatencyMs + o.TotalLatencyMs,
+	}
+}
+
+func (m Metrics) sub(o Metrics) Metrics {
+	return m.add(Metrics{
+		TotalRequests:      -o.TotalRequests,
+		TotalErrors:        -o.TotalErrors,
+		TotalAlbumsFetched: -o.TotalAlbumsFetched,
+		TotalAlbumsAdded:   -o.TotalAlbumsAdded,
+		TotalRateLimited:   -o.TotalRateLimited,
+		TotalLatencyMs:     -o.TotalLatencyMs,
+	})
+}
+
+// flushMetrics adds what the counters gained since the last successful flush
+// to store, in one write, every interval until ctx is cancelled at shutdown,
+// then once more so a clean shutdown keeps the final counts. Intervals with
+// nothing new are skipped, and a failed write is retried as part of the next
+// delta. Each interval's delta is also queued as a sample of the metrics
+// history, and the per-client counts follow; see metricsFlusher for what
+// happens while the store is failing. Intervals are timed by clk. It closes
+// done when it returns.
+func flushMetrics(ctx context.Context, store MetricsStore, clk clock.Clock, interval time.Duration, done chan<- struct{}) {
+	defer close(done)
+	f := newMetricsFlusher(store, clk, interval, currentConfig().MetricsBufferSize)
+	ticker := clk.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			f.flush(ctx, false)
+		case <-ctx.Done():
+			f.flush(ctx, true)
+			if n := len(f.pending); n > 0 {
+				log.Printf("🔥 Lost %d metrics history samples the metrics store never took", n)
+			}
+			return
+		}
+	}
+}
+
+// metricsFlusher is the state of flushMetrics. While the metrics store is
+// failing it keeps the samples it couldn't save, oldest first, up to
+// METRICS_BUFFER_SIZE, dropping the oldest to make room, and tries again
+// after a backoff that doubles from the interval up to
+// maxMetricsFlushBackoff. The failure is logged once, and again when the
+// store recovers and the samples are saved in order. Only the flusher's own
+// goroutine waits on the store; requests just bump counters.
+type metricsFlusher struct {
+	store    MetricsStore
+	clk      clock.Clock
+	interval time.Duration
+	size     int
+
+	flushed  Metrics // the counters as of the last totals the store took
+	sampled  Metrics // the counters as of the last sample queued
+	pending  []MetricsSample
+	failures int       // consecutive failed flushes
+	retryAt  time.Time // no flush before then, bar the last
+}
+
+const maxMetricsFlushBackoff = 5 * time.Minute
+
+var (
+	// metricsStoreFailing is set while flushes to the metrics store fail,
+	// for /healthz.
+	metricsStoreFailing atomic.Bool
+	// totalMetricsSamplesDropped counts the history samples dropped because
+	// METRICS_BUFFER_SIZE were already waiting, for /metrics.
+	totalMetricsSamplesDropped int64
+)
+
+func newMetricsFlusher(store MetricsStore, clk clock.Clock, interval time.Duration, size int) *metricsFlusher {
+	return &metricsFlusher{store: store, clk: clk, interval: interval, size: size}
+}
+
+// flush queues a sample of what the counters gained since the last one and,
+// unless it is backing off, writes everything outstanding. The last flush,
+// at shutdown, doesn't wait out the backoff.
+func (f *metricsFlusher) flush(ctx context.Context, last bool) {
+	now := snapshotMetrics()
+	at := f.clk.Now()
+	if delta := now.sub(f.sampled); delta != (Metrics{}) {
+		cfg := currentConfig()
+		f.queue(MetricsSample{Instance: cfg.InstanceID, Environment: cfg.Environment, At: at.UTC().Truncate(time.Second), Metrics: delta})
+		f.sampled = now
+	}
+	if !last && at.Before(f.retryAt) {
+		return
+	}
+	// The last flush runs after ctx is cancelled, so each write gets its
+	// own deadline instead of inheriting ctx's cancellation.
+	writeCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+	if err := f.write(writeCtx, now); err != nil {
+		f.failed(at, err)
+		return
+	}
+	if f.failures > 0 {
+		log.Printf("📈 Metrics store recovered after %d failed flushes", f.failures)
+	}
+	f.failures = 0
+	f.retryAt = time.Time{}
+	metricsStoreFailing.Store(false)
+}
+
+// write adds the totals, then saves the pending samples in order, then the
+// per-client counts, stopping at the first error.
+func (f *metricsFlusher) write(ctx context.Context, now Metrics) error {
+	if delta := now.sub(f.flushed); delta != (Metrics{}) {
+		if err := f.store.AddMetrics(ctx, delta); err != nil {
+			return err
+		}
+		f.flushed = now
+	}
+	for len(f.pending) > 0 {
+		if err := f.store.AddMetricsSample(ctx, f.pending[0]); err != nil {
+			return err
+		}
+		f.pending = f.pending[1:]
+	}
+	if deltas := clientMetrics.pending(); len(deltas) > 0 {
+		if err := f.store.AddClientMetrics(ctx, deltas, currentConfig().MetricsClientLimit); err != nil {
+			return err
+		}
+		clientMetrics.markFlushed(deltas)
+	}
+	return nil
+}
+
+func (f *metricsFlusher) queue(sample MetricsSample) {
+	if len(f.pending) >= f.size {
+		f.pending = f.pending[1:]
+		atomic.AddInt64(&totalMetricsSamplesDropped, 1)
+	}
+	f.pending = append(f.pending, sample)
+}
+
+func (f *metricsFlusher) failed(at time.Time, err error) {
+	f.failures++
+	backoff := f.interval
+	for i := 1; i < f.failures && backoff < maxMetricsFlushBackoff; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, maxMetricsFlushBackoff)
+	f.retryAt = at.Add(backoff)
+	if f.failures == 1 {
+		metricsStoreFailing.Store(true)
+		log.Printf("🔥 Failed to save metrics, keeping up to %d samples and retrying with backoff: %v", f.size, err)
+		return
+	}
+	debugf("Metrics store still failing after %d flushes, %d samples waiting, next try in %s: %v", f.failures, len(f.pending), backoff, err)
+}
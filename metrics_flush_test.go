@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingMetricsStore is a recordingMetricsStore that also keeps each
+// history sample written, and fails every write while failing is set.
+type countingMetricsStore struct {
+	*recordingMetricsStore
+	failing bool
+	samples []MetricsSample
+}
+
+var errMetricsStoreDown = errors.New("metrics store down")
+
+func (s *countingMetricsStore) AddMetrics(ctx context.Context, delta Metrics) error {
+	if s.failing {
+		s.record("AddMetrics")
+		return errMetricsStoreDown
+	}
+	return s.recordingMetricsStore.AddMetrics(ctx, delta)
+}
+
+func (s *countingMetricsStore) AddMetricsSample(ctx context.Context, sample MetricsSample) error {
+	s.record("AddMetricsSample")
+	if s.failing {
+		return errMetricsStoreDown
+	}
+	s.samples = append(s.samples, sample)
+	return nil
+}
+
+func TestMetricsFlusherBatches(t *testing.T) {
+	s := newTestServer(t)
+	store := &countingMetricsStore{recordingMetricsStore: newRecordingMetricsStore()}
+	f := newMetricsFlusher(store, s.clock, time.Minute, 3)
+	ctx := context.Background()
+	tick := func() {
+		s.clock.Advance(time.Minute)
+		f.flush(ctx, false)
+	}
+	expectCalls := func(when string, want int) {
+		t.Helper()
+		if got := len(store.Calls()); got != want {
+			t.Errorf("%s: %d store calls %v, want %d", when, got, store.Calls(), want)
+		}
+		store.calls = nil
+	}
+
+	tick()
+	expectCalls("an interval with nothing counted", 0)
+
+	// Every counter that moved goes in the one write.
+	atomic.AddInt64(&metrics.TotalRequests, 5)
+	atomic.AddInt64(&metrics.TotalErrors, 1)
+	atomic.AddInt64(&metrics.TotalLatencyMs, 40)
+	tick()
+	expectCalls("an interval with three counters moved", 2)
+	want := Metrics{TotalRequests: 5, TotalErrors: 1, TotalLatencyMs: 40}
+	if len(store.added) != 1 || store.added[0] != want || len(store.samples) != 1 || store.samples[0].Metrics != want {
+		t.Fatalf("wrote %+v and samples %+v, want one write and one sample of %+v", store.added, store.samples, want)
+	}
+	tick()
+	expectCalls("the next interval with nothing counted", 0)
+
+	// While the store fails, the intervals pile up to the buffer size, and
+	// no writes are tried until the backoff is over.
+	store.failing = true
+	droppedBefore := atomic.LoadInt64(&totalMetricsSamplesDropped)
+	for i := 0; i < 5; i++ {
+		atomic.AddInt64(&metrics.TotalRequests, 1)
+		tick()
+	}
+	// Failures at 1 and 2 minutes in, the retry 2 minutes after the second
+	// failing at 4 minutes in; 5 minutes in is still backing off.
+	expectCalls("five failing intervals", 3)
+	if len(f.pending) != 3 {
+		t.Errorf("%d samples waiting, want the buffer's 3", len(f.pending))
+	}
+	if got := atomic.LoadInt64(&totalMetricsSamplesDropped) - droppedBefore; got != 2 {
+		t.Errorf("%d samples dropped, want 2", got)
+	}
+
+	// Once it recovers, the totals go in one write and the samples in order.
+	store.failing = false
+	s.clock.Advance(maxMetricsFlushBackoff)
+	f.flush(ctx, false)
+	expectCalls("the first flush after recovering", 4)
+	if got := store.added[len(store.added)-1]; got != (Metrics{TotalRequests: 5}) {
+		t.Errorf("the write after recovering added %+v, want the 5 requests counted meanwhile", got)
+	}
+	for i := 1; i < len(store.samples); i++ {
+		if !store.samples[i-1].At.Before(store.samples[i].At) {
+			t.Errorf("samples written out of order: %v", store.samples)
+		}
+	}
+	if metricsStoreFailing.Load() {
+		t.Error("still reported failing after a successful flush")
+	}
+}
+
+// metricsStoreHealthy is what /healthz says of the metrics store. The
+// handler is called directly so that the probe isn't itself counted.
+func metricsStoreHealthy(t *testing.T) bool {
+	t.Helper()
+	w := httptest.NewRecorder()
+	healthzHandler(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	expectStatus(t, w, http.StatusOK)
+	return decodeBody[map[string]any](t, w)["metricsStoreHealthy"] == true
+}
+
+// TestMetricsFlusherOutage takes the metrics store down for eight intervals
+// and brings it back.
+func TestMetricsFlusherOutage(t *testing.T) {
+	s := newTestServer(t)
+	t.Cleanup(func() { metricsStoreFailing.Store(false) })
+	logs := captureLog(t)
+	store := &countingMetricsStore{recordingMetricsStore: newRecordingMetricsStore(), failing: true}
+	f := newMetricsFlusher(store, s.clock, time.Minute, 10)
+	ctx := context.Background()
+
+	var tried []time.Duration // when the flusher went to the store, from the start
+	for i := 1; i <= 8; i++ {
+		atomic.AddInt64(&metrics.TotalRequests, 1)
+		s.clock.Advance(time.Minute)
+		calls := len(store.Calls())
+		f.flush(ctx, false)
+		if len(store.Calls()) > calls {
+			tried = append(tried, time.Duration(i)*time.Minute)
+		}
+	}
+	// The backoff doubles from the interval: tries 1, 2, 4 and 8 minutes in.
+	if got := fmt.Sprint(tried); got != "[1m0s 2m0s 4m0s 8m0s]" {
+		t.Errorf("tried the store at %s", got)
+	}
+	if f.retryAt != testStart.Add(13*time.Minute) {
+		t.Errorf("next try at %s, want the 5 minute cap after the last", f.retryAt.Sub(testStart))
+	}
+	if got := strings.Count(logs.take(), "Failed to save metrics"); got != 1 {
+		t.Errorf("logged the failure %d times, want once", got)
+	}
+	if metricsStoreHealthy(t) {
+		t.Error("/healthz reports the metrics store healthy during the outage")
+	}
+	// An outage of the metrics store doesn't take the instance out.
+	w := httptest.NewRecorder()
+	readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	expectStatus(t, w, http.StatusOK)
+
+	store.failing = false
+	s.clock.Advance(5 * time.Minute)
+	f.flush(ctx, false)
+	if len(store.added) != 1 || store.added[0] != (Metrics{TotalRequests: 8}) {
+		t.Errorf("the totals written after the outage: %+v, want the 8 requests in one write", store.added)
+	}
+	if len(store.samples) != 8 {
+		t.Fatalf("%d samples written, want the 8 intervals", len(store.samples))
+	}
+	for i, sample := range store.samples {
+		if want := testStart.Add(time.Duration(i+1) * time.Minute); !sample.At.Equal(want) || sample.Metrics != (Metrics{TotalRequests: 1}) {
+			t.Errorf("sample %d = %+v at %s, want one request at %s", i, sample.Metrics, sample.At, want)
+		}
+	}
+	if !strings.Contains(logs.take(), "Metrics store recovered after 4 failed flushes") {
+		t.Error("the recovery wasn't logged")
+	}
+	if !metricsStoreHealthy(t) || len(f.pending) != 0 || !f.retryAt.IsZero() {
+		t.Errorf("after recovering: healthy %t, %d waiting, retry at %s", metricsStoreHealthy(t), len(f.pending), f.retryAt)
+	}
+}
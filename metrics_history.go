@@ -0,0 +1,426 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	defaultMetricsHistoryWindow = 24 * time.Hour
+	defaultMetricsHistoryBucket = 5 * time.Minute
+)
+
+// defaultInstanceID names this process in the metrics history when
+// INSTANCE_ID is unset: the hostname, which replicas may share, and a random
+// suffix, which they won't. It is picked once so a reload keeps it.
+var defaultInstanceID = func() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "instance"
+	}
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return host + "-" + hex.EncodeToString(suffix)
+}()
+
+// MetricsSample is what one instance counted during one flush interval,
+// tagged with its INSTANCE_ID and ENVIRONMENT. At is when the interval
+// ended, to the second.
+type MetricsSample struct {
+	Instance    string
+	Environment string
+	At          time.Time
+	Metrics
+}
+
+// metricsHistoryFilter picks the samples taken in [From, To), from the one
+// instance and environment when those are set.
+type metricsHistoryFilter struct {
+	Instance    string
+	Environment string
+	From, To    time.Time
+}
+
+func (f metricsHistoryFilter) matches(s MetricsSample) bool {
+	return (f.Instance == "" || s.Instance == f.Instance) &&
+		(f.Environment == "" || s.Environment == f.Environment) &&
+		!s.At.Before(f.From) && s.At.Before(f.To)
+}
+
+// metricsHistoryEntry is one entry of GET /metrics/history: a sample, or
+// with aggregate=true the sum of every instance's samples in a bucket.
+type metricsHistoryEntry struct {
+	At                 time.Time `json:"at"`
+	Instance           string    `json:"instance,omitempty"`
+	Environment        string    `json:"environment,omitempty"`
+	Instances          int       `json:"instances,omitempty"`
+	TotalRequests      int64     `json:"totalRequests"`
+	TotalErrors        int64     `json:"totalErrors"`
+	TotalAlbumsFetched int64     `json:"totalAlbumsFetched"`
+	TotalAlbumsAdded   int64     `json:"totalAlbumsAdded"`
+	TotalRateLimited   int64     `json:"totalRateLimited"`
+	AverageLatencyMs   int64     `json:"averageLatencyMs"`
+}
+
+func newMetricsHistoryEntry(at time.Time, m Metrics) metricsHistoryEntry {
+	return metricsHistoryEntry{
+		At:                 at,
+		TotalRequests:      m.TotalRequests,
+		TotalErrors:        m.TotalErrors,
+		TotalAlbumsFetched: m.TotalAlbumsFetched,
+		TotalAlbumsAdded:   m.TotalAlbumsAdded,
+		TotalRateLimited:   m.TotalRateLimited,
+		AverageLatencyMs:   m.averageLatency(),
+	}
+}
+
+// aggregateMetricsHistory sums samples, which are in time order, into one
+// entry per bucket that has any, counting the instances that contributed.
+// The average latency is over every request in the bucket, not an average of
+// the instances' averages.
+func aggregateMetricsHistory(samples []MetricsSample, bucket time.Duration) []metricsHistoryEntry {
+	var entries []metricsHistoryEntry
+	var sum Metrics
+	var start time.Time
+	instances := map[string]bool{}
+	emit := func() {
+		entry := newMetricsHistoryEntry(start, sum)
+		entry.Instances = len(instances)
+		entries = append(entries, entry)
+	}
+	for _, s := range samples {
+		at := s.At.Truncate(bucket)
+		if len(instances) > 0 && !at.Equal(start) {
+			emit()
+			sum, instances = Metrics{}, map[string]bool{}
+		}
+		start = at
+		sum = sum.add(s.Metrics)
+		instances[s.Instance] = true
+	}
+	if len(instances) > 0 {
+		emit()
+	}
+	return entries
+}
+
+// metricsHistoryPage is the answer to GET /metrics/history.
+type metricsHistoryPage struct {
+	From        time.Time             `json:"from"`
+	To          time.Time             `json:"to"`
+	Bucket      string                `json:"bucket,omitempty"`
+	Instance    string                `json:"instance,omitempty"`
+	Environment string                `json:"environment,omitempty"`
+	Aggregate   bool                  `json:"aggregate"`
+	Entries     []metricsHistoryEntry `json:"entries"`
+}
+
+// getMetricsHistory lists the saved samples in time order, the last day's by
+// default, or with aggregate=true their sum per bucket.
+func getMetricsHistory(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	now := serverClock.Now().UTC()
+	filter := metricsHistoryFilter{Instance: q.Get("instance"), Environment: q.Get("environment"), From: now.Add(-defaultMetricsHistoryWindow), To: now.Add(time.Second)}
+	for _, p := range []struct {
+		name string
+		into *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		if raw := q.Get(p.name); raw != "" {
+			t, err := time.Parse(time.RFC3339, raw)
+			if err != nil {
+				writeProblem(w, r, http.StatusBadRequest, localize(r, "%s must be an RFC 3339 time", p.name))
+				log.Println("📉 Bad request:", err)
+				return
+			}
+			*p.into = t.UTC()
+		}
+	}
+	if !filter.From.Before(filter.To) {
+		writeProblem(w, r, http.StatusBadRequest, "from must be before to")
+		log.Println("📉 Bad request: empty metrics history range")
+		return
+	}
+	aggregate := false
+	if raw := q.Get("aggregate"); raw != "" {
+		var err error
+		if aggregate, err = strconv.ParseBool(raw); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "aggregate must be true or false")
+			log.Println("📉 Bad request:", err)
+			return
+		}
+	}
+	bucket := defaultMetricsHistoryBucket
+	if raw := q.Get("bucket"); raw != "" {
+		var err error
+		if bucket, err = time.ParseDuration(raw); err != nil || bucket < time.Second {
+			writeProblem(w, r, http.StatusBadRequest, "bucket must be a duration of at least 1s")
+			log.Println("📉 Bad request: metrics history bucket", raw)
+			return
+		}
+	}
+
+	samples, err := metricsStore.LoadMetricsHistory(r.Context(), filter)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	page := metricsHistoryPage{From: filter.From, To: filter.To, Instance: filter.Instance, Environment: filter.Environment, Aggregate: aggregate, Entries: []metricsHistoryEntry{}}
+	if aggregate {
+		page.Bucket = bucket.String()
+		page.Entries = append(page.Entries, aggregateMetricsHistory(samples, bucket)...)
+	} else {
+		for _, s := range samples {
+			entry := newMetricsHistoryEntry(s.At, s.Metrics)
+			entry.Instance, entry.Environment = s.Instance, s.Environment
+			page.Entries = append(page.Entries, entry)
+		}
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (store *InMemoryMetricsStore) AddMetricsSample(ctx context.Context, sample MetricsSample) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.history = append(store.history, sample)
+	return nil
+}
+
+func (store *InMemoryMetricsStore) LoadMetricsHistory(ctx context.Context, filter metricsHistoryFilter) ([]MetricsSample, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	var samples []MetricsSample
+	for _, s := range store.history {
+		if filter.matches(s) {
+			samples = append(samples, s)
+		}
+	}
+	sortMetricsSamples(samples)
+	return samples, nil
+}
+
+// sortMetricsSamples puts samples in time order, and those taken at the same
+// second by instance.
+func sortMetricsSamples(samples []MetricsSample) {
+	slices.SortStableFunc(samples, func(a, b MetricsSample) int {
+		if c := a.At.Compare(b.At); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Instance, b.Instance)
+	})
+}
+
+const sqlMetricsSampleColumns = `instance, environment, at, total_requests, total_errors, total_albums_fetched,
+	 total_albums_added, total_rate_limited, total_latency_ms`
+
+func (store *PostgresMetricsStore) AddMetricsSample(ctx context.Context, s MetricsSample) error {
+	_, err := store.pool.Exec(ctx, `INSERT INTO metrics_history (`+sqlMetricsSampleColumns+`)
+		 VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		s.Instance, s.Environment, s.At, s.TotalRequests, s.TotalErrors, s.TotalAlbumsFetched, s.TotalAlbumsAdded, s.TotalRateLimited, s.TotalLatencyMs)
+	return err
+}
+
+func (store *PostgresMetricsStore) LoadMetricsHistory(ctx context.Context, f metricsHistoryFilter) ([]MetricsSample, error) {
+	rows, err := store.pool.Query(ctx, `SELECT `+sqlMetricsSampleColumns+` FROM metrics_history
+		 WHERE at >= $1 AND at < $2 AND ($3 = '' OR instance = $3) AND ($4 = '' OR environment = $4)
+		 ORDER BY at, instance`, f.From, f.To, f.Instance, f.Environment)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanMetricsSamples(rows.Next, rows.Scan, rows.Err)
+}
+
+func (store *SqliteMetricsStore) AddMetricsSample(ctx context.Context, s MetricsSample) error {
+	return store.db.WithContext(ctx).Exec(`INSERT INTO metrics_history (`+sqlMetricsSampleColumns+`)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		s.Instance, s.Environment, s.At, s.TotalRequests, s.TotalErrors, s.TotalAlbumsFetched, s.TotalAlbumsAdded, s.TotalRateLimited, s.TotalLatencyMs).Error
+}
+
+func (store *SqliteMetricsStore) LoadMetricsHistory(ctx context.Context, f metricsHistoryFilter) ([]MetricsSample, error) {
+	rows, err := store.db.WithContext(ctx).Raw(`SELECT `+sqlMetricsSampleColumns+` FROM metrics_history
+		 WHERE at >= ? AND at < ? AND (? = '' OR instance = ?) AND (? = '' OR environment = ?)
+		 ORDER BY at, instance`, f.From, f.To, f.Instance, f.Instance, f.Environment, f.Environment).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanMetricsSamples(rows.Next, rows.Scan, rows.Err)
+}
+
+// scanMetricsSamples reads sqlMetricsSampleColumns rows, from pgx or
+// database/sql.
+func scanMetricsSamples(next func() bool, scan func(...interface{}) error, rowsErr func() error) ([]MetricsSample, error) {
+	var samples []MetricsSample
+	for next() {
+		var s MetricsSample
+		if err := scan(&s.Instance, &s.Environment, &s.At, &s.TotalRequests, &s.TotalErrors, &s.TotalAlbumsFetched,
+			&s.TotalAlbumsAdded, &s.TotalRateLimited, &s.TotalLatencyMs); err != nil {
+			return nil, err
+		}
+		s.At = s.At.UTC()
+		samples = append(samples, s)
+	}
+	return samples, rowsErr()
+}
+
+// metricsSampleDoc is a sample's document in the metricsHistory collection,
+// and its item in the DynamoDB metricsHistory table. DynamoDB keeps At as
+// Unix seconds so that it compares as a number.
+type metricsSampleDoc struct {
+	Instance           string    `bson:"instance" dynamodbav:"instance"`
+	Environment        string    `bson:"environment" dynamodbav:"environment"`
+	At                 time.Time `bson:"at" dynamodbav:"-"`
+	AtUnix             int64     `bson:"-" dynamodbav:"at"`
+	TotalRequests      int64     `bson:"totalRequests" dynamodbav:"totalRequests"`
+	TotalErrors        int64     `bson:"totalErrors" dynamodbav:"totalErrors"`
+	TotalAlbumsFetched int64     `bson:"totalAlbumsFetched" dynamodbav:"totalAlbumsFetched"`
+	TotalAlbumsAdded   int64     `bson:"totalAlbumsAdded" dynamodbav:"totalAlbumsAdded"`
+	TotalRateLimited   int64     `bson:"totalRateLimited" dynamodbav:"totalRateLimited"`
+	TotalLatencyMs     int64     `bson:"totalLatencyMs" dynamodbav:"totalLatencyMs"`
+}
+
+func newMetricsSampleDoc(s MetricsSample) metricsSampleDoc {
+	return metricsSampleDoc{
+		Instance: s.Instance, Environment: s.Environment, At: s.At, AtUnix: s.At.Unix(),
+		TotalRequests: s.TotalRequests, TotalErrors: s.TotalErrors, TotalAlbumsFetched: s.TotalAlbumsFetched,
+		TotalAlbumsAdded: s.TotalAlbumsAdded, TotalRateLimited: s.TotalRateLimited, TotalLatencyMs: s.TotalLatencyMs,
+	}
+}
+
+func (d metricsSampleDoc) sample() MetricsSample {
+	return MetricsSample{Instance: d.Instance, Environment: d.Environment, At: d.At.UTC(), Metrics: Metrics{
+		TotalRequests: d.TotalRequests, TotalErrors: d.TotalErrors, TotalAlbumsFetched: d.TotalAlbumsFetched,
+		TotalAlbumsAdded: d.TotalAlbumsAdded, TotalRateLimited: d.TotalRateLimited, TotalLatencyMs: d.TotalLatencyMs,
+	}}
+}
+
+func (store *MongoMetricsStore) AddMetricsSample(ctx context.Context, s MetricsSample) error {
+	_, err := store.history.InsertOne(ctx, newMetricsSampleDoc(s))
+	return err
+}
+
+func (store *MongoMetricsStore) LoadMetricsHistory(ctx context.Context, f metricsHistoryFilter) ([]MetricsSample, error) {
+	filter := bson.D{{Key: "at", Value: bson.D{{Key: "$gte", Value: f.From}, {Key: "$lt", Value: f.To}}}}
+	if f.Instance != "" {
+		filter = append(filter, bson.E{Key: "instance", Value: f.Instance})
+	}
+	if f.Environment != "" {
+		filter = append(filter, bson.E{Key: "environment", Value: f.Environment})
+	}
+	cursor, err := store.history.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "at", Value: 1}, {Key: "instance", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var docs []metricsSampleDoc
+	if err := cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	samples := make([]MetricsSample, len(docs))
+	for i, d := range docs {
+		samples[i] = d.sample()
+	}
+	return samples, nil
+}
+
+const dynamoMetricsHistoryTable = "metricsHistory"
+
+func (store *DynamoMetricsStore) AddMetricsSample(ctx context.Context, s MetricsSample) error {
+	item, err := attributevalue.MarshalMap(newMetricsSampleDoc(s))
+	if err != nil {
+		return err
+	}
+	_, err = store.client.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(dynamoMetricsHistoryTable), Item: item})
+	return err
+}
+
+// LoadMetricsHistory scans the table. It is keyed by instance and at, but a
+// query would only serve the requests for one instance.
+func (store *DynamoMetricsStore) LoadMetricsHistory(ctx context.Context, f metricsHistoryFilter) ([]MetricsSample, error) {
+	filter := "#at >= :from AND #at < :to"
+	names := map[string]string{"#at": "at"}
+	values := map[string]types.AttributeValue{
+		":from": &types.AttributeValueMemberN{Value: strconv.FormatInt(f.From.Unix(), 10)},
+		":to":   &types.AttributeValueMemberN{Value: strconv.FormatInt(f.To.Unix(), 10)},
+	}
+	if f.Instance != "" {
+		filter += " AND instance = :instance"
+		values[":instance"] = &types.AttributeValueMemberS{Value: f.Instance}
+	}
+	if f.Environment != "" {
+		filter += " AND #env = :env"
+		names["#env"] = "environment"
+		values[":env"] = &types.AttributeValueMemberS{Value: f.Environment}
+	}
+	var samples []MetricsSample
+	pages := dynamodb.NewScanPaginator(store.client, &dynamodb.ScanInput{
+		TableName:                 aws.String(dynamoMetricsHistoryTable),
+		FilterExpression:          aws.String(filter),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var docs []metricsSampleDoc
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &docs); err != nil {
+			return nil, err
+		}
+		for _, d := range docs {
+			d.At = time.Unix(d.AtUnix, 0)
+			samples = append(samples, d.sample())
+		}
+	}
+	sortMetricsSamples(samples)
+	return samples, nil
+}
+
+func (store *BreakerMetricsStore) AddMetricsSample(ctx context.Context, s MetricsSample) error {
+	if !store.breaker.allow() {
+		return errCircuitOpen
+	}
+	err := store.backend.AddMetricsSample(ctx, s)
+	store.breaker.record(err)
+	return err
+}
+
+func (store *BreakerMetricsStore) LoadMetricsHistory(ctx context.Context, f metricsHistoryFilter) ([]MetricsSample, error) {
+	if !store.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+	samples, err := store.backend.LoadMetricsHistory(ctx, f)
+	store.breaker.record(err)
+	return samples, err
+}
+
+func (store *DeferredMetricsStore) AddMetricsSample(ctx context.Context, s MetricsSample) error {
+	ms, _, _, ok := store.conn.stores()
+	if !ok {
+		return errStoreConnecting
+	}
+	return ms.AddMetricsSample(ctx, s)
+}
+
+func (store *DeferredMetricsStore) LoadMetricsHistory(ctx context.Context, f metricsHistoryFilter) ([]MetricsSample, error) {
+	ms, _, _, ok := store.conn.stores()
+	if !ok {
+		return nil, errStoreConnecting
+	}
+	return ms.LoadMetricsHistory(ctx, f)
+}
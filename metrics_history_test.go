@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMetricsHistoryAggregate(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	hour := testStart.Add(-time.Hour)
+	for _, sample := range []MetricsSample{
+		{"web-1", "prod", hour.Add(time.Minute), Metrics{TotalRequests: 100, TotalErrors: 2, TotalAlbumsAdded: 1, TotalLatencyMs: 1000}},
+		{"web-2", "prod", hour.Add(3*time.Minute + 30*time.Second), Metrics{TotalRequests: 300, TotalErrors: 1, TotalRateLimited: 4, TotalLatencyMs: 9000}},
+		{"web-1", "prod", hour.Add(6 * time.Minute), Metrics{TotalRequests: 50, TotalLatencyMs: 500}},
+		{"web-1", "staging", hour.Add(2 * time.Minute), Metrics{TotalRequests: 1000, TotalLatencyMs: 1000}},
+	} {
+		if err := s.metrics.AddMetricsSample(ctx, sample); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page := decodeBody[metricsHistoryPage](t, s.do(http.MethodGet, "/metrics/history?aggregate=true&environment=prod", ""))
+	want := []metricsHistoryEntry{
+		// The latency is averaged over the 400 requests, not over the two
+		// instances' averages of 10ms and 30ms.
+		{At: hour, Instances: 2, TotalRequests: 400, TotalErrors: 3, TotalAlbumsAdded: 1, TotalRateLimited: 4, AverageLatencyMs: 25},
+		{At: hour.Add(5 * time.Minute), Instances: 1, TotalRequests: 50, AverageLatencyMs: 10},
+	}
+	if len(page.Entries) != len(want) {
+		t.Fatalf("entries %+v, want %+v", page.Entries, want)
+	}
+	for i, got := range page.Entries {
+		if !got.At.Equal(want[i].At) {
+			t.Errorf("entry %d at %s, want %s", i, got.At, want[i].At)
+		}
+		got.At = want[i].At
+		if got != want[i] {
+			t.Errorf("entry %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+	if page.Bucket != "5m0s" || !page.Aggregate || page.Environment != "prod" {
+		t.Errorf("page = %+v", page)
+	}
+
+	// Across environments the staging instance joins the first bucket.
+	page = decodeBody[metricsHistoryPage](t, s.do(http.MethodGet, "/metrics/history?aggregate=true&bucket=1h", ""))
+	if len(page.Entries) != 1 || page.Entries[0].Instances != 2 || page.Entries[0].TotalRequests != 1450 || page.Entries[0].AverageLatencyMs != 7 {
+		t.Errorf("hourly entries %+v, want one of 1450 requests from 2 instances", page.Entries)
+	}
+
+	page = decodeBody[metricsHistoryPage](t, s.do(http.MethodGet, "/metrics/history?instance=web-1&environment=prod", ""))
+	if len(page.Entries) != 2 || page.Entries[0].Instance != "web-1" || page.Entries[0].TotalRequests != 100 || page.Entries[1].TotalRequests != 50 {
+		t.Errorf("web-1's entries %+v", page.Entries)
+	}
+	for _, bad := range []string{"aggregate=maybe", "bucket=10ms", "from=yesterday", "from=2026-03-02T12:00:00Z&to=2026-03-02T11:00:00Z"} {
+		expectProblem(t, s.do(http.MethodGet, "/metrics/history?"+bad, ""), http.StatusBadRequest)
+	}
+}
+
+func TestMetricsSampleTagged(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.InstanceID, cfg.Environment = "web-3", "prod" })
+	atomic.AddInt64(&metrics.TotalRequests, 7)
+	newMetricsFlusher(s.metrics, s.clock, time.Minute, 10).flush(context.Background(), true)
+	samples, _ := s.metrics.LoadMetricsHistory(context.Background(), metricsHistoryFilter{Environment: "prod", From: testStart.Add(-time.Minute), To: testStart.Add(time.Minute)})
+	if len(samples) != 1 || samples[0].Instance != "web-3" || samples[0].TotalRequests != 7 || !samples[0].At.Equal(testStart) {
+		t.Errorf("samples %+v, want one from web-3", samples)
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gorm.io/gorm"
+)
+
+// MetricsStore persists the request counters. Every instance of the service
+// adds what it counted since its last flush, so the stored totals cover the
+// whole fleet; see flushMetrics.
+type MetricsStore interface {
+	// AddMetrics adds delta to the stored totals in a single write.
+	AddMetrics(ctx context.Context, delta Metrics) error
+	// LoadMetrics returns the stored totals.
+	LoadMetrics(ctx context.Context) (Metrics, error)
+	// AddClientMetrics adds each delta to its client's stored counts, then
+	// folds every client but the keep with the most requests into the
+	// otherClients entry, so the stored clients stay bounded too.
+	AddClientMetrics(ctx context.Context, deltas []ClientMetrics, keep int) error
+	// LoadClientMetrics returns every stored client, otherClients included.
+	LoadClientMetrics(ctx context.Context) ([]ClientMetrics, error)
+	// SaveRateLimitSnapshot replaces the stored rate limit snapshot.
+	SaveRateLimitSnapshot(ctx context.Context, snapshot []byte) error
+	// LoadRateLimitSnapshot returns the stored rate limit snapshot, or nil if
+	// none has been saved.
+	LoadRateLimitSnapshot(ctx context.Context) ([]byte, error)
+	// AddMetricsSample saves what one instance counted in one flush
+	// interval, for GET /metrics/history.
+	AddMetricsSample(ctx context.Context, sample MetricsSample) error
+	// LoadMetricsHistory returns the samples filter picks, in time order.
+	LoadMetricsHistory(ctx context.Context, filter metricsHistoryFilter) ([]MetricsSample, error)
+}
+
+type InMemoryMetricsStore struct {
+	mu         sync.Mutex
+	metrics    Metrics
+	clients    []ClientMetrics
+	rateLimits []byte
+	history    []MetricsSample
+
+	rateLimitsSavedAt time.Time
+}
+
+func (store *InMemoryMetricsStore) AddMetrics(ctx context.Context, delta Metrics) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.metrics = store.metrics.add(delta)
+	return nil
+}
+
+func (store *InMemoryMetricsStore) LoadMetrics(ctx context.Context) (Metrics, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.metrics, nil
+}
+
+func (store *InMemoryMetricsStore) AddClientMetrics(ctx context.Context, deltas []ClientMetrics, keep int) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	clients, other := mergeClientMetrics(store.clients, deltas)
+	clients, folded := foldClientMetrics(clients, keep)
+	if other = other.add(folded); other.Requests != 0 {
+		clients = append(clients, other)
+	}
+	store.clients = clients
+	return nil
+}
+
+func (store *InMemoryMetricsStore) LoadClientMetrics(ctx context.Context) ([]ClientMetrics, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return append([]ClientMetrics(nil), store.clients...), nil
+}
+
+// PostgresMetricsStore keeps the totals in the single row of the metrics
+// table from migrations/postgres.
+type PostgresMetricsStore struct {
+	pool *pgxpool.Pool
+}
+
+func NewPostgresMetricsStore(pool *pgxpool.Pool) *PostgresMetricsStore {
+	return &PostgresMetricsStore{pool: pool}
+}
+
+func (store *PostgresMetricsStore) AddMetrics(ctx context.Context, delta Metrics) error {
+	_, err := store.pool.Exec(ctx, `INSERT INTO metrics (id, total_requests, total_errors, total_albums_fetched,
+		 total_albums_added, total_rate_limited, total_latency_ms, saved_at)
+		 VALUES (1, $1, $2, $3, $4, $5, $6, now())
+		 ON CONFLICT (id) DO UPDATE SET total_requests = metrics.total_requests + EXCLUDED.total_requests,
+		 total_errors = metrics.total_errors + EXCLUDED.total_errors,
+		 total_albums_fetched = metrics.total_albums_fetched + EXCLUDED.total_albums_fetched,
+		 total_albums_added = metrics.total_albums_added + EXCLUDED.total_albums_added,
+		 total_rate_limited = metrics.total_rate_limited + EXCLUDED.total_rate_limited,
+		 total_latency_ms = metrics.total_latency_ms + EXCLUDED.total_latency_ms,
+		 saved_at = EXCLUDED.saved_at`,
+		delta.TotalRequests, delta.TotalErrors, delta.TotalAlbumsFetched, delta.TotalAlbumsAdded, delta.TotalRateLimited, delta.TotalLatencyMs)
+	return err
+}
+
+func (store *PostgresMetricsStore) LoadMetrics(ctx context.Context) (Metrics, error) {
+	var m Metrics
+	err := store.pool.QueryRow(ctx, `SELECT total_requests, total_errors, total_albums_fetched, total_albums_added,
+		 total_rate_limited, total_latency_ms FROM metrics WHERE id = 1`).
+		Scan(&m.TotalRequests, &m.TotalErrors, &m.TotalAlbumsFetched, &m.TotalAlbumsAdded, &m.TotalRateLimited, &m.TotalLatencyMs)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Metrics{}, nil
+	}
+	return m, err
+}
+
+// AddClientMetrics upserts every delta in one statement, then moves the
+// clients past keep into the otherClients row, in one transaction so
+// instances folding at once can't count a client twice.
+func (store *PostgresMetricsStore) AddClientMetrics(ctx context.Context, deltas []ClientMetrics, keep int) error {
+	clients := make([]string, len(deltas))
+	requests := make([]int64, len(deltas))
+	errs := make([]int64, len(deltas))
+	seen := make([]time.Time, len(deltas))
+	for i, d := range deltas {
+		clients[i], requests[i], errs[i], seen[i] = d.Client, d.Requests, d.Errors, d.LastSeen
+	}
+	const upsert = ` ON CONFLICT (client) DO UPDATE SET requests = client_metrics.requests + EXCLUDED.requests,
+		 errors = client_metrics.errors + EXCLUDED.errors,
+		 last_seen = GREATEST(client_metrics.last_seen, EXCLUDED.last_seen)`
+	return store.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `INSERT INTO client_metrics (client, requests, errors, last_seen)
+			 SELECT * FROM unnest($1::text[], $2::bigint[], $3::bigint[], $4::timestamptz[])`+upsert,
+			clients, requests, errs, seen)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(ctx, `WITH folded AS (
+			   DELETE FROM client_metrics WHERE client <> $1 AND client NOT IN (
+			     SELECT client FROM client_metrics WHERE client <> $1 ORDER BY requests DESC, client LIMIT $2)
+			   RETURNING requests, errors, last_seen)
+			 INSERT INTO client_metrics (client, requests, errors, last_seen)
+			 SELECT $1, sum(requests), sum(errors), max(last_seen) FROM folded HAVING count(*) > 0`+upsert,
+			otherClients, keep)
+		return err
+	})
+}
+
+func (store *PostgresMetricsStore) LoadClientMetrics(ctx context.Context) ([]ClientMetrics, error) {
+	rows, err := store.pool.Query(ctx, `SELECT client, requests, errors, last_seen FROM client_metrics`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var clients []ClientMetrics
+	for rows.Next() {
+		var c ClientMetrics
+		if err := rows.Scan(&c.Client, &c.Requests, &c.Errors, &c.LastSeen); err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
+}
+
+// SqliteMetricsStore keeps the totals in the single row of the metrics table
+// from migrations/sqlite.
+type SqliteMetricsStore struct {
+	db *gorm.DB
+}
+
+func NewSqliteMetricsStore(db *gorm.DB) *SqliteMetricsStore {
+	return &SqliteMetricsStore{db: db}
+}
+
+func (store *SqliteMetricsStore) AddMetrics(ctx context.Context, delta Metrics) error {
+	return store.db.WithContext(ctx).Exec(`INSERT INTO metrics (id, total_requests, total_errors, total_albums_fetched,
+		 total_albums_added, total_rate_limited, total_latency_ms, saved_at)
+		 VALUES (1, ?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT (id) DO UPDATE SET total_requests = total_requests + excluded.total_requests,
+		 total_errors = total_errors + excluded.total_errors,
+		 total_albums_fetched = total_albums_fetched + excluded.total_albums_fetched,
+		 total_albums_added = total_albums_added + excluded.total_albums_added,
+		 total_rate_limited = total_rate_limited + excluded.total_rate_limited,
+		 total_latency_ms = total_latency_ms + excluded.total_latency_ms,
+		 saved_at = excluded.saved_at`,
+		delta.TotalRequests, delta.TotalErrors, delta.TotalAlbumsFetched, delta.TotalAlbumsAdded, delta.TotalRateLimited, delta.TotalLatencyMs,
+		time.Now().UTC()).Error
+}
+
+func (store *SqliteMetricsStore) LoadMetrics(ctx context.Context) (Metrics, error) {
+	var m Metrics
+	err := store.db.WithContext(ctx).Raw(`SELECT total_requests, total_errors, total_albums_fetched, total_albums_added,
+		 total_rate_limited, total_latency_ms FROM metrics WHERE id = 1`).Row().
+		Scan(&m.TotalRequests, &m.TotalErrors, &m.TotalAlbumsFetched, &m.TotalAlbumsAdded, &m.TotalRateLimited, &m.TotalLatencyMs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Metrics{}, nil
+	}
+	return m, err
+}
+
+// AddClientMetrics upserts the deltas and moves the clients past keep into
+// the otherClients row in one transaction.
+func (store *SqliteMetricsStore) AddClientMetrics(ctx context.Context, deltas []ClientMetrics, keep int) error {
+	const upsert = ` ON CONFLICT (client) DO UPDATE SET requests = requests + excluded.requests,
+		 errors = errors + excluded.errors,
+		 last_seen = max(last_seen, excluded.last_seen)`
+	const past = `client <> ? AND client NOT IN (
+		 SELECT client FROM client_metrics WHERE client <> ? ORDER BY requests DESC, client LIMIT ?)`
+	return store.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, d := range deltas {
+			err := tx.Exec(`INSERT INTO client_metrics (client, requests, errors, last_seen) VALUES (?, ?, ?, ?)`+upsert,
+				d.Client, d.Requests, d.Errors, d.LastSeen.UTC()).Error
+			if err != nil {
+				return err
+			}
+		}
+		err := tx.Exec(`INSERT INTO client_metrics (client, requests, errors, last_seen)
+			 SELECT ?, sum(requests), sum(errors), max(last_seen) FROM client_metrics WHERE `+past+` HAVING count(*) > 0`+upsert,
+			otherClients, otherClients, otherClients, keep).Error
+		if err != nil {
+			return err
+		}
+		return tx.Exec(`DELETE FROM client_metrics WHERE `+past, otherClients, otherClients, keep).Error
+	})
+}
+
+func (store *SqliteMetricsStore) LoadClientMetrics(ctx context.Context) ([]ClientMetrics, error) {
+	rows, err := store.db.WithContext(ctx).Raw(`SELECT client, requests, errors, last_seen FROM client_metrics`).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var clients []ClientMetrics
+	for rows.Next() {
+		var c ClientMetrics
+		if err := rows.Scan(&c.Client, &c.Requests, &c.Errors, &c.LastSeen); err != nil {
+			return nil, err
+		}
+		clients = append(clients, c)
+	}
+	return clients, rows.Err()
+}
+
+// MongoMetricsStore keeps the totals in one document of the metrics
+// collection, the clients' counts in the clientMetrics collection, one
+// document per client, and the metrics history in the metricsHistory
+// collection.
+type MongoMetricsStore struct {
+	collection *mongo.Collection
+	clients    *mongo.Collection
+	history    *mongo.Collection
+}
+
+const mongoMetricsID = "totals"
+
+func NewMongoMetricsStore(collection, clients, history *mongo.Collection) *MongoMetricsStore {
+	return &MongoMetricsStore{collection: collection, clients: clients, history: history}
+}
+
+func (store *MongoMetricsStore) AddMetrics(ctx context.Context, delta Metrics) error {
+	_, err := store.collection.UpdateOne(ctx, bson.D{{Key: "_id", Value: mongoMetricsID}}, bson.D{
+		{Key: "$inc", Value: bson.D{
+			{Key: "totalRequests", Value: delta.TotalRequests},
+			{Key: "totalErrors", Value: delta.TotalErrors},
+			{Key: "totalAlbumsFetched", Value: delta.TotalAlbumsFetched},
+			{Key: "totalAlbumsAdded", Value: delta.TotalAlbumsAdded},
+			{Key: "totalRateLimited", Value: delta.TotalRateLimited},
+			{Key: "totalLatencyMs", Value: delta.TotalLatencyMs},
+		}},
+		{Key: "$currentDate", Value: bson.D{{Key: "savedAt", Value: true}}},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+func (store *MongoMetricsStore) LoadMetrics(ctx context.Context) (Metrics, error) {
+	var doc struct {
+		TotalRequests      int64 `bson:"totalRequests"`
+		TotalErrors        int64 `bson:"totalErrors"`
+		TotalAlbumsFetched int64 `bson:"totalAlbumsFetched"`
+		TotalAlbumsAdded   int64 `bson:"totalAlbumsAdded"`
+		TotalRateLimited   int64 `bson:"totalRateLimited"`
+		TotalLatencyMs     int64 `bson:"totalLatencyMs"`
+	}
+	err := store.collection.FindOne(ctx, bson.D{{Key: "_id", Value: mongoMetricsID}}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return Metrics{}, nil
+	}
+	return Metrics(doc), err
+}
+
+// mongoClientMetrics is a client's document in the clientMetrics collection.
+type mongoClientMetrics struct {
+	Client   string    `bson:"_id"`
+	Requests int64     `bson:"requests"`
+	Errors   int64     `bson:"errors"`
+	LastSeen time.Time `bson:"lastSeen"`
+}
+
+func (store *MongoMetricsStore) addClient(ctx context.Context, d ClientMetrics) error {
+	_, err := store.clients.UpdateOne(ctx, bson.D{{Key: "_id", Value: d.Client}}, bson.D{
+		{Key: "$inc", Value: bson.D{{Key: "requests", Value: d.Requests}, {Key: "errors", Value: d.Errors}}},
+		{Key: "$max", Value: bson.D{{Key: "lastSeen", Value: d.LastSeen}}},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+// AddClientMetrics upserts the deltas, then moves the clients past keep into
+// the otherClients document one at a time. Each is deleted before it is
+// added to otherClients, so instances folding at once can't count a client
+// twice.
+func (store *MongoMetricsStore) AddClientMetrics(ctx context.Context, deltas []ClientMetrics, keep int) error {
+	for _, d := range deltas {
+		if err := store.addClient(ctx, d); err != nil {
+			return err
+		}
+	}
+	named := bson.D{{Key: "_id", Value: bson.D{{Key: "$ne", Value: otherClients}}}}
+	cur, err := store.clients.Find(ctx, named, options.Find().
+		SetSort(bson.D{{Key: "requests", Value: -1}, {Key: "_id", Value: 1}}).
+		SetSkip(int64(keep)).
+		SetProjection(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	var past []mongoClientMetrics
+	if err := cur.All(ctx, &past); err != nil {
+		return err
+	}
+	for _, p := range past {
+		var doc mongoClientMetrics
+		err := store.clients.FindOneAndDelete(ctx, bson.D{{Key: "_id", Value: p.Client}}).Decode(&doc)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := store.addClient(ctx, ClientMetrics{Client: otherClients, Requests: doc.Requests, Errors: doc.Errors, LastSeen: doc.LastSeen}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *MongoMetricsStore) LoadClientMetrics(ctx context.Context) ([]ClientMetrics, error) {
+	cur, err := store.clients.Find(ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+	var docs []mongoClientMetrics
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	clients := make([]ClientMetrics, len(docs))
+	for i, doc := range docs {
+		clients[i] = ClientMetrics(doc)
+		clients[i].LastSeen = doc.LastSeen.UTC()
+	}
+	return clients, nil
+}
+
+// DynamoMetricsStore keeps the totals in one item of the metrics table,
+// updated with ADD so concurrent instances don't overwrite each other, and
+// the clients' counts in the clientMetrics table, one item per client.
+type DynamoMetricsStore struct {
+	client *dynamodb.Client
+}
+
+const (
+	dynamoMetricsTable       = "metrics"
+	dynamoMetricsID          = "totals"
+	dynamoClientMetricsTable = "clientMetrics"
+)
+
+func NewDynamoMetricsStore(client *dynamodb.Client) *DynamoMetricsStore {
+	return &DynamoMetricsStore{client: client}
+}
+
+func (store *DynamoMetricsStore) AddMetrics(ctx context.Context, delta Metrics) error {
+	n := func(v int64) types.AttributeValue {
+		return &types.AttributeValueMemberN{Value: strconv.FormatInt(v, 10)}
+	}
+	_, err := store.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(dynamoMetricsTable),
+		Key:       map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: dynamoMetricsID}},
+		UpdateExpression: aws.String("ADD totalRequests :requests, totalErrors :errors, totalAlbumsFetched :fetched, " +
+			"totalAlbumsAdded :added, totalRateLimited :limited, totalLatencyMs :latency SET savedAt = :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":requests": n(delta.TotalRequests),
+			":errors":   n(delta.TotalErrors),
+			":fetched":  n(delta.TotalAlbumsFetched),
+			":added":    n(delta.TotalAlbumsAdded),
+			":limited":  n(delta.TotalRateLimited),
+			":latency":  n(delta.TotalLatencyMs),
+			":now":      &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+		},
+	})
+	return err
+}
+
+func (store *DynamoMetricsStore) LoadMetrics(ctx context.Context) (Metrics, error) {
+	res, err := store.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(dynamoMetricsTable),
+		Key:            map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: dynamoMetricsID}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || res.Item == nil {
+		return Metrics{}, err
+	}
+	var item struct {
+		TotalRequests      int64 `dynamodbav:"totalRequests"`
+		TotalErrors        int64 `dynamodbav:"totalErrors"`
+		TotalAlbumsFetched int64 `dynamodbav:"totalAlbumsFetched"`
+		TotalAlbumsAdded   int64 `dynamodbav:"totalAlbumsAdded"`
+		TotalRateLimited   int64 `dynamodbav:"totalRateLimited"`
+		TotalLatencyMs     int64 `dynamodbav:"totalLatencyMs"`
+	}
+	if err := attributevalue.UnmarshalMap(res.Item, &item); err != nil {
+		return Metrics{}, err
+	}
+	return Metrics(item), nil
+}
+
+// dynamoClientMetrics is a client's item in the clientMetrics table, keyed
+// by client.
+type dynamoClientMetrics struct {
+	Client   string    `dynamodbav:"client"`
+	Requests int64     `dynamodbav:"requests"`
+	Errors   int64     `dynamodbav:"errors"`
+	LastSeen time.Time `dynamodbav:"lastSeen"`
+}
+
+// addClient adds d to its client's item. An update expression can't take
+// the later of two times, so lastSeen is set by a second update only when
+// d's is later; RFC 3339 times to the second compare correctly as strings.
+func (store *DynamoMetricsStore) addClient(ctx context.Context, d ClientMetrics) error {
+	key := map[string]types.AttributeValue{"client": &types.AttributeValueMemberS{Value: d.Client}}
+	_, err := store.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(dynamoClientMetricsTable),
+		Key:              key,
+		UpdateExpression: aws.String("ADD requests :requests, errors :errors"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":requests": &types.AttributeValueMemberN{Value: strconv.FormatInt(d.Requests, 10)},
+			":errors":   &types.AttributeValueMemberN{Value: strconv.FormatInt(d.Errors, 10)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = store.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(dynamoClientMetricsTable),
+		Key:                       key,
+		UpdateExpression:          aws.String("SET lastSeen = :seen"),
+		ConditionExpression:       aws.String("attribute_not_exists(lastSeen) OR lastSeen < :seen"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":seen": &types.AttributeValueMemberS{Value: d.LastSeen.UTC().Format(time.RFC3339)}},
+	})
+	var stale *types.ConditionalCheckFailedException
+	if errors.As(err, &stale) {
+		return nil
+	}
+	return err
+}
+
+// AddClientMetrics adds the deltas, then moves the clients past keep into
+// the otherClients item. Each is deleted before it is added to
+// otherClients, so instances folding at once can't count a client twice.
+func (store *DynamoMetricsStore) AddClientMetrics(ctx context.Context, deltas []ClientMetrics, keep int) error {
+	for _, d := range deltas {
+		if err := store.addClient(ctx, d); err != nil {
+			return err
+		}
+	}
+	clients, err := store.LoadClientMetrics(ctx)
+	if err != nil {
+		return err
+	}
+	kept, _ := foldClientMetrics(clients, keep)
+	keepers := make(map[string]bool, len(kept))
+	for _, c := range kept {
+		keepers[c.Client] = true
+	}
+	for _, c := range clients {
+		if keepers[c.Client] || c.Client == otherClients {
+			continue
+		}
+		res, err := store.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName:    aws.String(dynamoClientMetricsTable),
+			Key:          map[string]types.AttributeValue{"client": &types.AttributeValueMemberS{Value: c.Client}},
+			ReturnValues: types.ReturnValueAllOld,
+		})
+		if err != nil {
+			return err
+		}
+		if res.Attributes == nil {
+			continue // another instance folded it first
+		}
+		var item dynamoClientMetrics
+		if err := attributevalue.UnmarshalMap(res.Attributes, &item); err != nil {
+			return err
+		}
+		if err := store.addClient(ctx, ClientMetrics{Client: otherClients, Requests: item.Requests, Errors: item.Errors, LastSeen: item.LastSeen}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *DynamoMetricsStore) LoadClientMetrics(ctx context.Context) ([]ClientMetrics, error) {
+	var clients []ClientMetrics
+	pages := dynamodb.NewScanPaginator(store.client, &dynamodb.ScanInput{TableName: aws.String(dynamoClientMetricsTable), ConsistentRead: aws.Bool(true)})
+	for pages.HasMorePages() {
+		page, err := pages.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var items []dynamoClientMetrics
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			clients = append(clients, ClientMetrics(item))
+		}
+	}
+	return clients, nil
+}
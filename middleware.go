@@ -0,0 +1,182 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"sort"
+)
+
+// middlewareOrder is every layer a server's chain can have, outermost
+// first. newMiddlewareChain sorts the layers a server picks into this
+// order, so these hold however the chain is put together:
+//
+//   - timing comes first, so X-Response-Time covers every other layer.
+//   - origin comes next, so everything after it logs, limits, and builds
+//     links for the real client.
+//   - metrics and logging see the final status of every request, so they
+//     sit outside recovery and count a panic as the 500 it answers.
+//   - recovery is outside everything else that can panic.
+//   - requestBody is outside every layer that reads a body, so none of them
+//     can be held up by a slow or oversized one.
+//   - cors is outside every layer that can refuse a request, so that a
+//     browser can read the refusal.
+//   - loadShedding and rateLimit turn requests away before apiKey checks
+//     their keys, so a client over its limit never gets as far as a 401.
+//     Working out whose limit a request counts against still reads its key,
+//     through the key cache, which remembers unknown keys too: a flood
+//     repeating one bad key costs a single lookup, but one of made-up keys
+//     costs a lookup each.
+//   - syncToken is outside responseCache, so the token a write answers
+//     with is asked for after the write has dropped the cache.
+//   - responseCache is innermost, so a cached answer is only served to a
+//     request every other layer let through, and counts against its limits.
+//
+// The routes' own guards, requireClientCert and disconnectMiddleware, are
+// inside all of these.
+var middlewareOrder = []string{
+	"timing",
+	"origin",
+	"metrics",
+	"logging",
+	"recovery",
+	"requestBody",
+	"bodyLogging",
+	"cors",
+	"noStore",
+	"maintenance",
+	"loadShedding",
+	"rateLimit",
+	"apiKey",
+	"syncToken",
+	"responseCache",
+}
+
+// middleware is one named layer of a chain.
+type middleware struct {
+	name string
+	wrap func(http.Handler) http.Handler
+}
+
+// middlewareChain is a server's layers, outermost first.
+type middlewareChain []middleware
+
+// newMiddlewareChain puts layers into middlewareOrder. A layer that isn't
+// in it is a bug, and panics.
+func newMiddlewareChain(layers ...middleware) middlewareChain {
+	chain := append(middlewareChain(nil), layers...)
+	for _, m := range chain {
+		if !slices.Contains(middlewareOrder, m.name) {
+			panic("middleware " + m.name + " is not in middlewareOrder")
+		}
+	}
+	sort.SliceStable(chain, func(i, j int) bool {
+		return slices.Index(middlewareOrder, chain[i].name) < slices.Index(middlewareOrder, chain[j].name)
+	})
+	return chain
+}
+
+// then wraps h in the chain.
+func (c middlewareChain) then(h http.Handler) http.Handler {
+	for i := len(c) - 1; i >= 0; i-- {
+		h = c[i].wrap(h)
+	}
+	return h
+}
+
+// names lists the layers, outermost first.
+func (c middlewareChain) names() []string {
+	names := make([]string, len(c))
+	for i, m := range c {
+		names[i] = m.name
+	}
+	return names
+}
+
+// apiMiddleware is the chain of the API server. Load shedding is only in it
+// when MAX_IN_FLIGHT is set.
+func apiMiddleware(cfg *Config) middlewareChain {
+	layers := []middleware{
+		{"timing", timingMiddleware},
+		{"origin", originMiddleware},
+		{"metrics", metricsMiddleware},
+		{"logging", loggingMiddleware},
+		{"recovery", recoveryMiddleware},
+		{"requestBody", requestBodyMiddleware},
+		{"bodyLogging", bodyLoggingMiddleware},
+		{"cors", corsMiddleware},
+		{"noStore", noStoreMiddleware},
+		{"maintenance", maintenanceMiddleware},
+		{"rateLimit", rateLimitingMiddleware},
+		{"apiKey", apiKeyMiddleware},
+		{"syncToken", syncTokenMiddleware},
+		{"responseCache", responseCacheMiddleware},
+	}
+	if cfg.MaxInFlight > 0 {
+		layers = append(layers, middleware{"loadShedding", setupLoadShedding(cfg)})
+	}
+	return newMiddlewareChain(layers...)
+}
+
+// opsMiddleware is the chain of the admin server on ADMIN_ADDR, which is
+// never limited: operators must be able to reach it when the API is busy.
+func opsMiddleware() middlewareChain {
+	return newMiddlewareChain(
+		middleware{"timing", timingMiddleware},
+		middleware{"origin", originMiddleware},
+		middleware{"metrics", metricsMiddleware},
+		middleware{"logging", loggingMiddleware},
+		middleware{"recovery", recoveryMiddleware},
+		middleware{"requestBody", requestBodyMiddleware},
+		middleware{"noStore", noStoreMiddleware},
+	)
+}
+
+// recoveryMiddleware answers a handler's panic with a 500 and logs it with
+// the stack, and reports it with SENTRY_DSN. A panic after the response was
+// started can't be answered, so it aborts the response instead, as
+// net/http would have.
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &recoveryWriter{ResponseWriter: w}
+		inner := captureForReport(r)
+		defer func() {
+			// The ServeMux sets the pattern on the request it is given, and
+			// the middleware outside counts requests by route.
+			r.Pattern = inner.Pattern
+			p := recover()
+			switch {
+			case p == nil:
+				return
+			case p == http.ErrAbortHandler:
+				panic(p)
+			}
+			log.Printf("💥 Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, p, debug.Stack())
+			reportPanic(inner, p)
+			if rw.started {
+				panic(http.ErrAbortHandler)
+			}
+			writeProblem(w, r, http.StatusInternalServerError, "internal server error")
+		}()
+		next.ServeHTTP(rw, inner)
+	})
+}
+
+// recoveryWriter records whether the response was started.
+type recoveryWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *recoveryWriter) WriteHeader(code int) {
+	w.started = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recoveryWriter) Write(b []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recoveryWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMiddlewareOrder(t *testing.T) {
+	newTestServer(t)
+	got := strings.Join(apiMiddleware(&Config{MaxInFlight: 1}).names(), " ")
+	if want := strings.Join(middlewareOrder, " "); got != want {
+		t.Errorf("the API chain is\n%s\nwant\n%s", got, want)
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("a layer missing from middlewareOrder was accepted")
+		}
+	}()
+	newMiddlewareChain(middleware{"tracing", func(h http.Handler) http.Handler { return h }})
+}
+
+// TestPanicCountedAs500 checks that metrics and logging, outside recovery,
+// see the 500 a panic is answered with.
+func TestPanicCountedAs500(t *testing.T) {
+	newTestServer(t)
+	logs := captureLog(t)
+	requests, errs := atomic.LoadInt64(&metrics.TotalRequests), atomic.LoadInt64(&metrics.TotalErrors)
+	h := apiMiddleware(currentConfig()).then(http.HandlerFunc(func(http.ResponseWriter, *http.Request) { panic("boom") }))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/albums", nil))
+
+	expectProblem(t, w, http.StatusInternalServerError)
+	if n := atomic.LoadInt64(&metrics.TotalRequests) - requests; n != 1 {
+		t.Errorf("%d requests counted, want 1", n)
+	}
+	if n := atomic.LoadInt64(&metrics.TotalErrors) - errs; n != 1 {
+		t.Errorf("%d errors counted, want the 500", n)
+	}
+	if line := logs.take(); !strings.Contains(line, "GET /albums from 192.0.2.1 -> 500") {
+		t.Errorf("access log %q, want the 500", line)
+	}
+}
+
+// TestRateLimitBeforeAPIKey checks that a client over its limit is turned
+// away by the limiter before apiKey sees its key.
+func TestRateLimitBeforeAPIKey(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.RateLimitRequests = 2 })
+	logs := captureLog(t)
+	store := &countingAPIKeyStore{InMemoryAPIKeyStore: NewInMemoryAPIKeyStore()}
+	apiKeyStore = store
+
+	const bad = apiKeyPrefix + "00000000-0000-0000-0000-000000000000_nope"
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests, http.StatusTooManyRequests} {
+		w := s.do(http.MethodGet, "/albums", "", "Authorization", "Bearer "+bad)
+		if w.Code != want {
+			t.Errorf("request %d = %d, want %d", i+1, w.Code, want)
+		}
+		if auth := w.Header().Get("WWW-Authenticate"); (want == http.StatusTooManyRequests) != (auth == "") {
+			t.Errorf("request %d: WWW-Authenticate %q", i+1, auth)
+		}
+	}
+	if n := strings.Count(logs.take(), "Rejected API key"); n != 2 {
+		t.Errorf("apiKey rejected %d requests, want the 2 let through", n)
+	}
+	// The limiter's lookups of the one bad key are answered from the cache.
+	if n := store.gets.Load(); n != 1 {
+		t.Errorf("%d key lookups, want 1", n)
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// migrationFiles holds the schema for the SQL backends, one directory per
+// dialect. Files are named NNNN_description.up.sql and NNNN_description.down.sql
+// and are applied in version order. An up file whose first line is
+// "-- requires: <feature>" is left pending, and applied later, while the
+// database lacks the feature; see migrationTarget.supports.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+type migration struct {
+	version  int
+	name     string
+	up, down string
+	requires string // optional database feature, from the up file's first line
+}
+
+// loadMigrations reads the migrations for dialect ("postgres" or "sqlite"),
+// sorted by version. Every version needs both an up and a down file.
+func loadMigrations(dialect string) ([]migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", dir, err)
+	}
+	byVersion := map[int]*migration{}
+	for _, entry := range entries {
+		base := strings.TrimSuffix(entry.Name(), ".sql")
+		direction := path.Ext(base)
+		base = strings.TrimSuffix(base, direction)
+		prefix, name, ok := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || (direction != ".up" && direction != ".down") {
+			return nil, fmt.Errorf("%s/%s: want NNNN_name.up.sql or NNNN_name.down.sql", dir, entry.Name())
+		}
+		body, err := fs.ReadFile(migrationFiles, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m := byVersion[version]
+		if m == nil {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		}
+		if direction == ".up" {
+			m.up = string(body)
+			first, _, _ := strings.Cut(m.up, "\n")
+			if feature, ok := strings.CutPrefix(strings.TrimSpace(first), "-- requires:"); ok {
+				m.requires = strings.TrimSpace(feature)
+			}
+		} else {
+			m.down = string(body)
+		}
+	}
+	list := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("%s: migration %04d_%s needs both an up and a down file", dir, m.version, m.name)
+		}
+		list = append(list, *m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].version < list[j].version })
+	return list, nil
+}
+
+// migrationTarget is a database migrations are applied to. Applied versions
+// are recorded in its schema_migrations table.
+type migrationTarget interface {
+	// applied returns when each recorded version was applied, creating
+	// schema_migrations on first use.
+	applied(ctx context.Context) (map[int]time.Time, error)
+	// run executes m's up or down script and records or removes its version,
+	// in one transaction.
+	run(ctx context.Context, m migration, up bool) error
+	// supports reports whether the database has an optional feature a
+	// migration requires.
+	supports(ctx context.Context, feature string) (bool, error)
+}
+
+const createSchemaMigrations = `CREATE TABLE IF NOT EXISTS schema_migrations (
+	version BIGINT PRIMARY KEY,
+	applied_at TIMESTAMP NOT NULL
+)`
+
+type postgresMigrations struct {
+	pool *pgxpool.Pool
+}
+
+func (t postgresMigrations) applied(ctx context.Context) (map[int]time.Time, error) {
+	if _, err := t.pool.Exec(ctx, createSchemaMigrations); err != nil {
+		return nil, fmt.Errorf("creating schema_migrations: %w", err)
+	}
+	rows, err := t.pool.Query(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	versions := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		versions[version] = at
+	}
+	return versions, rows.Err()
+}
+
+func (t postgresMigrations) run(ctx context.Context, m migration, up bool) error {
+	return t.pool.BeginFunc(ctx, func(tx pgx.Tx) error {
+		// No arguments, so pgx uses the simple protocol and a script may
+		// hold several statements.
+		if up {
+			if _, err := tx.Exec(ctx, m.up); err != nil {
+				return err
+			}
+			_, err := tx.Exec(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)`, m.version, time.Now().UTC())
+			return err
+		}
+		if _, err := tx.Exec(ctx, m.down); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `DELETE FROM schema_migrations WHERE version = $1`, m.version)
+		return err
+	})
+}
+
+// supports knows about "pg_trgm", once the extension is installed in the
+// database.
+func (t postgresMigrations) supports(ctx context.Context, feature string) (bool, error) {
+	if feature != "pg_trgm" {
+		return false, nil
+	}
+	var installed bool
+	err := t.pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pg_trgm')`).Scan(&installed)
+	return installed, err
+}
+
+type sqliteMigrations struct {
+	db *sql.DB
+}
+
+// supports knows about "fts5", which go-sqlite3 only compiles in with the
+// sqlite_fts5 build tag.
+func (t sqliteMigrations) supports(ctx context.Context, feature string) (bool, error) {
+	if feature != "fts5" {
+		return false, nil
+	}
+	return sqliteHasFTS5(ctx, t.db)
+}
+
+func (t sqliteMigrations) applied(ctx context.Context) (map[int]time.Time, error) {
+	if _, err := t.db.ExecContext(ctx, createSchemaMigrations); err != nil {
+		return nil, fmt.Errorf("creating schema_migrations: %w", err)
+	}
+	rows, err := t.db.QueryContext(ctx, `SELECT version, applied_at FROM schema_migrations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	versions := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		versions[version] = at
+	}
+	return versions, rows.Err()
+}
+
+func (t sqliteMigrations) run(ctx context.Context, m migration, up bool) error {
+	tx, err := t.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if up {
+		if _, err := tx.ExecContext(ctx, m.up); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`, m.version, time.Now().UTC())
+	} else {
+		if _, err := tx.ExecContext(ctx, m.down); err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations WHERE version = ?`, m.version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateUp applies every pending migration in order and returns how many it
+// applied. Migrations requiring a feature the database lacks are skipped.
+func migrateUp(ctx context.Context, target migrationTarget, migrations []migration) (int, error) {
+	applied, err := target.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		if m.requires != "" {
+			ok, err := target.supports(ctx, m.requires)
+			if err != nil {
+				return n, fmt.Errorf("checking %04d_%s: %w", m.version, m.name, err)
+			}
+			if !ok {
+				log.Printf("🗄️ Skipped migration %04d_%s: the database lacks %s", m.version, m.name, m.requires)
+				continue
+			}
+		}
+		if err := target.run(ctx, m, true); err != nil {
+			return n, fmt.Errorf("applying %04d_%s: %w", m.version, m.name, err)
+		}
+		log.Printf("🗄️ Applied migration %04d_%s", m.version, m.name)
+		n++
+	}
+	return n, nil
+}
+
+// migrateDown reverts the most recently applied steps migrations and returns
+// how many it reverted.
+func migrateDown(ctx context.Context, target migrationTarget, migrations []migration, steps int) (int, error) {
+	applied, err := target.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for i := len(migrations) - 1; i >= 0 && n < steps; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		if err := target.run(ctx, m, false); err != nil {
+			return n, fmt.Errorf("reverting %04d_%s: %w", m.version, m.name, err)
+		}
+		log.Printf("🗄️ Reverted migration %04d_%s", m.version, m.name)
+		n++
+	}
+	return n, nil
+}
+
+// migrateOnStartup applies pending migrations for dialect unless
+// RUN_MIGRATIONS=false, which operators who run `migrate up` themselves set.
+func migrateOnStartup(cfg *Config, target migrationTarget, dialect string) error {
+	if !cfg.RunMigrations {
+		return nil
+	}
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		return err
+	}
+	_, err = migrateUp(context.Background(), target, migrations)
+	return err
+}
+
+const defaultSQLiteDSN = "file:metrics.db?cache=shared&_fk=1"
+
+// openSQLite opens the SQLite database at dsn with a single connection.
+// SQLite takes one writer at a time, and connections sharing a cache fail
+// with "database table is locked" instead of waiting for each other, so
+// concurrent requests queue for the connection instead.
+func openSQLite(dsn string, config *gorm.Config) (*gorm.DB, *sql.DB, error) {
+	db, err := gorm.Open(sqlite.Open(dsn), config)
+	if err != nil {
+		return nil, nil, err
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, nil, err
+	}
+	sqlDB.SetMaxOpenConns(1)
+	return db, sqlDB, nil
+}
+
+// migrateCommand implements `migrate up|down [n]|status` against the
+// database selected by DB_TYPE and returns the process exit code.
+func migrateCommand(cfg *Config, args []string) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "usage: migrate up | down [n] | status")
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+
+	var target migrationTarget
+	dialect := cfg.DBType
+	switch dialect {
+	case "postgres":
+		pool, err := connectPostgres(cfg)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to connect to PostgreSQL: %v\n", err)
+			return 1
+		}
+		defer pool.Close()
+		target = postgresMigrations{pool: pool}
+	case "sqlite":
+		_, sqlDB, err := openSQLite(cfg.SQLiteDSN, &gorm.Config{})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to connect to SQLite database: %v\n", err)
+			return 1
+		}
+		defer sqlDB.Close()
+		target = sqliteMigrations{db: sqlDB}
+	default:
+		fmt.Fprintln(os.Stderr, "migrate needs DB_TYPE=postgres or DB_TYPE=sqlite")
+		return 2
+	}
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		n, err := migrateUp(ctx, target, migrations)
+		fmt.Printf("Applied %d migration(s)\n", n)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return usage()
+			}
+		}
+		n, err := migrateDown(ctx, target, migrations, steps)
+		fmt.Printf("Reverted %d migration(s)\n", n)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	case "status":
+		applied, err := target.applied(ctx)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, m := range migrations {
+			status := "pending"
+			if m.requires != "" {
+				status += " (requires " + m.requires + ")"
+			}
+			if at, ok := applied[m.version]; ok {
+				status = "applied " + at.UTC().Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", m.version, m.name, status)
+		}
+	default:
+		return usage()
+	}
+	return 0
+}
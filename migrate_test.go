@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"gorm.io/gorm/schema"
+)
+
+// testSQLiteDB opens a scratch SQLite database that goes away with t.
+func testSQLiteDB(t testing.TB) *gorm.DB {
+	t.Helper()
+	db, sqlDB, err := openSQLite("file:"+filepath.Join(t.TempDir(), "test.db")+"?cache=shared&_fk=1", &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	return db
+}
+
+func TestLoadMigrations(t *testing.T) {
+	for _, dialect := range []string{"postgres", "sqlite"} {
+		migrations, err := loadMigrations(dialect)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, m := range migrations {
+			if m.version != i+1 {
+				t.Errorf("%s migration %d is version %d; versions must run 1, 2, ... without gaps", dialect, i, m.version)
+			}
+		}
+	}
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+	ctx := context.Background()
+	db := testSQLiteDB(t)
+	sqlDB, _ := db.DB()
+	target := sqliteMigrations{db: sqlDB}
+	migrations, err := loadMigrations("sqlite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fts, err := sqliteHasFTS5(ctx, sqlDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := 0
+	for _, m := range migrations {
+		if m.requires == "" || fts {
+			want++
+		}
+	}
+
+	if n, err := migrateUp(ctx, target, migrations); err != nil || n != want {
+		t.Fatalf("migrateUp = %d, %v; want %d applied", n, err, want)
+	}
+	if n, err := migrateUp(ctx, target, migrations); err != nil || n != 0 {
+		t.Fatalf("migrateUp again = %d, %v; want nothing applied", n, err)
+	}
+
+	// The final schema has every table the stores use, and every column of
+	// the albums model.
+	m := db.Migrator()
+	for _, table := range []string{"albums", "metrics", "audit_log", "api_keys", "client_metrics", "import_jobs",
+		"rate_limit_snapshot", "metrics_history", "album_changes", "album_change_log", "saved_searches", "payment_events"} {
+		if !m.HasTable(table) {
+			t.Errorf("no %s table after migrating", table)
+		}
+	}
+	model, err := schema.Parse(&sqliteAlbum{}, &sync.Map{}, db.NamingStrategy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range model.Fields {
+		if field.DBName != "" && !m.HasColumn(&sqliteAlbum{}, field.DBName) {
+			t.Errorf("albums has no %s column", field.DBName)
+		}
+	}
+
+	// The stores work against it.
+	albums, err := NewSqliteAlbumStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := albums.Create(ctx, newTestAlbum(withID(newAlbumID()), withBarcode("036000291452")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := albums.GetByBarcode(ctx, "036000291452"); err != nil || got.ID != a.ID {
+		t.Errorf("GetByBarcode = %s, %v; want %s", got.ID, err, a.ID)
+	}
+	ms := NewSqliteMetricsStore(db)
+	if err := ms.AddMetrics(ctx, Metrics{TotalRequests: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := ms.LoadMetrics(ctx); err != nil || got.TotalRequests != 2 {
+		t.Errorf("LoadMetrics = %+v, %v; want 2 requests", got, err)
+	}
+
+	// Down scripts undo their up scripts entirely.
+	if n, err := migrateDown(ctx, target, migrations, len(migrations)); err != nil || n != want {
+		t.Fatalf("migrateDown = %d, %v; want %d reverted", n, err, want)
+	}
+	tables, err := m.GetTables()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		if table != "schema_migrations" && table != "sqlite_sequence" {
+			t.Errorf("%s is left after migrating down", table)
+		}
+	}
+	if n, err := migrateUp(ctx, target, migrations); err != nil || n != want {
+		t.Errorf("migrateUp after migrating down = %d, %v; want %d applied", n, err, want)
+	}
+}
+
+func TestPostgresMigrations(t *testing.T) {
+	pool := testPostgresPool(t)
+	ctx := context.Background()
+	target := postgresMigrations{pool: pool}
+	migrations, err := loadMigrations("postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := target.applied(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := migrateDown(ctx, target, migrations, len(migrations))
+	if err != nil || n != len(applied) {
+		t.Fatalf("migrateDown = %d, %v; want %d reverted", n, err, len(applied))
+	}
+	if n, err := migrateUp(ctx, target, migrations); err != nil || n != len(applied) {
+		t.Fatalf("migrateUp after migrating down = %d, %v; want %d applied", n, err, len(applied))
+	}
+	albums, err := NewPostgresAlbumStore(pool, defaultPostgresQueryTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := albums.Create(ctx, newTestAlbum(withID(newAlbumID()))); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewPostgresMetricsStore(pool).AddMetrics(ctx, Metrics{TotalRequests: 1}); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,23 @@
+-- IF NOT EXISTS adopts albums tables created by releases that set up the
+-- schema in the store constructor.
+CREATE TABLE IF NOT EXISTS albums (
+	seq     BIGSERIAL,
+	id      TEXT PRIMARY KEY,
+	title   TEXT NOT NULL,
+	artist  TEXT NOT NULL,
+	price   DOUBLE PRECISION NOT NULL,
+	genre   TEXT NOT NULL DEFAULT '',
+	slug    TEXT NOT NULL CONSTRAINT albums_slug_key UNIQUE,
+	barcode TEXT CONSTRAINT albums_barcode_key UNIQUE,
+	year    INTEGER NOT NULL DEFAULT 0,
+	tracks  TEXT[] NOT NULL DEFAULT '{}',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+ALTER TABLE albums
+	ADD COLUMN IF NOT EXISTS genre TEXT NOT NULL DEFAULT '',
+	ADD COLUMN IF NOT EXISTS year INTEGER NOT NULL DEFAULT 0,
+	ADD COLUMN IF NOT EXISTS tracks TEXT[] NOT NULL DEFAULT '{}',
+	ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ NOT NULL DEFAULT now();
@@ -0,0 +1,11 @@
+-- A single row of running totals, incremented by AddMetrics.
+CREATE TABLE metrics (
+	id                   SMALLINT PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+	total_requests       BIGINT NOT NULL DEFAULT 0,
+	total_errors         BIGINT NOT NULL DEFAULT 0,
+	total_albums_fetched BIGINT NOT NULL DEFAULT 0,
+	total_albums_added   BIGINT NOT NULL DEFAULT 0,
+	total_rate_limited   BIGINT NOT NULL DEFAULT 0,
+	total_latency_ms     BIGINT NOT NULL DEFAULT 0,
+	saved_at             TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1,10 @@
+CREATE TABLE audit_log (
+	id        TEXT PRIMARY KEY,
+	timestamp TIMESTAMPTZ NOT NULL,
+	action    TEXT NOT NULL,
+	album_id  TEXT,
+	principal TEXT NOT NULL,
+	details   JSONB
+);
+
+CREATE INDEX audit_log_album_id_idx ON audit_log (album_id, timestamp);
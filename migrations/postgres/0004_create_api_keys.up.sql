@@ -0,0 +1,9 @@
+CREATE TABLE api_keys (
+	id           TEXT PRIMARY KEY,
+	name         TEXT NOT NULL,
+	tier         TEXT NOT NULL,
+	secret_hash  TEXT NOT NULL,
+	created_at   TIMESTAMPTZ NOT NULL,
+	last_used_at TIMESTAMPTZ,
+	revoked_at   TIMESTAMPTZ
+);
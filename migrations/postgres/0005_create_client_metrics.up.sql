@@ -0,0 +1,8 @@
+-- Running totals per client, added to by AddClientMetrics, which folds all
+-- but the busiest METRICS_CLIENT_LIMIT clients into the 'other' row.
+CREATE TABLE client_metrics (
+	client    TEXT PRIMARY KEY,
+	requests  BIGINT NOT NULL DEFAULT 0,
+	errors    BIGINT NOT NULL DEFAULT 0,
+	last_seen TIMESTAMPTZ NOT NULL
+);
@@ -0,0 +1,17 @@
+-- CSV imports started by POST /albums/import. cancel_requested is only set
+-- by CancelImportJob, so the worker's progress writes can't clear it.
+CREATE TABLE import_jobs (
+	id               TEXT PRIMARY KEY,
+	state            TEXT NOT NULL,
+	principal        TEXT NOT NULL,
+	rows_processed   INTEGER NOT NULL DEFAULT 0,
+	rows_created     INTEGER NOT NULL DEFAULT 0,
+	rows_failed      INTEGER NOT NULL DEFAULT 0,
+	failures         JSONB NOT NULL DEFAULT '[]',
+	error            TEXT NOT NULL DEFAULT '',
+	cancel_requested BOOLEAN NOT NULL DEFAULT FALSE,
+	created_at       TIMESTAMPTZ NOT NULL,
+	started_at       TIMESTAMPTZ,
+	finished_at      TIMESTAMPTZ,
+	updated_at       TIMESTAMPTZ NOT NULL
+);
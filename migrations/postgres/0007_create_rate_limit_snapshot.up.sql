@@ -0,0 +1,8 @@
+-- A single row holding the last snapshot of the rate limiter and quota
+-- windows, written by SaveRateLimitSnapshot when
+-- RATE_LIMIT_SNAPSHOT_INTERVAL is set.
+CREATE TABLE rate_limit_snapshot (
+	id       SMALLINT PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+	snapshot TEXT NOT NULL,
+	saved_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
@@ -0,0 +1 @@
+DROP TABLE metrics_history;
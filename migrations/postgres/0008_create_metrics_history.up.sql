@@ -0,0 +1,14 @@
+-- What each instance counted in each flush interval, added by
+-- AddMetricsSample and read by GET /metrics/history.
+CREATE TABLE metrics_history (
+	instance             TEXT NOT NULL,
+	environment          TEXT NOT NULL DEFAULT '',
+	at                   TIMESTAMPTZ NOT NULL,
+	total_requests       BIGINT NOT NULL DEFAULT 0,
+	total_errors         BIGINT NOT NULL DEFAULT 0,
+	total_albums_fetched BIGINT NOT NULL DEFAULT 0,
+	total_albums_added   BIGINT NOT NULL DEFAULT 0,
+	total_rate_limited   BIGINT NOT NULL DEFAULT 0,
+	total_latency_ms     BIGINT NOT NULL DEFAULT 0
+);
+CREATE INDEX metrics_history_at_idx ON metrics_history (at, instance);
@@ -0,0 +1,2 @@
+DROP INDEX albums_metadata_idx;
+ALTER TABLE albums DROP COLUMN metadata;
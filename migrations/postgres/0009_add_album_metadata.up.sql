@@ -0,0 +1,4 @@
+-- Free-form string metadata per album. The GIN index serves the
+-- containment match behind ?metadata.<key>= filters.
+ALTER TABLE albums ADD COLUMN metadata JSONB NOT NULL DEFAULT '{}';
+CREATE INDEX albums_metadata_idx ON albums USING GIN (metadata jsonb_path_ops);
@@ -0,0 +1,3 @@
+-- Copies of each album left to sell; sales reported by the payment
+-- provider take them off.
+ALTER TABLE albums ADD COLUMN stock INTEGER NOT NULL DEFAULT 0 CHECK (stock >= 0);
@@ -0,0 +1,4 @@
+DROP TRIGGER albums_record_change ON albums;
+DROP FUNCTION record_album_change();
+DROP TABLE album_change_log;
+DROP TABLE album_changes;
@@ -0,0 +1,41 @@
+-- The change feed behind GET /albums/changes: one row per album insert,
+-- update, or delete, written by a trigger in the same transaction. The
+-- trigger takes a transaction-level advisory lock first, so writers commit
+-- their changes in seq order and a client that has read through a seq never
+-- misses a lower one that commits later.
+CREATE TABLE album_changes (
+	seq        BIGSERIAL PRIMARY KEY,
+	op         TEXT NOT NULL,
+	album_id   TEXT NOT NULL,
+	changed_at TIMESTAMPTZ NOT NULL DEFAULT clock_timestamp()
+);
+
+CREATE INDEX album_changes_changed_at_idx ON album_changes (changed_at);
+
+-- The seq of the newest change the retention janitor has deleted.
+CREATE TABLE album_change_log (
+	id              INTEGER PRIMARY KEY CHECK (id = 1),
+	trimmed_through BIGINT NOT NULL
+);
+
+INSERT INTO album_change_log (id, trimmed_through) VALUES (1, 0);
+
+-- The albums already stored start the feed as created.
+INSERT INTO album_changes (op, album_id) SELECT 'created', id FROM albums ORDER BY seq;
+
+CREATE FUNCTION record_album_change() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_advisory_xact_lock(hashtext('album_changes'));
+	IF TG_OP = 'INSERT' THEN
+		INSERT INTO album_changes (op, album_id) VALUES ('created', NEW.id);
+	ELSIF TG_OP = 'UPDATE' THEN
+		INSERT INTO album_changes (op, album_id) VALUES ('updated', NEW.id);
+	ELSE
+		INSERT INTO album_changes (op, album_id) VALUES ('deleted', OLD.id);
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER albums_record_change AFTER INSERT OR UPDATE OR DELETE ON albums
+	FOR EACH ROW EXECUTE FUNCTION record_album_change();
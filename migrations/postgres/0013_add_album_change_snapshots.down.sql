@@ -0,0 +1,16 @@
+CREATE OR REPLACE FUNCTION record_album_change() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_advisory_xact_lock(hashtext('album_changes'));
+	IF TG_OP = 'INSERT' THEN
+		INSERT INTO album_changes (op, album_id) VALUES ('created', NEW.id);
+	ELSIF TG_OP = 'UPDATE' THEN
+		INSERT INTO album_changes (op, album_id) VALUES ('updated', NEW.id);
+	ELSE
+		INSERT INTO album_changes (op, album_id) VALUES ('deleted', OLD.id);
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE album_change_log DROP COLUMN history_since;
+ALTER TABLE album_changes DROP COLUMN before, DROP COLUMN after;
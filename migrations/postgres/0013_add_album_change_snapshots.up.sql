@@ -0,0 +1,23 @@
+-- Each change keeps the album row as it was before it and as it was left,
+-- for GET /admin/albums/diff: a create has no before, a delete no after.
+-- The changes already stored predate the snapshots; history_since is the
+-- time after which every change has them, and the retention janitor moves
+-- it up to the newest change it deletes.
+ALTER TABLE album_changes ADD COLUMN before JSONB, ADD COLUMN after JSONB;
+
+ALTER TABLE album_change_log ADD COLUMN history_since TIMESTAMPTZ NOT NULL DEFAULT clock_timestamp();
+ALTER TABLE album_change_log ALTER COLUMN history_since DROP DEFAULT;
+
+CREATE OR REPLACE FUNCTION record_album_change() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_advisory_xact_lock(hashtext('album_changes'));
+	IF TG_OP = 'INSERT' THEN
+		INSERT INTO album_changes (op, album_id, after) VALUES ('created', NEW.id, to_jsonb(NEW));
+	ELSIF TG_OP = 'UPDATE' THEN
+		INSERT INTO album_changes (op, album_id, before, after) VALUES ('updated', NEW.id, to_jsonb(OLD), to_jsonb(NEW));
+	ELSE
+		INSERT INTO album_changes (op, album_id, before) VALUES ('deleted', OLD.id, to_jsonb(OLD));
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
@@ -0,0 +1,3 @@
+ALTER TABLE album_change_log DROP COLUMN published_through;
+DROP INDEX albums_available_from_idx;
+ALTER TABLE albums DROP COLUMN available_from, DROP COLUMN available_until;
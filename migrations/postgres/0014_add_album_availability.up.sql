@@ -0,0 +1,8 @@
+-- The window in which an album is listed, either end open when NULL: from
+-- available_from, and before available_until. published_through is how far
+-- the album-publisher job has recorded the embargoes that lifted.
+ALTER TABLE albums ADD COLUMN available_from TIMESTAMPTZ, ADD COLUMN available_until TIMESTAMPTZ;
+CREATE INDEX albums_available_from_idx ON albums (available_from) WHERE available_from IS NOT NULL;
+
+ALTER TABLE album_change_log ADD COLUMN published_through TIMESTAMPTZ NOT NULL DEFAULT clock_timestamp();
+ALTER TABLE album_change_log ALTER COLUMN published_through DROP DEFAULT;
@@ -0,0 +1,12 @@
+-- Searches saved by POST /searches. definition is the JSON object of the
+-- search body or filter parameters, kept as sent and parsed on every run.
+CREATE TABLE saved_searches (
+	id         TEXT PRIMARY KEY,
+	name       TEXT NOT NULL,
+	owner      TEXT NOT NULL,
+	shared     BOOLEAN NOT NULL DEFAULT FALSE,
+	definition TEXT NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX saved_searches_owner_idx ON saved_searches (owner, created_at);
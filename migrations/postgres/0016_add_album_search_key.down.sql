@@ -0,0 +1,19 @@
+DROP TRIGGER albums_record_change ON albums;
+CREATE TRIGGER albums_record_change AFTER INSERT OR UPDATE OR DELETE ON albums
+	FOR EACH ROW EXECUTE FUNCTION record_album_change();
+
+CREATE OR REPLACE FUNCTION record_album_change() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_advisory_xact_lock(hashtext('album_changes'));
+	IF TG_OP = 'INSERT' THEN
+		INSERT INTO album_changes (op, album_id, after) VALUES ('created', NEW.id, to_jsonb(NEW));
+	ELSIF TG_OP = 'UPDATE' THEN
+		INSERT INTO album_changes (op, album_id, before, after) VALUES ('updated', NEW.id, to_jsonb(OLD), to_jsonb(NEW));
+	ELSE
+		INSERT INTO album_changes (op, album_id, before) VALUES ('deleted', OLD.id, to_jsonb(OLD));
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+ALTER TABLE albums DROP COLUMN search_key;
@@ -0,0 +1,26 @@
+-- The key q searches are narrowed with: the folded words of the title and
+-- artist, each after a space, computed by the application (searchKey).
+-- NULL until it has been; the store fills the keys in as it starts. The
+-- change log leaves the key out, of the trigger and the snapshots, so that
+-- filling it in isn't a change.
+ALTER TABLE albums ADD COLUMN search_key TEXT;
+
+CREATE OR REPLACE FUNCTION record_album_change() RETURNS trigger AS $$
+BEGIN
+	PERFORM pg_advisory_xact_lock(hashtext('album_changes'));
+	IF TG_OP = 'INSERT' THEN
+		INSERT INTO album_changes (op, album_id, after) VALUES ('created', NEW.id, to_jsonb(NEW) - 'search_key');
+	ELSIF TG_OP = 'UPDATE' THEN
+		INSERT INTO album_changes (op, album_id, before, after) VALUES ('updated', NEW.id, to_jsonb(OLD) - 'search_key', to_jsonb(NEW) - 'search_key');
+	ELSE
+		INSERT INTO album_changes (op, album_id, before) VALUES ('deleted', OLD.id, to_jsonb(OLD) - 'search_key');
+	END IF;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER albums_record_change ON albums;
+CREATE TRIGGER albums_record_change AFTER INSERT OR DELETE OR UPDATE OF
+	id, title, artist, price, genre, slug, barcode, year, tracks, metadata, stock,
+	created_at, updated_at, available_from, available_until ON albums
+	FOR EACH ROW EXECUTE FUNCTION record_album_change();
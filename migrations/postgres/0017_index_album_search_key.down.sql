@@ -0,0 +1 @@
+DROP INDEX albums_search_key_idx;
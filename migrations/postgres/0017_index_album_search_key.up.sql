@@ -0,0 +1,5 @@
+-- requires: pg_trgm
+-- A trigram index, so the LIKE patterns q searches are narrowed with don't
+-- read every row. It waits for the pg_trgm extension to be installed
+-- (CREATE EXTENSION pg_trgm).
+CREATE INDEX albums_search_key_idx ON albums USING GIN (search_key gin_trgm_ops);
@@ -0,0 +1,8 @@
+DROP TRIGGER albums_record_change ON albums;
+
+ALTER TABLE albums ALTER COLUMN id TYPE TEXT COLLATE "default";
+
+CREATE TRIGGER albums_record_change AFTER INSERT OR DELETE OR UPDATE OF
+	id, title, artist, price, genre, slug, barcode, year, tracks, metadata, stock,
+	created_at, updated_at, available_from, available_until ON albums
+	FOR EACH ROW EXECUTE FUNCTION record_album_change();
@@ -0,0 +1,15 @@
+-- Compare album IDs byte by byte. The IDs ALBUM_ID_STRATEGY=uuid7 or ulid
+-- makes start with the time, so under the C collation each new one sorts
+-- after the last and the primary key's B-tree takes every insert at its
+-- right-hand edge, in pages already cached. Random UUIDv4 IDs land on any
+-- leaf, reading and splitting pages across the whole index as it grows.
+-- The IDs already stored are kept as they are; only their order changes.
+-- The trigger names id, so it is dropped for the change of the column.
+DROP TRIGGER albums_record_change ON albums;
+
+ALTER TABLE albums ALTER COLUMN id TYPE TEXT COLLATE "C";
+
+CREATE TRIGGER albums_record_change AFTER INSERT OR DELETE OR UPDATE OF
+	id, title, artist, price, genre, slug, barcode, year, tracks, metadata, stock,
+	created_at, updated_at, available_from, available_until ON albums
+	FOR EACH ROW EXECUTE FUNCTION record_album_change();
@@ -0,0 +1,9 @@
+-- The payment events POST /integrations/payments has handled, so that a
+-- redelivery within PAYMENT_EVENT_TTL is acknowledged without selling the
+-- copies again. A record is written in the transaction of its sale.
+CREATE TABLE payment_events (
+	id         TEXT PRIMARY KEY,
+	expires_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX payment_events_expires_at_idx ON payment_events (expires_at);
@@ -0,0 +1,20 @@
+-- Matches the table gorm's AutoMigrate created in earlier releases, so
+-- existing databases are adopted as-is.
+CREATE TABLE IF NOT EXISTS `albums` (
+	`seq` integer PRIMARY KEY AUTOINCREMENT,
+	`id` text NOT NULL,
+	`title` text NOT NULL,
+	`artist` text NOT NULL,
+	`price` real NOT NULL,
+	`genre` text NOT NULL DEFAULT "",
+	`slug` text NOT NULL,
+	`barcode` text,
+	`year` integer NOT NULL DEFAULT 0,
+	`tracks` text,
+	`created_at` datetime,
+	`updated_at` datetime
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_albums_id` ON `albums`(`id`);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_albums_slug` ON `albums`(`slug`);
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_albums_barcode` ON `albums`(`barcode`);
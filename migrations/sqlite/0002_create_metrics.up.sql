@@ -0,0 +1,11 @@
+-- A single row of running totals, incremented by AddMetrics.
+CREATE TABLE `metrics` (
+	`id` integer PRIMARY KEY DEFAULT 1 CHECK (`id` = 1),
+	`total_requests` integer NOT NULL DEFAULT 0,
+	`total_errors` integer NOT NULL DEFAULT 0,
+	`total_albums_fetched` integer NOT NULL DEFAULT 0,
+	`total_albums_added` integer NOT NULL DEFAULT 0,
+	`total_rate_limited` integer NOT NULL DEFAULT 0,
+	`total_latency_ms` integer NOT NULL DEFAULT 0,
+	`saved_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
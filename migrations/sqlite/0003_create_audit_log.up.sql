@@ -0,0 +1,10 @@
+CREATE TABLE `audit_log` (
+	`id` text PRIMARY KEY,
+	`timestamp` datetime NOT NULL,
+	`action` text NOT NULL,
+	`album_id` text,
+	`principal` text NOT NULL,
+	`details` text
+);
+
+CREATE INDEX `idx_audit_log_album_id` ON `audit_log`(`album_id`, `timestamp`);
@@ -0,0 +1,4 @@
+DROP TRIGGER `albums_fts_update`;
+DROP TRIGGER `albums_fts_delete`;
+DROP TRIGGER `albums_fts_insert`;
+DROP TABLE `albums_fts`;
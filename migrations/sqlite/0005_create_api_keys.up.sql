@@ -0,0 +1,9 @@
+CREATE TABLE `api_keys` (
+	`id` text PRIMARY KEY,
+	`name` text NOT NULL,
+	`tier` text NOT NULL,
+	`secret_hash` text NOT NULL,
+	`created_at` datetime NOT NULL,
+	`last_used_at` datetime,
+	`revoked_at` datetime
+);
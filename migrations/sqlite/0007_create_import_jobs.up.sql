@@ -0,0 +1,17 @@
+-- CSV imports started by POST /albums/import. cancel_requested is only set
+-- by CancelImportJob, so the worker's progress writes can't clear it.
+CREATE TABLE `import_jobs` (
+	`id` text PRIMARY KEY,
+	`state` text NOT NULL,
+	`principal` text NOT NULL,
+	`rows_processed` integer NOT NULL DEFAULT 0,
+	`rows_created` integer NOT NULL DEFAULT 0,
+	`rows_failed` integer NOT NULL DEFAULT 0,
+	`failures` text NOT NULL DEFAULT '[]',
+	`error` text NOT NULL DEFAULT '',
+	`cancel_requested` integer NOT NULL DEFAULT 0,
+	`created_at` datetime NOT NULL,
+	`started_at` datetime,
+	`finished_at` datetime,
+	`updated_at` datetime NOT NULL
+);
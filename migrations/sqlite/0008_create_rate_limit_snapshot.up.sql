@@ -0,0 +1,8 @@
+-- A single row holding the last snapshot of the rate limiter and quota
+-- windows, written by SaveRateLimitSnapshot when
+-- RATE_LIMIT_SNAPSHOT_INTERVAL is set.
+CREATE TABLE `rate_limit_snapshot` (
+	`id` integer PRIMARY KEY DEFAULT 1 CHECK (`id` = 1),
+	`snapshot` text NOT NULL,
+	`saved_at` datetime NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
@@ -0,0 +1,14 @@
+-- What each instance counted in each flush interval, added by
+-- AddMetricsSample and read by GET /metrics/history.
+CREATE TABLE `metrics_history` (
+	`instance` text NOT NULL,
+	`environment` text NOT NULL DEFAULT '',
+	`at` datetime NOT NULL,
+	`total_requests` integer NOT NULL DEFAULT 0,
+	`total_errors` integer NOT NULL DEFAULT 0,
+	`total_albums_fetched` integer NOT NULL DEFAULT 0,
+	`total_albums_added` integer NOT NULL DEFAULT 0,
+	`total_rate_limited` integer NOT NULL DEFAULT 0,
+	`total_latency_ms` integer NOT NULL DEFAULT 0
+);
+CREATE INDEX `idx_metrics_history_at` ON `metrics_history`(`at`, `instance`);
@@ -0,0 +1,2 @@
+-- Free-form string metadata per album, as a JSON object.
+ALTER TABLE `albums` ADD COLUMN `metadata` text;
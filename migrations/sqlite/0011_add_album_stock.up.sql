@@ -0,0 +1,2 @@
+-- Copies of each album left to sell.
+ALTER TABLE `albums` ADD COLUMN `stock` integer NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+DROP TRIGGER `albums_change_delete`;
+DROP TRIGGER `albums_change_update`;
+DROP TRIGGER `albums_change_insert`;
+DROP TABLE `album_change_log`;
+DROP TABLE `album_changes`;
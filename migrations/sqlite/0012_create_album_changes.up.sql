@@ -0,0 +1,35 @@
+-- The change feed behind GET /albums/changes: one row per album insert,
+-- update, or delete, written by a trigger in the same transaction. SQLite
+-- has one writer at a time, so changes commit in seq order.
+CREATE TABLE `album_changes` (
+	`seq` integer PRIMARY KEY AUTOINCREMENT,
+	`op` text NOT NULL,
+	`album_id` text NOT NULL,
+	`changed_at` datetime NOT NULL
+);
+
+CREATE INDEX `idx_album_changes_changed_at` ON `album_changes`(`changed_at`);
+
+-- The seq of the newest change the retention janitor has deleted.
+CREATE TABLE `album_change_log` (
+	`id` integer PRIMARY KEY CHECK (`id` = 1),
+	`trimmed_through` integer NOT NULL
+);
+
+INSERT INTO `album_change_log` (`id`, `trimmed_through`) VALUES (1, 0);
+
+-- The albums already stored start the feed as created.
+INSERT INTO `album_changes` (`op`, `album_id`, `changed_at`)
+	SELECT 'created', `id`, strftime('%Y-%m-%d %H:%M:%f', 'now') FROM `albums` ORDER BY `seq`;
+
+CREATE TRIGGER `albums_change_insert` AFTER INSERT ON `albums` BEGIN
+	INSERT INTO `album_changes` (`op`, `album_id`, `changed_at`) VALUES ('created', new.`id`, strftime('%Y-%m-%d %H:%M:%f', 'now'));
+END;
+
+CREATE TRIGGER `albums_change_update` AFTER UPDATE ON `albums` BEGIN
+	INSERT INTO `album_changes` (`op`, `album_id`, `changed_at`) VALUES ('updated', new.`id`, strftime('%Y-%m-%d %H:%M:%f', 'now'));
+END;
+
+CREATE TRIGGER `albums_change_delete` AFTER DELETE ON `albums` BEGIN
+	INSERT INTO `album_changes` (`op`, `album_id`, `changed_at`) VALUES ('deleted', old.`id`, strftime('%Y-%m-%d %H:%M:%f', 'now'));
+END;
@@ -0,0 +1 @@
+ALTER TABLE `album_change_log` DROP COLUMN `sent_through`;
@@ -0,0 +1,6 @@
+-- The seq of the newest change the album event dispatcher has delivered:
+-- the change log doubles as its outbox. The changes already stored predate
+-- it and aren't delivered.
+ALTER TABLE `album_change_log` ADD COLUMN `sent_through` integer NOT NULL DEFAULT 0;
+
+UPDATE `album_change_log` SET `sent_through` = COALESCE((SELECT max(`seq`) FROM `album_changes`), `trimmed_through`);
@@ -0,0 +1,19 @@
+DROP TRIGGER `albums_change_insert`;
+DROP TRIGGER `albums_change_update`;
+DROP TRIGGER `albums_change_delete`;
+
+CREATE TRIGGER `albums_change_insert` AFTER INSERT ON `albums` BEGIN
+	INSERT INTO `album_changes` (`op`, `album_id`, `changed_at`) VALUES ('created', new.`id`, strftime('%Y-%m-%d %H:%M:%f', 'now'));
+END;
+
+CREATE TRIGGER `albums_change_update` AFTER UPDATE ON `albums` BEGIN
+	INSERT INTO `album_changes` (`op`, `album_id`, `changed_at`) VALUES ('updated', new.`id`, strftime('%Y-%m-%d %H:%M:%f', 'now'));
+END;
+
+CREATE TRIGGER `albums_change_delete` AFTER DELETE ON `albums` BEGIN
+	INSERT INTO `album_changes` (`op`, `album_id`, `changed_at`) VALUES ('deleted', old.`id`, strftime('%Y-%m-%d %H:%M:%f', 'now'));
+END;
+
+ALTER TABLE `album_change_log` DROP COLUMN `history_since`;
+ALTER TABLE `album_changes` DROP COLUMN `after`;
+ALTER TABLE `album_changes` DROP COLUMN `before`;
@@ -0,0 +1,42 @@
+-- The window in which an album is listed, either end open when NULL: from
+-- available_from, and before available_until. published_through is how far
+-- the album-publisher job has recorded the embargoes that lifted. The
+-- snapshots of the change log keep the window too.
+ALTER TABLE `albums` ADD COLUMN `available_from` datetime;
+ALTER TABLE `albums` ADD COLUMN `available_until` datetime;
+CREATE INDEX `idx_albums_available_from` ON `albums` (`available_from`) WHERE `available_from` IS NOT NULL;
+
+ALTER TABLE `album_change_log` ADD COLUMN `published_through` datetime NOT NULL DEFAULT '';
+UPDATE `album_change_log` SET `published_through` = strftime('%Y-%m-%d %H:%M:%f', 'now');
+
+DROP TRIGGER `albums_change_insert`;
+DROP TRIGGER `albums_change_update`;
+DROP TRIGGER `albums_change_delete`;
+
+CREATE TRIGGER `albums_change_insert` AFTER INSERT ON `albums` BEGIN
+	INSERT INTO `album_changes` (`op`, `album_id`, `changed_at`, `after`) VALUES ('created', new.`id`, strftime('%Y-%m-%d %H:%M:%f', 'now'), json_object(
+		'id', new.`id`, 'title', new.`title`, 'artist', new.`artist`, 'price', new.`price`,
+		'genre', new.`genre`, 'slug', new.`slug`, 'barcode', new.`barcode`, 'year', new.`year`,
+		'tracks', json(new.`tracks`), 'metadata', json(new.`metadata`), 'stock', new.`stock`, 'created_at', new.`created_at`,
+		'updated_at', new.`updated_at`, 'available_from', new.`available_from`, 'available_until', new.`available_until`));
+END;
+
+CREATE TRIGGER `albums_change_update` AFTER UPDATE ON `albums` BEGIN
+	INSERT INTO `album_changes` (`op`, `album_id`, `changed_at`, `before`, `after`) VALUES ('updated', new.`id`, strftime('%Y-%m-%d %H:%M:%f', 'now'), json_object(
+		'id', old.`id`, 'title', old.`title`, 'artist', old.`artist`, 'price', old.`price`,
+		'genre', old.`genre`, 'slug', old.`slug`, 'barcode', old.`barcode`, 'year', old.`year`,
+		'tracks', json(old.`tracks`), 'metadata', json(old.`metadata`), 'stock', old.`stock`, 'created_at', old.`created_at`,
+		'updated_at', old.`updated_at`, 'available_from', old.`available_from`, 'available_until', old.`available_until`), json_object(
+		'id', new.`id`, 'title', new.`title`, 'artist', new.`artist`, 'price', new.`price`,
+		'genre', new.`genre`, 'slug', new.`slug`, 'barcode', new.`barcode`, 'year', new.`year`,
+		'tracks', json(new.`tracks`), 'metadata', json(new.`metadata`), 'stock', new.`stock`, 'created_at', new.`created_at`,
+		'updated_at', new.`updated_at`, 'available_from', new.`available_from`, 'available_until', new.`available_until`));
+END;
+
+CREATE TRIGGER `albums_change_delete` AFTER DELETE ON `albums` BEGIN
+	INSERT INTO `album_changes` (`op`, `album_id`, `changed_at`, `before`) VALUES ('deleted', old.`id`, strftime('%Y-%m-%d %H:%M:%f', 'now'), json_object(
+		'id', old.`id`, 'title', old.`title`, 'artist', old.`artist`, 'price', old.`price`,
+		'genre', old.`genre`, 'slug', old.`slug`, 'barcode', old.`barcode`, 'year', old.`year`,
+		'tracks', json(old.`tracks`), 'metadata', json(old.`metadata`), 'stock', old.`stock`, 'created_at', old.`created_at`,
+		'updated_at', old.`updated_at`, 'available_from', old.`available_from`, 'available_until', old.`available_until`));
+END;
@@ -0,0 +1,12 @@
+-- Searches saved by POST /searches. definition is the JSON object of the
+-- search body or filter parameters, kept as sent and parsed on every run.
+CREATE TABLE `saved_searches` (
+	`id` text PRIMARY KEY,
+	`name` text NOT NULL,
+	`owner` text NOT NULL,
+	`shared` integer NOT NULL DEFAULT 0,
+	`definition` text NOT NULL,
+	`created_at` datetime NOT NULL
+);
+
+CREATE INDEX `idx_saved_searches_owner` ON `saved_searches` (`owner`, `created_at`);
@@ -0,0 +1,21 @@
+-- The key q searches are narrowed with: the folded words of the title and
+-- artist, each after a space, computed by the application (searchKey).
+-- NULL until it has been; the store fills the keys in as it starts. The
+-- change log leaves the key out, so that filling it in isn't a change.
+ALTER TABLE `albums` ADD COLUMN `search_key` text;
+
+DROP TRIGGER `albums_change_update`;
+
+CREATE TRIGGER `albums_change_update` AFTER UPDATE OF
+	`id`, `title`, `artist`, `price`, `genre`, `slug`, `barcode`, `year`, `tracks`, `metadata`, `stock`,
+	`created_at`, `updated_at`, `available_from`, `available_until` ON `albums` BEGIN
+	INSERT INTO `album_changes` (`op`, `album_id`, `changed_at`, `before`, `after`) VALUES ('updated', new.`id`, strftime('%Y-%m-%d %H:%M:%f', 'now'), json_object(
+		'id', old.`id`, 'title', old.`title`, 'artist', old.`artist`, 'price', old.`price`,
+		'genre', old.`genre`, 'slug', old.`slug`, 'barcode', old.`barcode`, 'year', old.`year`,
+		'tracks', json(old.`tracks`), 'metadata', json(old.`metadata`), 'stock', old.`stock`, 'created_at', old.`created_at`,
+		'updated_at', old.`updated_at`, 'available_from', old.`available_from`, 'available_until', old.`available_until`), json_object(
+		'id', new.`id`, 'title', new.`title`, 'artist', new.`artist`, 'price', new.`price`,
+		'genre', new.`genre`, 'slug', new.`slug`, 'barcode', new.`barcode`, 'year', new.`year`,
+		'tracks', json(new.`tracks`), 'metadata', json(new.`metadata`), 'stock', new.`stock`, 'created_at', new.`created_at`,
+		'updated_at', new.`updated_at`, 'available_from', new.`available_from`, 'available_until', new.`available_until`));
+END;
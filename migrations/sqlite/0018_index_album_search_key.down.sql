@@ -0,0 +1,27 @@
+DROP TRIGGER `albums_fts_update`;
+DROP TRIGGER `albums_fts_delete`;
+DROP TRIGGER `albums_fts_insert`;
+DROP TABLE `albums_fts`;
+
+CREATE VIRTUAL TABLE `albums_fts` USING fts5(
+	`title`,
+	`artist`,
+	content = 'albums',
+	content_rowid = 'seq',
+	tokenize = 'unicode61 remove_diacritics 0'
+);
+
+CREATE TRIGGER `albums_fts_insert` AFTER INSERT ON `albums` BEGIN
+	INSERT INTO `albums_fts` (rowid, `title`, `artist`) VALUES (new.`seq`, new.`title`, new.`artist`);
+END;
+
+CREATE TRIGGER `albums_fts_delete` AFTER DELETE ON `albums` BEGIN
+	INSERT INTO `albums_fts` (`albums_fts`, rowid, `title`, `artist`) VALUES ('delete', old.`seq`, old.`title`, old.`artist`);
+END;
+
+CREATE TRIGGER `albums_fts_update` AFTER UPDATE OF `title`, `artist` ON `albums` BEGIN
+	INSERT INTO `albums_fts` (`albums_fts`, rowid, `title`, `artist`) VALUES ('delete', old.`seq`, old.`title`, old.`artist`);
+	INSERT INTO `albums_fts` (rowid, `title`, `artist`) VALUES (new.`seq`, new.`title`, new.`artist`);
+END;
+
+INSERT INTO `albums_fts` (`albums_fts`) VALUES ('rebuild');
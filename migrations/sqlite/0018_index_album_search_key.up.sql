@@ -0,0 +1,31 @@
+-- requires: fts5
+-- The full-text index of ?q= searches moves from the titles and artists to
+-- their search keys, which are folded already, so it matches "Émigré" for
+-- "emigre" and "Straße" for "strasse". The keys are words separated by
+-- spaces, so the unicode61 tokenizer sees the words searchTerms does.
+DROP TRIGGER `albums_fts_update`;
+DROP TRIGGER `albums_fts_delete`;
+DROP TRIGGER `albums_fts_insert`;
+DROP TABLE `albums_fts`;
+
+CREATE VIRTUAL TABLE `albums_fts` USING fts5(
+	`search_key`,
+	content = 'albums',
+	content_rowid = 'seq',
+	tokenize = 'unicode61 remove_diacritics 0'
+);
+
+CREATE TRIGGER `albums_fts_insert` AFTER INSERT ON `albums` BEGIN
+	INSERT INTO `albums_fts` (rowid, `search_key`) VALUES (new.`seq`, new.`search_key`);
+END;
+
+CREATE TRIGGER `albums_fts_delete` AFTER DELETE ON `albums` BEGIN
+	INSERT INTO `albums_fts` (`albums_fts`, rowid, `search_key`) VALUES ('delete', old.`seq`, old.`search_key`);
+END;
+
+CREATE TRIGGER `albums_fts_update` AFTER UPDATE OF `search_key` ON `albums` BEGIN
+	INSERT INTO `albums_fts` (`albums_fts`, rowid, `search_key`) VALUES ('delete', old.`seq`, old.`search_key`);
+	INSERT INTO `albums_fts` (rowid, `search_key`) VALUES (new.`seq`, new.`search_key`);
+END;
+
+INSERT INTO `albums_fts` (`albums_fts`) VALUES ('rebuild');
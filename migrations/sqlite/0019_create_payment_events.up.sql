@@ -0,0 +1,10 @@
+-- The payment events POST /integrations/payments has handled, so that a
+-- redelivery within PAYMENT_EVENT_TTL is acknowledged without selling the
+-- copies again. A record is written in the transaction of its sale.
+-- expires_at is text in the layout the change log's changed_at uses.
+CREATE TABLE `payment_events` (
+	`id` text PRIMARY KEY,
+	`expires_at` text NOT NULL
+);
+
+CREATE INDEX `idx_payment_events_expires_at` ON `payment_events` (`expires_at`);
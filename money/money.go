@@ -0,0 +1,151 @@
+// Package money does arithmetic on prices in whole cents, so that sums,
+// averages, and adjustments don't pick up float64 error, and rounds only
+// where a Rounding says how. Amounts are printed with exactly two decimals.
+package money
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Rounding is how a result that falls between two cents is settled.
+// Results that don't fall exactly halfway go to the nearer cent either way.
+type Rounding int32
+
+const (
+	// HalfUp rounds halfway away from zero: 0.125 is 0.13.
+	HalfUp Rounding = iota
+	// HalfEven rounds halfway to the even cent, as bankers do: 0.125 is
+	// 0.12 and 0.135 is 0.14. Over many results the halves cancel out.
+	HalfEven
+)
+
+func (r Rounding) String() string {
+	if r == HalfEven {
+		return "half-even"
+	}
+	return "half-up"
+}
+
+// ParseRounding reads "half-up" or "half-even".
+func ParseRounding(s string) (Rounding, error) {
+	switch s {
+	case "half-up":
+		return HalfUp, nil
+	case "half-even":
+		return HalfEven, nil
+	}
+	return 0, fmt.Errorf(`must be "half-up" or "half-even", got %q`, s)
+}
+
+var rounding atomic.Int32
+
+// SetRounding sets the Rounding every Amount is settled with. HalfUp is the
+// default.
+func SetRounding(r Rounding) { rounding.Store(int32(r)) }
+
+// CurrentRounding returns the Rounding set by SetRounding.
+func CurrentRounding() Rounding { return Rounding(rounding.Load()) }
+
+// Amount is a price in dollars. It is a float64 so that it decodes, stores,
+// and compares as one, but every Amount the package returns is a whole
+// number of cents, and its JSON always has two decimals. An Amount read
+// from a client is rounded with Round before it is kept.
+type Amount float64
+
+// FromCents returns the Amount of cents.
+func FromCents(cents int64) Amount { return Amount(float64(cents) / 100) }
+
+// FromFloat rounds f to the cent.
+func FromFloat(f float64) Amount { return FromCents(Amount(f).Cents()) }
+
+// Cents returns a in cents, rounded. The rounding works on the shortest
+// decimal that reads back as a, so 2.675, which float64 holds as a little
+// under, is halfway as written.
+func (a Amount) Cents() int64 {
+	r, ok := new(big.Rat).SetString(strconv.FormatFloat(float64(a), 'g', -1, 64))
+	if !ok {
+		return 0 // NaN or an infinity
+	}
+	return roundRat(r.Mul(r, big.NewRat(100, 1)))
+}
+
+// Parse reads a decimal such as "17.99" or "1e2" and rounds it to the cent.
+func Parse(s string) (Amount, error) {
+	r, ok := new(big.Rat).SetString(s)
+	if !ok || strings.Contains(s, "/") {
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	return FromCents(roundRat(r.Mul(r, big.NewRat(100, 1)))), nil
+}
+
+// Set parses s as Parse does, so that an *Amount is a flag.Value.
+func (a *Amount) Set(s string) error {
+	amount, err := Parse(s)
+	if err != nil {
+		return err
+	}
+	*a = amount
+	return nil
+}
+
+// Round returns a rounded to the cent.
+func (a Amount) Round() Amount { return FromCents(a.Cents()) }
+
+// Add returns a + b, in cents.
+func (a Amount) Add(b Amount) Amount { return FromCents(a.Cents() + b.Cents()) }
+
+// Mul returns a times factor, rounded once: factor is taken as the
+// shortest decimal that reads back as it, so a price raised by 10% is
+// multiplied by exactly 1.1. Adjustments and currency conversions use it.
+// A raise undone by the inverse factor gives back the price it started
+// from. A cut undone that way can move the price by a cent the first time,
+// or by up to half a cent over factor for a cut deeper than half, but no
+// further however often it is repeated.
+func (a Amount) Mul(factor float64) Amount {
+	f, ok := new(big.Rat).SetString(strconv.FormatFloat(factor, 'g', -1, 64))
+	if !ok {
+		return 0
+	}
+	return FromCents(roundRat(f.Mul(f, big.NewRat(a.Cents(), 1))))
+}
+
+// Div returns a split n ways, rounded, as for an average. Div by 0 is 0.
+func (a Amount) Div(n int) Amount {
+	if n == 0 {
+		return 0
+	}
+	return FromCents(roundRat(big.NewRat(a.Cents(), int64(n))))
+}
+
+// String formats a with exactly two decimals, such as "17.99".
+func (a Amount) String() string {
+	cents := a.Cents()
+	sign := ""
+	if cents < 0 {
+		sign, cents = "-", -cents
+	}
+	return fmt.Sprintf("%s%d.%02d", sign, cents/100, cents%100)
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) { return []byte(a.String()), nil }
+
+// roundRat rounds r to a whole number with CurrentRounding.
+func roundRat(r *big.Rat) int64 {
+	q, rem := new(big.Int).QuoRem(r.Num(), r.Denom(), new(big.Int))
+	// Twice the remainder against the denominator says whether r is below,
+	// at, or past halfway to the next whole number away from zero.
+	half := new(big.Int).Abs(rem)
+	switch half.Lsh(half, 1).Cmp(r.Denom()) {
+	case 1:
+		q.Add(q, big.NewInt(int64(rem.Sign())))
+	case 0:
+		if CurrentRounding() == HalfUp || q.Bit(0) == 1 {
+			q.Add(q, big.NewInt(int64(rem.Sign())))
+		}
+	}
+	return q.Int64()
+}
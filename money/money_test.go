@@ -0,0 +1,157 @@
+package money
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"regexp"
+	"testing"
+	"testing/quick"
+)
+
+// withRounding runs f with each Rounding in turn.
+func withRounding(t *testing.T, f func(t *testing.T)) {
+	t.Cleanup(func() { SetRounding(HalfUp) })
+	for _, r := range []Rounding{HalfUp, HalfEven} {
+		SetRounding(r)
+		t.Run(r.String(), f)
+	}
+}
+
+// quickConfig runs a property a thousand times, from a fixed seed so that a
+// failure can be replayed.
+var quickConfig = &quick.Config{MaxCount: 1000, Rand: rand.New(rand.NewSource(1))}
+
+func TestRounding(t *testing.T) {
+	t.Cleanup(func() { SetRounding(HalfUp) })
+	for _, tc := range []struct {
+		in             string
+		halfUp, halfEv string
+	}{
+		{"0.125", "0.13", "0.12"},
+		{"0.135", "0.14", "0.14"},
+		{"2.675", "2.68", "2.68"},
+		{"2.665", "2.67", "2.66"},
+		{"0.1249", "0.12", "0.12"},
+		{"0.1251", "0.13", "0.13"},
+		{"-0.125", "-0.13", "-0.12"},
+		{"17.990000000000002", "17.99", "17.99"},
+		{"1e2", "100.00", "100.00"},
+	} {
+		for _, r := range []Rounding{HalfUp, HalfEven} {
+			SetRounding(r)
+			want := tc.halfUp
+			if r == HalfEven {
+				want = tc.halfEv
+			}
+			a, err := Parse(tc.in)
+			if err != nil || a.String() != want {
+				t.Errorf("%s, %s: %s, %v, want %s", tc.in, r, a, err, want)
+			}
+		}
+	}
+	for _, bad := range []string{"", "abc", "1/3", "1,00"} {
+		if _, err := Parse(bad); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+	if _, err := ParseRounding("bankers"); err == nil {
+		t.Error(`"bankers" is not a rounding`)
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	// 0.1 + 0.2 is 0.30000000000000004 in float64.
+	if got := Amount(0.1).Add(0.2); got != 0.3 {
+		t.Errorf("0.1 + 0.2 = %v", float64(got))
+	}
+	if got := Amount(17.99).Mul(1.1); got.String() != "19.79" {
+		t.Errorf("17.99 raised 10%% = %s", got)
+	}
+	if got := Amount(10).Div(3); got.String() != "3.33" {
+		t.Errorf("10 / 3 = %s", got)
+	}
+	if got := Amount(10).Div(0); got != 0 {
+		t.Errorf("10 / 0 = %s", got)
+	}
+	if got := Amount(math.NaN()).Cents(); got != 0 {
+		t.Errorf("NaN is %d cents", got)
+	}
+}
+
+// TestRaiseRevertDoesNotDrift is the property that a price raised by any
+// percentage and put back by the inverse factor is the price it was, however
+// many times that is done.
+func TestRaiseRevertDoesNotDrift(t *testing.T) {
+	withRounding(t, func(t *testing.T) {
+		property := func(cents uint32, percent uint8) bool {
+			start := FromCents(int64(cents % 10_000_000))
+			factor := 1 + float64(percent%100+1)/100
+			a := start
+			for i := 0; i < 20; i++ {
+				a = a.Mul(factor).Mul(1 / factor)
+			}
+			return a == start
+		}
+		if err := quick.Check(property, quickConfig); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// TestCutRevertDoesNotDrift is the property that a cut and its revert can
+// move the price by a little the first time, a cent for a cut of up to
+// half, and after that come back to the same price every time.
+func TestCutRevertDoesNotDrift(t *testing.T) {
+	withRounding(t, func(t *testing.T) {
+		property := func(cents uint32, percent uint8) bool {
+			start := FromCents(int64(cents % 10_000_000))
+			factor := 1 - float64(percent%90+1)/100
+			first := start.Mul(factor).Mul(1 / factor)
+			bound := int64(math.Ceil(0.5 / factor))
+			if d := first.Cents() - start.Cents(); d < -bound || d > bound {
+				return false
+			}
+			a := first
+			for i := 0; i < 20; i++ {
+				a = a.Mul(factor).Mul(1 / factor)
+			}
+			return a == first
+		}
+		if err := quick.Check(property, quickConfig); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+var twoDecimals = regexp.MustCompile(`^\d+\.\d{2}$`)
+
+// TestJSONTwoDecimals is the property that every non-negative amount,
+// however it was computed, is written with exactly two decimals.
+func TestJSONTwoDecimals(t *testing.T) {
+	withRounding(t, func(t *testing.T) {
+		property := func(f float64, percent uint8, n uint8) bool {
+			for _, a := range []Amount{
+				Amount(math.Abs(f)),
+				FromFloat(math.Abs(math.Mod(f, 1e6))),
+				FromFloat(math.Abs(math.Mod(f, 1e6))).Mul(1 + float64(percent)/100),
+				FromFloat(math.Abs(math.Mod(f, 1e6))).Div(int(n) + 1),
+			} {
+				b, err := json.Marshal(struct {
+					Price Amount `json:"price"`
+				}{a})
+				var got struct {
+					Price json.RawMessage `json:"price"`
+				}
+				if err != nil || json.Unmarshal(b, &got) != nil || !twoDecimals.Match(got.Price) {
+					t.Logf("%v is written %s", float64(a), b)
+					return false
+				}
+			}
+			return true
+		}
+		if err := quick.Check(property, quickConfig); err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// monthlyQuota is the number of requests tier allows per calendar month, or
+// 0 when the tier has no monthly quota. It is read per request so a reload
+// applies straight away.
+func monthlyQuota(tier string) int {
+	cfg := currentConfig()
+	if tier == tierPaid {
+		return cfg.QuotaPaidPerMonth
+	}
+	return cfg.QuotaFreePerMonth
+}
+
+// quotaMonth is the calendar month t falls in, like "2024-05", and when the
+// next one starts. Months are in UTC, so every replica rolls over at once
+// whatever its time zone.
+func quotaMonth(t time.Time) (month string, reset time.Time) {
+	t = t.UTC()
+	return t.Format("2006-01"), time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+}
+
+// MonthlyQuotaStore keeps the callers' counts by calendar month. As with
+// QuotaStore, the limit is passed in with every call.
+type MonthlyQuotaStore interface {
+	// ConsumeMonth counts a request from id in month if it is within
+	// limit, and reports the month's count either way; ok is false when
+	// the request is over the quota and wasn't counted. reset is when the
+	// month ends, after which its count is no longer needed.
+	ConsumeMonth(ctx context.Context, id, month string, limit int, reset time.Time) (used int, ok bool, err error)
+	// MonthUsage reports id's count in month without counting anything.
+	MonthUsage(ctx context.Context, id, month string) (int, error)
+}
+
+// memoryMonthlyQuotas keeps the monthly counts in this process. Each
+// replica counts on its own; the counts are saved in the rate limit
+// snapshot so a restart doesn't reset them.
+type memoryMonthlyQuotas struct {
+	mu     sync.Mutex
+	counts map[monthlyQuotaKey]int
+}
+
+type monthlyQuotaKey struct {
+	id, month string
+}
+
+func newMemoryMonthlyQuotas() *memoryMonthlyQuotas {
+	return &memoryMonthlyQuotas{counts: make(map[monthlyQuotaKey]int)}
+}
+
+func (s *memoryMonthlyQuotas) ConsumeMonth(ctx context.Context, id, month string, limit int, reset time.Time) (int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := monthlyQuotaKey{id: id, month: month}
+	if s.counts[key] >= limit {
+		return s.counts[key], false, nil
+	}
+	s.counts[key]++
+	return s.counts[key], true, nil
+}
+
+func (s *memoryMonthlyQuotas) MonthUsage(ctx context.Context, id, month string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[monthlyQuotaKey{id: id, month: month}], nil
+}
+
+// prune drops the counts of every month but month, returning how many.
+func (s *memoryMonthlyQuotas) prune(month string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for key := range s.counts {
+		if key.month != month {
+			delete(s.counts, key)
+			n++
+		}
+	}
+	return n
+}
+
+// redisConsumeMonthScript counts a request unless the count at KEYS[1] has
+// reached ARGV[1], in one step, so replicas counting at once can't both
+// take the last request of the month. The key expires at ARGV[2], in Unix
+// milliseconds. It replies with the count and 1 if the request was counted,
+// or 0 if not.
+const redisConsumeMonthScript = `local used = tonumber(redis.call('GET', KEYS[1]) or '0')
+if used >= tonumber(ARGV[1]) then return {used, 0} end
+used = redis.call('INCR', KEYS[1])
+redis.call('PEXPIREAT', KEYS[1], ARGV[2])
+return {used, 1}`
+
+// monthlyQuotaGrace is how long a month's count stays in Redis after the
+// month ends, for a replica whose clock is a little behind.
+const monthlyQuotaGrace = time.Hour
+
+// redisMonthlyQuotas keeps the monthly counts in Redis, with
+// QUOTA_REDIS_URL, shared by every replica.
+type redisMonthlyQuotas struct {
+	client *redisClient
+}
+
+func redisMonthlyQuotaKey(id, month string) string {
+	return "quota:month:" + month + ":" + id
+}
+
+func (s *redisMonthlyQuotas) ConsumeMonth(ctx context.Context, id, month string, limit int, reset time.Time) (int, bool, error) {
+	expireAt := strconv.FormatInt(reset.Add(monthlyQuotaGrace).UnixMilli(), 10)
+	reply, err := s.client.do(ctx, "EVAL", redisConsumeMonthScript, "1", redisMonthlyQuotaKey(id, month), strconv.Itoa(limit), expireAt)
+	if err != nil {
+		return 0, false, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return 0, false, fmt.Errorf("redis: unexpected reply %v to the monthly quota script", reply)
+	}
+	used, _ := values[0].(int64)
+	counted, _ := values[1].(int64)
+	return int(used), counted == 1, nil
+}
+
+func (s *redisMonthlyQuotas) MonthUsage(ctx context.Context, id, month string) (int, error) {
+	value, err := s.client.get(ctx, redisMonthlyQuotaKey(id, month))
+	if err == errRedisNil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+var monthlyQuotas MonthlyQuotaStore = newMemoryMonthlyQuotas()
+
+// consumeMonthlyQuota counts r against its caller's monthly quota, when
+// the caller's tier has one. It answers 429 with a quota-exhausted problem
+// and reports false once the month's quota is used up. As with the hourly
+// quota, a store that can't be reached lets the request through.
+func consumeMonthlyQuota(w http.ResponseWriter, r *http.Request, c caller) bool {
+	limit := monthlyQuota(c.tier)
+	if limit <= 0 {
+		return true
+	}
+	month, reset := quotaMonth(serverClock.Now())
+	used, ok, err := monthlyQuotas.ConsumeMonth(r.Context(), c.id, month, limit, reset)
+	if err != nil {
+		log.Printf("🔥 Failed to check the monthly quota for %s: %v", c.id, err)
+		return true
+	}
+	if ok {
+		return true
+	}
+	atomic.AddInt64(&metrics.TotalRateLimited, 1)
+	retry := max(int(reset.Sub(serverClock.Now()).Seconds()+0.5), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	writeQuotaExhausted(w, r, limit, used, reset)
+	log.Printf("⏳ Monthly quota of %d exhausted for %s (%s tier) in %s, resets at %s", limit, c.id, c.tier, month, reset.Format(time.RFC3339))
+	return false
+}
+
+// writeQuotaExhausted answers 429 for a caller past its monthly quota, with
+// the quota, the requests counted, and when the next month starts.
+func writeQuotaExhausted(w http.ResponseWriter, r *http.Request, limit, used int, reset time.Time) {
+	p := problem{Type: types.ProblemQuotaExhausted, Title: http.StatusText(http.StatusTooManyRequests), Status: http.StatusTooManyRequests,
+		Detail: localize(r, "the monthly quota of %d requests is used up until %s", limit, reset.Format(time.DateOnly)), Instance: r.URL.Path,
+		Limit: limit, Count: used, ResetsAt: &reset}
+	writeLocalizedDetail(w, r, &p)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSONAs(w, http.StatusTooManyRequests, "application/problem+json", p)
+}
+
+// monthlyUsage is the caller's monthly consumption for GET /me/usage, or
+// nil when their tier has no monthly quota.
+func monthlyUsage(ctx context.Context, c caller) (*types.MonthlyUsage, error) {
+	limit := monthlyQuota(c.tier)
+	if limit <= 0 {
+		return nil, nil
+	}
+	month, reset := quotaMonth(serverClock.Now())
+	used, err := monthlyQuotas.MonthUsage(ctx, c.id, month)
+	if err != nil {
+		return nil, err
+	}
+	return &types.MonthlyUsage{Month: month, Limit: limit, Used: used, Remaining: max(limit-used, 0), ResetsAt: reset}, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+func TestQuotaMonth(t *testing.T) {
+	la, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skip("no time zone database:", err)
+	}
+	for _, tc := range []struct {
+		at    time.Time
+		month string
+		reset time.Time
+	}{
+		{time.Date(2026, 5, 31, 23, 59, 59, 0, time.UTC), "2026-05", time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC), "2026-06", time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)},
+		// Still May in Los Angeles, but June in UTC.
+		{time.Date(2026, 5, 31, 17, 30, 0, 0, la), "2026-06", time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2026, 12, 31, 23, 0, 0, 0, time.UTC), "2026-12", time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{time.Date(2027, 1, 31, 12, 0, 0, 0, time.UTC), "2027-01", time.Date(2027, 2, 1, 0, 0, 0, 0, time.UTC)},
+	} {
+		month, reset := quotaMonth(tc.at)
+		if month != tc.month || !reset.Equal(tc.reset) || reset.Location() != time.UTC {
+			t.Errorf("quotaMonth(%s) = %s, %s; want %s, %s", tc.at, month, reset, tc.month, tc.reset)
+		}
+	}
+}
+
+// useMonthlyQuotas gives t monthly counts of its own, in memory.
+func useMonthlyQuotas(t *testing.T) *memoryMonthlyQuotas {
+	previous := monthlyQuotas
+	t.Cleanup(func() { monthlyQuotas = previous })
+	store := newMemoryMonthlyQuotas()
+	monthlyQuotas = store
+	return store
+}
+
+func TestMonthlyQuotaRollover(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.QuotaFreePerMonth = 3 })
+	store := useMonthlyQuotas(t)
+	// A minute before June starts in UTC.
+	s.clock.Advance(time.Date(2026, 5, 31, 23, 59, 0, 0, time.UTC).Sub(testStart))
+	june := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	expectStatus(t, s.do(http.MethodGet, "/albums", ""), http.StatusOK)
+	expectStatus(t, s.do(http.MethodGet, "/albums", ""), http.StatusOK)
+	usage := decodeBody[types.Usage](t, s.do(http.MethodGet, "/me/usage", ""))
+	if m := usage.Monthly; m == nil || m.Month != "2026-05" || m.Limit != 3 || m.Used != 3 || m.Remaining != 0 || !m.ResetsAt.Equal(june) {
+		t.Errorf("monthly usage %+v, want May used up", m)
+	}
+	// The hourly quota is reported beside it.
+	if usage.Limit != s.cfg.QuotaFreePerHour || usage.Used != 3 {
+		t.Errorf("usage %+v, want the hour's alongside", usage)
+	}
+
+	w := s.do(http.MethodGet, "/albums", "")
+	p := expectProblem(t, w, http.StatusTooManyRequests)
+	if p.Type != types.ProblemQuotaExhausted || p.Limit != 3 || p.Count != 3 || p.ResetsAt == nil || !p.ResetsAt.Equal(june) {
+		t.Errorf("problem %+v, want the quota exhausted until June", p)
+	}
+	if p.Detail != "the monthly quota of 3 requests is used up until 2026-06-01" {
+		t.Errorf("detail %q", p.Detail)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After %q, want the minute left of May", got)
+	}
+	// A refused request isn't counted.
+	if used, _ := store.MonthUsage(context.Background(), "192.0.2.1", "2026-05"); used != 3 {
+		t.Errorf("%d requests counted in May, want 3", used)
+	}
+
+	s.clock.Advance(time.Minute)
+	expectStatus(t, s.do(http.MethodGet, "/albums", ""), http.StatusOK)
+	if m := decodeBody[types.Usage](t, s.do(http.MethodGet, "/me/usage", "")).Monthly; m.Month != "2026-06" || m.Used != 2 || !m.ResetsAt.Equal(time.Date(2026, 7, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("June's usage %+v", m)
+	}
+	// The janitor drops May, and keeps June.
+	if err := pruneRateLimits(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(store.snapshot()); n != 1 {
+		t.Errorf("%d monthly counts after pruning, want June's", n)
+	}
+}
+
+func TestMonthlyQuotaSnapshot(t *testing.T) {
+	ctx := context.Background()
+	saved := newMemoryMonthlyQuotas()
+	reset := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	saved.ConsumeMonth(ctx, "key:a", "2026-04", 10, reset)
+	saved.ConsumeMonth(ctx, "key:a", "2026-05", 10, reset)
+	saved.ConsumeMonth(ctx, "key:a", "2026-05", 10, reset)
+
+	// A replica restarted in May adds the saved counts of May to those it
+	// made since, and drops April's.
+	restored := newMemoryMonthlyQuotas()
+	restored.ConsumeMonth(ctx, "key:a", "2026-05", 10, reset)
+	if n := restored.restore(saved.snapshot(), "2026-05"); n != 1 {
+		t.Errorf("restored %d counts, want May's", n)
+	}
+	if used, _ := restored.MonthUsage(ctx, "key:a", "2026-05"); used != 3 {
+		t.Errorf("%d used in May after the restore, want 3", used)
+	}
+	if used, _ := restored.MonthUsage(ctx, "key:a", "2026-04"); used != 0 {
+		t.Errorf("%d used in April after the restore", used)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// unmatchedPattern is the catch-all pattern every routeTable answers 404
+// on. requestRoute counts what it catches as "unmatched", with the requests
+// turned away before routing, so scanning for paths adds no routes to the
+// metrics.
+const unmatchedPattern = "/"
+
+// maxSuggestionDistance is the most edits a route can be from the path of
+// a request matching none for the 404 to suggest it.
+const maxSuggestionDistance = 2
+
+// routeTable is a ServeMux that keeps the patterns registered on it, to
+// suggest the nearest to a request that matches none. It answers that
+// request with a 404 problem rather than ServeMux's plain text one.
+type routeTable struct {
+	*http.ServeMux
+	patterns []string
+	flags    map[string]string // the feature flag of each pattern that has one
+}
+
+func newRouteTable() *routeTable {
+	t := &routeTable{ServeMux: http.NewServeMux()}
+	t.ServeMux.HandleFunc(unmatchedPattern, t.notFound)
+	return t
+}
+
+func (t *routeTable) Handle(pattern string, h http.Handler) {
+	t.ServeMux.Handle(pattern, h)
+	t.patterns = append(t.patterns, pattern)
+}
+
+func (t *routeTable) HandleFunc(pattern string, h func(http.ResponseWriter, *http.Request)) {
+	t.ServeMux.HandleFunc(pattern, h)
+	t.patterns = append(t.patterns, pattern)
+}
+
+// HandleNested routes the requests matching pattern to nested, which
+// holds the routes under it that can't share this ServeMux: ServeMux
+// refuses /albums/{id}/price-history beside /albums/by-slug/{slug...}, as
+// neither is more specific on /albums/by-slug/price-history. nested sets
+// r.Pattern to the route it matched, so middleware reading it after the
+// handler sees that route, and its routes are suggested by this table's 404.
+func (t *routeTable) HandleNested(pattern string, nested *routeTable) {
+	t.ServeMux.Handle(pattern, nested)
+	t.patterns = append(t.patterns, nested.patterns...)
+}
+
+// route is the pattern of the route r matches, looking inside nested
+// tables, for middleware that needs it before the handler runs.
+func (t *routeTable) route(r *http.Request) string {
+	h, pattern := t.ServeMux.Handler(r)
+	if nested, ok := h.(*routeTable); ok {
+		return nested.route(r)
+	}
+	return pattern
+}
+
+// HandleFeature registers a route that only exists while the named feature
+// is on. While it is off the route answers the 404 of a path that matches
+// none, and isn't suggested by one.
+func (t *routeTable) HandleFeature(name, pattern string, h http.HandlerFunc) {
+	t.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+		if !features.Enabled(name) {
+			r.Pattern = unmatchedPattern
+			t.notFound(w, r)
+			return
+		}
+		h(w, r)
+	})
+	if t.flags == nil {
+		t.flags = make(map[string]string)
+	}
+	t.flags[pattern] = name
+}
+
+// routes lists the patterns of the routes that currently exist.
+func (t *routeTable) routes() []string {
+	routes := make([]string, 0, len(t.patterns))
+	for _, pattern := range t.patterns {
+		if name, ok := t.flags[pattern]; !ok || features.Enabled(name) {
+			routes = append(routes, pattern)
+		}
+	}
+	return routes
+}
+
+// notFound answers a request that matches no route, with the route it
+// most likely meant when one is close enough.
+func (t *routeTable) notFound(w http.ResponseWriter, r *http.Request) {
+	p := problem{Type: "about:blank", Title: http.StatusText(http.StatusNotFound), Status: http.StatusNotFound,
+		Detail: localize(r, "no route matches %s", r.URL.Path), Instance: r.URL.Path}
+	if suggestion := suggestRoute(t.routes(), r.URL.Path); suggestion != "" {
+		p.Detail = localize(r, "no route matches %s; did you mean %s?", r.URL.Path, suggestion)
+		p.Suggestion = suggestion
+	}
+	writeLocalizedDetail(w, r, &p)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSONAs(w, http.StatusNotFound, "application/problem+json", p)
+	log.Printf("🧭 No route for %s %s", r.Method, r.URL.Path)
+}
+
+// suggestRoute is the path, of a route among patterns, fewest edits from
+// path and at most maxSuggestionDistance, or "" when there is none. Each
+// wildcard of a pattern takes the segment of path where it stands, so
+// /album/42 is one edit from /albums/{id...}, as /albums/42. Of routes as
+// near as each other the first in sorted order wins.
+func suggestRoute(patterns []string, path string) string {
+	sorted := append([]string(nil), patterns...)
+	sort.Strings(sorted)
+	best, bestDistance := "", maxSuggestionDistance+1
+	for _, pattern := range sorted {
+		candidate := fillPattern(pattern, path)
+		if candidate == "" || candidate == path {
+			continue
+		}
+		// A short path is near everything: /x is one edit from /me.
+		if d := editDistance(candidate, path); d < bestDistance && d < len(path)/2 {
+			best, bestDistance = candidate, d
+		}
+	}
+	return best
+}
+
+// fillPattern is pattern with its wildcards filled in from the segments of
+// path at the same place: {name...} takes the rest of path. It is "" for
+// a pattern with more wildcards than path has segments to fill them.
+func fillPattern(pattern, path string) string {
+	segments := strings.Split(pattern, "/")
+	values := strings.Split(path, "/")
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, "{") {
+			continue
+		}
+		if i >= len(values) || values[i] == "" {
+			return ""
+		}
+		if strings.HasSuffix(segment, "...}") {
+			return strings.Join(append(segments[:i], values[i:]...), "/")
+		}
+		segments[i] = values[i]
+	}
+	return strings.Join(segments, "/")
+}
+
+// editDistance is the Levenshtein distance between a and b, in bytes.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
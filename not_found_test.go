@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+func TestEditDistance(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"", "", 0},
+		{"/albums", "/albums", 0},
+		{"/albumz", "/albums", 1},
+		{"/album", "/albums", 1},
+		{"/ablums", "/albums", 2},
+		{"", "/me", 3},
+		{"kitten", "sitting", 3},
+	} {
+		if got := editDistance(tc.a, tc.b); got != tc.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+		if got := editDistance(tc.b, tc.a); got != tc.want {
+			t.Errorf("editDistance(%q, %q) = %d, want %d", tc.b, tc.a, got, tc.want)
+		}
+	}
+}
+
+func TestSuggestRoute(t *testing.T) {
+	patterns := []string{"/albums", "/albums/{id}", "/albums/{id}/price-history", "/albums/by-slug/{slug...}", "/genres", "/artists", "/me", "/me/usage"}
+	for _, tc := range []struct{ path, want string }{
+		{"/albumz", "/albums"},
+		{"/Albums", "/albums"},
+		{"/genre", "/genres"},
+		{"/albums/42/price-histroy", "/albums/42/price-history"},
+		// A wildcard takes the segment where it stands, and one with dots
+		// the rest of the path.
+		{"/album/42", "/albums/42"},
+		{"/album/by-slug/blue-train/2", "/albums/by-slug/blue-train/2"},
+		// Too far from any route.
+		{"/api/anything", ""},
+		{"/ablumz", ""},
+		// A path that is a route's isn't suggested to itself, and short
+		// paths are near everything.
+		{"/albums", ""},
+		{"/mx", ""},
+		{"/", ""},
+	} {
+		if got := suggestRoute(patterns, tc.path); got != tc.want {
+			t.Errorf("suggestRoute(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestUnknownRoute(t *testing.T) {
+	s := newTestServer(t)
+	logs := captureLog(t)
+	traffic := func() types.RouteTraffic {
+		return decodeBody[types.MetricsReport](t, s.do(http.MethodGet, "/metrics", "")).Traffic["unmatched"]
+	}
+	before := traffic()
+
+	w := s.do(http.MethodGet, "/albumz", "")
+	p := expectProblem(t, w, http.StatusNotFound)
+	if p.Detail != "no route matches /albumz; did you mean /albums?" || p.Suggestion != "/albums" || p.Instance != "/albumz" {
+		t.Errorf("problem %+v, want /albums suggested", p)
+	}
+	if got := w.Header().Get("Cache-Control"); got != "no-store" {
+		t.Errorf("Cache-Control %q", got)
+	}
+	if p := expectProblem(t, s.do(http.MethodGet, "/api/anything", ""), http.StatusNotFound); p.Detail != "no route matches /api/anything" || p.Suggestion != "" {
+		t.Errorf("problem %+v, want no suggestion", p)
+	}
+	if p := expectProblem(t, s.do(http.MethodGet, "/albumz", "", "Accept-Language", "fr"), http.StatusNotFound); p.Suggestion != "/albums" || strings.HasPrefix(p.Detail, "no route") {
+		t.Errorf("in French: %+v", p)
+	}
+	if log := logs.take(); !strings.Contains(log, "No route for GET /albumz") {
+		t.Errorf("the log has no 404:\n%s", log)
+	}
+
+	// Scanning for paths counts every request under the one route.
+	for i := 0; i < 50; i++ {
+		s.do(http.MethodGet, fmt.Sprintf("/wp-admin/%d.php", i), "")
+	}
+	after := decodeBody[types.MetricsReport](t, s.do(http.MethodGet, "/metrics", ""))
+	if got := after.Traffic["unmatched"]; got.Requests-before.Requests != 53 || got.Errors-before.Errors != 53 {
+		t.Errorf("unmatched traffic %+v, from %+v: want 53 more requests and errors", got, before)
+	}
+	for route := range after.Traffic {
+		if strings.Contains(route, "wp-admin") {
+			t.Errorf("a scanned path is a route of its own: %s", route)
+		}
+	}
+	if prom := s.do(http.MethodGet, "/metrics?format=prometheus", "").Body.String(); !strings.Contains(prom, `route="unmatched"} `) || !strings.Contains(prom, "# TYPE albums_route_errors_total counter") {
+		t.Error("the Prometheus output has no unmatched errors")
+	}
+}
+
+func TestMethodNotAllowedProblem(t *testing.T) {
+	s := newTestServer(t)
+	logs := captureLog(t)
+	before := decodeBody[types.MetricsReport](t, s.do(http.MethodGet, "/metrics", "")).Traffic
+	w := s.do(http.MethodDelete, "/albums/stats", "")
+	p := expectProblem(t, w, http.StatusMethodNotAllowed)
+	if p.Detail != "Method not allowed" || p.Suggestion != "" {
+		t.Errorf("problem %+v", p)
+	}
+	if got := w.Header().Get("Allow"); got != "GET, OPTIONS" {
+		t.Errorf("Allow %q", got)
+	}
+	if log := logs.take(); !strings.Contains(log, "DELETE /albums/stats") || !strings.Contains(log, "GET, OPTIONS") {
+		t.Errorf("the log doesn't say what was refused:\n%s", log)
+	}
+	// A route's 405 is counted under the route, not as unmatched.
+	traffic := decodeBody[types.MetricsReport](t, s.do(http.MethodGet, "/metrics", "")).Traffic
+	if got := traffic["/albums/stats"]; got.Requests-before["/albums/stats"].Requests != 1 || got.Errors-before["/albums/stats"].Errors != 1 || traffic["unmatched"] != before["unmatched"] {
+		t.Errorf("traffic %+v, want the 405 under /albums/stats", traffic)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultAlbumsPageSize    = 50
+	defaultAlbumsMaxPageSize = 500
+)
+
+// parseListPage reads limit and offset like parsePage, except that a limit
+// above maxLimit is lowered to it rather than refused, since some client
+// libraries ask for far more than any server gives. It reports whether it
+// did so.
+func parseListPage(r *http.Request, defaultLimit, maxLimit int) (limit, offset int, clamped bool, err error) {
+	q := r.URL.Query()
+	limit = defaultLimit
+	if raw := q.Get("limit"); raw != "" {
+		if limit, err = strconv.Atoi(raw); err != nil || limit < 1 {
+			return 0, 0, false, errors.New("limit must be a positive number")
+		}
+	}
+	if limit > maxLimit {
+		limit, clamped = maxLimit, true
+	}
+	if raw := q.Get("offset"); raw != "" {
+		if offset, err = strconv.Atoi(raw); err != nil || offset < 0 {
+			return 0, 0, false, errors.New("offset must be a non-negative number")
+		}
+	}
+	return limit, offset, clamped, nil
+}
+
+// writePageLinks sets an RFC 8288 Link header with the first, previous,
+// next, and last pages of a listing of total items, as absolute URLs that
+// keep the request's other query parameters. There is no previous link on
+// the first page and no next link on the last.
+func writePageLinks(w http.ResponseWriter, r *http.Request, limit, offset, total int) {
+	base := requestBaseURL(r) + r.URL.EscapedPath()
+	link := func(offset int, rel string) string {
+		q := r.URL.Query()
+		q.Set("limit", strconv.Itoa(limit))
+		q.Set("offset", strconv.Itoa(offset))
+		return "<" + base + "?" + q.Encode() + `>; rel="` + rel + `"`
+	}
+	last := 0
+	if total > 0 {
+		last = (total - 1) / limit * limit
+	}
+	links := []string{link(0, "first")}
+	if offset > 0 {
+		links = append(links, link(max(offset-limit, 0), "prev"))
+	}
+	if offset+limit < total {
+		links = append(links, link(offset+limit, "next"))
+	}
+	links = append(links, link(last, "last"))
+	w.Header().Set("Link", strings.Join(links, ", "))
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+}
+
+// writeCursorLinks sets the Link header of a cursor-paged listing: the
+// first page, and the next one when there is one. Its cursor is in
+// X-Next-Cursor too. There is no total, which would cost a count of the
+// whole listing.
+func writeCursorLinks(w http.ResponseWriter, r *http.Request, limit int, next string) {
+	base := requestBaseURL(r) + r.URL.EscapedPath()
+	link := func(cursor, rel string) string {
+		q := r.URL.Query()
+		q.Set("limit", strconv.Itoa(limit))
+		q.Set("cursor", cursor)
+		return "<" + base + "?" + q.Encode() + `>; rel="` + rel + `"`
+	}
+	links := []string{link("", "first")}
+	if next != "" {
+		links = append(links, link(next, "next"))
+		w.Header().Set("X-Next-Cursor", next)
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
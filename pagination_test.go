@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPageLinks(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.AlbumsPageSize, cfg.AlbumsMaxPageSize = 2, 3 })
+	for i := 0; i < 5; i++ {
+		s.create(newTestAlbum(withTitle(fmt.Sprintf("Album %d", i)), withArtist("Miles Davis")))
+	}
+	for _, tc := range []struct {
+		path  string
+		count int
+		links []string
+	}{
+		// The first page has no previous page, and the page size is the
+		// configured default.
+		{"/albums", 2, []string{
+			`<http://example.com/albums?limit=2&offset=0>; rel="first"`,
+			`<http://example.com/albums?limit=2&offset=2>; rel="next"`,
+			`<http://example.com/albums?limit=2&offset=4>; rel="last"`,
+		}},
+		{"/albums?artist=Miles+Davis&limit=2&offset=2", 2, []string{
+			`<http://example.com/albums?artist=Miles+Davis&limit=2&offset=0>; rel="first"`,
+			`<http://example.com/albums?artist=Miles+Davis&limit=2&offset=0>; rel="prev"`,
+			`<http://example.com/albums?artist=Miles+Davis&limit=2&offset=4>; rel="next"`,
+			`<http://example.com/albums?artist=Miles+Davis&limit=2&offset=4>; rel="last"`,
+		}},
+		// The last page has no next page.
+		{"/albums?limit=2&offset=4", 1, []string{
+			`<http://example.com/albums?limit=2&offset=0>; rel="first"`,
+			`<http://example.com/albums?limit=2&offset=2>; rel="prev"`,
+			`<http://example.com/albums?limit=2&offset=4>; rel="last"`,
+		}},
+		{"/albums?limit=2&offset=9", 0, []string{
+			`<http://example.com/albums?limit=2&offset=0>; rel="first"`,
+			`<http://example.com/albums?limit=2&offset=7>; rel="prev"`,
+			`<http://example.com/albums?limit=2&offset=4>; rel="last"`,
+		}},
+	} {
+		w := s.do(http.MethodGet, tc.path, "")
+		if got := decodeBody[[]album](t, w); len(got) != tc.count {
+			t.Errorf("GET %s: %d albums, want %d", tc.path, len(got), tc.count)
+		}
+		if got, want := w.Header().Get("Link"), strings.Join(tc.links, ", "); got != want {
+			t.Errorf("GET %s: Link\n got %s\nwant %s", tc.path, got, want)
+		}
+		if total := w.Header().Get("X-Total-Count"); total != "5" {
+			t.Errorf("GET %s: X-Total-Count %q", tc.path, total)
+		}
+		if clamped := w.Header().Get("X-Limit-Clamped"); clamped != "" {
+			t.Errorf("GET %s: X-Limit-Clamped %q", tc.path, clamped)
+		}
+	}
+
+	// A limit over the maximum is lowered to it, not refused.
+	w := s.do(http.MethodGet, "/albums?limit=10000", "")
+	if got := decodeBody[[]album](t, w); len(got) != 3 || w.Header().Get("X-Limit-Clamped") != "3" {
+		t.Errorf("limit=10000: %d albums and X-Limit-Clamped %q, want 3", len(got), w.Header().Get("X-Limit-Clamped"))
+	}
+	if link := w.Header().Get("Link"); !strings.Contains(link, `<http://example.com/albums?limit=3&offset=3>; rel="next"`) {
+		t.Errorf("limit=10000: Link %s, want pages of 3", link)
+	}
+	expectProblem(t, s.do(http.MethodGet, "/albums?limit=0", ""), http.StatusBadRequest)
+}
+
+func TestCursorPages(t *testing.T) {
+	s := newTestServer(t)
+	var want []string
+	for i := 0; i < 5; i++ {
+		want = append(want, s.create(newTestAlbum(withTitle(fmt.Sprintf("Album %d", i)))).ID)
+	}
+
+	// Following X-Next-Cursor reads each album once, newest first.
+	var got []string
+	path := "/albums?order=newest&limit=2&cursor="
+	for i := 0; ; i++ {
+		if i > 3 {
+			t.Fatal("the pages never end")
+		}
+		w := s.do(http.MethodGet, path, "")
+		expectStatus(t, w, http.StatusOK)
+		for _, a := range decodeBody[[]album](t, w) {
+			got = append(got, a.ID)
+		}
+		next := w.Header().Get("X-Next-Cursor")
+		if next == "" {
+			break
+		}
+		if link := w.Header().Get("Link"); !strings.Contains(link, `rel="next"`) || w.Header().Get("X-Total-Count") != "" {
+			t.Errorf("Link %s with X-Total-Count %q, want a next link and no total", link, w.Header().Get("X-Total-Count"))
+		}
+		path = "/albums?order=newest&limit=2&cursor=" + url.QueryEscape(next)
+	}
+	slices.Reverse(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("paged %v, want %v", got, want)
+	}
+
+	for _, path := range []string{
+		"/albums?cursor=not-a-cursor",
+		"/albums?cursor=&offset=2",
+		"/albums?cursor=&order=sideways",
+	} {
+		expectProblem(t, s.do(http.MethodGet, path, ""), http.StatusBadRequest)
+	}
+}
+
+func TestPageLinksProxied(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.AlbumsPageSize = 1
+		cfg.TrustedProxies = "10.0.0.0/8, fd00::/8"
+	})
+	s.create(newTestAlbum())
+	s.create(newTestAlbum(withTitle("Giant Steps")))
+	for _, tc := range []struct {
+		peer string
+		next string
+	}{
+		{"10.1.2.3:4000", "https://catalog.example.org/albums?limit=1&offset=1"},
+		{"[fd00::1]:4000", "https://catalog.example.org/albums?limit=1&offset=1"},
+		// Anyone else's forwarding headers are ignored.
+		{"203.0.113.9:4000", "http://example.com/albums?limit=1&offset=1"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/albums", nil)
+		req.RemoteAddr = tc.peer
+		// Two proxies: the first saw the client and the catalog's public
+		// name, the second the first and an internal one.
+		req.Header.Set("X-Forwarded-For", "198.51.100.4, 10.9.0.1")
+		req.Header.Set("X-Forwarded-Proto", "https, http")
+		req.Header.Set("X-Forwarded-Host", "catalog.example.org, internal.example.net")
+		w := httptest.NewRecorder()
+		s.handler.ServeHTTP(w, req)
+		if link := w.Header().Get("Link"); !strings.Contains(link, "<"+tc.next+`>; rel="next"`) {
+			t.Errorf("from %s: Link %s, want next at %s", tc.peer, link, tc.next)
+		}
+	}
+}
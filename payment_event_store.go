@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var (
+	errDuplicatePaymentEvent    = newCategorizedError(errConflict, "the payment event was already received")
+	errPaymentEventsUnsupported = errors.New("the configured store does not record payment events")
+)
+
+// paymentEventStore is implemented by album stores that record the payment
+// events they have handled next to the albums, so that a redelivery is
+// recognized by any instance, and after a restart.
+type paymentEventStore interface {
+	// SellAlbumForPayment records the payment event eventID until expires
+	// and sells quantity copies of the album with id, as SellAlbum does, in
+	// one change. It returns errDuplicatePaymentEvent, selling nothing, when
+	// eventID is recorded and its record hasn't expired at now. An unknown
+	// album or too little stock is returned with the event recorded, since a
+	// redelivery wouldn't fare better; any other failure records nothing.
+	SellAlbumForPayment(ctx context.Context, eventID string, now, expires time.Time, id string, quantity int) (album, error)
+	// PrunePaymentEvents forgets the records expired at now and returns how
+	// many there were.
+	PrunePaymentEvents(ctx context.Context, now time.Time) (int, error)
+}
+
+func paymentEventsOf(store AlbumStore) (paymentEventStore, error) {
+	events, ok := store.(paymentEventStore)
+	if !ok {
+		return nil, errPaymentEventsUnsupported
+	}
+	return events, nil
+}
+
+// settlesPayment reports whether a sale that failed with err still counts
+// the event as handled: the album is unknown or short of stock.
+func settlesPayment(err error) bool {
+	return errors.Is(err, errNotFound) || errors.Is(err, errOutOfStock)
+}
+
+func (store *InMemoryAlbumStore) SellAlbumForPayment(ctx context.Context, eventID string, now, expires time.Time, id string, quantity int) (album, error) {
+	store.mu.Lock()
+	if recorded, ok := store.paymentEvents[eventID]; ok && now.Before(recorded) {
+		store.mu.Unlock()
+		return album{}, errDuplicatePaymentEvent
+	}
+	store.paymentEvents[eventID] = expires
+	store.mu.Unlock()
+	// A concurrent delivery of the same event finds the record from here on;
+	// it is dropped again if the sale fails.
+	sold, err := store.SellAlbum(ctx, id, quantity)
+	if err != nil && !settlesPayment(err) {
+		store.mu.Lock()
+		delete(store.paymentEvents, eventID)
+		store.mu.Unlock()
+	}
+	return sold, err
+}
+
+func (store *InMemoryAlbumStore) PrunePaymentEvents(ctx context.Context, now time.Time) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	n := 0
+	for id, expires := range store.paymentEvents {
+		if !now.Before(expires) {
+			delete(store.paymentEvents, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// SellAlbumForPayment records the event and sells in one transaction. The
+// upsert only replaces an expired record; a live one, or one a concurrent
+// delivery is inserting, leaves it with no row written.
+func (store *PostgresAlbumStore) SellAlbumForPayment(ctx context.Context, eventID string, now, expires time.Time, id string, quantity int) (album, error) {
+	var sold album
+	var sellErr error
+	err := store.inTx(ctx, func(tx *PostgresAlbumStore) error {
+		opCtx, cancel := tx.opContext(ctx)
+		defer cancel()
+		tag, err := tx.db.Exec(opCtx,
+			`INSERT INTO payment_events (id, expires_at) VALUES ($1, $2)
+			 ON CONFLICT (id) DO UPDATE SET expires_at = excluded.expires_at WHERE payment_events.expires_at <= $3`,
+			eventID, expires, now)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return errDuplicatePaymentEvent
+		}
+		sold, sellErr = tx.SellAlbum(ctx, id, quantity)
+		if settlesPayment(sellErr) {
+			return nil
+		}
+		return sellErr
+	})
+	if err != nil {
+		return album{}, err
+	}
+	return sold, sellErr
+}
+
+func (store *PostgresAlbumStore) PrunePaymentEvents(ctx context.Context, now time.Time) (int, error) {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	tag, err := store.db.Exec(ctx, `DELETE FROM payment_events WHERE expires_at <= $1`, now)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// SellAlbumForPayment records the event and sells in one transaction, as
+// the Postgres store does. expires_at is kept as text in the layout of
+// sqliteChangeTime, so that it compares as a time.
+func (store *SqliteAlbumStore) SellAlbumForPayment(ctx context.Context, eventID string, now, expires time.Time, id string, quantity int) (album, error) {
+	var sold album
+	var sellErr error
+	err := store.inTx(ctx, func(tx *SqliteAlbumStore) error {
+		res := tx.db.WithContext(ctx).Exec(
+			`INSERT INTO payment_events (id, expires_at) VALUES (?, ?)
+			 ON CONFLICT (id) DO UPDATE SET expires_at = excluded.expires_at WHERE payment_events.expires_at <= ?`,
+			eventID, expires.UTC().Format(sqliteChangeTime), now.UTC().Format(sqliteChangeTime))
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return errDuplicatePaymentEvent
+		}
+		sold, sellErr = tx.SellAlbum(ctx, id, quantity)
+		if settlesPayment(sellErr) {
+			return nil
+		}
+		return sellErr
+	})
+	if err != nil {
+		return album{}, err
+	}
+	return sold, sellErr
+}
+
+func (store *SqliteAlbumStore) PrunePaymentEvents(ctx context.Context, now time.Time) (int, error) {
+	res := store.db.WithContext(ctx).Exec(`DELETE FROM payment_events WHERE expires_at <= ?`, now.UTC().Format(sqliteChangeTime))
+	return int(res.RowsAffected), res.Error
+}
+
+// paymentEvents is the collection of payment event records, one per event
+// ID as _id with the time it expires.
+func (store *MongoAlbumStore) paymentEvents() *mongo.Collection {
+	return store.collection.Database().Collection("paymentEvents")
+}
+
+// SellAlbumForPayment records the event and sells in one transaction on a
+// replica set. Recording upserts the document only if it has expired;
+// while it is live the upsert hits the duplicate _id. A standalone server
+// can't run the transaction, so there the record is deleted again when the
+// sale fails.
+func (store *MongoAlbumStore) SellAlbumForPayment(ctx context.Context, eventID string, now, expires time.Time, id string, quantity int) (album, error) {
+	var sold album
+	var sellErr error
+	recorded := false
+	sell := func(ctx context.Context) error {
+		_, err := store.paymentEvents().UpdateOne(ctx,
+			bson.D{{Key: "_id", Value: eventID}, {Key: "expiresAt", Value: bson.D{{Key: "$lte", Value: now}}}},
+			bson.D{{Key: "$set", Value: bson.D{{Key: "expiresAt", Value: expires}}}},
+			options.Update().SetUpsert(true))
+		if mongo.IsDuplicateKeyError(err) {
+			return errDuplicatePaymentEvent
+		}
+		if err != nil {
+			return err
+		}
+		recorded = true
+		sold, sellErr = store.SellAlbum(ctx, id, quantity)
+		if settlesPayment(sellErr) {
+			return nil
+		}
+		return sellErr
+	}
+	err := store.transaction(ctx, sell)
+	if errors.Is(err, errMongoStandalone) {
+		recorded = false
+		if err = sell(ctx); err != nil && recorded {
+			if _, delErr := store.paymentEvents().DeleteOne(context.WithoutCancel(ctx), bson.D{{Key: "_id", Value: eventID}}); delErr != nil {
+				log.Printf("🔥 Failed to forget payment event %s: %v", eventID, delErr)
+			}
+		}
+	}
+	if err != nil {
+		return album{}, err
+	}
+	return sold, sellErr
+}
+
+func (store *MongoAlbumStore) PrunePaymentEvents(ctx context.Context, now time.Time) (int, error) {
+	res, err := store.paymentEvents().DeleteMany(ctx, bson.D{{Key: "expiresAt", Value: bson.D{{Key: "$lte", Value: now}}}})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+// A payment event record is an item of the albums table, kept out of List
+// by its kind, with the time it expires in Unix milliseconds.
+const (
+	dynamoKindPaymentEvent = "paymentEvent"
+	dynamoPaymentPrefix    = "payment#"
+)
+
+// SellAlbumForPayment puts the record and updates the stock in one
+// transaction, each on its condition. A stock update that can't be made
+// cancels the record with it, so for an unknown album or too little stock
+// the record is put again on its own. The album is read back after the
+// sale, as a transaction returns no values.
+func (store *DynamoAlbumStore) SellAlbumForPayment(ctx context.Context, eventID string, now, expires time.Time, id string, quantity int) (album, error) {
+	record := &types.Put{
+		TableName: aws.String(dynamoAlbumsTable),
+		Item: map[string]types.AttributeValue{
+			"id":        &types.AttributeValueMemberS{Value: dynamoPaymentPrefix + eventID},
+			"kind":      &types.AttributeValueMemberS{Value: dynamoKindPaymentEvent},
+			"expiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(expires.UnixMilli(), 10)},
+		},
+		ConditionExpression:       aws.String("attribute_not_exists(id) OR expiresAt <= :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.UnixMilli(), 10)}},
+	}
+	updatedAt, err := attributevalue.Marshal(storeTimestamp())
+	if err != nil {
+		return album{}, err
+	}
+	opCtx, cancel := store.opContext(ctx)
+	defer cancel()
+	_, err = store.client.TransactWriteItems(opCtx, &dynamodb.TransactWriteItemsInput{TransactItems: []types.TransactWriteItem{
+		{Put: record},
+		{Update: &types.Update{
+			TableName:                aws.String(dynamoAlbumsTable),
+			Key:                      map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+			UpdateExpression:         aws.String("SET #stock = #stock - :quantity, updatedAt = :now"),
+			ConditionExpression:      aws.String("#kind = :album AND #stock >= :quantity"),
+			ExpressionAttributeNames: map[string]string{"#kind": "kind", "#stock": "stock"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":quantity": &types.AttributeValueMemberN{Value: strconv.Itoa(quantity)},
+				":now":      updatedAt,
+				":album":    &types.AttributeValueMemberS{Value: dynamoKindAlbum},
+			},
+		}},
+	}})
+	if err == nil {
+		return store.getAlbum(opCtx, id)
+	}
+	var canceled *types.TransactionCanceledException
+	i := dynamoFailedWrite(err)
+	if i < 0 || !errors.As(err, &canceled) || aws.ToString(canceled.CancellationReasons[i].Code) != "ConditionalCheckFailed" {
+		return album{}, err
+	}
+	if i == 0 {
+		return album{}, errDuplicatePaymentEvent
+	}
+	sellErr := errOutOfStock
+	if _, err := store.getAlbum(opCtx, id); err != nil {
+		if !errors.Is(err, errNotFound) {
+			return album{}, err
+		}
+		sellErr = err
+	}
+	_, err = store.client.PutItem(opCtx, &dynamodb.PutItemInput{
+		TableName:                 record.TableName,
+		Item:                      record.Item,
+		ConditionExpression:       record.ConditionExpression,
+		ExpressionAttributeValues: record.ExpressionAttributeValues,
+	})
+	var failed *types.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		return album{}, errDuplicatePaymentEvent
+	}
+	if err != nil {
+		return album{}, err
+	}
+	return album{}, sellErr
+}
+
+// PrunePaymentEvents scans for the expired records and deletes them one by
+// one, each on the condition that it is still expired.
+func (store *DynamoAlbumStore) PrunePaymentEvents(ctx context.Context, now time.Time) (int, error) {
+	nowValue := &types.AttributeValueMemberN{Value: strconv.FormatInt(now.UnixMilli(), 10)}
+	pages := dynamodb.NewScanPaginator(store.client, &dynamodb.ScanInput{
+		TableName:                aws.String(dynamoAlbumsTable),
+		ProjectionExpression:     aws.String("id"),
+		FilterExpression:         aws.String("#kind = :kind AND expiresAt <= :now"),
+		ExpressionAttributeNames: map[string]string{"#kind": "kind"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":kind": &types.AttributeValueMemberS{Value: dynamoKindPaymentEvent},
+			":now":  nowValue,
+		},
+	})
+	n := 0
+	for pages.HasMorePages() {
+		opCtx, cancel := store.opContext(ctx)
+		page, err := pages.NextPage(opCtx)
+		cancel()
+		if err != nil {
+			return n, err
+		}
+		for _, item := range page.Items {
+			opCtx, cancel := store.opContext(ctx)
+			_, err := store.client.DeleteItem(opCtx, &dynamodb.DeleteItemInput{
+				TableName:                 aws.String(dynamoAlbumsTable),
+				Key:                       map[string]types.AttributeValue{"id": item["id"]},
+				ConditionExpression:       aws.String("expiresAt <= :now"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{":now": nowValue},
+			})
+			cancel()
+			var failed *types.ConditionalCheckFailedException
+			if errors.As(err, &failed) {
+				continue
+			}
+			if err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, nil
+}
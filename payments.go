@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPaymentWebhookTolerance = 5 * time.Minute
+	defaultPaymentEventTTL         = 24 * time.Hour
+
+	// paymentSignatureHeader carries "t=<unix seconds>,v1=<hex HMAC>". The
+	// HMAC-SHA256 is over "<t>.<body>" with PAYMENT_WEBHOOK_SECRET; there
+	// may be several v1 values while the provider rotates secrets.
+	paymentSignatureHeader = "Payment-Signature"
+
+	// maxPaymentEventBytes bounds an event body; real ones are tiny.
+	maxPaymentEventBytes = 64 << 10
+
+	// paymentSucceeded is the event type that sells copies of an album.
+	// Other types are acknowledged and ignored.
+	paymentSucceeded = "payment.succeeded"
+)
+
+var (
+	errPaymentSignature = errors.New("the payment signature is missing or doesn't match")
+	errPaymentTimestamp = errors.New("the payment signature timestamp is outside the tolerance")
+)
+
+// paymentEvent is the body the payment provider posts.
+type paymentEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		AlbumID string `json:"albumId"`
+		// Quantity is the number of copies sold; 0 means 1.
+		Quantity int `json:"quantity"`
+	} `json:"data"`
+}
+
+// verifyPaymentSignature checks header, as sent with body, against secret:
+// its timestamp must be within tolerance of now, and one of its v1 values
+// the HMAC of the timestamp and body. The timestamp is signed, so a
+// captured request can't be replayed later under a fresh one.
+func verifyPaymentSignature(header string, body []byte, secret string, now time.Time, tolerance time.Duration) error {
+	var timestamp string
+	var signatures [][]byte
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(part), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			if sig, err := hex.DecodeString(value); err == nil {
+				signatures = append(signatures, sig)
+			}
+		}
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || len(signatures) == 0 {
+		return errPaymentSignature
+	}
+	want := signWebhook(secret, timestamp, body)
+	matched := false
+	for _, sig := range signatures {
+		matched = matched || hmac.Equal(sig, want)
+	}
+	if !matched {
+		return errPaymentSignature
+	}
+	if age := now.Sub(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return errPaymentTimestamp
+	}
+	return nil
+}
+
+// prunePaymentEvents is the payment-events-janitor job.
+func prunePaymentEvents(ctx context.Context) error {
+	events, err := paymentEventsOf(albumStore)
+	if err != nil {
+		return err
+	}
+	n, err := events.PrunePaymentEvents(ctx, serverClock.Now())
+	if err != nil {
+		return err
+	}
+	debugf("Pruned %d payment event records", n)
+	return nil
+}
+
+// setupPayments registers the janitor of the payment event records when the
+// webhook is enabled.
+func setupPayments(cfg *Config) {
+	if cfg.PaymentWebhookSecret == "" {
+		return
+	}
+	scheduler.register("payment-events-janitor", rateLimitJanitorInterval, prunePaymentEvents)
+	log.Printf("💳 Receiving payment webhooks, tolerating %s of clock skew", cfg.PaymentWebhookTolerance)
+}
+
+// postPaymentWebhook receives an event from the payment provider. Once the
+// signature checks out, a payment.succeeded event is recorded in the store
+// and its copies sold in one change before the answer, so a 200 means the
+// stock is down. A duplicate gets 200 too, and nothing else happens; a store
+// failure gets a 5xx, so the provider delivers the event again.
+func postPaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPaymentEventBytes))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	now := serverClock.Now()
+	if err := verifyPaymentSignature(r.Header.Get(paymentSignatureHeader), body, cfg.PaymentWebhookSecret, now, cfg.PaymentWebhookTolerance); err != nil {
+		writeProblem(w, r, http.StatusUnauthorized, err.Error())
+		log.Printf("🔒 Rejected payment webhook from %s: %v", clientAddr(r), err)
+		return
+	}
+	var event paymentEvent
+	if err := json.NewDecoder(bytes.NewReader(body)).Decode(&event); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	if event.ID == "" {
+		writeProblem(w, r, http.StatusBadRequest, "the event has no id")
+		log.Println("📉 Bad request: payment event has no id")
+		return
+	}
+	if event.Type != paymentSucceeded {
+		writeJSON(w, http.StatusOK, map[string]bool{"received": true})
+		log.Printf("💳 Ignored payment event %s of type %q", event.ID, event.Type)
+		return
+	}
+	if event.Data.AlbumID == "" || event.Data.Quantity < 0 {
+		writeProblem(w, r, http.StatusBadRequest, "the event needs an albumId and a quantity of at least 1")
+		log.Printf("📉 Bad request: payment event %s has no album or a negative quantity", event.ID)
+		return
+	}
+	events, err := paymentEventsOf(albumStore)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	quantity := max(event.Data.Quantity, 1)
+	sold, err := events.SellAlbumForPayment(r.Context(), event.ID, now, now.Add(cfg.PaymentEventTTL), event.Data.AlbumID, quantity)
+	switch {
+	case errors.Is(err, errDuplicatePaymentEvent):
+		writeJSON(w, http.StatusOK, map[string]bool{"received": true, "duplicate": true})
+		log.Printf("💳 Payment event %s was already received", event.ID)
+		return
+	case errors.Is(err, errNotFound):
+		log.Printf("💳 Payment event %s is for unknown album %s", event.ID, event.Data.AlbumID)
+	case errors.Is(err, errOutOfStock):
+		log.Printf("💳 Payment event %s sold %d of album %s, more than are in stock", event.ID, quantity, event.Data.AlbumID)
+	case err != nil:
+		respondError(w, r, fmt.Errorf("payment event %s: %w", event.ID, err))
+		return
+	default:
+		albumsChanged()
+		recordAudit(auditAlbumSold, sold.ID, principalPayments, map[string]interface{}{"event": event.ID, "quantity": quantity, "stock": sold.Stock})
+		log.Printf("💳 Sold %d of %s by %s, %d left", quantity, sold.Title, sold.Artist, sold.Stock)
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"received": true})
+}
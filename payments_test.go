@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testPaymentSecret = "whsec_test"
+
+// newPaymentServer is a test server receiving payment webhooks.
+func newPaymentServer(t *testing.T) *testServer {
+	return newTestServer(t, func(cfg *Config) { cfg.PaymentWebhookSecret = testPaymentSecret })
+}
+
+// paymentSignature is the signature header the provider would send with
+// body at at.
+func paymentSignature(secret, body string, at time.Time) string {
+	ts := strconv.FormatInt(at.Unix(), 10)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(signWebhook(secret, ts, []byte(body)))
+}
+
+func postPayment(s *testServer, body, signature string) *httptest.ResponseRecorder {
+	s.t.Helper()
+	return s.do(http.MethodPost, "/integrations/payments", body, paymentSignatureHeader, signature)
+}
+
+func TestPaymentWebhook(t *testing.T) {
+	s := newPaymentServer(t)
+	logs := captureLog(t)
+	a := s.create(newTestAlbum(func(a *album) { a.Stock = 5 }))
+	body := fmt.Sprintf(`{"id": "evt_1", "type": "payment.succeeded", "data": {"albumId": %q, "quantity": 2}}`, a.ID)
+
+	// The copies are sold by the time the event is acknowledged.
+	expectStatus(t, postPayment(s, body, paymentSignature(testPaymentSecret, body, s.clock.Now())), http.StatusOK)
+	if logged := logs.take(); !strings.Contains(logged, "Sold 2 of Blue Train by John Coltrane, 3 left") {
+		t.Errorf("logged %q, want the sale", logged)
+	}
+	if got := decodeBody[album](t, s.do(http.MethodGet, "/albums/"+a.ID, "")); got.Stock != 3 {
+		t.Errorf("stock %d after the event, want 3", got.Stock)
+	}
+	if entries := auditEntries(t, auditAlbumSold); len(entries) != 1 || entries[0].Principal != principalPayments {
+		t.Errorf("audit entries %+v, want the sale", entries)
+	}
+
+	// The provider redelivers the event, freshly signed: it is acknowledged
+	// and the copies aren't sold twice.
+	s.clock.Advance(time.Hour)
+	w := postPayment(s, body, paymentSignature(testPaymentSecret, body, s.clock.Now()))
+	if got := decodeBody[map[string]bool](t, w); !got["duplicate"] {
+		t.Errorf("the redelivery answered %v, want a duplicate", got)
+	}
+	if got := decodeBody[album](t, s.do(http.MethodGet, "/albums/"+a.ID, "")); got.Stock != 3 {
+		t.Errorf("stock %d after the redelivery, want 3", got.Stock)
+	}
+	if entries := auditEntries(t, auditAlbumSold); len(entries) != 1 {
+		t.Errorf("%d sales audited, want 1", len(entries))
+	}
+}
+
+func TestPaymentWebhookSignature(t *testing.T) {
+	s := newPaymentServer(t)
+	logs := captureLog(t)
+	a := s.create(newTestAlbum(func(a *album) { a.Stock = 5 }))
+	body := fmt.Sprintf(`{"id": "evt_2", "type": "payment.succeeded", "data": {"albumId": %q}}`, a.ID)
+	now := s.clock.Now()
+	good := paymentSignature(testPaymentSecret, body, now)
+
+	for _, tc := range []struct {
+		name, body, signature, detail string
+	}{
+		{"no signature", body, "", errPaymentSignature.Error()},
+		{"another secret", body, paymentSignature("whsec_other", body, now), errPaymentSignature.Error()},
+		{"another body", strings.Replace(body, `"data"`, `"data" `, 1), good, errPaymentSignature.Error()},
+		{"timestamp changed after signing", body, strings.Replace(good, "t="+strconv.FormatInt(now.Unix(), 10), "t="+strconv.FormatInt(now.Unix()+1, 10), 1), errPaymentSignature.Error()},
+		{"not hex", body, "t=" + strconv.FormatInt(now.Unix(), 10) + ",v1=zz", errPaymentSignature.Error()},
+		// A captured request replayed later, and one signed too far ahead.
+		{"replayed", body, paymentSignature(testPaymentSecret, body, now.Add(-defaultPaymentWebhookTolerance-time.Second)), errPaymentTimestamp.Error()},
+		{"from the future", body, paymentSignature(testPaymentSecret, body, now.Add(defaultPaymentWebhookTolerance+time.Second)), errPaymentTimestamp.Error()},
+	} {
+		if p := expectProblem(t, postPayment(s, tc.body, tc.signature), http.StatusUnauthorized); p.Detail != tc.detail {
+			t.Errorf("%s: %q, want %q", tc.name, p.Detail, tc.detail)
+		}
+	}
+
+	// While the provider rotates secrets either signature is good, and a
+	// timestamp at the edge of the tolerance still is.
+	rotating := paymentSignature("whsec_old", body, now.Add(-defaultPaymentWebhookTolerance)) + "," + strings.Split(paymentSignature(testPaymentSecret, body, now.Add(-defaultPaymentWebhookTolerance)), ",")[1]
+	expectStatus(t, postPayment(s, body, rotating), http.StatusOK)
+	// The rejected requests sold nothing; the accepted one sold one copy.
+	if logged := logs.take(); !strings.Contains(logged, "Sold 1 of Blue Train by John Coltrane, 4 left") {
+		t.Errorf("logged %q, want the one sale", logged)
+	}
+}
+
+func TestPaymentWebhookUnknownAlbum(t *testing.T) {
+	s := newPaymentServer(t)
+	logs := captureLog(t)
+	body := `{"id": "evt_3", "type": "payment.succeeded", "data": {"albumId": "no-such-album", "quantity": 1}}`
+	expectStatus(t, postPayment(s, body, paymentSignature(testPaymentSecret, body, s.clock.Now())), http.StatusOK)
+	if logged := logs.take(); !strings.Contains(logged, "Payment event evt_3 is for unknown album no-such-album") {
+		t.Errorf("logged %q, want the unknown album", logged)
+	}
+
+	// The event stays handled: a redelivery wouldn't find the album either.
+	w := postPayment(s, body, paymentSignature(testPaymentSecret, body, s.clock.Now()))
+	if got := decodeBody[map[string]bool](t, w); !got["duplicate"] {
+		t.Errorf("the redelivery answered %v, want a duplicate", got)
+	}
+	if entries := auditEntries(t, auditAlbumSold); len(entries) != 0 {
+		t.Errorf("audit entries %+v, want no sale", entries)
+	}
+
+	for _, bad := range []string{
+		`{"type": "payment.succeeded", "data": {"albumId": "x"}}`,
+		`{"id": "evt_4", "type": "payment.succeeded", "data": {}}`,
+		`{"id": "evt_5", "type": "payment.succeeded", "data": {"albumId": "x", "quantity": -1}}`,
+	} {
+		expectProblem(t, postPayment(s, bad, paymentSignature(testPaymentSecret, bad, s.clock.Now())), http.StatusBadRequest)
+	}
+}
+
+// failingSaleStore is an InMemoryAlbumStore whose payment sales fail with
+// errConnectionRefused while failing is set.
+type failingSaleStore struct {
+	*InMemoryAlbumStore
+	failing atomic.Bool
+}
+
+func (s *failingSaleStore) SellAlbumForPayment(ctx context.Context, eventID string, now, expires time.Time, id string, quantity int) (album, error) {
+	if s.failing.Load() {
+		return album{}, errConnectionRefused
+	}
+	return s.InMemoryAlbumStore.SellAlbumForPayment(ctx, eventID, now, expires, id, quantity)
+}
+
+func TestPaymentWebhookStoreFailure(t *testing.T) {
+	s := newPaymentServer(t)
+	a := s.create(newTestAlbum(func(a *album) { a.Stock = 5 }))
+	store := &failingSaleStore{InMemoryAlbumStore: s.albums}
+	albumStore = store
+	body := fmt.Sprintf(`{"id": "evt_6", "type": "payment.succeeded", "data": {"albumId": %q}}`, a.ID)
+
+	// A failed sale isn't acknowledged, so the provider delivers the event
+	// again, and the redelivery is new.
+	store.failing.Store(true)
+	w := postPayment(s, body, paymentSignature(testPaymentSecret, body, s.clock.Now()))
+	if w.Code < 500 {
+		t.Errorf("a failed sale answered %d, want a 5xx", w.Code)
+	}
+	store.failing.Store(false)
+	w = postPayment(s, body, paymentSignature(testPaymentSecret, body, s.clock.Now()))
+	if got := decodeBody[map[string]bool](t, w); !got["received"] || got["duplicate"] {
+		t.Errorf("the redelivery answered %v, want it received", got)
+	}
+	if got := decodeBody[album](t, s.do(http.MethodGet, "/albums/"+a.ID, "")); got.Stock != 4 {
+		t.Errorf("stock %d, want the one sale", got.Stock)
+	}
+}
+
+func TestPaymentWebhookAcrossRestarts(t *testing.T) {
+	s := newPaymentServer(t)
+	a := s.create(newTestAlbum(func(a *album) { a.Stock = 5 }))
+	body := fmt.Sprintf(`{"id": "evt_7", "type": "payment.succeeded", "data": {"albumId": %q}}`, a.ID)
+	expectStatus(t, postPayment(s, body, paymentSignature(testPaymentSecret, body, s.clock.Now())), http.StatusOK)
+
+	// Another instance on the same store recognizes the redelivery.
+	other := newPaymentServer(t)
+	albumStore = s.albums
+	w := postPayment(other, body, paymentSignature(testPaymentSecret, body, other.clock.Now()))
+	if got := decodeBody[map[string]bool](t, w); !got["duplicate"] {
+		t.Errorf("the redelivery answered %v, want a duplicate", got)
+	}
+
+	// Once the record has expired and been pruned, the event ID is new.
+	other.clock.Advance(defaultPaymentEventTTL)
+	if err := prunePaymentEvents(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	w = postPayment(other, body, paymentSignature(testPaymentSecret, body, other.clock.Now()))
+	if got := decodeBody[map[string]bool](t, w); got["duplicate"] {
+		t.Errorf("after the record expired the event answered %v, want it new", got)
+	}
+	if got := decodeBody[album](t, other.do(http.MethodGet, "/albums/"+a.ID, "")); got.Stock != 3 {
+		t.Errorf("stock %d, want 3", got.Stock)
+	}
+}
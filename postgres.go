@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+const defaultPostgresQueryTimeout = 5 * time.Second
+
+// connectPostgres opens a connection pool for DATABASE_URL, sized by
+// PG_MAX_CONNS and PG_MIN_CONNS when set, and pings it so a bad URL or an
+// unreachable server is reported at startup rather than on the first request.
+func connectPostgres(cfg *Config) (*pgxpool.Pool, error) {
+	config, err := postgresConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return dialPostgres(config)
+}
+
+// postgresConfig builds the pool configuration without connecting.
+func postgresConfig(cfg *Config) (*pgxpool.Config, error) {
+	return postgresPoolConfig(cfg, "DATABASE_URL", cfg.DatabaseURL)
+}
+
+// postgresReplicaConfig builds the configuration of the read replica's
+// pool, sized as the primary's, or returns nil without
+// DATABASE_REPLICA_URL.
+func postgresReplicaConfig(cfg *Config) (*pgxpool.Config, error) {
+	if cfg.DatabaseReplicaURL == "" {
+		return nil, nil
+	}
+	return postgresPoolConfig(cfg, "DATABASE_REPLICA_URL", cfg.DatabaseReplicaURL)
+}
+
+func postgresPoolConfig(cfg *Config, env, url string) (*pgxpool.Config, error) {
+	config, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", env, err)
+	}
+	if cfg.PGMaxConns > 0 {
+		config.MaxConns = int32(cfg.PGMaxConns)
+	}
+	config.MinConns = int32(cfg.PGMinConns)
+	if config.MinConns > config.MaxConns {
+		return nil, fmt.Errorf("PG_MIN_CONNS (%d) must not exceed PG_MAX_CONNS (%d)", config.MinConns, config.MaxConns)
+	}
+	return config, nil
+}
+
+// dialPostgres connects a pool for config and pings it, giving up after 10
+// seconds. The pool gets its own copy of config, so a failed attempt can be
+// repeated with the same one.
+func dialPostgres(config *pgxpool.Config) (*pgxpool.Pool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	pool, err := pgxpool.ConnectConfig(ctx, config.Copy())
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s:%d: %w", config.ConnConfig.Host, config.ConnConfig.Port, err)
+	}
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("pinging %s:%d/%s: %w", config.ConnConfig.Host, config.ConnConfig.Port, config.ConnConfig.Database, err)
+	}
+	return pool, nil
+}
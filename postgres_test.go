@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// testPostgresPool connects to the database at TEST_POSTGRES_URL, skipping t
+// without one. Each test gets a schema of its own, migrated up and dropped
+// when t ends, so tests can share the database.
+func testPostgresPool(t testing.TB) *pgxpool.Pool {
+	t.Helper()
+	url := os.Getenv("TEST_POSTGRES_URL")
+	if url == "" {
+		t.Skip("TEST_POSTGRES_URL is not set")
+	}
+	ctx := context.Background()
+	admin, err := pgxpool.Connect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(admin.Close)
+	schema := fmt.Sprintf("test_%d", rand.Int63())
+	if _, err := admin.Exec(ctx, "CREATE SCHEMA "+schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Exec(context.Background(), "DROP SCHEMA "+schema+" CASCADE") })
+
+	config, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ConnConfig.RuntimeParams["search_path"] = schema + ",public"
+	pool, err := dialPostgres(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	migrations, err := loadMigrations("postgres")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := migrateUp(ctx, postgresMigrations{pool: pool}, migrations); err != nil {
+		t.Fatal(err)
+	}
+	return pool
+}
+
+func TestPostgresPoolConfig(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.PGMaxConns, cfg.PGMinConns = 8, 2
+	config, err := postgresPoolConfig(&cfg, "DATABASE_URL", "postgres://albums@db.internal:5433/albums")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MaxConns != 8 || config.MinConns != 2 {
+		t.Errorf("pool sized %d..%d, want 2..8", config.MinConns, config.MaxConns)
+	}
+	if config.ConnConfig.Host != "db.internal" || config.ConnConfig.Port != 5433 {
+		t.Errorf("pool for %s:%d, want db.internal:5433", config.ConnConfig.Host, config.ConnConfig.Port)
+	}
+
+	cfg.PGMinConns = 9
+	if _, err := postgresPoolConfig(&cfg, "DATABASE_URL", "postgres://albums@db.internal/albums"); err == nil {
+		t.Error("PG_MIN_CONNS above PG_MAX_CONNS was accepted")
+	}
+	cfg.PGMinConns = 2
+	if _, err := postgresPoolConfig(&cfg, "DATABASE_URL", "postgres://albums@db.internal:port/albums"); err == nil {
+		t.Error("a malformed DATABASE_URL was accepted")
+	}
+}
+
+// TestPostgresConcurrentUse shares one pool between goroutines reading and
+// writing at once; run it with -race.
+func TestPostgresConcurrentUse(t *testing.T) {
+	pool := testPostgresPool(t)
+	ctx := context.Background()
+	albums, err := NewPostgresAlbumStore(pool, defaultPostgresQueryTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := NewPostgresMetricsStore(pool)
+
+	const workers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			a, err := albums.Create(ctx, newTestAlbum(withID(newAlbumID()), withTitle(fmt.Sprintf("Blue Train %d", i))))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if got, err := albums.GetByID(ctx, a.ID); err != nil || got.Title != a.Title {
+				t.Errorf("GetByID(%s) = %q, %v; want %q", a.ID, got.Title, err, a.Title)
+			}
+			if _, err := albums.List(ctx, ListOptions{}); err != nil {
+				t.Error(err)
+			}
+			if err := ms.AddMetrics(ctx, Metrics{TotalRequests: 1}); err != nil {
+				t.Error(err)
+			}
+			if _, err := ms.LoadMetrics(ctx); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	m, err := ms.LoadMetrics(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.TotalRequests != workers {
+		t.Errorf("TotalRequests = %d, want %d", m.TotalRequests, workers)
+	}
+	page, err := albums.List(ctx, ListOptions{Limit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Albums) != workers {
+		t.Errorf("%d albums listed, want %d", len(page.Albums), workers)
+	}
+}
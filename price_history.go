@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/brentmzey/web-service-go/money"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultPriceHistoryPageSize = 100
+	maxPriceHistoryPageSize     = 1000
+)
+
+var errPriceHistoryUnsupported = errors.New("the configured store does not keep price history")
+
+// PriceChange is one entry in an album's price history.
+type PriceChange struct {
+	OldPrice  *money.Amount `json:"oldPrice"` // nil for the price the album was created with
+	NewPrice  money.Amount  `json:"newPrice"`
+	ChangedAt time.Time     `json:"changedAt"`
+	Principal string        `json:"principal"`
+}
+
+// priceHistorian is implemented by stores that record every price an album
+// has had, as part of the write that set it.
+type priceHistorian interface {
+	// PriceHistory returns a page of the album's price changes, newest
+	// first, and how many there are in all.
+	PriceHistory(ctx context.Context, albumID string, limit, offset int) ([]PriceChange, int, error)
+}
+
+func storePriceHistory(ctx context.Context, store AlbumStore, albumID string, limit, offset int) ([]PriceChange, int, error) {
+	h, ok := store.(priceHistorian)
+	if !ok {
+		return nil, 0, errPriceHistoryUnsupported
+	}
+	return h.PriceHistory(ctx, albumID, limit, offset)
+}
+
+// initialPrice is the history entry for the price a was created with.
+func initialPrice(ctx context.Context, a album) PriceChange {
+	return PriceChange{NewPrice: a.Price, ChangedAt: a.CreatedAt, Principal: principalFrom(ctx)}
+}
+
+// priceChange is the history entry for an update of existing to updated. It
+// reports false when the price didn't change.
+func priceChange(ctx context.Context, existing, updated album) (PriceChange, bool) {
+	if existing.Price == updated.Price {
+		return PriceChange{}, false
+	}
+	old := existing.Price
+	return PriceChange{OldPrice: &old, NewPrice: updated.Price, ChangedAt: updated.UpdatedAt, Principal: principalFrom(ctx)}, true
+}
+
+// priceChangeDetails is what a price change keeps in the details of its
+// audit log entry.
+type priceChangeDetails struct {
+	OldPrice *money.Amount `json:"oldPrice,omitempty"`
+	NewPrice money.Amount  `json:"newPrice"`
+}
+
+// auditEntry is the audit log entry the SQL and MongoDB stores keep c as.
+// Its ID is a version 7 UUID, so entries written in the same millisecond
+// still sort in the order they were made.
+func (c PriceChange) auditEntry(albumID string) AuditEntry {
+	details := map[string]interface{}{"newPrice": c.NewPrice}
+	if c.OldPrice != nil {
+		details["oldPrice"] = *c.OldPrice
+	}
+	return AuditEntry{
+		ID:        uuid.Must(uuid.NewV7()).String(),
+		Timestamp: c.ChangedAt,
+		Action:    auditAlbumPriceChanged,
+		AlbumID:   albumID,
+		Principal: c.Principal,
+		Details:   details,
+	}
+}
+
+// priceChangeFromAudit reads a price change back from its audit log entry.
+func priceChangeFromAudit(at time.Time, principal string, details []byte) (PriceChange, error) {
+	var d priceChangeDetails
+	if err := json.Unmarshal(details, &d); err != nil {
+		return PriceChange{}, err
+	}
+	return PriceChange{OldPrice: d.OldPrice, NewPrice: d.NewPrice, ChangedAt: at.UTC(), Principal: principal}, nil
+}
+
+// priceLedger is the in-memory store's price history: each album's changes,
+// oldest first.
+type priceLedger map[string][]PriceChange
+
+// page returns the changes for albumID newest first, from offset.
+func (l priceLedger) page(albumID string, limit, offset int) ([]PriceChange, int) {
+	changes := l[albumID]
+	total := len(changes)
+	page := []PriceChange{}
+	for i := total - 1 - offset; i >= 0 && len(page) < limit; i-- {
+		page = append(page, changes[i])
+	}
+	return page, total
+}
+
+// priceHistoryPage is the answer to GET /albums/{id}/price-history.
+type priceHistoryPage struct {
+	AlbumID string        `json:"albumId"`
+	Changes []PriceChange `json:"changes"`
+	Total   int           `json:"total"` // changes across every page
+	Limit   int           `json:"limit"`
+	Offset  int           `json:"offset"`
+}
+
+// getPriceHistory lists how an album's price has moved, newest first, back
+// to the price it was created with.
+func getPriceHistory(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	limit, offset, err := parsePage(r, defaultPriceHistoryPageSize, maxPriceHistoryPageSize)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	if _, err := albumStore.GetByID(r.Context(), id); err != nil && !errors.Is(err, errStaleRead) {
+		respondError(w, r, err)
+		return
+	}
+	changes, total, err := storePriceHistory(r.Context(), albumStore, id, limit, offset)
+	if errors.Is(err, errPriceHistoryUnsupported) {
+		writeProblem(w, r, http.StatusNotImplemented, err.Error())
+		log.Println("🚧 Price history requested but the album store doesn't keep it")
+		return
+	}
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, priceHistoryPage{AlbumID: id, Changes: changes, Total: total, Limit: limit, Offset: offset})
+	log.Printf("💲 Served %d price changes for album %s", len(changes), id)
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// routeRequests is how many requests /metrics counts on route, which the
+// tests read before and after as the counts outlive them.
+func routeRequests(t *testing.T, s *testServer, route string) int64 {
+	t.Helper()
+	return decodeBody[types.MetricsReport](t, s.do(http.MethodGet, "/metrics", "")).Traffic[route].Requests
+}
+
+func TestPriceHistoryRoute(t *testing.T) {
+	s := newTestServer(t)
+	a := s.create(newTestAlbum())
+	before := routeRequests(t, s, "/albums/{id}/price-history")
+	expectStatus(t, s.do(http.MethodPut, "/albums/"+a.ID, albumJSON(newTestAlbum(withPrice(4999)))), http.StatusOK)
+
+	page := decodeBody[priceHistoryPage](t, s.do(http.MethodGet, "/albums/"+a.ID+"/price-history", ""))
+	if page.AlbumID != a.ID || page.Total != 2 || page.Changes[0].NewPrice.Cents() != 4999 {
+		t.Errorf("price history = %+v, want the update then the first price", page)
+	}
+	// It is a route of its own, with its own methods, and counted as one.
+	w := s.do(http.MethodPatch, "/albums/"+a.ID+"/price-history", `{"price": 1}`)
+	expectProblem(t, w, http.StatusMethodNotAllowed)
+	if allow := w.Header().Get("Allow"); allow != "GET, OPTIONS" {
+		t.Errorf("Allow = %q", allow)
+	}
+	if n := routeRequests(t, s, "/albums/{id}/price-history") - before; n != 2 {
+		t.Errorf("counted %d requests on /albums/{id}/price-history, want 2", n)
+	}
+	expectProblem(t, s.do(http.MethodGet, "/albums/no-such-album/price-history", ""), http.StatusNotFound)
+
+	// The lookups by slug and barcode aren't taken for it.
+	expectProblem(t, s.do(http.MethodGet, "/albums/by-slug/price-history", ""), http.StatusNotFound)
+	p := expectProblem(t, s.do(http.MethodGet, "/album/"+a.ID+"/price-history", ""), http.StatusNotFound)
+	if p.Suggestion != "/albums/"+a.ID+"/price-history" {
+		t.Errorf("suggestion %q", p.Suggestion)
+	}
+}
+
+func TestPriceHistoryRouteListed(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.MTLSOptionalRoutes = "/albums/{id}/price-history"
+		cfg.MetricsExcludeRoutes = "/albums/{id}/price-history"
+	})
+	a := s.create(newTestAlbum())
+	api := newAPIRoutes(s.cfg)
+	if got := api.route(httptest.NewRequest(http.MethodGet, "/albums/"+a.ID+"/price-history", nil)); got != "/albums/{id}/price-history" {
+		t.Errorf("route = %q", got)
+	}
+
+	// Without a client certificate, only the listed route gets in.
+	h := requireClientCert(s.cfg, api)
+	for path, want := range map[string]int{
+		"/albums/" + a.ID + "/price-history": http.StatusOK,
+		"/albums/" + a.ID:                    http.StatusUnauthorized,
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != want {
+			t.Errorf("GET %s without a certificate: %d, want %d", path, w.Code, want)
+		}
+	}
+
+	before := routeRequests(t, s, "/albums/{id}/price-history")
+	expectStatus(t, s.do(http.MethodGet, "/albums/"+a.ID+"/price-history", ""), http.StatusOK)
+	if n := routeRequests(t, s, "/albums/{id}/price-history") - before; n != 0 {
+		t.Errorf("counted %d requests on the excluded route", n)
+	}
+}
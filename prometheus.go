@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// promWriter writes the Prometheus text exposition format. Every series
+// carries the instance and environment labels, so series scraped from
+// replicas and deployments sharing a Prometheus stay apart.
+type promWriter struct {
+	buf    bytes.Buffer
+	labels string
+}
+
+func newPromWriter(instance, environment string) *promWriter {
+	return &promWriter{labels: promLabel("instance", instance) + "," + promLabel("environment", environment)}
+}
+
+// family starts a metric family of kind counter, gauge, or histogram.
+func (p *promWriter) family(name, kind, help string) {
+	fmt.Fprintf(&p.buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one series of the current family, with labels as name,
+// value pairs on top of the constant ones.
+func (p *promWriter) sample(name string, value int64, labels ...string) {
+	p.write(name, strconv.FormatInt(value, 10), labels)
+}
+
+// sampleFloat writes a series with a fractional value, such as seconds.
+func (p *promWriter) sampleFloat(name string, value float64, labels ...string) {
+	p.write(name, strconv.FormatFloat(value, 'g', -1, 64), labels)
+}
+
+func (p *promWriter) write(name, value string, labels []string) {
+	all := p.labels
+	for i := 0; i+1 < len(labels); i += 2 {
+		all += "," + promLabel(labels[i], labels[i+1])
+	}
+	fmt.Fprintf(&p.buf, "%s{%s} %s\n", name, all, value)
+}
+
+// single writes a family with one unlabelled series.
+func (p *promWriter) single(name, kind, help string, value int64) {
+	p.family(name, kind, help)
+	p.sample(name, value)
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func promLabel(name, value string) string {
+	return name + `="` + promEscaper.Replace(value) + `"`
+}
+
+// writePrometheus answers GET /metrics?format=prometheus with the counters
+// of report.
+func writePrometheus(w http.ResponseWriter, report types.MetricsReport) {
+	p := newPromWriter(report.Instance, report.Environment)
+	p.single("albums_requests_total", "counter", "Requests served.", report.TotalRequests)
+	p.single("albums_errors_total", "counter", "Requests answered with an error status.", report.TotalErrors)
+	p.single("albums_fetched_total", "counter", "Albums returned by reads.", report.TotalAlbumsFetched)
+	p.single("albums_added_total", "counter", "Albums created.", report.TotalAlbumsAdded)
+	p.single("albums_rate_limited_total", "counter", "Requests turned away by the rate limit.", report.TotalRateLimited)
+	p.single("albums_average_latency_ms", "gauge", "Average request latency in milliseconds.", report.AverageLatencyMs)
+	p.single("albums_in_flight_requests", "gauge", "Requests being served.", report.InFlightRequests)
+	p.single("albums_overload_shed_total", "counter", "Requests shed under load.", report.TotalOverloadShed)
+	p.single("albums_client_closed_requests_total", "counter", "Requests whose client hung up before the answer.", report.ClientClosedRequests)
+	p.single("albums_body_timeouts_total", "counter", "Requests answered 408 because their body didn't arrive in time.", report.TotalBodyTimeouts)
+	p.single("albums_body_too_large_total", "counter", "Requests answered 413 because their body was too large.", report.TotalBodyTooLarge)
+	p.single("albums_store_retries_total", "counter", "Store calls retried.", report.TotalStoreRetries)
+	p.single("albums_secondary_write_failures_total", "counter", "Writes the secondary store failed during a dual write.", report.TotalSecondaryWriteFailures)
+	p.single("albums_negative_cache_hits_total", "counter", "Lookups by ID answered 404 by the album ID filter without a store call.", report.TotalNegativeCacheHits)
+	p.single("albums_backup_failures_total", "counter", "Scheduled backups that failed.", report.TotalBackupFailures)
+	p.single("albums_metrics_samples_dropped_total", "counter", "Metrics history samples dropped while the metrics store was failing.", report.TotalMetricsSamplesDropped)
+	p.single("albums_rate_limit_clients", "gauge", "Clients the rate limiter is tracking.", int64(report.RateLimitClients))
+	p.single("albums_rate_limited_last_minute", "gauge", "Requests turned away by the rate limit in the last minute.", report.RateLimitedLastMinute)
+
+	p.family("albums_circuit_breaker_open", "gauge", "Whether a store's circuit breaker is open (1) or not (0).")
+	for _, name := range slices.Sorted(maps.Keys(report.CircuitBreakers)) {
+		open := int64(0)
+		if report.CircuitBreakers[name] == "open" {
+			open = 1
+		}
+		p.sample("albums_circuit_breaker_open", open, "store", name)
+	}
+	writeStoreCalls(p)
+	writeConnectionPools(p, report.ConnectionPools)
+	writeReadHedging(p, report.ReadHedging)
+	p.family("albums_slow_requests_total", "counter", "Requests slower than SLOW_REQUEST_THRESHOLD, by route.")
+	for _, route := range slices.Sorted(maps.Keys(report.SlowRequests)) {
+		p.sample("albums_slow_requests_total", report.SlowRequests[route], "route", route)
+	}
+	p.family("albums_request_bytes_total", "counter", "Bytes read from request bodies, by route.")
+	for _, route := range slices.Sorted(maps.Keys(report.Traffic)) {
+		p.sample("albums_request_bytes_total", report.Traffic[route].BytesIn, "route", route)
+	}
+	p.family("albums_response_bytes_total", "counter", "Bytes written in response bodies, by route.")
+	for _, route := range slices.Sorted(maps.Keys(report.Traffic)) {
+		p.sample("albums_response_bytes_total", report.Traffic[route].BytesOut, "route", route)
+	}
+	p.family("albums_route_errors_total", "counter", "Requests answered with a 4xx or 5xx status, by route.")
+	for _, route := range slices.Sorted(maps.Keys(report.Traffic)) {
+		p.sample("albums_route_errors_total", report.Traffic[route].Errors, "route", route)
+	}
+	counts, sum, count := responseSizeHistogram()
+	p.family("albums_response_size_bytes", "histogram", "Size of response bodies.")
+	cumulative := int64(0)
+	for i, bound := range responseSizeBuckets {
+		cumulative += counts[i]
+		p.sample("albums_response_size_bytes_bucket", cumulative, "le", strconv.FormatInt(bound, 10))
+	}
+	p.sample("albums_response_size_bytes_bucket", count, "le", "+Inf")
+	p.sample("albums_response_size_bytes_sum", sum)
+	p.sample("albums_response_size_bytes_count", count)
+	p.family("albums_build_info", "gauge", "The running build; always 1.")
+	p.sample("albums_build_info", 1, "version", report.Build.Version, "commit", report.Build.Commit, "db_type", report.Build.DBType)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(p.buf.Bytes())
+}
+
+// writeStoreCalls writes the latency histogram and the error count of every
+// instrumented store's calls, by backend and operation.
+func writeStoreCalls(p *promWriter) {
+	backends := slices.Sorted(maps.Keys(instrumentedStores))
+	snapshots := make([]map[string]storeCallStats, len(backends))
+	for i, backend := range backends {
+		snapshots[i] = instrumentedStores[backend].snapshot()
+	}
+	p.family("albums_store_call_duration_seconds", "histogram", "Latency of store calls, by backend and operation.")
+	for i, backend := range backends {
+		for _, op := range slices.Sorted(maps.Keys(snapshots[i])) {
+			s := snapshots[i][op]
+			cumulative := int64(0)
+			for b, bound := range storeCallBuckets {
+				cumulative += s.buckets[b]
+				p.sample("albums_store_call_duration_seconds_bucket", cumulative, "backend", backend, "operation", op, "le", strconv.FormatFloat(bound.Seconds(), 'g', -1, 64))
+			}
+			p.sample("albums_store_call_duration_seconds_bucket", s.calls, "backend", backend, "operation", op, "le", "+Inf")
+			p.sampleFloat("albums_store_call_duration_seconds_sum", s.total.Seconds(), "backend", backend, "operation", op)
+			p.sample("albums_store_call_duration_seconds_count", s.calls, "backend", backend, "operation", op)
+		}
+	}
+	p.family("albums_store_errors_total", "counter", "Store calls that failed, by backend and operation.")
+	for i, backend := range backends {
+		for _, op := range slices.Sorted(maps.Keys(snapshots[i])) {
+			p.sample("albums_store_errors_total", snapshots[i][op].errors, "backend", backend, "operation", op)
+		}
+	}
+}
+
+// writeConnectionPools writes the state of every store's connection pool.
+func writeConnectionPools(p *promWriter, pools map[string]types.PoolStats) {
+	backends := slices.Sorted(maps.Keys(pools))
+	p.family("albums_db_pool_connections", "gauge", "Connections in a store's pool, by state.")
+	for _, backend := range backends {
+		s := pools[backend]
+		p.sample("albums_db_pool_connections", int64(s.AcquiredConns), "backend", backend, "state", "acquired")
+		p.sample("albums_db_pool_connections", int64(s.IdleConns), "backend", backend, "state", "idle")
+		p.sample("albums_db_pool_connections", int64(s.ConstructingConns), "backend", backend, "state", "constructing")
+	}
+	p.family("albums_db_pool_max_connections", "gauge", "The most connections a store's pool opens.")
+	for _, backend := range backends {
+		p.sample("albums_db_pool_max_connections", int64(pools[backend].MaxConns), "backend", backend)
+	}
+	p.family("albums_db_pool_acquires_total", "counter", "Connections acquired from a store's pool.")
+	for _, backend := range backends {
+		p.sample("albums_db_pool_acquires_total", pools[backend].AcquireCount, "backend", backend)
+	}
+	p.family("albums_db_pool_empty_acquires_total", "counter", "Acquires that had to wait for a connection.")
+	for _, backend := range backends {
+		p.sample("albums_db_pool_empty_acquires_total", pools[backend].EmptyAcquireCount, "backend", backend)
+	}
+	p.family("albums_db_pool_canceled_acquires_total", "counter", "Acquires canceled before a connection was free.")
+	for _, backend := range backends {
+		p.sample("albums_db_pool_canceled_acquires_total", pools[backend].CanceledAcquireCount, "backend", backend)
+	}
+	p.family("albums_db_pool_acquire_seconds_total", "counter", "Time spent acquiring connections from a store's pool.")
+	for _, backend := range backends {
+		p.sampleFloat("albums_db_pool_acquire_seconds_total", pools[backend].AcquireDurationMs/1000, "backend", backend)
+	}
+}
+
+// writeReadHedging writes the hedged reads of every store that hedges them.
+func writeReadHedging(p *promWriter, hedging map[string]types.HedgeStats) {
+	backends := slices.Sorted(maps.Keys(hedging))
+	p.family("albums_store_hedged_reads_total", "counter", "Reads sent a second time because the first was slow.")
+	for _, backend := range backends {
+		p.sample("albums_store_hedged_reads_total", hedging[backend].Hedged, "backend", backend)
+	}
+	p.family("albums_store_hedge_wins_total", "counter", "Hedged reads the second request answered first.")
+	for _, backend := range backends {
+		p.sample("albums_store_hedge_wins_total", hedging[backend].Wins, "backend", backend)
+	}
+	p.family("albums_store_hedges_skipped_total", "counter", "Slow reads not hedged because the hedge budget was spent.")
+	for _, backend := range backends {
+		p.sample("albums_store_hedges_skipped_total", hedging[backend].Skipped, "backend", backend)
+	}
+}
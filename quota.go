@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brentmzey/web-service-go/internal/clock"
+	"github.com/brentmzey/web-service-go/types"
+)
+
+const (
+	tierFree = "free"
+	tierPaid = "paid"
+
+	defaultQuotaFreePerHour = 100
+	defaultQuotaPaidPerHour = 10000
+
+	quotaWindow = time.Hour
+)
+
+// caller is who a request is counted against by the rate limit and quota.
+type caller struct {
+	id   string // "key:<id>" for an API key, the client address for anonymous traffic
+	tier string
+}
+
+// identifyCaller works out who r is counted against: the API key it
+// presents, on the key's tier, or else its client address on the free tier.
+// The rate limiter calls it before apiKeyMiddleware has checked the key, so
+// a key that doesn't check out is counted against the client address; the
+// lookup goes through the key cache, which apiKeyMiddleware then reuses.
+func identifyCaller(r *http.Request) caller {
+	if secret := presentedAPIKey(r); secret != "" {
+		if k, ok, err := authenticateAPIKey(r.Context(), secret); err == nil && ok {
+			return caller{id: "key:" + k.ID, tier: k.Tier}
+		}
+	}
+	return caller{id: clientAddr(r), tier: tierFree}
+}
+
+// hourlyQuota is the number of requests tier allows per hour, read per
+// request so a reload applies straight away.
+func hourlyQuota(tier string) int {
+	cfg := currentConfig()
+	if tier == tierPaid {
+		return cfg.QuotaPaidPerHour
+	}
+	return cfg.QuotaFreePerHour
+}
+
+// quotaUsage is how much of its quota a caller has used in the current
+// window.
+type quotaUsage struct {
+	limit int
+	used  int
+	reset time.Time
+}
+
+func (u quotaUsage) remaining() int {
+	return max(u.limit-u.used, 0)
+}
+
+// QuotaStore keeps the callers' quota windows. A window is the hour up to
+// now, rolling with every request, so a caller can never get more than the
+// limit into any hour. The limit is passed in with every call rather than
+// stored, so a caller who changes tier mid-window keeps what they have used
+// and gets the new limit straight away.
+type QuotaStore interface {
+	// Consume counts a request from id if it is within limit in the
+	// window, and reports the usage either way; ok is false when the
+	// request is over the quota and wasn't counted.
+	Consume(ctx context.Context, id string, limit int, window time.Duration) (usage quotaUsage, ok bool, err error)
+	// Usage reports id's usage without counting anything.
+	Usage(ctx context.Context, id string, limit int, window time.Duration) (quotaUsage, error)
+}
+
+// quotaReset is when a caller who has made the requests counted at times,
+// oldest first, next has room for a request under limit: when the one that
+// leaves them one short of it drops out of the window. A caller with
+// nothing counted is given a whole window from now.
+func quotaReset(times []time.Time, limit int, now time.Time, window time.Duration) time.Time {
+	if len(times) == 0 {
+		return now.Add(window)
+	}
+	return times[max(len(times)-limit, 0)].Add(window)
+}
+
+// memoryQuotaStore keeps the quota windows in this process: the time of
+// every request counted in the last window, so a caller on the paid tier
+// costs up to QUOTA_PAID_PER_HOUR of them. Each replica counts on its own,
+// so behind a load balancer a caller gets the quota once per replica.
+type memoryQuotaStore struct {
+	clock   clock.Clock
+	mu      sync.Mutex
+	windows map[string][]time.Time
+}
+
+func newMemoryQuotaStore(c clock.Clock) *memoryQuotaStore {
+	return &memoryQuotaStore{clock: c, windows: make(map[string][]time.Time)}
+}
+
+// current returns the times of id's requests still in the window ending
+// now, forgetting the others. s.mu must be held.
+func (s *memoryQuotaStore) current(id string, now time.Time, window time.Duration) []time.Time {
+	times := s.windows[id]
+	n := 0
+	for n < len(times) && now.Sub(times[n]) >= window {
+		n++
+	}
+	if n == len(times) {
+		delete(s.windows, id)
+		return nil
+	}
+	times = times[n:]
+	s.windows[id] = times
+	return times
+}
+
+func (s *memoryQuotaStore) Consume(ctx context.Context, id string, limit int, window time.Duration) (quotaUsage, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	times := s.current(id, now, window)
+	ok := len(times) < limit
+	if ok {
+		times = append(times, now)
+		s.windows[id] = times
+	}
+	return quotaUsage{limit: limit, used: len(times), reset: quotaReset(times, limit, now, window)}, ok, nil
+}
+
+func (s *memoryQuotaStore) Usage(ctx context.Context, id string, limit int, window time.Duration) (quotaUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	times := s.current(id, now, window)
+	return quotaUsage{limit: limit, used: len(times), reset: quotaReset(times, limit, now, window)}, nil
+}
+
+// prune drops the callers with no request left in the window, returning
+// how many.
+func (s *memoryQuotaStore) prune(window time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	n := 0
+	for id, times := range s.windows {
+		if now.Sub(times[len(times)-1]) >= window {
+			delete(s.windows, id)
+			n++
+		}
+	}
+	return n
+}
+
+// redisQuotaStore keeps the quota windows in Redis, with QUOTA_REDIS_URL,
+// shared by every replica. A caller's window is a sorted set of its
+// requests, each scored by the Unix millisecond it was counted at.
+type redisQuotaStore struct {
+	client *redisClient
+	clock  clock.Clock
+}
+
+func redisQuotaKey(id string) string {
+	return "quota:hour:" + id
+}
+
+func redisMillis(t time.Time) string {
+	return strconv.FormatInt(t.UnixMilli(), 10)
+}
+
+// window drops the requests that have left key's window and counts the
+// rest, adding the request member first if it isn't "", all in one
+// transaction. The count is of the requests before member, including
+// those another replica has added and is still checking, so replicas
+// counting at once can't let through more than the quota between them.
+// oldest is when the first request left was counted.
+func (s *redisQuotaStore) window(ctx context.Context, key string, now time.Time, window time.Duration, member string) (count int, oldest time.Time, err error) {
+	cmds := [][]string{
+		{"MULTI"},
+		{"ZREMRANGEBYSCORE", key, "-inf", redisMillis(now.Add(-window))},
+		{"ZCARD", key},
+	}
+	if member != "" {
+		cmds = append(cmds,
+			[]string{"ZADD", key, redisMillis(now), member},
+			[]string{"PEXPIRE", key, strconv.FormatInt(window.Milliseconds(), 10)})
+	}
+	cmds = append(cmds, []string{"ZRANGE", key, "0", "0", "WITHSCORES"}, []string{"EXEC"})
+	replies, err := s.client.pipeline(ctx, cmds...)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	results, ok := replies[len(replies)-1].([]interface{})
+	if !ok || len(results) != len(cmds)-2 {
+		return 0, time.Time{}, fmt.Errorf("redis: unexpected reply %v to the quota transaction", replies[len(replies)-1])
+	}
+	n, ok := results[1].(int64)
+	if !ok {
+		return 0, time.Time{}, fmt.Errorf("redis: unexpected reply %v to ZCARD", results[1])
+	}
+	oldest, err = redisScoreTime(results[len(results)-1])
+	return int(n), oldest, err
+}
+
+// redisScoreTime reads the score of the first member in a ZRANGE reply
+// WITHSCORES as a time, or the zero time when there is none.
+func redisScoreTime(reply interface{}) (time.Time, error) {
+	values, ok := reply.([]interface{})
+	if !ok {
+		return time.Time{}, fmt.Errorf("redis: unexpected reply %v to ZRANGE", reply)
+	}
+	if len(values) < 2 {
+		return time.Time{}, nil
+	}
+	score, _ := values[1].(string)
+	ms, err := strconv.ParseFloat(score, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("redis: score %q: %w", score, err)
+	}
+	return time.UnixMilli(int64(ms)), nil
+}
+
+// reset is quotaReset for a window in Redis, given when its oldest request
+// was counted. Only a caller further over the limit than one request, as
+// one whose tier has just gone down, needs another look at the set.
+func (s *redisQuotaStore) reset(ctx context.Context, key string, used, limit int, oldest, now time.Time, window time.Duration) (time.Time, error) {
+	if used == 0 {
+		return now.Add(window), nil
+	}
+	if used <= limit {
+		return oldest.Add(window), nil
+	}
+	index := strconv.Itoa(used - limit)
+	reply, err := s.client.do(ctx, "ZRANGE", key, index, index, "WITHSCORES")
+	if err != nil {
+		return time.Time{}, err
+	}
+	at, err := redisScoreTime(reply)
+	if err != nil || at.IsZero() {
+		return now.Add(window), err
+	}
+	return at.Add(window), nil
+}
+
+func (s *redisQuotaStore) Consume(ctx context.Context, id string, limit int, window time.Duration) (quotaUsage, bool, error) {
+	now := s.clock.Now()
+	key := redisQuotaKey(id)
+	member := strconv.FormatInt(now.UnixNano(), 10) + "-" + strconv.FormatUint(rand.Uint64(), 36)
+	before, oldest, err := s.window(ctx, key, now, window, member)
+	if err != nil {
+		return quotaUsage{}, false, err
+	}
+	used, ok := before+1, before < limit
+	if !ok {
+		// The request is over the quota, so it isn't counted after all.
+		if _, err := s.client.do(ctx, "ZREM", key, member); err != nil {
+			return quotaUsage{}, false, err
+		}
+		used = before
+	}
+	reset, err := s.reset(ctx, key, used, limit, oldest, now, window)
+	if err != nil {
+		return quotaUsage{}, false, err
+	}
+	return quotaUsage{limit: limit, used: used, reset: reset}, ok, nil
+}
+
+func (s *redisQuotaStore) Usage(ctx context.Context, id string, limit int, window time.Duration) (quotaUsage, error) {
+	now := s.clock.Now()
+	key := redisQuotaKey(id)
+	used, oldest, err := s.window(ctx, key, now, window, "")
+	if err != nil {
+		return quotaUsage{}, err
+	}
+	reset, err := s.reset(ctx, key, used, limit, oldest, now, window)
+	if err != nil {
+		return quotaUsage{}, err
+	}
+	return quotaUsage{limit: limit, used: used, reset: reset}, nil
+}
+
+var quotas QuotaStore = newMemoryQuotaStore(serverClock)
+
+// setupQuotas picks where the hourly windows and monthly counts are kept:
+// in memory, or in Redis with QUOTA_REDIS_URL.
+func setupQuotas(cfg *Config) error {
+	if cfg.QuotaRedisURL == "" {
+		quotas = newMemoryQuotaStore(serverClock)
+		monthlyQuotas = newMemoryMonthlyQuotas()
+		return nil
+	}
+	client, err := newRedisClient(cfg.QuotaRedisURL)
+	if err != nil {
+		return err
+	}
+	quotas = &redisQuotaStore{client: client, clock: serverClock}
+	monthlyQuotas = &redisMonthlyQuotas{client: client}
+	log.Printf("⏳ Counting quotas in Redis at %s", client.addr)
+	return nil
+}
+
+// setQuotaHeaders reports u in the X-RateLimit headers, the reset as Unix
+// seconds.
+func setQuotaHeaders(w http.ResponseWriter, u quotaUsage) {
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(u.limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(u.remaining()))
+	w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(u.reset.Unix(), 10))
+}
+
+// consumeQuota counts r against its caller's hourly quota, setting the
+// X-RateLimit headers. It answers 429 and reports false once the quota is
+// used up. A store that can't be reached lets the request through rather
+// than turning everyone away.
+func consumeQuota(w http.ResponseWriter, r *http.Request, c caller) bool {
+	usage, ok, err := quotas.Consume(r.Context(), c.id, hourlyQuota(c.tier), quotaWindow)
+	if err != nil {
+		log.Printf("🔥 Failed to check the quota for %s: %v", c.id, err)
+		return true
+	}
+	setQuotaHeaders(w, usage)
+	if ok {
+		return true
+	}
+	atomic.AddInt64(&metrics.TotalRateLimited, 1)
+	retry := max(int(math.Ceil(usage.reset.Sub(serverClock.Now()).Seconds())), 1)
+	w.Header().Set("Retry-After", strconv.Itoa(retry))
+	writeProblem(w, r, http.StatusTooManyRequests, "Hourly quota exceeded")
+	log.Printf("⏳ Hourly quota of %d exceeded for %s (%s tier), resets at %s", usage.limit, c.id, c.tier, usage.reset.Format(time.RFC3339))
+	return false
+}
+
+// getUsage reports the caller's tier and how much of the hourly quota they
+// have left, counting this request, how much of the month's quota when
+// their tier has one, and the catalog's size under CATALOG_MAX_ALBUMS when
+// it is set.
+func getUsage(w http.ResponseWriter, r *http.Request) {
+	c := identifyCaller(r)
+	usage, err := quotas.Usage(r.Context(), c.id, hourlyQuota(c.tier), quotaWindow)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	body := types.Usage{
+		Tier:      c.tier,
+		Limit:     usage.limit,
+		Used:      usage.used,
+		Remaining: usage.remaining(),
+		ResetsAt:  usage.reset.UTC(),
+	}
+	if body.Monthly, err = monthlyUsage(r.Context(), c); err != nil {
+		respondError(w, r, err)
+		return
+	}
+	if limit := currentConfig().CatalogMaxAlbums; limit > 0 {
+		stats, err := storeStats(r.Context(), albumStore, AlbumFilter{})
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		body.Catalog = &types.CatalogUsage{Albums: stats.Count, Limit: limit, Remaining: max(limit-stats.Count, 0)}
+	}
+	setQuotaHeaders(w, usage)
+	writeJSON(w, http.StatusOK, body)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/internal/clock/clocktest"
+	"github.com/brentmzey/web-service-go/types"
+)
+
+func TestQuotaStores(t *testing.T) {
+	for _, backend := range []struct {
+		name string
+		open func(t *testing.T, clk *clocktest.Fake) QuotaStore
+	}{
+		{"memory", func(t *testing.T, clk *clocktest.Fake) QuotaStore { return newMemoryQuotaStore(clk) }},
+		{"redis", func(t *testing.T, clk *clocktest.Fake) QuotaStore {
+			return &redisQuotaStore{client: newFakeRedis(t).client(t), clock: clk}
+		}},
+	} {
+		t.Run(backend.name, func(t *testing.T) {
+			clk := clocktest.New(testStart)
+			s := backend.open(t, clk)
+			ctx := context.Background()
+			consume := func(wantOK bool, wantUsed int, wantReset time.Duration) {
+				t.Helper()
+				u, ok, err := s.Consume(ctx, "key:a", 3, time.Hour)
+				if err != nil || ok != wantOK || u.used != wantUsed || !u.reset.Equal(testStart.Add(wantReset)) {
+					t.Errorf("Consume = %+v, %v, %v, want %v with %d used and a reset at +%s", u, ok, err, wantOK, wantUsed, wantReset)
+				}
+			}
+
+			consume(true, 1, time.Hour)
+			consume(true, 2, time.Hour)
+			if u, _ := s.Usage(ctx, "key:b", 3, time.Hour); u.used != 0 || u.remaining() != 3 {
+				t.Errorf("another caller's usage = %+v, want none used", u)
+			}
+			clk.Advance(30 * time.Minute)
+			consume(true, 3, time.Hour)
+			consume(false, 3, time.Hour)
+
+			// The hour rolls: the first two requests leave it, and the one
+			// at 30 minutes is still counted.
+			clk.Advance(30 * time.Minute)
+			consume(true, 2, 90*time.Minute)
+			// A limit lowered below the count resets once enough have left.
+			if u, _ := s.Usage(ctx, "key:a", 1, time.Hour); u.used != 2 || !u.reset.Equal(testStart.Add(2*time.Hour)) {
+				t.Errorf("usage under a limit of 1 = %+v, want 2 used until +2h", u)
+			}
+			clk.Advance(time.Hour)
+			if u, _ := s.Usage(ctx, "key:a", 3, time.Hour); u.used != 0 || !u.reset.Equal(testStart.Add(3*time.Hour)) {
+				t.Errorf("usage after an hour without requests = %+v", u)
+			}
+		})
+	}
+}
+
+func TestMemoryQuotaStorePrune(t *testing.T) {
+	clk := clocktest.New(testStart)
+	s := newMemoryQuotaStore(clk)
+	ctx := context.Background()
+	s.Consume(ctx, "key:a", 2, time.Hour)
+	clk.Advance(30 * time.Minute)
+	s.Consume(ctx, "key:b", 2, time.Hour)
+	clk.Advance(30 * time.Minute)
+	if n := s.prune(time.Hour); n != 1 || len(s.windows) != 1 {
+		t.Errorf("pruned %d callers and kept %d, want 1 of each", n, len(s.windows))
+	}
+}
+
+func TestRedisQuotaStoreConcurrent(t *testing.T) {
+	const limit = 10
+	redis := newFakeRedis(t)
+	clk := clocktest.New(testStart)
+	ctx := context.Background()
+
+	// Replicas, each with a connection of its own, share the quota.
+	var wg sync.WaitGroup
+	var counted atomic.Int64
+	for range 5 {
+		s := &redisQuotaStore{client: redis.client(t), clock: clk}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				if _, ok, err := s.Consume(ctx, "key:a", limit, time.Hour); err != nil {
+					t.Error(err)
+				} else if ok {
+					counted.Add(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := counted.Load(); n != limit {
+		t.Errorf("%d of 50 requests counted, want the limit of %d", n, limit)
+	}
+	s := &redisQuotaStore{client: redis.client(t), clock: clk}
+	if u, _ := s.Usage(ctx, "key:a", limit, time.Hour); u.used != limit {
+		t.Errorf("usage %+v, want the turned-away requests left out", u)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.QuotaFreePerHour = 3 })
+	// expect sends a request and checks its status and X-RateLimit
+	// headers.
+	expect := func(status, remaining int) {
+		t.Helper()
+		w := s.do(http.MethodGet, "/albums", "")
+		if w.Code != status || w.Header().Get("X-RateLimit-Limit") != "3" || w.Header().Get("X-RateLimit-Remaining") != strconv.Itoa(remaining) {
+			t.Errorf("%d with limit %s and %s remaining, want %d with 3 and %d", w.Code, w.Header().Get("X-RateLimit-Limit"), w.Header().Get("X-RateLimit-Remaining"), status, remaining)
+		}
+	}
+
+	expect(http.StatusOK, 2)
+	expect(http.StatusOK, 1)
+	s.clock.Advance(10 * time.Minute)
+
+	// GET /me/usage counts itself, and uses up the quota.
+	usage := decodeBody[types.Usage](t, s.do(http.MethodGet, "/me/usage", ""))
+	if usage.Tier != tierFree || usage.Used != 3 || usage.Remaining != 0 || !usage.ResetsAt.Equal(testStart.Add(time.Hour)) {
+		t.Errorf("usage = %+v", usage)
+	}
+	w := s.do(http.MethodGet, "/albums", "")
+	expectProblem(t, w, http.StatusTooManyRequests)
+	if got := w.Header().Get("Retry-After"); got != "3000" {
+		t.Errorf("Retry-After = %q, want the 50 minutes left of the window", got)
+	}
+
+	// Another address has a quota of its own.
+	req := httptest.NewRequest(http.MethodGet, "/albums", nil)
+	req.RemoteAddr = "198.51.100.7:4000"
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Remaining") != "2" {
+		t.Errorf("another address: %d with %s remaining", w.Code, w.Header().Get("X-RateLimit-Remaining"))
+	}
+
+	// The hour rolls: the two requests at the start leave it, and the one
+	// to /me/usage is still counted.
+	s.clock.Advance(50 * time.Minute)
+	expect(http.StatusOK, 1)
+}
+
+func TestQuotaTierSwitch(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.QuotaFreePerHour = 3
+		cfg.QuotaPaidPerHour = 5
+	})
+	w := s.admin(http.MethodPost, "/admin/apikeys", `{"name": "ci", "tier": "free"}`)
+	expectStatus(t, w, http.StatusCreated)
+	key := decodeBody[types.APIKey](t, w)
+	auth := []string{"Authorization", "Bearer " + key.Secret}
+	setTier := func(tier string) {
+		t.Helper()
+		expectStatus(t, s.admin(http.MethodPatch, "/admin/apikeys/"+key.ID, `{"tier": "`+tier+`"}`), http.StatusOK)
+	}
+	// expect sends a request with the key and checks its status and
+	// X-RateLimit headers.
+	expect := func(status, limit, remaining int) {
+		t.Helper()
+		w := s.do(http.MethodGet, "/albums", "", auth...)
+		if w.Code != status || w.Header().Get("X-RateLimit-Limit") != strconv.Itoa(limit) || w.Header().Get("X-RateLimit-Remaining") != strconv.Itoa(remaining) {
+			t.Errorf("%d with limit %s and %s remaining, want %d with %d and %d", w.Code, w.Header().Get("X-RateLimit-Limit"), w.Header().Get("X-RateLimit-Remaining"), status, limit, remaining)
+		}
+	}
+
+	expect(http.StatusOK, 3, 2)
+	expect(http.StatusOK, 3, 1)
+	expect(http.StatusOK, 3, 0)
+	expect(http.StatusTooManyRequests, 3, 0)
+
+	// Moving up keeps what was used and raises the limit at once.
+	s.clock.Advance(10 * time.Minute)
+	setTier(tierPaid)
+	expect(http.StatusOK, 5, 1)
+	// GET /me/usage counts itself.
+	usage := decodeBody[types.Usage](t, s.do(http.MethodGet, "/me/usage", "", auth...))
+	if usage.Tier != tierPaid || usage.Used != 5 || usage.Remaining != 0 || !usage.ResetsAt.Equal(testStart.Add(time.Hour)) {
+		t.Errorf("usage after moving to paid = %+v", usage)
+	}
+	expect(http.StatusTooManyRequests, 5, 0)
+
+	// Moving down mid-window leaves nothing.
+	setTier(tierFree)
+	expect(http.StatusTooManyRequests, 3, 0)
+
+	// Anonymous traffic is counted by its address, apart from the key.
+	req := httptest.NewRequest(http.MethodGet, "/albums", nil)
+	req.RemoteAddr = "198.51.100.7:4000"
+	w = httptest.NewRecorder()
+	s.handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Remaining") != "2" {
+		t.Errorf("an anonymous request: %d with %s remaining", w.Code, w.Header().Get("X-RateLimit-Remaining"))
+	}
+
+	// The three requests at the start leave the hour; the two at 10
+	// minutes are still counted.
+	s.clock.Advance(50 * time.Minute)
+	expect(http.StatusOK, 3, 0)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/jackc/pgx/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// rateLimitSnapshotVersion is bumped whenever rateLimitSnapshot changes in a
+// way older code would misread. A snapshot of any other version is ignored.
+const rateLimitSnapshotVersion = 2
+
+// rateLimitSnapshot is the rate limiter's and quota store's state, saved so
+// a restart doesn't hand every client a fresh window.
+type rateLimitSnapshot struct {
+	Version int              `json:"version"`
+	TakenAt time.Time        `json:"takenAt"`
+	Clients []rateLimitEntry `json:"clients"`
+	Quotas  []quotaEntry     `json:"quotas"`
+	// Months is left out of snapshots taken before there were monthly
+	// quotas, which restore with none.
+	Months []monthlyQuotaEntry `json:"months,omitempty"`
+}
+
+type rateLimitEntry struct {
+	ID          string    `json:"id"`
+	LastRequest time.Time `json:"lastRequest"`
+	Count       int       `json:"count"`
+}
+
+type quotaEntry struct {
+	ID       string      `json:"id"`
+	Requests []time.Time `json:"requests"`
+}
+
+type monthlyQuotaEntry struct {
+	ID    string `json:"id"`
+	Month string `json:"month"`
+	Used  int    `json:"used"`
+}
+
+func (l *rateLimiter) snapshot() []rateLimitEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entries := make([]rateLimitEntry, 0, len(l.clients))
+	for id, info := range l.clients {
+		entries = append(entries, rateLimitEntry{ID: id, LastRequest: info.lastRequest, Count: info.requestCount})
+	}
+	return entries
+}
+
+// restore adds the entries still inside window to the counts, returning how
+// many. A client that has already been seen since the restart keeps its
+// newer request time and has the saved count added to its own.
+func (l *rateLimiter) restore(entries []rateLimitEntry, window time.Duration) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for _, e := range entries {
+		if l.clock.Since(e.LastRequest) >= window {
+			continue
+		}
+		if info, ok := l.clients[e.ID]; ok {
+			info.requestCount += e.Count
+		} else {
+			l.clients[e.ID] = &clientInfo{lastRequest: e.LastRequest, requestCount: e.Count}
+		}
+		n++
+	}
+	return n
+}
+
+func (s *memoryQuotaStore) snapshot() []quotaEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]quotaEntry, 0, len(s.windows))
+	for id, times := range s.windows {
+		entries = append(entries, quotaEntry{ID: id, Requests: slices.Clone(times)})
+	}
+	return entries
+}
+
+func (s *memoryMonthlyQuotas) snapshot() []monthlyQuotaEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := make([]monthlyQuotaEntry, 0, len(s.counts))
+	for key, used := range s.counts {
+		entries = append(entries, monthlyQuotaEntry{ID: key.id, Month: key.month, Used: used})
+	}
+	return entries
+}
+
+// restore adds the counts of month to those made since the restart,
+// returning how many; the other months' are over.
+func (s *memoryMonthlyQuotas) restore(entries []monthlyQuotaEntry, month string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, e := range entries {
+		if e.Month != month {
+			continue
+		}
+		s.counts[monthlyQuotaKey{id: e.ID, month: e.Month}] += e.Used
+		n++
+	}
+	return n
+}
+
+// restore puts back the requests still in the window, returning how many
+// callers had any. A caller already counted since the restart has its
+// requests put after the saved ones, which were made first.
+func (s *memoryQuotaStore) restore(entries []quotaEntry, window time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	n := 0
+	for _, e := range entries {
+		saved := slices.DeleteFunc(e.Requests, func(t time.Time) bool { return now.Sub(t) >= window })
+		if len(saved) == 0 {
+			continue
+		}
+		s.windows[e.ID] = append(saved, s.windows[e.ID]...)
+		n++
+	}
+	return n
+}
+
+// saveRateLimits is the rate-limit-snapshot job, also run once more on
+// shutdown. Quota windows and monthly counts are only saved when they are
+// kept in memory.
+func saveRateLimits(ctx context.Context) error {
+	snap := rateLimitSnapshot{Version: rateLimitSnapshotVersion, TakenAt: serverClock.Now().UTC(), Clients: limiter.snapshot()}
+	if store, ok := quotas.(*memoryQuotaStore); ok {
+		snap.Quotas = store.snapshot()
+	}
+	if store, ok := monthlyQuotas.(*memoryMonthlyQuotas); ok {
+		snap.Months = store.snapshot()
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if err := metricsStore.SaveRateLimitSnapshot(ctx, data); err != nil {
+		return err
+	}
+	debugf("Saved the rate limits of %d clients, %d quota windows, and %d monthly quotas", len(snap.Clients), len(snap.Quotas), len(snap.Months))
+	return nil
+}
+
+// restoreRateLimits loads the last snapshot, if there is one, dropping the
+// entries whose window has run out since. A snapshot this build can't read
+// is ignored; the clients start over as they would without one.
+func restoreRateLimits(ctx context.Context, store MetricsStore) {
+	data, err := store.LoadRateLimitSnapshot(ctx)
+	if err != nil {
+		log.Printf("🔥 Failed to load the rate limit snapshot: %v", err)
+		return
+	}
+	if data == nil {
+		return
+	}
+	var snap rateLimitSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil || snap.Version != rateLimitSnapshotVersion {
+		log.Printf("⏳ Ignoring a rate limit snapshot this build can't read (version %d, want %d)", snap.Version, rateLimitSnapshotVersion)
+		return
+	}
+	clients := limiter.restore(snap.Clients, currentConfig().RateLimitWindow)
+	windows := 0
+	if q, ok := quotas.(*memoryQuotaStore); ok {
+		windows = q.restore(snap.Quotas, quotaWindow)
+	}
+	months := 0
+	if q, ok := monthlyQuotas.(*memoryMonthlyQuotas); ok {
+		month, _ := quotaMonth(serverClock.Now())
+		months = q.restore(snap.Months, month)
+	}
+	log.Printf("⏳ Restored the rate limits of %d clients, %d quota windows, and %d monthly quotas from %s", clients, windows, months, snap.TakenAt.Format(time.RFC3339))
+}
+
+func (store *InMemoryMetricsStore) SaveRateLimitSnapshot(ctx context.Context, snapshot []byte) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.rateLimits = append([]byte(nil), snapshot...)
+	store.rateLimitsSavedAt = serverClock.Now().UTC()
+	return nil
+}
+
+func (store *InMemoryMetricsStore) LoadRateLimitSnapshot(ctx context.Context) ([]byte, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.rateLimits, nil
+}
+
+func (store *PostgresMetricsStore) SaveRateLimitSnapshot(ctx context.Context, snapshot []byte) error {
+	_, err := store.pool.Exec(ctx, `INSERT INTO rate_limit_snapshot (id, snapshot, saved_at) VALUES (1, $1, now())
+		 ON CONFLICT (id) DO UPDATE SET snapshot = EXCLUDED.snapshot, saved_at = EXCLUDED.saved_at`, string(snapshot))
+	return err
+}
+
+func (store *PostgresMetricsStore) LoadRateLimitSnapshot(ctx context.Context) ([]byte, error) {
+	var snapshot string
+	err := store.pool.QueryRow(ctx, `SELECT snapshot FROM rate_limit_snapshot WHERE id = 1`).Scan(&snapshot)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return []byte(snapshot), err
+}
+
+func (store *SqliteMetricsStore) SaveRateLimitSnapshot(ctx context.Context, snapshot []byte) error {
+	return store.db.WithContext(ctx).Exec(`INSERT INTO rate_limit_snapshot (id, snapshot, saved_at) VALUES (1, ?, ?)
+		 ON CONFLICT (id) DO UPDATE SET snapshot = excluded.snapshot, saved_at = excluded.saved_at`,
+		string(snapshot), time.Now().UTC()).Error
+}
+
+func (store *SqliteMetricsStore) LoadRateLimitSnapshot(ctx context.Context) ([]byte, error) {
+	var snapshot string
+	err := store.db.WithContext(ctx).Raw(`SELECT snapshot FROM rate_limit_snapshot WHERE id = 1`).Row().Scan(&snapshot)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return []byte(snapshot), err
+}
+
+// mongoRateLimitsID is the metrics collection's document holding the rate
+// limit snapshot.
+const mongoRateLimitsID = "rateLimits"
+
+func (store *MongoMetricsStore) SaveRateLimitSnapshot(ctx context.Context, snapshot []byte) error {
+	_, err := store.collection.UpdateOne(ctx, bson.D{{Key: "_id", Value: mongoRateLimitsID}}, bson.D{
+		{Key: "$set", Value: bson.D{{Key: "snapshot", Value: string(snapshot)}}},
+		{Key: "$currentDate", Value: bson.D{{Key: "savedAt", Value: true}}},
+	}, options.Update().SetUpsert(true))
+	return err
+}
+
+func (store *MongoMetricsStore) LoadRateLimitSnapshot(ctx context.Context) ([]byte, error) {
+	var doc struct {
+		Snapshot string `bson:"snapshot"`
+	}
+	err := store.collection.FindOne(ctx, bson.D{{Key: "_id", Value: mongoRateLimitsID}}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []byte(doc.Snapshot), nil
+}
+
+// dynamoRateLimitsID is the metrics table's item holding the rate limit
+// snapshot.
+const dynamoRateLimitsID = "rateLimits"
+
+func (store *DynamoMetricsStore) SaveRateLimitSnapshot(ctx context.Context, snapshot []byte) error {
+	_, err := store.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(dynamoMetricsTable),
+		Item: map[string]types.AttributeValue{
+			"id":       &types.AttributeValueMemberS{Value: dynamoRateLimitsID},
+			"snapshot": &types.AttributeValueMemberS{Value: string(snapshot)},
+			"savedAt":  &types.AttributeValueMemberS{Value: time.Now().UTC().Format(time.RFC3339)},
+		},
+	})
+	return err
+}
+
+func (store *DynamoMetricsStore) LoadRateLimitSnapshot(ctx context.Context) ([]byte, error) {
+	res, err := store.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(dynamoMetricsTable),
+		Key:            map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: dynamoRateLimitsID}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil || res.Item == nil {
+		return nil, err
+	}
+	snapshot, ok := res.Item["snapshot"].(*types.AttributeValueMemberS)
+	if !ok {
+		return nil, nil
+	}
+	return []byte(snapshot.Value), nil
+}
+
+func (store *BreakerMetricsStore) SaveRateLimitSnapshot(ctx context.Context, snapshot []byte) error {
+	if !store.breaker.allow() {
+		return errCircuitOpen
+	}
+	err := store.backend.SaveRateLimitSnapshot(ctx, snapshot)
+	store.breaker.record(err)
+	return err
+}
+
+func (store *BreakerMetricsStore) LoadRateLimitSnapshot(ctx context.Context) ([]byte, error) {
+	if !store.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+	snapshot, err := store.backend.LoadRateLimitSnapshot(ctx)
+	store.breaker.record(err)
+	return snapshot, err
+}
+
+func (store *DeferredMetricsStore) SaveRateLimitSnapshot(ctx context.Context, snapshot []byte) error {
+	ms, _, _, ok := store.conn.stores()
+	if !ok {
+		return errStoreConnecting
+	}
+	return ms.SaveRateLimitSnapshot(ctx, snapshot)
+}
+
+func (store *DeferredMetricsStore) LoadRateLimitSnapshot(ctx context.Context) ([]byte, error) {
+	ms, _, _, ok := store.conn.stores()
+	if !ok {
+		return nil, errStoreConnecting
+	}
+	return ms.LoadRateLimitSnapshot(ctx)
+}
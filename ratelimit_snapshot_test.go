@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// restart replaces the rate limiter and quota stores with empty ones, as a
+// new process would start with.
+func restart(s *testServer) {
+	limiter = newRateLimiter(s.clock)
+	quotas = newMemoryQuotaStore(s.clock)
+	monthlyQuotas = newMemoryMonthlyQuotas()
+}
+
+func TestRateLimitSnapshot(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	window := s.cfg.RateLimitWindow
+	month, reset := quotaMonth(s.clock.Now())
+
+	limiter.record("192.0.2.9", window, 100)
+	s.clock.Advance(window)
+	for i := 0; i < 3; i++ {
+		limiter.record("192.0.2.1", window, 100)
+		quotas.Consume(ctx, "key:ci", 10, quotaWindow)
+		monthlyQuotas.ConsumeMonth(ctx, "key:ci", month, 1000, reset)
+	}
+	if err := saveRateLimits(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	restart(s)
+	s.clock.Advance(time.Second)
+	// A request made before the snapshot is restored counts with it.
+	quotas.Consume(ctx, "key:ci", 10, quotaWindow)
+	restoreRateLimits(ctx, s.metrics)
+
+	// 192.0.2.9's window had run out before the snapshot was taken.
+	if n := limiter.clientCount(); n != 1 {
+		t.Errorf("%d clients restored, want 1", n)
+	}
+	if got := limiter.record("192.0.2.1", window, 100); got != 4 {
+		t.Errorf("the first request after the restart counted %d, want 4", got)
+	}
+	usage, _ := quotas.Usage(ctx, "key:ci", 10, quotaWindow)
+	if usage.remaining() != 6 || !usage.reset.Equal(testStart.Add(window+quotaWindow)) {
+		t.Errorf("quota %+v, want 6 of 10 left in the window started before the restart", usage)
+	}
+	if used, _ := monthlyQuotas.MonthUsage(ctx, "key:ci", month); used != 3 {
+		t.Errorf("%d used this month, want 3", used)
+	}
+}
+
+func TestRateLimitSnapshotExpired(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	limiter.record("192.0.2.1", s.cfg.RateLimitWindow, 100)
+	quotas.Consume(ctx, "key:ci", 10, quotaWindow)
+	if err := saveRateLimits(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart after the windows have run out gives everyone a new one.
+	restart(s)
+	s.clock.Advance(quotaWindow)
+	restoreRateLimits(ctx, s.metrics)
+	if n := limiter.clientCount(); n != 0 {
+		t.Errorf("%d clients restored, want none", n)
+	}
+	if usage, _ := quotas.Usage(ctx, "key:ci", 10, quotaWindow); usage.remaining() != 10 {
+		t.Errorf("quota %+v, want a fresh window", usage)
+	}
+}
+
+func TestRateLimitSnapshotVersion(t *testing.T) {
+	s := newTestServer(t)
+	ctx := context.Background()
+	logs := captureLog(t)
+	for _, data := range []string{
+		`{"version": 1, "takenAt": "2026-03-02T12:00:00Z", "clients": [{"id": "192.0.2.1", "lastRequest": "2026-03-02T12:00:00Z", "count": 5}]}`,
+		`{"clients": {"192.0.2.1": 5}}`,
+		`not json`,
+	} {
+		restart(s)
+		s.metrics.SaveRateLimitSnapshot(ctx, []byte(data))
+		restoreRateLimits(ctx, s.metrics)
+		if n := limiter.clientCount(); n != 0 {
+			t.Errorf("%s: %d clients restored, want the snapshot ignored", data, n)
+		}
+		if got := logs.take(); !strings.Contains(got, "Ignoring a rate limit snapshot") {
+			t.Errorf("%s: logged %q", data, got)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/internal/clock/clocktest"
+)
+
+func TestRateLimiterWindow(t *testing.T) {
+	clk := clocktest.New(testStart)
+	l := newRateLimiter(clk)
+	const window, limit = 10 * time.Second, 2
+
+	for i, want := range []int{1, 2, 3, 4} {
+		if got := l.record("192.0.2.1", window, limit); got != want {
+			t.Errorf("request %d counted %d, want %d", i+1, got, want)
+		}
+		clk.Advance(time.Second)
+	}
+	if got := l.rejectedLastMinute(); got != 2 {
+		t.Errorf("rejectedLastMinute = %d, want 2", got)
+	}
+
+	// The window runs from the second request, the last one let through.
+	clk.Advance(window - 3*time.Second - time.Nanosecond)
+	if got := l.record("192.0.2.1", window, limit); got != 5 {
+		t.Errorf("a request a nanosecond before the window ends counted %d, want 5", got)
+	}
+	clk.Advance(time.Nanosecond)
+	if got := l.record("192.0.2.1", window, limit); got != 1 {
+		t.Errorf("the first request of a new window counted %d, want 1", got)
+	}
+	if got := l.record("192.0.2.2", window, limit); got != 1 {
+		t.Errorf("another client's first request counted %d, want 1", got)
+	}
+
+	// Rejections age out of the last minute a second at a time.
+	clk.Advance(52 * time.Second)
+	if got := l.rejectedLastMinute(); got != 1 {
+		t.Errorf("rejectedLastMinute a minute after the first two = %d, want 1", got)
+	}
+	clk.Advance(7 * time.Second)
+	if got := l.rejectedLastMinute(); got != 0 {
+		t.Errorf("rejectedLastMinute a minute later = %d, want 0", got)
+	}
+}
+
+func TestRateLimiterPrune(t *testing.T) {
+	clk := clocktest.New(testStart)
+	l := newRateLimiter(clk)
+	const window = 10 * time.Second
+
+	l.record("192.0.2.1", window, 5)
+	clk.Advance(5 * time.Second)
+	l.record("192.0.2.2", window, 5)
+	clk.Advance(5 * time.Second)
+	if n := l.prune(window); n != 1 || l.clientCount() != 1 {
+		t.Errorf("prune dropped %d clients and kept %d, want 1 of each", n, l.clientCount())
+	}
+	clk.Advance(5 * time.Second)
+	if n := l.prune(window); n != 1 || l.clientCount() != 0 {
+		t.Errorf("prune dropped %d clients and kept %d, want the last one dropped", n, l.clientCount())
+	}
+}
+
+func TestRateLimitJanitor(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.RateLimitWindow = time.Minute })
+	s.do(http.MethodGet, "/albums", "")
+	if limiter.clientCount() != 1 {
+		t.Fatalf("tracking %d clients, want 1", limiter.clientCount())
+	}
+	pruneRateLimits(context.Background())
+	if limiter.clientCount() != 1 {
+		t.Error("pruned a client inside its window")
+	}
+	s.clock.Advance(time.Minute)
+	pruneRateLimits(context.Background())
+	if limiter.clientCount() != 0 {
+		t.Error("kept a client whose window ran out")
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+)
+
+// syncTokenHeader carries a sync token. A successful write answers with
+// one for what it wrote; a request that sends it back reads at least as
+// fresh as that write, even from a replica.
+const syncTokenHeader = "X-Sync-Token"
+
+const (
+	defaultReplicaWaitTimeout = 500 * time.Millisecond
+
+	// replicaPollInterval is how often a read waiting for the replica to
+	// catch up checks how far it has got.
+	replicaPollInterval = 10 * time.Millisecond
+)
+
+// syncTokenIssuer is implemented by the stores whose reads can lag behind
+// their writes, as from a read replica.
+type syncTokenIssuer interface {
+	// SyncToken is an opaque token for every write the store has made so
+	// far, or "" while its reads see them all anyway. A read whose context
+	// carries the token (see withSyncToken) sees those writes.
+	SyncToken(ctx context.Context) (string, error)
+}
+
+// storeSyncToken returns the sync token of store, or "" for a store whose
+// reads always see its writes, like the in-memory one.
+func storeSyncToken(ctx context.Context, store AlbumStore) (string, error) {
+	s, ok := store.(syncTokenIssuer)
+	if !ok {
+		return "", nil
+	}
+	return s.SyncToken(ctx)
+}
+
+type syncTokenKey struct{}
+
+// withSyncToken has the store's reads in ctx be at least as fresh as token.
+func withSyncToken(ctx context.Context, token string) context.Context {
+	return context.WithValue(ctx, syncTokenKey{}, token)
+}
+
+// syncTokenFrom is the sync token the reads of ctx must see, or "".
+func syncTokenFrom(ctx context.Context) string {
+	token, _ := ctx.Value(syncTokenKey{}).(string)
+	return token
+}
+
+type primaryReadsKey struct{}
+
+// withPrimaryReads has the store's reads in ctx go to the primary, as
+// those of a write do, so it doesn't act on a stale album.
+func withPrimaryReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryReadsKey{}, true)
+}
+
+func primaryReads(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryReadsKey{}).(bool)
+	return primary
+}
+
+// syncTokenMiddleware gives the store the sync token a request sends, and
+// answers a successful write with the token for it. The token is asked for
+// as the response starts, after the handler's writes.
+func syncTokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inner := r
+		if token := r.Header.Get(syncTokenHeader); token != "" {
+			inner = inner.WithContext(withSyncToken(inner.Context(), token))
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions {
+			inner = inner.WithContext(withPrimaryReads(inner.Context()))
+			w = &syncTokenWriter{ResponseWriter: w, r: inner}
+		}
+		// The ServeMux sets the pattern on the request it is given, and the
+		// middleware outside counts requests by route.
+		defer func() { r.Pattern = inner.Pattern }()
+		next.ServeHTTP(w, inner)
+	})
+}
+
+// syncTokenWriter sets the sync token header on a 2xx response.
+type syncTokenWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	wroteHeader bool
+}
+
+func (w *syncTokenWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if code >= 200 && code < 300 {
+			w.setToken()
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *syncTokenWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *syncTokenWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// setToken adds the token; failing to get one only leaves it out, as the
+// write went through.
+func (w *syncTokenWriter) setToken() {
+	token, err := storeSyncToken(w.r.Context(), albumStore)
+	if err != nil {
+		log.Printf("⚠️ Failed to get the sync token for %s %s: %v", w.r.Method, w.r.URL.Path, err)
+		return
+	}
+	if token != "" {
+		w.Header().Set(syncTokenHeader, token)
+	}
+}
+
+// replicaCaughtUp reports whether position reaches want, checking every
+// replicaPollInterval for up to wait. Failing to check counts as not.
+func replicaCaughtUp(ctx context.Context, want uint64, wait time.Duration, position func(context.Context) (uint64, error)) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	ticker := time.NewTicker(replicaPollInterval)
+	defer ticker.Stop()
+	for {
+		got, err := position(ctx)
+		if err != nil {
+			debugf("Failed to check how far the replica has got: %v", err)
+			return false
+		}
+		if got >= want {
+			return true
+		}
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// useReplica sends the store's album reads to replica, which is waited
+// for up to wait when a read has a sync token it hasn't replayed to yet.
+func (store *PostgresAlbumStore) useReplica(replica *pgxpool.Pool, wait time.Duration) {
+	store.replica, store.replicaWait = replica, wait
+}
+
+// SyncToken implements syncTokenIssuer with the primary's WAL position,
+// once reads go to a replica.
+func (store *PostgresAlbumStore) SyncToken(ctx context.Context) (string, error) {
+	if store.replica == nil {
+		return "", nil
+	}
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	var lsn string
+	err := store.pool.QueryRow(ctx, `SELECT pg_current_wal_lsn()::text`).Scan(&lsn)
+	return lsn, err
+}
+
+// reader is what an album read queries: the replica, unless ctx has a sync
+// token the replica doesn't reach within REPLICA_WAIT_TIMEOUT, or is a
+// write's, when it is the primary. A store bound to a transaction reads in
+// it.
+func (store *PostgresAlbumStore) reader(ctx context.Context) postgresQuerier {
+	if store.replica == nil || primaryReads(ctx) {
+		return store.db
+	}
+	token := syncTokenFrom(ctx)
+	if token == "" {
+		return store.replica
+	}
+	want, err := parseLSN(token)
+	if err != nil {
+		debugf("Reading from the primary for sync token %q: %v", token, err)
+		return store.db
+	}
+	if replicaCaughtUp(ctx, want, store.replicaWait, store.replayedLSN) {
+		return store.replica
+	}
+	debugf("The replica hasn't reached sync token %s within %s; reading from the primary", token, store.replicaWait)
+	return store.db
+}
+
+// replayedLSN is how far the replica has replayed the primary's WAL. A
+// server that isn't replaying any is a primary itself, with every write.
+func (store *PostgresAlbumStore) replayedLSN(ctx context.Context) (uint64, error) {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	var lsn *string
+	if err := store.replica.QueryRow(ctx, `SELECT pg_last_wal_replay_lsn()::text`).Scan(&lsn); err != nil {
+		return 0, err
+	}
+	if lsn == nil {
+		return math.MaxUint64, nil
+	}
+	return parseLSN(*lsn)
+}
+
+// parseLSN reads a WAL position as Postgres prints it, like "16/B374D848".
+func parseLSN(s string) (uint64, error) {
+	hi, lo, ok := strings.Cut(s, "/")
+	if !ok {
+		return 0, fmt.Errorf("malformed WAL position %q", s)
+	}
+	h, err := strconv.ParseUint(hi, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("malformed WAL position %q", s)
+	}
+	l, err := strconv.ParseUint(lo, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("malformed WAL position %q", s)
+	}
+	return h<<32 | l, nil
+}
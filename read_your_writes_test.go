@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// laggingReplicaStore writes to a primary and reads from a replica that
+// only replays the writes when the test calls catchUp, reading from the
+// primary as the Postgres store does: for a write's reads, and for a sync
+// token the replica doesn't reach within wait.
+type laggingReplicaStore struct {
+	*InMemoryAlbumStore // the primary
+	replica             *InMemoryAlbumStore
+	wait                time.Duration
+
+	mu       sync.Mutex
+	pending  []album
+	written  atomic.Uint64
+	replayed atomic.Uint64
+
+	primaryReads, replicaReads atomic.Int64
+}
+
+func newLaggingReplicaStore(wait time.Duration) *laggingReplicaStore {
+	return &laggingReplicaStore{InMemoryAlbumStore: NewInMemoryAlbumStore(), replica: NewInMemoryAlbumStore(), wait: wait}
+}
+
+func (store *laggingReplicaStore) Create(ctx context.Context, a album) (album, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	created, err := store.InMemoryAlbumStore.Create(ctx, a)
+	if err == nil {
+		store.pending = append(store.pending, created)
+		store.written.Add(1)
+	}
+	return created, err
+}
+
+// catchUp replays every write so far to the replica.
+func (store *laggingReplicaStore) catchUp() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	for _, a := range store.pending {
+		if _, err := store.replica.Create(context.Background(), a); err != nil {
+			panic(err)
+		}
+	}
+	store.pending = nil
+	store.replayed.Store(store.written.Load())
+}
+
+// SyncToken prints the number of writes as a WAL position.
+func (store *laggingReplicaStore) SyncToken(ctx context.Context) (string, error) {
+	n := store.written.Load()
+	return fmt.Sprintf("%X/%X", n>>32, uint32(n)), nil
+}
+
+func (store *laggingReplicaStore) reader(ctx context.Context) *InMemoryAlbumStore {
+	if primaryReads(ctx) {
+		store.primaryReads.Add(1)
+		return store.InMemoryAlbumStore
+	}
+	if token := syncTokenFrom(ctx); token != "" {
+		want, err := parseLSN(token)
+		if err != nil || !replicaCaughtUp(ctx, want, store.wait, func(context.Context) (uint64, error) { return store.replayed.Load(), nil }) {
+			store.primaryReads.Add(1)
+			return store.InMemoryAlbumStore
+		}
+	}
+	store.replicaReads.Add(1)
+	return store.replica
+}
+
+func (store *laggingReplicaStore) GetByID(ctx context.Context, id string) (album, error) {
+	return store.reader(ctx).GetByID(ctx, id)
+}
+
+func (store *laggingReplicaStore) List(ctx context.Context, opts ListOptions) (albumPage, error) {
+	return store.reader(ctx).List(ctx, opts)
+}
+
+func TestReadYourWrites(t *testing.T) {
+	s := newTestServer(t)
+	store := newLaggingReplicaStore(time.Minute)
+	albumStore = store
+
+	w := s.do(http.MethodPost, "/albums", albumJSON(newTestAlbum()))
+	expectStatus(t, w, http.StatusCreated)
+	created := decodeBody[album](t, w)
+	token := w.Header().Get(syncTokenHeader)
+	if token != "0/1" {
+		t.Fatalf("sync token %q, want the first write's", token)
+	}
+
+	// Without the token, a read goes to the replica, which hasn't the album
+	// yet.
+	expectStatus(t, s.do(http.MethodGet, "/albums/"+created.ID, ""), http.StatusNotFound)
+
+	// With it, the read waits for the replica to catch up, and reads from
+	// it.
+	time.AfterFunc(30*time.Millisecond, store.catchUp)
+	primary := store.primaryReads.Load()
+	start := time.Now()
+	expectStatus(t, s.do(http.MethodGet, "/albums/"+created.ID, "", syncTokenHeader, token), http.StatusOK)
+	if took := time.Since(start); took < 30*time.Millisecond {
+		t.Errorf("answered in %s, before the replica caught up", took)
+	}
+	if store.primaryReads.Load() != primary {
+		t.Error("read from the primary once the replica caught up")
+	}
+	// A token the replica has reached reads from it at once.
+	replica := store.replicaReads.Load()
+	expectStatus(t, s.do(http.MethodGet, "/albums/"+created.ID, "", syncTokenHeader, token), http.StatusOK)
+	if store.replicaReads.Load() != replica+1 || store.primaryReads.Load() != primary {
+		t.Error("the read with a token already reached didn't go to the replica")
+	}
+}
+
+func TestReadYourWritesTimeout(t *testing.T) {
+	s := newTestServer(t)
+	store := newLaggingReplicaStore(50 * time.Millisecond)
+	albumStore = store
+
+	w := s.do(http.MethodPost, "/albums", albumJSON(newTestAlbum()))
+	expectStatus(t, w, http.StatusCreated)
+	created := decodeBody[album](t, w)
+
+	// The replica never catches up, so the read falls back to the primary
+	// after the wait.
+	start := time.Now()
+	expectStatus(t, s.do(http.MethodGet, "/albums/"+created.ID, "", syncTokenHeader, w.Header().Get(syncTokenHeader)), http.StatusOK)
+	if took := time.Since(start); took < 50*time.Millisecond {
+		t.Errorf("fell back to the primary after %s, want the wait", took)
+	}
+	if store.replicaReads.Load() != 0 {
+		t.Errorf("%d reads from the replica", store.replicaReads.Load())
+	}
+
+	// A token the store can't read goes straight to the primary.
+	primary := store.primaryReads.Load()
+	start = time.Now()
+	expectStatus(t, s.do(http.MethodGet, "/albums/"+created.ID, "", syncTokenHeader, "not-a-position"), http.StatusOK)
+	if took := time.Since(start); took >= 50*time.Millisecond || store.primaryReads.Load() != primary+1 {
+		t.Errorf("a malformed token waited %s", took)
+	}
+}
+
+func TestReadYourWritesInMemory(t *testing.T) {
+	s := newTestServer(t)
+
+	// The in-memory store reads its writes anyway, so it gives no token,
+	// and takes any sent.
+	w := s.do(http.MethodPost, "/albums", albumJSON(newTestAlbum()))
+	expectStatus(t, w, http.StatusCreated)
+	created := decodeBody[album](t, w)
+	if token, ok := w.Header()[syncTokenHeader]; ok {
+		t.Errorf("sync token %q from the in-memory store", token)
+	}
+	expectStatus(t, s.do(http.MethodGet, "/albums/"+created.ID, "", syncTokenHeader, "0/1"), http.StatusOK)
+
+	// The decorators hand the token on from the store they wrap.
+	lagging := newLaggingReplicaStore(time.Minute)
+	lagging.Create(context.Background(), newTestAlbum())
+	for backend, want := range map[AlbumStore]string{lagging: "0/1", s.albums: ""} {
+		token, err := storeSyncToken(context.Background(), NewCoalescingAlbumStore(backend, time.Minute))
+		if token != want || err != nil {
+			t.Errorf("token %q, %v; want %q", token, err, want)
+		}
+	}
+}
+
+func TestParseLSN(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want uint64
+		ok   bool
+	}{
+		{"0/0", 0, true},
+		{"16/B374D848", 0x16<<32 | 0xB374D848, true},
+		{"FFFFFFFF/FFFFFFFF", 1<<64 - 1, true},
+		{"16", 0, false},
+		{"16/", 0, false},
+		{"1FFFFFFFF/0", 0, false},
+		{"x/1", 0, false},
+	} {
+		got, err := parseLSN(tc.s)
+		if got != tc.want || (err == nil) != tc.ok {
+			t.Errorf("parseLSN(%q) = %X, %v", tc.s, got, err)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis serves the few Redis commands the quota store sends, with
+// MULTI and EXEC, over the real protocol. Sorted sets are all it keeps.
+// HANG is never answered, standing in for a Redis that has stopped
+// responding. Its connections are closed when the test ends.
+type fakeRedis struct {
+	addr string
+
+	mu     sync.Mutex
+	zsets  map[string]map[string]float64
+	conns  []net.Conn
+	closed bool
+}
+
+func newFakeRedis(t testing.TB) *fakeRedis {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRedis{addr: ln.Addr().String(), zsets: make(map[string]map[string]float64)}
+	var conns sync.WaitGroup
+	t.Cleanup(func() {
+		ln.Close()
+		r.mu.Lock()
+		r.closed = true
+		for _, conn := range r.conns {
+			conn.Close()
+		}
+		r.mu.Unlock()
+		conns.Wait()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r.mu.Lock()
+			if r.closed {
+				conn.Close()
+			}
+			r.conns = append(r.conns, conn)
+			r.mu.Unlock()
+			conns.Add(1)
+			go func() {
+				defer conns.Done()
+				r.serve(conn)
+			}()
+		}
+	}()
+	return r
+}
+
+// client returns a redisClient for r.
+func (r *fakeRedis) client(t testing.TB) *redisClient {
+	t.Helper()
+	c, err := newRedisClient("redis://" + r.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// redisStatus is a simple string reply, as against a bulk string.
+type redisStatus string
+
+func (r *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	rd, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	var queued [][]string
+	inMulti := false
+	for {
+		reply, err := readRedisReply(rd)
+		if err != nil {
+			return
+		}
+		items, _ := reply.([]interface{})
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		var out interface{}
+		switch name := strings.ToUpper(args[0]); {
+		case name == "HANG":
+			io.Copy(io.Discard, conn)
+			return
+		case name == "MULTI":
+			inMulti, queued = true, nil
+			out = redisStatus("OK")
+		case name == "EXEC":
+			r.mu.Lock()
+			results := make([]interface{}, len(queued))
+			for i, cmd := range queued {
+				results[i] = r.run(cmd)
+			}
+			r.mu.Unlock()
+			inMulti, out = false, results
+		case inMulti:
+			queued = append(queued, args)
+			out = redisStatus("QUEUED")
+		default:
+			r.mu.Lock()
+			out = r.run(args)
+			r.mu.Unlock()
+		}
+		writeFakeRedisReply(w, out)
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// run carries out one command; r.mu is held.
+func (r *fakeRedis) run(args []string) interface{} {
+	zset := func() map[string]float64 {
+		if r.zsets[args[1]] == nil {
+			r.zsets[args[1]] = make(map[string]float64)
+		}
+		return r.zsets[args[1]]
+	}
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return redisStatus("PONG")
+	case "PEXPIRE":
+		return int64(1)
+	case "ZADD":
+		score, _ := strconv.ParseFloat(args[2], 64)
+		_, exists := zset()[args[3]]
+		zset()[args[3]] = score
+		if exists {
+			return int64(0)
+		}
+		return int64(1)
+	case "ZREM":
+		_, exists := zset()[args[2]]
+		delete(zset(), args[2])
+		if exists {
+			return int64(1)
+		}
+		return int64(0)
+	case "ZCARD":
+		return int64(len(zset()))
+	case "ZREMRANGEBYSCORE":
+		if args[2] != "-inf" {
+			return redisError("ERR only -inf is supported as the minimum")
+		}
+		highest, _ := strconv.ParseFloat(args[3], 64)
+		n := int64(0)
+		for member, score := range zset() {
+			if score <= highest {
+				delete(zset(), member)
+				n++
+			}
+		}
+		return n
+	case "ZRANGE":
+		members := make([]string, 0, len(zset()))
+		for member := range zset() {
+			members = append(members, member)
+		}
+		set := zset()
+		slices.SortFunc(members, func(a, b string) int {
+			if set[a] != set[b] {
+				if set[a] < set[b] {
+					return -1
+				}
+				return 1
+			}
+			return strings.Compare(a, b)
+		})
+		start, _ := strconv.Atoi(args[2])
+		stop, _ := strconv.Atoi(args[3])
+		if stop < 0 {
+			stop += len(members)
+		}
+		var out []interface{}
+		for i := start; i <= stop && i < len(members); i++ {
+			out = append(out, members[i], strconv.FormatFloat(set[members[i]], 'f', -1, 64))
+		}
+		return out
+	}
+	return redisError(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+}
+
+func writeFakeRedisReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case redisStatus:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case redisError:
+		fmt.Fprintf(w, "-%s\r\n", string(v))
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeFakeRedisReply(w, item)
+		}
+	default:
+		w.WriteString("$-1\r\n")
+	}
+}
+
+func TestRedisPipeline(t *testing.T) {
+	c := newFakeRedis(t).client(t)
+	ctx := context.Background()
+
+	// A transaction with a failing command still reads every reply, and
+	// leaves the connection usable.
+	replies, err := c.pipeline(ctx, []string{"MULTI"}, []string{"ZADD", "k", "1", "a"}, []string{"NOPE"}, []string{"ZCARD", "k"}, []string{"EXEC"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, _ := replies[4].([]interface{})
+	if len(results) != 3 || results[0] != int64(1) || results[2] != int64(1) {
+		t.Fatalf("EXEC replied %v", replies[4])
+	}
+	if _, ok := results[1].(redisError); !ok {
+		t.Errorf("the unknown command replied %v, want an error", results[1])
+	}
+	if reply, err := c.do(ctx, "PING"); err != nil || reply != "PONG" {
+		t.Errorf("PING after the transaction = %v, %v", reply, err)
+	}
+
+	// An error reply outside a transaction is returned once the rest are
+	// read.
+	replies, err = c.pipeline(ctx, []string{"NOPE"}, []string{"ZCARD", "k"})
+	var replyErr redisError
+	if !errors.As(err, &replyErr) || replies[1] != int64(1) {
+		t.Errorf("pipeline = %v, %v, want an error reply and the count", replies, err)
+	}
+}
+
+func TestRedisPool(t *testing.T) {
+	c := newFakeRedis(t).client(t)
+	ctx := context.Background()
+
+	// A command that hangs holds its own connection; the others go on.
+	hung := make(chan error, 1)
+	hangCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		_, err := c.do(hangCtx, "HANG")
+		hung <- err
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 2*redisPoolSize; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.do(ctx, "ZADD", "k", "1", strconv.Itoa(i)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n, err := c.do(ctx, "ZCARD", "k"); err != nil || n != int64(2*redisPoolSize) {
+		t.Errorf("ZCARD = %v, %v; want every ZADD", n, err)
+	}
+
+	// Cancelling the hung command's context ends it at once, well before
+	// redisTimeout, and drops its connection.
+	start := time.Now()
+	cancel()
+	if err := <-hung; !errors.Is(err, context.Canceled) {
+		t.Errorf("the cancelled command returned %v", err)
+	}
+	if waited := time.Since(start); waited >= redisTimeout {
+		t.Errorf("the cancelled command took %s to return", waited)
+	}
+	if len(c.slots) > redisPoolSize {
+		t.Errorf("%d connections open, want at most %d", len(c.slots), redisPoolSize)
+	}
+
+	// A deadline on the context sooner than redisTimeout bounds a command.
+	deadlineCtx, cancelDeadline := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancelDeadline()
+	start = time.Now()
+	if _, err := c.do(deadlineCtx, "HANG"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("a command past its deadline returned %v", err)
+	}
+	if waited := time.Since(start); waited >= redisTimeout {
+		t.Errorf("the command past its deadline took %s to return", waited)
+	}
+	if reply, err := c.do(ctx, "PING"); err != nil || reply != "PONG" {
+		t.Errorf("PING after the dropped connections = %v, %v", reply, err)
+	}
+}
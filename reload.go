@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// liveConfig holds the configuration in effect. Settings tagged reload:"true"
+// may be swapped out by reloadConfig while the service runs, so code that
+// uses them asks currentConfig on every use instead of keeping a copy.
+var liveConfig atomic.Pointer[Config]
+
+func currentConfig() *Config {
+	return liveConfig.Load()
+}
+
+// configPath is the -config file that reloads re-read.
+var configPath string
+
+// reloadMu keeps a SIGHUP and an admin request from reloading at once.
+var reloadMu sync.Mutex
+
+// reloadConfig re-reads the configuration file and the environment and
+// applies the settings that are safe to change at runtime, returning them as
+// KEY=value. Changes to any other setting, like LISTEN_ADDR or DB_TYPE, are
+// left out and returned as warnings; they take effect on the next restart.
+// An invalid configuration is rejected whole and the running one stays.
+func reloadConfig(path string) (applied, warnings []string, err error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	loaded, warnings, err := loadConfig(path, os.LookupEnv)
+	if err != nil {
+		return nil, nil, err
+	}
+	running := currentConfig()
+	next := *running
+	rv, lv, nv := reflect.ValueOf(running).Elem(), reflect.ValueOf(loaded), reflect.ValueOf(&next).Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		tag := rv.Type().Field(i).Tag
+		if tag.Get("env") == "" || reflect.DeepEqual(rv.Field(i).Interface(), lv.Field(i).Interface()) {
+			continue
+		}
+		if tag.Get("reload") != "true" {
+			warnings = append(warnings, fmt.Sprintf("%s changed but needs a restart to take effect", tag.Get("env")))
+			continue
+		}
+		nv.Field(i).Set(lv.Field(i))
+		applied = append(applied, fmt.Sprintf("%s=%s", tag.Get("env"), maskSecret(tag, fmt.Sprint(lv.Field(i).Interface()))))
+	}
+	// Feature flags can always change. A reload also puts any flag toggled
+	// through /admin/features back to its configured state.
+	next.Features = loaded.Features
+	var changed []string
+	for name, on := range loaded.Features {
+		if running.Features[name] != on {
+			changed = append(changed, fmt.Sprintf("%s=%v", featureEnv(name), on))
+		}
+	}
+	sort.Strings(changed)
+	applied = append(applied, changed...)
+	// The kept settings are checked alongside the applied ones, e.g. that
+	// MUSICBRAINZ_URL is set before enrichment is switched on.
+	if err := next.validate(); err != nil {
+		return nil, nil, err
+	}
+	liveConfig.Store(&next)
+	return applied, warnings, nil
+}
+
+// logConfigReload reports the outcome of reloadConfig.
+func logConfigReload(applied, warnings []string, err error) {
+	if err != nil {
+		log.Printf("⚙️ Configuration reload rejected, keeping the running configuration:\n%v", err)
+		return
+	}
+	for _, warning := range warnings {
+		log.Printf("⚠️ Configuration reload: %s", warning)
+	}
+	if len(applied) == 0 {
+		log.Println("⚙️ Configuration reloaded, nothing to apply")
+		return
+	}
+	log.Printf("⚙️ Configuration reloaded: %s", strings.Join(applied, " "))
+}
+
+// watchConfigReloads reloads the configuration on every signal from hup.
+func watchConfigReloads(hup <-chan os.Signal) {
+	for range hup {
+		logConfigReload(reloadConfig(configPath))
+	}
+}
+
+// postConfigReload reloads the configuration, answering with the settings
+// that were applied and the warnings, or 422 if it is invalid.
+func postConfigReload(w http.ResponseWriter, r *http.Request) {
+	applied, warnings, err := reloadConfig(configPath)
+	logConfigReload(applied, warnings, err)
+	if err != nil {
+		writeProblem(w, r, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{
+		"applied":  append([]string{}, applied...),
+		"warnings": append([]string{}, warnings...),
+	})
+}
+
+// debugf logs only while LOG_LEVEL=debug.
+func debugf(format string, args ...interface{}) {
+	if currentConfig().LogLevel == "debug" {
+		log.Printf("🐛 "+format, args...)
+	}
+}
+
+// corsMiddleware lets browsers on the origins in CORS_ALLOWED_ORIGINS call
+// the API, and answers their preflight requests. With no origins configured
+// it adds nothing.
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" || !corsAllowed(currentConfig().CORSAllowedOrigins, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", syncTokenHeader+", "+responseTimeHeader)
+		// Without it a browser hides Server-Timing from the page and devtools.
+		w.Header().Set("Timing-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, "+syncTokenHeader+", "+debugTimingHeader)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsAllowed reports whether origin is in the comma-separated list
+// allowed, where "*" allows any origin.
+func corsAllowed(allowed, origin string) bool {
+	for _, o := range strings.Split(allowed, ",") {
+		if o = strings.TrimSpace(o); o == "*" || o == origin {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// logCapture collects what the standard logger writes during t.
+type logCapture struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func captureLog(t *testing.T) *logCapture {
+	c := &logCapture{}
+	log.SetOutput(c)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+	return c
+}
+
+func (c *logCapture) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Write(p)
+}
+
+// take returns what was logged since the last take.
+func (c *logCapture) take() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.buf.String()
+	c.buf.Reset()
+	return s
+}
+
+func TestConfigReloadLogLevel(t *testing.T) {
+	s := newTestServer(t)
+	logs := captureLog(t)
+	previous := configPath
+	t.Cleanup(func() { configPath = previous })
+	configPath = writeConfigFile(t, `
+admin_token: `+testAdminToken+`
+listen_addr: ":9999"
+log_level: debug
+rate_limit_requests: 10000
+quota_free_per_hour: 100000
+quota_paid_per_hour: 100000
+`)
+
+	expectStatus(t, s.do(http.MethodGet, "/albums", ""), http.StatusOK)
+	if got := logs.take(); strings.Contains(got, "🐛") {
+		t.Fatalf("debug lines before the reload:\n%s", got)
+	}
+
+	w := s.admin(http.MethodPost, "/admin/config/reload", "")
+	expectStatus(t, w, http.StatusOK)
+	res := decodeBody[map[string][]string](t, w)
+	if !strings.Contains(strings.Join(res["applied"], " "), "LOG_LEVEL=debug") {
+		t.Errorf("applied %q, want LOG_LEVEL=debug", res["applied"])
+	}
+	if !strings.Contains(strings.Join(res["warnings"], " "), "LISTEN_ADDR") {
+		t.Errorf("warnings %q, want one that LISTEN_ADDR needs a restart", res["warnings"])
+	}
+	if currentConfig().ListenAddr == ":9999" {
+		t.Error("the reload changed LISTEN_ADDR")
+	}
+
+	logs.take()
+	expectStatus(t, s.do(http.MethodGet, "/albums", ""), http.StatusOK)
+	if got := logs.take(); !strings.Contains(got, "🐛 GET /albums") {
+		t.Errorf("no debug line for a request after the reload:\n%s", got)
+	}
+}
+
+func TestConfigReloadRejectsInvalidFile(t *testing.T) {
+	s := newTestServer(t)
+	previous := configPath
+	t.Cleanup(func() { configPath = previous })
+	configPath = writeConfigFile(t, "admin_token: "+testAdminToken+"\nlog_level: debug\nrate_limit_requests: lots\n")
+
+	expectProblem(t, s.admin(http.MethodPost, "/admin/config/reload", ""), http.StatusUnprocessableEntity)
+	if currentConfig().LogLevel == "debug" {
+		t.Error("a rejected file still changed LOG_LEVEL")
+	}
+}
+
+func TestCORSPreflight(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.CORSAllowedOrigins = "https://shop.example" })
+
+	w := s.do(http.MethodOptions, "/albums", "", "Origin", "https://shop.example", "Access-Control-Request-Method", "POST")
+	expectStatus(t, w, http.StatusNoContent)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://shop.example" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the allowed origin", got)
+	}
+	w = s.do(http.MethodGet, "/albums", "", "Origin", "https://elsewhere.example")
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("Access-Control-Allow-Origin = %q for an origin not allowed", got)
+	}
+}
+
+func TestConfigReloadSecretFile(t *testing.T) {
+	s := newTestServer(t)
+	previous := configPath
+	t.Cleanup(func() { configPath = previous })
+	configPath = writeConfigFile(t, "rate_limit_requests: 10000\nquota_free_per_hour: 100000\nquota_paid_per_hour: 100000\n")
+	token := writeSecretFile(t, "rotated-token\n")
+	t.Setenv("ADMIN_TOKEN_FILE", token)
+
+	// The secret was rotated in its file; a reload picks it up, and the old
+	// token stops working.
+	w := s.admin(http.MethodPost, "/admin/config/reload", "")
+	expectStatus(t, w, http.StatusOK)
+	if strings.Contains(w.Body.String(), "rotated-token") {
+		t.Errorf("the reload shows the new token: %s", w.Body)
+	}
+	expectStatus(t, s.admin(http.MethodGet, "/admin/features", ""), http.StatusUnauthorized)
+	expectStatus(t, s.do(http.MethodGet, "/admin/features", "", "Authorization", "Bearer rotated-token"), http.StatusOK)
+
+	// A file emptied mid-rotation is rejected, keeping the running token.
+	if err := os.WriteFile(token, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, s.do(http.MethodPost, "/admin/config/reload", "", "Authorization", "Bearer rotated-token"), http.StatusUnprocessableEntity)
+	expectStatus(t, s.do(http.MethodGet, "/admin/features", "", "Authorization", "Bearer rotated-token"), http.StatusOK)
+}
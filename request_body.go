@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultBodyMaxBytes      = 1 << 20
+	defaultBodyTimeout       = time.Minute
+	defaultBodyIdleTimeout   = 10 * time.Second
+)
+
+// errBodyTimeout is what reading a request body returns once it has taken
+// longer than REQUEST_BODY_TIMEOUT, or gone REQUEST_BODY_IDLE_TIMEOUT
+// without a byte.
+var errBodyTimeout = errors.New("the request body didn't arrive in time")
+
+// totalBodyTimeouts and totalBodyTooLarge count the requests answered 408
+// and 413 for their bodies.
+var totalBodyTimeouts, totalBodyTooLarge int64
+
+// bulkBodyRoutes take uploads that can rightly take minutes to send: a CSV
+// import, bounded by IMPORT_MAX_BYTES instead, and a whole backup being
+// restored. They are held to REQUEST_BODY_IDLE_TIMEOUT alone.
+var bulkBodyRoutes = map[string]bool{"/albums/import": true, "/admin/import": true}
+
+type bodyGuardKey struct{}
+
+// bodyGuard reads a request body within the limits of REQUEST_BODY_*. Each
+// read that brings data moves the connection's read deadline on by the idle
+// timeout, but never past the total budget, so a client dribbling a byte at
+// a time is cut off as surely as one that stops. The first limit the body
+// breaks is kept, for writeProblem to answer with.
+type bodyGuard struct {
+	body     io.ReadCloser
+	rc       *http.ResponseController // nil when deadlines can't be set
+	header   http.Header
+	idle     time.Duration
+	deadline time.Time // zero without a total budget
+	limit    int64
+	failed   int // 0, or the status the body failed with
+}
+
+func (g *bodyGuard) Read(p []byte) (int, error) {
+	n, err := g.body.Read(p)
+	if n > 0 && err == nil {
+		g.extend()
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case err == nil:
+	case err == io.EOF:
+		// The server reads on in the background once the body is done, to
+		// notice a client hanging up, and a deadline passing then would
+		// cancel the request.
+		if g.rc != nil {
+			g.rc.SetReadDeadline(time.Time{})
+		}
+	case errors.As(err, &tooLarge):
+		g.fail(http.StatusRequestEntityTooLarge)
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		g.fail(http.StatusRequestTimeout)
+		err = errBodyTimeout
+	}
+	return n, err
+}
+
+func (g *bodyGuard) Close() error { return g.body.Close() }
+
+// extend moves the read deadline to the idle timeout from now, or to the
+// end of the budget if that is sooner.
+func (g *bodyGuard) extend() {
+	if g.rc == nil || g.idle <= 0 && g.deadline.IsZero() {
+		return
+	}
+	var next time.Time
+	if g.idle > 0 {
+		next = time.Now().Add(g.idle)
+	}
+	if !g.deadline.IsZero() && (next.IsZero() || next.After(g.deadline)) {
+		next = g.deadline
+	}
+	if err := g.rc.SetReadDeadline(next); err != nil {
+		g.rc = nil
+	}
+}
+
+// fail records the first limit the body broke, and has the connection
+// closed after the answer: the rest of the body is still on the wire, or
+// the read that timed out left the connection unusable.
+func (g *bodyGuard) fail(status int) {
+	if g.failed != 0 {
+		return
+	}
+	g.failed = status
+	g.header.Set("Connection", "close")
+	if status == http.StatusRequestTimeout {
+		atomic.AddInt64(&totalBodyTimeouts, 1)
+	} else {
+		atomic.AddInt64(&totalBodyTooLarge, 1)
+	}
+}
+
+// failedBody is the guard of r's body if the body broke one of its limits,
+// or nil.
+func failedBody(r *http.Request) *bodyGuard {
+	if g, ok := r.Context().Value(bodyGuardKey{}).(*bodyGuard); ok && g.failed != 0 {
+		return g
+	}
+	return nil
+}
+
+// bodyTimedOut reports whether the body of the request of ctx went past one
+// of its deadlines.
+func bodyTimedOut(ctx context.Context) bool {
+	g, ok := ctx.Value(bodyGuardKey{}).(*bodyGuard)
+	return ok && g.failed == http.StatusRequestTimeout
+}
+
+// detail is the problem detail of the limit g's body broke.
+func (g *bodyGuard) detail(r *http.Request) string {
+	if g.failed == http.StatusRequestTimeout {
+		return localize(r, errBodyTimeout.Error())
+	}
+	return localize(r, "the request body is larger than %d bytes", g.limit)
+}
+
+// requestBodyMiddleware bounds how large a request body can be and how long
+// it can take to arrive, with REQUEST_BODY_MAX_BYTES, REQUEST_BODY_TIMEOUT,
+// and REQUEST_BODY_IDLE_TIMEOUT. A body declared larger than the limit is
+// refused before it is read. A handler that fails reading one answers as it
+// would any bad body, and writeProblem turns its 400 into a 408 or a 413.
+func requestBodyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cfg := currentConfig()
+		g := &bodyGuard{rc: http.NewResponseController(w), header: w.Header(), idle: cfg.BodyIdleTimeout}
+		if !bulkBodyRoutes[r.URL.Path] {
+			g.limit = int64(cfg.BodyMaxBytes)
+			if cfg.BodyTimeout > 0 {
+				g.deadline = time.Now().Add(cfg.BodyTimeout)
+			}
+		}
+		g.body = r.Body
+		if g.limit > 0 {
+			if r.ContentLength > g.limit {
+				g.fail(http.StatusRequestEntityTooLarge)
+				// The server would otherwise wait for the body, to read past
+				// it, before closing the connection.
+				if g.rc != nil {
+					g.rc.SetReadDeadline(time.Now())
+				}
+				writeProblem(w, r, http.StatusRequestEntityTooLarge, g.detail(r))
+				log.Printf("📦 Refused %s %s: a %d-byte body is over REQUEST_BODY_MAX_BYTES", r.Method, r.URL.Path, r.ContentLength)
+				return
+			}
+			g.body = http.MaxBytesReader(w, r.Body, g.limit)
+		}
+		g.extend()
+		r.Body = g
+		guarded := r.WithContext(context.WithValue(r.Context(), bodyGuardKey{}, g))
+		// The ServeMux sets the pattern on the request it is given, and the
+		// middleware outside counts requests by route, and reports panics
+		// by it.
+		defer func() { r.Pattern = guarded.Pattern }()
+		next.ServeHTTP(w, guarded)
+		if g.failed == http.StatusRequestTimeout {
+			log.Printf("🐢 %s %s: the body didn't arrive in time, closing the connection", r.Method, r.URL.Path)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// slowClient speaks HTTP/1.1 over a connection of its own, as slowly as a
+// test asks it to.
+type slowClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialSlow(t *testing.T, url string) *slowClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return &slowClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// send writes s all at once.
+func (c *slowClient) send(s string) {
+	c.t.Helper()
+	if _, err := io.WriteString(c.conn, s); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// dribble writes s a byte at a time, every, and stops at the first write
+// the server refuses.
+func (c *slowClient) dribble(s string, every time.Duration) {
+	for i := 0; i < len(s); i++ {
+		if _, err := c.conn.Write([]byte{s[i]}); err != nil {
+			return
+		}
+		time.Sleep(every)
+	}
+}
+
+// response reads the answer to the request sent.
+func (c *slowClient) response() *http.Response {
+	c.t.Helper()
+	res, err := http.ReadResponse(c.r, nil)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return res
+}
+
+// expectClosed fails the test unless the server has closed the
+// connection.
+func (c *slowClient) expectClosed() {
+	c.t.Helper()
+	if b, err := c.r.ReadByte(); !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !isConnReset(err) {
+		c.t.Errorf("read %q, %v from the connection, want it closed", b, err)
+	}
+}
+
+func isConnReset(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "connection reset")
+}
+
+// postHeader is the head of a POST /albums with the given framing.
+func postHeader(framing string) string {
+	return "POST /albums HTTP/1.1\r\nHost: albums.test\r\nContent-Type: application/json\r\n" + framing + "\r\n\r\n"
+}
+
+// paddedAlbum is an album's JSON padded with spaces to n bytes.
+func paddedAlbum(n int) string {
+	body := albumJSON(newTestAlbum())
+	return body + strings.Repeat(" ", n-len(body))
+}
+
+func TestSlowAndOversizedBodies(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.ListenAddr = "127.0.0.1:0"
+		cfg.ReadHeaderTimeout = 200 * time.Millisecond
+		cfg.BodyMaxBytes = 1024
+		cfg.BodyTimeout = 400 * time.Millisecond
+		cfg.BodyIdleTimeout = 100 * time.Millisecond
+	})
+	url := startServers(t, s)[0]
+	timeouts, tooLarge := atomic.LoadInt64(&totalBodyTimeouts), atomic.LoadInt64(&totalBodyTooLarge)
+
+	expect := func(name string, res *http.Response, status int) {
+		t.Helper()
+		if res.StatusCode != status || res.Header.Get("Content-Type") != "application/problem+json" || !res.Close {
+			t.Errorf("%s: %d %s, closing %t; want a %d problem and the connection closed", name, res.StatusCode, res.Header.Get("Content-Type"), res.Close, status)
+		}
+	}
+
+	t.Run("stalled", func(t *testing.T) {
+		c := dialSlow(t, url)
+		body := paddedAlbum(200)
+		c.send(postHeader("Content-Length: 200") + body[:20])
+		expect("a body that stops", c.response(), http.StatusRequestTimeout)
+		c.expectClosed()
+	})
+
+	t.Run("dribbled", func(t *testing.T) {
+		// Each byte comes within the idle timeout, but the whole body would
+		// take far longer than the total budget.
+		c := dialSlow(t, url)
+		c.send(postHeader("Content-Length: 500"))
+		go c.dribble(paddedAlbum(500), 20*time.Millisecond)
+		start := time.Now()
+		expect("a body a byte at a time", c.response(), http.StatusRequestTimeout)
+		if took := time.Since(start); took > 2*time.Second {
+			t.Errorf("answered after %s", took)
+		}
+		c.expectClosed()
+	})
+
+	t.Run("declared too large", func(t *testing.T) {
+		c := dialSlow(t, url)
+		c.send(postHeader("Content-Length: 5000"))
+		expect("a Content-Length over the limit", c.response(), http.StatusRequestEntityTooLarge)
+		c.expectClosed()
+	})
+
+	t.Run("chunked too large", func(t *testing.T) {
+		c := dialSlow(t, url)
+		body := albumJSON(newTestAlbum(withTitle(strings.Repeat("Blue Train ", 200))))
+		c.send(postHeader("Transfer-Encoding: chunked") + fmt.Sprintf("%x\r\n%s\r\n0\r\n\r\n", len(body), body))
+		expect("a chunked body over the limit", c.response(), http.StatusRequestEntityTooLarge)
+		c.expectClosed()
+	})
+
+	t.Run("slow header", func(t *testing.T) {
+		c := dialSlow(t, url)
+		c.send("POST /albums HTTP/1.1\r\nHost: alb")
+		c.expectClosed()
+	})
+
+	t.Run("keep-alive", func(t *testing.T) {
+		// A body that arrives in time leaves the connection fit for the next
+		// request.
+		c := dialSlow(t, url)
+		body := albumJSON(newTestAlbum(withTitle("Giant Steps")))
+		c.send(postHeader(fmt.Sprintf("Content-Length: %d", len(body))) + body)
+		if res := c.response(); res.StatusCode != http.StatusCreated || res.Close {
+			t.Fatalf("POST /albums = %d, closing %t", res.StatusCode, res.Close)
+		}
+		c.send("GET /albums HTTP/1.1\r\nHost: albums.test\r\n\r\n")
+		if res := c.response(); res.StatusCode != http.StatusOK {
+			t.Errorf("GET /albums on the same connection = %d", res.StatusCode)
+		}
+	})
+
+	if n := atomic.LoadInt64(&totalBodyTimeouts) - timeouts; n != 2 {
+		t.Errorf("%d body timeouts counted, want 2", n)
+	}
+	if n := atomic.LoadInt64(&totalBodyTooLarge) - tooLarge; n != 2 {
+		t.Errorf("%d bodies too large counted, want 2", n)
+	}
+	prom := s.do(http.MethodGet, "/metrics?format=prometheus", "").Body.String()
+	for _, want := range []string{"albums_body_timeouts_total ", "albums_body_too_large_total "} {
+		if !strings.Contains(prom, want) {
+			t.Errorf("the Prometheus output has no %s", want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultResponseMaxBytes = 8 << 20
+
+	// RESPONSE_OVERSIZE settings: a list page that would be larger than
+	// RESPONSE_MAX_BYTES is cut short or refused.
+	oversizePaginate = "paginate"
+	oversizeReject   = "reject"
+
+	// responseEnvelopeBytes is set aside for what a list response has
+	// around its albums: brackets, and the totals of a search.
+	responseEnvelopeBytes = 256
+)
+
+// fitPage works out how many albums from the start of page fit in a
+// response of at most maxBytes, laid out as writeJSON indents them depth
+// levels deep, and reports whether they all do. Albums are encoded one at
+// a time and counting stops at the first that doesn't fit, so an oversized
+// page is never encoded whole. A maxBytes of 0 fits anything.
+func fitPage(page []album, maxBytes, depth int) (int, bool) {
+	if maxBytes <= 0 {
+		return len(page), true
+	}
+	prefix := strings.Repeat("  ", depth)
+	size := responseEnvelopeBytes
+	for i, a := range page {
+		b, err := json.MarshalIndent(a, prefix, "  ")
+		if err != nil {
+			// writeJSON reports the error when it encodes the page.
+			return len(page), true
+		}
+		size += len(prefix) + len(b) + len(",\n")
+		if size > maxBytes {
+			return i, false
+		}
+	}
+	return len(page), true
+}
+
+// cutPage applies RESPONSE_OVERSIZE to a page of which only n albums fit in
+// RESPONSE_MAX_BYTES. With paginate it returns the limit to answer with,
+// which keeps at least one album so that a client paging through always
+// moves on, and says so in X-Limit-Clamped and a Warning header. With
+// reject it answers 413, suggesting a limit, and returns false.
+func cutPage(w http.ResponseWriter, r *http.Request, cfg *Config, n, asked int) (int, bool) {
+	n = max(n, 1)
+	if cfg.ResponseOversize == oversizeReject {
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, localize(r, "the response would be larger than %d bytes; ask for at most %d albums with limit", cfg.ResponseMaxBytes, n))
+		log.Printf("📦 Refused a page of %d albums, larger than RESPONSE_MAX_BYTES", asked)
+		return 0, false
+	}
+	w.Header().Set("X-Limit-Clamped", strconv.Itoa(n))
+	w.Header().Set("Warning", fmt.Sprintf(`299 - "page cut to %d albums to stay under %d bytes"`, n, cfg.ResponseMaxBytes))
+	log.Printf("📦 Cut a page of %d albums to %d to stay under RESPONSE_MAX_BYTES", asked, n)
+	return n, true
+}
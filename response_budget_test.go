@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFitPage(t *testing.T) {
+	store, _ := newSizedAlbumStore(t, 10)
+	page, _ := store.List(t.Context(), ListOptions{})
+	whole, _ := json.MarshalIndent(page.Albums, "", "  ")
+
+	if n, fits := fitPage(page.Albums, 0, 1); n != 10 || !fits {
+		t.Errorf("no limit: %d, %t", n, fits)
+	}
+	if n, fits := fitPage(page.Albums, len(whole)+responseEnvelopeBytes, 1); n != 10 || !fits {
+		t.Errorf("room for the page: %d, %t", n, fits)
+	}
+	// The estimate is never under what writeJSON writes.
+	for _, max := range []int{responseEnvelopeBytes, len(whole) / 3, len(whole) / 2, len(whole)} {
+		n, fits := fitPage(page.Albums, max, 1)
+		if fits {
+			t.Errorf("%d bytes: all 10 fit in less than the page", max)
+			continue
+		}
+		if got, _ := json.MarshalIndent(page.Albums[:n], "", "  "); len(got) > max {
+			t.Errorf("%d bytes: %d albums fit, taking %d", max, n, len(got))
+		}
+	}
+}
+
+// TestResponseBudget lists a catalog whose first page of 1000 is megabytes
+// of JSON, against a budget of 64KB.
+func TestResponseBudget(t *testing.T) {
+	const budget = 64 << 10
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.AlbumsMaxPageSize = 1000
+		cfg.ResponseMaxBytes = budget
+	})
+	batch := make([]album, 1000)
+	for i := range batch {
+		batch[i] = newTestAlbum(withID(newAlbumID()), withTitle("Album "+strconv.Itoa(i)), func(a *album) {
+			a.Metadata = map[string]string{"notes": strings.Repeat("liner notes ", 40)}
+		})
+	}
+	if _, err := s.albums.CreateMany(t.Context(), batch); err != nil {
+		t.Fatal(err)
+	}
+
+	w := s.do(http.MethodGet, "/albums?limit=1000", "")
+	page := decodeBody[[]album](t, w)
+	if w.Body.Len() > budget {
+		t.Errorf("a response of %d bytes", w.Body.Len())
+	}
+	n := len(page)
+	if n == 0 || n >= 1000 || w.Header().Get("X-Limit-Clamped") != strconv.Itoa(n) || !strings.HasPrefix(w.Header().Get("Warning"), "299 - ") {
+		t.Fatalf("%d albums with X-Limit-Clamped %q and Warning %q, want a cut page", n, w.Header().Get("X-Limit-Clamped"), w.Header().Get("Warning"))
+	}
+	next := "<http://example.com/albums?limit=" + strconv.Itoa(n) + "&offset=" + strconv.Itoa(n) + `>; rel="next"`
+	if link := w.Header().Get("Link"); !strings.Contains(link, next) {
+		t.Errorf("Link %s, want next at %s", link, next)
+	}
+	// A page that fits isn't touched.
+	w = s.do(http.MethodGet, "/albums?limit="+strconv.Itoa(n), "")
+	if len(decodeBody[[]album](t, w)) != n || w.Header().Get("Warning") != "" {
+		t.Errorf("limit=%d: Warning %q", n, w.Header().Get("Warning"))
+	}
+	w = s.do(http.MethodPost, "/albums/search", `{"limit": 500}`)
+	if w.Body.Len() > budget || w.Header().Get("Warning") == "" {
+		t.Errorf("search: a response of %d bytes with Warning %q", w.Body.Len(), w.Header().Get("Warning"))
+	}
+
+	reject := *s.cfg
+	reject.ResponseOversize = oversizeReject
+	liveConfig.Store(&reject)
+	p := expectProblem(t, s.do(http.MethodGet, "/albums?limit=1000", ""), http.StatusRequestEntityTooLarge)
+	if !strings.Contains(p.Detail, "ask for at most "+strconv.Itoa(n)+" albums") {
+		t.Errorf("413 detail %q, want the limit that fits", p.Detail)
+	}
+}
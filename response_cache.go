@@ -0,0 +1,346 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultResponseCacheSize = 1000
+
+	// responseCacheMaxBody is the largest body the cache keeps; anything
+	// bigger is served uncached.
+	responseCacheMaxBody = 1 << 20
+
+	redisResponseCachePrefix = "albums:response-cache:"
+)
+
+// responseCacheStore keeps cached responses. Every entry belongs to the
+// generation it was stored under; invalidate starts a new one, which drops
+// every entry at once.
+type responseCacheStore interface {
+	generation(ctx context.Context) (string, error)
+	get(ctx context.Context, generation, key string) (cachedResponse, bool, error)
+	// put stores entry for ttl, unless generation is no longer current:
+	// the response may predate a mutation.
+	put(ctx context.Context, generation, key string, entry cachedResponse, ttl time.Duration) error
+	invalidate(ctx context.Context) error
+}
+
+// cachedResponse is a 200 answer as the handler wrote it: the headers it
+// set and the body.
+type cachedResponse struct {
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body"`
+	StoredAt time.Time   `json:"storedAt"`
+}
+
+// responseCache is where the responseCache layer keeps its entries: the
+// in-memory LRU, or Redis with RESPONSE_CACHE_REDIS_URL.
+var responseCache responseCacheStore = newMemoryResponseCache(defaultResponseCacheSize)
+
+// responseCacheFailing is set while the cache's store fails, so that the
+// failure is logged once rather than on every request.
+var responseCacheFailing atomic.Bool
+
+// setupResponseCache picks the store of the response cache.
+func setupResponseCache(cfg *Config) error {
+	if cfg.ResponseCacheRedisURL == "" {
+		responseCache = newMemoryResponseCache(cfg.ResponseCacheSize)
+		return nil
+	}
+	client, err := newRedisClient(cfg.ResponseCacheRedisURL)
+	if err != nil {
+		return err
+	}
+	responseCache = &redisResponseCache{client: client}
+	log.Printf("🧊 Caching responses in Redis at %s", client.addr)
+	return nil
+}
+
+// albumsChanged drops what is cached about the albums: the stats and the
+// cached responses. Handlers call it after changing albums. With Redis the
+// responses are dropped for every replica; the in-memory caches of other
+// replicas keep theirs until they expire.
+func albumsChanged() {
+	albumStatsResults.invalidate()
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	noteResponseCache(responseCache.invalidate(ctx))
+}
+
+// parseResponseCacheRoutes reads RESPONSE_CACHE_ROUTES, a comma-separated
+// list of path=ttl. The routes under /admin/ and /me/ answer for one caller,
+// so they can never be listed.
+func parseResponseCacheRoutes(list string) (map[string]time.Duration, error) {
+	routes := map[string]time.Duration{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		path, raw, ok := strings.Cut(entry, "=")
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("%q is not a path=ttl pair", entry)
+		}
+		if strings.HasPrefix(path, "/admin/") || strings.HasPrefix(path, "/me/") {
+			return nil, fmt.Errorf("%s answers for one caller and can't be cached", path)
+		}
+		ttl, err := time.ParseDuration(raw)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("the TTL of %s must be a positive duration, got %q", path, raw)
+		}
+		routes[path] = ttl
+	}
+	return routes, nil
+}
+
+// responseCacheMiddleware serves the GETs of the paths in
+// RESPONSE_CACHE_ROUTES from the cache, and caches their 200 answers for
+// the path's TTL. Entries are keyed by path, query, Accept, and
+// Accept-Language. Responses the handler marks private or no-store, stale
+// reads, and conditional requests or those with a sync token are never
+// cached, and a request with
+// Cache-Control: no-cache skips the cache and refreshes it. Answers say
+// X-Cache: HIT or MISS, and a hit has an Age.
+func responseCacheMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		routes, _ := parseResponseCacheRoutes(currentConfig().ResponseCacheRoutes)
+		ttl, ok := routes[r.URL.Path]
+		if !ok || r.Method != http.MethodGet || r.Header.Get("If-None-Match") != "" || r.Header.Get("If-Modified-Since") != "" || r.Header.Get(syncTokenHeader) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := responseCacheKey(r)
+		generation, err := responseCache.generation(r.Context())
+		if noteResponseCache(err) != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+			entry, found, err := responseCache.get(r.Context(), generation, key)
+			if noteResponseCache(err) == nil && found {
+				for name, values := range entry.Header {
+					w.Header()[name] = values
+				}
+				age := max(serverClock.Since(entry.StoredAt), 0)
+				w.Header().Set("Age", strconv.Itoa(int(age/time.Second)))
+				w.Header().Set("X-Cache", "HIT")
+				w.WriteHeader(http.StatusOK)
+				w.Write(entry.Body)
+				debugf("Served %s from the response cache", r.URL.Path)
+				return
+			}
+		}
+
+		w.Header().Set("X-Cache", "MISS")
+		before := w.Header().Clone()
+		cw := &cachingWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(cw, r)
+		if cw.status != http.StatusOK || cw.overflow || !cacheableResponse(w.Header()) {
+			return
+		}
+		set := http.Header{}
+		for name, values := range w.Header() {
+			if name != "X-Cache" && fmt.Sprint(before[name]) != fmt.Sprint(values) {
+				set[name] = values
+			}
+		}
+		entry := cachedResponse{Header: set, Body: cw.body, StoredAt: serverClock.Now()}
+		noteResponseCache(responseCache.put(context.WithoutCancel(r.Context()), generation, key, entry, ttl))
+	})
+}
+
+// responseCacheKey identifies a request's answer: the same path and query,
+// in any parameter order, with the same Accept and Accept-Language.
+func responseCacheKey(r *http.Request) string {
+	return strings.Join([]string{r.URL.Path, r.URL.Query().Encode(), r.Header.Get("Accept"), r.Header.Get("Accept-Language")}, "\x00")
+}
+
+// cacheableResponse reports whether the headers of an answer let it be
+// shared: never when private, no-store, or a stale read from an open
+// breaker, or when it sets a cookie.
+func cacheableResponse(h http.Header) bool {
+	cc := h.Get("Cache-Control")
+	return !strings.Contains(cc, "private") && !strings.Contains(cc, "no-store") && h.Get("X-Data-Stale") == "" && h.Get("Set-Cookie") == ""
+}
+
+// noteResponseCache logs the first failure of the cache's store and its
+// recovery, and returns err. A failing cache only leaves requests uncached.
+func noteResponseCache(err error) error {
+	if err != nil {
+		if !responseCacheFailing.Swap(true) {
+			log.Printf("🧊 Response cache unavailable, serving uncached: %v", err)
+		}
+		return err
+	}
+	if responseCacheFailing.Swap(false) {
+		log.Println("🧊 Response cache recovered")
+	}
+	return nil
+}
+
+// cachingWriter keeps a copy of the body as it is written, up to
+// responseCacheMaxBody.
+type cachingWriter struct {
+	http.ResponseWriter
+	status   int
+	body     []byte
+	overflow bool
+}
+
+func (w *cachingWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cachingWriter) Write(b []byte) (int, error) {
+	if !w.overflow {
+		if len(w.body)+len(b) > responseCacheMaxBody {
+			w.overflow, w.body = true, nil
+		} else {
+			w.body = append(w.body, b...)
+		}
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *cachingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// memoryResponseCache is an LRU of at most size entries, held by this
+// replica.
+type memoryResponseCache struct {
+	mu      sync.Mutex
+	size    int
+	gen     uint64
+	order   *list.List // of *memoryCacheEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type memoryCacheEntry struct {
+	key     string
+	value   cachedResponse
+	expires time.Time
+}
+
+func newMemoryResponseCache(size int) *memoryResponseCache {
+	return &memoryResponseCache{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *memoryResponseCache) generation(context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return strconv.FormatUint(c.gen, 10), nil
+}
+
+func (c *memoryResponseCache) get(_ context.Context, generation, key string) (cachedResponse, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || generation != strconv.FormatUint(c.gen, 10) {
+		return cachedResponse{}, false, nil
+	}
+	entry := e.Value.(*memoryCacheEntry)
+	if !serverClock.Now().Before(entry.expires) {
+		c.order.Remove(e)
+		delete(c.entries, key)
+		return cachedResponse{}, false, nil
+	}
+	c.order.MoveToFront(e)
+	return entry.value, true, nil
+}
+
+func (c *memoryResponseCache) put(_ context.Context, generation, key string, value cachedResponse, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != strconv.FormatUint(c.gen, 10) {
+		return nil
+	}
+	entry := &memoryCacheEntry{key: key, value: value, expires: serverClock.Now().Add(ttl)}
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.order.MoveToFront(e)
+		return nil
+	}
+	c.entries[key] = c.order.PushFront(entry)
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*memoryCacheEntry).key)
+	}
+	return nil
+}
+
+func (c *memoryResponseCache) invalidate(context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+	return nil
+}
+
+// redisResponseCache keeps the entries in Redis, shared by every replica.
+// The generation is a counter there too, so an invalidation by any replica
+// drops the entries for all of them; the old ones expire on their own.
+type redisResponseCache struct {
+	client *redisClient
+}
+
+func (c *redisResponseCache) generation(ctx context.Context) (string, error) {
+	gen, err := c.client.get(ctx, redisResponseCachePrefix+"generation")
+	if errors.Is(err, errRedisNil) {
+		return "0", nil
+	}
+	return gen, err
+}
+
+// entryKey hashes key, which holds whatever the client sent, into a Redis
+// key of fixed length.
+func (c *redisResponseCache) entryKey(generation, key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return redisResponseCachePrefix + generation + ":" + hex.EncodeToString(sum[:])
+}
+
+func (c *redisResponseCache) get(ctx context.Context, generation, key string) (cachedResponse, bool, error) {
+	raw, err := c.client.get(ctx, c.entryKey(generation, key))
+	if errors.Is(err, errRedisNil) {
+		return cachedResponse{}, false, nil
+	}
+	if err != nil {
+		return cachedResponse{}, false, err
+	}
+	var entry cachedResponse
+	if err := json.Unmarshal([]byte(raw), &entry); err != nil {
+		return cachedResponse{}, false, err
+	}
+	return entry, true, nil
+}
+
+// put can't tell whether generation is still current without a round trip
+// of its own, and needn't: an entry stored under an old generation is never
+// read.
+func (c *redisResponseCache) put(ctx context.Context, generation, key string, entry cachedResponse, ttl time.Duration) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return c.client.setPX(ctx, c.entryKey(generation, key), string(raw), ttl)
+}
+
+func (c *redisResponseCache) invalidate(ctx context.Context) error {
+	_, err := c.client.incr(ctx, redisResponseCachePrefix+"generation")
+	return err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseResponseCacheRoutes(t *testing.T) {
+	routes, err := parseResponseCacheRoutes(" /albums/stats=1m, /genres=30s,,")
+	if err != nil || len(routes) != 2 || routes["/albums/stats"] != time.Minute || routes["/genres"] != 30*time.Second {
+		t.Errorf("parsed %v, %v", routes, err)
+	}
+	for _, bad := range []string{"/albums/stats", "albums=1m", "/albums=soon", "/albums=0s", "/albums=-1m", "/admin/apikeys=1m", "/me/usage=1m"} {
+		if _, err := parseResponseCacheRoutes(bad); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.ResponseCacheRoutes = "/albums/stats=1m"
+		cfg.StatsCacheTTL = 0 // only the response cache
+	})
+	store := &countingStatsStore{InMemoryAlbumStore: s.albums}
+	albumStore = store
+	s.create(newTestAlbum())
+
+	get := func(want, age string, aggregations int32, headers ...string) string {
+		t.Helper()
+		w := s.do(http.MethodGet, "/albums/stats", "", headers...)
+		expectStatus(t, w, http.StatusOK)
+		if got := w.Header().Get("X-Cache"); got != want {
+			t.Errorf("X-Cache %q, want %q", got, want)
+		}
+		if got := w.Header().Get("Age"); got != age {
+			t.Errorf("Age %q, want %q", got, age)
+		}
+		if n := store.aggregations.Load(); n != aggregations {
+			t.Errorf("%d aggregations, want %d", n, aggregations)
+		}
+		return w.Body.String()
+	}
+
+	first := get("MISS", "", 1)
+	if got := get("HIT", "0", 1); got != first {
+		t.Errorf("the hit answered\n%s\nwhere the miss answered\n%s", got, first)
+	}
+	s.clock.Advance(45 * time.Second)
+	get("HIT", "45", 1)
+	// Another language is another entry.
+	get("MISS", "", 2, "Accept-Language", "fr")
+	get("HIT", "0", 2, "Accept-Language", "fr")
+
+	// The entry lasts exactly its TTL.
+	s.clock.Advance(15 * time.Second)
+	get("MISS", "", 3)
+	get("HIT", "0", 3)
+
+	// A write drops every entry, and the next answer has the new album.
+	s.create(newTestAlbum(withTitle("Giant Steps")))
+	if got := get("MISS", "", 4); got == first || !strings.Contains(got, `"count": 2`) {
+		t.Errorf("the answer after a POST:\n%s", got)
+	}
+	get("HIT", "0", 4)
+
+	// no-cache goes to the handler, and refreshes the entry.
+	s.clock.Advance(30 * time.Second)
+	get("MISS", "", 5, "Cache-Control", "no-cache")
+	get("HIT", "0", 5)
+	// Conditional requests are left to the handler.
+	get("", "", 6, "If-None-Match", `"abc"`)
+	// A listed path is only cached for GET.
+	if w := s.do(http.MethodHead, "/albums/stats", ""); w.Header().Get("X-Cache") != "" {
+		t.Errorf("HEAD X-Cache %q", w.Header().Get("X-Cache"))
+	}
+}
+
+func TestMemoryResponseCacheLRU(t *testing.T) {
+	newTestServer(t)
+	ctx := context.Background()
+	c := newMemoryResponseCache(2)
+	gen, _ := c.generation(ctx)
+	for _, key := range []string{"a", "b"} {
+		c.put(ctx, gen, key, cachedResponse{Body: []byte(key)}, time.Minute)
+	}
+	c.get(ctx, gen, "a") // b is now the least recently used
+	c.put(ctx, gen, "c", cachedResponse{Body: []byte("c")}, time.Minute)
+	for key, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, found, _ := c.get(ctx, gen, key); found != want {
+			t.Errorf("%s cached: %t, want %t", key, found, want)
+		}
+	}
+	// A response computed before an invalidation isn't stored after it.
+	c.invalidate(ctx)
+	c.put(ctx, gen, "a", cachedResponse{Body: []byte("stale")}, time.Minute)
+	current, _ := c.generation(ctx)
+	if _, found, _ := c.get(ctx, current, "a"); found {
+		t.Error("an entry of the old generation was stored")
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWriteJSONMatchesMarshalIndent(t *testing.T) {
+	list, _ := newSizedAlbumStore(t, 3)
+	page, _ := list.List(t.Context(), ListOptions{})
+	for _, v := range []any{page.Albums, page.Albums[0], map[string]any{"html": "<b>&</b>"}, []album{}} {
+		want, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		writeJSON(w, http.StatusOK, v)
+		if !bytes.Equal(w.Body.Bytes(), want) {
+			t.Errorf("writeJSON wrote\n%s\nwant\n%s", w.Body, want)
+		}
+	}
+}
+
+func TestWriteJSONEncodingError(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeJSON(w, http.StatusOK, map[string]any{"f": func() {}})
+	expectProblem(t, w, http.StatusInternalServerError)
+}
+
+// jsonBaseline is how responses were written before the buffers were
+// pooled, for comparison.
+func jsonBaseline(w http.ResponseWriter, status int, data any) {
+	body, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// discardWriter is a ResponseWriter that keeps nothing, so the benchmarks
+// measure the encoding alone.
+type discardWriter struct{ h http.Header }
+
+func (d discardWriter) Header() http.Header         { return d.h }
+func (d discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (d discardWriter) WriteHeader(int)             {}
+
+// BenchmarkWriteJSON writes a page of 100 albums and a single album with
+// MarshalIndent, as responses used to be written, and with writeJSON.
+// Run with -benchmem for the allocations.
+func BenchmarkWriteJSON(b *testing.B) {
+	store, _ := newSizedAlbumStore(b, 100)
+	page, _ := store.List(b.Context(), ListOptions{})
+	for _, payload := range []struct {
+		name string
+		data any
+	}{
+		{"list", page.Albums},
+		{"album", page.Albums[0]},
+	} {
+		for _, writer := range []struct {
+			name  string
+			write func(http.ResponseWriter, int, any)
+		}{
+			{"marshalIndent", jsonBaseline},
+			{"pooled", writeJSON},
+		} {
+			b.Run(payload.name+"/"+writer.name, func(b *testing.B) {
+				b.ReportAllocs()
+				w := discardWriter{h: http.Header{}}
+				for b.Loop() {
+					writer.write(w, http.StatusOK, payload.data)
+				}
+			})
+		}
+	}
+}
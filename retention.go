@@ -0,0 +1,456 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	// retentionJobInterval is how often the retention job runs.
+	retentionJobInterval = time.Hour
+
+	// retentionBatchSize is how many rows each statement of the SQL stores
+	// deletes or updates, so a first run over years of history doesn't hold
+	// a lock for the whole of it.
+	retentionBatchSize = 500
+)
+
+var errRetentionUnsupported = errors.New("the configured store does not support retention")
+
+// The data classes of the retention job, as they appear in its status.
+const (
+	retentionAudit         = "auditEntriesAnonymized"
+	retentionImportJobs    = "importJobsDeleted"
+	retentionMetrics       = "metricsSamplesDeleted"
+	retentionRateLimitSnap = "rateLimitSnapshotsDeleted"
+)
+
+// albumRetainer is implemented by the album stores that can apply the
+// retention periods to what they keep next to the albums. With dryRun each
+// method only counts what it would change.
+type albumRetainer interface {
+	// AnonymizeAudit replaces the principal of the audit entries recorded
+	// before before with principalAnonymized, and returns how many it
+	// changed.
+	AnonymizeAudit(ctx context.Context, before time.Time, dryRun bool) (int, error)
+	// PruneImportJobs deletes the import jobs that finished before before,
+	// and returns how many. Jobs still queued or running are kept.
+	PruneImportJobs(ctx context.Context, before time.Time, dryRun bool) (int, error)
+}
+
+func storeAnonymizeAudit(ctx context.Context, store AlbumStore, before time.Time, dryRun bool) (int, error) {
+	r, ok := store.(albumRetainer)
+	if !ok {
+		return 0, errRetentionUnsupported
+	}
+	return r.AnonymizeAudit(ctx, before, dryRun)
+}
+
+func storePruneImportJobs(ctx context.Context, store AlbumStore, before time.Time, dryRun bool) (int, error) {
+	r, ok := store.(albumRetainer)
+	if !ok {
+		return 0, errRetentionUnsupported
+	}
+	return r.PruneImportJobs(ctx, before, dryRun)
+}
+
+// metricsRetainer is implemented by the metrics stores that can apply the
+// retention periods, as albumRetainer.
+type metricsRetainer interface {
+	// PruneMetricsHistory deletes the metrics samples taken before before,
+	// and returns how many.
+	PruneMetricsHistory(ctx context.Context, before time.Time, dryRun bool) (int, error)
+	// PruneRateLimitSnapshot deletes the rate limit snapshot if it was
+	// saved before before, and returns 1 if it did.
+	PruneRateLimitSnapshot(ctx context.Context, before time.Time, dryRun bool) (int, error)
+}
+
+func storePruneMetricsHistory(ctx context.Context, store MetricsStore, before time.Time, dryRun bool) (int, error) {
+	r, ok := store.(metricsRetainer)
+	if !ok {
+		return 0, errRetentionUnsupported
+	}
+	return r.PruneMetricsHistory(ctx, before, dryRun)
+}
+
+func storePruneRateLimitSnapshot(ctx context.Context, store MetricsStore, before time.Time, dryRun bool) (int, error) {
+	r, ok := store.(metricsRetainer)
+	if !ok {
+		return 0, errRetentionUnsupported
+	}
+	return r.PruneRateLimitSnapshot(ctx, before, dryRun)
+}
+
+// retentionClass is one kind of data the retention job looks after.
+type retentionClass struct {
+	name      string
+	retention time.Duration
+	verb      string // what happens to the data, for the log
+	apply     func(ctx context.Context, before time.Time, dryRun bool) (int, error)
+}
+
+// retentionClasses lists the data classes with their periods from cfg.
+// Albums have none: a delete removes an album outright, so there is no
+// soft-deleted album to purge.
+func retentionClasses(cfg *Config) []retentionClass {
+	return []retentionClass{
+		{retentionAudit, cfg.AuditRetention, "anonymize audit entries", func(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+			// The store keeps the price changes, and this process the rest.
+			n, err := storeAnonymizeAudit(ctx, albumStore, before, dryRun)
+			if errors.Is(err, errRetentionUnsupported) {
+				n, err = 0, nil
+			}
+			if l, ok := auditLog.(*InMemoryAuditLog); ok && err == nil {
+				n += l.anonymize(before, dryRun)
+			}
+			return n, err
+		}},
+		{retentionImportJobs, cfg.ImportJobRetention, "delete import jobs", func(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+			return storePruneImportJobs(ctx, albumStore, before, dryRun)
+		}},
+		{retentionMetrics, cfg.MetricsHistoryRetention, "delete metrics samples", func(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+			return storePruneMetricsHistory(ctx, metricsStore, before, dryRun)
+		}},
+		{retentionRateLimitSnap, cfg.RateLimitSnapshotRetention, "delete the rate limit snapshot", func(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+			return storePruneRateLimitSnapshot(ctx, metricsStore, before, dryRun)
+		}},
+	}
+}
+
+// applyRetention is the retention job. For each data class with a
+// retention period it changes what is older than the period, and reports
+// how much in the job's status. With RETENTION_DRY_RUN it only logs what it
+// would change, and reports that. A class the store can't apply retention
+// to is skipped; a failure of one class doesn't stop the others.
+func applyRetention(ctx context.Context) error {
+	cfg := currentConfig()
+	now := serverClock.Now()
+	result := make(map[string]int)
+	var errs []error
+	for _, class := range retentionClasses(cfg) {
+		if class.retention <= 0 {
+			continue
+		}
+		before := now.Add(-class.retention).UTC()
+		n, err := class.apply(ctx, before, cfg.RetentionDryRun)
+		switch {
+		case errors.Is(err, errRetentionUnsupported):
+			debugf("Retention: the store can't %s, skipping", class.verb)
+			continue
+		case err != nil:
+			errs = append(errs, err)
+			continue
+		}
+		result[class.name] = n
+		if cfg.RetentionDryRun {
+			log.Printf("🧹 Retention dry run: would %s from before %s: %d", class.verb, before.Format(time.RFC3339), n)
+		} else if n > 0 {
+			log.Printf("🧹 Retention: %s from before %s: %d", class.verb, before.Format(time.RFC3339), n)
+		}
+	}
+	setJobResult(ctx, result)
+	return errors.Join(errs...)
+}
+
+// setupRetention registers the retention job. It always runs, as the
+// periods can be set by a reload, and does nothing while none is.
+func setupRetention() {
+	scheduler.register("retention", retentionJobInterval, applyRetention)
+}
+
+// anonymize replaces the principal of the entries from before before,
+// returning how many it changed, or would with dryRun.
+func (l *InMemoryAuditLog) anonymize(before time.Time, dryRun bool) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := 0
+	for i, e := range l.entries {
+		if e.Timestamp.Before(before) && e.Principal != principalAnonymized {
+			if !dryRun {
+				l.entries[i].Principal = principalAnonymized
+			}
+			n++
+		}
+	}
+	return n
+}
+
+// AnonymizeAudit implements albumRetainer, for the price history, which is
+// what the in-memory store keeps of the audit log.
+func (store *InMemoryAlbumStore) AnonymizeAudit(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	n := 0
+	for _, changes := range store.prices {
+		for i, c := range changes {
+			if c.ChangedAt.Before(before) && c.Principal != principalAnonymized {
+				if !dryRun {
+					changes[i].Principal = principalAnonymized
+				}
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+func (store *InMemoryAlbumStore) PruneImportJobs(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	n := 0
+	for id, job := range store.importJobs {
+		if job.finished() && job.FinishedAt.Before(before) {
+			if !dryRun {
+				delete(store.importJobs, id)
+			}
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (store *InMemoryMetricsStore) PruneMetricsHistory(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	kept := make([]MetricsSample, 0, len(store.history))
+	for _, s := range store.history {
+		if !s.At.Before(before) {
+			kept = append(kept, s)
+		}
+	}
+	n := len(store.history) - len(kept)
+	if !dryRun {
+		store.history = kept
+	}
+	return n, nil
+}
+
+func (store *InMemoryMetricsStore) PruneRateLimitSnapshot(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.rateLimits == nil || !store.rateLimitsSavedAt.Before(before) {
+		return 0, nil
+	}
+	if !dryRun {
+		store.rateLimits = nil
+	}
+	return 1, nil
+}
+
+// sqlRetention runs a retention statement in batches of retentionBatchSize
+// until one changes fewer, or, with dryRun, runs count instead. exec runs
+// one batch and returns the rows it changed.
+func sqlRetention(dryRun bool, count func() (int, error), exec func() (int, error)) (int, error) {
+	if dryRun {
+		return count()
+	}
+	total := 0
+	for {
+		n, err := exec()
+		total += n
+		if err != nil || n < retentionBatchSize {
+			return total, err
+		}
+	}
+}
+
+func (store *SqliteAlbumStore) AnonymizeAudit(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	db := store.db.WithContext(ctx)
+	return sqlRetention(dryRun, func() (int, error) {
+		var n int
+		err := db.Raw(`SELECT count(*) FROM audit_log WHERE timestamp < ? AND principal <> ?`, before, principalAnonymized).Scan(&n).Error
+		return n, err
+	}, func() (int, error) {
+		res := db.Exec(`UPDATE audit_log SET principal = ? WHERE id IN
+			 (SELECT id FROM audit_log WHERE timestamp < ? AND principal <> ? LIMIT ?)`, principalAnonymized, before, principalAnonymized, retentionBatchSize)
+		return int(res.RowsAffected), res.Error
+	})
+}
+
+func (store *SqliteAlbumStore) PruneImportJobs(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	db := store.db.WithContext(ctx)
+	return sqlRetention(dryRun, func() (int, error) {
+		var n int
+		err := db.Raw(`SELECT count(*) FROM import_jobs WHERE finished_at < ? AND state NOT IN (?, ?)`, before, importQueued, importRunning).Scan(&n).Error
+		return n, err
+	}, func() (int, error) {
+		res := db.Exec(`DELETE FROM import_jobs WHERE id IN
+			 (SELECT id FROM import_jobs WHERE finished_at < ? AND state NOT IN (?, ?) LIMIT ?)`, before, importQueued, importRunning, retentionBatchSize)
+		return int(res.RowsAffected), res.Error
+	})
+}
+
+func (store *SqliteMetricsStore) PruneMetricsHistory(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	db := store.db.WithContext(ctx)
+	return sqlRetention(dryRun, func() (int, error) {
+		var n int
+		err := db.Raw(`SELECT count(*) FROM metrics_history WHERE at < ?`, before).Scan(&n).Error
+		return n, err
+	}, func() (int, error) {
+		res := db.Exec(`DELETE FROM metrics_history WHERE rowid IN (SELECT rowid FROM metrics_history WHERE at < ? LIMIT ?)`, before, retentionBatchSize)
+		return int(res.RowsAffected), res.Error
+	})
+}
+
+func (store *SqliteMetricsStore) PruneRateLimitSnapshot(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	db := store.db.WithContext(ctx)
+	if dryRun {
+		var n int
+		err := db.Raw(`SELECT count(*) FROM rate_limit_snapshot WHERE saved_at < ?`, before).Scan(&n).Error
+		return n, err
+	}
+	res := db.Exec(`DELETE FROM rate_limit_snapshot WHERE saved_at < ?`, before)
+	return int(res.RowsAffected), res.Error
+}
+
+func (store *PostgresAlbumStore) AnonymizeAudit(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	return sqlRetention(dryRun, func() (int, error) {
+		ctx, cancel := store.opContext(ctx)
+		defer cancel()
+		var n int
+		err := store.db.QueryRow(ctx, `SELECT count(*) FROM audit_log WHERE timestamp < $1 AND principal <> $2`, before, principalAnonymized).Scan(&n)
+		return n, err
+	}, func() (int, error) {
+		ctx, cancel := store.opContext(ctx)
+		defer cancel()
+		tag, err := store.db.Exec(ctx, `UPDATE audit_log SET principal = $2 WHERE id IN
+			 (SELECT id FROM audit_log WHERE timestamp < $1 AND principal <> $2 LIMIT $3)`, before, principalAnonymized, retentionBatchSize)
+		return int(tag.RowsAffected()), err
+	})
+}
+
+func (store *PostgresAlbumStore) PruneImportJobs(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	return sqlRetention(dryRun, func() (int, error) {
+		ctx, cancel := store.opContext(ctx)
+		defer cancel()
+		var n int
+		err := store.db.QueryRow(ctx, `SELECT count(*) FROM import_jobs WHERE finished_at < $1 AND state NOT IN ($2, $3)`,
+			before, importQueued, importRunning).Scan(&n)
+		return n, err
+	}, func() (int, error) {
+		ctx, cancel := store.opContext(ctx)
+		defer cancel()
+		tag, err := store.db.Exec(ctx, `DELETE FROM import_jobs WHERE id IN
+			 (SELECT id FROM import_jobs WHERE finished_at < $1 AND state NOT IN ($2, $3) LIMIT $4)`, before, importQueued, importRunning, retentionBatchSize)
+		return int(tag.RowsAffected()), err
+	})
+}
+
+func (store *PostgresMetricsStore) PruneMetricsHistory(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	return sqlRetention(dryRun, func() (int, error) {
+		var n int
+		err := store.pool.QueryRow(ctx, `SELECT count(*) FROM metrics_history WHERE at < $1`, before).Scan(&n)
+		return n, err
+	}, func() (int, error) {
+		tag, err := store.pool.Exec(ctx, `DELETE FROM metrics_history WHERE ctid IN (SELECT ctid FROM metrics_history WHERE at < $1 LIMIT $2)`,
+			before, retentionBatchSize)
+		return int(tag.RowsAffected()), err
+	})
+}
+
+func (store *PostgresMetricsStore) PruneRateLimitSnapshot(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	if dryRun {
+		var n int
+		err := store.pool.QueryRow(ctx, `SELECT count(*) FROM rate_limit_snapshot WHERE saved_at < $1`, before).Scan(&n)
+		return n, err
+	}
+	tag, err := store.pool.Exec(ctx, `DELETE FROM rate_limit_snapshot WHERE saved_at < $1`, before)
+	return int(tag.RowsAffected()), err
+}
+
+// MongoDB updates and deletes many documents in one command without holding
+// a lock over the collection, so its stores don't batch.
+
+func (store *MongoAlbumStore) AnonymizeAudit(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	filter := bson.D{{Key: "timestamp", Value: bson.D{{Key: "$lt", Value: before}}}, {Key: "principal", Value: bson.D{{Key: "$ne", Value: principalAnonymized}}}}
+	if dryRun {
+		n, err := store.audit.CountDocuments(ctx, filter)
+		return int(n), err
+	}
+	res, err := store.audit.UpdateMany(ctx, filter, bson.D{{Key: "$set", Value: bson.D{{Key: "principal", Value: principalAnonymized}}}})
+	if err != nil {
+		return 0, err
+	}
+	return int(res.ModifiedCount), nil
+}
+
+func (store *MongoAlbumStore) PruneImportJobs(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	filter := bson.D{{Key: "finishedAt", Value: bson.D{{Key: "$lt", Value: before}}}, {Key: "state", Value: bson.D{{Key: "$nin", Value: bson.A{importQueued, importRunning}}}}}
+	if dryRun {
+		n, err := store.importJobs.CountDocuments(ctx, filter)
+		return int(n), err
+	}
+	res, err := store.importJobs.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+func (store *MongoMetricsStore) PruneMetricsHistory(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	filter := bson.D{{Key: "at", Value: bson.D{{Key: "$lt", Value: before}}}}
+	if dryRun {
+		n, err := store.history.CountDocuments(ctx, filter)
+		return int(n), err
+	}
+	res, err := store.history.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+func (store *MongoMetricsStore) PruneRateLimitSnapshot(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	filter := bson.D{{Key: "_id", Value: mongoRateLimitsID}, {Key: "savedAt", Value: bson.D{{Key: "$lt", Value: before}}}}
+	if dryRun {
+		n, err := store.collection.CountDocuments(ctx, filter)
+		return int(n), err
+	}
+	res, err := store.collection.DeleteOne(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	return int(res.DeletedCount), nil
+}
+
+func (store *BreakerMetricsStore) PruneMetricsHistory(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	if !store.breaker.allow() {
+		return 0, errCircuitOpen
+	}
+	n, err := storePruneMetricsHistory(ctx, store.backend, before, dryRun)
+	if !errors.Is(err, errRetentionUnsupported) {
+		store.breaker.record(err)
+	}
+	return n, err
+}
+
+func (store *BreakerMetricsStore) PruneRateLimitSnapshot(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	if !store.breaker.allow() {
+		return 0, errCircuitOpen
+	}
+	n, err := storePruneRateLimitSnapshot(ctx, store.backend, before, dryRun)
+	if !errors.Is(err, errRetentionUnsupported) {
+		store.breaker.record(err)
+	}
+	return n, err
+}
+
+func (store *DeferredMetricsStore) PruneMetricsHistory(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	ms, _, _, ok := store.conn.stores()
+	if !ok {
+		return 0, errStoreConnecting
+	}
+	return storePruneMetricsHistory(ctx, ms, before, dryRun)
+}
+
+func (store *DeferredMetricsStore) PruneRateLimitSnapshot(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	ms, _, _, ok := store.conn.stores()
+	if !ok {
+		return 0, errStoreConnecting
+	}
+	return storePruneRateLimitSnapshot(ctx, ms, before, dryRun)
+}
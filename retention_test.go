@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// retentionBackend seeds the data the retention job looks after into one
+// backend's stores, at the times a test picks, and reads back who the
+// audit entries name. Each seeded audit entry is kept as copies records.
+type retentionBackend struct {
+	albums     AlbumStore
+	metrics    MetricsStore
+	copies     int
+	audit      func(at time.Time, principal string)
+	snapshot   func(savedAt time.Time)
+	principals func() []string
+}
+
+// Each retention period, and the seeds on either side of its cutoff.
+const (
+	testAuditRetention     = 365 * 24 * time.Hour
+	testImportJobRetention = 30 * 24 * time.Hour
+	testMetricsRetention   = 7 * 24 * time.Hour
+	testSnapshotRetention  = 24 * time.Hour
+)
+
+func testRetention(t *testing.T, s *testServer, b retentionBackend) {
+	ctx := context.Background()
+	now := s.clock.Now()
+	cfg := *s.cfg
+	cfg.AuditRetention, cfg.ImportJobRetention = testAuditRetention, testImportJobRetention
+	cfg.MetricsHistoryRetention, cfg.RateLimitSnapshotRetention = testMetricsRetention, testSnapshotRetention
+	liveConfig.Store(&cfg)
+	albumStore, metricsStore = b.albums, b.metrics
+
+	b.audit(now.Add(-testAuditRetention-time.Second), "key:old")
+	b.audit(now.Add(-testAuditRetention+time.Second), "key:recent")
+	// Already anonymized, so not counted again.
+	b.audit(now.Add(-2*testAuditRetention), principalAnonymized)
+
+	jobs := b.albums.(importJobStore)
+	for _, job := range []importJob{
+		{ID: "finished-old", State: importCompleted, FinishedAt: now.Add(-testImportJobRetention - time.Second)},
+		{ID: "failed-old", State: importFailed, FinishedAt: now.Add(-testImportJobRetention - time.Hour)},
+		{ID: "finished-recent", State: importCompleted, FinishedAt: now.Add(-testImportJobRetention + time.Second)},
+		// Still running, however long ago it started.
+		{ID: "running", State: importRunning, StartedAt: now.Add(-2 * testImportJobRetention)},
+	} {
+		job.Principal, job.CreatedAt, job.UpdatedAt = "admin", now.Add(-3*testImportJobRetention), now
+		if err := jobs.CreateImportJob(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, at := range []time.Time{now.Add(-testMetricsRetention - time.Minute), now.Add(-testMetricsRetention - time.Second), now.Add(-testMetricsRetention + time.Second)} {
+		if err := b.metrics.AddMetricsSample(ctx, MetricsSample{Instance: "web-1", At: at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.snapshot(now.Add(-testSnapshotRetention - time.Second))
+
+	run := func() map[string]int {
+		t.Helper()
+		var result map[string]int
+		if err := applyRetention(context.WithValue(ctx, jobResultKey{}, &result)); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	want := map[string]int{retentionAudit: b.copies, retentionImportJobs: 2, retentionMetrics: 2, retentionRateLimitSnap: 1}
+
+	// A dry run counts what a run would change, and changes nothing.
+	cfg.RetentionDryRun = true
+	if got := run(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("dry run: %v, want %v", got, want)
+	}
+	if got := strings.Join(b.principals(), " "); got != "anonymized key:old key:recent" {
+		t.Errorf("principals after the dry run: %s", got)
+	}
+
+	cfg.RetentionDryRun = false
+	if got := run(); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("run: %v, want %v", got, want)
+	}
+	if got := strings.Join(b.principals(), " "); got != "anonymized anonymized key:recent" {
+		t.Errorf("principals after the run: %s", got)
+	}
+	for id, kept := range map[string]bool{"finished-old": false, "failed-old": false, "finished-recent": true, "running": true} {
+		if _, err := jobs.GetImportJob(ctx, id); kept != (err == nil) || !kept && !errors.Is(err, errImportJobNotFound) {
+			t.Errorf("import job %s: %v, want kept %t", id, err, kept)
+		}
+	}
+	samples, err := b.metrics.LoadMetricsHistory(ctx, metricsHistoryFilter{From: now.Add(-2 * testMetricsRetention), To: now})
+	if err != nil || len(samples) != 1 || !samples[0].At.Equal(now.Add(-testMetricsRetention+time.Second)) {
+		t.Errorf("samples after the run: %+v, %v", samples, err)
+	}
+	if snap, err := b.metrics.LoadRateLimitSnapshot(ctx); snap != nil || err != nil {
+		t.Errorf("the snapshot after the run: %q, %v", snap, err)
+	}
+
+	// Nothing is left to change.
+	if got := run(); fmt.Sprint(got) != fmt.Sprint(map[string]int{retentionAudit: 0, retentionImportJobs: 0, retentionMetrics: 0, retentionRateLimitSnap: 0}) {
+		t.Errorf("second run: %v", got)
+	}
+}
+
+func TestRetentionInMemory(t *testing.T) {
+	s := newTestServer(t)
+	metrics := &InMemoryMetricsStore{}
+	testRetention(t, s, retentionBackend{
+		albums:  s.albums,
+		metrics: metrics,
+		copies:  2,
+		// The store keeps the price changes, and the audit log the rest.
+		audit: func(at time.Time, principal string) {
+			s.albums.mu.Lock()
+			if s.albums.prices == nil {
+				s.albums.prices = priceLedger{}
+			}
+			s.albums.prices["a"] = append(s.albums.prices["a"], PriceChange{ChangedAt: at, Principal: principal})
+			s.albums.mu.Unlock()
+			auditLog.Record(AuditEntry{ID: newAlbumID(), Timestamp: at, Action: auditAlbumUpdated, Principal: principal})
+		},
+		snapshot: func(savedAt time.Time) {
+			metrics.rateLimits, metrics.rateLimitsSavedAt = []byte("{}"), savedAt
+		},
+		principals: func() []string {
+			var out []string
+			entries, _ := auditLog.List()
+			for i, e := range entries {
+				if e.Principal != s.albums.prices["a"][i].Principal {
+					t.Errorf("the audit log has %s where the price history has %s", e.Principal, s.albums.prices["a"][i].Principal)
+				}
+				out = append(out, e.Principal)
+			}
+			sort.Strings(out)
+			return out
+		},
+	})
+}
+
+func TestRetentionSQLite(t *testing.T) {
+	s := newTestServer(t)
+	db := testSQLiteStores(t)
+	albums, err := NewSqliteAlbumStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRetention(t, s, retentionBackend{
+		albums:  albums,
+		metrics: NewSqliteMetricsStore(db),
+		copies:  1,
+		audit: func(at time.Time, principal string) {
+			if err := db.Exec(`INSERT INTO audit_log (id, timestamp, action, album_id, principal) VALUES (?, ?, ?, ?, ?)`,
+				newAlbumID(), at.UTC(), auditAlbumPriceChanged, "a", principal).Error; err != nil {
+				t.Fatal(err)
+			}
+		},
+		snapshot: func(savedAt time.Time) {
+			if err := db.Exec(`INSERT INTO rate_limit_snapshot (id, snapshot, saved_at) VALUES (1, '{}', ?)`, savedAt.UTC()).Error; err != nil {
+				t.Fatal(err)
+			}
+		},
+		principals: func() []string {
+			var out []string
+			if err := db.Raw(`SELECT principal FROM audit_log ORDER BY principal`).Scan(&out).Error; err != nil {
+				t.Fatal(err)
+			}
+			return out
+		},
+	})
+}
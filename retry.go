@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/brentmzey/web-service-go/types"
+	"github.com/jackc/pgconn"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// totalStoreRetries counts read attempts repeated after a transient error,
+// for /metrics.
+var totalStoreRetries int64
+
+// retryPolicy retries idempotent store reads that failed with a
+// connection-class error, with full-jitter exponential backoff.
+type retryPolicy struct {
+	attempts  int           // total tries, including the first
+	baseDelay time.Duration // cap on the first backoff; doubles per attempt
+	maxDelay  time.Duration
+	// budget bounds the total time spent retrying one call, on top of
+	// whatever deadline the caller's context carries.
+	budget time.Duration
+}
+
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	d := p.baseDelay << attempt
+	if d > p.maxDelay || d <= 0 {
+		d = p.maxDelay
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// RetryingAlbumStore retries reads on transient errors. Writes pass straight
+// through: a Create that timed out may still have committed, and repeating
+// it must be the client's call.
+type RetryingAlbumStore struct {
+	AlbumStore
+	policy retryPolicy
+}
+
+func NewRetryingAlbumStore(store AlbumStore, policy retryPolicy) *RetryingAlbumStore {
+	return &RetryingAlbumStore{AlbumStore: store, policy: policy}
+}
+
+func (store *RetryingAlbumStore) List(ctx context.Context, opts ListOptions) (albumPage, error) {
+	var page albumPage
+	err := store.retry(ctx, "List", func() (err error) {
+		page, err = store.AlbumStore.List(ctx, opts)
+		return err
+	})
+	return page, err
+}
+
+// Iterate is retried only until fn has seen an album: after that a retry
+// would hand it the same albums again.
+func (store *RetryingAlbumStore) Iterate(ctx context.Context, opts ListOptions, fn func(album) error) error {
+	f := &iterFunc{fn: fn}
+	var err error
+	store.retry(ctx, "Iterate", func() error {
+		err = store.AlbumStore.Iterate(ctx, opts, f.call)
+		if f.called {
+			return nil
+		}
+		return err
+	})
+	return err
+}
+
+func (store *RetryingAlbumStore) GetByID(ctx context.Context, id string) (album, error) {
+	return store.get(ctx, "GetByID", func() (album, error) { return store.AlbumStore.GetByID(ctx, id) })
+}
+
+func (store *RetryingAlbumStore) GetBySlug(ctx context.Context, slug string) (album, error) {
+	return store.get(ctx, "GetBySlug", func() (album, error) { return store.AlbumStore.GetBySlug(ctx, slug) })
+}
+
+func (store *RetryingAlbumStore) GetByBarcode(ctx context.Context, code string) (album, error) {
+	return store.get(ctx, "GetByBarcode", func() (album, error) { return store.AlbumStore.GetByBarcode(ctx, code) })
+}
+
+func (store *RetryingAlbumStore) Stats(ctx context.Context, filter AlbumFilter) (albumStats, error) {
+	var s albumStats
+	err := store.retry(ctx, "Stats", func() (err error) {
+		s, err = storeStats(ctx, store.AlbumStore, filter)
+		return err
+	})
+	return s, err
+}
+
+func (store *RetryingAlbumStore) PriceHistory(ctx context.Context, albumID string, limit, offset int) ([]PriceChange, int, error) {
+	var changes []PriceChange
+	var total int
+	err := store.retry(ctx, "PriceHistory", func() (err error) {
+		changes, total, err = storePriceHistory(ctx, store.AlbumStore, albumID, limit, offset)
+		return err
+	})
+	return changes, total, err
+}
+
+func (store *RetryingAlbumStore) Changes(ctx context.Context, since int64, limit int) ([]types.AlbumChange, int64, error) {
+	var changes []types.AlbumChange
+	var head int64
+	err := store.retry(ctx, "Changes", func() (err error) {
+		changes, head, err = storeChanges(ctx, store.AlbumStore, since, limit)
+		return err
+	})
+	return changes, head, err
+}
+
+func (store *RetryingAlbumStore) TrimChanges(ctx context.Context, before time.Time) (int, error) {
+	var n int
+	err := store.retry(ctx, "TrimChanges", func() (err error) {
+		n, err = storeTrimChanges(ctx, store.AlbumStore, before)
+		return err
+	})
+	return n, err
+}
+
+func (store *RetryingAlbumStore) OutboxPosition(ctx context.Context) (outboxPosition, error) {
+	var pos outboxPosition
+	err := store.retry(ctx, "OutboxPosition", func() (err error) {
+		pos, err = storeOutboxPosition(ctx, store.AlbumStore)
+		return err
+	})
+	return pos, err
+}
+
+// AdvanceOutbox is safe to retry: it only moves the position from from, so
+// a retry after an attempt that did reports false.
+func (store *RetryingAlbumStore) AdvanceOutbox(ctx context.Context, from, to int64) (bool, error) {
+	var moved bool
+	err := store.retry(ctx, "AdvanceOutbox", func() (err error) {
+		moved, err = storeAdvanceOutbox(ctx, store.AlbumStore, from, to)
+		return err
+	})
+	return moved, err
+}
+
+func (store *RetryingAlbumStore) PublishDue(ctx context.Context, now time.Time) ([]album, error) {
+	var published []album
+	err := store.retry(ctx, "PublishDue", func() (err error) {
+		published, err = storePublishDue(ctx, store.AlbumStore, now)
+		return err
+	})
+	return published, err
+}
+
+func (store *RetryingAlbumStore) Revisions(ctx context.Context, from, to time.Time) ([]albumRevision, time.Time, error) {
+	var revisions []albumRevision
+	var since time.Time
+	err := store.retry(ctx, "Revisions", func() (err error) {
+		revisions, since, err = storeRevisions(ctx, store.AlbumStore, from, to)
+		return err
+	})
+	return revisions, since, err
+}
+
+func (store *RetryingAlbumStore) AnonymizeAudit(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	var n int
+	err := store.retry(ctx, "AnonymizeAudit", func() (err error) {
+		n, err = storeAnonymizeAudit(ctx, store.AlbumStore, before, dryRun)
+		return err
+	})
+	return n, err
+}
+
+func (store *RetryingAlbumStore) PruneImportJobs(ctx context.Context, before time.Time, dryRun bool) (int, error) {
+	var n int
+	err := store.retry(ctx, "PruneImportJobs", func() (err error) {
+		n, err = storePruneImportJobs(ctx, store.AlbumStore, before, dryRun)
+		return err
+	})
+	return n, err
+}
+
+func (store *RetryingAlbumStore) SyncToken(ctx context.Context) (string, error) {
+	var token string
+	err := store.retry(ctx, "SyncToken", func() (err error) {
+		token, err = storeSyncToken(ctx, store.AlbumStore)
+		return err
+	})
+	return token, err
+}
+
+func (store *RetryingAlbumStore) ArtistGroups(ctx context.Context, availableAt time.Time) ([]artistGroup, error) {
+	var groups []artistGroup
+	err := store.retry(ctx, "ArtistGroups", func() (err error) {
+		groups, err = storeArtistGroups(ctx, store.AlbumStore, availableAt)
+		return err
+	})
+	return groups, err
+}
+
+func (store *RetryingAlbumStore) Search(ctx context.Context, query searchNode) ([]album, error) {
+	var list []album
+	err := store.retry(ctx, "Search", func() (err error) {
+		list, err = storeSearch(ctx, store.AlbumStore, query)
+		return err
+	})
+	return list, err
+}
+
+func (store *RetryingAlbumStore) get(ctx context.Context, op string, fetch func() (album, error)) (album, error) {
+	var a album
+	err := store.retry(ctx, op, func() (err error) {
+		a, err = fetch()
+		return err
+	})
+	return a, err
+}
+
+// retry gives up early, returning the last error, once ctx is done: there
+// is no one left to answer.
+func (store *RetryingAlbumStore) retry(ctx context.Context, op string, call func() error) error {
+	deadline := time.Now().Add(store.policy.budget)
+	var err error
+	for attempt := 0; ; attempt++ {
+		if err = call(); err == nil || !isTransientStoreError(err) || attempt+1 >= store.policy.attempts || ctx.Err() != nil {
+			return err
+		}
+		delay := store.policy.backoff(attempt)
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		log.Printf("🔁 %s failed (%v), retrying in %v", op, err, delay.Round(time.Millisecond))
+		atomic.AddInt64(&totalStoreRetries, 1)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (store *RetryingAlbumStore) Import(ctx context.Context, mode importMode, next func() (album, error)) (int, error) {
+	importer, ok := store.AlbumStore.(AlbumImporter)
+	if !ok {
+		return 0, errImportUnsupported
+	}
+	return importer.Import(ctx, mode, next)
+}
+
+func (store *RetryingAlbumStore) DeleteMany(ctx context.Context, ids []string) error {
+	return storeDeleteMany(ctx, store.AlbumStore, ids)
+}
+
+func (store *RetryingAlbumStore) MergeAlbums(ctx context.Context, survivor album, duplicates []string) (album, error) {
+	return storeMergeAlbums(ctx, store.AlbumStore, survivor, duplicates)
+}
+
+func (store *RetryingAlbumStore) RenameArtist(ctx context.Context, from, to string) ([]album, error) {
+	return storeRenameArtist(ctx, store.AlbumStore, from, to)
+}
+
+// SellAlbum is a write, so it isn't retried.
+func (store *RetryingAlbumStore) SellAlbum(ctx context.Context, id string, quantity int) (album, error) {
+	return storeSellAlbum(ctx, store.AlbumStore, id, quantity)
+}
+
+// SellAlbumForPayment is a write as well. The provider redelivers an event
+// that failed, which is its retry.
+func (store *RetryingAlbumStore) SellAlbumForPayment(ctx context.Context, eventID string, now, expires time.Time, id string, quantity int) (album, error) {
+	events, err := paymentEventsOf(store.AlbumStore)
+	if err != nil {
+		return album{}, err
+	}
+	return events.SellAlbumForPayment(ctx, eventID, now, expires, id, quantity)
+}
+
+func (store *RetryingAlbumStore) PrunePaymentEvents(ctx context.Context, now time.Time) (int, error) {
+	events, err := paymentEventsOf(store.AlbumStore)
+	if err != nil {
+		return 0, err
+	}
+	return events.PrunePaymentEvents(ctx, now)
+}
+
+func (store *RetryingAlbumStore) CreateImportJob(ctx context.Context, job importJob) error {
+	jobs, err := importJobsOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return jobs.CreateImportJob(ctx, job)
+}
+
+func (store *RetryingAlbumStore) GetImportJob(ctx context.Context, id string) (importJob, error) {
+	jobs, err := importJobsOf(store.AlbumStore)
+	if err != nil {
+		return importJob{}, err
+	}
+	return jobs.GetImportJob(ctx, id)
+}
+
+func (store *RetryingAlbumStore) SaveImportJobProgress(ctx context.Context, job importJob) error {
+	jobs, err := importJobsOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return jobs.SaveImportJobProgress(ctx, job)
+}
+
+func (store *RetryingAlbumStore) CancelImportJob(ctx context.Context, id string) error {
+	jobs, err := importJobsOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return jobs.CancelImportJob(ctx, id)
+}
+
+func (store *RetryingAlbumStore) CreateSavedSearch(ctx context.Context, s savedSearch) error {
+	searches, err := savedSearchesOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return searches.CreateSavedSearch(ctx, s)
+}
+
+func (store *RetryingAlbumStore) GetSavedSearch(ctx context.Context, id string) (savedSearch, error) {
+	searches, err := savedSearchesOf(store.AlbumStore)
+	if err != nil {
+		return savedSearch{}, err
+	}
+	return searches.GetSavedSearch(ctx, id)
+}
+
+func (store *RetryingAlbumStore) ListSavedSearches(ctx context.Context, owner string) ([]savedSearch, error) {
+	searches, err := savedSearchesOf(store.AlbumStore)
+	if err != nil {
+		return nil, err
+	}
+	return searches.ListSavedSearches(ctx, owner)
+}
+
+func (store *RetryingAlbumStore) DeleteSavedSearch(ctx context.Context, id string) error {
+	searches, err := savedSearchesOf(store.AlbumStore)
+	if err != nil {
+		return err
+	}
+	return searches.DeleteSavedSearch(ctx, id)
+}
+
+func (store *RetryingAlbumStore) Ping(ctx context.Context) error {
+	if p, ok := store.AlbumStore.(pinger); ok {
+		return p.Ping(ctx)
+	}
+	return nil
+}
+
+// isTransientStoreError reports whether err looks like a dropped or refused
+// connection or a timeout, i.e. something a retry might fix. Query errors,
+// constraint violations, and domain errors are not.
+func isTransientStoreError(err error) bool {
+	if err == nil || !isStoreFailure(err) {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	if pgconn.SafeToRetry(err) || pgconn.Timeout(err) {
+		return true
+	}
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+	// Errors the AWS SDK's own retryer would have retried: throttling,
+	// connection errors, and 5xx responses.
+	if retry.IsErrorRetryables(retry.DefaultRetryables).IsErrorRetryable(err).Bool() {
+		return true
+	}
+	return false
+}
+
+// setupRetryPolicy applies STORE_RETRY_ATTEMPTS and STORE_RETRY_BASE_DELAY.
+func setupRetryPolicy(cfg *Config) retryPolicy {
+	return retryPolicy{attempts: cfg.StoreRetryAttempts, baseDelay: cfg.StoreRetryBaseDelay, maxDelay: time.Second, budget: 3 * time.Second}
+}
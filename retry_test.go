@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testRetryPolicy retries quickly enough for tests.
+var testRetryPolicy = retryPolicy{attempts: 3, baseDelay: time.Millisecond, maxDelay: 5 * time.Millisecond, budget: time.Second}
+
+func TestRetryingAlbumStoreReads(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		failFirst int32
+		wantCalls int32
+		wantErr   bool
+	}{
+		{0, 1, false},
+		{1, 2, false},
+		{2, 3, false},
+		{3, 3, true}, // out of attempts
+	} {
+		backend := newFaultyAlbumStore()
+		a, err := backend.Create(ctx, newTestAlbum(withID(newAlbumID())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend.calls.Store(0)
+		backend.failFirst.Store(tc.failFirst)
+		retriesBefore := atomic.LoadInt64(&totalStoreRetries)
+
+		_, err = NewRetryingAlbumStore(backend, testRetryPolicy).GetByID(ctx, a.ID)
+		if tc.wantErr != (err != nil) {
+			t.Errorf("failing %d times: GetByID = %v", tc.failFirst, err)
+		}
+		if got := backend.calls.Load(); got != tc.wantCalls {
+			t.Errorf("failing %d times: %d calls, want %d", tc.failFirst, got, tc.wantCalls)
+		}
+		if got := atomic.LoadInt64(&totalStoreRetries) - retriesBefore; got != int64(tc.wantCalls-1) {
+			t.Errorf("failing %d times: %d retries counted, want %d", tc.failFirst, got, tc.wantCalls-1)
+		}
+	}
+}
+
+func TestRetryingAlbumStoreDoesNotRetry(t *testing.T) {
+	ctx := context.Background()
+	backend := newFaultyAlbumStore()
+	store := NewRetryingAlbumStore(backend, testRetryPolicy)
+
+	// A write that may have committed is the client's to repeat.
+	backend.failFirst.Store(1)
+	if _, err := store.Create(ctx, newTestAlbum(withID(newAlbumID()))); !errors.Is(err, errConnectionRefused) {
+		t.Errorf("Create = %v, want the connection error", err)
+	}
+	if got := backend.calls.Load(); got != 1 {
+		t.Errorf("Create made %d calls, want 1", got)
+	}
+
+	// Neither is a domain error worth a second try.
+	backend.calls.Store(0)
+	backend.failFirst.Store(0)
+	if _, err := store.GetByID(ctx, "missing"); !errors.Is(err, errAlbumNotFound) {
+		t.Errorf("GetByID = %v, want errAlbumNotFound", err)
+	}
+	if got := backend.calls.Load(); got != 1 {
+		t.Errorf("GetByID of a missing album made %d calls, want 1", got)
+	}
+
+	// Nor is a read the caller has given up on.
+	backend.calls.Store(0)
+	backend.failFirst.Store(10)
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := store.List(canceled, ListOptions{}); err == nil {
+		t.Error("List with a canceled context succeeded")
+	}
+	if got := backend.calls.Load(); got != 1 {
+		t.Errorf("List with a canceled context made %d calls, want 1", got)
+	}
+}
+
+func TestRetryingAlbumStoreBudget(t *testing.T) {
+	backend := newFaultyAlbumStore()
+	backend.failing.Store(true)
+	policy := retryPolicy{attempts: 100, baseDelay: 20 * time.Millisecond, maxDelay: 20 * time.Millisecond, budget: 50 * time.Millisecond}
+	start := time.Now()
+	if _, err := NewRetryingAlbumStore(backend, policy).List(context.Background(), ListOptions{}); err == nil {
+		t.Fatal("List against a dead store succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("List retried for %v, past its 50ms budget", elapsed)
+	}
+	if got := backend.calls.Load(); got >= 100 {
+		t.Errorf("List made %d calls within its budget", got)
+	}
+}
+
+func TestIsTransientStoreError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want bool
+	}{
+		{errConnectionRefused, true},
+		{context.DeadlineExceeded, true},
+		{errAlbumNotFound, false},
+		{context.Canceled, false},
+		{errors.New("syntax error at or near \"SELCT\""), false},
+	} {
+		if got := isTransientStoreError(tc.err); got != tc.want {
+			t.Errorf("isTransientStoreError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+func TestMethodsTable(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(r.Method)) }
+	m := methods{http.MethodGet: ok, http.MethodPost: ok}
+
+	for _, tc := range []struct {
+		method string
+		status int
+		allow  string
+	}{
+		{http.MethodGet, http.StatusOK, ""},
+		{http.MethodPost, http.StatusOK, ""},
+		{http.MethodOptions, http.StatusNoContent, "GET, OPTIONS, POST"},
+		{http.MethodDelete, http.StatusMethodNotAllowed, "GET, OPTIONS, POST"},
+	} {
+		w := httptest.NewRecorder()
+		m.ServeHTTP(w, httptest.NewRequest(tc.method, "/things", nil))
+		if w.Code != tc.status || w.Header().Get("Allow") != tc.allow {
+			t.Errorf("%s: %d with Allow %q, want %d with %q", tc.method, w.Code, w.Header().Get("Allow"), tc.status, tc.allow)
+		}
+		if tc.status == http.StatusOK && w.Body.String() != tc.method {
+			t.Errorf("%s reached the %s handler", tc.method, w.Body)
+		}
+	}
+
+	// A route that handles OPTIONS itself lists it once.
+	m[http.MethodOptions] = ok
+	if got := m.allow(); got != "GET, OPTIONS, POST" {
+		t.Errorf("allow = %q", got)
+	}
+}
+
+// TestRoutesCheckBeforeMethod pins what the move to path patterns kept: the
+// route's own checks run before the method is, so a route that is switched
+// off or needs the admin token doesn't give itself away with a 405.
+func TestRoutesCheckBeforeMethod(t *testing.T) {
+	s := newTestServer(t)
+	useFeatures(t, fakeFeatures{})
+
+	expectProblem(t, s.do(http.MethodDelete, "/albums/feed", ""), http.StatusNotFound)
+	expectProblem(t, s.do(http.MethodDelete, "/admin/features", ""), http.StatusUnauthorized)
+	expectProblem(t, s.admin(http.MethodDelete, "/admin/features", ""), http.StatusMethodNotAllowed)
+
+	// Extra segments after an album ID are a lookup of an album that
+	// doesn't exist, not an unknown route.
+	a := s.create(newTestAlbum())
+	p := expectProblem(t, s.do(http.MethodGet, "/albums/"+a.ID+"/tracks", ""), http.StatusNotFound)
+	if p.Instance != "/albums/"+a.ID+"/tracks" {
+		t.Errorf("instance = %q", p.Instance)
+	}
+}
+
+func TestOptionsAllow(t *testing.T) {
+	s := newTestServer(t)
+	a := s.create(newTestAlbum())
+
+	for path, allow := range map[string]string{
+		"/albums":         "GET, OPTIONS, POST, PUT",
+		"/albums/" + a.ID: "GET, OPTIONS, PATCH, PUT",
+		"/metrics":        "GET, OPTIONS",
+	} {
+		w := s.do(http.MethodOptions, path, "")
+		if w.Code != http.StatusNoContent || w.Header().Get("Allow") != allow {
+			t.Errorf("OPTIONS %s: %d with Allow %q, want 204 with %q", path, w.Code, w.Header().Get("Allow"), allow)
+		}
+		w = s.do(http.MethodDelete, path, "")
+		expectProblem(t, w, http.StatusMethodNotAllowed)
+		if w.Header().Get("Allow") != allow {
+			t.Errorf("DELETE %s: Allow %q, want %q", path, w.Header().Get("Allow"), allow)
+		}
+	}
+
+	// With CORS on, a preflight is answered by the CORS middleware, and a
+	// plain OPTIONS from the same origin still reaches the route.
+	cors := *s.cfg
+	cors.CORSAllowedOrigins = "https://shop.example"
+	liveConfig.Store(&cors)
+	w := s.do(http.MethodOptions, "/albums", "", "Origin", "https://shop.example", "Access-Control-Request-Method", "POST")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Methods") == "" || w.Header().Get("Allow") != "" {
+		t.Errorf("preflight of /albums: %d with headers %v, want the CORS answer", w.Code, w.Header())
+	}
+	w = s.do(http.MethodOptions, "/albums", "", "Origin", "https://shop.example")
+	if w.Code != http.StatusNoContent || w.Header().Get("Allow") != "GET, OPTIONS, POST, PUT" || w.Header().Get("Access-Control-Allow-Origin") != "https://shop.example" {
+		t.Errorf("OPTIONS /albums from an allowed origin: %d with headers %v", w.Code, w.Header())
+	}
+}
+
+func TestResourceURL(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/albums", nil)
+	for _, tc := range []struct {
+		pattern string
+		values  []string
+		want    string
+	}{
+		{albumRoute, []string{"abc"}, "http://example.com/albums/abc"},
+		{albumRoute, []string{"a b/c?"}, "http://example.com/albums/a%20b%2Fc%3F"},
+		{apiKeyRoute, []string{"k1"}, "http://example.com/admin/apikeys/k1"},
+		{jobsRoute, nil, "http://example.com/admin/jobs"},
+	} {
+		if got := resourceURL(req, tc.pattern, tc.values...); got != tc.want {
+			t.Errorf("%s %v: %s, want %s", tc.pattern, tc.values, got, tc.want)
+		}
+	}
+}
+
+// locationPath is the path of w's Location, which should be an absolute URL
+// on the test server.
+func locationPath(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	u, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || u.Scheme != "http" || u.Host != "example.com" {
+		t.Fatalf("Location %q, want an absolute URL", w.Header().Get("Location"))
+	}
+	return u.Path
+}
+
+func TestCreateLocation(t *testing.T) {
+	s := newTestServer(t)
+
+	w := s.do(http.MethodPost, "/albums", albumJSON(newTestAlbum()))
+	created := decodeBody[album](t, w)
+	if path := locationPath(t, w); path != "/albums/"+created.ID {
+		t.Errorf("album Location %s", path)
+	}
+	if got := decodeBody[album](t, s.do(http.MethodGet, locationPath(t, w), "")); got.ID != created.ID || got.Title != created.Title {
+		t.Errorf("GET of the album's Location = %+v, want %+v", got, created)
+	}
+
+	w = s.admin(http.MethodPost, "/admin/apikeys", `{"name": "ci"}`)
+	key := decodeBody[types.APIKey](t, w)
+	if w.Code != http.StatusCreated {
+		t.Errorf("POST /admin/apikeys = %d", w.Code)
+	}
+	if got := decodeBody[types.APIKey](t, s.admin(http.MethodGet, locationPath(t, w), "")); got.ID != key.ID || got.Name != "ci" {
+		t.Errorf("GET of the key's Location = %+v, want %+v", got, key)
+	}
+	expectStatus(t, s.admin(http.MethodDelete, locationPath(t, w), ""), http.StatusNoContent)
+
+	w = s.do(http.MethodPost, "/albums/import?async=true", "title,artist,price\nGiant Steps,John Coltrane,9.99\n")
+	job := decodeBody[importJob](t, w)
+	if got := decodeBody[importJob](t, s.do(http.MethodGet, locationPath(t, w), "")); got.ID != job.ID {
+		t.Errorf("GET of the import's Location = %+v, want job %s", got, job.ID)
+	}
+	imports.wait()
+
+	// A batch has no one URL to point at.
+	w = s.do(http.MethodPost, "/albums", "["+strings.Join([]string{albumJSON(newTestAlbum(withTitle("Lush Life"))), albumJSON(newTestAlbum(withTitle("Ballads")))}, ",")+"]")
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "" {
+		t.Errorf("batch create = %d with Location %q", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/jackc/pgx/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var errSavedSearchNotFound = newCategorizedError(errNotFound, "saved search not found")
+
+// savedSearchStore is implemented by album stores that keep the saved
+// searches of POST /searches next to the albums, so every instance runs the
+// same ones. A saved search is never changed, only deleted.
+type savedSearchStore interface {
+	CreateSavedSearch(ctx context.Context, s savedSearch) error
+	// GetSavedSearch returns errSavedSearchNotFound for an unknown id.
+	GetSavedSearch(ctx context.Context, id string) (savedSearch, error)
+	// ListSavedSearches returns the searches owner saved, oldest first.
+	ListSavedSearches(ctx context.Context, owner string) ([]savedSearch, error)
+	// DeleteSavedSearch returns errSavedSearchNotFound for an unknown id.
+	DeleteSavedSearch(ctx context.Context, id string) error
+}
+
+func sortSavedSearches(list []savedSearch) {
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+}
+
+// savedSearchDefinition is how the stores keep what a saved search runs:
+// a JSON object with its search body or its filter parameters.
+type savedSearchDefinition struct {
+	Search json.RawMessage   `json:"search,omitempty"`
+	Params map[string]string `json:"params,omitempty"`
+}
+
+func (s savedSearch) definition() (string, error) {
+	b, err := json.Marshal(savedSearchDefinition{Search: s.Search, Params: s.Params})
+	return string(b), err
+}
+
+func (s *savedSearch) setDefinition(raw string) error {
+	var def savedSearchDefinition
+	if err := json.Unmarshal([]byte(raw), &def); err != nil {
+		return err
+	}
+	s.Search, s.Params = def.Search, def.Params
+	return nil
+}
+
+func (store *InMemoryAlbumStore) CreateSavedSearch(ctx context.Context, s savedSearch) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.savedSearches[s.ID] = s
+	return nil
+}
+
+func (store *InMemoryAlbumStore) GetSavedSearch(ctx context.Context, id string) (savedSearch, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	s, ok := store.savedSearches[id]
+	if !ok {
+		return savedSearch{}, errSavedSearchNotFound
+	}
+	return s, nil
+}
+
+func (store *InMemoryAlbumStore) ListSavedSearches(ctx context.Context, owner string) ([]savedSearch, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+	var list []savedSearch
+	for _, s := range store.savedSearches {
+		if s.Owner == owner {
+			list = append(list, s)
+		}
+	}
+	sortSavedSearches(list)
+	return list, nil
+}
+
+func (store *InMemoryAlbumStore) DeleteSavedSearch(ctx context.Context, id string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if _, ok := store.savedSearches[id]; !ok {
+		return errSavedSearchNotFound
+	}
+	delete(store.savedSearches, id)
+	return nil
+}
+
+const sqlSavedSearchColumns = `id, name, owner, shared, definition, created_at`
+
+// scanSQLSavedSearch reads a row of sqlSavedSearchColumns.
+func scanSQLSavedSearch(scan func(dest ...interface{}) error) (savedSearch, error) {
+	var s savedSearch
+	var def string
+	if err := scan(&s.ID, &s.Name, &s.Owner, &s.Shared, &def, &s.CreatedAt); err != nil {
+		return savedSearch{}, err
+	}
+	s.CreatedAt = s.CreatedAt.UTC()
+	return s, s.setDefinition(def)
+}
+
+func (store *PostgresAlbumStore) CreateSavedSearch(ctx context.Context, s savedSearch) error {
+	def, err := s.definition()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	_, err = store.db.Exec(ctx, `INSERT INTO saved_searches (`+sqlSavedSearchColumns+`) VALUES ($1, $2, $3, $4, $5, $6)`,
+		s.ID, s.Name, s.Owner, s.Shared, def, s.CreatedAt)
+	return err
+}
+
+func (store *PostgresAlbumStore) GetSavedSearch(ctx context.Context, id string) (savedSearch, error) {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	s, err := scanSQLSavedSearch(store.db.QueryRow(ctx, `SELECT `+sqlSavedSearchColumns+` FROM saved_searches WHERE id = $1`, id).Scan)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return savedSearch{}, errSavedSearchNotFound
+	}
+	return s, err
+}
+
+func (store *PostgresAlbumStore) ListSavedSearches(ctx context.Context, owner string) ([]savedSearch, error) {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	rows, err := store.db.Query(ctx, `SELECT `+sqlSavedSearchColumns+` FROM saved_searches WHERE owner = $1 ORDER BY created_at`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []savedSearch
+	for rows.Next() {
+		s, err := scanSQLSavedSearch(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+func (store *PostgresAlbumStore) DeleteSavedSearch(ctx context.Context, id string) error {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	tag, err := store.db.Exec(ctx, `DELETE FROM saved_searches WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errSavedSearchNotFound
+	}
+	return nil
+}
+
+func (store *SqliteAlbumStore) CreateSavedSearch(ctx context.Context, s savedSearch) error {
+	def, err := s.definition()
+	if err != nil {
+		return err
+	}
+	return store.db.WithContext(ctx).Exec(`INSERT INTO saved_searches (`+sqlSavedSearchColumns+`) VALUES (?, ?, ?, ?, ?, ?)`,
+		s.ID, s.Name, s.Owner, s.Shared, def, s.CreatedAt).Error
+}
+
+func (store *SqliteAlbumStore) GetSavedSearch(ctx context.Context, id string) (savedSearch, error) {
+	s, err := scanSQLSavedSearch(store.db.WithContext(ctx).Raw(`SELECT `+sqlSavedSearchColumns+` FROM saved_searches WHERE id = ?`, id).Row().Scan)
+	if errors.Is(err, sql.ErrNoRows) {
+		return savedSearch{}, errSavedSearchNotFound
+	}
+	return s, err
+}
+
+func (store *SqliteAlbumStore) ListSavedSearches(ctx context.Context, owner string) ([]savedSearch, error) {
+	rows, err := store.db.WithContext(ctx).Raw(`SELECT `+sqlSavedSearchColumns+` FROM saved_searches WHERE owner = ? ORDER BY created_at`, owner).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var list []savedSearch
+	for rows.Next() {
+		s, err := scanSQLSavedSearch(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
+
+func (store *SqliteAlbumStore) DeleteSavedSearch(ctx context.Context, id string) error {
+	res := store.db.WithContext(ctx).Exec(`DELETE FROM saved_searches WHERE id = ?`, id)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return errSavedSearchNotFound
+	}
+	return nil
+}
+
+// mongoSavedSearch is a saved search as stored in the savedSearches
+// collection, with the ID as _id.
+type mongoSavedSearch struct {
+	ID         string    `bson:"_id"`
+	Name       string    `bson:"name"`
+	Owner      string    `bson:"owner"`
+	Shared     bool      `bson:"shared"`
+	Definition string    `bson:"definition"`
+	CreatedAt  time.Time `bson:"createdAt"`
+}
+
+func (doc mongoSavedSearch) savedSearch() (savedSearch, error) {
+	s := savedSearch{ID: doc.ID, Name: doc.Name, Owner: doc.Owner, Shared: doc.Shared, CreatedAt: doc.CreatedAt.UTC()}
+	return s, s.setDefinition(doc.Definition)
+}
+
+func (store *MongoAlbumStore) CreateSavedSearch(ctx context.Context, s savedSearch) error {
+	def, err := s.definition()
+	if err != nil {
+		return err
+	}
+	_, err = store.savedSearches.InsertOne(ctx, mongoSavedSearch{ID: s.ID, Name: s.Name, Owner: s.Owner, Shared: s.Shared, Definition: def, CreatedAt: s.CreatedAt})
+	return err
+}
+
+func (store *MongoAlbumStore) GetSavedSearch(ctx context.Context, id string) (savedSearch, error) {
+	var doc mongoSavedSearch
+	err := store.savedSearches.FindOne(ctx, bson.D{{Key: "_id", Value: id}}).Decode(&doc)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return savedSearch{}, errSavedSearchNotFound
+	}
+	if err != nil {
+		return savedSearch{}, err
+	}
+	return doc.savedSearch()
+}
+
+func (store *MongoAlbumStore) ListSavedSearches(ctx context.Context, owner string) ([]savedSearch, error) {
+	cur, err := store.savedSearches.Find(ctx, bson.D{{Key: "owner", Value: owner}}, options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	var docs []mongoSavedSearch
+	if err := cur.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	list := make([]savedSearch, len(docs))
+	for i, doc := range docs {
+		if list[i], err = doc.savedSearch(); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func (store *MongoAlbumStore) DeleteSavedSearch(ctx context.Context, id string) error {
+	res, err := store.savedSearches.DeleteOne(ctx, bson.D{{Key: "_id", Value: id}})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return errSavedSearchNotFound
+	}
+	return nil
+}
+
+const dynamoSavedSearchesTable = "savedSearches"
+
+// dynamoSavedSearch is a saved search as stored in the savedSearches table,
+// keyed by id.
+type dynamoSavedSearch struct {
+	ID         string    `dynamodbav:"id"`
+	Name       string    `dynamodbav:"name"`
+	Owner      string    `dynamodbav:"owner"`
+	Shared     bool      `dynamodbav:"shared"`
+	Definition string    `dynamodbav:"definition"`
+	CreatedAt  time.Time `dynamodbav:"createdAt"`
+}
+
+func (item dynamoSavedSearch) savedSearch() (savedSearch, error) {
+	s := savedSearch{ID: item.ID, Name: item.Name, Owner: item.Owner, Shared: item.Shared, CreatedAt: item.CreatedAt.UTC()}
+	return s, s.setDefinition(item.Definition)
+}
+
+func (store *DynamoAlbumStore) CreateSavedSearch(ctx context.Context, s savedSearch) error {
+	def, err := s.definition()
+	if err != nil {
+		return err
+	}
+	av, err := attributevalue.MarshalMap(dynamoSavedSearch{ID: s.ID, Name: s.Name, Owner: s.Owner, Shared: s.Shared, Definition: def, CreatedAt: s.CreatedAt})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	_, err = store.client.PutItem(ctx, &dynamodb.PutItemInput{TableName: aws.String(dynamoSavedSearchesTable), Item: av})
+	return err
+}
+
+func (store *DynamoAlbumStore) GetSavedSearch(ctx context.Context, id string) (savedSearch, error) {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	res, err := store.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(dynamoSavedSearchesTable),
+		Key:            map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return savedSearch{}, err
+	}
+	if res.Item == nil {
+		return savedSearch{}, errSavedSearchNotFound
+	}
+	var item dynamoSavedSearch
+	if err := attributevalue.UnmarshalMap(res.Item, &item); err != nil {
+		return savedSearch{}, err
+	}
+	return item.savedSearch()
+}
+
+// ListSavedSearches scans the table for the owner's searches. There are few
+// enough saved searches that an index on the owner isn't worth keeping.
+func (store *DynamoAlbumStore) ListSavedSearches(ctx context.Context, owner string) ([]savedSearch, error) {
+	var list []savedSearch
+	pages := dynamodb.NewScanPaginator(store.client, &dynamodb.ScanInput{
+		TableName:                 aws.String(dynamoSavedSearchesTable),
+		FilterExpression:          aws.String("#owner = :owner"),
+		ExpressionAttributeNames:  map[string]string{"#owner": "owner"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{":owner": &types.AttributeValueMemberS{Value: owner}},
+		ConsistentRead:            aws.Bool(true),
+	})
+	for pages.HasMorePages() {
+		opCtx, cancel := store.opContext(ctx)
+		page, err := pages.NextPage(opCtx)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		var items []dynamoSavedSearch
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			return nil, err
+		}
+		for _, item := range items {
+			s, err := item.savedSearch()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, s)
+		}
+	}
+	sortSavedSearches(list)
+	return list, nil
+}
+
+func (store *DynamoAlbumStore) DeleteSavedSearch(ctx context.Context, id string) error {
+	ctx, cancel := store.opContext(ctx)
+	defer cancel()
+	_, err := store.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(dynamoSavedSearchesTable),
+		Key:                 map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	})
+	var failed *types.ConditionalCheckFailedException
+	if errors.As(err, &failed) {
+		return errSavedSearchNotFound
+	}
+	return err
+}
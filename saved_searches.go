@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"github.com/brentmzey/web-service-go/types"
+	"github.com/google/uuid"
+)
+
+const (
+	savedSearchRoute = "/searches/{searchId}"
+
+	maxSavedSearchName = 100
+)
+
+var (
+	errSavedSearchesUnsupported = errors.New("the configured store does not keep saved searches")
+	errSavedSearchPrincipal     = errors.New("saved searches need an API key or a client certificate")
+	errSavedSearchNotOwner      = errors.New("only its owner may delete a saved search")
+)
+
+// savedSearch is a search saved by POST /searches. It runs either Search,
+// a search body without limit and offset, or Params, the filter parameters
+// of GET /albums, both kept as they were sent: they are parsed each time the
+// search runs, against the fields of the day.
+type savedSearch struct {
+	ID        string
+	Name      string
+	Owner     string // the requestPrincipal that saved it
+	Shared    bool
+	Search    json.RawMessage
+	Params    map[string]string
+	CreatedAt time.Time
+}
+
+func (s savedSearch) apiSavedSearch() types.SavedSearch {
+	return types.SavedSearch{ID: s.ID, Name: s.Name, Owner: s.Owner, Shared: s.Shared, Search: s.Search, Params: s.Params, CreatedAt: s.CreatedAt}
+}
+
+// visibleTo reports whether principal may see and run s.
+func (s savedSearch) visibleTo(principal string) bool {
+	return s.Shared || s.Owner == principal
+}
+
+// compile parses what s runs. A saved search that parsed when it was saved
+// fails here once a field or operator it uses is gone. The pointer of a
+// searchError is into the saved search, as on POST /searches.
+func (s savedSearch) compile() (searchRequest, AlbumFilter, error) {
+	if len(s.Params) > 0 {
+		filter, err := parseSavedSearchParams(s.Params)
+		return searchRequest{}, filter, err
+	}
+	req, err := parseSavedSearchBody(s.Search)
+	return req, AlbumFilter{}, err
+}
+
+// parseSavedSearchBody parses the search of a saved search. Its page is
+// chosen each time it runs, so it has no limit or offset.
+func parseSavedSearchBody(raw json.RawMessage) (searchRequest, error) {
+	members, ok := searchMembers(raw)
+	if !ok {
+		return searchRequest{}, &searchError{"/search", "the search must be a JSON object"}
+	}
+	for _, name := range slices.Sorted(maps.Keys(members)) {
+		if name != "query" && name != "sort" {
+			return searchRequest{}, &searchError{searchPointer("/search", name), "a saved search may only have query and sort"}
+		}
+	}
+	req, err := parseSearch(raw, 1, 1)
+	var bad *searchError
+	if errors.As(err, &bad) {
+		return searchRequest{}, &searchError{"/search" + bad.pointer, bad.detail}
+	}
+	return req, err
+}
+
+// savedSearchParams are the GET /albums parameters a saved search may
+// have, besides the metadata.<key> filters.
+var savedSearchParams = []string{"artist", "genre", "minPrice", "maxPrice", "q"}
+
+// parseSavedSearchParams parses the filter parameters of a saved search.
+// includeUnavailable isn't one: it is up to whoever runs the search.
+func parseSavedSearchParams(params map[string]string) (AlbumFilter, error) {
+	q := url.Values{}
+	for name, value := range params {
+		if !slices.Contains(savedSearchParams, name) && !strings.HasPrefix(name, "metadata.") {
+			return AlbumFilter{}, errors.New("params may only have artist, genre, minPrice, maxPrice, q, and metadata.<key>")
+		}
+		q.Set(name, value)
+	}
+	return parseFilterParams(q)
+}
+
+func savedSearchesOf(store AlbumStore) (savedSearchStore, error) {
+	searches, ok := store.(savedSearchStore)
+	if !ok {
+		return nil, errSavedSearchesUnsupported
+	}
+	return searches, nil
+}
+
+// savedSearchHandler is a handler of the saved searches kept by the album
+// store.
+type savedSearchHandler func(w http.ResponseWriter, r *http.Request, searches savedSearchStore)
+
+// withSavedSearches hands the album store's saved searches to next, or
+// answers 501 for a store that doesn't keep them.
+func withSavedSearches(next savedSearchHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		searches, err := savedSearchesOf(albumStore)
+		if err != nil {
+			writeProblem(w, r, http.StatusNotImplemented, err.Error())
+			log.Printf("🚧 %s %s but the album store doesn't keep saved searches", r.Method, r.URL.Path)
+			return
+		}
+		next(w, r, searches)
+	}
+}
+
+// searchOwner is the principal that saves and lists the searches of r, or
+// "" after answering 403 to an anonymous request.
+func searchOwner(w http.ResponseWriter, r *http.Request) string {
+	principal := requestPrincipal(r)
+	if principal == principalAnonymous {
+		writeProblem(w, r, http.StatusForbidden, errSavedSearchPrincipal.Error())
+		log.Printf("🔒 Rejected an anonymous %s %s", r.Method, r.URL.Path)
+		return ""
+	}
+	return principal
+}
+
+// savedSearchBody is the body of POST /searches.
+type savedSearchBody struct {
+	Name   string            `json:"name"`
+	Shared bool              `json:"shared"`
+	Search json.RawMessage   `json:"search"`
+	Params map[string]string `json:"params"`
+}
+
+// postSearches saves a search for the caller, after checking that it parses
+// as it would run now.
+func postSearches(w http.ResponseWriter, r *http.Request, searches savedSearchStore) {
+	owner := searchOwner(w, r)
+	if owner == "" {
+		return
+	}
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	var body savedSearchBody
+	if err := json.Unmarshal(raw, &body); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "invalid JSON body")
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	body.Name = strings.TrimSpace(body.Name)
+	var detail string
+	switch {
+	case body.Name == "" || utf8.RuneCountInString(body.Name) > maxSavedSearchName:
+		detail = "name must be 1 to 100 characters"
+	case isJSONNull(body.Search) == (len(body.Params) == 0):
+		detail = "a saved search must have exactly one of search and params"
+	}
+	if detail != "" {
+		writeProblem(w, r, http.StatusBadRequest, detail)
+		log.Println("📉 Bad request:", detail)
+		return
+	}
+	s := savedSearch{
+		ID:        uuid.New().String(),
+		Name:      body.Name,
+		Owner:     owner,
+		Shared:    body.Shared,
+		CreatedAt: time.Now().UTC(),
+	}
+	if len(body.Params) > 0 {
+		s.Params = body.Params
+	} else {
+		s.Search = body.Search
+	}
+	if _, _, err := s.compile(); err != nil {
+		var bad *searchError
+		if errors.As(err, &bad) {
+			writeSearchProblem(w, r, bad)
+			return
+		}
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	if err := searches.CreateSavedSearch(r.Context(), s); err != nil {
+		respondError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", resourceURL(r, savedSearchRoute, s.ID))
+	writeJSON(w, http.StatusCreated, s.apiSavedSearch())
+	log.Printf("🔖 Saved search %q for %s", s.Name, owner)
+}
+
+// getSearches lists the searches the caller saved, shared or not, oldest
+// first.
+func getSearches(w http.ResponseWriter, r *http.Request, searches savedSearchStore) {
+	owner := searchOwner(w, r)
+	if owner == "" {
+		return
+	}
+	list, err := searches.ListSavedSearches(r.Context(), owner)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	body := make([]types.SavedSearch, len(list))
+	for i, s := range list {
+		body[i] = s.apiSavedSearch()
+	}
+	w.Header().Set("Cache-Control", privateCacheControl)
+	writeJSON(w, http.StatusOK, body)
+}
+
+// visibleSavedSearch looks up the saved search of r's path, which r's
+// principal must be allowed to see. Another's private search is
+// errSavedSearchNotFound, so as not to tell that it exists.
+func visibleSavedSearch(r *http.Request, searches savedSearchStore) (savedSearch, error) {
+	s, err := searches.GetSavedSearch(r.Context(), r.PathValue("searchId"))
+	if err != nil {
+		return savedSearch{}, err
+	}
+	if !s.visibleTo(requestPrincipal(r)) {
+		return savedSearch{}, errSavedSearchNotFound
+	}
+	return s, nil
+}
+
+func getSavedSearch(w http.ResponseWriter, r *http.Request, searches savedSearchStore) {
+	s, err := visibleSavedSearch(r, searches)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	if !s.Shared {
+		w.Header().Set("Cache-Control", privateCacheControl)
+	}
+	writeJSON(w, http.StatusOK, s.apiSavedSearch())
+}
+
+// deleteSavedSearch removes a saved search. Only its owner may; anyone else
+// may at most run a shared one.
+func deleteSavedSearch(w http.ResponseWriter, r *http.Request, searches savedSearchStore) {
+	s, err := visibleSavedSearch(r, searches)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	if s.Owner != requestPrincipal(r) {
+		writeProblem(w, r, http.StatusForbidden, errSavedSearchNotOwner.Error())
+		log.Printf("🔒 Rejected deleting saved search %s by someone other than %s", s.ID, s.Owner)
+		return
+	}
+	if err := searches.DeleteSavedSearch(r.Context(), s.ID); err != nil {
+		respondError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+	log.Printf("🔖 Deleted saved search %q of %s", s.Name, s.Owner)
+}
+
+// getSavedSearchResults runs a saved search against the catalog as it is
+// now, answering one page as POST /albums/search does. The limit and offset
+// come from the query string, as do includeUnavailable and its rules. A
+// search that no longer parses is 409.
+func getSavedSearchResults(w http.ResponseWriter, r *http.Request, searches savedSearchStore) {
+	s, err := visibleSavedSearch(r, searches)
+	if err != nil {
+		respondError(w, r, err)
+		return
+	}
+	req, filter, err := s.compile()
+	if err != nil {
+		writeStaleSearchProblem(w, r, s, err)
+		return
+	}
+	include, err := includeUnavailable(r)
+	if err != nil {
+		writeFilterProblem(w, r, err)
+		return
+	}
+	cfg := currentConfig()
+	limit, offset, clamped, err := parseListPage(r, cfg.AlbumsPageSize, cfg.AlbumsMaxPageSize)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	if clamped {
+		w.Header().Set("X-Limit-Clamped", strconv.Itoa(limit))
+	}
+	if !include {
+		filter.AvailableAt = availabilityNow()
+	}
+	filter.Collation = requestCollation(r)
+	varyCollation(w)
+	if abandoned(r) {
+		return
+	}
+	var list []album
+	if len(s.Params) > 0 {
+		list, err = listAll(r.Context(), albumStore, filter)
+	} else {
+		list, err = storeSearch(r.Context(), albumStore, req.query)
+		if !include {
+			list = availableAlbums(list, filter.AvailableAt)
+		}
+	}
+	if err = acceptStale(w, err); err != nil {
+		respondError(w, r, err)
+		return
+	}
+	if abandoned(r) {
+		return
+	}
+	atomic.AddInt64(&metrics.TotalAlbumsFetched, 1)
+	sortSearchResults(list, req.sort, filter.Collation)
+	total := len(list)
+	page := list[min(offset, total):min(offset+limit, total)]
+	if n, fits := fitPage(page, cfg.ResponseMaxBytes, 2); !fits {
+		var ok bool
+		if limit, ok = cutPage(w, r, cfg, n, len(page)); !ok {
+			return
+		}
+		page = page[:limit]
+	}
+	if !s.Shared || include {
+		w.Header().Set("Cache-Control", privateCacheControl)
+	}
+	writeJSON(w, http.StatusOK, types.SearchResult{Albums: page, Total: total, Limit: limit, Offset: offset})
+	log.Printf("🔖 Ran saved search %q: %d of %d albums", s.Name, len(page), total)
+}
+
+// writeStaleSearchProblem answers 409 for a saved search that no longer
+// parses, with the reason and, for a search body, where it fails.
+func writeStaleSearchProblem(w http.ResponseWriter, r *http.Request, s savedSearch, err error) {
+	log.Printf("⚔️ Saved search %s no longer parses: %v", s.ID, err)
+	p := problem{Type: types.ProblemStaleSearch, Title: http.StatusText(http.StatusConflict), Status: http.StatusConflict,
+		Detail: err.Error(), Instance: r.URL.Path}
+	var bad *searchError
+	if errors.As(err, &bad) {
+		p.Detail, p.Pointer = bad.detail, bad.pointer
+	}
+	writeLocalizedDetail(w, r, &p)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSONAs(w, http.StatusConflict, "application/problem+json", p)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// saveSearch saves a search with the key's secret, and returns it.
+func saveSearch(t *testing.T, s *testServer, secret, body string) types.SavedSearch {
+	t.Helper()
+	w := s.do(http.MethodPost, "/searches", body, "Authorization", "Bearer "+secret)
+	expectStatus(t, w, http.StatusCreated)
+	return decodeBody[types.SavedSearch](t, w)
+}
+
+func TestSavedSearchOwnership(t *testing.T) {
+	s := newTestServer(t)
+	alice, bob := newTestAPIKey(t, s, tierFree), newTestAPIKey(t, s, tierFree)
+	as := func(key types.APIKey) []string { return []string{"Authorization", "Bearer " + key.Secret} }
+	s.create(newTestAlbum())
+
+	private := saveSearch(t, s, alice.Secret, `{"name": "Coltrane", "params": {"artist": "John Coltrane"}}`)
+	shared := saveSearch(t, s, alice.Secret, `{"name": "Cheap", "shared": true, "search": {"query": {"field": "price", "op": "lt", "value": 100}}}`)
+	if private.Owner != "key:"+alice.ID || private.Shared || shared.Params != nil {
+		t.Errorf("saved %+v and %+v", private, shared)
+	}
+
+	// Alice runs both, and lists them.
+	for _, id := range []string{private.ID, shared.ID} {
+		w := s.do(http.MethodGet, "/searches/"+id+"/results", "", as(alice)...)
+		expectStatus(t, w, http.StatusOK)
+		if res := decodeBody[types.SearchResult](t, w); res.Total != 1 {
+			t.Errorf("search %s found %d albums", id, res.Total)
+		}
+	}
+	if list := decodeBody[[]types.SavedSearch](t, s.do(http.MethodGet, "/searches", "", as(alice)...)); len(list) != 2 || list[0].ID != private.ID {
+		t.Errorf("Alice's searches %+v", list)
+	}
+
+	// Bob can't see Alice's private search, or tell it exists, and lists
+	// none of hers.
+	for _, path := range []string{"/searches/" + private.ID, "/searches/" + private.ID + "/results"} {
+		expectProblem(t, s.do(http.MethodGet, path, "", as(bob)...), http.StatusNotFound)
+		expectProblem(t, s.do(http.MethodGet, path, ""), http.StatusNotFound)
+	}
+	expectProblem(t, s.do(http.MethodDelete, "/searches/"+private.ID, "", as(bob)...), http.StatusNotFound)
+	if list := decodeBody[[]types.SavedSearch](t, s.do(http.MethodGet, "/searches", "", as(bob)...)); len(list) != 0 {
+		t.Errorf("Bob's searches %+v", list)
+	}
+
+	// He may run the shared one, but not delete it.
+	w := s.do(http.MethodGet, "/searches/"+shared.ID+"/results", "", as(bob)...)
+	expectStatus(t, w, http.StatusOK)
+	if got := w.Header().Get("Cache-Control"); got == privateCacheControl {
+		t.Errorf("a shared search's results are %q", got)
+	}
+	expectProblem(t, s.do(http.MethodDelete, "/searches/"+shared.ID, "", as(bob)...), http.StatusForbidden)
+
+	// An anonymous caller can't save or list searches.
+	expectProblem(t, s.do(http.MethodPost, "/searches", `{"name": "x", "params": {"artist": "x"}}`), http.StatusForbidden)
+	expectProblem(t, s.do(http.MethodGet, "/searches", ""), http.StatusForbidden)
+
+	expectStatus(t, s.do(http.MethodDelete, "/searches/"+private.ID, "", as(alice)...), http.StatusNoContent)
+	expectProblem(t, s.do(http.MethodGet, "/searches/"+private.ID+"/results", "", as(alice)...), http.StatusNotFound)
+}
+
+func TestSavedSearchValidation(t *testing.T) {
+	s := newTestServer(t)
+	key := newTestAPIKey(t, s, tierFree)
+	for _, tc := range []struct {
+		body, pointer string
+	}{
+		{`{"name": "", "params": {"artist": "x"}}`, ""},
+		{`{"name": "both", "params": {"artist": "x"}, "search": {}}`, ""},
+		{`{"name": "neither"}`, ""},
+		{`{"name": "unknown param", "params": {"label": "x"}}`, ""},
+		{`{"name": "bad price", "params": {"minPrice": "cheap"}}`, ""},
+		{`{"name": "paged", "search": {"limit": 10}}`, "/search/limit"},
+		{`{"name": "unknown field", "search": {"query": {"field": "label", "op": "eq", "value": "x"}}}`, "/search/query/field"},
+	} {
+		p := expectProblem(t, s.do(http.MethodPost, "/searches", tc.body, "Authorization", "Bearer "+key.Secret), http.StatusBadRequest)
+		if p.Pointer != tc.pointer {
+			t.Errorf("%s: pointer %q, want %q", tc.body, p.Pointer, tc.pointer)
+		}
+	}
+}
+
+func TestSavedSearchResultsPaging(t *testing.T) {
+	s := newTestServer(t)
+	key := newTestAPIKey(t, s, tierFree)
+	for _, title := range []string{"Blue Train", "Giant Steps", "Lush Life"} {
+		s.create(newTestAlbum(withTitle(title)))
+	}
+	s.create(newTestAlbum(withTitle("Kind of Blue"), withArtist("Miles Davis")))
+	saved := saveSearch(t, s, key.Secret, `{"name": "Coltrane", "search": {"query": {"field": "artist", "op": "eq", "value": "John Coltrane"}, "sort": [{"field": "title", "order": "desc"}]}}`)
+
+	w := s.do(http.MethodGet, "/searches/"+saved.ID+"/results?limit=2&offset=1", "", "Authorization", "Bearer "+key.Secret)
+	expectStatus(t, w, http.StatusOK)
+	res := decodeBody[types.SearchResult](t, w)
+	if res.Total != 3 || res.Limit != 2 || res.Offset != 1 || len(res.Albums) != 2 || res.Albums[0].Title != "Giant Steps" || res.Albums[1].Title != "Blue Train" {
+		t.Errorf("the second page: %+v", res)
+	}
+	// The results are of the catalog as it is when the search runs.
+	s.create(newTestAlbum(withTitle("Ballads")))
+	if res := decodeBody[types.SearchResult](t, s.do(http.MethodGet, "/searches/"+saved.ID+"/results", "", "Authorization", "Bearer "+key.Secret)); res.Total != 4 {
+		t.Errorf("after another album: %d found", res.Total)
+	}
+}
+
+func TestSavedSearchStale(t *testing.T) {
+	s := newTestServer(t)
+	captureLog(t)
+	key := newTestAPIKey(t, s, tierFree)
+	run := func(id string) *types.Problem {
+		t.Helper()
+		w := s.do(http.MethodGet, "/searches/"+id+"/results", "", "Authorization", "Bearer "+key.Secret)
+		if w.Code == http.StatusOK {
+			return nil
+		}
+		p := expectProblem(t, w, http.StatusConflict)
+		return &p
+	}
+	byBarcode := saveSearch(t, s, key.Secret, `{"name": "By barcode", "search": {"query": {"field": "barcode", "op": "eq", "value": "036000291452"}}}`)
+	byGenre := saveSearch(t, s, key.Secret, `{"name": "Jazz", "params": {"genre": "Jazz"}}`)
+	sortedByYear := saveSearch(t, s, key.Secret, `{"name": "By year", "search": {"sort": [{"field": "year"}]}}`)
+	for _, id := range []string{byBarcode.ID, byGenre.ID, sortedByYear.ID} {
+		if p := run(id); p != nil {
+			t.Fatalf("search %s before the fields were removed: %+v", id, p)
+		}
+	}
+
+	// The fields the searches use are removed, as a release might.
+	barcode, year := searchFields["barcode"], searchFields["year"]
+	params := savedSearchParams
+	delete(searchFields, "barcode")
+	delete(searchFields, "year")
+	savedSearchParams = slices.DeleteFunc(slices.Clone(params), func(p string) bool { return p == "genre" })
+	t.Cleanup(func() {
+		searchFields["barcode"], searchFields["year"] = barcode, year
+		savedSearchParams = params
+	})
+
+	for _, tc := range []struct {
+		id, pointer string
+	}{
+		{byBarcode.ID, "/search/query/field"},
+		{sortedByYear.ID, "/search/sort/0/field"},
+		{byGenre.ID, ""},
+	} {
+		p := run(tc.id)
+		if p == nil {
+			t.Errorf("search %s ran without its field", tc.id)
+			continue
+		}
+		if p.Type != types.ProblemStaleSearch || p.Pointer != tc.pointer || p.Detail == "" {
+			t.Errorf("search %s: %+v, want it stale at %q", tc.id, p, tc.pointer)
+		}
+	}
+	// A stale search can still be read, to save it again, and deleted.
+	expectStatus(t, s.do(http.MethodGet, "/searches/"+byBarcode.ID, "", "Authorization", "Bearer "+key.Secret), http.StatusOK)
+	expectStatus(t, s.do(http.MethodDelete, "/searches/"+byBarcode.ID, "", "Authorization", "Bearer "+key.Secret), http.StatusNoContent)
+	// And no new one is saved with the field that is gone.
+	expectProblem(t, s.do(http.MethodPost, "/searches", `{"name": "Jazz", "params": {"genre": "Jazz"}}`, "Authorization", "Bearer "+key.Secret), http.StatusBadRequest)
+}
+
+func TestSavedSearchStoreSQLite(t *testing.T) {
+	store, err := NewSqliteAlbumStore(testSQLiteStores(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	start := time.Now().UTC().Truncate(time.Millisecond)
+	saved := []savedSearch{
+		{ID: "s1", Name: "Coltrane", Owner: "key:a", Params: map[string]string{"artist": "John Coltrane", "metadata.label": "Blue Note"}, CreatedAt: start},
+		{ID: "s2", Name: "Cheap", Owner: "key:a", Shared: true, Search: json.RawMessage(`{"query":{"field":"price","op":"lt","value":10}}`), CreatedAt: start.Add(time.Second)},
+		{ID: "s3", Name: "Bob's", Owner: "key:b", Params: map[string]string{"q": "blue"}, CreatedAt: start.Add(2 * time.Second)},
+	}
+	for _, s := range saved {
+		if err := store.CreateSavedSearch(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := store.ListSavedSearches(ctx, "key:a")
+	if err != nil || len(list) != 2 || list[0].ID != "s1" || list[1].ID != "s2" {
+		t.Fatalf("key:a's searches %+v, %v", list, err)
+	}
+	for i, got := range list {
+		want := saved[i]
+		if got.Name != want.Name || got.Owner != want.Owner || got.Shared != want.Shared || string(got.Search) != string(want.Search) || !maps.Equal(got.Params, want.Params) || !got.CreatedAt.Equal(want.CreatedAt) {
+			t.Errorf("read back %+v, want %+v", got, want)
+		}
+	}
+	if err := store.DeleteSavedSearch(ctx, "s1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"s1", "nope"} {
+		if _, err := store.GetSavedSearch(ctx, id); !errors.Is(err, errSavedSearchNotFound) {
+			t.Errorf("GetSavedSearch(%s) = %v", id, err)
+		}
+		if err := store.DeleteSavedSearch(ctx, id); !errors.Is(err, errSavedSearchNotFound) {
+			t.Errorf("DeleteSavedSearch(%s) = %v", id, err)
+		}
+	}
+}
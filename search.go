@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// Bounds on a search query. A bare condition is one level deep, and each
+// and, or, or not around it adds one.
+const (
+	searchMaxDepth      = 5
+	searchMaxConditions = 50
+)
+
+// searchKind is the type of a field a search can test, which decides the
+// operators it takes and the type of their value.
+type searchKind int
+
+const (
+	searchText searchKind = iota
+	searchNumber
+	searchTime
+)
+
+// searchFields are the album fields a search can test and sort on.
+var searchFields = map[string]searchKind{
+	"title":     searchText,
+	"artist":    searchText,
+	"genre":     searchText,
+	"barcode":   searchText,
+	"slug":      searchText,
+	"price":     searchNumber,
+	"year":      searchNumber,
+	"createdAt": searchTime,
+	"updatedAt": searchTime,
+}
+
+// searchNode is a parsed search query: the and, or, or not of its nodes, or
+// a condition on one field. The zero searchNode matches every album.
+type searchNode struct {
+	logic string // "and", "or", or "not"; empty for a condition
+	nodes []searchNode
+
+	field string
+	op    string
+	value interface{} // a string, float64, or time.Time, by the field's kind
+}
+
+// searchValue is a's value of field, as the type its kind compares.
+func searchValue(a album, field string) interface{} {
+	switch field {
+	case "title":
+		return a.Title
+	case "artist":
+		return a.Artist
+	case "genre":
+		return a.Genre
+	case "barcode":
+		return a.Barcode
+	case "slug":
+		return a.Slug
+	case "price":
+		return float64(a.Price)
+	case "year":
+		return float64(a.Year)
+	case "createdAt":
+		return a.CreatedAt
+	}
+	return a.UpdatedAt
+}
+
+// matches evaluates the query against a. Text ignores case, the way the
+// artist and genre filters of GET /albums do.
+func (n searchNode) matches(a album) bool {
+	switch n.logic {
+	case "and":
+		for _, c := range n.nodes {
+			if !c.matches(a) {
+				return false
+			}
+		}
+		return true
+	case "or":
+		for _, c := range n.nodes {
+			if c.matches(a) {
+				return true
+			}
+		}
+		return false
+	case "not":
+		return !n.nodes[0].matches(a)
+	}
+	if n.field == "" {
+		return true
+	}
+	return n.test(searchValue(a, n.field))
+}
+
+// test applies a condition's operator to a field's value.
+func (n searchNode) test(v interface{}) bool {
+	switch v := v.(type) {
+	case string:
+		want := n.value.(string)
+		switch n.op {
+		case "eq":
+			return strings.EqualFold(v, want)
+		case "ne":
+			return !strings.EqualFold(v, want)
+		}
+		return strings.Contains(strings.ToLower(v), strings.ToLower(want))
+	case float64:
+		return searchCompare(n.op, cmp.Compare(v, n.value.(float64)))
+	}
+	return searchCompare(n.op, v.(time.Time).Compare(n.value.(time.Time)))
+}
+
+func searchCompare(op string, c int) bool {
+	switch op {
+	case "eq":
+		return c == 0
+	case "ne":
+		return c != 0
+	case "gt":
+		return c > 0
+	}
+	return c < 0
+}
+
+// filter returns the albums of list that match, in order, as a new slice.
+func (n searchNode) filter(list []album) []album {
+	matched := []album{}
+	for _, a := range list {
+		if n.matches(a) {
+			matched = append(matched, a)
+		}
+	}
+	return matched
+}
+
+// searchSQLOps are the SQL comparisons of the operators other than contains.
+var searchSQLOps = map[string]string{"eq": "=", "ne": "<>", "gt": ">", "lt": "<"}
+
+// searchSQL translates a query into a condition over the albums table, for
+// the SQL stores. bind adds a value to the arguments and returns its
+// placeholder; contains formats a substring test of its first argument for
+// its second. The zero query is the empty condition.
+func searchSQL(n searchNode, bind func(value interface{}) string, contains string) string {
+	switch n.logic {
+	case "and", "or":
+		conds := make([]string, len(n.nodes))
+		for i, c := range n.nodes {
+			conds[i] = searchSQL(c, bind, contains)
+		}
+		return "(" + strings.Join(conds, " "+strings.ToUpper(n.logic)+" ") + ")"
+	case "not":
+		return "NOT " + searchSQL(n.nodes[0], bind, contains)
+	}
+	if n.field == "" {
+		return ""
+	}
+	column := map[string]string{"barcode": "coalesce(barcode, '')", "createdAt": "created_at", "updatedAt": "updated_at"}[n.field]
+	if column == "" {
+		column = n.field
+	}
+	if searchFields[n.field] != searchText {
+		return "(" + column + " " + searchSQLOps[n.op] + " " + bind(n.value) + ")"
+	}
+	if n.op == "contains" {
+		return fmt.Sprintf(contains, "lower("+column+")", "lower("+bind(n.value)+")")
+	}
+	return "(lower(" + column + ") " + searchSQLOps[n.op] + " lower(" + bind(n.value) + "))"
+}
+
+// albumSearcher is implemented by stores that can run a search in the
+// database instead of listing every album to the application.
+type albumSearcher interface {
+	Search(ctx context.Context, query searchNode) ([]album, error)
+}
+
+// storeSearch returns the albums in store matching query, in insertion
+// order, searching in the database when the store supports it.
+func storeSearch(ctx context.Context, store AlbumStore, query searchNode) ([]album, error) {
+	if s, ok := store.(albumSearcher); ok {
+		return s.Search(ctx, query)
+	}
+	list, err := listAll(ctx, store, AlbumFilter{})
+	if err != nil && !errors.Is(err, errStaleRead) {
+		return nil, err
+	}
+	return query.filter(list), err
+}
+
+// searchError is a search body that doesn't parse. The pointer locates the
+// fault within the body; the detail is a fixed message, so it translates.
+type searchError struct {
+	pointer string
+	detail  string
+}
+
+func (e *searchError) Error() string {
+	return e.pointer + ": " + e.detail
+}
+
+// searchPointer appends a member name or index to a JSON Pointer, escaped
+// as RFC 6901 asks.
+func searchPointer(pointer string, token interface{}) string {
+	return pointer + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(fmt.Sprint(token))
+}
+
+// searchRequest is a parsed search body.
+type searchRequest struct {
+	query   searchNode
+	sort    []searchSort
+	limit   int
+	offset  int
+	clamped bool
+}
+
+type searchSort struct {
+	field string
+	desc  bool
+}
+
+const searchFieldsDetail = "field must be one of title, artist, genre, barcode, slug, price, year, createdAt, and updatedAt"
+
+// parseSearch reads a search body. The limit defaults to pageSize and is
+// lowered to maxPageSize, as on GET /albums.
+func parseSearch(body []byte, pageSize, maxPageSize int) (searchRequest, error) {
+	members, ok := searchMembers(body)
+	if !ok {
+		return searchRequest{}, &searchError{"", "the body must be a JSON object"}
+	}
+	for _, name := range slices.Sorted(maps.Keys(members)) {
+		switch name {
+		case "query", "sort", "limit", "offset":
+		default:
+			return searchRequest{}, &searchError{searchPointer("", name), "a search may only have query, sort, limit, and offset"}
+		}
+	}
+	req := searchRequest{limit: pageSize}
+	if raw, ok := members["query"]; ok {
+		var err error
+		p := searchParser{}
+		if req.query, err = p.node(raw, "/query", 1); err != nil {
+			return searchRequest{}, err
+		}
+	}
+	if raw, ok := members["sort"]; ok {
+		var keys []json.RawMessage
+		if json.Unmarshal(raw, &keys) != nil {
+			return searchRequest{}, &searchError{"/sort", "sort must be an array of fields and orders"}
+		}
+		for i, raw := range keys {
+			s, err := parseSearchSort(raw, searchPointer("/sort", i))
+			if err != nil {
+				return searchRequest{}, err
+			}
+			req.sort = append(req.sort, s)
+		}
+	}
+	if raw, ok := members["limit"]; ok {
+		if json.Unmarshal(raw, &req.limit) != nil || req.limit < 1 {
+			return searchRequest{}, &searchError{"/limit", "limit must be a positive number"}
+		}
+	}
+	if req.limit > maxPageSize {
+		req.limit, req.clamped = maxPageSize, true
+	}
+	if raw, ok := members["offset"]; ok {
+		if json.Unmarshal(raw, &req.offset) != nil || req.offset < 0 {
+			return searchRequest{}, &searchError{"/offset", "offset must be a non-negative number"}
+		}
+	}
+	return req, nil
+}
+
+// searchMembers decodes a JSON object into its raw members. It reports
+// false for anything else, null included.
+func searchMembers(raw json.RawMessage) (map[string]json.RawMessage, bool) {
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &members); err != nil || members == nil {
+		return nil, false
+	}
+	return members, true
+}
+
+func parseSearchSort(raw json.RawMessage, pointer string) (searchSort, error) {
+	members, ok := searchMembers(raw)
+	if !ok {
+		return searchSort{}, &searchError{pointer, "sort must be an array of fields and orders"}
+	}
+	for _, name := range slices.Sorted(maps.Keys(members)) {
+		if name != "field" && name != "order" {
+			return searchSort{}, &searchError{searchPointer(pointer, name), "sort must be an array of fields and orders"}
+		}
+	}
+	var s searchSort
+	if _, ok := searchFields[searchString(members["field"])]; !ok {
+		return searchSort{}, &searchError{pointer + "/field", searchFieldsDetail}
+	}
+	s.field = searchString(members["field"])
+	if raw, ok := members["order"]; ok {
+		switch searchString(raw) {
+		case "asc":
+		case "desc":
+			s.desc = true
+		default:
+			return searchSort{}, &searchError{pointer + "/order", "order must be asc or desc"}
+		}
+	}
+	return s, nil
+}
+
+// searchString decodes a JSON string, or returns "" for anything else.
+func searchString(raw json.RawMessage) string {
+	var s string
+	if isJSONNull(raw) || json.Unmarshal(raw, &s) != nil {
+		return ""
+	}
+	return s
+}
+
+// isJSONNull reports whether raw is missing or null, neither of which
+// decodes to an error.
+func isJSONNull(raw json.RawMessage) bool {
+	return raw == nil || bytes.Equal(bytes.TrimSpace(raw), []byte("null"))
+}
+
+// searchParser parses the nodes of one query, counting its conditions.
+type searchParser struct {
+	conditions int
+}
+
+func (p *searchParser) node(raw json.RawMessage, pointer string, depth int) (searchNode, error) {
+	members, ok := searchMembers(raw)
+	if !ok {
+		return searchNode{}, &searchError{pointer, "a query node must be a JSON object"}
+	}
+	if depth > searchMaxDepth {
+		return searchNode{}, &searchError{pointer, "queries may nest at most 5 levels deep"}
+	}
+	kinds := 0
+	for _, name := range slices.Sorted(maps.Keys(members)) {
+		switch name {
+		case "and", "or", "not", "field":
+			kinds++
+		case "op", "value":
+		default:
+			return searchNode{}, &searchError{searchPointer(pointer, name), "a query node may only have and, or, not, field, op, and value"}
+		}
+	}
+	_, condition := members["field"]
+	if kinds != 1 || !condition && len(members) != 1 {
+		return searchNode{}, &searchError{pointer, "a query node must have exactly one of and, or, not, and field"}
+	}
+	if condition {
+		return p.condition(members, pointer)
+	}
+	if raw, ok := members["not"]; ok {
+		c, err := p.node(raw, pointer+"/not", depth+1)
+		if err != nil {
+			return searchNode{}, err
+		}
+		return searchNode{logic: "not", nodes: []searchNode{c}}, nil
+	}
+	logic := "and"
+	if _, ok := members["or"]; ok {
+		logic = "or"
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(members[logic], &items); err != nil || len(items) == 0 {
+		return searchNode{}, &searchError{pointer + "/" + logic, "and and or take a non-empty array of query nodes"}
+	}
+	n := searchNode{logic: logic, nodes: make([]searchNode, len(items))}
+	for i, item := range items {
+		var err error
+		if n.nodes[i], err = p.node(item, searchPointer(pointer+"/"+logic, i), depth+1); err != nil {
+			return searchNode{}, err
+		}
+	}
+	return n, nil
+}
+
+func (p *searchParser) condition(members map[string]json.RawMessage, pointer string) (searchNode, error) {
+	p.conditions++
+	if p.conditions > searchMaxConditions {
+		return searchNode{}, &searchError{pointer, "queries may have at most 50 conditions"}
+	}
+	n := searchNode{field: searchString(members["field"]), op: searchString(members["op"])}
+	kind, ok := searchFields[n.field]
+	if !ok {
+		return searchNode{}, &searchError{pointer + "/field", searchFieldsDetail}
+	}
+	switch n.op {
+	case "eq", "ne":
+	case "gt", "lt":
+		if kind == searchText {
+			return searchNode{}, &searchError{pointer + "/op", "gt and lt don't apply to text fields"}
+		}
+	case "contains":
+		if kind != searchText {
+			return searchNode{}, &searchError{pointer + "/op", "contains only applies to text fields"}
+		}
+	default:
+		return searchNode{}, &searchError{pointer + "/op", "op must be one of eq, ne, gt, lt, and contains"}
+	}
+	raw := members["value"]
+	switch kind {
+	case searchText:
+		var s string
+		if isJSONNull(raw) || json.Unmarshal(raw, &s) != nil {
+			return searchNode{}, &searchError{pointer + "/value", "value must be a string"}
+		}
+		n.value = s
+	case searchNumber:
+		var f float64
+		if isJSONNull(raw) || json.Unmarshal(raw, &f) != nil {
+			return searchNode{}, &searchError{pointer + "/value", "value must be a number"}
+		}
+		n.value = f
+	case searchTime:
+		t, err := time.Parse(time.RFC3339Nano, searchString(raw))
+		if err != nil {
+			return searchNode{}, &searchError{pointer + "/value", "value must be an RFC 3339 timestamp"}
+		}
+		n.value = t.UTC()
+	}
+	return n, nil
+}
+
+// sortSearchResults orders list by the sort keys in turn, comparing text in
+// the collation. Albums the keys don't tell apart keep their order. The
+// collation keys of a text field are computed once for every album, before
+// sorting.
+func sortSearchResults(list []album, sort []searchSort, collation textCollation) {
+	if len(sort) == 0 {
+		return
+	}
+	keys := map[string][]string{}
+	for _, s := range sort {
+		if _, ok := keys[s.field]; ok || searchFields[s.field] != searchText {
+			continue
+		}
+		values := make([]string, len(list))
+		for i, a := range list {
+			values[i] = searchValue(a, s.field).(string)
+		}
+		keys[s.field] = collation.sortKeys(values)
+	}
+	order := make([]int, len(list))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(i, j int) int {
+		for _, s := range sort {
+			var c int
+			if k, ok := keys[s.field]; ok {
+				c = strings.Compare(k[i], k[j])
+			} else {
+				c = compareSearchValues(searchValue(list[i], s.field), searchValue(list[j], s.field))
+			}
+			if s.desc {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+	sorted := make([]album, len(list))
+	for i, j := range order {
+		sorted[i] = list[j]
+	}
+	copy(list, sorted)
+}
+
+// compareSearchValues compares the numbers or times of a field.
+func compareSearchValues(a, b interface{}) int {
+	if a, ok := a.(float64); ok {
+		return cmp.Compare(a, b.(float64))
+	}
+	return a.(time.Time).Compare(b.(time.Time))
+}
+
+// postAlbumsSearch answers POST /albums/search with one page of the albums
+// matching the query in the body, sorted as it asks. As on GET /albums,
+// those outside their availability window are left out unless the request
+// may includeUnavailable.
+func postAlbumsSearch(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	cfg := currentConfig()
+	req, err := parseSearch(body, cfg.AlbumsPageSize, cfg.AlbumsMaxPageSize)
+	if err != nil {
+		writeSearchProblem(w, r, err.(*searchError))
+		return
+	}
+	include, err := includeUnavailable(r)
+	if err != nil {
+		writeFilterProblem(w, r, err)
+		return
+	}
+	if req.clamped {
+		w.Header().Set("X-Limit-Clamped", strconv.Itoa(req.limit))
+	}
+	varyCollation(w)
+	if abandoned(r) {
+		return
+	}
+	list, err := storeSearch(r.Context(), albumStore, req.query)
+	if err = acceptStale(w, err); err != nil {
+		respondError(w, r, err)
+		return
+	}
+	if !include {
+		list = availableAlbums(list, availabilityNow())
+	}
+	if abandoned(r) {
+		return
+	}
+	atomic.AddInt64(&metrics.TotalAlbumsFetched, 1)
+	sortSearchResults(list, req.sort, requestCollation(r))
+	total := len(list)
+	page := list[min(req.offset, total):min(req.offset+req.limit, total)]
+	if n, fits := fitPage(page, cfg.ResponseMaxBytes, 2); !fits {
+		var ok bool
+		if req.limit, ok = cutPage(w, r, cfg, n, len(page)); !ok {
+			return
+		}
+		page = page[:req.limit]
+	}
+	writeJSON(w, http.StatusOK, types.SearchResult{Albums: page, Total: total, Limit: req.limit, Offset: req.offset})
+	log.Printf("🔎 Searched %d of %d albums", len(page), total)
+}
+
+// writeSearchProblem answers 400 for a search body that doesn't parse,
+// pointing at the fault.
+func writeSearchProblem(w http.ResponseWriter, r *http.Request, bad *searchError) {
+	log.Println("📉 Bad request: search", bad)
+	p := problem{Type: types.ProblemInvalidSearch, Title: http.StatusText(http.StatusBadRequest), Status: http.StatusBadRequest,
+		Detail: bad.detail, Instance: r.URL.Path, Pointer: bad.pointer}
+	writeLocalizedDetail(w, r, &p)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSONAs(w, http.StatusBadRequest, "application/problem+json", p)
+}
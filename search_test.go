@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// describeSearch writes a query tree out compactly, for comparing parses.
+func describeSearch(n searchNode) string {
+	if n.logic == "" {
+		if n.field == "" {
+			return "all"
+		}
+		value := fmt.Sprint(n.value)
+		if t, ok := n.value.(time.Time); ok {
+			value = t.Format(time.RFC3339)
+		}
+		return n.field + " " + n.op + " " + value
+	}
+	parts := make([]string, len(n.nodes))
+	for i, c := range n.nodes {
+		parts[i] = describeSearch(c)
+	}
+	return n.logic + "(" + strings.Join(parts, ", ") + ")"
+}
+
+// nestedSearch nests a condition in n nots.
+func nestedSearch(n int) string {
+	return strings.Repeat(`{"not": `, n) + `{"field": "year", "op": "eq", "value": 1957}` + strings.Repeat("}", n)
+}
+
+func TestParseSearch(t *testing.T) {
+	conditions := make([]string, searchMaxConditions+1)
+	for i := range conditions {
+		conditions[i] = `{"field": "year", "op": "eq", "value": 1957}`
+	}
+	for _, tc := range []struct {
+		body    string
+		want    string // the tree, or the pointer and detail of the error
+		sort    string
+		limit   int
+		offset  int
+		clamped bool
+	}{
+		{body: `{}`, want: "all", limit: 50},
+		{body: `{"query": {"field": "title", "op": "contains", "value": "blue"}}`, want: "title contains blue", limit: 50},
+		{
+			body: `{"query": {"and": [{"or": [{"field": "artist", "op": "eq", "value": "John Coltrane"}, {"field": "artist", "op": "eq", "value": "Miles Davis"}]}, {"not": {"field": "price", "op": "gt", "value": 20.5}}, {"field": "createdAt", "op": "lt", "value": "2026-03-02T12:00:00+01:00"}]}}`,
+			want: "and(or(artist eq John Coltrane, artist eq Miles Davis), not(price gt 20.5), createdAt lt 2026-03-02T11:00:00Z)", limit: 50,
+		},
+		{body: `{"sort": [{"field": "price", "order": "desc"}, {"field": "title"}], "limit": 10, "offset": 20}`, want: "all", sort: "[{price true} {title false}]", limit: 10, offset: 20},
+		{body: `{"limit": 10000}`, want: "all", limit: 500, clamped: true},
+		{body: `{"query": ` + nestedSearch(searchMaxDepth-1) + `}`, want: strings.Repeat("not(", 4) + "year eq 1957" + strings.Repeat(")", 4), limit: 50},
+		{body: `{"query": {"or": [` + strings.Join(conditions[:searchMaxConditions], ",") + `]}}`, want: "or(" + strings.TrimSuffix(strings.Repeat("year eq 1957, ", searchMaxConditions), ", ") + ")", limit: 50},
+
+		{body: `[]`, want: ": the body must be a JSON object"},
+		{body: `null`, want: ": the body must be a JSON object"},
+		{body: `{"filter": {}}`, want: "/filter: a search may only have query, sort, limit, and offset"},
+		{body: `{"query": []}`, want: "/query: a query node must be a JSON object"},
+		{body: `{"query": {"field": "label", "op": "eq", "value": "x"}}`, want: "/query/field: " + searchFieldsDetail},
+		{body: `{"query": {"field": "title", "op": "like", "value": "x"}}`, want: "/query/op: op must be one of eq, ne, gt, lt, and contains"},
+		{body: `{"query": {"field": "title", "op": "gt", "value": "x"}}`, want: "/query/op: gt and lt don't apply to text fields"},
+		{body: `{"query": {"field": "price", "op": "contains", "value": "1"}}`, want: "/query/op: contains only applies to text fields"},
+		{body: `{"query": {"field": "price", "op": "eq", "value": "9.99"}}`, want: "/query/value: value must be a number"},
+		{body: `{"query": {"field": "title", "op": "eq", "value": null}}`, want: "/query/value: value must be a string"},
+		{body: `{"query": {"field": "title", "op": "eq"}}`, want: "/query/value: value must be a string"},
+		{body: `{"query": {"field": "updatedAt", "op": "gt", "value": "yesterday"}}`, want: "/query/value: value must be an RFC 3339 timestamp"},
+		{body: `{"query": {"field": "title", "op": "eq", "value": "x", "and": []}}`, want: "/query: a query node must have exactly one of and, or, not, and field"},
+		{body: `{"query": {"and": [{"field": "title", "op": "eq", "value": "x"}], "op": "eq"}}`, want: "/query: a query node must have exactly one of and, or, not, and field"},
+		{body: `{"query": {"op": "eq"}}`, want: "/query: a query node must have exactly one of and, or, not, and field"},
+		{body: `{"query": {"or": []}}`, want: "/query/or: and and or take a non-empty array of query nodes"},
+		{body: `{"query": {"and": {"field": "title"}}}`, want: "/query/and: and and or take a non-empty array of query nodes"},
+		{body: `{"query": {"or": [{"field": "year", "op": "eq", "value": 1957}, {"not": {"field": "year", "op": "lt", "value": "1950"}}]}}`, want: "/query/or/1/not/value: value must be a number"},
+		{body: `{"query": {"and": [{"title": "x"}]}}`, want: "/query/and/0/title: a query node may only have and, or, not, field, op, and value"},
+		{body: `{"query": ` + nestedSearch(searchMaxDepth) + `}`, want: "/query" + strings.Repeat("/not", searchMaxDepth) + ": queries may nest at most 5 levels deep"},
+		{body: `{"query": {"or": [` + strings.Join(conditions, ",") + `]}}`, want: "/query/or/50: queries may have at most 50 conditions"},
+		{body: `{"sort": {"field": "title"}}`, want: "/sort: sort must be an array of fields and orders"},
+		{body: `{"sort": [{"field": "metadata"}]}`, want: "/sort/0/field: " + searchFieldsDetail},
+		{body: `{"sort": [{"field": "title", "order": "up"}]}`, want: "/sort/0/order: order must be asc or desc"},
+		{body: `{"sort": [{"field": "title", "by": "x"}]}`, want: "/sort/0/by: sort must be an array of fields and orders"},
+		{body: `{"limit": 0}`, want: "/limit: limit must be a positive number"},
+		{body: `{"offset": -1}`, want: "/offset: offset must be a non-negative number"},
+	} {
+		req, err := parseSearch([]byte(tc.body), 50, 500)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		} else {
+			got = describeSearch(req.query)
+		}
+		if got != tc.want {
+			t.Errorf("%s:\n got %s\nwant %s", tc.body, got, tc.want)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if sort := fmt.Sprint(req.sort); tc.sort != "" && sort != tc.sort {
+			t.Errorf("%s: sort %s, want %s", tc.body, sort, tc.sort)
+		}
+		if req.limit != tc.limit || req.offset != tc.offset || req.clamped != tc.clamped {
+			t.Errorf("%s: limit %d, offset %d, clamped %t", tc.body, req.limit, req.offset, req.clamped)
+		}
+	}
+}
+
+// searchFixtures are the albums of the end-to-end searches.
+var searchFixtures = []album{
+	newTestAlbum(withTitle("Blue Train"), withPrice(1999)),
+	newTestAlbum(withTitle("Giant Steps"), withPrice(2499)),
+	newTestAlbum(withTitle("Ascension"), withPrice(1599), func(a *album) { a.Genre, a.Year = "Free Jazz", 1966 }),
+	newTestAlbum(withTitle("Kind of Blue"), withArtist("Miles Davis"), withPrice(1899), func(a *album) { a.Year = 1959 }),
+	newTestAlbum(withTitle("Bitches Brew"), withArtist("Miles Davis"), withPrice(2999), func(a *album) { a.Genre, a.Year = "Fusion", 1970 }),
+	newTestAlbum(withTitle("Mingus Ah Um"), withArtist("Charles Mingus"), withPrice(1499), func(a *album) { a.Year = 1959 }),
+}
+
+// nestedSearchQuery is albums by Coltrane or Davis, but not fusion, that
+// are under $25 or from the fifties: all but Bitches Brew and Mingus Ah Um.
+const nestedSearchQuery = `{
+	"and": [
+		{"or": [
+			{"field": "artist", "op": "eq", "value": "john coltrane"},
+			{"field": "artist", "op": "contains", "value": "DAVIS"}
+		]},
+		{"not": {"field": "genre", "op": "eq", "value": "Fusion"}},
+		{"or": [
+			{"field": "price", "op": "lt", "value": 25},
+			{"and": [
+				{"field": "year", "op": "gt", "value": 1949},
+				{"field": "year", "op": "lt", "value": 1960}
+			]}
+		]}
+	]
+}`
+
+func TestSearch(t *testing.T) {
+	s := newTestServer(t)
+	for _, a := range searchFixtures {
+		s.create(a)
+	}
+	titles := func(albums []album) string {
+		out := make([]string, len(albums))
+		for i, a := range albums {
+			out[i] = a.Title
+		}
+		return strings.Join(out, ", ")
+	}
+
+	body := `{"query": ` + nestedSearchQuery + `, "sort": [{"field": "price", "order": "desc"}], "limit": 3}`
+	result := decodeBody[types.SearchResult](t, s.do(http.MethodPost, "/albums/search", body))
+	if got := titles(result.Albums); result.Total != 4 || got != "Giant Steps, Blue Train, Kind of Blue" {
+		t.Errorf("first page: %s of %d", got, result.Total)
+	}
+	body = `{"query": ` + nestedSearchQuery + `, "sort": [{"field": "price", "order": "desc"}], "limit": 3, "offset": 3}`
+	result = decodeBody[types.SearchResult](t, s.do(http.MethodPost, "/albums/search", body))
+	if got := titles(result.Albums); result.Total != 4 || got != "Ascension" || result.Offset != 3 {
+		t.Errorf("second page: %s of %d", got, result.Total)
+	}
+	// Ties on year fall back to the title.
+	body = `{"query": {"field": "year", "op": "eq", "value": 1959}, "sort": [{"field": "year"}, {"field": "title", "order": "desc"}]}`
+	if got := titles(decodeBody[types.SearchResult](t, s.do(http.MethodPost, "/albums/search", body)).Albums); got != "Mingus Ah Um, Kind of Blue" {
+		t.Errorf("1959 by title descending: %s", got)
+	}
+
+	p := expectProblem(t, s.do(http.MethodPost, "/albums/search", `{"query": {"and": [{"field": "year", "op": "contains", "value": "19"}]}}`), http.StatusBadRequest)
+	if p.Type != types.ProblemInvalidSearch || p.Pointer != "/query/and/0/op" || p.Detail != "contains only applies to text fields" {
+		t.Errorf("problem %+v, want the operator pointed at", p)
+	}
+}
+
+func TestSearchSQLite(t *testing.T) {
+	store, err := NewSqliteAlbumStore(testSQLiteStores(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, a := range searchFixtures {
+		a.ID = newAlbumID()
+		if _, err := store.Create(ctx, a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := parseSearch([]byte(`{"query": `+nestedSearchQuery+`}`), 50, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The query runs as SQL, and finds what the in-memory evaluation does.
+	found, err := storeSearch(ctx, store, req.query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sortSearchResults(found, []searchSort{{field: "title"}}, textCollation{})
+	var got []string
+	for _, a := range found {
+		got = append(got, a.Title)
+	}
+	if strings.Join(got, ", ") != "Ascension, Blue Train, Giant Steps, Kind of Blue" {
+		t.Errorf("SQLite found %v", got)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// defaultSeed is loaded into an empty store at startup unless SEED_FILE
+// points somewhere else.
+//
+//go:embed seed.json
+var defaultSeed []byte
+
+// seedAlbum is one entry of a seed file. ID is optional; entries without one
+// get a random UUID, which means they'll differ between fresh databases.
+type seedAlbum struct {
+	ID string `json:"id"`
+	albumInput
+}
+
+// loadSeed reads the seed file at path (SEED_FILE), falling back to the
+// embedded default when path is empty.
+func loadSeed(path string) ([]album, error) {
+	if path == "" {
+		return parseSeed("seed.json", defaultSeed)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseSeed(path, data)
+}
+
+// parseSeed decodes a JSON array of albums. Errors are prefixed with
+// name:line:column and the offending field so a bad seed file is easy to fix.
+func parseSeed(name string, data []byte) ([]album, error) {
+	fail := func(offset int64, format string, args ...interface{}) error {
+		line, col := lineColumn(data, offset)
+		return fmt.Errorf("%s:%d:%d: %s", name, line, col, fmt.Sprintf(format, args...))
+	}
+	syntaxFail := func(err error) error {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return fail(syntaxErr.Offset, "%v", err)
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+			return fail(int64(len(data)), "unexpected end of file")
+		}
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil {
+		return nil, syntaxFail(err)
+	} else if tok != json.Delim('[') {
+		return nil, fail(0, "seed must be a JSON array of albums")
+	}
+
+	var list []album
+	ids := make(map[string]int)
+	for i := 0; dec.More(); i++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, syntaxFail(err)
+		}
+		start := dec.InputOffset() - int64(len(raw))
+		field := func(f string) string { return fmt.Sprintf("[%d].%s", i, f) }
+
+		var entry seedAlbum
+		entryDec := json.NewDecoder(bytes.NewReader(raw))
+		entryDec.DisallowUnknownFields()
+		if err := entryDec.Decode(&entry); err != nil {
+			var typeErr *json.UnmarshalTypeError
+			if errors.As(err, &typeErr) {
+				return nil, fail(start+typeErr.Offset, "%s: expected %s, got %s", field(typeErr.Field), typeErr.Type, typeErr.Value)
+			}
+			return nil, fail(start, "[%d]: %v", i, err)
+		}
+
+		var idErr error
+		if entry.ID != "" {
+			idErr = validAlbumID(entry.ID)
+		}
+		switch {
+		case idErr != nil:
+			return nil, fail(start, "%s: %v", field("id"), idErr)
+		case entry.ID != "" && ids[entry.ID] > 0:
+			return nil, fail(start, "%s: %s is already used by entry %d", field("id"), entry.ID, ids[entry.ID]-1)
+		case entry.Title == "":
+			return nil, fail(start, "%s is required", field("title"))
+		case entry.Artist == "":
+			return nil, fail(start, "%s is required", field("artist"))
+		case entry.Price < 0:
+			return nil, fail(start, "%s must not be negative", field("price"))
+		}
+		if err := entry.validate(); err != nil {
+			return nil, fail(start, "%s: %v", field("barcode"), err)
+		}
+
+		if entry.ID == "" {
+			entry.ID = newAlbumID()
+		}
+		ids[entry.ID] = i + 1
+		list = append(list, album{
+			ID: entry.ID, Title: entry.Title, Artist: entry.Artist, Price: entry.Price.Round(), Genre: entry.Genre,
+			Barcode: entry.Barcode, Year: entry.Year, Tracks: entry.Tracks,
+		})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, syntaxFail(err)
+	}
+	return list, nil
+}
+
+// lineColumn converts a byte offset into 1-based line and column numbers.
+func lineColumn(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	col := int(offset) - bytes.LastIndexByte(before, '\n')
+	return line, col
+}
+
+// seedAlbums loads the seed into store if it holds no albums yet, so restarts
+// against a persistent backend don't add the seed again.
+func seedAlbums(ctx context.Context, store AlbumStore, seedFile string) error {
+	existing, err := store.List(ctx, ListOptions{Limit: 1})
+	if err != nil {
+		return fmt.Errorf("checking for existing albums: %w", err)
+	}
+	if len(existing.Albums) > 0 {
+		log.Println("🌱 Store already has albums, skipping seed")
+		return nil
+	}
+	seed, err := loadSeed(seedFile)
+	if err != nil {
+		return fmt.Errorf("loading seed: %w", err)
+	}
+	ctx = withPrincipal(ctx, principalSeed)
+	for _, a := range seed {
+		if _, err := store.Create(ctx, a); err != nil {
+			return fmt.Errorf("seeding album %q: %w", a.Title, err)
+		}
+	}
+	log.Printf("🌱 Seeded %d albums", len(seed))
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSeedErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, data, want string
+	}{
+		{"not an array", `{"title": "x"}`, "seed.json:1:1: seed must be a JSON array"},
+		{"syntax", "[\n  {\"title\": \"A\",}\n]", "seed.json:2:"},
+		{"truncated", `[{"title": "A"`, "unexpected end of file"},
+		{"wrong type", "[\n{\"title\": \"A\", \"artist\": \"B\", \"price\": \"cheap\"}]", "seed.json:2:"},
+		{"unknown field", `[{"title": "A", "artist": "B", "colour": "blue"}]`, `[0]: json: unknown field "colour"`},
+		{"missing title", `[{"artist": "B"}]`, "[0].title is required"},
+		{"missing artist", "[\n{\"title\": \"A\", \"artist\": \"B\"},\n{\"title\": \"C\"}]", "seed.json:3:1: [1].artist is required"},
+		{"negative price", `[{"title": "A", "artist": "B", "price": -1}]`, "[0].price must not be negative"},
+		{"bad barcode", `[{"title": "A", "artist": "B", "barcode": "123"}]`, "[0].barcode"},
+		{"duplicate id", `[{"id": "a1b2c3d4-0000-4000-8000-000000000001", "title": "A", "artist": "B"}, {"id": "a1b2c3d4-0000-4000-8000-000000000001", "title": "C", "artist": "D"}]`, "already used by entry 0"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseSeed("seed.json", []byte(tc.data))
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("err = %v, want it to contain %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestParseSeedWrongTypeNamesField(t *testing.T) {
+	_, err := parseSeed("seed.json", []byte(`[{"title": "A", "artist": "B", "year": "1957"}]`))
+	if err == nil || !strings.Contains(err.Error(), "[0].year: expected int") {
+		t.Errorf("err = %v, want the field named", err)
+	}
+}
+
+func TestEmbeddedSeed(t *testing.T) {
+	list, err := loadSeed("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) == 0 {
+		t.Fatal("the embedded seed is empty")
+	}
+	for _, a := range list {
+		if a.ID == "" || a.Title == "" || a.Artist == "" {
+			t.Errorf("seed album %+v lacks an ID, title, or artist", a)
+		}
+	}
+}
+
+func TestSeedAlbums(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seed.json")
+	if err := os.WriteFile(path, []byte(`[{"title": "Blue Train", "artist": "John Coltrane", "price": 56.99}, {"title": "Jeru", "artist": "Gerry Mulligan"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	store := NewInMemoryAlbumStore()
+	if err := seedAlbums(ctx, store, path); err != nil {
+		t.Fatal(err)
+	}
+	page, _ := store.List(ctx, ListOptions{})
+	if len(page.Albums) != 2 {
+		t.Fatalf("%d albums after seeding, want 2", len(page.Albums))
+	}
+
+	// A store that already has albums is left alone, so a restart doesn't
+	// seed twice.
+	if err := seedAlbums(ctx, store, path); err != nil {
+		t.Fatal(err)
+	}
+	if page, _ := store.List(ctx, ListOptions{}); len(page.Albums) != 2 {
+		t.Errorf("%d albums after seeding a populated store, want 2", len(page.Albums))
+	}
+
+	// So is a populated store when the seed file is broken: the seed is
+	// never read.
+	os.WriteFile(path, []byte(`[{`), 0o600)
+	if err := seedAlbums(ctx, store, path); err != nil {
+		t.Errorf("seeding a populated store read the seed: %v", err)
+	}
+	if err := seedAlbums(ctx, NewInMemoryAlbumStore(), path); err == nil {
+		t.Error("a broken seed file seeded an empty store")
+	}
+}
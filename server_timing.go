@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	responseTimeHeader = "X-Response-Time"
+	serverTimingHeader = "Server-Timing"
+
+	// debugTimingHeader, set to true by a caller with ADMIN_TOKEN or a live
+	// API key, asks for a Server-Timing breakdown of the response.
+	debugTimingHeader = "X-Debug-Timing"
+)
+
+// requestTiming adds up where one request's time went, from the hooks
+// that time its store calls and its serialization.
+type requestTiming struct {
+	start      time.Time
+	detailed   bool // answer with Server-Timing
+	store      atomic.Int64
+	storeCalls atomic.Int64
+	serialize  atomic.Int64
+}
+
+type requestTimingKey struct{}
+
+func timingFrom(ctx context.Context) *requestTiming {
+	t, _ := ctx.Value(requestTimingKey{}).(*requestTiming)
+	return t
+}
+
+// noteStoreTime adds a store call to the timing of the request ctx belongs
+// to, if any.
+func noteStoreTime(ctx context.Context, took time.Duration) {
+	if t := timingFrom(ctx); t != nil {
+		t.store.Add(int64(took))
+		t.storeCalls.Add(1)
+	}
+}
+
+// noteSerializeTime adds the encoding of a response body to its request's
+// timing, if any.
+func noteSerializeTime(ctx context.Context, took time.Duration) {
+	if t := timingFrom(ctx); t != nil {
+		t.serialize.Add(int64(took))
+	}
+}
+
+// timingMiddleware stamps every response with X-Response-Time, the
+// milliseconds from when the request reached the outermost layer to when
+// the response headers went out. A request with X-Debug-Timing: true from
+// an authenticated caller also gets Server-Timing, splitting that into the
+// time spent in the album store, in serializing the body, and in total.
+func timingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := &requestTiming{start: time.Now()}
+		t.detailed = r.Header.Get(debugTimingHeader) == "true" && debugTimingAllowed(r)
+		tw := &timingWriter{ResponseWriter: w, timing: t}
+		next.ServeHTTP(tw, r.WithContext(context.WithValue(r.Context(), requestTimingKey{}, t)))
+		tw.stamp()
+	})
+}
+
+// debugTimingAllowed reports whether r is from a caller who may see how
+// the service spends its time: an admin, or the holder of a live API key.
+func debugTimingAllowed(r *http.Request) bool {
+	if hasAdminToken(r) {
+		return true
+	}
+	secret := presentedAPIKey(r)
+	if secret == "" {
+		return false
+	}
+	_, ok, err := authenticateAPIKey(r.Context(), secret)
+	return ok && err == nil
+}
+
+// timingWriter sets the timing headers just before the response's own
+// headers are sent.
+type timingWriter struct {
+	http.ResponseWriter
+	timing  *requestTiming
+	stamped bool
+}
+
+func (w *timingWriter) WriteHeader(code int) {
+	// An informational response isn't the answer.
+	if code >= http.StatusOK {
+		w.stamp()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *timingWriter) Write(b []byte) (int, error) {
+	w.stamp()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *timingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+// stamp sets the headers once; a response that never started gets them
+// too, as net/http sends its headers after the handler returns.
+func (w *timingWriter) stamp() {
+	if w.stamped {
+		return
+	}
+	w.stamped = true
+	total := time.Since(w.timing.start)
+	h := w.Header()
+	h.Set(responseTimeHeader, strconv.FormatFloat(milliseconds(total), 'f', 3, 64)+"ms")
+	if w.timing.detailed {
+		h.Set(serverTimingHeader, w.timing.serverTiming(total))
+	}
+}
+
+// serverTiming renders the breakdown in the Server-Timing syntax of the
+// W3C spec: metrics separated by commas, each a name with dur in
+// milliseconds and a quoted desc. The store is only listed when its calls
+// were timed; the in-memory store's aren't.
+func (t *requestTiming) serverTiming(total time.Duration) string {
+	var metrics []string
+	metric := func(name string, d time.Duration, desc string) {
+		metrics = append(metrics, fmt.Sprintf("%s;dur=%s;desc=%s", name, strconv.FormatFloat(milliseconds(d), 'f', 3, 64), strconv.Quote(desc)))
+	}
+	if t.storeCalls.Load() > 0 {
+		metric("store", time.Duration(t.store.Load()), "Album store")
+	}
+	metric("serialize", time.Duration(t.serialize.Load()), "Serialization")
+	metric("total", total, "Total")
+	return strings.Join(metrics, ", ")
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// laggingGetStore is an InMemoryAlbumStore whose GetByID takes lag, as a
+// database's round trip would.
+type laggingGetStore struct {
+	*InMemoryAlbumStore
+	lag time.Duration
+}
+
+func (s laggingGetStore) GetByID(ctx context.Context, id string) (album, error) {
+	time.Sleep(s.lag)
+	return s.InMemoryAlbumStore.GetByID(ctx, id)
+}
+
+var (
+	responseTimeFormat = regexp.MustCompile(`^\d+\.\d{3}ms$`)
+	// A Server-Timing metric: a token name, then its dur and quoted desc.
+	serverTimingMetric = regexp.MustCompile(`^([!#$%&'*+\-.^_` + "`" + `|~0-9A-Za-z]+);dur=(\d+\.\d{3});desc="[^"\\]*"$`)
+)
+
+// serverTimings parses a Server-Timing header into the durations of its
+// metrics, in order, failing t on anything the spec doesn't allow.
+func serverTimings(t *testing.T, header string) (names []string, durs map[string]time.Duration) {
+	t.Helper()
+	durs = map[string]time.Duration{}
+	for _, metric := range strings.Split(header, ", ") {
+		m := serverTimingMetric.FindStringSubmatch(metric)
+		if m == nil {
+			t.Fatalf("Server-Timing metric %q isn't in the spec's syntax", metric)
+		}
+		ms, _ := strconv.ParseFloat(m[2], 64)
+		names = append(names, m[1])
+		durs[m[1]] = time.Duration(ms * float64(time.Millisecond))
+	}
+	return names, durs
+}
+
+func TestResponseTime(t *testing.T) {
+	s := newTestServer(t)
+	a := s.create(newTestAlbum())
+	for _, w := range []*httptest.ResponseRecorder{
+		s.do(http.MethodGet, "/albums/"+a.ID, ""),
+		s.do(http.MethodGet, "/albums/nope", ""),
+		s.do(http.MethodPost, "/albums", "{"),
+		s.do(http.MethodGet, "/healthz", ""),
+		// Asking isn't enough to get the breakdown.
+		s.do(http.MethodGet, "/albums", "", debugTimingHeader, "true"),
+	} {
+		if got := w.Header().Get(responseTimeHeader); !responseTimeFormat.MatchString(got) {
+			t.Errorf("%d answer: %s %q", w.Code, responseTimeHeader, got)
+		}
+		if got := w.Header().Get(serverTimingHeader); got != "" {
+			t.Errorf("%d answer to an anonymous caller: Server-Timing %q", w.Code, got)
+		}
+	}
+}
+
+func TestServerTiming(t *testing.T) {
+	s := newTestServer(t)
+	useInstrumentedStores(t)
+	a := s.create(newTestAlbum())
+	const lag = 20 * time.Millisecond
+	albumStore = NewInstrumentedAlbumStore(laggingGetStore{s.albums, lag}, "postgres")
+	key, revoked := newTestAPIKey(t, s, tierFree), newTestAPIKey(t, s, tierFree)
+	expectStatus(t, s.admin(http.MethodDelete, "/admin/apikeys/"+revoked.ID, ""), http.StatusNoContent)
+	get := func(headers ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := s.do(http.MethodGet, "/albums/"+a.ID, "", headers...)
+		expectStatus(t, w, http.StatusOK)
+		return w
+	}
+
+	// The breakdown is only for an admin or a live API key that asks.
+	for name, headers := range map[string][]string{
+		"the admin":  {"Authorization", "Bearer " + testAdminToken, debugTimingHeader, "true"},
+		"an API key": {"Authorization", "Bearer " + key.Secret, debugTimingHeader, "true"},
+	} {
+		w := get(headers...)
+		names, durs := serverTimings(t, w.Header().Get(serverTimingHeader))
+		if strings.Join(names, " ") != "store serialize total" {
+			t.Errorf("%s: metrics %v", name, names)
+		}
+		if durs["store"] < lag || durs["total"] < durs["store"]+durs["serialize"] {
+			t.Errorf("%s: store %s, serialize %s, total %s", name, durs["store"], durs["serialize"], durs["total"])
+		}
+		// X-Response-Time is the same total.
+		if got, want := w.Header().Get(responseTimeHeader), strconv.FormatFloat(milliseconds(durs["total"]), 'f', 3, 64)+"ms"; got != want {
+			t.Errorf("%s: %s %q, want the total, %q", name, responseTimeHeader, got, want)
+		}
+	}
+	for name, headers := range map[string][]string{
+		"the admin, not asking":  {"Authorization", "Bearer " + testAdminToken},
+		"an API key, not asking": {"Authorization", "Bearer " + key.Secret, debugTimingHeader, "1"},
+		"a revoked API key":      {"Authorization", "Bearer " + revoked.Secret, debugTimingHeader, "true"},
+		"a wrong admin token":    {"Authorization", "Bearer wrong", debugTimingHeader, "true"},
+		"an anonymous caller":    {debugTimingHeader, "true"},
+	} {
+		w := s.do(http.MethodGet, "/albums/"+a.ID, "", headers...)
+		if got := w.Header().Get(serverTimingHeader); got != "" {
+			t.Errorf("%s: Server-Timing %q", name, got)
+		}
+		if got := w.Header().Get(responseTimeHeader); !responseTimeFormat.MatchString(got) {
+			t.Errorf("%s: %s %q", name, responseTimeHeader, got)
+		}
+	}
+
+	// The in-memory store's calls aren't timed, so store is left out.
+	albumStore = s.albums
+	names, _ := serverTimings(t, get("Authorization", "Bearer "+testAdminToken, debugTimingHeader, "true").Header().Get(serverTimingHeader))
+	if strings.Join(names, " ") != "serialize total" {
+		t.Errorf("metrics %v for the in-memory store", names)
+	}
+}
+
+func TestServerTimingCORS(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.CORSAllowedOrigins = "https://app.example.com" })
+	w := s.do(http.MethodGet, "/albums", "", "Origin", "https://app.example.com")
+	if got := w.Header().Get("Access-Control-Expose-Headers"); !strings.Contains(got, responseTimeHeader) {
+		t.Errorf("Access-Control-Expose-Headers %q", got)
+	}
+	if got := w.Header().Get("Timing-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Timing-Allow-Origin %q", got)
+	}
+	w = s.do(http.MethodOptions, "/albums", "", "Origin", "https://app.example.com", "Access-Control-Request-Method", "GET")
+	if got := w.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(got, debugTimingHeader) {
+		t.Errorf("Access-Control-Allow-Headers %q", got)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultSlowRequestThreshold = time.Second
+
+// slowRequestCounts counts the requests that took longer than
+// SLOW_REQUEST_THRESHOLD, by route. Like the breaker states, they are only
+// kept in memory and start from zero on every restart.
+var slowRequestCounts = struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}{counts: map[string]int64{}}
+
+// requestRoute is the pattern the request was routed by, like
+// "/albums/{id...}", so the albums aren't counted one by one. Requests turned
+// away before routing, or caught by unmatchedPattern, are "unmatched".
+func requestRoute(r *http.Request) string {
+	if r.Pattern == "" || r.Pattern == unmatchedPattern {
+		return "unmatched"
+	}
+	return r.Pattern
+}
+
+// noteSlowRequest logs a warning and counts the request if it took longer
+// than SLOW_REQUEST_THRESHOLD, read per request so a reload applies straight
+// away.
+func noteSlowRequest(r *http.Request, status int, duration time.Duration) {
+	threshold := currentConfig().SlowRequestThreshold
+	if duration <= threshold {
+		return
+	}
+	route := requestRoute(r)
+	slowRequestCounts.mu.Lock()
+	slowRequestCounts.counts[route]++
+	slowRequestCounts.mu.Unlock()
+	log.Printf("⚠️ Slow request: %s %s (route %s) -> %d took %s, over %s", r.Method, r.URL.Path, route, status, duration, threshold)
+}
+
+// slowRequests copies the counts for /metrics.
+func slowRequests() map[string]int64 {
+	slowRequestCounts.mu.Lock()
+	defer slowRequestCounts.mu.Unlock()
+	counts := make(map[string]int64, len(slowRequestCounts.counts))
+	for route, n := range slowRequestCounts.counts {
+		counts[route] = n
+	}
+	return counts
+}
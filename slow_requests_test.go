@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+func TestSlowRequests(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) { cfg.SlowRequestThreshold = time.Millisecond })
+	logs := captureLog(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/albums/{id...}", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		w.WriteHeader(http.StatusTeapot)
+	})
+	h := loggingMiddleware(mux)
+	before := slowRequests()
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/albums/a", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/albums/b", nil))
+	got := logs.take()
+	if strings.Count(got, "⚠️ Slow request") != 2 || !strings.Contains(got, "GET /albums/a (route /albums/{id...}) -> 418 took") || !strings.Contains(got, "over 1ms") {
+		t.Errorf("logged\n%s\nwant a slow request line for each, with the route and status", got)
+	}
+	if n := slowRequests()["/albums/{id...}"] - before["/albums/{id...}"]; n != 2 {
+		t.Errorf("counted %d slow requests on /albums/{id...}, want 2 under the one route", n)
+	}
+
+	// The threshold is read per request, so a reload raising it applies
+	// to the next one.
+	reloaded := *s.cfg
+	reloaded.SlowRequestThreshold = time.Hour
+	liveConfig.Store(&reloaded)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/albums/c", nil))
+	if got := logs.take(); strings.Contains(got, "Slow request") {
+		t.Errorf("logged a request under the raised threshold:\n%s", got)
+	}
+	if n := slowRequests()["/albums/{id...}"] - before["/albums/{id...}"]; n != 2 {
+		t.Errorf("counted %d slow requests after raising the threshold, want still 2", n)
+	}
+
+	report := decodeBody[types.MetricsReport](t, s.do(http.MethodGet, "/metrics", ""))
+	if report.SlowRequests["/albums/{id...}"] != slowRequests()["/albums/{id...}"] {
+		t.Errorf("/metrics slowRequests = %v", report.SlowRequests)
+	}
+}
+
+func TestRequestRoute(t *testing.T) {
+	for pattern, want := range map[string]string{
+		"":                    "unmatched",
+		unmatchedPattern:      "unmatched",
+		"/albums/{id...}":     "/albums/{id...}",
+		"/admin/apikeys/{id}": "/admin/apikeys/{id}",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Pattern = pattern
+		if got := requestRoute(r); got != want {
+			t.Errorf("requestRoute with pattern %q = %q, want %q", pattern, got, want)
+		}
+	}
+}
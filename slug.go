@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+)
+
+var errSlugTaken = newCategorizedError(errConflict, "slug is already used by another album")
+
+// foldReplacer handles letters that don't decompose into a base letter plus
+// combining marks under NFD, so they would otherwise be dropped.
+var foldReplacer = strings.NewReplacer(
+	"ß", "ss", "æ", "ae", "Æ", "ae", "œ", "oe", "Œ", "oe",
+	"ø", "o", "Ø", "o", "đ", "d", "Đ", "d", "ł", "l", "Ł", "l",
+	"þ", "th", "Þ", "th", "ð", "d", "Ð", "d", "ı", "i",
+	"&", " and ",
+)
+
+// foldDiacritics strips combining marks so "Émigré" becomes "Emigre".
+func foldDiacritics(s string) string {
+	t := transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+	folded, _, err := transform.String(t, foldReplacer.Replace(s))
+	if err != nil {
+		return s
+	}
+	return folded
+}
+
+// slugify builds a URL-safe slug from an album's title and artist: lowercase
+// ASCII letters and digits, with every other run of characters collapsed into a
+// single hyphen.
+func slugify(title, artist string) string {
+	var b strings.Builder
+	pendingHyphen := false
+	for _, r := range strings.ToLower(foldDiacritics(title + " " + artist)) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if pendingHyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			pendingHyphen = false
+			b.WriteRune(r)
+			continue
+		}
+		pendingHyphen = true
+	}
+	if b.Len() == 0 {
+		return "album"
+	}
+	return b.String()
+}
+
+// uniqueSlug appends -2, -3, ... to base until taken reports the slug as free.
+func uniqueSlug(base string, taken func(string) bool) string {
+	if !taken(base) {
+		return base
+	}
+	for n := 2; ; n++ {
+		candidate := base + "-" + strconv.Itoa(n)
+		if !taken(candidate) {
+			return candidate
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestSlugify(t *testing.T) {
+	for _, tc := range []struct {
+		title, artist, want string
+	}{
+		{"Blue Train", "John Coltrane", "blue-train-john-coltrane"},
+		{"  Kind of   Blue ", "Miles Davis", "kind-of-blue-miles-davis"},
+		{"Back in Black", "AC/DC", "back-in-black-ac-dc"},
+		{"Bridge over Troubled Water", "Simon & Garfunkel", "bridge-over-troubled-water-simon-and-garfunkel"},
+		{"1999", "Prince", "1999-prince"},
+		{"...Baby One More Time!", "Britney Spears", "baby-one-more-time-britney-spears"},
+		{"Homogenic", "Björk", "homogenic-bjork"},
+		{"Ágætis byrjun", "Sigur Rós", "agaetis-byrjun-sigur-ros"},
+		{"Émigré", "Café Tacvba", "emigre-cafe-tacvba"},
+		{"Straße", "Die Ärzte", "strasse-die-arzte"},
+		{"Łódź", "Øresund", "lodz-oresund"},
+		{"Ça Ira", "ÇIRAĞAN", "ca-ira-ciragan"},
+		{"東京", "椎名林檎", "album"},
+		{"東京 2020", "", "2020"},
+		{"", "", "album"},
+	} {
+		if got := slugify(tc.title, tc.artist); got != tc.want {
+			t.Errorf("slugify(%q, %q) = %q, want %q", tc.title, tc.artist, got, tc.want)
+		}
+	}
+}
+
+func TestUniqueSlug(t *testing.T) {
+	taken := map[string]bool{"blue-train": true, "blue-train-2": true}
+	if got := uniqueSlug("blue-train", func(s string) bool { return taken[s] }); got != "blue-train-3" {
+		t.Errorf("uniqueSlug = %q, want blue-train-3", got)
+	}
+	if got := uniqueSlug("giant-steps", func(s string) bool { return taken[s] }); got != "giant-steps" {
+		t.Errorf("uniqueSlug = %q, want giant-steps", got)
+	}
+}
+
+func TestSlugLookup(t *testing.T) {
+	s := newTestServer(t)
+	first := s.create(newTestAlbum())
+	second := s.create(newTestAlbum())
+	if first.Slug != "blue-train-john-coltrane" || second.Slug != "blue-train-john-coltrane-2" {
+		t.Fatalf("slugs = %q and %q, want the second suffixed", first.Slug, second.Slug)
+	}
+	got := decodeBody[album](t, s.do(http.MethodGet, "/albums/by-slug/"+second.Slug, ""))
+	if got.ID != second.ID {
+		t.Errorf("by-slug found %s, want %s", got.ID, second.ID)
+	}
+
+	// A title change keeps the slug, so links stay valid, unless asked.
+	w := s.do(http.MethodPut, "/albums/"+first.ID, albumJSON(newTestAlbum(withTitle("Lush Life"))))
+	expectStatus(t, w, http.StatusOK)
+	if got := decodeBody[album](t, w); got.Slug != first.Slug {
+		t.Errorf("slug after a title change = %q, want %q kept", got.Slug, first.Slug)
+	}
+	if _, err := s.albums.Update(context.Background(), decodeBody[album](t, w), true); err != nil {
+		t.Fatal(err)
+	}
+	got = decodeBody[album](t, s.do(http.MethodGet, "/albums/by-slug/lush-life-john-coltrane", ""))
+	if got.ID != first.ID {
+		t.Errorf("the regenerated slug finds %s, want %s", got.ID, first.ID)
+	}
+	expectProblem(t, s.do(http.MethodGet, "/albums/by-slug/"+first.Slug, ""), http.StatusNotFound)
+}
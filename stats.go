@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/brentmzey/web-service-go/money"
+	"golang.org/x/sync/singleflight"
+)
+
+// albumStats summarizes the albums matching a filter.
+type albumStats struct {
+	Count        int          `json:"count"`
+	TotalValue   money.Amount `json:"totalValue"`
+	AveragePrice money.Amount `json:"averagePrice"`
+	MinPrice     money.Amount `json:"minPrice"`
+	MaxPrice     money.Amount `json:"maxPrice"`
+}
+
+func computeAlbumStats(list []album) albumStats {
+	var s albumStats
+	for _, a := range list {
+		s.add(a)
+	}
+	return s.finish()
+}
+
+// add counts a into stats being computed one album at a time, as from an
+// Iterate; finish works out the average once they are all in.
+func (s *albumStats) add(a album) {
+	if s.Count == 0 || a.Price < s.MinPrice {
+		s.MinPrice = a.Price
+	}
+	if a.Price > s.MaxPrice {
+		s.MaxPrice = a.Price
+	}
+	s.Count++
+	s.TotalValue = s.TotalValue.Add(a.Price)
+}
+
+func (s albumStats) finish() albumStats {
+	if s.Count > 0 {
+		s.AveragePrice = s.TotalValue.Div(s.Count)
+	}
+	return s
+}
+
+// albumStatser is implemented by stores that can summarize albums
+// themselves instead of listing every match to the application.
+type albumStatser interface {
+	Stats(ctx context.Context, filter AlbumFilter) (albumStats, error)
+}
+
+// storeStats summarizes the albums in store matching filter, in the database
+// when the store supports it.
+func storeStats(ctx context.Context, store AlbumStore, filter AlbumFilter) (albumStats, error) {
+	if s, ok := store.(albumStatser); ok {
+		return s.Stats(ctx, filter)
+	}
+	list, err := listAll(ctx, store, filter)
+	if err != nil && !errors.Is(err, errStaleRead) {
+		return albumStats{}, err
+	}
+	return computeAlbumStats(list), err
+}
+
+const (
+	defaultStatsCacheTTL = 5 * time.Second
+
+	// statsCacheSize bounds the number of filters with cached stats; when
+	// it fills up the cache starts over.
+	statsCacheSize = 128
+)
+
+// cachedStats is a computed summary and when it was computed, which is also
+// the GET /albums/stats response.
+type cachedStats struct {
+	albumStats
+	ComputedAt time.Time `json:"computedAt"`
+}
+
+// statsCache keeps computed stats by filter for STATS_CACHE_TTL, so
+// dashboards polling the endpoint don't each cost an aggregation. Album
+// writes made through this instance drop the lot; writes made by other
+// processes show once the entries expire.
+type statsCache struct {
+	mu      sync.Mutex
+	writes  uint64 // bumped by every invalidation, see put
+	entries map[string]cachedStats
+}
+
+var albumStatsResults = &statsCache{}
+
+func (c *statsCache) get(key string, ttl time.Duration) (cachedStats, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || serverClock.Since(entry.ComputedAt) >= ttl {
+		return cachedStats{}, false
+	}
+	return entry, true
+}
+
+// generation returns the invalidation count to pass to put.
+func (c *statsCache) generation() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writes
+}
+
+// put caches entry for key, unless the cache was invalidated since writes
+// was read, before the stats were computed: they may predate the write.
+func (c *statsCache) put(key string, entry cachedStats, writes uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if writes != c.writes {
+		return
+	}
+	if c.entries == nil || len(c.entries) >= statsCacheSize {
+		c.entries = make(map[string]cachedStats)
+	}
+	c.entries[key] = entry
+}
+
+// invalidate drops every cached summary. Handlers call it after changing
+// albums.
+func (c *statsCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writes++
+	c.entries = nil
+}
+
+// statsRequests coalesces concurrent stats requests for the same filter into
+// one query of the store.
+var statsRequests singleflight.Group
+
+func getAlbumStats(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseAlbumFilter(r)
+	if err != nil {
+		writeFilterProblem(w, r, err)
+		return
+	}
+	keepPrivate(w, filter)
+	varyCollation(w)
+	key, ttl := filter.cacheKey(), currentConfig().StatsCacheTTL
+	if entry, ok := albumStatsResults.get(key, ttl); ok {
+		writeJSON(w, http.StatusOK, entry)
+		log.Println("📊 Served album stats from the cache")
+		return
+	}
+	// The listing is shared by every caller waiting on it, so one client
+	// disconnecting must not cancel it for the rest.
+	ctx := context.WithoutCancel(r.Context())
+	v, err, _ := statsRequests.Do(key, func() (interface{}, error) {
+		// A caller that missed the cache just as the last computation
+		// finished gets its result rather than starting another.
+		if entry, ok := albumStatsResults.get(key, ttl); ok {
+			return entry, nil
+		}
+		writes := albumStatsResults.generation()
+		s, err := storeStats(ctx, albumStore, filter)
+		if err != nil && !errors.Is(err, errStaleRead) {
+			return nil, err
+		}
+		entry := cachedStats{albumStats: s, ComputedAt: serverClock.Now().UTC()}
+		if err == nil && ttl > 0 {
+			albumStatsResults.put(key, entry, writes)
+		}
+		return entry, err
+	})
+	if err = acceptStale(w, err); err != nil {
+		respondError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+	log.Println("📊 Served album stats")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStatsStore counts the aggregations asked of an InMemoryAlbumStore.
+type countingStatsStore struct {
+	*InMemoryAlbumStore
+	aggregations atomic.Int32
+}
+
+func (s *countingStatsStore) Stats(ctx context.Context, filter AlbumFilter) (albumStats, error) {
+	s.aggregations.Add(1)
+	// Slow enough for the other callers to pile up behind it.
+	time.Sleep(10 * time.Millisecond)
+	list, err := listAll(ctx, s.InMemoryAlbumStore, filter)
+	return computeAlbumStats(list), err
+}
+
+func TestStatsCoalesced(t *testing.T) {
+	s := newTestServer(t)
+	store := &countingStatsStore{InMemoryAlbumStore: s.albums}
+	albumStore = store
+	s.create(newTestAlbum())
+
+	// burst sends 50 parallel stats requests and returns the responses.
+	burst := func() []cachedStats {
+		t.Helper()
+		var wg sync.WaitGroup
+		results := make([]cachedStats, 50)
+		for i := range results {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := s.do(http.MethodGet, "/albums/stats", "")
+				// Unmarshalled here as decodeBody can't fail the test off
+				// its goroutine.
+				if w.Code == http.StatusOK {
+					json.Unmarshal(w.Body.Bytes(), &results[i])
+				}
+			}()
+		}
+		wg.Wait()
+		return results
+	}
+	expect := func(aggregations int32, count int, computedAt time.Time) {
+		t.Helper()
+		for _, got := range burst() {
+			if got.Count != count || !got.ComputedAt.Equal(computedAt) {
+				t.Fatalf("stats %+v, want a count of %d computed at %s", got, count, computedAt)
+			}
+		}
+		if n := store.aggregations.Load(); n != aggregations {
+			t.Errorf("%d aggregations, want %d", n, aggregations)
+		}
+	}
+
+	expect(1, 1, testStart)
+	s.clock.Advance(defaultStatsCacheTTL - time.Second)
+	expect(1, 1, testStart)
+
+	// Past the TTL, one of the next burst computes them again.
+	s.clock.Advance(time.Second)
+	expect(2, 1, testStart.Add(defaultStatsCacheTTL))
+
+	// A write drops them straight away.
+	s.create(newTestAlbum(withTitle("Sketches of Spain")))
+	expect(3, 2, testStart.Add(defaultStatsCacheTTL))
+}
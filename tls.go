@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const defaultMTLSOptionalRoutes = "/healthz,/readyz"
+
+// setupTLS builds the TLS configuration both listeners serve with, or nil
+// when TLS_CERT_FILE is unset and they serve plain HTTP. With
+// MTLS_CLIENT_CA set, clients must present a certificate signed by one of
+// its CAs. The routes in MTLS_OPTIONAL_ROUTES need one only if the client
+// offers it, so the handshake merely verifies what is given, and
+// requireClientCert turns away the other routes' requests without one.
+func setupTLS(cfg *Config) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if cfg.MTLSClientCA == "" {
+		return tlsConfig, nil
+	}
+	pem, err := os.ReadFile(cfg.MTLSClientCA)
+	if err != nil {
+		return nil, fmt.Errorf("MTLS_CLIENT_CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("MTLS_CLIENT_CA: no certificates found in %s", cfg.MTLSClientCA)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	if hasOptionalCertRoutes(cfg) {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
+
+// hasOptionalCertRoutes reports whether any route is served without a client
+// certificate. MTLS_OPTIONAL_ROUTES=none lists none, since an empty variable
+// counts as unset.
+func hasOptionalCertRoutes(cfg *Config) bool {
+	routes := strings.TrimSpace(cfg.MTLSOptionalRoutes)
+	return routes != "" && routes != "none"
+}
+
+// requireClientCert turns away requests without a verified client
+// certificate, except to the routes in MTLS_OPTIONAL_ROUTES. It wraps routes
+// itself, which it asks for the route, so it only needs adding where the
+// handshake doesn't already insist on a certificate.
+func requireClientCert(cfg *Config, routes *routeTable) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if clientCert(r) == nil {
+			if !routeListed(cfg.MTLSOptionalRoutes, routes.route(r)) {
+				writeProblem(w, r, http.StatusUnauthorized, "a client certificate is required")
+				log.Printf("🔒 Rejected %s %s without a client certificate", r.Method, r.URL.Path)
+				return
+			}
+		}
+		routes.ServeHTTP(w, r)
+	})
+}
+
+// clientCert is the client certificate the handshake verified, or nil.
+func clientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// certName names the holder of a client certificate: its common name, or
+// failing that its first DNS or URI SAN, like a SPIFFE ID.
+func certName(cert *x509.Certificate) string {
+	switch {
+	case cert.Subject.CommonName != "":
+		return cert.Subject.CommonName
+	case len(cert.DNSNames) > 0:
+		return cert.DNSNames[0]
+	case len(cert.URIs) > 0:
+		return cert.URIs[0].String()
+	}
+	return cert.SerialNumber.String()
+}
+
+// requestPrincipal is who r is recorded as acting for in the audit log: the
+// holder of its client certificate, its API key, or anonymous.
+func requestPrincipal(r *http.Request) string {
+	if cert := clientCert(r); cert != nil {
+		return "cert:" + certName(cert)
+	}
+	if c := identifyCaller(r); strings.HasPrefix(c.id, "key:") {
+		return c.id
+	}
+	return principalAnonymous
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a certificate for name signed by ca, for a server if ips
+// are given and for a client otherwise.
+func (ca *testCA) issue(t *testing.T, name string, ips ...net.IP) tls.Certificate {
+	t.Helper()
+	return ca.issueUntil(t, name, time.Now().Add(time.Hour), ips...)
+}
+
+// issueUntil is issue with a certificate that expires at notAfter.
+func (ca *testCA) issueUntil(t *testing.T, name string, notAfter time.Time, ips ...net.IP) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	usage := x509.ExtKeyUsageClientAuth
+	if len(ips) > 0 {
+		usage = x509.ExtKeyUsageServerAuth
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		IPAddresses:  ips,
+		NotBefore:    notAfter.Add(-90 * 24 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writeKeyPair writes cert and its key as PEM files for TLS_CERT_FILE and
+// TLS_KEY_FILE.
+func writeKeyPair(t *testing.T, cert tls.Certificate) (certFile, keyFile string) {
+	t.Helper()
+	dir := t.TempDir()
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	return certFile, keyFile
+}
+
+// startMTLSServer serves the API over TLS with client certificates signed
+// by ca, and MTLS_OPTIONAL_ROUTES set to optional, returning its URL and a
+// function making a client presenting cert, or none if it is nil.
+func startMTLSServer(t *testing.T, ca *testCA, optional string) (string, func(cert *tls.Certificate) *http.Client) {
+	t.Helper()
+	certFile, keyFile := writeKeyPair(t, ca.issue(t, "albums", net.IPv4(127, 0, 0, 1)))
+	caFile := filepath.Join(t.TempDir(), "clients.pem")
+	if err := os.WriteFile(caFile, ca.pem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.ListenAddr = "127.0.0.1:0"
+		cfg.TLSCertFile, cfg.TLSKeyFile = certFile, keyFile
+		cfg.MTLSClientCA = caFile
+		cfg.MTLSOptionalRoutes = optional
+	})
+	url := startServers(t, s)[0]
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	return url, func(cert *tls.Certificate) *http.Client {
+		tlsConfig := &tls.Config{RootCAs: roots}
+		if cert != nil {
+			// Offered whoever the server says it trusts; a client picking
+			// from Certificates would hold back an untrusted one.
+			tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return cert, nil }
+		}
+		transport := &http.Transport{TLSClientConfig: tlsConfig}
+		t.Cleanup(transport.CloseIdleConnections)
+		return &http.Client{Transport: transport}
+	}
+}
+
+func TestMTLS(t *testing.T) {
+	ca := newTestCA(t, "Albums Test CA")
+	trusted := ca.issue(t, "ci-runner")
+	untrusted := newTestCA(t, "Someone Else's CA").issue(t, "mallory")
+	url, client := startMTLSServer(t, ca, defaultMTLSOptionalRoutes)
+
+	if got := get(t, client(&trusted), url+"/albums", false); got != http.StatusOK {
+		t.Errorf("GET /albums with a trusted certificate: %d, want 200", got)
+	}
+	if got := get(t, client(nil), url+"/albums", false); got != http.StatusUnauthorized {
+		t.Errorf("GET /albums without a certificate: %d, want 401", got)
+	}
+	if got := get(t, client(nil), url+"/healthz", false); got != http.StatusOK {
+		t.Errorf("GET /healthz without a certificate: %d, want 200", got)
+	}
+	if _, err := client(&untrusted).Get(url + "/healthz"); err == nil {
+		t.Error("the handshake took a certificate from an untrusted CA")
+	}
+
+	// The certificate's holder is the principal of what it changes.
+	res, err := client(&trusted).Post(url+"/albums", "application/json", strings.NewReader(albumJSON(newTestAlbum())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("POST /albums with a trusted certificate: %d", res.StatusCode)
+	}
+	entries, _ := auditLog.List()
+	if len(entries) != 1 || entries[0].Principal != "cert:ci-runner" {
+		t.Errorf("audit entries %+v, want the create by cert:ci-runner", entries)
+	}
+}
+
+func TestMTLSWithoutOptionalRoutes(t *testing.T) {
+	ca := newTestCA(t, "Albums Test CA")
+	trusted := ca.issue(t, "ci-runner")
+	url, client := startMTLSServer(t, ca, "none")
+
+	if got := get(t, client(&trusted), url+"/healthz", false); got != http.StatusOK {
+		t.Errorf("GET /healthz with a trusted certificate: %d, want 200", got)
+	}
+	// Without a certificate the handshake itself fails, on any route.
+	if _, err := client(nil).Get(url + "/healthz"); err == nil {
+		t.Error("the handshake went through without a certificate")
+	}
+}
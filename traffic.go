@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// responseSizeBuckets are the upper bounds, in bytes, of the response size
+// histogram; larger responses fall in a last, unbounded bucket.
+var responseSizeBuckets = []int64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20}
+
+// trafficCounts adds up the bytes read from request bodies and written in
+// responses, in total and by route, for the requests metricsMiddleware
+// counts. Like the slow request counts, they are only kept in memory.
+var trafficCounts = struct {
+	mu        sync.Mutex
+	routes    map[string]*types.RouteTraffic
+	bytesIn   int64
+	bytesOut  int64
+	sizes     []int64 // responses per bucket of responseSizeBuckets, then the rest
+	responses int64
+}{routes: map[string]*types.RouteTraffic{}, sizes: make([]int64, len(responseSizeBuckets)+1)}
+
+// countingBody counts the bytes a handler actually reads from a request
+// body, whatever its Content-Length says.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+	// timedOut is set when a read went past the deadline of REQUEST_BODY_*,
+	// which cancels the request's context as a client hanging up does.
+	timedOut bool
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		b.timedOut = true
+	}
+	return n, err
+}
+
+// countBody swaps r's body for one that counts what is read from it.
+func countBody(r *http.Request) *countingBody {
+	body := &countingBody{ReadCloser: r.Body}
+	r.Body = body
+	return body
+}
+
+// noteTraffic adds a request's bytes, and its error if status is one, to
+// trafficCounts.
+func noteTraffic(r *http.Request, status int, in, out int64) {
+	route := requestRoute(r)
+	bucket := len(responseSizeBuckets)
+	for i, bound := range responseSizeBuckets {
+		if out <= bound {
+			bucket = i
+			break
+		}
+	}
+	trafficCounts.mu.Lock()
+	defer trafficCounts.mu.Unlock()
+	t, ok := trafficCounts.routes[route]
+	if !ok {
+		t = &types.RouteTraffic{}
+		trafficCounts.routes[route] = t
+	}
+	t.Requests++
+	t.BytesIn += in
+	t.BytesOut += out
+	if status >= 400 {
+		t.Errors++
+	}
+	trafficCounts.bytesIn += in
+	trafficCounts.bytesOut += out
+	trafficCounts.sizes[bucket]++
+	trafficCounts.responses++
+}
+
+// trafficSnapshot copies the counts for /metrics.
+func trafficSnapshot() (in, out int64, routes map[string]types.RouteTraffic) {
+	trafficCounts.mu.Lock()
+	defer trafficCounts.mu.Unlock()
+	routes = make(map[string]types.RouteTraffic, len(trafficCounts.routes))
+	for route, t := range trafficCounts.routes {
+		routes[route] = *t
+	}
+	return trafficCounts.bytesIn, trafficCounts.bytesOut, routes
+}
+
+// responseSizeHistogram copies the response size histogram for the
+// Prometheus output: the responses per bucket, their total size, and
+// their number.
+func responseSizeHistogram() (counts []int64, sum, count int64) {
+	trafficCounts.mu.Lock()
+	defer trafficCounts.mu.Unlock()
+	return append([]int64(nil), trafficCounts.sizes...), trafficCounts.bytesOut, trafficCounts.responses
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+func TestTrafficBytes(t *testing.T) {
+	s := newTestServer(t)
+	report := func() types.MetricsReport {
+		return decodeBody[types.MetricsReport](t, s.do(http.MethodGet, "/metrics", ""))
+	}
+	before := report()
+	logs := captureLog(t)
+
+	// The body is counted as read, whatever Content-Length claims.
+	body := albumJSON(newTestAlbum())
+	req := httptest.NewRequest(http.MethodPost, "/albums", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.ContentLength = 10
+	post := httptest.NewRecorder()
+	s.handler.ServeHTTP(post, req)
+	expectStatus(t, post, http.StatusCreated)
+	created := decodeBody[album](t, post)
+
+	get := s.do(http.MethodGet, "/albums/"+created.ID, "")
+	expectStatus(t, get, http.StatusOK)
+
+	after := report()
+	delta := func(route string) types.RouteTraffic {
+		a, b := after.Traffic[route], before.Traffic[route]
+		return types.RouteTraffic{Requests: a.Requests - b.Requests, BytesIn: a.BytesIn - b.BytesIn, BytesOut: a.BytesOut - b.BytesOut, Errors: a.Errors - b.Errors}
+	}
+	if got, want := delta("/albums"), (types.RouteTraffic{Requests: 1, BytesIn: int64(len(body)), BytesOut: int64(post.Body.Len())}); got != want {
+		t.Errorf("POST /albums traffic %+v, want %+v", got, want)
+	}
+	if got, want := delta(albumRoute), (types.RouteTraffic{Requests: 1, BytesOut: int64(get.Body.Len())}); got != want {
+		t.Errorf("GET %s traffic %+v, want %+v", albumRoute, got, want)
+	}
+	// /metrics itself is left out, so the totals are the two requests'.
+	if in := after.TotalBytesIn - before.TotalBytesIn; in != int64(len(body)) {
+		t.Errorf("totalBytesIn went up %d, want %d", in, len(body))
+	}
+	if out := after.TotalBytesOut - before.TotalBytesOut; out != int64(post.Body.Len()+get.Body.Len()) {
+		t.Errorf("totalBytesOut went up %d, want %d", out, post.Body.Len()+get.Body.Len())
+	}
+
+	logged := logs.take()
+	for _, want := range []string{
+		"POST /albums from 192.0.2.1 -> 201",
+		fmt.Sprintf("(%dB in, %dB out)", len(body), post.Body.Len()),
+		fmt.Sprintf("(0B in, %dB out)", get.Body.Len()),
+	} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("access log %q, want %q", logged, want)
+		}
+	}
+
+	prom := s.do(http.MethodGet, "/metrics?format=prometheus", "").Body.String()
+	if !strings.Contains(prom, "albums_response_size_bytes_bucket{") {
+		t.Errorf("no response size histogram in the Prometheus output")
+	}
+}
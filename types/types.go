@@ -0,0 +1,374 @@
+// Package types holds the JSON shapes of the album service's API, shared by
+// the server and the Go client so the two can't drift apart.
+package types
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/brentmzey/web-service-go/money"
+)
+
+// Album represents data about a record album.
+type Album struct {
+	ID      string       `json:"id"`
+	Title   string       `json:"title"`
+	Artist  string       `json:"artist"`
+	Price   money.Amount `json:"price"`
+	Genre   string       `json:"genre,omitempty"`
+	Slug    string       `json:"slug"`
+	Barcode string       `json:"barcode,omitempty"`
+	Year    int          `json:"year,omitempty"`
+	Tracks  []string     `json:"tracks,omitempty"`
+	// Metadata holds whatever strings an integration wants to keep with
+	// the album, such as a label or catalog number.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Stock is how many copies are left to sell; each sale reported by the
+	// payment provider takes one or more off.
+	Stock int `json:"stock"`
+	// AvailableFrom and AvailableUntil bound when the album is public: the
+	// public listings and lookups leave it out before AvailableFrom, its
+	// street date, and from AvailableUntil on, once it is delisted.
+	AvailableFrom  *time.Time `json:"availableFrom,omitempty"`
+	AvailableUntil *time.Time `json:"availableUntil,omitempty"`
+
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// AlbumInput is the body of a create or update: the fields a client sets.
+// The server assigns the rest.
+type AlbumInput struct {
+	Title   string       `json:"title"`
+	Artist  string       `json:"artist"`
+	Price   money.Amount `json:"price"`
+	Genre   string       `json:"genre"`
+	Barcode string       `json:"barcode"`
+	Year    int          `json:"year"`
+	Tracks  []string     `json:"tracks"`
+	// Metadata replaces the album's metadata as a whole; PATCH merges it
+	// instead.
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	Stock          int               `json:"stock"`
+	AvailableFrom  *time.Time        `json:"availableFrom,omitempty"`
+	AvailableUntil *time.Time        `json:"availableUntil,omitempty"`
+}
+
+// AlbumValidation answers POST /albums/validate for one album. Errors are
+// the problems creating it would fail with, as POST /albums reports them.
+type AlbumValidation struct {
+	Valid  bool      `json:"valid"`
+	Errors []Problem `json:"errors,omitempty"`
+}
+
+// BatchValidation answers POST /albums/validate for a batch, with a result
+// for each album in the order sent. Valid is set when every album is.
+type BatchValidation struct {
+	Valid   bool                    `json:"valid"`
+	Results []AlbumValidationResult `json:"results"`
+}
+
+// AlbumValidationResult is the validation of the album at Index of a batch.
+type AlbumValidationResult struct {
+	Index int `json:"index"`
+	AlbumValidation
+}
+
+// AlbumChange is an entry of the change feed: an album was created,
+// updated, or deleted. A deleted album is only its ID.
+type AlbumChange struct {
+	Seq       int64     `json:"seq"`
+	Op        string    `json:"op"` // "created", "updated", "deleted", or "published"
+	AlbumID   string    `json:"albumId"`
+	ChangedAt time.Time `json:"changedAt"`
+}
+
+// AlbumChanges answers GET /albums/changes: the changes after the since
+// asked for, oldest first, and Head, the seq of the newest change of all.
+// A client is up to date once it has read through Head.
+type AlbumChanges struct {
+	Changes []AlbumChange `json:"changes"`
+	Head    int64         `json:"head"`
+}
+
+// AlbumDiff answers GET /admin/albums/diff: the albums created, updated,
+// and deleted between From and To, counted by op, and a page of them in
+// the order each last changed.
+type AlbumDiff struct {
+	From    time.Time        `json:"from"`
+	To      time.Time        `json:"to"`
+	Created int              `json:"created"`
+	Updated int              `json:"updated"`
+	Deleted int              `json:"deleted"`
+	Albums  []AlbumDiffEntry `json:"albums"`
+	Total   int              `json:"total"`
+	Limit   int              `json:"limit"`
+	Offset  int              `json:"offset"`
+}
+
+// AlbumDiffEntry is what became of one album over a diff's window. Album is
+// the album as it was at the end of it, or when it was deleted; Changes is
+// set on an update, keyed by field.
+type AlbumDiffEntry struct {
+	Op        string                 `json:"op"` // "created", "updated", or "deleted"
+	AlbumID   string                 `json:"albumId"`
+	Album     *Album                 `json:"album"`
+	Changes   map[string]FieldChange `json:"changes,omitempty"`
+	ChangedAt time.Time              `json:"changedAt"`
+}
+
+// FieldChange is a field an update changed: its value before and after.
+type FieldChange struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// AlbumEvent is the body of an album event webhook: a change of the change
+// feed, delivered at least once and in seq order. A redelivery has the same
+// ID, so a receiver can drop the ones it has seen.
+type AlbumEvent struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"` // "album.created", "album.updated", "album.deleted", or "album.published"
+	Seq        int64     `json:"seq"`
+	AlbumID    string    `json:"albumId"`
+	OccurredAt time.Time `json:"occurredAt"`
+	// BestEffort is set when the store doesn't keep its events across a
+	// restart, so that one can be lost to a crash.
+	BestEffort bool `json:"bestEffort,omitempty"`
+}
+
+// SearchRequest is the body of POST /albums/search. A nil Query matches
+// every album.
+type SearchRequest struct {
+	Query  *SearchQuery `json:"query,omitempty"`
+	Sort   []SearchSort `json:"sort,omitempty"`
+	Limit  int          `json:"limit,omitempty"`
+	Offset int          `json:"offset,omitempty"`
+}
+
+// SearchQuery is a node of a search: exactly one of And, Or, Not, or a
+// condition (Field, Op, and Value) is set.
+type SearchQuery struct {
+	And []SearchQuery `json:"and,omitempty"`
+	Or  []SearchQuery `json:"or,omitempty"`
+	Not *SearchQuery  `json:"not,omitempty"`
+
+	Field string `json:"field,omitempty"`
+	// Op is eq, ne, gt, lt, or contains.
+	Op string `json:"op,omitempty"`
+	// Value is a string for text fields, a number for price and year, and
+	// an RFC 3339 timestamp for createdAt and updatedAt.
+	Value interface{} `json:"value,omitempty"`
+}
+
+// SearchSort orders search results by Field, ascending unless Order is
+// "desc".
+type SearchSort struct {
+	Field string `json:"field"`
+	Order string `json:"order,omitempty"`
+}
+
+// SearchResult is the answer to POST /albums/search: one page of the
+// matching albums, and how many match across every page.
+type SearchResult struct {
+	Albums []Album `json:"albums"`
+	Total  int     `json:"total"`
+	Limit  int     `json:"limit"`
+	Offset int     `json:"offset"`
+}
+
+// SavedSearch is a named search kept by POST /searches, to run again with
+// GET /searches/{id}/results. Exactly one of Search and Params is set.
+type SavedSearch struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Owner string `json:"owner"`
+	// Shared lets anyone who has the ID run the search; only its owner may
+	// run a private one.
+	Shared bool `json:"shared"`
+	// Search is a POST /albums/search body, such as a SearchRequest,
+	// without limit and offset. It is kept as it was sent.
+	Search json.RawMessage `json:"search,omitempty"`
+	// Params are filter parameters of GET /albums, such as artist and
+	// minPrice.
+	Params    map[string]string `json:"params,omitempty"`
+	CreatedAt time.Time         `json:"createdAt"`
+}
+
+// MetricsReport is the body of GET /metrics.
+type MetricsReport struct {
+	TotalRequests               int64                   `json:"totalRequests"`
+	TotalErrors                 int64                   `json:"totalErrors"`
+	TotalAlbumsFetched          int64                   `json:"totalAlbumsFetched"`
+	TotalAlbumsAdded            int64                   `json:"totalAlbumsAdded"`
+	TotalRateLimited            int64                   `json:"totalRateLimited"`
+	AverageLatencyMs            int64                   `json:"averageLatencyMs"`
+	InFlightRequests            int64                   `json:"inFlightRequests"`
+	TotalOverloadShed           int64                   `json:"totalOverloadShed"`
+	ClientClosedRequests        int64                   `json:"clientClosedRequests"`
+	TotalBodyTimeouts           int64                   `json:"totalBodyTimeouts"`
+	TotalBodyTooLarge           int64                   `json:"totalBodyTooLarge"`
+	CircuitBreakers             map[string]string       `json:"circuitBreakers"`
+	TotalStoreRetries           int64                   `json:"totalStoreRetries"`
+	TotalSecondaryWriteFailures int64                   `json:"totalSecondaryWriteFailures"`
+	TotalNegativeCacheHits      int64                   `json:"totalNegativeCacheHits"`
+	MaintenanceMode             string                  `json:"maintenanceMode"`
+	SlowRequests                map[string]int64        `json:"slowRequests"`
+	TotalBytesIn                int64                   `json:"totalBytesIn"`
+	TotalBytesOut               int64                   `json:"totalBytesOut"`
+	Traffic                     map[string]RouteTraffic `json:"traffic"`
+	TotalBackupFailures         int64                   `json:"totalBackupFailures"`
+	TotalMetricsSamplesDropped  int64                   `json:"totalMetricsSamplesDropped"`
+	RateLimitClients            int                     `json:"rateLimitClients"`
+	RateLimitedLastMinute       int64                   `json:"rateLimitedLastMinute"`
+	StoreCalls                  []StoreCalls            `json:"storeCalls"`
+	ConnectionPools             map[string]PoolStats    `json:"connectionPools,omitempty"`
+	ReadHedging                 map[string]HedgeStats   `json:"readHedging,omitempty"`
+	Build                       VersionInfo             `json:"build"`
+	Instance                    string                  `json:"instance"`
+	Environment                 string                  `json:"environment"`
+}
+
+// RouteTraffic is a route's entry under traffic in /metrics: its requests,
+// the bytes read from their bodies and written in their responses, and how
+// many were answered with an error status.
+type RouteTraffic struct {
+	Requests int64 `json:"requests"`
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+	Errors   int64 `json:"errors"`
+}
+
+// StoreCalls is an entry under storeCalls in /metrics: the calls this
+// instance made of one store operation on one backend. Errors leave out
+// domain outcomes such as a missing album or a conflict.
+type StoreCalls struct {
+	Backend          string  `json:"backend"`
+	Operation        string  `json:"operation"`
+	Calls            int64   `json:"calls"`
+	Errors           int64   `json:"errors"`
+	AverageLatencyMs float64 `json:"averageLatencyMs"`
+}
+
+// PoolStats is an entry under connectionPools in /metrics: the state of a
+// backend's database connection pool, and its acquires since startup.
+type PoolStats struct {
+	MaxConns             int32   `json:"maxConns"`
+	TotalConns           int32   `json:"totalConns"`
+	AcquiredConns        int32   `json:"acquiredConns"`
+	IdleConns            int32   `json:"idleConns"`
+	ConstructingConns    int32   `json:"constructingConns"`
+	AcquireCount         int64   `json:"acquireCount"`
+	EmptyAcquireCount    int64   `json:"emptyAcquireCount"`
+	CanceledAcquireCount int64   `json:"canceledAcquireCount"`
+	AcquireDurationMs    float64 `json:"acquireDurationMs"`
+}
+
+// HedgeStats is an entry under readHedging in /metrics: the reads a backend
+// sent twice because the first was slow, how many the second answered, and
+// how many slow reads went without one as the hedge budget was spent.
+type HedgeStats struct {
+	Hedged  int64 `json:"hedged"`
+	Wins    int64 `json:"wins"`
+	Skipped int64 `json:"skipped"`
+}
+
+// VersionInfo is the body of GET /version: which build is running, and
+// against which backend.
+type VersionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+	DBType    string `json:"dbType"`
+}
+
+// Usage is the body of GET /me/usage: the caller's quota tier and how much
+// of the hourly quota is left, the monthly quota if the tier has one, and
+// the catalog's size if it is limited.
+type Usage struct {
+	Tier      string        `json:"tier"`
+	Limit     int           `json:"limit"`
+	Used      int           `json:"used"`
+	Remaining int           `json:"remaining"`
+	ResetsAt  time.Time     `json:"resetsAt"`
+	Monthly   *MonthlyUsage `json:"monthly,omitempty"`
+	Catalog   *CatalogUsage `json:"catalog,omitempty"`
+}
+
+// MonthlyUsage is how much of the monthly quota a caller has used in the
+// calendar month, in UTC, like "2024-05".
+type MonthlyUsage struct {
+	Month     string    `json:"month"`
+	Limit     int       `json:"limit"`
+	Used      int       `json:"used"`
+	Remaining int       `json:"remaining"`
+	ResetsAt  time.Time `json:"resetsAt"`
+}
+
+// CatalogUsage is how many albums the catalog holds out of its limit.
+type CatalogUsage struct {
+	Albums    int `json:"albums"`
+	Limit     int `json:"limit"`
+	Remaining int `json:"remaining"`
+}
+
+// APIKey is an API key as listed by GET /admin/apikeys. Secret is only set
+// in the answer to the POST that created the key.
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Tier       string     `json:"tier"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	LastUsedAt *time.Time `json:"lastUsedAt,omitempty"`
+	Revoked    bool       `json:"revoked"`
+	RevokedAt  *time.Time `json:"revokedAt,omitempty"`
+	Secret     string     `json:"secret,omitempty"`
+}
+
+// ProblemCatalogFull is the problem type of the 403 answering a create that
+// would take the catalog past its album limit.
+const ProblemCatalogFull = "urn:web-service-go:problem:catalog-full"
+
+// ProblemInvalidSearch is the problem type of the 400 answering a search
+// body that doesn't parse as a query.
+const ProblemInvalidSearch = "urn:web-service-go:problem:invalid-search"
+
+// ProblemStaleSearch is the problem type of the 409 answering a saved
+// search that no longer parses, as when a field it uses was removed.
+const ProblemStaleSearch = "urn:web-service-go:problem:stale-search"
+
+// ProblemHistoryTrimmed is the problem type of the 410 answering a catalog
+// diff whose window starts before the oldest change kept.
+const ProblemHistoryTrimmed = "urn:web-service-go:problem:history-trimmed"
+
+// ProblemQuotaExhausted is the problem type of the 429 answering a request
+// past its caller's monthly quota.
+const ProblemQuotaExhausted = "urn:web-service-go:problem:quota-exhausted"
+
+// Problem is an RFC 7807 problem details body, sent with every error.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// Limit and Count are set on a catalog-full problem: the most albums
+	// the catalog may hold, and how many it holds. On a quota-exhausted
+	// problem they are the monthly quota and the requests counted in it.
+	Limit int `json:"limit,omitempty"`
+	Count int `json:"count,omitempty"`
+	// Pointer is set on an invalid-search problem: a JSON Pointer (RFC
+	// 6901) to the part of the body at fault, such as /query/and/1/op. On
+	// a stale-search problem it points into the saved search.
+	Pointer string `json:"pointer,omitempty"`
+	// Earliest is set on a history-trimmed problem: the earliest from a
+	// catalog diff can start at.
+	Earliest *time.Time `json:"earliest,omitempty"`
+	// Suggestion is set on the 404 of a request matching no route: the
+	// path of the nearest route, when one is close.
+	Suggestion string `json:"suggestion,omitempty"`
+	// ResetsAt is set on a quota-exhausted problem: when the next month,
+	// and its quota, starts.
+	ResetsAt *time.Time `json:"resetsAt,omitempty"`
+}
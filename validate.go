@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+// postAlbumsValidate checks the body of a create, one album or a batch, as
+// POST /albums would, without creating anything. It answers 200 either way,
+// with the problems each album would fail with. Only a body that isn't JSON,
+// a batch POST /albums would refuse as a whole, or a store that can't be
+// asked about barcodes gets an error status.
+func postAlbumsValidate(w http.ResponseWriter, r *http.Request) {
+	var body json.RawMessage
+	if err := decodeAlbumJSON(r.Body, &body); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	if !isJSONArray(body) {
+		problems, err := validateNewAlbum(r, body, nil)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		writeValidation(w, r, albumValidation(r, problems))
+		return
+	}
+
+	var items []json.RawMessage
+	if err := json.Unmarshal(body, &items); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	if err := checkBatchSize(len(items)); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		log.Println("📉 Bad request:", err)
+		return
+	}
+	report := types.BatchValidation{Valid: true, Results: make([]types.AlbumValidationResult, len(items))}
+	barcodes := map[string]bool{}
+	for i, item := range items {
+		problems, err := validateNewAlbum(r, item, barcodes)
+		if err != nil {
+			respondError(w, r, err)
+			return
+		}
+		report.Results[i] = types.AlbumValidationResult{Index: i, AlbumValidation: albumValidation(r, problems)}
+		report.Valid = report.Valid && report.Results[i].Valid
+	}
+	writeValidation(w, r, report)
+}
+
+// validateNewAlbum lists the problems creating the album in data would
+// fail with: a body that doesn't decode, the checks of validate, and a
+// barcode another album, or an earlier album of the batch, already has.
+// batch holds the barcodes seen so far in a batch, and is nil for a single
+// album. The error is a store failure that kept the barcode from being
+// checked.
+func validateNewAlbum(r *http.Request, data json.RawMessage, batch map[string]bool) ([]problem, error) {
+	var in albumInput
+	if err := json.Unmarshal(data, &in); err != nil {
+		return []problem{statusProblem(http.StatusBadRequest, err.Error())}, nil
+	}
+	var problems []problem
+	for _, err := range in.validationErrors() {
+		problems = append(problems, errorProblem(r, err))
+	}
+	if in.Barcode == "" || !validBarcode(in.Barcode) {
+		return problems, nil
+	}
+	taken := batch[in.Barcode]
+	if !taken {
+		_, err := albumStore.GetByBarcode(r.Context(), in.Barcode)
+		if err != nil && !errors.Is(err, errNotFound) {
+			return nil, err
+		}
+		taken = err == nil
+	}
+	if taken {
+		problems = append(problems, errorProblem(r, errBarcodeTaken))
+	}
+	if batch != nil {
+		batch[in.Barcode] = true
+	}
+	return problems, nil
+}
+
+// albumValidation reports problems in the language the request asks for.
+func albumValidation(r *http.Request, problems []problem) types.AlbumValidation {
+	for i := range problems {
+		problems[i].Detail, _ = translate(r, problems[i].Detail)
+	}
+	return types.AlbumValidation{Valid: len(problems) == 0, Errors: problems}
+}
+
+// writeValidation answers with a validation report, whose details are in
+// the language the request asks for.
+func writeValidation(w http.ResponseWriter, r *http.Request, report interface{}) {
+	w.Header().Set("Content-Language", negotiateLanguage(r.Header.Get("Accept-Language")))
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, report)
+}
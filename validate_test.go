@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/brentmzey/web-service-go/types"
+)
+
+func TestValidateMatchesCreate(t *testing.T) {
+	s := newTestServer(t)
+	s.create(newTestAlbum(withBarcode("036000291452")))
+	added := atomic.LoadInt64(&metrics.TotalAlbumsAdded)
+
+	for _, tc := range []struct {
+		name string
+		body string
+		lang string
+	}{
+		{"bad check digit", albumJSON(newTestAlbum(withBarcode("036000291453"))), ""},
+		{"barcode taken", albumJSON(newTestAlbum(withBarcode("036000291452"))), ""},
+		{"reserved metadata key", albumJSON(newTestAlbum(func(a *album) { a.Metadata = map[string]string{"wsg_id": "1"} })), ""},
+		{"negative stock", albumJSON(newTestAlbum(func(a *album) { a.Stock = -1 })), ""},
+		{"window backwards", `{"title": "Blue Train", "artist": "John Coltrane", "price": 56.99, "availableFrom": "2026-04-01T00:00:00Z", "availableUntil": "2026-03-01T00:00:00Z"}`, ""},
+		{"price not a number", `{"title": "Blue Train", "artist": "John Coltrane", "price": "cheap"}`, ""},
+		{"bad check digit in French", albumJSON(newTestAlbum(withBarcode("036000291453"))), "fr"},
+	} {
+		created := s.do(http.MethodPost, "/albums", tc.body, "Accept-Language", tc.lang)
+		if created.Code < 400 {
+			t.Fatalf("%s: POST /albums = %d", tc.name, created.Code)
+		}
+		want := decodeBody[types.Problem](t, created)
+		report := decodeBody[types.AlbumValidation](t, s.do(http.MethodPost, "/albums/validate", tc.body, "Accept-Language", tc.lang))
+		if report.Valid || len(report.Errors) != 1 {
+			t.Errorf("%s: validation %+v, want the one problem of POST /albums", tc.name, report)
+			continue
+		}
+		// The instance is the path each was sent to.
+		got := report.Errors[0]
+		got.Instance, want.Instance = "", ""
+		if got != want {
+			t.Errorf("%s: /albums/validate reported\n%+v\nwhere POST /albums answered\n%+v", tc.name, got, want)
+		}
+	}
+
+	if report := decodeBody[types.AlbumValidation](t, s.do(http.MethodPost, "/albums/validate", albumJSON(newTestAlbum()))); !report.Valid || len(report.Errors) != 0 {
+		t.Errorf("a good album: %+v", report)
+	}
+	if n := atomic.LoadInt64(&metrics.TotalAlbumsAdded) - added; n != 0 {
+		t.Errorf("validation counted %d albums added", n)
+	}
+	if n := len(s.albums.byID); n != 1 {
+		t.Errorf("%d albums after validating, want the one created first", n)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	s := newTestServer(t)
+	bad := newTestAlbum(withBarcode("036000291453"), func(a *album) { a.Stock = -2 })
+	report := decodeBody[types.AlbumValidation](t, s.do(http.MethodPost, "/albums/validate", albumJSON(bad)))
+	if len(report.Errors) != 2 || report.Errors[0].Detail != errInvalidBarcode.Error() || report.Errors[1].Detail != errNegativeStock.Error() {
+		t.Errorf("validation %+v, want the barcode and the stock", report)
+	}
+	// POST /albums stops at the first.
+	if p := expectProblem(t, s.do(http.MethodPost, "/albums", albumJSON(bad)), http.StatusUnprocessableEntity); p.Detail != errInvalidBarcode.Error() {
+		t.Errorf("POST /albums: %q", p.Detail)
+	}
+}
+
+func TestValidateBatch(t *testing.T) {
+	s := newTestServer(t)
+	batch := "[" + strings.Join([]string{
+		albumJSON(newTestAlbum(withBarcode("036000291452"))),
+		albumJSON(newTestAlbum(withTitle("Giant Steps"))),
+		// The same barcode as the first album of the batch.
+		albumJSON(newTestAlbum(withTitle("Lush Life"), withBarcode("036000291452"))),
+		`{"title": 7}`,
+	}, ",") + "]"
+	report := decodeBody[types.BatchValidation](t, s.do(http.MethodPost, "/albums/validate", batch))
+	if report.Valid || len(report.Results) != 4 {
+		t.Fatalf("batch validation %+v", report)
+	}
+	for i, valid := range []bool{true, true, false, false} {
+		if r := report.Results[i]; r.Index != i || r.Valid != valid {
+			t.Errorf("result %d = %+v, want valid %t", i, r, valid)
+		}
+	}
+	if p := report.Results[2].Errors; len(p) != 1 || p[0].Detail != errBarcodeTaken.Error() || p[0].Status != http.StatusConflict {
+		t.Errorf("the repeated barcode: %+v", p)
+	}
+	if p := report.Results[3].Errors; len(p) != 1 || p[0].Status != http.StatusBadRequest {
+		t.Errorf("the album that doesn't decode: %+v", p)
+	}
+	if n := len(s.albums.byID); n != 0 {
+		t.Errorf("validating created %d albums", n)
+	}
+	expectProblem(t, s.do(http.MethodPost, "/albums/validate", "["+strings.Repeat(albumJSON(newTestAlbum())+",", maxBatchAlbums)+albumJSON(newTestAlbum())+"]"), http.StatusBadRequest)
+}
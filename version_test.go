@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/brentmzey/web-service-go/internal/buildinfo"
+	"github.com/brentmzey/web-service-go/types"
+)
+
+func TestVersion(t *testing.T) {
+	s := newTestServer(t)
+	w := s.do(http.MethodGet, "/version", "")
+	expectStatus(t, w, http.StatusOK)
+	var fields map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	if want := []string{"buildDate", "commit", "dbType", "goVersion", "version"}; !slices.Equal(keys, want) {
+		t.Errorf("GET /version has %v, want %v", keys, want)
+	}
+	// A test binary has no -ldflags and no VCS stamp.
+	want := types.VersionInfo{Version: buildinfo.Unknown, Commit: buildinfo.Unknown, BuildDate: buildinfo.Unknown, GoVersion: runtime.Version(), DBType: "memory"}
+	if got := decodeBody[types.VersionInfo](t, w); got != want {
+		t.Errorf("GET /version = %+v, want %+v", got, want)
+	}
+}
+
+func TestVersionFromLdflags(t *testing.T) {
+	s := newTestServer(t)
+	previous := buildinfo.Version
+	t.Cleanup(func() { buildinfo.Version = previous })
+	buildinfo.Version = "v1.4.0"
+
+	if got := decodeBody[types.VersionInfo](t, s.do(http.MethodGet, "/version", "")); got.Version != "v1.4.0" || got.Commit != buildinfo.Unknown {
+		t.Errorf("GET /version = %+v, want v1.4.0 and the rest unknown", got)
+	}
+	// /metrics reports the same build.
+	if report := decodeBody[types.MetricsReport](t, s.do(http.MethodGet, "/metrics", "")); report.Build != versionInfo() {
+		t.Errorf("/metrics build = %+v, want %+v", report.Build, versionInfo())
+	}
+	w := s.do(http.MethodGet, "/metrics?format=prometheus", "")
+	if want := `,version="v1.4.0",commit="` + buildinfo.Unknown + `",db_type="memory"} 1`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("the Prometheus metrics have no %s:\n%s", want, w.Body)
+	}
+}
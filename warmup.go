@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const defaultWarmupTimeout = 30 * time.Second
+
+// warmingUp is set while the warm-up runs; until it is done, or out of
+// time, /readyz reports 503.
+var warmingUp atomic.Bool
+
+// warmer is a request the warm-up makes to fill a cache, as the first
+// client to make it otherwise would.
+type warmer struct {
+	name string
+	path string
+}
+
+// warmers lists what the warm-up requests, from what is turned on: the
+// first page of GET /albums, which the in-memory store caches marshaled
+// and which opens the database connections otherwise; GET /albums/stats
+// with the stats feature and STATS_CACHE_TTL; and every other route in
+// RESPONSE_CACHE_ROUTES.
+func warmers(cfg *Config) []warmer {
+	list := []warmer{{name: "album list", path: "/albums"}}
+	if features.Enabled("stats") && cfg.StatsCacheTTL > 0 {
+		list = append(list, warmer{name: "album stats", path: "/albums/stats"})
+	}
+	routes, _ := parseResponseCacheRoutes(cfg.ResponseCacheRoutes)
+	paths := make([]string, 0, len(routes))
+	for path := range routes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if !slices.ContainsFunc(list, func(w warmer) bool { return w.path == path }) {
+			list = append(list, warmer{name: "response cache", path: path})
+		}
+	}
+	return list
+}
+
+// startWarmup runs the warm-up in the background with WARMUP_ENABLED. It is
+// called once the stores are connected and seeded, and before storesReady
+// is set, so /readyz goes from the one 503 to the other.
+func startWarmup(ctx context.Context, cfg *Config) {
+	if !cfg.WarmupEnabled {
+		return
+	}
+	warmingUp.Store(true)
+	go warmUp(ctx, cfg.WarmupTimeout, responseCacheMiddleware(newAPIRoutes(cfg)), warmers(cfg))
+}
+
+// warmUp sends the requests of list to h, one at a time, and clears
+// warmingUp once they are done or timeout has passed, whichever is first.
+// A request that fails is logged and the rest still made; one still
+// running when the time is up is cancelled.
+func warmUp(ctx context.Context, timeout time.Duration, h http.Handler, list []warmer) {
+	defer warmingUp.Store(false)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, w := range list {
+			if ctx.Err() != nil {
+				return
+			}
+			w.warm(ctx, h)
+		}
+	}()
+	select {
+	case <-done:
+		log.Printf("🌡️ Warmed up %d cache(s) in %s", len(list), time.Since(start).Round(time.Millisecond))
+	case <-ctx.Done():
+		log.Printf("⚠️ The warm-up didn't finish within WARMUP_TIMEOUT (%s); reporting ready anyway", timeout)
+	}
+}
+
+func (w warmer) warm(ctx context.Context, h http.Handler) {
+	start := time.Now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, w.path, nil)
+	if err != nil {
+		log.Printf("⚠️ Warm-up of the %s: %v", w.name, err)
+		return
+	}
+	req.RemoteAddr = "127.0.0.1:0"
+	rec := &warmupWriter{header: http.Header{}}
+	h.ServeHTTP(rec, req)
+	if rec.status != 0 && rec.status != http.StatusOK {
+		log.Printf("⚠️ Warm-up of the %s: GET %s answered %d", w.name, w.path, rec.status)
+		return
+	}
+	debugf("Warmed up the %s with GET %s in %s", w.name, w.path, time.Since(start))
+}
+
+// warmupWriter keeps the status of a warm-up request and drops its body.
+type warmupWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *warmupWriter) Header() http.Header { return w.header }
+
+func (w *warmupWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+}
+
+func (w *warmupWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWarmers(t *testing.T) {
+	s := newTestServer(t)
+	paths := func(configure func(*Config)) string {
+		cfg := *s.cfg
+		cfg.Features = defaultFeatures()
+		configure(&cfg)
+		liveConfig.Store(&cfg)
+		var out []string
+		for _, w := range warmers(&cfg) {
+			out = append(out, w.path)
+		}
+		return strings.Join(out, " ")
+	}
+	for _, tc := range []struct {
+		name      string
+		configure func(*Config)
+		want      string
+	}{
+		{"by default", func(*Config) {}, "/albums /albums/stats"},
+		{"without the stats cache", func(cfg *Config) { cfg.StatsCacheTTL = 0 }, "/albums"},
+		{"without the stats feature", func(cfg *Config) { cfg.Features["stats"] = false }, "/albums"},
+		// A route already warmed isn't warmed twice.
+		{"with cached routes", func(cfg *Config) { cfg.ResponseCacheRoutes = "/genres=30s,/albums/stats=1m,/artists=1m" }, "/albums /albums/stats /artists /genres"},
+	} {
+		if got := paths(tc.configure); got != tc.want {
+			t.Errorf("%s: %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+// gatedHandler answers each request once the test lets it, telling the
+// test the path of each as it arrives.
+type gatedHandler struct {
+	arrived chan string
+	release chan struct{}
+}
+
+func newGatedHandler() *gatedHandler {
+	return &gatedHandler{arrived: make(chan string), release: make(chan struct{})}
+}
+
+func (h *gatedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.arrived <- r.URL.Path
+	select {
+	case <-h.release:
+	case <-r.Context().Done():
+		return
+	}
+	if r.URL.Path == "/genres" {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (h *gatedHandler) expect(t *testing.T, path string) {
+	t.Helper()
+	select {
+	case got := <-h.arrived:
+		if got != path {
+			t.Fatalf("warmed %s, want %s", got, path)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s was never warmed", path)
+	}
+}
+
+// useWarmup makes warmingUp t's own.
+func useWarmup(t *testing.T) {
+	t.Cleanup(func() { warmingUp.Store(false) })
+}
+
+func TestWarmupReadiness(t *testing.T) {
+	s := newTestServer(t)
+	useWarmup(t)
+	logs := captureLog(t)
+	readiness := func() string {
+		t.Helper()
+		return fmt.Sprint(decodeBody[map[string]string](t, s.do(http.MethodGet, "/readyz", ""))["message"])
+	}
+
+	// Until the stores connect, that is what readiness waits on; then it
+	// waits on the warm-up, which starts before storesReady is set.
+	storesReady.Store(false)
+	if got := readiness(); got != "stores are still connecting" {
+		t.Errorf("before the stores connect: %q", got)
+	}
+	h := newGatedHandler()
+	warmingUp.Store(true)
+	storesReady.Store(true)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		warmUp(context.Background(), time.Minute, h, []warmer{{"album list", "/albums"}, {"response cache", "/genres"}, {"album stats", "/albums/stats"}})
+	}()
+
+	for _, path := range []string{"/albums", "/genres", "/albums/stats"} {
+		h.expect(t, path)
+		if got := readiness(); got != "caches are warming up" {
+			t.Errorf("while warming %s: %q", path, got)
+		}
+		h.release <- struct{}{}
+	}
+	<-done
+	expectStatus(t, s.do(http.MethodGet, "/readyz", ""), http.StatusOK)
+
+	// A warmer that fails is logged, and the rest still run.
+	log := logs.take()
+	for _, want := range []string{"Warm-up of the response cache: GET /genres answered 500", "Warmed up 3 cache(s)"} {
+		if !strings.Contains(log, want) {
+			t.Errorf("the log has no %q:\n%s", want, log)
+		}
+	}
+}
+
+func TestWarmupTimeout(t *testing.T) {
+	s := newTestServer(t)
+	useWarmup(t)
+	logs := captureLog(t)
+	h := newGatedHandler()
+	warmingUp.Store(true)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		warmUp(context.Background(), 50*time.Millisecond, h, []warmer{{"album list", "/albums"}, {"album stats", "/albums/stats"}})
+	}()
+
+	// The first warmer never finishes: the time runs out on it, it is
+	// cancelled, and the second never runs.
+	h.expect(t, "/albums")
+	expectStatus(t, s.do(http.MethodGet, "/readyz", ""), http.StatusServiceUnavailable)
+	select {
+	case <-done:
+	case path := <-h.arrived:
+		t.Fatalf("warmed %s after the timeout", path)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the warm-up outlasted its timeout")
+	}
+	expectStatus(t, s.do(http.MethodGet, "/readyz", ""), http.StatusOK)
+	if log := logs.take(); !strings.Contains(log, "The warm-up didn't finish within WARMUP_TIMEOUT (50ms); reporting ready anyway") {
+		t.Errorf("the log has no timeout warning:\n%s", log)
+	}
+}
+
+func TestWarmupPrimesCaches(t *testing.T) {
+	s := newTestServer(t, func(cfg *Config) {
+		cfg.ResponseCacheRoutes = "/albums/stats=1m"
+		cfg.StatsCacheTTL = 0
+	})
+	store := &countingStatsStore{InMemoryAlbumStore: s.albums}
+	albumStore = store
+	s.create(newTestAlbum())
+	useWarmup(t)
+
+	warmingUp.Store(true)
+	warmUp(context.Background(), time.Minute, responseCacheMiddleware(newAPIRoutes(s.cfg)), warmers(s.cfg))
+	if warmingUp.Load() {
+		t.Error("still warming up after the warm-up")
+	}
+	w := s.do(http.MethodGet, "/albums/stats", "")
+	if got := w.Header().Get("X-Cache"); got != "HIT" || store.aggregations.Load() != 1 {
+		t.Errorf("the first client's stats: X-Cache %q after %d aggregations, want the warm-up's", got, store.aggregations.Load())
+	}
+}
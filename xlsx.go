@@ -0,0 +1,209 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// xlsxWriter streams a single-sheet Office Open XML workbook. Rows are encoded
+// straight into the zip entry as they are written, so memory use doesn't grow
+// with the number of rows. The header row is bold, frozen, and carries an
+// auto-filter over the full data range.
+type xlsxWriter struct {
+	zw        *zip.Writer
+	sheet     *bufio.Writer
+	sheetName string
+	cols      int
+	rows      int
+}
+
+// xlsxCell is one typed spreadsheet cell.
+type xlsxCell struct {
+	kind  int
+	str   string
+	num   float64
+	valid bool
+}
+
+const (
+	xlsxKindString = iota
+	xlsxKindNumber
+	xlsxKindCurrency
+	xlsxKindDateTime
+)
+
+// Indexes into cellXfs in xlsxStyles.
+const (
+	xlsxStyleDefault  = 0
+	xlsxStyleHeader   = 1
+	xlsxStyleCurrency = 2
+	xlsxStyleDateTime = 3
+)
+
+func xlsxString(s string) xlsxCell    { return xlsxCell{kind: xlsxKindString, str: s, valid: true} }
+func xlsxNumber(n float64) xlsxCell   { return xlsxCell{kind: xlsxKindNumber, num: n, valid: true} }
+func xlsxCurrency(n float64) xlsxCell { return xlsxCell{kind: xlsxKindCurrency, num: n, valid: true} }
+
+// xlsxDateTime converts t to an Excel serial date; the zero time becomes an
+// empty cell.
+func xlsxDateTime(t time.Time) xlsxCell {
+	if t.IsZero() {
+		return xlsxCell{}
+	}
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	return xlsxCell{kind: xlsxKindDateTime, num: t.UTC().Sub(epoch).Hours() / 24, valid: true}
+}
+
+func newXLSXWriter(w io.Writer, sheetName string, header []string) (*xlsxWriter, error) {
+	x := &xlsxWriter{zw: zip.NewWriter(w), sheetName: sheetName, cols: len(header)}
+	for _, part := range []struct{ name, body string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRootRels},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+		{"xl/styles.xml", xlsxStyles},
+	} {
+		if err := x.writePart(part.name, part.body); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := x.zw.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	x.sheet = bufio.NewWriter(f)
+	x.sheet.WriteString(xml.Header)
+	x.sheet.WriteString(`<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">`)
+	x.sheet.WriteString(`<sheetViews><sheetView workbookViewId="0"><pane ySplit="1" topLeftCell="A2" activePane="bottomLeft" state="frozen"/></sheetView></sheetViews>`)
+	x.sheet.WriteString(`<sheetData>`)
+
+	cells := make([]xlsxCell, len(header))
+	for i, h := range header {
+		cells[i] = xlsxString(h)
+	}
+	if err := x.writeRow(cells, xlsxStyleHeader); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+func (x *xlsxWriter) writePart(name, body string) error {
+	f, err := x.zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(f, body)
+	return err
+}
+
+// WriteRow appends a data row. Cells beyond the header width are ignored.
+func (x *xlsxWriter) WriteRow(cells ...xlsxCell) error {
+	return x.writeRow(cells, -1)
+}
+
+func (x *xlsxWriter) writeRow(cells []xlsxCell, style int) error {
+	x.rows++
+	fmt.Fprintf(x.sheet, `<row r="%d">`, x.rows)
+	for i, c := range cells {
+		if i >= x.cols || !c.valid {
+			continue
+		}
+		ref := xlsxColumn(i) + strconv.Itoa(x.rows)
+		s := style
+		if s < 0 {
+			switch c.kind {
+			case xlsxKindCurrency:
+				s = xlsxStyleCurrency
+			case xlsxKindDateTime:
+				s = xlsxStyleDateTime
+			default:
+				s = xlsxStyleDefault
+			}
+		}
+		if c.kind == xlsxKindString {
+			fmt.Fprintf(x.sheet, `<c r="%s" s="%d" t="inlineStr"><is><t xml:space="preserve">`, ref, s)
+			xml.EscapeText(x.sheet, []byte(c.str))
+			x.sheet.WriteString(`</t></is></c>`)
+			continue
+		}
+		fmt.Fprintf(x.sheet, `<c r="%s" s="%d"><v>%s</v></c>`, ref, s, strconv.FormatFloat(c.num, 'f', -1, 64))
+	}
+	_, err := x.sheet.WriteString(`</row>`)
+	return err
+}
+
+// Close finishes the sheet, writes the workbook part (which needs the final
+// row count for the filter range), and flushes the archive.
+func (x *xlsxWriter) Close() error {
+	dataRange := fmt.Sprintf("A1:%s%d", xlsxColumn(x.cols-1), x.rows)
+	fmt.Fprintf(x.sheet, `</sheetData><autoFilter ref="%s"/></worksheet>`, dataRange)
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+
+	name := xmlEscape(x.sheetName)
+	absRange := fmt.Sprintf("$A$1:$%s$%d", xlsxColumn(x.cols-1), x.rows)
+	workbook := xml.Header +
+		`<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+		`<sheets><sheet name="` + name + `" sheetId="1" r:id="rId1"/></sheets>` +
+		`<definedNames><definedName name="_xlnm._FilterDatabase" localSheetId="0" hidden="1">'` + name + `'!` + absRange + `</definedName></definedNames>` +
+		`</workbook>`
+	if err := x.writePart("xl/workbook.xml", workbook); err != nil {
+		return err
+	}
+	return x.zw.Close()
+}
+
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// xlsxColumn converts a zero-based column index to its letter name (A, B, ... AA).
+func xlsxColumn(i int) string {
+	name := ""
+	for i++; i > 0; i = (i - 1) / 26 {
+		name = string(rune('A'+(i-1)%26)) + name
+	}
+	return name
+}
+
+const xlsxContentTypes = xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+	`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+	`<Default Extension="xml" ContentType="application/xml"/>` +
+	`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+	`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+	`<Override PartName="/xl/styles.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.styles+xml"/>` +
+	`</Types>`
+
+const xlsxRootRels = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+	`</Relationships>`
+
+const xlsxWorkbookRels = xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+	`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+	`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/styles" Target="styles.xml"/>` +
+	`</Relationships>`
+
+// xlsxStyles defines the cellXfs referenced by the xlsxStyle* constants:
+// default, bold header, US-dollar currency, and date-time.
+const xlsxStyles = xml.Header + `<styleSheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">` +
+	`<numFmts count="1"><numFmt numFmtId="164" formatCode="&quot;$&quot;#,##0.00"/></numFmts>` +
+	`<fonts count="2"><font><sz val="11"/><name val="Calibri"/></font><font><b/><sz val="11"/><name val="Calibri"/></font></fonts>` +
+	`<fills count="2"><fill><patternFill patternType="none"/></fill><fill><patternFill patternType="gray125"/></fill></fills>` +
+	`<borders count="1"><border><left/><right/><top/><bottom/><diagonal/></border></borders>` +
+	`<cellStyleXfs count="1"><xf numFmtId="0" fontId="0" fillId="0" borderId="0"/></cellStyleXfs>` +
+	`<cellXfs count="4">` +
+	`<xf numFmtId="0" fontId="0" fillId="0" borderId="0" xfId="0"/>` +
+	`<xf numFmtId="0" fontId="1" fillId="0" borderId="0" xfId="0" applyFont="1"/>` +
+	`<xf numFmtId="164" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`<xf numFmtId="22" fontId="0" fillId="0" borderId="0" xfId="0" applyNumberFormat="1"/>` +
+	`</cellXfs>` +
+	`</styleSheet>`